@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/datatogether/core"
+	"time"
 )
 
 // ClientReqActions is a list of all actions a client may request
@@ -35,12 +36,64 @@ var ClientReqActions = []ClientAction{
 	SaveCollectionAction{},
 	DeleteCollectionAction{},
 	MetadataByKeyRequest{},
+	SuggestMetadataAction{},
+	SubjectSubscribeAction{},
+	SubjectUnsubscribeAction{},
+	EditStartAction{},
+	EditHeartbeatAction{},
+	EditStopAction{},
+	FetchConfigSnapshotAction{},
+	DiffConfigSnapshotsAction{},
+	ReconcileMembershipAction{},
 	FetchRecentContentUrlsAction{},
 	TasksRequestAct{},
 	TaskEnqueueAct{},
 	CollectionItemsAction{},
 	SaveCollectionItemsAction{},
 	DeleteCollectionItemsAction{},
+	CollectionSubscribeAction{},
+	CollectionUnsubscribeAction{},
+	ReportContentAction{},
+	ModerationQueueAction{},
+	ResolveCaseAction{},
+	FetchMetaFieldsAction{},
+	SaveMetaFieldsAction{},
+	DeleteMetaFieldsAction{},
+	CapabilitiesAction{},
+	HelloAction{},
+	ServerReplyAction{},
+	SubjectRelationsAction{},
+	TrialArchiveAction{},
+	LinkHistoryAction{},
+	ArchiveLinkAction{},
+	ServerInfoAction{},
+	FetchSavedSearchesAction{},
+	SaveSavedSearchAction{},
+	DeleteSavedSearchAction{},
+	FetchSearchMatchesAction{},
+	MetadataHistoryAction{},
+	FetchUrlContentAction{},
+	ChainHealthAction{},
+	SubprimerPlanAction{},
+	RenderCardAction{},
+	DashboardAction{},
+	UserExportAction{},
+	WhoAmIAction{},
+	AnnouncementsAction{},
+	SaveAnnouncementAction{},
+	DeleteAnnouncementAction{},
+	DismissAnnouncementAction{},
+	CaptureNotesAction{},
+	AddCaptureNoteAction{},
+	DeleteCaptureNoteAction{},
+	ListUserActivityAction{},
+	UserActivitySummaryAction{},
+	OutboxDeadLettersAction{},
+	RequeueDeadLetterAction{},
+	CustodyReportAction{},
+	PingAction{},
+	RenameMetaKeyAction{},
+	LimitsStatusAction{},
 }
 
 // Action is a collection of typed events for exchange between client & server
@@ -67,16 +120,26 @@ type ServerRequestAction interface {
 }
 
 type ClientResponse struct {
-	Type        string      `json:"type"`
-	RequestId   string      `json:"requestId"`
-	Error       string      `json:"error,omitempty"`
-	SilentError bool        `json:"silentError,omitempty"`
-	Message     string      `json:"message,omitempty"`
-	Schema      string      `json:"schema,omitempty"`
-	Page        int         `json:"page,omitempty"`
-	PageSize    int         `json:"pageSize,omitempty"`
-	Id          string      `json:"id,omitempty"`
-	Data        interface{} `json:"data,omitempty"`
+	Type      string `json:"type"`
+	RequestId string `json:"requestId"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+	// parameters of the error's message, see messages.go
+	Details     map[string]string `json:"details,omitempty"`
+	SilentError bool              `json:"silentError,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Schema      string            `json:"schema,omitempty"`
+	Page        int               `json:"page,omitempty"`
+	PageSize    int               `json:"pageSize,omitempty"`
+	Id          string            `json:"id,omitempty"`
+	Data        interface{}       `json:"data,omitempty"`
+	// filter a subscription is sending events through, see SubscriptionFilter
+	Filter *SubscriptionFilter `json:"filter,omitempty"`
+	// content token & suggested seconds clients can reuse the response for, see applyCacheHints
+	Token  string `json:"token,omitempty"`
+	MaxAge int    `json:"maxAge,omitempty"`
+	// personal responses are assembled for one user & never carry cache hints
+	personal bool
 }
 
 type ReqAction struct {
@@ -85,9 +148,22 @@ type ReqAction struct {
 	err         error
 }
 
+// ClientBoundAction is implemented by actions that need to know which client
+// sent them. The client is set after parsing & before Exec is called
+type ClientBoundAction interface {
+	SetClient(c *Client)
+}
+
+// clientAction can be embedded in an action to implement ClientBoundAction
+type clientAction struct {
+	client *Client
+}
+
+func (a *clientAction) SetClient(c *Client) { a.client = c }
+
 type MsgReqAct struct {
 	ReqAction
-	Message string
+	Message string `json:"message"`
 }
 
 func (m MsgReqAct) Type() string        { return "MESSAGE_REQUEST" }
@@ -112,9 +188,9 @@ func (a *MsgReqAct) Exec() (res *ClientResponse) {
 
 type SearchReqAct struct {
 	ReqAction
-	Query    string
-	Page     int
-	PageSize int
+	clientAction
+	pageRequest
+	Query string `json:"query"`
 }
 
 func (SearchReqAct) Type() string        { return "SEARCH_REQUEST" }
@@ -128,10 +204,14 @@ func (SearchReqAct) Parse(reqId string, data json.RawMessage) ClientRequestActio
 	return a
 }
 func (s *SearchReqAct) Exec() (res *ClientResponse) {
-	if s.Page > 0 {
-		s.Page = s.Page - 1
+	if err := s.window(); err != nil {
+		return &ClientResponse{
+			Type:      s.FailureType(),
+			Error:     err.Error(),
+			RequestId: s.RequestId,
+		}
 	}
-	results, err := core.Search(appDB, s.Query, s.PageSize, s.Page*s.PageSize)
+	results, err := SearchUrls(appDB, s.Query, s.fetch(), s.offset)
 	if err != nil {
 		return &ClientResponse{
 			Type:      s.FailureType(),
@@ -139,18 +219,31 @@ func (s *SearchReqAct) Exec() (res *ClientResponse) {
 			RequestId: s.RequestId,
 		}
 	}
+	v, err := s.visibility()
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      s.FailureType(),
+			Error:     err.Error(),
+			RequestId: s.RequestId,
+		}
+	}
+	page := newPage(&s.pageRequest, results)
 	return &ClientResponse{
 		Type:      s.SuccessType(),
 		RequestId: s.RequestId,
 		Schema:    "SEARCH_RESULT_ARRAY",
-		Data:      results,
+		Page:      s.Page,
+		PageSize:  s.PageSize,
+		Data:      page.filter(unsuppressed(v.Urls(page.Items.([]*core.Url)))),
 	}
 }
 
 // FetchUrlAct fetches a url from the DB
 type FetchUrlAct struct {
 	ReqAction
-	Url string
+	clientAction
+	Url string `json:"url"`
 }
 
 func (FetchUrlAct) Type() string        { return "URL_FETCH_REQUEST" }
@@ -165,27 +258,173 @@ func (FetchUrlAct) Parse(reqId string, data json.RawMessage) ClientRequestAction
 }
 
 func (a *FetchUrlAct) Exec() (res *ClientResponse) {
+	v, err := a.visibility()
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
 	u := &core.Url{Url: a.Url}
-	if err := u.Read(store); err != nil {
+	if err := u.Read(store); err == ErrNotFound || (err == nil && !v.Url(u.Url)) {
+		return notFoundResponse(a, a.RequestId, "url", a.Url)
+	} else if err != nil {
 		return &ClientResponse{
 			Type:      a.FailureType(),
 			RequestId: a.RequestId,
 			Error:     err.Error(),
 		}
 	}
+	if isSuppressed(u) {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Code:      suppressedErrCode,
+			Error:     ErrContentSuppressed.Error(),
+		}
+	}
 
 	return &ClientResponse{
 		Type:      a.SuccessType(),
 		Schema:    "URL",
 		RequestId: a.RequestId,
-		Data:      u,
+		Data:      newUrlDetail(u, a.client.identity()),
+	}
+}
+
+// urlDetail is a url with additional info for the url detail view. Url fields are
+// embedded so they serialize at the top level, same as a plain url
+type urlDetail struct {
+	*core.Url
+	// people currently editing metadata for this url's content
+	Editors []*Editor `json:"editors"`
+	// how the url was last fetched, if forensics were recorded
+	Forensics *FetchForensics `json:"forensics,omitempty"`
+	// fields to render when editing metadata for this url's content
+	MetaFields []*MetaField `json:"metaFields"`
+	// collections the requester can see that hold this url
+	Collections []*CollectionRef `json:"collections"`
+	// notes about this url's capture, oldest first
+	Notes []*CaptureNote `json:"notes"`
+}
+
+// newUrlDetail adds detail view info to a url, as seen by keyId
+func newUrlDetail(u *core.Url, keyId string) *urlDetail {
+	d := &urlDetail{Url: u, Editors: []*Editor{}, Collections: []*CollectionRef{}, Notes: []*CaptureNote{}}
+	if u.Hash != "" {
+		d.Editors = editing.Editors(u.Hash)
+	}
+	if hash, ok := u.Meta[urlForensicsMetaKey].(string); ok && appDB != nil {
+		f, err := ReadForensics(appDB, hash)
+		if err != nil {
+			log.Info(err.Error())
+		}
+		d.Forensics = f
+	}
+	if appDB != nil {
+		fields, err := metaFieldsForUrl(appDB, u)
+		if err != nil {
+			log.Info(err.Error())
+		}
+		d.MetaFields = fields
+
+		collections, err := urlCollections(appDB, u.Url, keyId)
+		if err != nil {
+			log.Info(err.Error())
+		} else {
+			d.Collections = collections
+		}
+
+		if u.Hash != "" {
+			notes, err := ReadCaptureNotes(appDB, u.Hash)
+			if err != nil {
+				log.Info(err.Error())
+			} else {
+				d.Notes = notes
+			}
+		}
+	}
+	return d
+}
+
+// CapabilitiesAction reports what a client can do with a url, so the frontend
+// can render the right controls. clients that connected with an api key are
+// sent it's scope
+type CapabilitiesAction struct {
+	ReqAction
+	clientAction
+	Url   string `json:"url"`
+	KeyId string `json:"keyId"`
+}
+
+func (CapabilitiesAction) Type() string        { return "CAPABILITIES_REQUEST" }
+func (CapabilitiesAction) SuccessType() string { return "CAPABILITIES_SUCCESS" }
+func (CapabilitiesAction) FailureType() string { return "CAPABILITIES_FAILURE" }
+
+func (CapabilitiesAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &CapabilitiesAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *CapabilitiesAction) Exec() (res *ClientResponse) {
+	u := &core.Url{Url: a.Url}
+	if err := u.Read(store); err != nil && err != ErrNotFound {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	fields, err := metaFieldsForUrl(appDB, u)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	s, err := matchSource(appDB, u.Url)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	data := map[string]interface{}{
+		"url":              u.Url,
+		"writable":         maintenance.Status() == nil,
+		"metaFields":       fields,
+		"manageMetaFields": isSourceOwner(s, a.KeyId),
+	}
+	if a.client != nil && a.client.apiKey != nil {
+		data["manageMetaFields"] = isSourceOwner(s, a.client.apiKey.KeyId)
+		data["apiKey"] = a.client.apiKey.scope()
+		data["archivable"] = a.client.apiKey.hasScope(apiScopeArchive)
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "CAPABILITIES",
+		Data:      data,
 	}
 }
 
 // FetchInboundLinksAct fetches a url's outbound links
 type FetchInboundLinksAct struct {
 	ReqAction
-	Url string
+	clientAction
+	pageRequest
+	Url string `json:"url"`
 }
 
 func (FetchInboundLinksAct) Type() string        { return "URL_FETCH_INBOUND_LINKS_REQUEST" }
@@ -199,27 +438,48 @@ func (FetchInboundLinksAct) Parse(reqId string, data json.RawMessage) ClientRequ
 }
 
 func (a *FetchInboundLinksAct) Exec() (res *ClientResponse) {
-	links, err := core.ReadSrcLinks(appDB, &core.Url{Url: a.Url})
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	v, err := a.visibility()
 	if err != nil {
+		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
 			RequestId: a.RequestId,
 			Error:     err.Error(),
 		}
 	}
+	links := []*core.Link{}
+	if v.Url(a.Url) {
+		if links, err = core.ReadSrcLinks(appDB, &core.Url{Url: a.Url}); err != nil {
+			return &ClientResponse{
+				Type:      a.FailureType(),
+				RequestId: a.RequestId,
+				Error:     err.Error(),
+			}
+		}
+	}
 
+	// links are read whole, & paged once hidden ones are left out
+	page := slicePage(&a.pageRequest, v.Links(links))
+	page.Items = readLinkDetails(appDB, page.Items.([]*core.Link), time.Now())
 	return &ClientResponse{
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "LINK_ARRAY",
-		Data:      links,
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      page,
 	}
 }
 
 // FetchOutboundLinksAct fetches a url's outbound links
 type FetchOutboundLinksAct struct {
 	ReqAction
-	Url string
+	clientAction
+	pageRequest
+	Url string `json:"url"`
 }
 
 func (FetchOutboundLinksAct) Type() string        { return "URL_FETCH_OUTBOUND_LINKS_REQUEST" }
@@ -233,7 +493,10 @@ func (FetchOutboundLinksAct) Parse(reqId string, data json.RawMessage) ClientReq
 }
 
 func (a *FetchOutboundLinksAct) Exec() (res *ClientResponse) {
-	links, err := core.ReadDstLinks(appDB, &core.Url{Url: a.Url})
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	v, err := a.visibility()
 	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
@@ -242,12 +505,28 @@ func (a *FetchOutboundLinksAct) Exec() (res *ClientResponse) {
 			Error:     err.Error(),
 		}
 	}
+	links := []*core.Link{}
+	if v.Url(a.Url) {
+		if links, err = core.ReadDstLinks(appDB, &core.Url{Url: a.Url}); err != nil {
+			log.Info(err.Error())
+			return &ClientResponse{
+				Type:      a.FailureType(),
+				RequestId: a.RequestId,
+				Error:     err.Error(),
+			}
+		}
+	}
 
+	// links are read whole, & paged once hidden ones are left out
+	page := slicePage(&a.pageRequest, v.Links(links))
+	page.Items = readLinkDetails(appDB, page.Items.([]*core.Link), time.Now())
 	return &ClientResponse{
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "LINK_ARRAY",
-		Data:      links,
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      page,
 	}
 }
 
@@ -255,8 +534,8 @@ func (a *FetchOutboundLinksAct) Exec() (res *ClientResponse) {
 // urls that lead to content
 type FetchRecentContentUrlsAction struct {
 	ReqAction
-	Page     int
-	PageSize int
+	clientAction
+	pageRequest
 }
 
 func (FetchRecentContentUrlsAction) Type() string        { return "CONTENT_RECENT_URLS_REQUEST" }
@@ -271,8 +550,20 @@ func (FetchRecentContentUrlsAction) Parse(reqId string, data json.RawMessage) Cl
 }
 
 func (a *FetchRecentContentUrlsAction) Exec() (res *ClientResponse) {
-	urls, err := core.ContentUrls(appDB, a.PageSize, a.PageSize*(a.Page-1))
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	urls, err := core.ContentUrls(appDB, a.fetch(), a.offset)
+	if err != nil {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	v, err := a.visibility()
 	if err != nil {
+		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
 			RequestId: a.RequestId,
@@ -280,20 +571,22 @@ func (a *FetchRecentContentUrlsAction) Exec() (res *ClientResponse) {
 		}
 	}
 
+	page := newPage(&a.pageRequest, urls)
 	return &ClientResponse{
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "URL_ARRAY",
 		Page:      a.Page,
 		PageSize:  a.PageSize,
-		Data:      urls,
+		Data:      page.filter(withNoteCounts(appDB, unsuppressed(v.Urls(page.Items.([]*core.Url))))),
 	}
 }
 
 // FetchContentUrlsAction triggers archiving a url
 type FetchContentUrlsAction struct {
 	ReqAction
-	Hash string
+	clientAction
+	Hash string `json:"hash"`
 }
 
 func (FetchContentUrlsAction) Type() string        { return "CONTENT_URLS_REQUEST" }
@@ -308,8 +601,30 @@ func (FetchContentUrlsAction) Parse(reqId string, data json.RawMessage) ClientRe
 }
 
 func (a *FetchContentUrlsAction) Exec() (res *ClientResponse) {
-	urls, err := core.UrlsForHash(appDB, a.Hash)
+	// content re-hashed since it was captured is still stored under it's old hash
+	hashes, err := hashAliases(appDB, a.Hash)
+	if err != nil {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	urls := []*core.Url{}
+	for _, hash := range hashes {
+		found, err := core.UrlsForHash(appDB, hash)
+		if err != nil {
+			return &ClientResponse{
+				Type:      a.FailureType(),
+				RequestId: a.RequestId,
+				Error:     err.Error(),
+			}
+		}
+		urls = append(urls, found...)
+	}
+	v, err := a.visibility()
 	if err != nil {
+		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
 			RequestId: a.RequestId,
@@ -320,13 +635,14 @@ func (a *FetchContentUrlsAction) Exec() (res *ClientResponse) {
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "URL_ARRAY",
-		Data:      urls,
+		Data:      withNoteCounts(appDB, unsuppressed(v.Urls(urls))),
 	}
 }
 
 // FetchMetadataAction triggers archiving a url
 type FetchMetadataAction struct {
 	ReqAction
+	clientAction
 	KeyId   string `json:"keyId"`
 	Subject string `json:"subject"`
 }
@@ -343,15 +659,23 @@ func (FetchMetadataAction) Parse(reqId string, data json.RawMessage) ClientReque
 }
 
 func (a *FetchMetadataAction) Exec() (res *ClientResponse) {
-	m, err := core.LatestMetadata(appDB, a.KeyId, a.Subject)
+	visible, err := a.canSee(a.Subject)
 	if err != nil {
-		if err == core.ErrNotFound {
-			return &ClientResponse{
-				Type:      a.SuccessType(),
-				RequestId: a.RequestId,
-			}
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
 		}
+	}
+	if !visible {
+		return notFoundResponse(a, a.RequestId, "metadata", a.KeyId+" "+a.Subject)
+	}
 
+	m, err := metaCache.LatestMetadata(appDB, a.KeyId, a.Subject)
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "metadata", a.KeyId+" "+a.Subject)
+	} else if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -364,13 +688,14 @@ func (a *FetchMetadataAction) Exec() (res *ClientResponse) {
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "METADATA",
-		Data:      m,
+		Data:      metadataBadges.Detail(m),
 	}
 }
 
 // SaveMetadataAction triggers archiving a url
 type SaveMetadataAction struct {
 	ReqAction
+	clientAction
 	KeyId   string                 `json:"keyId"`
 	Subject string                 `json:"subject"`
 	Meta    map[string]interface{} `json:"meta"`
@@ -388,6 +713,27 @@ func (SaveMetadataAction) Parse(reqId string, data json.RawMessage) ClientReques
 }
 
 func (a *SaveMetadataAction) Exec() (res *ClientResponse) {
+	// only members describe content in a restricted subprimer
+	v, err := a.visibility()
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	if visible, err := v.Subject(a.Subject); err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	} else if !visible {
+		return notFoundResponse(a, a.RequestId, "content", a.Subject)
+	}
+
 	m, err := core.NextMetadata(appDB, a.KeyId, a.Subject)
 	if err != nil {
 		log.Info(err.Error())
@@ -399,7 +745,7 @@ func (a *SaveMetadataAction) Exec() (res *ClientResponse) {
 	}
 
 	m.Meta = a.Meta
-	if err := m.Write(store); err != nil {
+	if err := WriteMetadata(m); err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -419,9 +765,8 @@ func (a *SaveMetadataAction) Exec() (res *ClientResponse) {
 // FetchPrimersAction grabs a page of primers
 type FetchPrimersAction struct {
 	ReqAction
-	BaseOnly bool
-	Page     int
-	PageSize int
+	pageRequest
+	BaseOnly bool `json:"baseOnly"`
 }
 
 func (FetchPrimersAction) Type() string        { return "PRIMERS_FETCH_REQUEST" }
@@ -440,10 +785,13 @@ func (a *FetchPrimersAction) Exec() (res *ClientResponse) {
 		primers []*core.Primer
 		err     error
 	)
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
 	if a.BaseOnly {
-		primers, err = core.BasePrimers(appDB, 50, 0)
+		primers, err = core.BasePrimers(appDB, a.fetch(), a.offset)
 	} else {
-		primers, err = core.ListPrimers(store, 50, 0)
+		primers, err = core.ListPrimers(store, a.fetch(), a.offset)
 	}
 	if err != nil {
 		log.Info(err.Error())
@@ -457,14 +805,16 @@ func (a *FetchPrimersAction) Exec() (res *ClientResponse) {
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "PRIMER_ARRAY",
-		Data:      primers,
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      newPage(&a.pageRequest, primers),
 	}
 }
 
 // FetchPrimerAction grabs a page of primers
 type FetchPrimerAction struct {
 	ReqAction
-	Id string
+	Id string `json:"id"`
 }
 
 func (FetchPrimerAction) Type() string        { return "PRIMER_FETCH_REQUEST" }
@@ -480,7 +830,9 @@ func (FetchPrimerAction) Parse(reqId string, data json.RawMessage) ClientRequest
 
 func (a *FetchPrimerAction) Exec() (res *ClientResponse) {
 	p := &core.Primer{Id: a.Id}
-	if err := p.Read(store); err != nil {
+	if err := p.Read(store); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "primer", a.Id)
+	} else if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -518,8 +870,7 @@ func (a *FetchPrimerAction) Exec() (res *ClientResponse) {
 // FetchSourcesAction grabs a page of primers
 type FetchSourcesAction struct {
 	ReqAction
-	Page     int
-	PageSize int
+	pageRequest
 }
 
 func (FetchSourcesAction) Type() string        { return "SOURCES_FETCH_REQUEST" }
@@ -534,7 +885,10 @@ func (FetchSourcesAction) Parse(reqId string, data json.RawMessage) ClientReques
 }
 
 func (a *FetchSourcesAction) Exec() (res *ClientResponse) {
-	s, err := core.ListSources(store, a.PageSize, (a.Page-1)*a.PageSize)
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	s, err := core.ListSources(store, a.fetch(), a.offset)
 	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
@@ -548,7 +902,7 @@ func (a *FetchSourcesAction) Exec() (res *ClientResponse) {
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "SOURCE_ARRAY",
-		Data:      s,
+		Data:      newPage(&a.pageRequest, s),
 		Page:      a.Page,
 		PageSize:  a.PageSize,
 	}
@@ -557,7 +911,7 @@ func (a *FetchSourcesAction) Exec() (res *ClientResponse) {
 // FetchSourceAction grabs a page of subprimers for a given primer id
 type FetchSourceAction struct {
 	ReqAction
-	Id string
+	Id string `json:"id"`
 }
 
 func (FetchSourceAction) Type() string        { return "SOURCE_FETCH_REQUEST" }
@@ -573,7 +927,9 @@ func (FetchSourceAction) Parse(reqId string, data json.RawMessage) ClientRequest
 
 func (a *FetchSourceAction) Exec() (res *ClientResponse) {
 	s := &core.Source{Id: a.Id}
-	if err := s.Read(store); err != nil {
+	if err := s.Read(store); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "source", a.Id)
+	} else if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -614,9 +970,9 @@ func (a *FetchSourceAction) Exec() (res *ClientResponse) {
 // FetchSourceAction grabs a page of primers
 type FetchSourceUrlsAction struct {
 	ReqAction
-	Id       string
-	Page     int
-	PageSize int
+	clientAction
+	pageRequest
+	Id string `json:"id"`
 }
 
 func (FetchSourceUrlsAction) Type() string        { return "SOURCE_URLS_REQUEST" }
@@ -631,8 +987,13 @@ func (FetchSourceUrlsAction) Parse(reqId string, data json.RawMessage) ClientReq
 }
 
 func (a *FetchSourceUrlsAction) Exec() (res *ClientResponse) {
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
 	s := &core.Source{Id: a.Id}
-	if err := s.Read(store); err != nil {
+	if err := s.Read(store); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "source", a.Id)
+	} else if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -641,7 +1002,16 @@ func (a *FetchSourceUrlsAction) Exec() (res *ClientResponse) {
 		}
 	}
 
-	urls, err := s.UndescribedContent(appDB, 100, 0)
+	urls, err := s.UndescribedContent(appDB, a.fetch(), a.offset)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	v, err := a.visibility()
 	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
@@ -651,6 +1021,7 @@ func (a *FetchSourceUrlsAction) Exec() (res *ClientResponse) {
 		}
 	}
 
+	page := newPage(&a.pageRequest, urls)
 	return &ClientResponse{
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
@@ -658,15 +1029,15 @@ func (a *FetchSourceUrlsAction) Exec() (res *ClientResponse) {
 		Id:        a.Id,
 		Page:      a.Page,
 		PageSize:  a.PageSize,
-		Data:      urls,
+		Data:      page.filter(unsuppressed(v.Urls(page.Items.([]*core.Url)))),
 	}
 }
 
 type FetchSourceAttributedUrlsAction struct {
 	ReqAction
-	Id       string
-	Page     int
-	PageSize int
+	clientAction
+	pageRequest
+	Id string `json:"id"`
 }
 
 func (FetchSourceAttributedUrlsAction) Type() string {
@@ -687,8 +1058,13 @@ func (FetchSourceAttributedUrlsAction) Parse(reqId string, data json.RawMessage)
 }
 
 func (a *FetchSourceAttributedUrlsAction) Exec() (res *ClientResponse) {
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
 	s := &core.Source{Id: a.Id}
-	if err := s.Read(store); err != nil {
+	if err := s.Read(store); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "source", a.Id)
+	} else if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -697,7 +1073,16 @@ func (a *FetchSourceAttributedUrlsAction) Exec() (res *ClientResponse) {
 		}
 	}
 
-	urls, err := s.DescribedContent(appDB, 100, 0)
+	urls, err := s.DescribedContent(appDB, a.fetch(), a.offset)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	v, err := a.visibility()
 	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
@@ -707,6 +1092,7 @@ func (a *FetchSourceAttributedUrlsAction) Exec() (res *ClientResponse) {
 		}
 	}
 
+	page := newPage(&a.pageRequest, urls)
 	return &ClientResponse{
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
@@ -714,14 +1100,15 @@ func (a *FetchSourceAttributedUrlsAction) Exec() (res *ClientResponse) {
 		Id:        a.Id,
 		Page:      a.Page,
 		PageSize:  a.PageSize,
-		Data:      urls,
+		Data:      page.filter(unsuppressed(v.Urls(page.Items.([]*core.Url)))),
 	}
 }
 
 // FetchConsensusAction fetches a url from the DB
 type FetchConsensusAction struct {
 	ReqAction
-	Subject string
+	clientAction
+	Subject string `json:"subject"`
 }
 
 func (FetchConsensusAction) Type() string        { return "CONSENSUS_REQUEST" }
@@ -736,17 +1123,7 @@ func (FetchConsensusAction) Parse(reqId string, data json.RawMessage) ClientRequ
 }
 
 func (a *FetchConsensusAction) Exec() (res *ClientResponse) {
-	blocks, err := core.MetadataBySubject(appDB, a.Subject)
-	if err != nil {
-		log.Info(err.Error())
-		return &ClientResponse{
-			Type:      a.FailureType(),
-			RequestId: a.RequestId,
-			Error:     err.Error(),
-		}
-	}
-
-	c, values, err := core.SumConsensus(a.Subject, blocks)
+	visible, err := a.canSee(a.Subject)
 	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
@@ -756,13 +1133,16 @@ func (a *FetchConsensusAction) Exec() (res *ClientResponse) {
 		}
 	}
 
-	md, err := c.Metadata(values)
-	if err != nil {
-		log.Info(err.Error())
-		return &ClientResponse{
-			Type:      a.FailureType(),
-			RequestId: a.RequestId,
-			Error:     err.Error(),
+	// hidden content has the same consensus as content nobody's described
+	md := map[string][]interface{}{}
+	if visible {
+		if md, err = metaCache.Consensus(appDB, a.Subject); err != nil {
+			log.Info(err.Error())
+			return &ClientResponse{
+				Type:      a.FailureType(),
+				RequestId: a.RequestId,
+				Error:     err.Error(),
+			}
 		}
 	}
 
@@ -777,11 +1157,11 @@ func (a *FetchConsensusAction) Exec() (res *ClientResponse) {
 	}
 }
 
-// FetchCollectionsAction grabs a page of collections
+// FetchCollectionsAction grabs a page of the collections the client can see
 type FetchCollectionsAction struct {
 	ReqAction
-	Page     int
-	PageSize int
+	clientAction
+	pageRequest
 }
 
 func (FetchCollectionsAction) Type() string        { return "COLLECTIONS_FETCH_REQUEST" }
@@ -796,7 +1176,10 @@ func (FetchCollectionsAction) Parse(reqId string, data json.RawMessage) ClientRe
 }
 
 func (a *FetchCollectionsAction) Exec() (res *ClientResponse) {
-	collections, err := core.ListCollections(store, 50, 0)
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	collections, err := listCollections(appDB, a.client.identity(), "", a.fetch(), a.offset)
 	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
@@ -810,16 +1193,19 @@ func (a *FetchCollectionsAction) Exec() (res *ClientResponse) {
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "COLLECTION_ARRAY",
-		Data:      collections,
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      newPage(&a.pageRequest, collections),
 	}
 }
 
-// UserCollectionsAction grabs a page of a user's collections
+// UserCollectionsAction grabs a page of a user's collections, private
+// collections are only listed for their owner
 type UserCollectionsAction struct {
 	ReqAction
-	Creator  string
-	Page     int
-	PageSize int
+	clientAction
+	pageRequest
+	Creator string `json:"creator"`
 }
 
 func (UserCollectionsAction) Type() string        { return "USER_COLLECTIONS_REQUEST" }
@@ -834,7 +1220,13 @@ func (UserCollectionsAction) Parse(reqId string, data json.RawMessage) ClientReq
 }
 
 func (a *UserCollectionsAction) Exec() (res *ClientResponse) {
-	collections, err := core.CollectionsByCreator(store, a.Creator, "created DESC", a.PageSize, (a.Page-1)*a.PageSize)
+	if a.Creator == "" {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: "creator is required"}
+	}
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	collections, err := listCollections(appDB, a.client.identity(), a.Creator, a.fetch(), a.offset)
 	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
@@ -848,14 +1240,17 @@ func (a *UserCollectionsAction) Exec() (res *ClientResponse) {
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "COLLECTION_ARRAY",
-		Data:      collections,
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      newPage(&a.pageRequest, collections),
 	}
 }
 
-// FetchCollectionAction grabs a page of collections
+// FetchCollectionAction grabs a single collection
 type FetchCollectionAction struct {
 	ReqAction
-	Id string
+	clientAction
+	Id string `json:"id"`
 }
 
 func (FetchCollectionAction) Type() string        { return "COLLECTION_FETCH_REQUEST" }
@@ -871,7 +1266,13 @@ func (FetchCollectionAction) Parse(reqId string, data json.RawMessage) ClientReq
 
 func (a *FetchCollectionAction) Exec() (res *ClientResponse) {
 	c := &core.Collection{Id: a.Id}
-	if err := c.Read(store); err != nil {
+	acc, err := readCollectionAccess(appDB, a.Id)
+	if err == nil {
+		err = c.Read(store)
+	}
+	if err == ErrNotFound || (err == nil && !acc.visibleTo(a.client.identity())) {
+		return notFoundResponse(a, a.RequestId, "collection", a.Id)
+	} else if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -884,14 +1285,18 @@ func (a *FetchCollectionAction) Exec() (res *ClientResponse) {
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "COLLECTION",
-		Data:      c,
+		Data:      &collectionDetail{Collection: c, Visibility: acc.Visibility},
 	}
 }
 
-// SaveCollectionAction triggers archiving a url
+// SaveCollectionAction creates or updates a collection. new collections are
+// owned by the key the client said hello with, only the owner can update one.
+// visibility is public or private, & left as it is if empty
 type SaveCollectionAction struct {
 	ReqAction
+	clientAction
 	Collection *core.Collection `json:"collection"`
+	Visibility string           `json:"visibility"`
 }
 
 func (SaveCollectionAction) Type() string        { return "COLLECTION_SAVE_REQUEST" }
@@ -906,8 +1311,11 @@ func (SaveCollectionAction) Parse(reqId string, data json.RawMessage) ClientRequ
 }
 
 func (a *SaveCollectionAction) Exec() (res *ClientResponse) {
-	log.Info(a.Collection)
-	if err := a.Collection.Save(store); err != nil {
+	if a.err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+	detail, err := a.save()
+	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -920,13 +1328,52 @@ func (a *SaveCollectionAction) Exec() (res *ClientResponse) {
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "COLLECTION",
-		Data:      a.Collection,
+		Data:      detail,
+	}
+}
+
+func (a *SaveCollectionAction) save() (*collectionDetail, error) {
+	keyId := a.client.identity()
+	if a.Collection == nil {
+		return nil, fmt.Errorf("collection is required")
+	}
+	if a.Visibility != "" && a.Visibility != collectionPublic && a.Visibility != collectionPrivate {
+		return nil, ErrCollectionVisibility
+	}
+
+	visibility := a.Visibility
+	if acc, err := readCollectionAccess(appDB, a.Collection.Id); err == nil {
+		if keyId == "" || keyId != acc.Creator {
+			return nil, ErrCollectionOwner
+		}
+		if visibility == "" {
+			visibility = acc.Visibility
+		}
+	} else if err != ErrNotFound {
+		return nil, err
+	} else if keyId == "" {
+		return nil, ErrCollectionAnonymous
+	} else {
+		a.Collection.Id = ""
+		if visibility == "" {
+			visibility = collectionPublic
+		}
 	}
+	a.Collection.Creator = keyId
+
+	if err := checkWriteErr(a.Collection.Save(store)); err != nil {
+		return nil, err
+	}
+	if err := setCollectionVisibility(appDB, a.Collection.Id, visibility, time.Now()); err != nil {
+		return nil, err
+	}
+	return &collectionDetail{Collection: a.Collection, Visibility: visibility}, nil
 }
 
-// DeleteCollectionAction triggers archiving a url
+// DeleteCollectionAction deletes a collection, only it's owner can
 type DeleteCollectionAction struct {
 	ReqAction
+	clientAction
 	// Collection *core.Collection `json:"collection"`
 	Id string `json:"id"`
 }
@@ -944,7 +1391,13 @@ func (DeleteCollectionAction) Parse(reqId string, data json.RawMessage) ClientRe
 
 func (a *DeleteCollectionAction) Exec() (res *ClientResponse) {
 	c := &core.Collection{Id: a.Id}
-	if err := c.Delete(store); err != nil {
+	err := checkCollectionOwner(appDB, a.Id, a.client.identity())
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "collection", a.Id)
+	} else if err == nil {
+		err = checkWriteErr(c.Delete(store))
+	}
+	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -964,9 +1417,9 @@ func (a *DeleteCollectionAction) Exec() (res *ClientResponse) {
 // CollectionItemsAction grabs a page of collection items
 type CollectionItemsAction struct {
 	ReqAction
-	CollectionId string
-	Page         int
-	PageSize     int
+	clientAction
+	pageRequest
+	CollectionId string `json:"collectionId"`
 }
 
 func (CollectionItemsAction) Type() string        { return "COLLECTION_ITEMS_REQUEST" }
@@ -981,9 +1434,27 @@ func (CollectionItemsAction) Parse(reqId string, data json.RawMessage) ClientReq
 }
 
 func (a *CollectionItemsAction) Exec() (res *ClientResponse) {
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
 	c := core.Collection{Id: a.CollectionId}
+	if visible, err := canViewCollection(appDB, a.CollectionId, a.client.identity()); err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	} else if !visible {
+		return notFoundResponse(a, a.RequestId, "collection", a.CollectionId)
+	}
 
-	items, err := c.ReadItems(store, "created DESC", a.PageSize, (a.Page-1)*a.PageSize)
+	items, err := c.ReadItems(store, "created DESC", a.fetch(), a.offset)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	v, err := a.visibility()
 	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
@@ -992,23 +1463,31 @@ func (a *CollectionItemsAction) Exec() (res *ClientResponse) {
 			Error:     err.Error(),
 		}
 	}
+	page := newPage(&a.pageRequest, items)
+	visible := make([]*core.CollectionItem, 0, len(items))
+	for _, item := range page.Items.([]*core.CollectionItem) {
+		if v.Url(item.Url.Url) {
+			visible = append(visible, item)
+		}
+	}
 
 	return &ClientResponse{
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "COLLECTION_ITEM_ARRAY",
-		Data:      items,
+		Data:      page.filter(visible),
 		Id:        a.CollectionId,
 		Page:      a.Page,
 		PageSize:  a.PageSize,
 	}
 }
 
-// SaveCollectionItemsAction grabs a page of collection items
+// SaveCollectionItemsAction adds items to a collection, only it's owner can
 type SaveCollectionItemsAction struct {
 	ReqAction
-	CollectionId string
-	Items        []*core.CollectionItem
+	clientAction
+	CollectionId string                 `json:"collectionId"`
+	Items        []*core.CollectionItem `json:"items"`
 }
 
 func (SaveCollectionItemsAction) Type() string        { return "COLLECTION_SAVE_ITEMS_REQUEST" }
@@ -1024,7 +1503,9 @@ func (SaveCollectionItemsAction) Parse(reqId string, data json.RawMessage) Clien
 
 func (a *SaveCollectionItemsAction) Exec() (res *ClientResponse) {
 	c := core.Collection{Id: a.CollectionId}
-	if err := c.SaveItems(store, a.Items); err != nil {
+	if err := a.client.service().changeCollectionItems(c.Id, a.client.identity(), collectionAdded, a.Items); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "collection", c.Id)
+	} else if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -1046,11 +1527,12 @@ func (a *SaveCollectionItemsAction) Exec() (res *ClientResponse) {
 	}
 }
 
-// DeleteCollectionItemsAction grabs a page of collection items
+// DeleteCollectionItemsAction removes items from a collection, only it's owner can
 type DeleteCollectionItemsAction struct {
 	ReqAction
-	CollectionId string
-	Items        []*core.CollectionItem
+	clientAction
+	CollectionId string                 `json:"collectionId"`
+	Items        []*core.CollectionItem `json:"items"`
 }
 
 func (DeleteCollectionItemsAction) Type() string        { return "COLLECTION_DELETE_ITEMS_REQUEST" }
@@ -1066,7 +1548,9 @@ func (DeleteCollectionItemsAction) Parse(reqId string, data json.RawMessage) Cli
 
 func (a *DeleteCollectionItemsAction) Exec() (res *ClientResponse) {
 	c := core.Collection{Id: a.CollectionId}
-	if err := c.DeleteItems(store, a.Items); err != nil {
+	if err := a.client.service().changeCollectionItems(c.Id, a.client.identity(), collectionRemoved, a.Items); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "collection", c.Id)
+	} else if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
 			Type:      a.FailureType(),
@@ -1091,9 +1575,9 @@ func (a *DeleteCollectionItemsAction) Exec() (res *ClientResponse) {
 // MetadataByKeyRequest triggers archiving a url
 type MetadataByKeyRequest struct {
 	ReqAction
-	Key      string `json:"key"`
-	Page     int    `json:"page"`
-	PageSize int    `json:"pageSize"`
+	clientAction
+	pageRequest
+	Key string `json:"key"`
 }
 
 func (MetadataByKeyRequest) Type() string        { return "METADATA_BY_KEY_REQUEST" }
@@ -1108,7 +1592,19 @@ func (MetadataByKeyRequest) Parse(reqId string, data json.RawMessage) ClientRequ
 }
 
 func (a *MetadataByKeyRequest) Exec() (res *ClientResponse) {
-	results, err := core.MetadataByKey(appDB, a.Key, a.PageSize, (a.Page-1)*a.PageSize)
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	results, err := core.MetadataByKey(appDB, a.Key, a.fetch(), a.offset)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	v, err := a.visibility()
 	if err != nil {
 		log.Info(err.Error())
 		return &ClientResponse{
@@ -1117,11 +1613,22 @@ func (a *MetadataByKeyRequest) Exec() (res *ClientResponse) {
 			Error:     err.Error(),
 		}
 	}
+	page := newPage(&a.pageRequest, results)
+	if results, err = v.Metadata(page.Items.([]*core.Metadata)); err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
 
 	return &ClientResponse{
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "METADATA_ARRAY",
-		Data:      results,
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      page.filter(metadataBadges.Details(results)),
 	}
 }
@@ -9,9 +9,9 @@ import (
 // as ajax calls
 type CreateUserAct struct {
 	ReqAction
-	Username string
-	Email    string
-	Password string
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
 }
 
 func (CreateUserAct) Type() string        { return "SESSION_SIGNUP_REQUEST" }
@@ -35,8 +35,8 @@ func (s *CreateUserAct) Exec() (res *ClientResponse) {
 
 type SessionLoginAct struct {
 	ReqAction
-	Username string
-	Password string
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 func (SessionLoginAct) Type() string        { return "SESSION_LOGIN_REQUEST" }
@@ -60,9 +60,9 @@ func (s *SessionLoginAct) Exec() (res *ClientResponse) {
 
 type SessionLogoutAct struct {
 	ReqAction
-	Query    string
-	Page     int
-	PageSize int
+	Query    string `json:"query"`
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
 }
 
 func (SessionLogoutAct) Type() string        { return "SESSION_LOGOUT_REQUEST" }
@@ -86,9 +86,9 @@ func (s *SessionLogoutAct) Exec() (res *ClientResponse) {
 
 type SessionKeysAct struct {
 	ReqAction
-	Query    string
-	Page     int
-	PageSize int
+	Query    string `json:"query"`
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
 }
 
 func (SessionKeysAct) Type() string        { return "SESSION_KEYS_REQUEST" }
@@ -112,9 +112,9 @@ func (s *SessionKeysAct) Exec() (res *ClientResponse) {
 
 type SaveUserAct struct {
 	ReqAction
-	Query    string
-	Page     int
-	PageSize int
+	Query    string `json:"query"`
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
 }
 
 func (SaveUserAct) Type() string        { return "SAVE_SESSION_USER_REQUEST" }
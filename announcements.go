@@ -0,0 +1,473 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Announcements
+//
+// Admins announce things like maintenance windows to connected clients. an
+// announcement is for every client, or only the clients in a room: those
+// subscribed to a subject or collection topic. announcements are broadcast to
+// their room as ANNOUNCEMENT messages when they start, & clients are sent
+// ANNOUNCEMENT_EXPIRED when they end or are deleted. clients that connect
+// while one is active get it in their HELLO response. each instance polls for
+// announcements that started or ended so clients of every instance hear about
+// them, & broadcasts the ones it saves immediately.
+//
+// Users dismiss announcements so they aren't shown again each time they
+// reconnect. editing an announcement shows it again, even to users who
+// dismissed it
+
+const (
+	// longest announcement message
+	maxAnnouncementLength = 1000
+	// how often instances check for announcements that started or ended
+	announcementPollInterval = 30 * time.Second
+	// how long ended announcements are kept before they're removed
+	announcementRetention = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrAnnouncementMessage is returned for announcements without a message, or with one that's too long
+	ErrAnnouncementMessage = fmt.Errorf("announcements need a message of at most %d characters", maxAnnouncementLength)
+	// ErrAnnouncementSeverity is returned for announcements with an unknown severity
+	ErrAnnouncementSeverity = fmt.Errorf("announcement severity must be one of info, warning or critical")
+	// ErrAnnouncementWindow is returned for announcements that end before they start
+	ErrAnnouncementWindow = fmt.Errorf("announcements must end after they start")
+	// ErrAnnouncementRoom is returned for announcements for a room that isn't a subject or collection topic
+	ErrAnnouncementRoom = fmt.Errorf("announcement room must be empty, or a subject: or collection: topic")
+	// ErrAnnouncementAnonymous is returned when an anonymous client dismisses an announcement
+	ErrAnnouncementAnonymous = fmt.Errorf("you must be signed in to dismiss announcements")
+)
+
+// RoomAnnouncement is a notice admins send to connected clients
+type RoomAnnouncement struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Message string    `json:"message"`
+	// one of ["info","warning","critical"]. default "info"
+	Severity string    `json:"severity"`
+	Starts   time.Time `json:"starts"`
+	// when the announcement expires, nil if it lasts until it's deleted
+	Ends *time.Time `json:"ends,omitempty"`
+	// topic of the room the announcement is for, eg: "subject:[hash]". empty for every client
+	Room string `json:"room"`
+}
+
+// announcementCols are the columns of announcements
+var announcementCols = &columnSet{
+	table:   "announcements",
+	columns: []string{"id", "created", "updated", "message", "severity", "starts", "ends", "room"},
+}
+
+// scanTargets maps announcementCols to the announcement's fields
+func (a *RoomAnnouncement) scanTargets() scanTargets {
+	return scanTargets{
+		"id":       &a.Id,
+		"created":  &a.Created,
+		"updated":  &a.Updated,
+		"message":  &a.Message,
+		"severity": &a.Severity,
+		"starts":   &a.Starts,
+		"ends":     &a.Ends,
+		"room":     &a.Room,
+	}
+}
+
+// activeAt checks if an announcement is showing at t
+func (a *RoomAnnouncement) activeAt(t time.Time) bool {
+	return !a.Starts.After(t) && (a.Ends == nil || a.Ends.After(t))
+}
+
+// validate checks & normalizes an announcement being saved
+func (a *RoomAnnouncement) validate() error {
+	a.Message = strings.TrimSpace(a.Message)
+	if a.Message == "" || len(a.Message) > maxAnnouncementLength {
+		return ErrAnnouncementMessage
+	}
+	if a.Severity == "" {
+		a.Severity = "info"
+	}
+	if _, ok := severities[a.Severity]; !ok {
+		return ErrAnnouncementSeverity
+	}
+	if a.Ends != nil && !a.Ends.After(a.Starts) {
+		return ErrAnnouncementWindow
+	}
+	if a.Room != "" && !strings.HasPrefix(a.Room, subjectTopic("")) && !strings.HasPrefix(a.Room, collectionTopic("")) {
+		return ErrAnnouncementRoom
+	}
+	return nil
+}
+
+// SaveAnnouncement creates an announcement, or updates it if it has an id.
+// announcements without a start time start now
+func SaveAnnouncement(db *sql.DB, a *RoomAnnouncement, now time.Time) error {
+	if a.Starts.IsZero() {
+		// truncated so it's active straight away
+		a.Starts = now.Truncate(time.Second)
+	}
+	now = now.Round(time.Second).In(time.UTC)
+	a.Starts = a.Starts.In(time.UTC)
+	if a.Ends != nil {
+		ends := a.Ends.In(time.UTC)
+		a.Ends = &ends
+	}
+	if err := a.validate(); err != nil {
+		return err
+	}
+
+	a.Updated = now
+	if a.Id == "" {
+		a.Id = uuid.New()
+		a.Created = now
+		_, err := db.Exec("insert into announcements ("+announcementCols.String()+") values ($1, $2, $3, $4, $5, $6, $7, $8)",
+			a.Id, a.Created, a.Updated, a.Message, a.Severity, a.Starts, a.Ends, a.Room)
+		return checkWriteErr(err)
+	}
+	err := db.QueryRow("update announcements set updated = $2, message = $3, severity = $4, starts = $5, ends = $6, room = $7 where id = $1 returning created",
+		a.Id, a.Updated, a.Message, a.Severity, a.Starts, a.Ends, a.Room).Scan(&a.Created)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return checkWriteErr(err)
+}
+
+// DeleteAnnouncement removes an announcement & it's dismissals
+func DeleteAnnouncement(db *sql.DB, id string) error {
+	if uuid.Parse(id) == nil {
+		return ErrNotFound
+	}
+	res, err := db.Exec("delete from announcements where id = $1", id)
+	if err != nil {
+		return checkWriteErr(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReadAnnouncements lists every announcement, including scheduled & ended
+// ones, newest first
+func ReadAnnouncements(db *sql.DB) ([]*RoomAnnouncement, error) {
+	return queryAnnouncements(db, "select "+announcementCols.String()+" from announcements order by starts desc, id")
+}
+
+// ReadAnnouncement reads an announcement by id
+func ReadAnnouncement(db *sql.DB, id string) (*RoomAnnouncement, error) {
+	if uuid.Parse(id) == nil {
+		return nil, ErrNotFound
+	}
+	a := &RoomAnnouncement{}
+	err := announcementCols.scan(db.QueryRow("select "+announcementCols.String()+" from announcements where id = $1", id), a.scanTargets())
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return a, err
+}
+
+// ActiveAnnouncements lists the announcements showing at now, oldest first.
+// announcements a user dismissed since they were last edited are left out if
+// keyId isn't empty
+func ActiveAnnouncements(db *sql.DB, keyId string, now time.Time) ([]*RoomAnnouncement, error) {
+	return queryAnnouncements(db, `select `+announcementCols.String()+` from announcements a
+		where starts <= $1 and (ends is null or ends > $1)
+		and ($2 = '' or not exists (select 1 from announcement_dismissals d where d.announcement_id = a.id and d.key_id = $2 and d.created >= a.updated))
+		order by starts, id`, now.In(time.UTC), keyId)
+}
+
+func queryAnnouncements(db *sql.DB, query string, args ...interface{}) ([]*RoomAnnouncement, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []*RoomAnnouncement{}
+	for rows.Next() {
+		a := &RoomAnnouncement{}
+		if err := announcementCols.scan(rows, a.scanTargets()); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// DismissAnnouncement records a user dismissing an announcement
+func DismissAnnouncement(db *sql.DB, id, keyId string, now time.Time) error {
+	if uuid.Parse(id) == nil {
+		return ErrNotFound
+	}
+	res, err := db.Exec(`insert into announcement_dismissals (announcement_id, key_id, created) select id, $2, $3 from announcements where id = $1
+		on conflict (announcement_id, key_id) do update set created = excluded.created`, id, keyId, now.Round(time.Second).In(time.UTC))
+	if err != nil {
+		return checkWriteErr(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// removeEndedAnnouncements is the leader task that removes announcements that
+// ended more than announcementRetention ago
+func removeEndedAnnouncements(db *sql.DB, now time.Time) {
+	if _, err := db.Exec("delete from announcements where ends < $1", now.Add(-announcementRetention).In(time.UTC)); err != nil {
+		log.Infof("error removing ended announcements: %s", err.Error())
+	}
+}
+
+// announcer broadcasts announcements to this instance's clients as they start
+// & end, remembering what it's broadcast
+type announcer struct {
+	sync.Mutex
+	// active announcements this instance has broadcast, by id
+	sent map[string]*RoomAnnouncement
+}
+
+// newAnnouncer creates an announcer that hasn't broadcast anything
+func newAnnouncer() *announcer {
+	return &announcer{sent: map[string]*RoomAnnouncement{}}
+}
+
+// announcements broadcasts announcements to the default service's clients
+var announcements = newAnnouncer()
+
+// run checks for announcements that started or ended every announcementPollInterval
+func (an *announcer) run(s *Service) {
+	for {
+		if err := an.sync(s, s.Clock()); err != nil {
+			s.Log.Infof("error checking announcements: %s", err.Error())
+		}
+		time.Sleep(announcementPollInterval)
+	}
+}
+
+// sync broadcasts announcements that are active at now & haven't been
+// broadcast since they were last edited, & expires broadcast ones that aren't
+// active anymore
+func (an *announcer) sync(s *Service, now time.Time) error {
+	active, err := ActiveAnnouncements(s.DB, "", now)
+	if err != nil {
+		return err
+	}
+
+	an.Lock()
+	defer an.Unlock()
+	showing := map[string]bool{}
+	for _, a := range active {
+		showing[a.Id] = true
+		if prev := an.sent[a.Id]; prev == nil || !prev.Updated.Equal(a.Updated) || prev.Room != a.Room {
+			if prev != nil && prev.Room != a.Room {
+				s.broadcastAnnouncement("ANNOUNCEMENT_EXPIRED", prev)
+			}
+			s.broadcastAnnouncement("ANNOUNCEMENT", a)
+			an.sent[a.Id] = a
+		}
+	}
+	for id, a := range an.sent {
+		if !showing[id] {
+			s.broadcastAnnouncement("ANNOUNCEMENT_EXPIRED", a)
+			delete(an.sent, id)
+		}
+	}
+	return nil
+}
+
+// broadcastAnnouncement sends an announcement to every client in it's room
+func (s *Service) broadcastAnnouncement(typ string, a *RoomAnnouncement) {
+	if s.Hub == nil {
+		return
+	}
+	data, err := json.Marshal(&ClientResponse{
+		Type:      typ,
+		RequestId: "server",
+		Schema:    "ANNOUNCEMENT",
+		Id:        a.Id,
+		Data:      a,
+	})
+	if err != nil {
+		s.Log.Info(err.Error())
+		return
+	}
+	if a.Room == "" {
+		s.Hub.broadcast <- data
+		return
+	}
+	s.Hub.publish <- &topicMessage{topic: a.Room, data: data, event: typ, severity: severities[a.Severity]}
+}
+
+// AnnouncementsAction lists every announcement for admins
+type AnnouncementsAction struct {
+	ReqAction
+	clientAction
+	Token string `json:"token"`
+}
+
+func (AnnouncementsAction) Type() string        { return "ANNOUNCEMENTS_REQUEST" }
+func (AnnouncementsAction) SuccessType() string { return "ANNOUNCEMENTS_SUCCESS" }
+func (AnnouncementsAction) FailureType() string { return "ANNOUNCEMENTS_FAILURE" }
+
+func (AnnouncementsAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &AnnouncementsAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *AnnouncementsAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrNotModerator.Error()}
+	}
+	list, err := ReadAnnouncements(svc.DB)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "ANNOUNCEMENT_ARRAY",
+		Data:      list,
+	}
+}
+
+// SaveAnnouncementAction creates or edits an announcement. announcements that
+// are active once saved are broadcast straight away
+type SaveAnnouncementAction struct {
+	ReqAction
+	clientAction
+	Token        string            `json:"token"`
+	Announcement *RoomAnnouncement `json:"announcement"`
+}
+
+func (SaveAnnouncementAction) Type() string        { return "ANNOUNCEMENT_SAVE_REQUEST" }
+func (SaveAnnouncementAction) SuccessType() string { return "ANNOUNCEMENT_SAVE_SUCCESS" }
+func (SaveAnnouncementAction) FailureType() string { return "ANNOUNCEMENT_SAVE_FAILURE" }
+
+func (SaveAnnouncementAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &SaveAnnouncementAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *SaveAnnouncementAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrNotModerator.Error()}
+	}
+	if a.Announcement == nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrAnnouncementMessage.Error()}
+	}
+
+	now := svc.Clock()
+	if err := SaveAnnouncement(svc.DB, a.Announcement, now); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "announcement", a.Announcement.Id)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if err := svc.Announcements.sync(svc, now); err != nil {
+		log.Info(err.Error())
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "ANNOUNCEMENT",
+		Data:      a.Announcement,
+	}
+}
+
+// DeleteAnnouncementAction removes an announcement, expiring it for clients
+// that are showing it
+type DeleteAnnouncementAction struct {
+	ReqAction
+	clientAction
+	Token string `json:"token"`
+	Id    string `json:"id"`
+}
+
+func (DeleteAnnouncementAction) Type() string        { return "ANNOUNCEMENT_DELETE_REQUEST" }
+func (DeleteAnnouncementAction) SuccessType() string { return "ANNOUNCEMENT_DELETE_SUCCESS" }
+func (DeleteAnnouncementAction) FailureType() string { return "ANNOUNCEMENT_DELETE_FAILURE" }
+
+func (DeleteAnnouncementAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &DeleteAnnouncementAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *DeleteAnnouncementAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrNotModerator.Error()}
+	}
+	if err := DeleteAnnouncement(svc.DB, a.Id); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "announcement", a.Id)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if err := svc.Announcements.sync(svc, svc.Clock()); err != nil {
+		log.Info(err.Error())
+	}
+	return &ClientResponse{Type: a.SuccessType(), RequestId: a.RequestId, Id: a.Id}
+}
+
+// DismissAnnouncementAction stops an announcement being shown to the
+// requester when they reconnect
+type DismissAnnouncementAction struct {
+	ReqAction
+	clientAction
+	Id string `json:"id"`
+}
+
+func (DismissAnnouncementAction) Type() string        { return "ANNOUNCEMENT_DISMISS_REQUEST" }
+func (DismissAnnouncementAction) SuccessType() string { return "ANNOUNCEMENT_DISMISS_SUCCESS" }
+func (DismissAnnouncementAction) FailureType() string { return "ANNOUNCEMENT_DISMISS_FAILURE" }
+
+func (DismissAnnouncementAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &DismissAnnouncementAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *DismissAnnouncementAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if _, err := ReadAnnouncement(svc.DB, a.Id); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "announcement", a.Id)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	keyId := a.client.requester()
+	if keyId == "" {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrAnnouncementAnonymous.Error()}
+	}
+	if err := DismissAnnouncement(svc.DB, a.Id, keyId, svc.Clock()); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "announcement", a.Id)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{Type: a.SuccessType(), RequestId: a.RequestId, Id: a.Id}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomAnnouncementValidate(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := now.Add(-time.Hour)
+	cases := []struct {
+		a   *RoomAnnouncement
+		err error
+	}{
+		{&RoomAnnouncement{Message: "down at 5pm", Starts: now}, nil},
+		{&RoomAnnouncement{Message: "down at 5pm", Severity: "critical", Starts: now, Room: subjectTopic("1220a")}, nil},
+		{&RoomAnnouncement{Message: "  ", Starts: now}, ErrAnnouncementMessage},
+		{&RoomAnnouncement{Message: strings.Repeat("a", maxAnnouncementLength+1), Starts: now}, ErrAnnouncementMessage},
+		{&RoomAnnouncement{Message: "down at 5pm", Severity: "loud", Starts: now}, ErrAnnouncementSeverity},
+		{&RoomAnnouncement{Message: "down at 5pm", Starts: now, Ends: &before}, ErrAnnouncementWindow},
+		{&RoomAnnouncement{Message: "down at 5pm", Starts: now, Room: "lobby"}, ErrAnnouncementRoom},
+	}
+
+	for i, c := range cases {
+		if err := c.a.validate(); err != c.err {
+			t.Errorf("case %d expected error %v, got: %v", i, c.err, err)
+		}
+	}
+}
+
+func TestHelloAnnouncements(t *testing.T) {
+	defer resetTestData(appDB, "announcements", "announcement_dismissals")
+	now := time.Now()
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+
+	global := &RoomAnnouncement{Message: "down for maintenance at 5pm", Severity: "warning"}
+	room := &RoomAnnouncement{Message: "this subject is being migrated", Room: subjectTopic("1220a"), Starts: now.Add(-time.Second), Ends: &later}
+	scheduled := &RoomAnnouncement{Message: "not yet", Starts: later}
+	ended := &RoomAnnouncement{Message: "over", Starts: now.Add(-2 * time.Hour), Ends: &earlier}
+	for _, a := range []*RoomAnnouncement{global, room, scheduled, ended} {
+		if err := SaveAnnouncement(appDB, a, now.Add(-time.Minute)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	hello := func(keyId string) []string {
+		a := HelloAction{}.Parse("req", json.RawMessage(`{"keyId":"`+keyId+`"}`))
+		res := a.Exec()
+		if res.Error != "" {
+			t.Fatal(res.Error)
+		}
+		ids := []string{}
+		for _, an := range res.Data.(map[string]interface{})["announcements"].([]*RoomAnnouncement) {
+			ids = append(ids, an.Id)
+		}
+		return ids
+	}
+	expect := func(label string, got []string, want ...*RoomAnnouncement) {
+		ids := []string{}
+		for _, a := range want {
+			ids = append(ids, a.Id)
+		}
+		if strings.Join(got, ",") != strings.Join(ids, ",") {
+			t.Errorf("%s: expected announcements %v, got: %v", label, ids, got)
+		}
+	}
+
+	// clients connecting while announcements are active get them, but not scheduled or ended ones
+	expect("connect", hello("reader"), global, room)
+
+	// dismissed announcements aren't sent again on reconnect, to that user
+	if err := DismissAnnouncement(appDB, global.Id, "reader", now); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("dismissed", hello("reader"), room)
+	expect("other user", hello("someone else"), global, room)
+	expect("anonymous", hello(""), global, room)
+
+	// editing an announcement shows it again
+	global.Message = "down for maintenance at 6pm"
+	if err := SaveAnnouncement(appDB, global, now.Add(time.Minute)); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("edited", hello("reader"), global, room)
+
+	// deleting removes dismissals with the announcement
+	if err := DeleteAnnouncement(appDB, global.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("deleted", hello("reader"), room)
+	var dismissals int
+	if err := appDB.QueryRow("select count(1) from announcement_dismissals").Scan(&dismissals); err != nil || dismissals != 0 {
+		t.Errorf("expected dismissals to be deleted, got: %d %v", dismissals, err)
+	}
+
+	// ended announcements are removed after announcementRetention
+	removeEndedAnnouncements(appDB, now.Add(announcementRetention))
+	if _, err := ReadAnnouncement(appDB, ended.Id); err != ErrNotFound {
+		t.Errorf("expected ended announcement to be removed, got: %v", err)
+	}
+	if _, err := ReadAnnouncement(appDB, room.Id); err != nil {
+		t.Errorf("expected active announcement to be kept, got: %v", err)
+	}
+}
+
+func TestAnnouncementBroadcast(t *testing.T) {
+	defer resetTestData(appDB, "announcements", "announcement_dismissals")
+
+	now := time.Now()
+	svc := newTestService()
+	svc.Config.ModerationToken = "matrix"
+	svc.Clock = func() time.Time { return now }
+	hub := newRoom()
+	go hub.run()
+	svc.Hub = hub
+	admin := &Client{svc: svc, hub: hub, send: make(chan []byte, 8)}
+	member := &Client{svc: svc, hub: hub, send: make(chan []byte, 8)}
+	hub.register <- admin
+	hub.register <- member
+	hub.subscribe <- &subscription{client: member, topic: subjectTopic("1220a")}
+
+	received := func(c *Client) string {
+		select {
+		case data := <-c.send:
+			res := &ClientResponse{}
+			json.Unmarshal(data, res)
+			return res.Type
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+	exec := func(a ClientRequestAction) *ClientResponse {
+		a.(ClientBoundAction).SetClient(admin)
+		res := a.Exec()
+		if res.Error != "" {
+			t.Fatal(res.Error)
+		}
+		return res
+	}
+
+	// room announcements go to subscribers as soon as they're saved
+	res := exec(SaveAnnouncementAction{}.Parse("req", json.RawMessage(`{"token":"matrix","announcement":{"message":"migrating","room":"subject:1220a"}}`)))
+	id := res.Data.(*RoomAnnouncement).Id
+	if typ := received(member); typ != "ANNOUNCEMENT" {
+		t.Errorf("expected subscriber to be sent the announcement, got: %q", typ)
+	}
+	if typ := received(admin); typ != "" {
+		t.Errorf("expected clients outside the room not to be sent it, got: %q", typ)
+	}
+
+	// global announcements go to everyone
+	exec(SaveAnnouncementAction{}.Parse("req", json.RawMessage(`{"token":"matrix","announcement":{"message":"down at 5pm"}}`)))
+	for _, c := range []*Client{member, admin} {
+		if typ := received(c); typ != "ANNOUNCEMENT" {
+			t.Errorf("expected every client to be sent the global announcement, got: %q", typ)
+		}
+	}
+
+	// syncing again doesn't resend, deleting expires
+	if err := svc.Announcements.sync(svc, now); err != nil {
+		t.Fatal(err.Error())
+	}
+	exec(DeleteAnnouncementAction{}.Parse("req", json.RawMessage(`{"token":"matrix","id":"`+id+`"}`)))
+	if typ := received(member); typ != "ANNOUNCEMENT_EXPIRED" {
+		t.Errorf("expected subscriber to be sent the expiry, got: %q", typ)
+	}
+
+	// non-admins can't announce
+	a := SaveAnnouncementAction{}.Parse("req", json.RawMessage(`{"token":"wrong","announcement":{"message":"hi"}}`))
+	a.(ClientBoundAction).SetClient(member)
+	if res := a.Exec(); res.Error != ErrNotModerator.Error() {
+		t.Errorf("expected non-admins to be refused, got: %q", res.Error)
+	}
+}
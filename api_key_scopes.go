@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Subprimer api keys
+//
+// A key can be limited to a list of subprimers, so partners can run their own
+// scripts against their part of the archive without an admin key. limited keys
+// only archive & read urls that fall under their subprimers, & only through
+// actions that say what they act on, everything else is refused. the key's
+// user must be an owner or member of each subprimer when the key is issued,
+// keys are revoked if their user stops being one. keys issued with the read
+// scope connect to the websocket with an "Authorization: Bearer" header &
+// act for their user, websocket actions are checked against the key like http
+// requests are. every use of a key is recorded in the api_key_log table
+
+// apiKeyScopeErrCode is set as the code of responses refused because of a key's scopes
+const apiKeyScopeErrCode = "API_KEY_SCOPE"
+
+var (
+	// ErrApiKeySubprimer is returned when a key limited to subprimers is used outside them
+	ErrApiKeySubprimer = fmt.Errorf("api key isn't allowed to act outside it's subprimers")
+	// ErrApiKeySubprimerRole is returned when limiting a key to a subprimer it's user isn't an owner or member of
+	ErrApiKeySubprimerRole = fmt.Errorf("api keys can only be limited to subprimers their user owns or is a member of")
+	// ErrUnknownSubprimer is returned when limiting a key to a subprimer that doesn't exist
+	ErrUnknownSubprimer = fmt.Errorf("api keys can only be limited to subprimers that exist")
+)
+
+// apiKeyUnscopedActions can be sent by keys limited to subprimers without
+// naming what they act on
+var apiKeyUnscopedActions = map[string]bool{
+	HelloAction{}.Type():  true,
+	WhoAmIAction{}.Type(): true,
+	PingAction{}.Type():   true,
+}
+
+// apiKeyScoped is implemented by actions that act on urls or subprimers, so
+// keys limited to subprimers can be checked against them
+type apiKeyScoped interface {
+	// apiScope lists the urls & subprimer ids the action reads or archives
+	apiScope() (urls, subprimers []string)
+}
+
+func (a *FetchUrlAct) apiScope() ([]string, []string)           { return []string{a.Url}, nil }
+func (a *FetchInboundLinksAct) apiScope() ([]string, []string)  { return []string{a.Url}, nil }
+func (a *FetchOutboundLinksAct) apiScope() ([]string, []string) { return []string{a.Url}, nil }
+func (a *CapabilitiesAction) apiScope() ([]string, []string)    { return []string{a.Url}, nil }
+func (a *TrialArchiveAction) apiScope() ([]string, []string)    { return []string{a.Url}, nil }
+func (a *ArchiveLinkAction) apiScope() ([]string, []string)     { return []string{a.Src, a.Dst}, nil }
+func (a *FetchSourceAction) apiScope() ([]string, []string)     { return nil, []string{a.Id} }
+func (a *FetchSourceUrlsAction) apiScope() ([]string, []string) { return nil, []string{a.Id} }
+func (a *RenameMetaKeyAction) apiScope() ([]string, []string)   { return nil, []string{a.SourceId} }
+
+// ApiKeyScope describes what the key a client connected with can do
+type ApiKeyScope struct {
+	Id     string   `json:"id"`
+	Scopes []string `json:"scopes"`
+	// subprimers the key is limited to, empty if it isn't limited
+	Subprimers []string `json:"subprimers"`
+}
+
+// scope describes the key's scopes to clients
+func (k *ApiKey) scope() *ApiKeyScope {
+	subprimers := k.Subprimers
+	if subprimers == nil {
+		subprimers = []string{}
+	}
+	return &ApiKeyScope{Id: k.Id, Scopes: k.Scopes, Subprimers: subprimers}
+}
+
+// limitedTo checks a key can act on a subprimer
+func (k *ApiKey) limitedTo(subprimer string) bool {
+	if len(k.Subprimers) == 0 {
+		return true
+	}
+	for _, id := range k.Subprimers {
+		if id == subprimer {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUrl makes sure a key can act on a url, returning ErrApiKeySubprimer if
+// the url doesn't fall under one of the key's subprimers
+func (k *ApiKey) checkUrl(db *sql.DB, url string) error {
+	if len(k.Subprimers) == 0 {
+		return nil
+	}
+	id, err := subprimerForUrl(db, url)
+	if err != nil {
+		return err
+	}
+	if id == "" || !k.limitedTo(id) {
+		return ErrApiKeySubprimer
+	}
+	return nil
+}
+
+// authorize checks an action is within a key's scopes & subprimers, returning
+// what it was checked against
+func (k *ApiKey) authorize(db *sql.DB, act ClientRequestAction) (target string, err error) {
+	if archiveActions[act.Type()] && !k.hasScope(apiScopeArchive) {
+		return "", ErrApiKeyScope
+	}
+	if len(k.Subprimers) == 0 || apiKeyUnscopedActions[act.Type()] {
+		return "", nil
+	}
+	scoped, ok := act.(apiKeyScoped)
+	if !ok {
+		return "", ErrApiKeySubprimer
+	}
+	urls, subprimers := scoped.apiScope()
+	target = strings.Join(append(append([]string{}, urls...), subprimers...), " ")
+	for _, id := range subprimers {
+		if !k.limitedTo(id) {
+			return target, ErrApiKeySubprimer
+		}
+	}
+	for _, url := range urls {
+		if err := k.checkUrl(db, url); err != nil {
+			return target, err
+		}
+	}
+	return target, nil
+}
+
+// subprimerForUrl finds the id of the most specific subprimer a url falls
+// under, the same one it's archived under. empty if there isn't one. % & _ in
+// subprimer urls are escaped, they match themselves rather than any characters
+func subprimerForUrl(db *sql.DB, url string) (string, error) {
+	var id string
+	err := db.QueryRow(`select id from sources where $1 ilike concat('%', replace(replace(replace(url, '\', '\\'), '%', '\%'), '_', '\_'), '%')
+		and deleted = false order by length(url) desc limit 1`, url).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return id, err
+}
+
+// checkSubprimerRoles makes sure keyId owns or is a member of every subprimer
+func checkSubprimerRoles(db *sql.DB, keyId string, subprimers []string) error {
+	for _, id := range subprimers {
+		var (
+			url  string
+			data []byte
+		)
+		err := db.QueryRow("select url, meta from sources where id::text = $1 and deleted = false", id).Scan(&url, &data)
+		if err == sql.ErrNoRows {
+			return ErrUnknownSubprimer
+		} else if err != nil {
+			return err
+		}
+		meta := map[string]interface{}{}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &meta); err != nil {
+				return err
+			}
+		}
+		if !newSourceAccess(id, url, meta).members[keyId] {
+			return ErrApiKeySubprimerRole
+		}
+	}
+	return nil
+}
+
+func init() {
+	// a subprimer's owners & members can change whenever it's edited
+	addEventListener(func(e *Event) {
+		if e.Type != EventSourceUpdated || appDB == nil {
+			return
+		}
+		go func() {
+			if _, err := RevalidateApiKeys(appDB, e.Subject, time.Now()); err != nil {
+				log.Infof("error revalidating api keys: %s", err.Error())
+			}
+		}()
+	})
+}
+
+// RevalidateApiKeys revokes keys limited to a subprimer whose user is no
+// longer an owner or member of all of the key's subprimers, returning them
+func RevalidateApiKeys(db *sql.DB, subprimer string, now time.Time) ([]*ApiKey, error) {
+	rows, err := db.Query("select " + apiKeyCols.String() + " from api_keys where revoked is null and subprimers <> ''")
+	if err != nil {
+		return nil, err
+	}
+	keys := []*ApiKey{}
+	for rows.Next() {
+		k, err := scanApiKey(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if len(k.Subprimers) > 0 && k.limitedTo(subprimer) {
+			keys = append(keys, k)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := []*ApiKey{}
+	for _, k := range keys {
+		err := checkSubprimerRoles(db, k.KeyId, k.Subprimers)
+		if err == nil {
+			continue
+		} else if err != ErrApiKeySubprimerRole && err != ErrUnknownSubprimer {
+			return revoked, err
+		}
+		if err := RevokeApiKey(db, k.Id, now); err != nil && err != ErrNotFound {
+			return revoked, err
+		}
+		log.Infof("revoked api key %s for %s: %s", k.Id, k.KeyId, err.Error())
+		logApiKeyAction(db, k.Id, "REVOKE", subprimer, false, err, now)
+		revoked = append(revoked, k)
+	}
+	return revoked, nil
+}
+
+// ApiKeyLogEntry is a use of an api key
+type ApiKeyLogEntry struct {
+	Created  time.Time `json:"created"`
+	ApiKeyId string    `json:"apiKeyId"`
+	// action type, or the endpoint for http requests
+	Action string `json:"action"`
+	// urls or subprimers the action was checked against
+	Target  string `json:"target"`
+	Allowed bool   `json:"allowed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// logApiKeyAction records a use of an api key. failures are logged, they don't
+// stop the action
+func logApiKeyAction(db *sql.DB, apiKeyId, action, target string, allowed bool, reason error, now time.Time) {
+	if db == nil {
+		return
+	}
+	msg := ""
+	if reason != nil {
+		msg = reason.Error()
+	}
+	if _, err := db.Exec("insert into api_key_log (created,api_key_id,action,target,allowed,error) values ($1, $2, $3, $4, $5, $6)",
+		now.Round(time.Second).In(time.UTC), apiKeyId, action, target, allowed, msg); err != nil {
+		log.Infof("error logging use of api key %s: %s", apiKeyId, err.Error())
+	}
+}
+
+// ReadApiKeyLog reads the uses of a key, newest first
+func ReadApiKeyLog(db *sql.DB, apiKeyId string) ([]*ApiKeyLogEntry, error) {
+	rows, err := db.Query("select created, api_key_id, action, target, allowed, error from api_key_log where api_key_id = $1 order by id desc", apiKeyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*ApiKeyLogEntry{}
+	for rows.Next() {
+		e := &ApiKeyLogEntry{}
+		if err := rows.Scan(&e.Created, &e.ApiKeyId, &e.Action, &e.Target, &e.Allowed, &e.Error); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// apiKeyResponse is the response for an action a client that connected with
+// an api key isn't allowed to send, nil if it's allowed or the client didn't
+// connect with a key. the key is read again so revoking it applies to open
+// connections, & every action is logged
+func (c *Client) apiKeyResponse(act ClientRequestAction, reqId string) *ClientResponse {
+	if c == nil || c.apiKey == nil {
+		return nil
+	}
+	s := c.service()
+	k, err := readApiKey(s.DB, c.apiKey.Id)
+	target := ""
+	if err == nil {
+		target, err = k.authorize(s.DB, act)
+	}
+	logApiKeyAction(s.DB, c.apiKey.Id, act.Type(), target, err == nil, err, s.Clock())
+	if err == nil {
+		return nil
+	}
+	res := &ClientResponse{Type: act.FailureType(), RequestId: reqId, Error: err.Error()}
+	if err == ErrApiKeyScope || err == ErrApiKeySubprimer {
+		res.Code = apiKeyScopeErrCode
+		if err == ErrApiKeySubprimer {
+			res.Details = map[string]string{"reason": "subprimer"}
+		}
+		res.Schema = "API_KEY_SCOPE"
+		res.Data = c.apiKey.scope()
+	} else if err != ErrInvalidApiKey {
+		s.Log.Info(err.Error())
+	}
+	return res
+}
+
+// readApiKey reads a key in use by id, ErrInvalidApiKey if it's been revoked
+func readApiKey(db *sql.DB, id string) (*ApiKey, error) {
+	k, err := scanApiKey(db.QueryRow("select "+apiKeyCols.String()+" from api_keys where id::text = $1 and revoked is null", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidApiKey
+	}
+	return k, err
+}
+
+// WhoAmIAction reports who a client is acting as, the scope of the api key
+// it connected with, if any, & the intervals it's connection is pinged at
+type WhoAmIAction struct {
+	ReqAction
+	clientAction
+}
+
+func (WhoAmIAction) Type() string        { return "WHOAMI_REQUEST" }
+func (WhoAmIAction) SuccessType() string { return "WHOAMI_SUCCESS" }
+func (WhoAmIAction) FailureType() string { return "WHOAMI_FAILURE" }
+
+func (WhoAmIAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &WhoAmIAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *WhoAmIAction) Exec() (res *ClientResponse) {
+	data := map[string]interface{}{"keyId": a.client.requester()}
+	if a.client != nil && a.client.apiKey != nil {
+		data["apiKey"] = a.client.apiKey.scope()
+	}
+	if a.client != nil && a.client.latency != nil {
+		data["latency"] = a.client.latency.latency()
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "WHOAMI",
+		Data:      data,
+		personal:  true,
+	}
+}
+
+// uniqueStrings drops empty & repeated strings, keeping their order
+func uniqueStrings(strs []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, s := range strs {
+		if s = strings.TrimSpace(s); s != "" && !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestApiKeyAuthorize(t *testing.T) {
+	limited := &ApiKey{Id: "limited", Scopes: []string{apiScopeRead}, Subprimers: []string{"partner"}}
+	unlimited := &ApiKey{Id: "unlimited", Scopes: []string{apiScopeRead, apiScopeArchive}}
+	cases := []struct {
+		key *ApiKey
+		act ClientRequestAction
+		err error
+	}{
+		{limited, &HelloAction{}, nil},
+		{limited, &WhoAmIAction{}, nil},
+		{limited, &FetchSourceAction{Id: "partner"}, nil},
+		{limited, &FetchSourceUrlsAction{Id: "other"}, ErrApiKeySubprimer},
+		{limited, &SaveMetadataAction{}, ErrApiKeySubprimer},
+		{limited, &TrialArchiveAction{Url: "http://partner.example.com"}, ErrApiKeyScope},
+		{unlimited, &FetchSourceAction{Id: "other"}, nil},
+		{unlimited, &SaveMetadataAction{}, nil},
+	}
+
+	for i, c := range cases {
+		if _, err := c.key.authorize(nil, c.act); err != c.err {
+			t.Errorf("case %d expected error %v, got: %v", i, c.err, err)
+		}
+	}
+}
+
+func TestSubprimerApiKeys(t *testing.T) {
+	defer resetTestData(appDB, "api_keys", "api_key_log")
+	const (
+		partner = "3f2c1b4a-5d6e-4f70-8192-a3b4c5d6e7f8"
+		other   = "4a3d2c5b-6e7f-4081-9203-b4c5d6e7f809"
+		missing = "5b4e3d6c-7f80-4192-a314-c5d6e7f8091a"
+		escaped = "6c5f4e7d-8091-42a3-b425-d6e7f8091a2c"
+	)
+	if _, err := appDB.Exec(`insert into sources (id,created,updated,title,url,crawl,meta) values
+		($1, now(), now(), 'partner', 'partner.example.com', true, '{"owners":["partner"]}'),
+		($2, now(), now(), 'other', 'other.example.com', true, '{"members":["someone else"]}'),
+		($3, now(), now(), 'escaped', 'open_data%.example.com', true, '{}')`, partner, other, escaped); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer appDB.Exec("delete from sources where id in ($1, $2, $3)", partner, other, escaped)
+
+	// wildcards in subprimer urls only match themselves
+	for url, expect := range map[string]string{"http://open_data%.example.com/page": escaped, "http://openXdata-anything.example.com/page": ""} {
+		if id, err := subprimerForUrl(appDB, url); err != nil || id != expect {
+			t.Errorf("expected %s to fall under subprimer %q, got: %q %v", url, expect, id, err)
+		}
+	}
+
+	scopes := []string{apiScopeRead}
+	if _, _, err := CreateSubprimerApiKey(appDB, "partner", "scripts", scopes, []string{partner, other}, time.Now()); err != ErrApiKeySubprimerRole {
+		t.Errorf("expected keys for subprimers the user has no role in to be refused, got: %v", err)
+	}
+	if _, _, err := CreateSubprimerApiKey(appDB, "partner", "scripts", scopes, []string{missing}, time.Now()); err != ErrUnknownSubprimer {
+		t.Errorf("expected keys for missing subprimers to be refused, got: %v", err)
+	}
+	k, _, err := CreateSubprimerApiKey(appDB, "partner", "scripts", scopes, []string{partner, partner}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(k.Subprimers) != 1 {
+		t.Errorf("expected repeated subprimers to be dropped, got: %v", k.Subprimers)
+	}
+
+	svc := newTestService()
+	client := &Client{svc: svc, apiKey: k, send: make(chan []byte, 4)}
+	client.setKeyId(k.KeyId)
+	send := func(typ, data string) *ClientResponse {
+		return client.HandleRequestAction(typ, "req", false, "", json.RawMessage(data))
+	}
+
+	// websocket actions are checked against the key's subprimers
+	if res := send("URL_FETCH_REQUEST", `{"url":"http://partner.example.com/page"}`); res.Code == apiKeyScopeErrCode {
+		t.Errorf("expected urls under the key's subprimers to be allowed, got: %s", res.Error)
+	}
+	if res := send("URL_FETCH_REQUEST", `{"url":"http://other.example.com/page"}`); res.Code != apiKeyScopeErrCode {
+		t.Errorf("expected urls outside the key's subprimers to be refused, got: %q", res.Code)
+	}
+	res := send("WHOAMI_REQUEST", `{}`)
+	if scope, ok := res.Data.(map[string]interface{})["apiKey"].(*ApiKeyScope); !ok || scope.Id != k.Id || len(scope.Subprimers) != 1 {
+		t.Errorf("expected whoami to describe the key, got: %v", res.Data)
+	}
+
+	entries, err := ReadApiKeyLog(appDB, k.Id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 3 || !entries[0].Allowed || entries[1].Allowed || entries[1].Target != "http://other.example.com/page" {
+		t.Errorf("expected every action to be logged with the key, got: %d entries", len(entries))
+	}
+
+	// keys are revoked once their user stops being an owner or member
+	if revoked, err := RevalidateApiKeys(appDB, partner, time.Now()); err != nil || len(revoked) != 0 {
+		t.Errorf("expected the key to stay valid, got: %d revoked %v", len(revoked), err)
+	}
+	if _, err := appDB.Exec(`update sources set meta = '{"owners":[]}' where id = $1`, partner); err != nil {
+		t.Fatal(err.Error())
+	}
+	if revoked, err := RevalidateApiKeys(appDB, partner, time.Now()); err != nil || len(revoked) != 1 {
+		t.Errorf("expected the key to be revoked, got: %d revoked %v", len(revoked), err)
+	}
+	if res := send("URL_FETCH_REQUEST", `{"url":"http://partner.example.com/page"}`); res.Error != ErrInvalidApiKey.Error() {
+		t.Errorf("expected open connections to stop working once the key is revoked, got: %q", res.Error)
+	}
+}
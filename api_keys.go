@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// API keys
+//
+// External systems that don't speak the websocket protocol authenticate with
+// an api key, sent as a bearer token. keys act for a user's key id, so
+// archives they request are checked & retained as if the user made them, but
+// can only be used for the scopes they're issued with. Admins issue & revoke
+// keys at /admin/api-keys. tokens are only shown when a key is issued, only
+// their hash is stored. keys can also be limited to subprimers, see
+// api_key_scopes.go
+
+const (
+	// apiScopeArchive allows requesting archives through POST /hooks/archive
+	apiScopeArchive = "archive"
+	// apiScopeExport allows exporting the user's data, through GET /exports or
+	// USER_EXPORT_REQUEST
+	apiScopeExport = "export"
+	// apiScopeRead allows connecting to the websocket api with the key & reading through it
+	apiScopeRead = "read"
+	// prefix of api key tokens, so leaked tokens are easy to spot
+	apiKeyTokenPrefix = "pb_"
+)
+
+// apiKeyScopes are the scopes keys can be issued with
+var apiKeyScopes = []string{apiScopeArchive, apiScopeExport, apiScopeRead}
+
+var (
+	// ErrInvalidApiKey is returned for missing, unknown or revoked api keys
+	ErrInvalidApiKey = fmt.Errorf("invalid api key")
+	// ErrApiKeyScope is returned when an api key is used for a scope it wasn't issued with
+	ErrApiKeyScope = fmt.Errorf("api key doesn't have the required scope")
+)
+
+// ApiKey lets an external system act for a user within it's scopes
+type ApiKey struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// key id of the user the api key acts for
+	KeyId  string   `json:"keyId"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ids of the subprimers the key is limited to, empty if it isn't limited
+	Subprimers []string `json:"subprimers,omitempty"`
+	// when the key was revoked, nil if it's in use
+	Revoked *time.Time `json:"revoked,omitempty"`
+
+	tokenHash  string
+	scopes     string
+	subprimers string
+}
+
+// apiKeyCols are the columns of api_keys
+var apiKeyCols = &columnSet{
+	table:   "api_keys",
+	columns: []string{"id", "created", "key_id", "name", "token_hash", "scopes", "revoked", "subprimers"},
+}
+
+// scanTargets maps apiKeyCols to the key's fields
+func (k *ApiKey) scanTargets() scanTargets {
+	return scanTargets{
+		"id":         &k.Id,
+		"created":    &k.Created,
+		"key_id":     &k.KeyId,
+		"name":       &k.Name,
+		"token_hash": &k.tokenHash,
+		"scopes":     &k.scopes,
+		"revoked":    &k.Revoked,
+		"subprimers": &k.subprimers,
+	}
+}
+
+// scanApiKey reads a key selected with apiKeyCols
+func scanApiKey(row sqlScannable) (*ApiKey, error) {
+	k := &ApiKey{}
+	if err := apiKeyCols.scan(row, k.scanTargets()); err != nil {
+		return nil, err
+	}
+	k.Scopes = strings.Fields(k.scopes)
+	k.Subprimers = strings.Fields(k.subprimers)
+	return k, nil
+}
+
+// hasScope checks if a key was issued with a scope
+func (k *ApiKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hashApiKeyToken is the hash api key tokens are stored & looked up by
+func hashApiKeyToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newApiKeyToken generates a random token
+func newApiKeyToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyTokenPrefix + hex.EncodeToString(buf), nil
+}
+
+// CreateApiKey issues a key acting for keyId, returning it with it's token.
+// the token can't be read again
+func CreateApiKey(db *sql.DB, keyId, name string, scopes []string, now time.Time) (*ApiKey, string, error) {
+	return CreateSubprimerApiKey(db, keyId, name, scopes, nil, now)
+}
+
+// CreateSubprimerApiKey issues a key limited to a list of subprimers, keyId
+// must be an owner or member of each. the key isn't limited if subprimers is empty
+func CreateSubprimerApiKey(db *sql.DB, keyId, name string, scopes, subprimers []string, now time.Time) (*ApiKey, string, error) {
+	keyId = strings.TrimSpace(keyId)
+	if keyId == "" {
+		return nil, "", fmt.Errorf("api keys need a keyId to act for")
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("api keys need at least one scope, one of %v", apiKeyScopes)
+	}
+	for _, s := range scopes {
+		if !isApiKeyScope(s) {
+			return nil, "", fmt.Errorf("unknown api key scope: %s", s)
+		}
+	}
+	subprimers = uniqueStrings(subprimers)
+	if err := checkSubprimerRoles(db, keyId, subprimers); err != nil {
+		return nil, "", err
+	}
+
+	token, err := newApiKeyToken()
+	if err != nil {
+		return nil, "", err
+	}
+	k := &ApiKey{
+		Id:         uuid.New(),
+		Created:    now.Round(time.Second).In(time.UTC),
+		KeyId:      keyId,
+		Name:       strings.TrimSpace(name),
+		Scopes:     scopes,
+		Subprimers: subprimers,
+		tokenHash:  hashApiKeyToken(token),
+	}
+	_, err = db.Exec("insert into api_keys (id,created,key_id,name,token_hash,scopes,subprimers) values ($1, $2, $3, $4, $5, $6, $7)",
+		k.Id, k.Created, k.KeyId, k.Name, k.tokenHash, strings.Join(k.Scopes, " "), strings.Join(k.Subprimers, " "))
+	if err = checkWriteErr(err); err != nil {
+		return nil, "", err
+	}
+	return k, token, nil
+}
+
+func isApiKeyScope(scope string) bool {
+	for _, s := range apiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadApiKeys reads the keys acting for a key id, newest first. every key is read if keyId is empty
+func ReadApiKeys(db *sql.DB, keyId string) ([]*ApiKey, error) {
+	rows, err := db.Query("select "+apiKeyCols.String()+" from api_keys where $1 = '' or key_id = $1 order by created desc", keyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*ApiKey{}
+	for rows.Next() {
+		k, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeApiKey stops a key from being used, returning ErrNotFound if it doesn't exist
+func RevokeApiKey(db *sql.DB, id string, now time.Time) error {
+	res, err := db.Exec("update api_keys set revoked = $2 where id::text = $1 and revoked is null", id, now.Round(time.Second).In(time.UTC))
+	if err = checkWriteErr(err); err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// authenticateApiKey reads the key a token belongs to, checking it's been
+// issued with scope. revoked keys are invalid
+func authenticateApiKey(db *sql.DB, token, scope string) (*ApiKey, error) {
+	if !strings.HasPrefix(token, apiKeyTokenPrefix) {
+		return nil, ErrInvalidApiKey
+	}
+	k, err := scanApiKey(db.QueryRow("select "+apiKeyCols.String()+" from api_keys where token_hash = $1 and revoked is null", hashApiKeyToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidApiKey
+	} else if err != nil {
+		return nil, err
+	}
+	if !k.hasScope(scope) {
+		return nil, ErrApiKeyScope
+	}
+	return k, nil
+}
+
+// bearerToken reads the token from a request's "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// ApiKeysHandler lists api keys, optionally for a ?keyId=, on GET, or the audit
+// log of the key with ?log=. POST issues a key from a {"keyId","name","scopes",
+// "subprimers"} body, responding with it's token. DELETE revokes the key with ?id=
+func ApiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminConfigured(w) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if id := r.URL.Query().Get("log"); id != "" {
+			entries, err := ReadApiKeyLog(appDB, id)
+			if err != nil {
+				log.Info(err.Error())
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, entries)
+			return
+		}
+		keys, err := ReadApiKeys(appDB, r.URL.Query().Get("keyId"))
+		if err != nil {
+			log.Info(err.Error())
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, keys)
+	case "POST":
+		req := struct {
+			KeyId      string   `json:"keyId"`
+			Name       string   `json:"name"`
+			Scopes     []string `json:"scopes"`
+			Subprimers []string `json:"subprimers"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		k, token, err := CreateSubprimerApiKey(appDB, req.KeyId, req.Name, req.Scopes, req.Subprimers, time.Now())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"key": k, "token": token})
+	case "DELETE":
+		if err := RevokeApiKey(appDB, r.URL.Query().Get("id"), time.Now()); err == ErrNotFound {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "api key not found"})
+			return
+		} else if err != nil {
+			log.Info(err.Error())
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
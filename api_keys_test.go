@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBearerToken(t *testing.T) {
+	cases := []struct {
+		header, token string
+	}{
+		{"", ""},
+		{"Bearer pb_abc", "pb_abc"},
+		{"bearer  pb_abc ", "pb_abc"},
+		{"Basic YWRtaW46YWRtaW4=", ""},
+		{"Bearer", ""},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("POST", "/hooks/archive", nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		if got := bearerToken(r); got != c.token {
+			t.Errorf("case %d expected token %q, got: %q", i, c.token, got)
+		}
+	}
+}
+
+func TestApiKeys(t *testing.T) {
+	defer resetTestData(appDB, "api_keys")
+
+	if _, _, err := CreateApiKey(appDB, "key", "ci", []string{"delete_everything"}, time.Now()); err == nil {
+		t.Errorf("expected unknown scopes to be rejected")
+	}
+	if _, _, err := CreateApiKey(appDB, "", "ci", []string{apiScopeArchive}, time.Now()); err == nil {
+		t.Errorf("expected keys without a keyId to be rejected")
+	}
+
+	k, token, err := CreateApiKey(appDB, "key", "ci", []string{apiScopeArchive}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, err := authenticateApiKey(appDB, token, apiScopeArchive); err != nil || got.Id != k.Id || got.KeyId != "key" {
+		t.Errorf("expected token to authenticate key %s, got: %v %v", k.Id, got, err)
+	}
+	if _, err := authenticateApiKey(appDB, token, "admin"); err != ErrApiKeyScope {
+		t.Errorf("expected error %v, got: %v", ErrApiKeyScope, err)
+	}
+	if _, err := authenticateApiKey(appDB, token+"0", apiScopeArchive); err != ErrInvalidApiKey {
+		t.Errorf("expected error %v, got: %v", ErrInvalidApiKey, err)
+	}
+
+	keys, err := ReadApiKeys(appDB, "key")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 1 || len(keys[0].Scopes) != 1 || keys[0].Revoked != nil {
+		t.Errorf("expected one key in use, got: %v", keys)
+	}
+
+	if err := RevokeApiKey(appDB, k.Id, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := RevokeApiKey(appDB, k.Id, time.Now()); err != ErrNotFound {
+		t.Errorf("expected revoking twice to return not found, got: %v", err)
+	}
+	if _, err := authenticateApiKey(appDB, token, apiScopeArchive); err != ErrInvalidApiKey {
+		t.Errorf("expected revoked keys to be invalid, got: %v", err)
+	}
+}
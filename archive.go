@@ -4,39 +4,63 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/datatogether/core"
-	"github.com/ipfs/go-datastore"
 	"time"
 )
 
-// ValidArchivingUrl checks to see if this url pattern-matches the list of subprimers
-// TODO - there are many ways to spoof this, replace with actual URL matching.
+// defaultFollowDelay is how long archiving waits between GET's of the links a
+// page references, to avoid bombing servers with requests
+const defaultFollowDelay = time.Second * 3
+
+// ValidArchivingUrl checks a url with the default service over db, see Service.ValidArchivingUrl
 func ValidArchivingUrl(db *sql.DB, url string) error {
+	return defaultService().withDB(db).ValidArchivingUrl(url)
+}
+
+// ValidArchivingUrl checks to see if this url pattern-matches the list of subprimers.
+// urls rejected recently are rejected again without a query, see archiveRejections
+// TODO - there are many ways to spoof this, replace with actual URL matching.
+func (s *Service) ValidArchivingUrl(url string) error {
+	if err := s.Rejections.check(rejectedNoSubprimers, url); err != nil {
+		return err
+	}
 	var exists bool
-	err := db.QueryRow("select exists(select 1 from subprimers where $1 ilike concat('%', url ,'%'))", url).Scan(&exists)
+	err := s.DB.QueryRow("select exists(select 1 from sources where $1 ilike concat('%', url ,'%') and deleted = false)", url).Scan(&exists)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		return fmt.Errorf("Oops! Only urls contained in subprimers can be archived. cannot archive %s", url)
+		err := &notInSubprimerError{url: url}
+		s.Rejections.add(rejectedNoSubprimers, url, err)
+		return err
 	}
 	return nil
 }
 
-func (c *Client) ArchiveUrl(db *sql.DB, reqId, url string) {
-	if err := ValidArchivingUrl(db, url); err != nil {
-		log.Info(err.Error())
+func (c *Client) ArchiveUrl(db *sql.DB, reqId, rawurl string) {
+	c.service().withDB(db).ArchiveUrlFor(c, reqId, rawurl)
+}
+
+// ArchiveUrlFor archives a url on behalf of a websocket client, sending it
+// progress as the url & the links it references are fetched
+func (s *Service) ArchiveUrlFor(c *Client, reqId, rawurl string) {
+	if status := maintenance.Status(); status != nil {
 		c.SendResponse(&ClientResponse{
 			Type:      "URL_ARCHIVE_ERROR",
 			RequestId: reqId,
-			Error:     err.Error(),
+			Error:     ErrMaintenanceMode.Error(),
+			Code:      maintenanceErrCode,
+			Schema:    "MAINTENANCE_STATUS",
+			Data:      status,
 		})
 		return
 	}
 
-	// TODO - plumb userId into this
-	_, err := db.Exec("insert into archive_requests (created,url,user_id) values ($1, $2, $3)", time.Now().Round(time.Second).In(time.UTC), url, "")
+	// redact before anything else so the original url is never logged or stored
+	url, redacted, err := s.RedactArchivingUrl(rawurl)
 	if err != nil {
-		log.Info(err.Error())
+		if !rejectedForArchiving(err) {
+			s.Log.Info(err.Error())
+		}
 		c.SendResponse(&ClientResponse{
 			Type:      "URL_ARCHIVE_ERROR",
 			RequestId: reqId,
@@ -45,38 +69,67 @@ func (c *Client) ArchiveUrl(db *sql.DB, reqId, url string) {
 		return
 	}
 
-	log.Info("archiving %s", url)
-	u := &core.Url{Url: url}
-	if _, err := u.ParsedUrl(); err != nil {
-		log.Info(err.Error())
+	if err := s.ValidArchivingUrl(url); err != nil {
+		if !rejectedForArchiving(err) {
+			s.Log.Info(err.Error())
+		}
+		c.SendResponse(&ClientResponse{
+			Type:      "URL_ARCHIVE_ERROR",
+			RequestId: reqId,
+			Error:     err.Error(),
+		})
+		return
+	}
+	if err := bandwidth.Check(); err != nil {
+		c.SendResponse(&ClientResponse{
+			Type:      "URL_ARCHIVE_ERROR",
+			RequestId: reqId,
+			Error:     err.Error(),
+			Code:      bandwidthCapErrCode,
+			Schema:    "BANDWIDTH_STATUS",
+			Data:      bandwidth.Status(),
+		})
+		return
+	}
+	if err := s.checkArchiveAccess(url, c.identity()); err != nil {
+		s.Log.Info(err.Error())
 		c.SendResponse(&ClientResponse{
 			Type:      "URL_ARCHIVE_ERROR",
 			RequestId: reqId,
-			Error:     fmt.Sprintf("url parse error: %s", err.Error()),
+			Error:     err.Error(),
 		})
 		return
 	}
 
-	if err := u.Read(store); err != nil {
-		if err == core.ErrNotFound {
-			if err := u.Save(store); err != nil {
-				log.Info(err.Error())
-				c.SendResponse(&ClientResponse{
-					Type:      "URL_ARCHIVE_ERROR",
-					RequestId: reqId,
-					Error:     fmt.Sprintf("internal server error"),
-				})
-				return
-			}
-		} else {
-			log.Info(err.Error())
-			c.SendResponse(&ClientResponse{
-				Type:      "URL_ARCHIVE_ERROR",
-				RequestId: reqId,
-				Error:     fmt.Sprintf("internal server error"),
-			})
-			return
-		}
+	s.Log.Infof("archiving %s", url)
+	manifest := s.jobManifest(url, nil)
+	class := archiveRetention(c.requester())
+	u, err := s.recordArchiveIntake(url, redacted, archiveRequester{userId: c.requester()})
+	if err == ErrMaintenanceMode {
+		c.SendResponse(&ClientResponse{
+			Type:      "URL_ARCHIVE_ERROR",
+			RequestId: reqId,
+			Error:     err.Error(),
+			Code:      maintenanceErrCode,
+			Schema:    "MAINTENANCE_STATUS",
+			Data:      maintenance.Status(),
+		})
+		return
+	} else if rejectedForArchiving(err) {
+		c.SendResponse(&ClientResponse{
+			Type:      "URL_ARCHIVE_ERROR",
+			RequestId: reqId,
+			Error:     err.Error(),
+		})
+		return
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		c.SendResponse(&ClientResponse{
+			Type:      "URL_ARCHIVE_ERROR",
+			RequestId: reqId,
+			Error:     fmt.Sprintf("internal server error"),
+		})
+		return
 	}
 
 	// Initial get succeeded, let the client know
@@ -88,9 +141,9 @@ func (c *Client) ArchiveUrl(db *sql.DB, reqId, url string) {
 	})
 
 	// Perform base GET request
-	_, links, err := u.Get(store)
+	_, links, err := s.getRetained(u, nil, class)
 	if err != nil {
-		log.Info(err.Error())
+		s.Log.Info(err.Error())
 		c.SendResponse(&ClientResponse{
 			Type:      "URL_ARCHIVE_ERROR",
 			RequestId: reqId,
@@ -104,16 +157,22 @@ func (c *Client) ArchiveUrl(db *sql.DB, reqId, url string) {
 		Type:      FetchOutboundLinksAct{}.SuccessType(),
 		RequestId: "server",
 		Schema:    "LINK_ARRAY",
-		Data:      links,
+		Data:      wholePage(readLinkDetails(s.DB, links, s.Clock())),
 	})
 
-	go func(db *sql.DB, links []*core.Link) {
+	go func(links []*core.Link) {
+		fetched := 0
 		// GET each destination link from this page in parallel
 		for _, l := range links {
 			// need a sleep here to avoid bombing server with requests
 			// tooooo hard, also we sleep first b/c the websocket trips up if
 			// we jam the messages to hard.
-			time.Sleep(time.Second * 3)
+			time.Sleep(s.FollowDelay)
+
+			// urls outside of all subprimers aren't followed
+			if isOrphaned(l.Dst) {
+				continue
+			}
 
 			c.SendResponse(&ClientResponse{
 				Type:      "URL_SET_LOADING",
@@ -124,8 +183,8 @@ func (c *Client) ArchiveUrl(db *sql.DB, reqId, url string) {
 				},
 			})
 
-			if _, _, err := l.Dst.Get(store); err != nil {
-				log.Info(err.Error())
+			if _, _, err := s.getRetained(l.Dst, nil, class); err != nil {
+				s.Log.Info(err.Error())
 				c.SendResponse(&ClientResponse{
 					Type:      "URL_SET_ERROR",
 					RequestId: "server",
@@ -134,6 +193,8 @@ func (c *Client) ArchiveUrl(db *sql.DB, reqId, url string) {
 						"error": err.Error(),
 					},
 				})
+			} else {
+				fetched++
 			}
 
 			c.SendResponse(&ClientResponse{
@@ -145,52 +206,76 @@ func (c *Client) ArchiveUrl(db *sql.DB, reqId, url string) {
 				},
 			})
 		}
-	}(db, links)
+		s.summarizeArchive(u, manifest, len(links), fetched)
+	}(links)
 }
 
-// ArchiveUrl GET's a url and if it's an HTML page, any links it directly references
-func ArchiveUrl(db *sql.DB, url string, done func(err error)) (*core.Url, []*core.Link, error) {
-	u := &core.Url{Url: url}
-	if _, err := u.ParsedUrl(); err != nil {
+// ArchiveUrl archives a url with the default service over db, see Service.ArchiveUrl
+func ArchiveUrl(db *sql.DB, rawurl string, opts ArchiveOpts, done func(err error)) (*core.Url, []*core.Link, error) {
+	return defaultService().withDB(db).ArchiveUrl(rawurl, opts, done)
+}
+
+// ArchiveUrl GET's a url and if it's an HTML page, any links it directly references.
+// opts can record the job's fetches, or replay them from an earlier recording
+func (s *Service) ArchiveUrl(rawurl string, opts ArchiveOpts, done func(err error)) (*core.Url, []*core.Link, error) {
+	if err := maintenance.Check(); err != nil {
+		done(err)
+		return nil, nil, err
+	}
+	if err := bandwidth.Check(); err != nil {
 		done(err)
 		return nil, nil, err
 	}
 
-	if err := u.Read(store); err != nil {
-		if err == core.ErrNotFound {
-			if err := u.Save(store); err != nil {
-				done(err)
-				return nil, nil, err
-			}
-		} else {
-			done(err)
-			return nil, nil, err
-		}
+	url, redacted, err := s.RedactArchivingUrl(rawurl)
+	if err != nil {
+		done(err)
+		return nil, nil, err
 	}
 
-	// Perform GET request
-	_, links, err := u.Get(store)
+	rec, err := s.newFetchRecording(url, opts)
+	if err != nil {
+		done(err)
+		return nil, nil, err
+	}
+
+	u, err := s.readOrCreateUrl(url, redacted)
 	if err != nil {
+		done(err)
+		return nil, nil, err
+	}
+	manifest := s.jobManifest(url, rec)
+
+	// Perform GET request
+	_, links, err := s.getUrl(u, rec)
+	if err = checkWriteErr(err); err != nil {
 		done(err)
 		return u, links, err
 	}
 
 	tasks := len(links)
 	errs := make(chan error, tasks)
+	// links fetched without error, counted before each send on errs
+	fetched := 0
 
-	go func(store datastore.Datastore, links []*core.Link) {
+	go func(links []*core.Link) {
 		// GET each destination link from this page in parallel
 		for _, l := range links {
-			if _, _, err := l.Dst.Get(store); err != nil {
-				log.Info(err.Error())
+			// urls outside of all subprimers aren't followed
+			if !isOrphaned(l.Dst) {
+				if _, _, err := s.getUrl(l.Dst, rec); err != nil {
+					s.Log.Info(err.Error())
+				} else {
+					fetched++
+				}
 			}
 			errs <- nil
 
 			// need a sleep here to avoid bombing server with requests
 			// tooooo hard
-			time.Sleep(time.Second * 3)
+			time.Sleep(s.FollowDelay)
 		}
-	}(store, links)
+	}(links)
 
 	go func() {
 		for i := 0; i < tasks; i++ {
@@ -200,15 +285,97 @@ func ArchiveUrl(db *sql.DB, url string, done func(err error)) (*core.Url, []*cor
 				return
 			}
 		}
+		s.summarizeArchive(u, manifest, tasks, fetched)
 		done(nil)
 	}()
 
 	return u, links, err
 }
 
-func ArchiveUrlSync(db *sql.DB, url string) (*core.Url, error) {
-	done := make(chan error)
-	u, _, err := ArchiveUrl(db, url, func(err error) {
+// archiveRequester describes who an archive request came from
+type archiveRequester struct {
+	userId string
+	// anonymous requests come from people without an account, identified by a
+	// hash of their ip address
+	anonymous bool
+	requester string
+	// via is the page a link archive request was made from. the request falls
+	// under via's subprimer instead of the url's own
+	via string
+}
+
+// recordArchiveIntake writes an archive request for an already-redacted url, stamped
+// with the config snapshot of the subprimer it falls under, & reads (or creates) it's url record
+// TODO - plumb userId into this for registered users
+func (s *Service) recordArchiveIntake(url string, redacted []string, r archiveRequester) (*core.Url, error) {
+	// check the url parses before recording a request for it
+	if _, err := (&core.Url{Url: url}).ParsedUrl(); err != nil {
+		return nil, ErrInvalidArchivingUrl
+	}
+	if _, err := s.recordArchiveRequest(url, r); err != nil {
+		return nil, err
+	}
+	return s.readOrCreateUrl(url, redacted)
+}
+
+// recordArchiveRequest writes an archive request for an already-redacted url,
+// returning the request's id
+func (s *Service) recordArchiveRequest(url string, r archiveRequester) (id int64, err error) {
+	subprimerUrl := url
+	if r.via != "" {
+		subprimerUrl = r.via
+	}
+	snapshot, err := snapshotForUrl(s.DB, subprimerUrl)
+	if err = checkWriteErr(err); err != nil {
+		return 0, err
+	}
+
+	err = s.DB.QueryRow("insert into archive_requests (created,url,user_id,config_snapshot,anonymous,requester,via) values ($1, $2, $3, $4, $5, $6, $7) returning id",
+		s.Clock().Round(time.Second).In(time.UTC), url, r.userId, snapshot, r.anonymous, r.requester, r.via).Scan(&id)
+	if err = checkWriteErr(err); err != nil {
+		return
+	}
+	if !r.anonymous {
+		logArchiveAction(s.DB, r.userId, url, subprimerUrl, s.Clock())
+	}
+	return
+}
+
+// readOrCreateUrl reads a url from the store, saving it if it doesn't exist. If
+// any query params were redacted from the url, the stored record is marked
+func (s *Service) readOrCreateUrl(url string, redacted []string) (*core.Url, error) {
+	u := &core.Url{Url: url}
+	if _, err := u.ParsedUrl(); err != nil {
+		return nil, ErrInvalidArchivingUrl
+	}
+
+	if err := u.Read(s.Store); err != nil {
+		if err != ErrNotFound {
+			return nil, err
+		}
+		markRedacted(u, redacted)
+		if err := checkWriteErr(u.Save(s.Store)); err != nil {
+			return nil, err
+		}
+	} else if len(redacted) > 0 && u.Meta["redacted"] != true {
+		markRedacted(u, redacted)
+		if err := checkWriteErr(u.Save(s.Store)); err != nil {
+			return nil, err
+		}
+	}
+
+	return u, nil
+}
+
+// ArchiveUrlSync archives a url with the default service over db, see Service.ArchiveUrlSync
+func ArchiveUrlSync(db *sql.DB, url string, opts ArchiveOpts) (*core.Url, error) {
+	return defaultService().withDB(db).ArchiveUrlSync(url, opts)
+}
+
+// ArchiveUrlSync archives a url, returning once the links it references are fetched
+func (s *Service) ArchiveUrlSync(url string, opts ArchiveOpts) (*core.Url, error) {
+	done := make(chan error, 1)
+	u, _, err := s.ArchiveUrl(url, opts, func(err error) {
 		done <- err
 	})
 	if err != nil {
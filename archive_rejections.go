@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// Archive rejections
+//
+// Misconfigured integrations can submit the same invalid url for archiving
+// thousands of times. urls that don't normalize, or don't fall under any
+// subprimer, are remembered for archiveRejectionTTL keyed by reason & url, so
+// repeat submissions are rejected without touching the database. the first
+// rejection is logged, repeats are counted & logged together every
+// archiveRejectionLogInterval. rate limits are checked before urls are, so
+// repeats still count against them.
+//
+// subprimer rejections are forgotten whenever a subprimer changes, as a url
+// that didn't fall under any might now. the TTL bounds how long a rejection
+// outlives a change made without publishing EventSourceUpdated. urls are
+// remembered hashed, as a rejected url can carry credentials
+
+// reasons a url is rejected
+const (
+	rejectedInvalid      = "invalid"
+	rejectedNoSubprimers = "subprimers"
+)
+
+const (
+	// how long a rejection is remembered
+	archiveRejectionTTL = 5 * time.Minute
+	// most rejections remembered at once
+	archiveRejectionLimit = 10000
+	// how often repeat rejections are logged
+	archiveRejectionLogInterval = time.Minute
+)
+
+var (
+	// archiveRejectionStats exposes rejection counts at /debug/vars
+	archiveRejectionStats = expvar.NewMap("archiveRejections")
+	// archiveRejections is the package-level rejection cache
+	archiveRejections = newRejectionCache(archiveRejectionTTL, archiveRejectionLimit)
+)
+
+// notInSubprimerError is returned for urls that don't fall under any subprimer
+type notInSubprimerError struct {
+	url string
+}
+
+func (e *notInSubprimerError) Error() string {
+	return fmt.Sprintf("Oops! Only urls contained in subprimers can be archived. cannot archive %s", e.url)
+}
+
+// rejectedForArchiving reports weather err rejects a submitted url, as opposed
+// to being a failure to check it
+func rejectedForArchiving(err error) bool {
+	if _, ok := err.(*notInSubprimerError); ok {
+		return true
+	}
+	return err == ErrInvalidArchivingUrl || err == ErrUrlCredentials
+}
+
+// archiveRejection is a remembered rejection
+type archiveRejection struct {
+	err     error
+	expires time.Time
+}
+
+// rejectionCache remembers recently rejected urls
+type rejectionCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]*archiveRejection
+	// repeats of each reason since they were last logged
+	repeats map[string]int
+	now     func() time.Time
+}
+
+func newRejectionCache(ttl time.Duration, max int) *rejectionCache {
+	return &rejectionCache{
+		ttl:     ttl,
+		max:     max,
+		entries: map[string]*archiveRejection{},
+		repeats: map[string]int{},
+		now:     time.Now,
+	}
+}
+
+// rejectionKey is the key of a url's rejection for reason. urls are normalized
+// first, so submissions that only differ in case or encoding share a rejection.
+// urls that don't normalize are keyed as they were submitted
+func rejectionKey(reason, url string) string {
+	if normalized, err := core.NormalizeURLString(url); err == nil {
+		url = normalized
+	}
+	sum := sha256.Sum256([]byte(url))
+	return reason + " " + hex.EncodeToString(sum[:])
+}
+
+// check returns the error a url was last rejected with for reason, nil if it
+// hasn't been recently
+func (c *rejectionCache) check(reason, url string) error {
+	c.Lock()
+	defer c.Unlock()
+	key := rejectionKey(reason, url)
+	r := c.entries[key]
+	if r == nil {
+		return nil
+	}
+	if !c.now().Before(r.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	c.repeats[reason]++
+	archiveRejectionStats.Add("repeats", 1)
+	return r.err
+}
+
+// add remembers a url's rejection, logging it. when full, expired rejections
+// are dropped to make room, & rejections that still don't fit aren't remembered
+func (c *rejectionCache) add(reason, url string, err error) {
+	log.Infof("rejected url for archiving (%s): %s", reason, err.Error())
+	archiveRejectionStats.Add("rejected", 1)
+
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	if len(c.entries) >= c.max {
+		for key, r := range c.entries {
+			if !now.Before(r.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= c.max {
+			return
+		}
+	}
+	c.entries[rejectionKey(reason, url)] = &archiveRejection{err: err, expires: now.Add(c.ttl)}
+}
+
+// forget drops every rejection for reason
+func (c *rejectionCache) forget(reason string) {
+	c.Lock()
+	defer c.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, reason+" ") {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// handleEvent drops subprimer rejections when a subprimer changes
+func (c *rejectionCache) handleEvent(e *Event) {
+	if e.Type == EventSourceUpdated {
+		c.forget(rejectedNoSubprimers)
+	}
+}
+
+// flush logs & resets the count of repeat rejections
+func (c *rejectionCache) flush() {
+	c.Lock()
+	repeats := c.repeats
+	c.repeats = map[string]int{}
+	size := len(c.entries)
+	c.Unlock()
+
+	for reason, n := range repeats {
+		log.Infof("rejected %d repeat submissions of urls for archiving (%s) in the last %s, %d rejections remembered", n, reason, archiveRejectionLogInterval, size)
+	}
+}
+
+// run logs repeat rejections every archiveRejectionLogInterval
+func (c *rejectionCache) run() {
+	for range time.Tick(archiveRejectionLogInterval) {
+		c.flush()
+	}
+}
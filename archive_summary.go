@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+
+	"github.com/datatogether/core"
+	"github.com/lib/pq"
+)
+
+const (
+	// archiveSummaryKey is the meta key archive job summaries are written under
+	archiveSummaryKey = reservedMetaPrefix + "archive"
+)
+
+// archiveSummaryLock serializes summary writes, so concurrent jobs capturing
+// the same content don't both decide the latest summary is out of date
+var archiveSummaryLock sync.Mutex
+
+// ArchiveSummary describes what an archive job captured. Summaries are written
+// as metadata on the captured content under the system key id, so a capture's
+// provenance is part of the same hash chain as the metadata people write.
+// summary keys are reserved, so they never count towards consensus
+type ArchiveSummary struct {
+	Url           string `json:"url"`
+	ContentHash   string `json:"contentHash"`
+	ContentLength int64  `json:"contentLength"`
+	ContentType   string `json:"contentType"`
+	Status        int    `json:"status"`
+	// links found on the page, & how many of them were fetched
+	Links        int `json:"links"`
+	LinksFetched int `json:"linksFetched"`
+	// hash of the job's crawl manifest, see crawlManifest
+	Manifest string `json:"manifest"`
+}
+
+// summarizing reports weather archive jobs write summaries
+func (s *Service) summarizing() bool {
+	return s.Config != nil && s.Config.SystemKeyId != ""
+}
+
+// jobManifest is the manifest hash an archive job is summarized with. recorded
+// & replayed jobs use their recording's hash
+func (s *Service) jobManifest(url string, rec *fetchRecording) string {
+	if rec != nil {
+		return rec.Hash
+	}
+	if !s.summarizing() {
+		return ""
+	}
+	_, hash, err := s.newCrawlManifest(url)
+	if err != nil {
+		s.Log.Infof("error creating crawl manifest for %s: %s", url, err.Error())
+	}
+	return hash
+}
+
+// summarizeArchive writes a summary of a finished archive job. the capture is
+// already stored, failing to summarize it only logs
+func (s *Service) summarizeArchive(u *core.Url, manifest string, links, fetched int) {
+	if !s.summarizing() || u.Hash == "" {
+		return
+	}
+	sum := &ArchiveSummary{
+		Url:           u.Url,
+		ContentHash:   u.Hash,
+		ContentLength: u.ContentLength,
+		ContentType:   u.ContentType,
+		Status:        u.Status,
+		Links:         links,
+		LinksFetched:  fetched,
+		Manifest:      manifest,
+	}
+	if err := s.writeArchiveSummary(sum); err != nil {
+		s.Log.Infof("error writing archive summary for %s: %s", u.Url, err.Error())
+	}
+}
+
+// writeArchiveSummary adds a summary to the system's metadata for the captured
+// content. Summaries that only differ from the latest one by manifest aren't
+// written, so re-running a job that captures the same thing doesn't add blocks
+func (s *Service) writeArchiveSummary(sum *ArchiveSummary) error {
+	archiveSummaryLock.Lock()
+	defer archiveSummaryLock.Unlock()
+
+	m, err := core.NextMetadata(s.DB, s.Config.SystemKeyId, sum.ContentHash)
+	if err != nil {
+		return err
+	}
+	if sameCapture(m.Meta[archiveSummaryKey], sum) {
+		return nil
+	}
+
+	// keep other system keys, but not attribution, it belongs to the block it was written in
+	meta := map[string]interface{}{}
+	for key, val := range m.Meta {
+		if isReservedMetaKey(key) && key != metaAttributionKey {
+			meta[key] = val
+		}
+	}
+	meta[archiveSummaryKey] = sum
+	m.Meta = meta
+	return s.WriteSystemMetadata(m, "")
+}
+
+// sameCapture checks if a previously written summary describes the same capture
+// as sum, ignoring which job it came from
+func sameCapture(prev interface{}, sum *ArchiveSummary) bool {
+	if prev == nil {
+		return false
+	}
+	data, err := json.Marshal(prev)
+	if err != nil {
+		return false
+	}
+	p := &ArchiveSummary{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return false
+	}
+	p.Manifest = sum.Manifest
+	return *p == *sum
+}
+
+// ReadMetadataHistory reads the blocks written about a subject & it's hash
+// aliases, newest first. blocks written under systemKeyId are left out if it isn't empty
+func ReadMetadataHistory(db *sql.DB, subject, systemKeyId string, limit, offset int) ([]*core.Metadata, error) {
+	subjects, err := hashAliases(db, subject)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("select "+metadataCols.String()+" from metadata where subject = any($1) and deleted = false and ($2 = '' or key_id != $2) order by time_stamp desc, hash limit $3 offset $4",
+		pq.Array(subjects), systemKeyId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []*core.Metadata{}
+	for rows.Next() {
+		m, err := scanMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, m)
+	}
+	return blocks, rows.Err()
+}
+
+// MetadataHistoryAction lists the metadata blocks written about a subject
+type MetadataHistoryAction struct {
+	ReqAction
+	clientAction
+	pageRequest
+	Subject string `json:"subject"`
+	// leave out blocks the system wrote, like archive summaries
+	HideSystem bool `json:"hideSystem"`
+}
+
+func (MetadataHistoryAction) Type() string        { return "METADATA_HISTORY_REQUEST" }
+func (MetadataHistoryAction) SuccessType() string { return "METADATA_HISTORY_SUCCESS" }
+func (MetadataHistoryAction) FailureType() string { return "METADATA_HISTORY_FAILURE" }
+
+func (MetadataHistoryAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &MetadataHistoryAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *MetadataHistoryAction) Exec() (res *ClientResponse) {
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	hide := ""
+	if a.HideSystem && cfg != nil {
+		hide = cfg.SystemKeyId
+	}
+
+	visible, err := a.canSee(a.Subject)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	// hidden content has the same history as content nobody's described
+	blocks := []*core.Metadata{}
+	if visible {
+		blocks, err = ReadMetadataHistory(appDB, a.Subject, hide, a.fetch(), a.offset)
+	}
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	page := newPage(&a.pageRequest, blocks)
+	page.Items = metadataBadges.Details(page.Items.([]*core.Metadata))
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "METADATA_ARRAY",
+		Id:        a.Subject,
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      page,
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/datatogether/core"
+)
+
+func TestSameCapture(t *testing.T) {
+	sum := &ArchiveSummary{Url: "http://www.epa.gov", ContentHash: "1220...", ContentLength: 1024, Status: 200, Links: 3, LinksFetched: 2, Manifest: "b"}
+
+	cases := []struct {
+		prev   interface{}
+		expect bool
+	}{
+		{nil, false},
+		{"not a summary", false},
+		{&ArchiveSummary{Url: "http://www.epa.gov", ContentHash: "1220...", ContentLength: 1024, Status: 200, Links: 3, LinksFetched: 2, Manifest: "b"}, true},
+		// summaries read back from the database are maps of json values
+		{map[string]interface{}{"url": "http://www.epa.gov", "contentHash": "1220...", "contentLength": float64(1024), "contentType": "", "status": float64(200), "links": float64(3), "linksFetched": float64(2), "manifest": "a"}, true},
+		{map[string]interface{}{"url": "http://www.epa.gov", "contentHash": "1220...", "contentLength": float64(1024), "contentType": "", "status": float64(200), "links": float64(3), "linksFetched": float64(3), "manifest": "b"}, false},
+	}
+
+	for i, c := range cases {
+		if got := sameCapture(c.prev, sum); got != c.expect {
+			t.Errorf("case %d expected %t, got: %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestArchiveSummary(t *testing.T) {
+	defer resetTestData(appDB, "metadata")
+	subject := "1220c0ffee00000000000000000000000000000000000000000000000000000000aa"
+
+	svc := newTestService()
+	svc.Config.SystemKeyId = ""
+	svc.summarizeArchive(&core.Url{Url: "http://www.epa.gov", Hash: subject}, "a", 0, 0)
+	if blocks, err := ReadMetadataHistory(appDB, subject, "", 10, 0); err != nil {
+		t.Fatal(err.Error())
+	} else if len(blocks) != 0 {
+		t.Errorf("expected no summary without a system key id, got %d blocks", len(blocks))
+	}
+
+	svc.Config.SystemKeyId = "system"
+	sum := &ArchiveSummary{Url: "http://www.epa.gov", ContentHash: subject, ContentLength: 1024, ContentType: "text/html", Status: 200, Links: 3, LinksFetched: 2, Manifest: "a"}
+	if err := svc.writeArchiveSummary(sum); err != nil {
+		t.Fatal(err.Error())
+	}
+	// re-running a job that captures the same content doesn't add a block
+	again := *sum
+	again.Manifest = "b"
+	if err := svc.writeArchiveSummary(&again); err != nil {
+		t.Fatal(err.Error())
+	}
+	changed := *sum
+	changed.Status = 404
+	if err := svc.writeArchiveSummary(&changed); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := svc.WriteMetadata(&core.Metadata{KeyId: "key", Subject: subject, Meta: map[string]interface{}{"title": "EPA"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	all, err := ReadMetadataHistory(appDB, subject, "", 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(all) != 3 {
+		t.Fatalf("expected 2 summaries & 1 human block, got %d blocks", len(all))
+	}
+	hashes := map[string]bool{}
+	for _, b := range all {
+		hashes[b.Hash] = true
+	}
+	chained := false
+	for _, b := range all {
+		if b.KeyId == "system" && hashes[b.Prev] {
+			chained = true
+		}
+	}
+	if !chained {
+		t.Errorf("expected summaries to be chained")
+	}
+
+	human, err := ReadMetadataHistory(appDB, subject, "system", 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(human) != 1 || human[0].KeyId != "key" {
+		t.Errorf("expected hiding system blocks to leave 1 human block, got %d", len(human))
+	}
+
+	// summary keys are reserved, they don't count towards consensus
+	con, err := calcConsensus(appDB, subject)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(con) != 1 || con["title"] == nil {
+		t.Errorf("expected consensus to only include title, got: %v", con)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Bandwidth
+//
+// Hosted deployments pay for the bytes they crawl & the bytes they serve.
+// Both are counted in memory as they're read & written, & added to per-day
+// counters in the bandwidth table every bandwidthFlushInterval, so accounting
+// survives restarts & is shared by instances. Counting is a single atomic add,
+// caps are only checked against the month's totals when they're flushed.
+//
+// With BandwidthCrawlCapGB set, crawling slows to one fetch at a time once
+// BandwidthThrottlePercent of the cap is used, & new archive requests are
+// rejected with a BANDWIDTH_CAP code once it's passed. Fetches already under
+// way carry on, throttled. Reads are never rejected by the crawl cap. Passing
+// BandwidthServedCapGB only rate limits reads if BandwidthThrottleReads is set.
+
+// EventBandwidthCapChanged is broadcast to clients when a cap starts or stops
+// limiting the deployment
+const EventBandwidthCapChanged = "BANDWIDTH_CAP_CHANGED"
+
+const (
+	// bandwidthCapErrCode is set as the code of responses rejected by a bandwidth cap
+	bandwidthCapErrCode = "BANDWIDTH_CAP"
+
+	// kinds of bandwidth
+	bandwidthCrawl  = "crawl"
+	bandwidthServed = "served"
+
+	// cap states
+	bandwidthOk        = "ok"
+	bandwidthThrottled = "throttled"
+	bandwidthCapped    = "capped"
+
+	// how often counted bytes are written & caps are checked
+	bandwidthFlushInterval = 30 * time.Second
+	// reads each client can make per minute while reads are throttled
+	bandwidthThrottledReadsPerMinute = 30
+	// bytes in a gigabyte, as bandwidth is billed
+	bytesPerGB = 1000 * 1000 * 1000
+)
+
+var (
+	// ErrBandwidthCap is returned for archive requests made after the crawl cap is passed
+	ErrBandwidthCap = fmt.Errorf("this archive has used it's crawling allowance for the month & isn't accepting archive requests right now")
+	// ErrBandwidthThrottled is returned for reads over the per-client limit while reads are throttled
+	ErrBandwidthThrottled = fmt.Errorf("this archive has used it's bandwidth allowance for the month, please slow down")
+
+	// bandwidthStats exposes bytes counted by this instance at /debug/vars
+	bandwidthStats = expvar.NewMap("bandwidth")
+	// bandwidth is the package-level bandwidth meter
+	bandwidth = newBandwidthMeter()
+)
+
+// archiveActions lists request types that start archiving, rejected once the
+// crawl cap is passed. ArchiveUrlFor & Service.ArchiveUrl check the cap themselves
+var archiveActions = map[string]bool{
+	TrialArchiveAction{}.Type(): true,
+	ArchiveLinkAction{}.Type():  true,
+}
+
+// BandwidthStatus is the month's bandwidth use against the deployment's caps
+type BandwidthStatus struct {
+	// one of "ok", "throttled", "capped"
+	State string `json:"state"`
+	// weather reads are rate limited
+	ReadsThrottled bool `json:"readsThrottled"`
+	// month totals are for, eg: "2017-01"
+	Month string `json:"month"`
+	// bytes used this month
+	Crawled int64 `json:"crawled"`
+	Served  int64 `json:"served"`
+	// caps in bytes, 0 if uncapped
+	CrawlCap  int64 `json:"crawlCap"`
+	ServedCap int64 `json:"servedCap"`
+}
+
+// bandwidthMeter counts bytes crawled & served, & enforces monthly caps
+type bandwidthMeter struct {
+	// bytes counted since the last flush, only changed atomically
+	crawled, served int64
+
+	db              *sql.DB
+	crawlCap        int64
+	servedCap       int64
+	throttlePercent int64
+	throttleReads   bool
+	// status as of the last flush, a *BandwidthStatus
+	status atomic.Value
+	// held by each fetch while crawling is throttled
+	crawlSlot chan struct{}
+	// per-client read limits while reads are throttled
+	reads *rateLimiter
+	// announce is called with the new status each time a cap starts or stops limiting
+	announce func(s *BandwidthStatus)
+	now      func() time.Time
+}
+
+func newBandwidthMeter() *bandwidthMeter {
+	m := &bandwidthMeter{
+		throttlePercent: 80,
+		crawlSlot:       make(chan struct{}, 1),
+		reads:           newRateLimiter(bandwidthThrottledReadsPerMinute, time.Minute),
+		announce:        announceBandwidth,
+		now:             time.Now,
+	}
+	m.status.Store(&BandwidthStatus{State: bandwidthOk})
+	return m
+}
+
+// configure sets the meter's database & caps from config
+func (m *bandwidthMeter) configure(db *sql.DB, c *config) {
+	m.db = db
+	m.crawlCap = int64(c.BandwidthCrawlCapGB) * bytesPerGB
+	m.servedCap = int64(c.BandwidthServedCapGB) * bytesPerGB
+	m.throttlePercent = int64(c.BandwidthThrottlePercent)
+	m.throttleReads = c.BandwidthThrottleReads
+}
+
+// add counts bytes of a kind of bandwidth
+func (m *bandwidthMeter) add(kind string, n int64) {
+	if n <= 0 {
+		return
+	}
+	switch kind {
+	case bandwidthCrawl:
+		atomic.AddInt64(&m.crawled, n)
+	case bandwidthServed:
+		atomic.AddInt64(&m.served, n)
+	}
+	bandwidthStats.Add(kind, n)
+}
+
+// Status returns the month's bandwidth use as of the last flush
+func (m *bandwidthMeter) Status() *BandwidthStatus {
+	s := *m.status.Load().(*BandwidthStatus)
+	return &s
+}
+
+// Check returns ErrBandwidthCap if archive requests aren't currently accepted
+func (m *bandwidthMeter) Check() error {
+	if m.Status().State == bandwidthCapped {
+		return ErrBandwidthCap
+	}
+	return nil
+}
+
+// crawlTurn waits for a turn to fetch while crawling is throttled, returning a
+// func that ends it. fetches don't wait while crawling isn't throttled
+func (m *bandwidthMeter) crawlTurn() func() {
+	if m.status.Load().(*BandwidthStatus).State == bandwidthOk {
+		return func() {}
+	}
+	m.crawlSlot <- struct{}{}
+	return func() { <-m.crawlSlot }
+}
+
+// run flushes counted bytes every bandwidthFlushInterval
+func (m *bandwidthMeter) run() {
+	if err := m.flush(); err != nil {
+		log.Infof("error flushing bandwidth: %s", err.Error())
+	}
+	for range time.Tick(bandwidthFlushInterval) {
+		if err := m.flush(); err != nil {
+			log.Infof("error flushing bandwidth: %s", err.Error())
+		}
+	}
+}
+
+// flush adds bytes counted since the last flush to today's counters, then
+// re-reads the month's totals & checks them against the caps. bytes that
+// can't be written are kept for the next flush
+func (m *bandwidthMeter) flush() error {
+	if m.db == nil {
+		return nil
+	}
+	now := m.now().In(time.UTC)
+	counted := map[string]*int64{bandwidthCrawl: &m.crawled, bandwidthServed: &m.served}
+
+	var flushErr error
+	for _, kind := range []string{bandwidthCrawl, bandwidthServed} {
+		n := atomic.SwapInt64(counted[kind], 0)
+		if n == 0 {
+			continue
+		}
+		_, err := m.db.Exec(`insert into bandwidth (day,kind,bytes) values ($1, $2, $3)
+			on conflict (day, kind) do update set bytes = bandwidth.bytes + $3`, now.Format("2006-01-02"), kind, n)
+		if err = checkWriteErr(err); err != nil {
+			atomic.AddInt64(counted[kind], n)
+			flushErr = err
+		}
+	}
+
+	crawled, served, err := monthBandwidth(m.db, now)
+	if err != nil {
+		return err
+	}
+	m.update(now.Format("2006-01"), crawled, served)
+	return flushErr
+}
+
+// update sets the month's totals, announcing any change in what's limited
+func (m *bandwidthMeter) update(month string, crawled, served int64) {
+	s := &BandwidthStatus{
+		State:     bandwidthOk,
+		Month:     month,
+		Crawled:   crawled,
+		Served:    served,
+		CrawlCap:  m.crawlCap,
+		ServedCap: m.servedCap,
+	}
+	if m.crawlCap > 0 {
+		if crawled >= m.crawlCap {
+			s.State = bandwidthCapped
+		} else if crawled*100 >= m.crawlCap*m.throttlePercent {
+			s.State = bandwidthThrottled
+		}
+	}
+	s.ReadsThrottled = m.throttleReads && m.servedCap > 0 && served >= m.servedCap
+
+	prev := m.status.Load().(*BandwidthStatus)
+	m.status.Store(s)
+	if prev.State != s.State || prev.ReadsThrottled != s.ReadsThrottled {
+		log.Infof("bandwidth for %s: crawling %s, reads throttled: %t. crawled %d of %d bytes, served %d of %d bytes",
+			month, s.State, s.ReadsThrottled, crawled, m.crawlCap, served, m.servedCap)
+		if m.announce != nil {
+			m.announce(s)
+		}
+	}
+}
+
+// monthBandwidth sums the bytes crawled & served in the month of t
+func monthBandwidth(db *sql.DB, t time.Time) (crawled, served int64, err error) {
+	t = t.In(time.UTC)
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	rows, err := db.Query("select kind, sum(bytes) from bandwidth where day >= $1 and day < $2 group by kind",
+		start.Format("2006-01-02"), start.AddDate(0, 1, 0).Format("2006-01-02"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			kind  string
+			bytes int64
+		)
+		if err := rows.Scan(&kind, &bytes); err != nil {
+			return 0, 0, err
+		}
+		switch kind {
+		case bandwidthCrawl:
+			crawled = bytes
+		case bandwidthServed:
+			served = bytes
+		}
+	}
+	return crawled, served, rows.Err()
+}
+
+// announceBandwidth tells all connected clients a cap has started or stopped limiting
+func announceBandwidth(s *BandwidthStatus) {
+	broadcastEvent(&Event{Type: EventBandwidthCapChanged, Origin: instanceId, Data: s})
+}
+
+// meteredBody counts bytes read from a response body
+type meteredBody struct {
+	io.ReadCloser
+	kind string
+}
+
+func (b meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	bandwidth.add(b.kind, int64(n))
+	return n, err
+}
+
+// meteredWriter counts bytes written to a writer
+type meteredWriter struct {
+	io.Writer
+	kind string
+}
+
+func (w meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	bandwidth.add(w.kind, int64(n))
+	return n, err
+}
+
+// BandwidthHandler reports the month's bandwidth use & each day's counters
+func BandwidthHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminConfigured(w) {
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	days, err := bandwidthDays(appDB, time.Now())
+	if err != nil {
+		log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": bandwidth.Status(),
+		"days":   days,
+	})
+}
+
+// bandwidthDay is a single day's counter
+type bandwidthDay struct {
+	Day   string `json:"day"`
+	Kind  string `json:"kind"`
+	Bytes int64  `json:"bytes"`
+}
+
+// bandwidthDays lists the counters for each day of the month of t
+func bandwidthDays(db *sql.DB, t time.Time) ([]*bandwidthDay, error) {
+	t = t.In(time.UTC)
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	rows, err := db.Query("select day, kind, bytes from bandwidth where day >= $1 and day < $2 order by day, kind",
+		start.Format("2006-01-02"), start.AddDate(0, 1, 0).Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := []*bandwidthDay{}
+	for rows.Next() {
+		var (
+			d   = &bandwidthDay{}
+			day time.Time
+		)
+		if err := rows.Scan(&day, &d.Kind, &d.Bytes); err != nil {
+			return nil, err
+		}
+		d.Day = day.Format("2006-01-02")
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBandwidthUpdate(t *testing.T) {
+	announced := []*BandwidthStatus{}
+	m := newBandwidthMeter()
+	m.crawlCap, m.servedCap, m.throttleReads = 1000, 500, true
+	m.announce = func(s *BandwidthStatus) { announced = append(announced, s) }
+
+	cases := []struct {
+		crawled, served int64
+		state           string
+		readsThrottled  bool
+		announced       int
+	}{
+		{0, 0, bandwidthOk, false, 0},
+		{799, 0, bandwidthOk, false, 0},
+		{800, 0, bandwidthThrottled, false, 1},
+		{900, 0, bandwidthThrottled, false, 1},
+		{1000, 0, bandwidthCapped, false, 2},
+		{1000, 500, bandwidthCapped, true, 3},
+		// a new month starts over
+		{0, 0, bandwidthOk, false, 4},
+	}
+	for i, c := range cases {
+		m.update("2017-01", c.crawled, c.served)
+		s := m.Status()
+		if s.State != c.state || s.ReadsThrottled != c.readsThrottled {
+			t.Errorf("case %d expected %s & reads throttled %t, got: %s & %t", i, c.state, c.readsThrottled, s.State, s.ReadsThrottled)
+		}
+		if len(announced) != c.announced {
+			t.Errorf("case %d expected %d announcements, got: %d", i, c.announced, len(announced))
+		}
+	}
+
+	// reads aren't affected by the served cap unless they're set to be throttled
+	m.throttleReads = false
+	m.update("2017-01", 0, 5000)
+	if m.Status().ReadsThrottled {
+		t.Errorf("expected reads not to be throttled")
+	}
+}
+
+func TestBandwidthResponse(t *testing.T) {
+	svc := newTestService()
+
+	trial := TrialArchiveAction{}.Parse("1", json.RawMessage(`{}`))
+	read := FetchUrlAct{}.Parse("2", json.RawMessage(`{}`))
+
+	svc.Bandwidth.status.Store(&BandwidthStatus{State: bandwidthThrottled})
+	if res, _ := actionLimitResponse(svc, trial, "1", limitKeys{limitScopeIP: "127.0.0.1"}); res != nil {
+		t.Errorf("expected throttled crawling to accept archive requests, got: %s", res.Error)
+	}
+
+	svc.Bandwidth.status.Store(&BandwidthStatus{State: bandwidthCapped})
+	if res, _ := actionLimitResponse(svc, trial, "1", limitKeys{limitScopeIP: "127.0.0.1"}); res == nil || res.Code != bandwidthCapErrCode {
+		t.Errorf("expected capped crawling to reject archive requests with %s", bandwidthCapErrCode)
+	}
+	if res, _ := actionLimitResponse(svc, read, "2", limitKeys{limitScopeIP: "127.0.0.1"}); res != nil {
+		t.Errorf("expected the crawl cap not to affect reads, got: %s", res.Error)
+	}
+
+	svc.Bandwidth.status.Store(&BandwidthStatus{State: bandwidthOk, ReadsThrottled: true})
+	rejected := 0
+	for i := 0; i < bandwidthThrottledReadsPerMinute+5; i++ {
+		if res, _ := actionLimitResponse(svc, read, "2", limitKeys{limitScopeIP: "bandwidth_test_client"}); res != nil {
+			rejected++
+		}
+	}
+	if rejected != 5 {
+		t.Errorf("expected reads past the limit to be rejected, got %d rejections", rejected)
+	}
+}
+
+func TestBandwidthMeteredFetch(t *testing.T) {
+	body := strings.Repeat("a", 4096)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer s.Close()
+
+	before := atomic.LoadInt64(&bandwidth.crawled)
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	res, err := newEgress(egressDirect, nil, true).Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if got := atomic.LoadInt64(&bandwidth.crawled) - before; got != int64(len(body)) {
+		t.Errorf("expected %d crawled bytes to be counted, got: %d", len(body), got)
+	}
+}
+
+func TestBandwidthFlush(t *testing.T) {
+	defer resetTestData(appDB, "bandwidth")
+	now := time.Date(2017, 1, 31, 23, 0, 0, 0, time.UTC)
+	m := newBandwidthMeter()
+	m.announce = nil
+	m.configure(appDB, &config{BandwidthCrawlCapGB: 1, BandwidthThrottlePercent: 80})
+	m.now = func() time.Time { return now }
+
+	m.add(bandwidthCrawl, 600*1000*1000)
+	m.add(bandwidthServed, 10)
+	if err := m.flush(); err != nil {
+		t.Fatal(err.Error())
+	}
+	m.add(bandwidthCrawl, 300*1000*1000)
+	if err := m.flush(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := m.Status(); s.State != bandwidthThrottled || s.Crawled != 900*1000*1000 || s.Served != 10 {
+		t.Errorf("expected month totals to be summed, got: %#v", s)
+	}
+
+	// a restarted instance picks up where it left off
+	restarted := newBandwidthMeter()
+	restarted.announce = nil
+	restarted.configure(appDB, &config{BandwidthCrawlCapGB: 1, BandwidthThrottlePercent: 80})
+	restarted.now = m.now
+	restarted.add(bandwidthCrawl, 100*1000*1000)
+	if err := restarted.flush(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := restarted.Check(); err != ErrBandwidthCap {
+		t.Errorf("expected crawl cap to be reached after restart, got: %v", err)
+	}
+
+	// the next month starts from nothing
+	now = now.Add(2 * time.Hour)
+	if err := restarted.flush(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := restarted.Status(); s.State != bandwidthOk || s.Month != "2017-02" {
+		t.Errorf("expected a new month to reset caps, got: %#v", s)
+	}
+
+	days, err := bandwidthDays(appDB, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := []string{}
+	for _, d := range days {
+		got = append(got, fmt.Sprintf("%s %s %d", d.Day, d.Kind, d.Bytes))
+	}
+	if strings.Join(got, ",") != "2017-01-31 crawl 1000000000,2017-01-31 served 10" {
+		t.Errorf("unexpected daily counters: %v", got)
+	}
+}
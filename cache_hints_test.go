@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestContentToken(t *testing.T) {
+	// tokens must be identical across processes, so they're checked against a fixed value
+	a := map[string]interface{}{"title": "EPA", "keywords": []string{"air", "water"}, "count": 2}
+	b := map[string]interface{}{"count": 2, "keywords": []string{"air", "water"}, "title": "EPA"}
+
+	ad, _ := json.Marshal(a)
+	bd, _ := json.Marshal(b)
+	if contentToken(ad) != contentToken(bd) {
+		t.Errorf("expected equal data to produce equal tokens")
+	}
+	if got, expect := contentToken(ad), "c0fa10022524357b8863532943b18187"; got != expect {
+		t.Errorf("token mismatch. expected: %s, got: %s", expect, got)
+	}
+}
+
+func TestApplyCacheHints(t *testing.T) {
+	data := map[string]interface{}{"url": "http://www.epa.gov"}
+	res := &ClientResponse{Type: FetchUrlAct{}.SuccessType(), Data: data}
+	if err := applyCacheHints(res, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Token == "" || res.MaxAge == 0 {
+		t.Fatalf("expected opted-in response to get a token & max-age. got: %v", res)
+	}
+	if res.Code != "" || res.Data == nil {
+		t.Errorf("expected response without a last-seen token to carry data")
+	}
+
+	cases := []struct {
+		res         *ClientResponse
+		lastToken   string
+		token       bool
+		notModified bool
+	}{
+		{&ClientResponse{Type: FetchUrlAct{}.SuccessType(), Data: data}, res.Token, true, true},
+		{&ClientResponse{Type: FetchUrlAct{}.SuccessType(), Data: data}, "stale", true, false},
+		// errors & non-opted-in responses never get tokens
+		{&ClientResponse{Type: FetchUrlAct{}.SuccessType(), Error: "nope", Data: data}, res.Token, false, false},
+		{&ClientResponse{Type: SaveMetadataAction{}.SuccessType(), Data: data}, res.Token, false, false},
+		// neither do personal responses
+		{&ClientResponse{Type: DashboardAction{}.SuccessType(), Data: data, personal: true}, res.Token, false, false},
+	}
+
+	for i, c := range cases {
+		if err := applyCacheHints(c.res, c.lastToken); err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if (c.res.Token != "") != c.token {
+			t.Errorf("case %d expected token: %t, got: %s", i, c.token, c.res.Token)
+		}
+		if (c.res.Code == notModifiedCode) != c.notModified {
+			t.Errorf("case %d expected not modified: %t, got code: %s", i, c.notModified, c.res.Code)
+		}
+		if c.notModified && c.res.Data != nil {
+			t.Errorf("case %d expected not modified response to drop data", i)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Cache snapshots
+//
+// After a deploy the in-memory caches start cold & the first minutes of
+// traffic all go to the database. with cfg.CacheSnapshots on, the warm state
+// of contentCache & metaCache's consensus values is written to the
+// cache_snapshots table on shutdown & every cfg.CacheSnapshotIntervalSeconds,
+// & read back at startup before the server starts listening. instances share
+// one snapshot, the last to write it wins, any instance's warm state is a
+// better start than none.
+//
+// snapshots are only restored if they're younger than
+// cfg.CacheSnapshotMaxAgeSeconds & were taken by a build with the same schema
+// version. snapshots that are stale, from another schema, in a format this
+// build doesn't read, truncated or fail their checksum are ignored & the
+// caches start cold. restored entries are reconciled against the database in
+// the background: hashes are restored stale so they're served while they're
+// refreshed, & every restored entry is re-read, replacing it unless it was
+// invalidated in the meantime.
+//
+// the encoding is compact & cheap to read:
+//
+//	"PBCS" format byte
+//	uvarint schema version, varint created unix nanoseconds
+//	uvarint count, then url & hash strings for each contentCache entry
+//	uvarint count, then subject string & json consensus for each metaCache entry
+//	big-endian crc32 (IEEE) of everything before it
+//
+// strings are uvarint length prefixed. entries are most recently used first.
+// the subprimer matchers & feature flags aren't cached in memory in this
+// build, they're read from the database, so there's nothing of theirs to snapshot
+
+const (
+	// cacheSnapshotName is the cache_snapshots row instances share
+	cacheSnapshotName = "caches"
+	// cacheSnapshotFormat is the version of the encoding. bump it with every
+	// change to it, snapshots in other formats are ignored
+	cacheSnapshotFormat = 1
+)
+
+// cacheSnapshotMagic starts every encoded snapshot
+var cacheSnapshotMagic = []byte("PBCS")
+
+var (
+	// ErrCacheSnapshotCorrupt is returned decoding a snapshot that's truncated or fails it's checksum
+	ErrCacheSnapshotCorrupt = fmt.Errorf("cache snapshot is corrupt")
+	// ErrCacheSnapshotStale is returned reading a snapshot older than the max age
+	ErrCacheSnapshotStale = fmt.Errorf("cache snapshot is stale")
+)
+
+// cacheSnapshotStats exposes snapshot writes, restores & reconciliation counts at /debug/vars
+var cacheSnapshotStats = expvar.NewMap("cacheSnapshots")
+
+// cacheSnapshot is the warm state of the in-memory caches
+type cacheSnapshot struct {
+	Created time.Time
+	// schema version of the build that took the snapshot
+	SchemaVersion int
+	// latest capture hashes in contentCache, most recently used first
+	Content []*urlContentSnapshot
+	// consensus values in metaCache, most recently used first
+	Consensus []*consensusSnapshot
+}
+
+// urlContentSnapshot is a url's cached latest capture hash
+type urlContentSnapshot struct {
+	Url  string
+	Hash string
+}
+
+// consensusSnapshot is a subject's cached consensus
+type consensusSnapshot struct {
+	Subject string
+	Values  map[string][]interface{}
+}
+
+// takeCacheSnapshot snapshots the warm state of content & meta
+func takeCacheSnapshot(content *urlContentCache, meta *metadataCache, now time.Time) *cacheSnapshot {
+	return &cacheSnapshot{
+		Created:       now,
+		SchemaVersion: schemaVersion,
+		Content:       content.snapshot(),
+		Consensus:     meta.consensusSnapshot(),
+	}
+}
+
+// encodeCacheSnapshot encodes a snapshot in the binary format
+func encodeCacheSnapshot(s *cacheSnapshot) ([]byte, error) {
+	buf := append([]byte{}, cacheSnapshotMagic...)
+	buf = append(buf, cacheSnapshotFormat)
+	buf = binary.AppendUvarint(buf, uint64(s.SchemaVersion))
+	buf = binary.AppendVarint(buf, s.Created.UnixNano())
+
+	buf = binary.AppendUvarint(buf, uint64(len(s.Content)))
+	for _, e := range s.Content {
+		buf = appendSnapshotBytes(buf, []byte(e.Url))
+		buf = appendSnapshotBytes(buf, []byte(e.Hash))
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(s.Consensus)))
+	for _, e := range s.Consensus {
+		values, err := json.Marshal(e.Values)
+		if err != nil {
+			return nil, err
+		}
+		buf = appendSnapshotBytes(buf, []byte(e.Subject))
+		buf = appendSnapshotBytes(buf, values)
+	}
+
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf)), nil
+}
+
+// appendSnapshotBytes appends length prefixed bytes
+func appendSnapshotBytes(buf, data []byte) []byte {
+	return append(binary.AppendUvarint(buf, uint64(len(data))), data...)
+}
+
+// decodeCacheSnapshot decodes a snapshot encoded with encodeCacheSnapshot,
+// returning ErrCacheSnapshotCorrupt if it's checksum or structure is off
+func decodeCacheSnapshot(data []byte) (*cacheSnapshot, error) {
+	head := len(cacheSnapshotMagic) + 1
+	if len(data) < head+crc32.Size || !bytes.Equal(data[:len(cacheSnapshotMagic)], cacheSnapshotMagic) {
+		return nil, ErrCacheSnapshotCorrupt
+	}
+	body := data[:len(data)-crc32.Size]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(body):]) {
+		return nil, ErrCacheSnapshotCorrupt
+	}
+	if format := body[head-1]; format != cacheSnapshotFormat {
+		return nil, fmt.Errorf("cache snapshot format %d isn't supported, expected %d", format, cacheSnapshotFormat)
+	}
+
+	r := &snapshotReader{data: body[head:]}
+	s := &cacheSnapshot{
+		SchemaVersion: int(r.uvarint()),
+		Created:       time.Unix(0, r.varint()),
+	}
+	// every entry is at least two length prefixes, so counts can't claim more
+	// entries than there are bytes left
+	s.Content = make([]*urlContentSnapshot, r.count(2))
+	for i := range s.Content {
+		s.Content[i] = &urlContentSnapshot{Url: string(r.bytes()), Hash: string(r.bytes())}
+	}
+	s.Consensus = make([]*consensusSnapshot, r.count(2))
+	for i := range s.Consensus {
+		e := &consensusSnapshot{Subject: string(r.bytes())}
+		if values := r.bytes(); r.err == nil {
+			if err := json.Unmarshal(values, &e.Values); err != nil {
+				return nil, ErrCacheSnapshotCorrupt
+			}
+		}
+		s.Consensus[i] = e
+	}
+	if r.err != nil || len(r.data) > 0 {
+		return nil, ErrCacheSnapshotCorrupt
+	}
+	return s, nil
+}
+
+// snapshotReader reads values from an encoded snapshot, recording the first
+// error. reads after an error return zero values
+type snapshotReader struct {
+	data []byte
+	err  error
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = ErrCacheSnapshotCorrupt
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *snapshotReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = ErrCacheSnapshotCorrupt
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads a count of entries at least size bytes long
+func (r *snapshotReader) count(size int) int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.data)/size) {
+		r.err = ErrCacheSnapshotCorrupt
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (r *snapshotReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.data)) {
+		r.err = ErrCacheSnapshotCorrupt
+	}
+	if r.err != nil {
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// checkCacheSnapshot checks a snapshot can be restored at now
+func checkCacheSnapshot(s *cacheSnapshot, now time.Time, maxAge time.Duration) error {
+	if s.SchemaVersion != schemaVersion {
+		return fmt.Errorf("cache snapshot is from schema %d, expected %d", s.SchemaVersion, schemaVersion)
+	}
+	if now.Sub(s.Created) > maxAge {
+		return ErrCacheSnapshotStale
+	}
+	return nil
+}
+
+// writeCacheSnapshot stores a snapshot, replacing the last one
+func writeCacheSnapshot(db *sql.DB, s *cacheSnapshot) error {
+	data, err := encodeCacheSnapshot(s)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`insert into cache_snapshots (name,created,data) values ($1, $2, $3)
+		on conflict (name) do update set created = excluded.created, data = excluded.data`, cacheSnapshotName, s.Created.In(time.UTC), data)
+	if err == nil {
+		cacheSnapshotStats.Add("written", 1)
+		cacheSnapshotStats.Add("writtenBytes", int64(len(data)))
+	}
+	return err
+}
+
+// readCacheSnapshot reads the stored snapshot, returning nil if there isn't
+// one & an error if it can't be restored at now
+func readCacheSnapshot(db *sql.DB, now time.Time, maxAge time.Duration) (*cacheSnapshot, error) {
+	var data []byte
+	if err := db.QueryRow("select data from cache_snapshots where name = $1", cacheSnapshotName).Scan(&data); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s, err := decodeCacheSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCacheSnapshot(s, now, maxAge); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// saveCacheSnapshot snapshots the package-level caches to db
+func saveCacheSnapshot(db *sql.DB, now time.Time) error {
+	return writeCacheSnapshot(db, takeCacheSnapshot(contentCache, metaCache, now))
+}
+
+// restoreCacheSnapshot restores a snapshot into content & meta
+func restoreCacheSnapshot(s *cacheSnapshot, content *urlContentCache, meta *metadataCache) {
+	content.restore(s.Content)
+	meta.restoreConsensus(s.Consensus)
+	cacheSnapshotStats.Add("restored", 1)
+	cacheSnapshotStats.Add("restoredEntries", int64(len(s.Content)+len(s.Consensus)))
+}
+
+// reconcileCacheSnapshot re-reads every entry restored from a snapshot, least
+// recently used first so the caches keep their order
+func reconcileCacheSnapshot(s *cacheSnapshot, content *urlContentCache, meta *metadataCache, consensus func(subject string) (map[string][]interface{}, error)) {
+	for i := len(s.Content) - 1; i >= 0; i-- {
+		if err := content.reconcile(s.Content[i].Url); err != nil {
+			cacheSnapshotStats.Add("reconcileErrors", 1)
+			log.Infof("error reconciling cached content for %s: %s", s.Content[i].Url, err.Error())
+		}
+	}
+	for i := len(s.Consensus) - 1; i >= 0; i-- {
+		if err := meta.reconcileConsensus(s.Consensus[i].Subject, consensus); err != nil {
+			cacheSnapshotStats.Add("reconcileErrors", 1)
+			log.Infof("error reconciling cached consensus for %s: %s", s.Consensus[i].Subject, err.Error())
+		}
+	}
+	cacheSnapshotStats.Add("reconciled", 1)
+}
+
+// startCacheSnapshots restores the stored snapshot into the package-level
+// caches & snapshots them every interval, if c turns snapshots on. restoring
+// happens before it returns, reconciling in the background
+func startCacheSnapshots(db *sql.DB, c *config) {
+	if c == nil || !c.CacheSnapshots {
+		return
+	}
+	now := time.Now()
+	s, err := readCacheSnapshot(db, now, time.Duration(c.CacheSnapshotMaxAgeSeconds)*time.Second)
+	if err != nil {
+		cacheSnapshotStats.Add("ignored", 1)
+		log.Infof("not restoring cache snapshot: %s", err.Error())
+	} else if s != nil {
+		restoreCacheSnapshot(s, contentCache, metaCache)
+		log.Infof("restored %d cached urls & %d cached subjects from a snapshot taken %s ago", len(s.Content), len(s.Consensus), now.Sub(s.Created).Round(time.Second))
+		go reconcileCacheSnapshot(s, contentCache, metaCache, func(subject string) (map[string][]interface{}, error) {
+			return calcConsensus(db, subject)
+		})
+	}
+
+	go func() {
+		for now := range time.Tick(time.Duration(c.CacheSnapshotIntervalSeconds) * time.Second) {
+			if err := saveCacheSnapshot(db, now); err != nil {
+				log.Infof("error saving cache snapshot: %s", err.Error())
+			}
+		}
+	}()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshotEncoding(t *testing.T) {
+	s := &cacheSnapshot{
+		Created:       time.Unix(0, 1483228801000000123),
+		SchemaVersion: schemaVersion,
+		Content: []*urlContentSnapshot{
+			{Url: "http://www.epa.gov", Hash: "1220aa"},
+			{Url: "http://www.noaa.gov", Hash: "1220bb"},
+		},
+		Consensus: []*consensusSnapshot{
+			{Subject: "1220aa", Values: map[string][]interface{}{"title": {"EPA"}, "year": {2017.0}}},
+		},
+	}
+	data, err := encodeCacheSnapshot(s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := decodeCacheSnapshot(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect, _ := json.Marshal(s)
+	if data, _ := json.Marshal(got); string(data) != string(expect) || !got.Created.Equal(s.Created) {
+		t.Errorf("expected snapshot to round trip as %s, got: %s", expect, data)
+	}
+
+	empty, _ := encodeCacheSnapshot(&cacheSnapshot{Created: s.Created, SchemaVersion: schemaVersion})
+	if got, err := decodeCacheSnapshot(empty); err != nil || len(got.Content) != 0 || len(got.Consensus) != 0 {
+		t.Errorf("expected an empty snapshot to round trip, got: %v %v", got, err)
+	}
+
+	// corrupt snapshots are refused, never half read
+	for i := 0; i < len(data); i++ {
+		if _, err := decodeCacheSnapshot(data[:i]); err != ErrCacheSnapshotCorrupt {
+			t.Errorf("expected a snapshot truncated to %d bytes to be corrupt, got: %v", i, err)
+		}
+		flipped := append([]byte{}, data...)
+		flipped[i] ^= 0xff
+		if _, err := decodeCacheSnapshot(flipped); err != ErrCacheSnapshotCorrupt {
+			t.Errorf("expected a snapshot with byte %d changed to be corrupt, got: %v", i, err)
+		}
+	}
+
+	// bodies with valid checksums are still checked
+	sum := func(body []byte) []byte {
+		return binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+	}
+	head := append(append([]byte{}, cacheSnapshotMagic...), cacheSnapshotFormat)
+	head = binary.AppendUvarint(head, uint64(schemaVersion))
+	head = binary.AppendVarint(head, 0)
+	cases := []struct {
+		data []byte
+		err  error
+	}{
+		// a count claiming more entries than there are bytes
+		{sum(binary.AppendUvarint(append([]byte{}, head...), 1<<40)), ErrCacheSnapshotCorrupt},
+		// trailing bytes
+		{sum(append(binary.AppendUvarint(binary.AppendUvarint(append([]byte{}, head...), 0), 0), 0)), ErrCacheSnapshotCorrupt},
+		// consensus values that aren't json
+		{sum(appendSnapshotBytes(appendSnapshotBytes(binary.AppendUvarint(binary.AppendUvarint(append([]byte{}, head...), 0), 1), []byte("1220aa")), []byte("{"))), ErrCacheSnapshotCorrupt},
+	}
+	for i, c := range cases {
+		if _, err := decodeCacheSnapshot(c.data); err != c.err {
+			t.Errorf("case %d expected error %v, got: %v", i, c.err, err)
+		}
+	}
+	other := append([]byte{}, data[:len(data)-crc32.Size]...)
+	other[len(cacheSnapshotMagic)] = cacheSnapshotFormat + 1
+	if _, err := decodeCacheSnapshot(sum(other)); err == nil {
+		t.Errorf("expected snapshots in another format to be refused")
+	}
+
+	now := s.Created.Add(time.Minute)
+	if err := checkCacheSnapshot(s, now, time.Hour); err != nil {
+		t.Errorf("expected a fresh snapshot to be restorable, got: %s", err.Error())
+	}
+	if err := checkCacheSnapshot(s, now, time.Second); err != ErrCacheSnapshotStale {
+		t.Errorf("expected a stale snapshot to be refused, got: %v", err)
+	}
+	if err := checkCacheSnapshot(&cacheSnapshot{Created: s.Created, SchemaVersion: schemaVersion - 1}, now, time.Hour); err == nil {
+		t.Errorf("expected a snapshot from another schema to be refused")
+	}
+}
+
+func TestCacheSnapshotRestore(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	captures := &fakeCaptures{hashes: map[string]string{"http://a.example.com": "a2", "http://c.example.com": "c"}}
+	content := newUrlContentCache(2, 10*time.Second, time.Minute, captures.load)
+	content.healthy = func() bool { return true }
+	content.now = func() time.Time { return now }
+	meta := newMetadataCache(2, time.Minute)
+	meta.healthy = func() bool { return true }
+
+	s := &cacheSnapshot{
+		Created:       now,
+		SchemaVersion: schemaVersion,
+		Content: []*urlContentSnapshot{
+			{Url: "http://a.example.com", Hash: "a"},
+			{Url: "http://b.example.com", Hash: "b"},
+			{Url: "http://c.example.com", Hash: "c"},
+		},
+		Consensus: []*consensusSnapshot{
+			{Subject: "1220aa", Values: map[string][]interface{}{"title": {"a"}}},
+			{Subject: "1220bb", Values: map[string][]interface{}{"title": {"b"}}},
+			{Subject: "1220cc", Values: map[string][]interface{}{"title": {"c"}}},
+		},
+	}
+	restoreCacheSnapshot(s, content, meta)
+
+	// the most recently used entries that fit are restored, in order
+	if data, _ := json.Marshal(content.snapshot()); string(data) != `[{"Url":"http://a.example.com","Hash":"a"},{"Url":"http://b.example.com","Hash":"b"}]` {
+		t.Errorf("expected the most recently used urls to be restored, got: %s", data)
+	}
+	if data, _ := json.Marshal(meta.consensusSnapshot()); string(data) != `[{"Subject":"1220aa","Values":{"title":["a"]}},{"Subject":"1220bb","Values":{"title":["b"]}}]` {
+		t.Errorf("expected the most recently used subjects to be restored, got: %s", data)
+	}
+	// restored hashes are stale, they're refreshed on read & expire a soft TTL early
+	now = now.Add(content.hardTTL - content.softTTL)
+	if entries := content.snapshot(); len(entries) != 0 {
+		t.Errorf("expected restored hashes to expire a hard TTL after they went stale, got %d", len(entries))
+	}
+	now = now.Add(content.softTTL - content.hardTTL)
+
+	reconcileCacheSnapshot(s, content, meta, func(subject string) (map[string][]interface{}, error) {
+		if subject == "1220bb" {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return map[string][]interface{}{"title": {subject}}, nil
+	})
+	// changed hashes are updated, urls that aren't captured anymore dropped,
+	// & entries that weren't restored left for the next read
+	if data, _ := json.Marshal(content.snapshot()); string(data) != `[{"Url":"http://a.example.com","Hash":"a2"}]` {
+		t.Errorf("expected restored urls to be reconciled, got: %s", data)
+	}
+	if captures.loaded() != 2 {
+		t.Errorf("expected only restored urls to be read, got %d reads", captures.loaded())
+	}
+	// consensus that can't be read is kept until it expires
+	if data, _ := json.Marshal(meta.consensusSnapshot()); string(data) != `[{"Subject":"1220aa","Values":{"title":["1220aa"]}},{"Subject":"1220bb","Values":{"title":["b"]}}]` {
+		t.Errorf("expected restored subjects to be reconciled, got: %s", data)
+	}
+
+	// urls invalidated since they were restored aren't read back in
+	content.Invalidate("http://a.example.com")
+	if err := content.reconcile("http://a.example.com"); err != nil || len(content.snapshot()) != 0 || captures.loaded() != 2 {
+		t.Errorf("expected invalidated urls not to be reconciled, got: %v %d", err, len(content.snapshot()))
+	}
+
+	taken := takeCacheSnapshot(content, meta, now)
+	if taken.SchemaVersion != schemaVersion || !taken.Created.Equal(now) || len(taken.Consensus) != 2 {
+		t.Errorf("expected a snapshot of the caches, got: %#v", taken)
+	}
+}
+
+func TestCacheSnapshotStore(t *testing.T) {
+	defer resetTestData(appDB, "cache_snapshots")
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if s, err := readCacheSnapshot(appDB, now, time.Hour); s != nil || err != nil {
+		t.Errorf("expected no snapshot, got: %v %v", s, err)
+	}
+	s := &cacheSnapshot{
+		Created:       now,
+		SchemaVersion: schemaVersion,
+		Content:       []*urlContentSnapshot{{Url: "http://www.epa.gov", Hash: "1220aa"}},
+	}
+	if err := writeCacheSnapshot(appDB, s); err != nil {
+		t.Fatal(err.Error())
+	}
+	// writes replace the last snapshot
+	s.Content[0].Hash = "1220bb"
+	if err := writeCacheSnapshot(appDB, s); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := readCacheSnapshot(appDB, now.Add(time.Minute), time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(got.Content) != 1 || got.Content[0].Hash != "1220bb" {
+		t.Errorf("expected the last snapshot written, got: %#v", got.Content)
+	}
+
+	if _, err := readCacheSnapshot(appDB, now.Add(2*time.Hour), time.Hour); err != ErrCacheSnapshotStale {
+		t.Errorf("expected a stale snapshot to be refused, got: %v", err)
+	}
+	if _, err := appDB.Exec("update cache_snapshots set data = $1", []byte("not a snapshot")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := readCacheSnapshot(appDB, now, time.Hour); err != ErrCacheSnapshotCorrupt {
+		t.Errorf("expected a corrupt snapshot to be refused, got: %v", err)
+	}
+}
+
+// BenchmarkCacheStart compares warming the caches from the database, as after
+// a cold start, with restoring them from a snapshot
+func BenchmarkCacheStart(b *testing.B) {
+	const urls = 1000
+	defer resetTestData(appDB, "urls", "cache_snapshots")
+	if _, err := appDB.Exec(`insert into urls (url,created,updated,last_get,hash)
+		select 'http://bench.example.com/' || i, now(), now(), now(), '1220' || lpad(to_hex(i), 64, '0') from generate_series(1, $1) i`, urls); err != nil {
+		b.Fatal(err.Error())
+	}
+	newCaches := func() (*urlContentCache, *metadataCache) {
+		content := newUrlContentCache(contentCacheSize, contentCacheSoftTTL, contentCacheHardTTL, func(url string) (string, error) {
+			return latestCaptureHash(appDB, url)
+		})
+		content.healthy = func() bool { return true }
+		meta := newMetadataCache(metadataCacheSize, metadataCacheTTL)
+		meta.healthy = func() bool { return true }
+		return content, meta
+	}
+	warm := func(content *urlContentCache, meta *metadataCache) {
+		for i := 1; i <= urls; i++ {
+			hash, err := content.Latest(fmt.Sprintf("http://bench.example.com/%d", i))
+			if err != nil {
+				b.Fatal(err.Error())
+			}
+			if _, err := meta.Consensus(appDB, hash); err != nil {
+				b.Fatal(err.Error())
+			}
+		}
+	}
+
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			warm(newCaches())
+		}
+	})
+
+	content, meta := newCaches()
+	warm(content, meta)
+	if err := writeCacheSnapshot(appDB, takeCacheSnapshot(content, meta, time.Now())); err != nil {
+		b.Fatal(err.Error())
+	}
+	b.Run("snapshot", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s, err := readCacheSnapshot(appDB, time.Now(), time.Hour)
+			if err != nil || s == nil {
+				b.Fatalf("expected a snapshot, got: %v", err)
+			}
+			content, meta := newCaches()
+			restoreCacheSnapshot(s, content, meta)
+		}
+	})
+}
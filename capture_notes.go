@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/lib/pq"
+	"github.com/pborman/uuid"
+)
+
+// Capture notes
+//
+// Curators leave quick operational notes on a capture, eg: "this fetch got a
+// cookie banner", that don't belong in the metadata chain of it's subject.
+// notes are kept in their own table, keyed by the hash of the captured
+// content, so they're never hashed, never count towards consensus & aren't
+// part of user exports. WARC exports leave them out unless asked to include
+// them. notes are read following hash aliases, so notes on content that's
+// been re-hashed stay with it. anyone connected with an api key who can see a
+// capture can note it, only a note's author or a moderator can delete it.
+// authors are the user the api key acts for, not the key id a client says
+// hello with
+
+// longest capture note, in bytes
+const maxCaptureNoteLength = 2000
+
+var (
+	// ErrCaptureNoteText is returned for notes without text, or with too much of it
+	ErrCaptureNoteText = fmt.Errorf("notes need text of at most %d bytes", maxCaptureNoteLength)
+	// ErrCaptureNoteAnonymous is returned when an anonymous client writes a note
+	ErrCaptureNoteAnonymous = fmt.Errorf("connect with an api key to write notes")
+	// ErrNotNoteAuthor is returned when someone other than a note's author deletes it without a moderation token
+	ErrNotNoteAuthor = fmt.Errorf("notes can only be deleted by their author or a moderator")
+)
+
+// CaptureNote is a note about a capture
+type CaptureNote struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// hash of the captured content
+	Capture string `json:"capture"`
+	// key id of the user that wrote the note
+	Author string `json:"author"`
+	Text   string `json:"text"`
+}
+
+// captureNoteCols are the columns of capture_notes
+var captureNoteCols = &columnSet{
+	table:   "capture_notes",
+	columns: []string{"id", "created", "capture", "author", "text"},
+}
+
+// scanTargets maps captureNoteCols to the note's fields
+func (n *CaptureNote) scanTargets() scanTargets {
+	return scanTargets{
+		"id":      &n.Id,
+		"created": &n.Created,
+		"capture": &n.Capture,
+		"author":  &n.Author,
+		"text":    &n.Text,
+	}
+}
+
+// validate checks & normalizes a note being written
+func (n *CaptureNote) validate() error {
+	n.Text = strings.TrimSpace(n.Text)
+	if n.Text == "" || len(n.Text) > maxCaptureNoteLength {
+		return ErrCaptureNoteText
+	}
+	if n.Author == "" {
+		return ErrCaptureNoteAnonymous
+	}
+	return nil
+}
+
+// AddCaptureNote writes a note about a capture. the capture isn't checked,
+// callers make sure it exists
+func AddCaptureNote(db *sql.DB, n *CaptureNote, now time.Time) error {
+	if err := n.validate(); err != nil {
+		return err
+	}
+	n.Id = uuid.New()
+	n.Created = now.Round(time.Second).In(time.UTC)
+	_, err := db.Exec("insert into capture_notes ("+captureNoteCols.String()+") values ($1, $2, $3, $4, $5)",
+		n.Id, n.Created, n.Capture, n.Author, n.Text)
+	return err
+}
+
+// ReadCaptureNote reads a note by id
+func ReadCaptureNote(db *sql.DB, id string) (*CaptureNote, error) {
+	if uuid.Parse(id) == nil {
+		return nil, ErrNotFound
+	}
+	n := &CaptureNote{}
+	err := captureNoteCols.scan(db.QueryRow("select "+captureNoteCols.String()+" from capture_notes where id = $1", id), n.scanTargets())
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return n, err
+}
+
+// DeleteCaptureNote removes a note
+func DeleteCaptureNote(db *sql.DB, id string) error {
+	if uuid.Parse(id) == nil {
+		return ErrNotFound
+	}
+	res, err := db.Exec("delete from capture_notes where id = $1", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReadCaptureNotes lists the notes about a capture under any of it's hash
+// aliases, oldest first
+func ReadCaptureNotes(db *sql.DB, capture string) ([]*CaptureNote, error) {
+	hashes, err := hashAliases(db, capture)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("select "+captureNoteCols.String()+" from capture_notes where capture = any($1) order by created, id", pq.Array(hashes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []*CaptureNote{}
+	for rows.Next() {
+		n := &CaptureNote{}
+		if err := captureNoteCols.scan(rows, n.scanTargets()); err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// CaptureNoteCounts counts the notes about a list of captures, including
+// notes written under hashes aliased to them. captures without notes are left
+// out
+func CaptureNoteCounts(db *sql.DB, captures []string) (map[string]int, error) {
+	rows, err := db.Query(`select c.hash, count(1) from unnest($1::text[]) as c(hash)
+		join capture_notes n on n.capture = c.hash or n.capture in (select old from hash_aliases where new = c.hash)
+		group by c.hash`, pq.Array(captures))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var (
+			hash string
+			n    int
+		)
+		if err := rows.Scan(&hash, &n); err != nil {
+			return nil, err
+		}
+		counts[hash] = n
+	}
+	return counts, rows.Err()
+}
+
+// captureListing is a url in a list of captures, with the number of notes
+// about it's capture. url fields are embedded so they serialize at the top
+// level, same as a plain url
+type captureListing struct {
+	*core.Url
+	Notes int `json:"notes"`
+}
+
+// withNoteCounts adds note counts to a list of urls. counts that can't be
+// read are logged & left at zero
+func withNoteCounts(db *sql.DB, urls []*core.Url) []*captureListing {
+	list := make([]*captureListing, len(urls))
+	hashes := []string{}
+	for i, u := range urls {
+		list[i] = &captureListing{Url: u}
+		if u.Hash != "" {
+			hashes = append(hashes, u.Hash)
+		}
+	}
+	if db == nil || len(hashes) == 0 {
+		return list
+	}
+	counts, err := CaptureNoteCounts(db, hashes)
+	if err != nil {
+		log.Info(err.Error())
+		return list
+	}
+	for _, l := range list {
+		l.Notes = counts[l.Hash]
+	}
+	return list
+}
+
+// checkCapture makes sure a capture exists & the client that sent an action
+// can see it
+func (a *clientAction) checkCapture(svc *Service, capture string) error {
+	if capture == "" {
+		return ErrNotFound
+	}
+	have, err := HaveHashes(svc.DB, svc.Store, []string{capture})
+	if err != nil {
+		return err
+	}
+	if !have[capture] {
+		return ErrNotFound
+	}
+	v, err := loadVisibility(svc.DB, a.client.identity(), svc.Clock())
+	if err != nil {
+		return err
+	}
+	if visible, err := v.Subject(capture); err != nil {
+		return err
+	} else if !visible {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CaptureNotesAction lists the notes about a capture
+type CaptureNotesAction struct {
+	ReqAction
+	clientAction
+	Capture string `json:"capture"`
+}
+
+func (CaptureNotesAction) Type() string        { return "CAPTURE_NOTES_REQUEST" }
+func (CaptureNotesAction) SuccessType() string { return "CAPTURE_NOTES_SUCCESS" }
+func (CaptureNotesAction) FailureType() string { return "CAPTURE_NOTES_FAILURE" }
+
+func (CaptureNotesAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &CaptureNotesAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *CaptureNotesAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if err := a.checkCapture(svc, a.Capture); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "capture", a.Capture)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	notes, err := ReadCaptureNotes(svc.DB, a.Capture)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "CAPTURE_NOTE_ARRAY",
+		Data:      notes,
+	}
+}
+
+// AddCaptureNoteAction writes a note about a capture as the requester
+type AddCaptureNoteAction struct {
+	ReqAction
+	clientAction
+	Capture string `json:"capture"`
+	Text    string `json:"text"`
+}
+
+func (AddCaptureNoteAction) Type() string        { return "CAPTURE_NOTE_ADD_REQUEST" }
+func (AddCaptureNoteAction) SuccessType() string { return "CAPTURE_NOTE_ADD_SUCCESS" }
+func (AddCaptureNoteAction) FailureType() string { return "CAPTURE_NOTE_ADD_FAILURE" }
+
+func (AddCaptureNoteAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &AddCaptureNoteAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *AddCaptureNoteAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if err := a.checkCapture(svc, a.Capture); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "capture", a.Capture)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	n := &CaptureNote{Capture: a.Capture, Author: a.client.identity(), Text: a.Text}
+	if err := AddCaptureNote(svc.DB, n, svc.Clock()); err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "CAPTURE_NOTE",
+		Data:      n,
+	}
+}
+
+// DeleteCaptureNoteAction removes a note. the requester must be the note's
+// author, or send a moderation token
+type DeleteCaptureNoteAction struct {
+	ReqAction
+	clientAction
+	Token string `json:"token"`
+	Id    string `json:"id"`
+}
+
+func (DeleteCaptureNoteAction) Type() string        { return "CAPTURE_NOTE_DELETE_REQUEST" }
+func (DeleteCaptureNoteAction) SuccessType() string { return "CAPTURE_NOTE_DELETE_SUCCESS" }
+func (DeleteCaptureNoteAction) FailureType() string { return "CAPTURE_NOTE_DELETE_FAILURE" }
+
+func (DeleteCaptureNoteAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &DeleteCaptureNoteAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *DeleteCaptureNoteAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	n, err := ReadCaptureNote(svc.DB, a.Id)
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "note", a.Id)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	keyId := a.client.identity()
+	if (keyId == "" || keyId != n.Author) && !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrNotNoteAuthor.Error()}
+	}
+	if err := DeleteCaptureNote(svc.DB, a.Id); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "note", a.Id)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{Type: a.SuccessType(), RequestId: a.RequestId, Id: a.Id}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestCaptureNoteValidate(t *testing.T) {
+	cases := []struct {
+		n   *CaptureNote
+		err error
+	}{
+		{&CaptureNote{Author: "key", Text: "this fetch got a cookie banner"}, nil},
+		{&CaptureNote{Author: "key", Text: strings.Repeat("a", maxCaptureNoteLength)}, nil},
+		{&CaptureNote{Author: "key", Text: strings.Repeat("a", maxCaptureNoteLength+1)}, ErrCaptureNoteText},
+		{&CaptureNote{Author: "key", Text: " \n "}, ErrCaptureNoteText},
+		{&CaptureNote{Text: "server returned partial content"}, ErrCaptureNoteAnonymous},
+	}
+
+	for i, c := range cases {
+		if err := c.n.validate(); err != c.err {
+			t.Errorf("case %d expected error %v, got: %v", i, c.err, err)
+		}
+	}
+}
+
+func TestWriteWARCNotes(t *testing.T) {
+	fetched := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	u := &core.Url{Url: "https://www.epa.gov/", LastGet: &fetched}
+	notes := []*CaptureNote{{Id: "2c9e4f1a-7b3d-4e5f-8a6b-0c1d2e3f4a5b", Capture: "1220b", Author: "key", Text: "cookie banner"}}
+	buf := &bytes.Buffer{}
+	if err := writeWARCNotes(buf, u, notes); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r, err := newWARCReader(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rec, err := r.next()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if rec.header.Get("WARC-Type") != "metadata" || rec.header.Get("WARC-Target-URI") != u.Url {
+		t.Errorf("unexpected record headers: %v", rec.header)
+	}
+	body, _ := ioutil.ReadAll(rec.body)
+	got := []*CaptureNote{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(got) != 1 || got[0].Text != "cookie banner" {
+		t.Errorf("expected notes in the record body, got: %s", body)
+	}
+}
+
+func TestCaptureNotes(t *testing.T) {
+	defer resetTestData(appDB, "urls", "capture_notes")
+
+	const (
+		url     = "https://www.census.gov/nometa.pdf"
+		capture = "1220af06510193276b5fd9ad2fc55dcc004ada557d9259ca3505478bfef0b12ed988"
+		missing = "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a"
+	)
+	svc := newTestService()
+	svc.Config.ModerationToken = "matrix"
+	client := func(keyId string) *Client {
+		c := &Client{svc: svc}
+		if keyId != "" {
+			c.apiKey = &ApiKey{KeyId: keyId}
+		}
+		c.setKeyId(keyId)
+		return c
+	}
+	author, other, anon := client("author"), client("other"), client("")
+	// saying hello with the author's key id doesn't make a client the author
+	claimer := &Client{svc: svc}
+	claimer.setKeyId("author")
+	exec := func(c *Client, a ClientRequestAction) *ClientResponse {
+		a.(ClientBoundAction).SetClient(c)
+		return a.Exec()
+	}
+	add := func(c *Client, capture, text string) *ClientResponse {
+		data, _ := json.Marshal(map[string]string{"capture": capture, "text": text})
+		return exec(c, AddCaptureNoteAction{}.Parse("req", data))
+	}
+
+	res := add(author, capture, "this fetch got a cookie banner")
+	if res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	note := res.Data.(*CaptureNote)
+	if res := add(author, capture, strings.Repeat("a", maxCaptureNoteLength+1)); res.Error != ErrCaptureNoteText.Error() {
+		t.Errorf("expected notes over the size cap to be refused, got: %q", res.Error)
+	}
+	for _, c := range []*Client{anon, claimer} {
+		if res := add(c, capture, "anonymous"); res.Error != ErrCaptureNoteAnonymous.Error() {
+			t.Errorf("expected anonymous notes to be refused, got: %q", res.Error)
+		}
+	}
+	if res := add(author, missing, "missing"); res.Code != notFoundErrCode {
+		t.Errorf("expected notes on missing captures to be not found, got: %q", res.Error)
+	}
+	if res := add(other, capture, "server returned partial content"); res.Error != "" {
+		t.Fatal(res.Error)
+	}
+
+	// listings count notes, detail & list actions have them in full
+	res = exec(anon, FetchContentUrlsAction{}.Parse("req", json.RawMessage(`{"hash":"`+capture+`"}`)))
+	if list, ok := res.Data.([]*captureListing); !ok || len(list) != 1 || list[0].Notes != 2 {
+		t.Errorf("expected the capture listing to count 2 notes, got: %v", res.Data)
+	}
+	res = exec(anon, FetchUrlAct{}.Parse("req", json.RawMessage(`{"url":"`+url+`"}`)))
+	if d, ok := res.Data.(*urlDetail); !ok || len(d.Notes) != 2 || d.Notes[0].Id != note.Id {
+		t.Errorf("expected url detail to have the capture's notes, got: %v", res.Data)
+	}
+	res = exec(anon, CaptureNotesAction{}.Parse("req", json.RawMessage(`{"capture":"`+capture+`"}`)))
+	if notes, ok := res.Data.([]*CaptureNote); !ok || len(notes) != 2 {
+		t.Errorf("expected 2 notes, got: %v", res.Data)
+	}
+
+	// notes aren't metadata
+	if blocks, err := MetadataForSubject(appDB, capture); err != nil || len(blocks) != 0 {
+		t.Errorf("expected notes to stay out of the metadata chain, got: %d blocks %v", len(blocks), err)
+	}
+
+	// only the author or a moderator can delete
+	del := func(c *Client, token string) *ClientResponse {
+		return exec(c, DeleteCaptureNoteAction{}.Parse("req", json.RawMessage(`{"id":"`+note.Id+`","token":"`+token+`"}`)))
+	}
+	if res := del(other, ""); res.Error != ErrNotNoteAuthor.Error() {
+		t.Errorf("expected other users to be refused, got: %q", res.Error)
+	}
+	if res := del(claimer, ""); res.Error != ErrNotNoteAuthor.Error() {
+		t.Errorf("expected clients without the author's api key to be refused, got: %q", res.Error)
+	}
+	if res := del(anon, "wrong"); res.Error != ErrNotNoteAuthor.Error() {
+		t.Errorf("expected invalid tokens to be refused, got: %q", res.Error)
+	}
+	if res := del(author, ""); res.Error != "" {
+		t.Errorf("expected the author to delete their note, got: %q", res.Error)
+	}
+	notes, err := ReadCaptureNotes(appDB, capture)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(notes) != 1 {
+		t.Fatalf("expected 1 note left, got: %d", len(notes))
+	}
+	note = notes[0]
+	if res := del(anon, "matrix"); res.Error != "" {
+		t.Errorf("expected moderators to delete any note, got: %q", res.Error)
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/pborman/uuid"
+)
+
+// Chain health
+//
+// Every key writes metadata about a subject as a chain, each block naming the
+// block before it in prev. chain health runs verify a random sample of chains
+// once a day & record how many are healthy, broken, forked or unverifiable,
+// so operators get a trend line. samples are drawn with a recorded seed from
+// the chains that existed when the run started, so a run can be checked again
+// against exactly the same chains
+
+// EventChainHealthAlert is published when the share of broken chains rises
+// more than cfg.ChainHealthAlertPoints between runs
+const EventChainHealthAlert = "CHAIN_HEALTH_ALERT"
+
+// Chain health, from worst to best. chains are counted under their worst cause
+const (
+	chainBroken       = "broken"
+	chainForked       = "forked"
+	chainUnverifiable = "unverifiable"
+	chainHealthy      = "healthy"
+)
+
+// Causes of unhealthy chains, & the health each one gives a chain
+const (
+	// a block doesn't hash to it's hash
+	causeHashMismatch = "hash_mismatch"
+	// a block's prev isn't in the chain
+	causeMissingPrev = "missing_prev"
+	// following prev loops back on itself
+	causeCycle = "cycle"
+	// more than one block follows the same block, or the chain has more than one start
+	causeFork = "fork"
+	// a block was deleted, leaving nothing to hash
+	causeDeleted = "deleted"
+	// a block was anonymized, so it no longer has the key id it was hashed with, see erase.go
+	causeErased = "erased"
+	// a block is stamped before it's prev, see clock_skew.go
+	causeOutOfOrder = "out_of_order"
+)
+
+var chainCauseHealth = map[string]string{
+	causeHashMismatch: chainBroken,
+	causeMissingPrev:  chainBroken,
+	causeCycle:        chainBroken,
+	causeFork:         chainForked,
+	causeDeleted:      chainUnverifiable,
+	causeErased:       chainUnverifiable,
+	causeOutOfOrder:   chainBroken,
+}
+
+const (
+	// how often the leader runs chain health
+	chainHealthInterval = 24 * time.Hour
+	// chains sampled each run unless configured
+	defaultChainHealthSampleSize = 200
+	// percentage point rise in broken chains between runs that alerts, unless configured
+	defaultChainHealthAlertPoints = 5
+	// example block hashes kept for each cause
+	chainHealthExamples = 5
+	// most runs returned by CHAIN_HEALTH_REQUEST
+	maxChainHealthRuns = 52
+)
+
+// chainHealthRunning is 1 while this instance is running chain health
+var chainHealthRunning int32
+
+// ChainHealthRun is the result of verifying a sample of metadata chains
+type ChainHealthRun struct {
+	Id string `json:"id"`
+	// chains that existed at created were sampled, blocks written since are ignored
+	Created time.Time `json:"created"`
+	// seed the sample was drawn with
+	Seed int64 `json:"seed"`
+	// chains requested & chains actually sampled, fewer if the corpus is small
+	SampleSize int `json:"sampleSize"`
+	Sampled    int `json:"sampled"`
+
+	Healthy      int `json:"healthy"`
+	Broken       int `json:"broken"`
+	Forked       int `json:"forked"`
+	Unverifiable int `json:"unverifiable"`
+	// chains each cause was found in, a chain can have more than one cause
+	Causes map[string]int `json:"causes"`
+	// hashes of blocks each cause was found at, up to chainHealthExamples
+	Examples map[string][]string `json:"examples"`
+}
+
+var chainHealthRunCols = &columnSet{
+	table:   "chain_health_runs",
+	columns: []string{"id", "created", "seed", "sample_size", "sampled", "healthy", "broken", "forked", "unverifiable", "causes", "examples"},
+}
+
+// BrokenPercent is the percent of sampled chains that are broken
+func (r *ChainHealthRun) BrokenPercent() float64 {
+	if r.Sampled == 0 {
+		return 0
+	}
+	return float64(r.Broken) * 100 / float64(r.Sampled)
+}
+
+// chainKey identifies a chain: the blocks a key wrote about a subject
+type chainKey struct {
+	KeyId   string
+	Subject string
+}
+
+// chainFinding is a cause found at a block of a chain
+type chainFinding struct {
+	cause string
+	hash  string
+}
+
+// checkChain verifies a chain's blocks, returning everything wrong with it.
+// deleted lists blocks that were deleted
+func checkChain(blocks []*core.Metadata, deleted map[string]bool) ([]chainFinding, error) {
+	found := []chainFinding{}
+	byHash := map[string]*core.Metadata{}
+	next := map[string][]string{}
+	for _, m := range blocks {
+		byHash[m.Hash] = m
+		next[m.Prev] = append(next[m.Prev], m.Hash)
+	}
+
+	for _, m := range blocks {
+		if deleted[m.Hash] {
+			found = append(found, chainFinding{causeDeleted, m.Hash})
+		} else if erasedKeyId(m.KeyId) {
+			found = append(found, chainFinding{causeErased, m.Hash})
+		} else if got, err := metadataHash(m); err != nil {
+			return nil, err
+		} else if got != m.Hash {
+			found = append(found, chainFinding{causeHashMismatch, m.Hash})
+		}
+		if m.Prev != "" && byHash[m.Prev] == nil {
+			found = append(found, chainFinding{causeMissingPrev, m.Hash})
+		}
+		// a walk back along prev longer than the chain has looped
+		at, looped := m, false
+		for steps := 0; at != nil && at.Prev != ""; steps++ {
+			if steps > len(blocks) {
+				found = append(found, chainFinding{causeCycle, m.Hash})
+				looped = true
+				break
+			}
+			at = byHash[at.Prev]
+		}
+		// blocks stamped in the same second as their prev were written before
+		// timestamps were bumped, & skew adjusted blocks are always after it
+		if prev := byHash[m.Prev]; prev != nil && !looped && m.Timestamp.Before(prev.Timestamp) {
+			found = append(found, chainFinding{causeOutOfOrder, m.Hash})
+		}
+	}
+
+	prevs := make([]string, 0, len(next))
+	for prev := range next {
+		prevs = append(prevs, prev)
+	}
+	sort.Strings(prevs)
+	for _, prev := range prevs {
+		if len(next[prev]) > 1 {
+			found = append(found, chainFinding{causeFork, next[prev][0]})
+		}
+	}
+	return found, nil
+}
+
+// chainHealth is the worst health the findings give a chain
+func chainHealth(found []chainFinding) string {
+	health := chainHealthy
+	rank := map[string]int{chainHealthy: 0, chainUnverifiable: 1, chainForked: 2, chainBroken: 3}
+	for _, f := range found {
+		if h := chainCauseHealth[f.cause]; rank[h] > rank[health] {
+			health = h
+		}
+	}
+	return health
+}
+
+// add counts a chain's findings into the run
+func (r *ChainHealthRun) add(found []chainFinding) {
+	r.Sampled++
+	switch chainHealth(found) {
+	case chainBroken:
+		r.Broken++
+	case chainForked:
+		r.Forked++
+	case chainUnverifiable:
+		r.Unverifiable++
+	default:
+		r.Healthy++
+	}
+	counted := map[string]bool{}
+	for _, f := range found {
+		if !counted[f.cause] {
+			counted[f.cause] = true
+			r.Causes[f.cause]++
+		}
+		if len(r.Examples[f.cause]) < chainHealthExamples {
+			r.Examples[f.cause] = append(r.Examples[f.cause], f.hash)
+		}
+	}
+}
+
+// sampleChains draws up to size chains that existed at at. chains are
+// ordered by a hash of the seed & the chain, so the same seed & time always
+// draws the same chains
+func sampleChains(db *sql.DB, seed int64, size int, at time.Time) ([]chainKey, error) {
+	rows, err := db.Query(`select key_id, subject from metadata
+		group by key_id, subject having min(time_stamp) <= $2
+		order by md5($1 || '/' || key_id || '/' || subject), key_id, subject limit $3`,
+		strconv.FormatInt(seed, 10), at.In(time.UTC), size)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []chainKey{}
+	for rows.Next() {
+		k := chainKey{}
+		if err := rows.Scan(&k.KeyId, &k.Subject); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// readChain reads the blocks of a chain written by at, & which of them are deleted
+func readChain(db *sql.DB, k chainKey, at time.Time) ([]*core.Metadata, map[string]bool, error) {
+	rows, err := db.Query("select "+metadataCols.String()+" from metadata where key_id = $1 and subject = $2 and time_stamp <= $3 order by time_stamp, hash",
+		k.KeyId, k.Subject, at.In(time.UTC))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	blocks := []*core.Metadata{}
+	for rows.Next() {
+		m, err := scanMetadata(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	deleted := map[string]bool{}
+	drows, err := db.Query("select hash from metadata where key_id = $1 and subject = $2 and time_stamp <= $3 and deleted = true", k.KeyId, k.Subject, at.In(time.UTC))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer drows.Close()
+	for drows.Next() {
+		var hash string
+		if err := drows.Scan(&hash); err != nil {
+			return nil, nil, err
+		}
+		deleted[hash] = true
+	}
+	return blocks, deleted, drows.Err()
+}
+
+// SampleChainHealth verifies a sample of the chains that existed at at,
+// drawn with seed. the result isn't saved
+func SampleChainHealth(db *sql.DB, seed int64, size int, at time.Time) (*ChainHealthRun, error) {
+	at = at.Round(time.Second).In(time.UTC)
+	keys, err := sampleChains(db, seed, size, at)
+	if err != nil {
+		return nil, err
+	}
+	r := &ChainHealthRun{
+		Id:         uuid.New(),
+		Created:    at,
+		Seed:       seed,
+		SampleSize: size,
+		Causes:     map[string]int{},
+		Examples:   map[string][]string{},
+	}
+	for _, k := range keys {
+		blocks, deleted, err := readChain(db, k, at)
+		if err != nil {
+			return nil, err
+		}
+		found, err := checkChain(blocks, deleted)
+		if err != nil {
+			return nil, err
+		}
+		r.add(found)
+	}
+	return r, nil
+}
+
+// save records a run in the chain health history
+func (r *ChainHealthRun) save(db *sql.DB) error {
+	causes, err := json.Marshal(r.Causes)
+	if err != nil {
+		return err
+	}
+	examples, err := json.Marshal(r.Examples)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("insert into chain_health_runs ("+chainHealthRunCols.String()+") values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		r.Id, r.Created, r.Seed, r.SampleSize, r.Sampled, r.Healthy, r.Broken, r.Forked, r.Unverifiable, causes, examples)
+	return checkWriteErr(err)
+}
+
+// scanChainHealthRun reads a run selected with chainHealthRunCols
+func scanChainHealthRun(row sqlScannable) (*ChainHealthRun, error) {
+	r := &ChainHealthRun{Causes: map[string]int{}, Examples: map[string][]string{}}
+	var causes, examples []byte
+	err := chainHealthRunCols.scan(row, scanTargets{
+		"id":           &r.Id,
+		"created":      &r.Created,
+		"seed":         &r.Seed,
+		"sample_size":  &r.SampleSize,
+		"sampled":      &r.Sampled,
+		"healthy":      &r.Healthy,
+		"broken":       &r.Broken,
+		"forked":       &r.Forked,
+		"unverifiable": &r.Unverifiable,
+		"causes":       &causes,
+		"examples":     &examples,
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	r.Created = r.Created.In(time.UTC)
+	if err := json.Unmarshal(causes, &r.Causes); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(examples, &r.Examples); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ChainHealthHistory reads the most recent runs, newest first
+func ChainHealthHistory(db *sql.DB, limit int) ([]*ChainHealthRun, error) {
+	if limit <= 0 || limit > maxChainHealthRuns {
+		limit = maxChainHealthRuns
+	}
+	rows, err := db.Query("select "+chainHealthRunCols.String()+" from chain_health_runs order by created desc limit $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []*ChainHealthRun{}
+	for rows.Next() {
+		r, err := scanChainHealthRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// readChainHealthRun reads a single run by id
+func readChainHealthRun(db *sql.DB, id string) (*ChainHealthRun, error) {
+	return scanChainHealthRun(db.QueryRow("select "+chainHealthRunCols.String()+" from chain_health_runs where id = $1", id))
+}
+
+// ChainHealthAlert describes a rise in broken chains between runs
+type ChainHealthAlert struct {
+	RunId string `json:"runId"`
+	// percent of sampled chains broken in the previous & latest run
+	PreviousPercent float64 `json:"previousPercent"`
+	BrokenPercent   float64 `json:"brokenPercent"`
+	// hashes of blocks where chains broke in the latest run
+	Examples map[string][]string `json:"examples"`
+}
+
+// chainHealthAlert checks if the share of broken chains rose more than points
+// percentage points from prev to r, nil if it didn't
+func chainHealthAlert(prev, r *ChainHealthRun, points int) *ChainHealthAlert {
+	if prev == nil || prev.Sampled == 0 || r.Sampled == 0 {
+		return nil
+	}
+	if r.BrokenPercent()-prev.BrokenPercent() <= float64(points) {
+		return nil
+	}
+	examples := map[string][]string{}
+	for cause, hashes := range r.Examples {
+		if chainCauseHealth[cause] == chainBroken {
+			examples[cause] = hashes
+		}
+	}
+	return &ChainHealthAlert{RunId: r.Id, PreviousPercent: prev.BrokenPercent(), BrokenPercent: r.BrokenPercent(), Examples: examples}
+}
+
+// runChainHealth is the leader task that samples chain health once every
+// chainHealthInterval, alerting when broken chains rise between runs
+func runChainHealth(db *sql.DB, now time.Time) {
+	if !atomic.CompareAndSwapInt32(&chainHealthRunning, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&chainHealthRunning, 0)
+
+	history, err := ChainHealthHistory(db, 1)
+	if err != nil {
+		log.Infof("error reading chain health history: %s", err.Error())
+		return
+	}
+	var prev *ChainHealthRun
+	if len(history) > 0 {
+		prev = history[0]
+		if now.Sub(prev.Created) < chainHealthInterval {
+			return
+		}
+	}
+
+	size, points := defaultChainHealthSampleSize, defaultChainHealthAlertPoints
+	if cfg != nil {
+		size, points = cfg.ChainHealthSampleSize, cfg.ChainHealthAlertPoints
+	}
+	r, err := SampleChainHealth(db, now.UnixNano(), size, now)
+	if err != nil {
+		log.Infof("error sampling chain health: %s", err.Error())
+		return
+	}
+	if err := r.save(db); err != nil {
+		log.Infof("error saving chain health: %s", err.Error())
+		return
+	}
+	log.Infof("chain health: %d chains sampled, %d broken, %d forked, %d unverifiable", r.Sampled, r.Broken, r.Forked, r.Unverifiable)
+
+	if alert := chainHealthAlert(prev, r, points); alert != nil {
+		log.Errorf("broken metadata chains rose from %.1f%% to %.1f%% of sampled chains, run %s", alert.PreviousPercent, alert.BrokenPercent, r.Id)
+		publishEvent(&Event{Type: EventChainHealthAlert, Data: alert})
+	}
+}
+
+// writeChainHealthMetrics writes the latest run as prometheus gauges
+func writeChainHealthMetrics(w io.Writer, r *ChainHealthRun) {
+	fmt.Fprintln(w, "# HELP patchbay_chain_health_sampled metadata chains sampled by the latest chain health run")
+	fmt.Fprintln(w, "# TYPE patchbay_chain_health_sampled gauge")
+	fmt.Fprintf(w, "patchbay_chain_health_sampled %d\n", r.Sampled)
+	fmt.Fprintln(w, "# HELP patchbay_chain_health_chains sampled chains by health")
+	fmt.Fprintln(w, "# TYPE patchbay_chain_health_chains gauge")
+	for _, s := range []struct {
+		health string
+		n      int
+	}{{chainHealthy, r.Healthy}, {chainBroken, r.Broken}, {chainForked, r.Forked}, {chainUnverifiable, r.Unverifiable}} {
+		fmt.Fprintf(w, "patchbay_chain_health_chains{health=%q} %d\n", s.health, s.n)
+	}
+	fmt.Fprintln(w, "# HELP patchbay_chain_health_causes sampled chains each cause was found in")
+	fmt.Fprintln(w, "# TYPE patchbay_chain_health_causes gauge")
+	for _, cause := range []string{causeHashMismatch, causeMissingPrev, causeCycle, causeFork, causeOutOfOrder, causeDeleted, causeErased} {
+		fmt.Fprintf(w, "patchbay_chain_health_causes{cause=%q} %d\n", cause, r.Causes[cause])
+	}
+	fmt.Fprintln(w, "# HELP patchbay_chain_health_broken_percent percent of sampled chains that are broken")
+	fmt.Fprintln(w, "# TYPE patchbay_chain_health_broken_percent gauge")
+	fmt.Fprintf(w, "patchbay_chain_health_broken_percent %g\n", r.BrokenPercent())
+	fmt.Fprintln(w, "# HELP patchbay_chain_health_run_timestamp_seconds when the latest run sampled chains")
+	fmt.Fprintln(w, "# TYPE patchbay_chain_health_run_timestamp_seconds gauge")
+	fmt.Fprintf(w, "patchbay_chain_health_run_timestamp_seconds %d\n", r.Created.Unix())
+}
+
+// ChainHealthMetricsHandler exposes the latest chain health run, metadata
+// badge stats, client round trip times & rate limit consumption in the prometheus text format. chain health isn't written until
+// the first run
+func ChainHealthMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	history, err := ChainHealthHistory(appDB, 1)
+	if err != nil {
+		log.Info(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	limits, err := rateLimits.Status(defaultService(), time.Now())
+	if err != nil {
+		log.Info(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if len(history) > 0 {
+		writeChainHealthMetrics(w, history[0])
+	}
+	writeMetadataBadgeMetrics(w, metadataBadges.Stats())
+	writeLatencyMetrics(w)
+	writeReplicaMetrics(w, replicas)
+	writeLimitMetrics(w, limits)
+}
+
+// ChainHealthAction reads chain health history for admins, with per-cause
+// breakdowns & example hashes. setting recheck verifies the sample of a past
+// run again, against the same chains as they are now
+type ChainHealthAction struct {
+	ReqAction
+	clientAction
+	Token string `json:"token"`
+	Limit int    `json:"limit"`
+	// id of a run to check again
+	Recheck string `json:"recheck"`
+}
+
+func (ChainHealthAction) Type() string        { return "CHAIN_HEALTH_REQUEST" }
+func (ChainHealthAction) SuccessType() string { return "CHAIN_HEALTH_SUCCESS" }
+func (ChainHealthAction) FailureType() string { return "CHAIN_HEALTH_FAILURE" }
+
+func (ChainHealthAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &ChainHealthAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *ChainHealthAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrNotModerator.Error()}
+	}
+
+	if a.Recheck != "" {
+		prev, err := readChainHealthRun(svc.DB, a.Recheck)
+		if err == ErrNotFound {
+			return notFoundResponse(a, a.RequestId, "chainHealthRun", a.Recheck)
+		} else if err != nil {
+			log.Info(err.Error())
+			return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+		}
+		r, err := SampleChainHealth(svc.DB, prev.Seed, prev.SampleSize, prev.Created)
+		if err != nil {
+			log.Info(err.Error())
+			return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+		}
+		return &ClientResponse{Type: a.SuccessType(), RequestId: a.RequestId, Schema: "CHAIN_HEALTH_RUN", Id: a.Recheck, Data: r}
+	}
+
+	runs, err := ChainHealthHistory(svc.DB, a.Limit)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{Type: a.SuccessType(), RequestId: a.RequestId, Schema: "CHAIN_HEALTH_RUN_ARRAY", Data: runs}
+}
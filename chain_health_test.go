@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// testChain builds a chain of correctly hashed blocks, each following the last
+func testChain(t *testing.T, titles ...string) []*core.Metadata {
+	blocks := []*core.Metadata{}
+	prev := ""
+	for i, title := range titles {
+		m := &core.Metadata{
+			Timestamp: time.Date(2017, 1, 1, 0, 0, i, 0, time.UTC),
+			KeyId:     "key",
+			Subject:   "subject",
+			Prev:      prev,
+			Meta:      map[string]interface{}{"title": title},
+		}
+		hash, err := metadataHash(m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		m.Hash = hash
+		prev = hash
+		blocks = append(blocks, m)
+	}
+	return blocks
+}
+
+func TestCheckChain(t *testing.T) {
+	healthy := testChain(t, "EPA", "EPA!", "EPA!!")
+
+	tampered := testChain(t, "EPA", "EPA!")
+	tampered[1].Meta = map[string]interface{}{"title": "not the EPA"}
+
+	missing := testChain(t, "EPA", "EPA!", "EPA!!")[1:]
+
+	forked := testChain(t, "EPA", "EPA!")
+	fork := &core.Metadata{Timestamp: time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC), KeyId: "key", Subject: "subject", Prev: forked[0].Hash, Meta: map[string]interface{}{"title": "EPA?"}}
+	fork.Hash, _ = metadataHash(fork)
+	forked = append(forked, fork)
+
+	looped := testChain(t, "EPA", "EPA!")
+	looped[0].Prev = looped[1].Hash
+
+	// blocks stamped in the same second as their prev are legacy writes, not skew
+	skewed := testChain(t, "EPA", "EPA!", "EPA!!")
+	skewed[1].Timestamp = skewed[0].Timestamp.Add(-time.Minute)
+	skewed[1].Hash, _ = metadataHash(skewed[1])
+	skewed[2].Prev = skewed[1].Hash
+	skewed[2].Timestamp = skewed[1].Timestamp
+	skewed[2].Hash, _ = metadataHash(skewed[2])
+
+	// anonymized blocks no longer hash to their hash, but aren't tampered with
+	anonymized := testChain(t, "EPA", "EPA!")
+	for _, m := range anonymized {
+		m.KeyId = pseudonymPrefix + "5f1c2b3a-4d5e-4f60-8a7b-9c0d1e2f3a4b"
+	}
+
+	cases := []struct {
+		blocks  []*core.Metadata
+		deleted map[string]bool
+		causes  []string
+		health  string
+	}{
+		{healthy, nil, []string{}, chainHealthy},
+		{healthy, map[string]bool{healthy[1].Hash: true}, []string{causeDeleted}, chainUnverifiable},
+		{tampered, nil, []string{causeHashMismatch}, chainBroken},
+		{missing, nil, []string{causeMissingPrev}, chainBroken},
+		{forked, nil, []string{causeFork}, chainForked},
+		// the loop is found walking back from both blocks
+		{looped, nil, []string{causeHashMismatch, causeCycle, causeCycle}, chainBroken},
+		{skewed, nil, []string{causeOutOfOrder}, chainBroken},
+		{anonymized, nil, []string{causeErased, causeErased}, chainUnverifiable},
+	}
+
+	for i, c := range cases {
+		found, err := checkChain(c.blocks, c.deleted)
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err.Error())
+			continue
+		}
+		causes := []string{}
+		for _, f := range found {
+			causes = append(causes, f.cause)
+		}
+		if strings.Join(causes, ",") != strings.Join(c.causes, ",") {
+			t.Errorf("case %d expected causes %v, got: %v", i, c.causes, causes)
+		}
+		if got := chainHealth(found); got != c.health {
+			t.Errorf("case %d expected health %s, got: %s", i, c.health, got)
+		}
+	}
+}
+
+func TestChainHealthAlert(t *testing.T) {
+	run := func(sampled, broken int) *ChainHealthRun {
+		return &ChainHealthRun{
+			Id:       "run",
+			Sampled:  sampled,
+			Broken:   broken,
+			Examples: map[string][]string{causeMissingPrev: {"a"}, causeFork: {"b"}},
+		}
+	}
+	cases := []struct {
+		prev, r *ChainHealthRun
+		alert   bool
+	}{
+		{nil, run(100, 50), false},
+		{run(0, 0), run(100, 50), false},
+		{run(100, 1), run(100, 6), false},
+		{run(100, 1), run(100, 7), true},
+		{run(100, 10), run(200, 20), false},
+		{run(100, 10), run(100, 2), false},
+	}
+
+	for i, c := range cases {
+		alert := chainHealthAlert(c.prev, c.r, 5)
+		if (alert != nil) != c.alert {
+			t.Errorf("case %d expected alert to be %t, got: %v", i, c.alert, alert)
+			continue
+		}
+		if alert != nil && (len(alert.Examples) != 1 || alert.Examples[causeMissingPrev] == nil) {
+			t.Errorf("case %d expected alert to only give examples of broken chains, got: %v", i, alert.Examples)
+		}
+	}
+}
+
+func TestWriteChainHealthMetrics(t *testing.T) {
+	r := &ChainHealthRun{
+		Created:  time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		Sampled:  4,
+		Healthy:  3,
+		Broken:   1,
+		Causes:   map[string]int{causeHashMismatch: 1},
+		Examples: map[string][]string{},
+	}
+	buf := &bytes.Buffer{}
+	writeChainHealthMetrics(buf, r)
+	for _, line := range []string{
+		"patchbay_chain_health_sampled 4",
+		`patchbay_chain_health_chains{health="healthy"} 3`,
+		`patchbay_chain_health_chains{health="broken"} 1`,
+		`patchbay_chain_health_causes{cause="hash_mismatch"} 1`,
+		`patchbay_chain_health_causes{cause="fork"} 0`,
+		`patchbay_chain_health_causes{cause="out_of_order"} 0`,
+		"patchbay_chain_health_broken_percent 25",
+		"patchbay_chain_health_run_timestamp_seconds 1483228800",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected metrics to include %q, got:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestSampleChainHealth(t *testing.T) {
+	defer resetTestData(appDB, "metadata", "chain_health_runs")
+
+	if _, err := appDB.Exec(`insert into metadata (hash,time_stamp,key_id,subject,prev,meta,deleted) values
+		('a', '2017-01-01 00:00:01', 'alice', 'epa', '', '{"title":"EPA"}', false),
+		('b', '2017-01-01 00:00:02', 'alice', 'epa', 'a', '{"title":"EPA!"}', false),
+		('c', '2017-01-01 00:00:01', 'bob', 'epa', '', '{"title":"EPA"}', false),
+		('d', '2017-01-01 00:00:01', 'alice', 'noaa', 'missing', '{"title":"NOAA"}', false),
+		('e', '2017-01-01 00:00:01', 'bob', 'noaa', '', null, true),
+		('f', '2017-01-03 00:00:01', 'carol', 'epa', '', '{"title":"EPA"}', false)`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	at := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	r, err := SampleChainHealth(appDB, 42, 3, at)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Sampled != 3 {
+		t.Errorf("expected 3 chains to be sampled, got: %d", r.Sampled)
+	}
+	if err := r.save(appDB); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the same seed & time draws the same chains, even once more are written
+	if _, err := appDB.Exec(`insert into metadata (hash,time_stamp,key_id,subject,prev,meta,deleted) values
+		('g', '2017-01-04 00:00:01', 'dave', 'epa', '', '{"title":"EPA"}', false)`); err != nil {
+		t.Fatal(err.Error())
+	}
+	again, err := SampleChainHealth(appDB, 42, 3, at)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if again.Healthy != r.Healthy || again.Broken != r.Broken || again.Unverifiable != r.Unverifiable || len(again.Examples) != len(r.Examples) {
+		t.Errorf("expected reruns to match, got: %#v, %#v", r, again)
+	}
+	for cause, hashes := range r.Examples {
+		if strings.Join(hashes, ",") != strings.Join(again.Examples[cause], ",") {
+			t.Errorf("expected %s examples to match, got: %v, %v", cause, hashes, again.Examples[cause])
+		}
+	}
+
+	history, err := ChainHealthHistory(appDB, 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(history) != 1 || history[0].Id != r.Id || history[0].Seed != 42 || !history[0].Created.Equal(at) {
+		t.Errorf("expected run to be recorded, got: %v", history)
+	}
+}
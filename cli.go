@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// Command line
+//
+// Running the binary with arguments runs a maintenance command instead of the
+// server, eg: patchbay archive https://www.epa.gov. commands run against the
+// configured database with the same service the server uses, & call the same
+// functions as the equivalent websocket actions & admin endpoints.
+//
+// Results are written to stdout, progress & errors to stderr. --json writes
+// results & errors as JSON for scripting. Commands exit 1 on failure & 2 when
+// they're used incorrectly
+
+// exit codes
+const (
+	cliExitOk    = 0
+	cliExitError = 1
+	cliExitUsage = 2
+)
+
+// cliCommand is a maintenance task run from the command line
+type cliCommand struct {
+	name  string
+	usage string
+	help  string
+	// checkSchema is false for commands that must run against an out of date schema
+	checkSchema bool
+	run         func(c *cliContext, args []string) error
+}
+
+// cliCommands are the commands the binary runs, by name. set in init as
+// the help command lists them
+var cliCommands map[string]*cliCommand
+
+func init() {
+	cliCommands = map[string]*cliCommand{}
+	for _, cmd := range []*cliCommand{
+		{"archive", "archive [--record] <url>", "archive a url & the links it references", true, cliArchive},
+		{"verify-metadata", "verify-metadata [--subject <hash>]", "re-hash stored metadata, failing if any doesn't match it's hash", true, cliVerifyMetadata},
+		{"migrate", "migrate", "create tables & indexes the database is missing", false, cliMigrate},
+		{"gc", "gc [--dry-run]", "remove stored content nothing references & stale temp files", true, cliGC},
+		{"export-warc", "export-warc --subprimer <id> | --collection <id> [--notes] -o <file>", "write a subprimer's or collection's captures to a gzipped WARC", true, cliExportWARC},
+		{"import-metadata", "import-metadata <file>", "load metadata blocks from a user export zip or a file of JSON blocks", true, cliImportMetadata},
+		{"subprimer", "subprimer add --primer <id> [--title <title>] <url> | subprimer list", "add or list subprimers", true, cliSubprimer},
+		{"backfill-anchors", "backfill-anchors", "re-extract link anchor text from stored HTML captures", true, cliBackfillAnchors},
+		{"help", "help", "list commands", false, nil},
+	} {
+		cliCommands[cmd.name] = cmd
+	}
+}
+
+// cliUsageError is an error in how a command was called
+type cliUsageError struct {
+	msg string
+}
+
+func (e cliUsageError) Error() string { return e.msg }
+
+func cliUsageErrorf(format string, args ...interface{}) error {
+	return cliUsageError{fmt.Sprintf(format, args...)}
+}
+
+// cliError is how a failed command is reported with --json
+type cliError struct {
+	Command string `json:"command"`
+	Error   string `json:"error"`
+	Usage   string `json:"usage,omitempty"`
+}
+
+// cliContext is what a running command writes output with
+type cliContext struct {
+	s      *Service
+	stdout io.Writer
+	stderr io.Writer
+	json   bool
+}
+
+// flags creates a flag set for a command that accepts --json anywhere before
+// the command's arguments
+func (c *cliContext) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.BoolVar(&c.json, "json", c.json, "write output as JSON")
+	return fs
+}
+
+// parse parses a command's flags, reporting bad flags as usage errors
+func (c *cliContext) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return cliUsageError{err.Error()}
+	}
+	return nil
+}
+
+// progress writes a line of progress to stderr. progress isn't written with --json
+func (c *cliContext) progress(format string, args ...interface{}) {
+	if !c.json {
+		fmt.Fprintf(c.stderr, format+"\n", args...)
+	}
+}
+
+// result writes a command's result to stdout, as v with --json & as the text
+// written by text otherwise
+func (c *cliContext) result(v interface{}, text func(w io.Writer)) error {
+	if c.json {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	text(c.stdout)
+	return nil
+}
+
+// runCLI runs the command named by args[0], returning the process exit code.
+// setup configures the service commands run against, it's only called for
+// commands that need it
+func runCLI(args []string, stdout, stderr io.Writer, setup func(checkSchema bool) (*Service, error)) int {
+	c := &cliContext{stdout: stdout, stderr: stderr}
+	fs := c.flags("patchbay")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		c.usage()
+		return cliExitUsage
+	}
+	name, args := fs.Arg(0), fs.Args()[1:]
+	cmd := cliCommands[name]
+	if cmd == nil {
+		c.fail(name, "", cliUsageErrorf("unknown command: %s", name))
+		return cliExitUsage
+	}
+	if cmd.run == nil {
+		c.usage()
+		return cliExitOk
+	}
+
+	s, err := setup(cmd.checkSchema)
+	if err != nil {
+		c.fail(name, "", err)
+		return cliExitError
+	}
+	c.s = s
+	// events are published in the background, don't exit before they're sent
+	defer waitForEvents()
+	if err := cmd.run(c, args); err != nil {
+		if _, ok := err.(cliUsageError); ok {
+			c.fail(name, cmd.usage, err)
+			return cliExitUsage
+		}
+		c.fail(name, "", err)
+		return cliExitError
+	}
+	return cliExitOk
+}
+
+// fail reports a failed command to stderr
+func (c *cliContext) fail(name, usage string, err error) {
+	if c.json {
+		json.NewEncoder(c.stderr).Encode(&cliError{Command: name, Error: err.Error(), Usage: usage})
+		return
+	}
+	fmt.Fprintf(c.stderr, "patchbay %s: %s\n", name, err.Error())
+	if usage != "" {
+		fmt.Fprintf(c.stderr, "usage: patchbay %s\n", usage)
+	}
+}
+
+// usage lists commands on stderr
+func (c *cliContext) usage() {
+	fmt.Fprintln(c.stderr, "usage: patchbay [--json] <command> [args]")
+	fmt.Fprintln(c.stderr, "runs the server when called without a command. commands:")
+	tw := tabwriter.NewWriter(c.stderr, 0, 4, 2, ' ', 0)
+	for _, name := range []string{"archive", "verify-metadata", "migrate", "gc", "export-warc", "subprimer", "backfill-anchors", "help"} {
+		cmd := cliCommands[name]
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.usage, cmd.help)
+	}
+	tw.Flush()
+}
+
+// setupCLI connects to the configured database & datastore the way the server
+// does, without starting anything that runs in the background. logs go to
+// stderr so they don't mix with results
+func setupCLI(checkSchema bool) (*Service, error) {
+	var err error
+	if cfg, err = initConfig(os.Getenv("GOLANG_ENV")); err != nil {
+		return nil, fmt.Errorf("configuration error: %s", err.Error())
+	}
+	log.Out = os.Stderr
+	if appDB, err = SetupConnection(cfg.PostgresDbUrl); err != nil {
+		return nil, err
+	}
+	if checkSchema {
+		if err := checkColumnSets(appDB); err != nil {
+			return nil, fmt.Errorf("database schema error: %s, run patchbay migrate", err.Error())
+		}
+	}
+	if err := startConfiguredMaintenance(cfg); err != nil {
+		return nil, fmt.Errorf("configuration error: %s", err.Error())
+	}
+	setupStore(appDB)
+	// commands that change subprimers tell running servers about it
+	if cfg.RedisUrl != "" {
+		eventsPool = newEventsPool(cfg.RedisUrl)
+	}
+	bandwidth.configure(appDB, cfg)
+	// reads this month's usage, so caps apply
+	if err := bandwidth.flush(); err != nil {
+		return nil, err
+	}
+	return defaultService(), nil
+}
+
+func cliArchive(c *cliContext, args []string) error {
+	fs := c.flags("archive")
+	record := fs.Bool("record", false, "record the job's fetches so it can be replayed")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return cliUsageErrorf("archive takes a single url")
+	}
+
+	done := make(chan error, 1)
+	u, links, err := c.s.ArchiveUrl(fs.Arg(0), ArchiveOpts{Record: *record}, func(err error) { done <- err })
+	// crawled bytes are counted in memory, write them before exiting
+	defer bandwidth.flush()
+	if err != nil {
+		return err
+	}
+	c.progress("fetched %s: %d %s", u.Url, u.Status, u.Hash)
+	c.progress("following %d links", len(links))
+	if err := <-done; err != nil {
+		return err
+	}
+
+	res := struct {
+		Url    string `json:"url"`
+		Status int    `json:"status"`
+		Hash   string `json:"hash"`
+		Links  int    `json:"links"`
+	}{u.Url, u.Status, u.Hash, len(links)}
+	return c.result(res, func(w io.Writer) {
+		fmt.Fprintf(w, "archived %s (%d links)\n", u.Url, len(links))
+	})
+}
+
+func cliVerifyMetadata(c *cliContext, args []string) error {
+	fs := c.flags("verify-metadata")
+	subject := fs.String("subject", "", "only verify metadata about this subject")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return cliUsageErrorf("verify-metadata takes no arguments")
+	}
+
+	v, err := VerifyMetadata(c.s.DB, *subject, func(checked int) {
+		c.progress("checked %d blocks", checked)
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.result(v, func(w io.Writer) {
+		for _, m := range v.Mismatches {
+			fmt.Fprintf(w, "mismatch: %s hashes to %s\n", m.Expected, m.Got)
+		}
+		fmt.Fprintf(w, "verified %d metadata blocks, %d mismatched\n", v.Checked, len(v.Mismatches))
+	}); err != nil {
+		return err
+	}
+	if len(v.Mismatches) > 0 {
+		return fmt.Errorf("%d metadata blocks don't match their hash", len(v.Mismatches))
+	}
+	return nil
+}
+
+func cliMigrate(c *cliContext, args []string) error {
+	fs := c.flags("migrate")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if err := migrateDatabase(c.s.DB); err != nil {
+		return err
+	}
+	if err := checkColumnSets(c.s.DB); err != nil {
+		return fmt.Errorf("tables were created, but existing tables need changes: %s", err.Error())
+	}
+	res := map[string]int{"schemaVersion": schemaVersion}
+	return c.result(res, func(w io.Writer) {
+		fmt.Fprintf(w, "database is up to date with schema %d\n", schemaVersion)
+	})
+}
+
+func cliGC(c *cliContext, args []string) error {
+	fs := c.flags("gc")
+	dryRun := fs.Bool("dry-run", false, "list what would be removed without removing it")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return cliUsageErrorf("gc takes no arguments")
+	}
+
+	r, err := CollectContent(c.s.DB, c.s.Store, c.s.Config.ImportContentDir, c.s.Clock(), *dryRun)
+	if err != nil {
+		return err
+	}
+	return c.result(r, func(w io.Writer) {
+		verb := "removed"
+		if *dryRun {
+			verb = "would remove"
+		}
+		for _, names := range [][]string{r.Unreferenced, r.Temp} {
+			for _, name := range names {
+				fmt.Fprintf(w, "%s %s\n", verb, name)
+			}
+		}
+		fmt.Fprintf(w, "checked %d files, %s %d (%d bytes)\n", r.Checked, verb, len(r.Unreferenced)+len(r.Temp), r.Bytes)
+	})
+}
+
+func cliExportWARC(c *cliContext, args []string) error {
+	fs := c.flags("export-warc")
+	sourceId := fs.String("subprimer", "", "id of the subprimer to export")
+	collectionId := fs.String("collection", "", "id of the collection to export")
+	path := fs.String("o", "", "file to write the WARC to")
+	notes := fs.Bool("notes", false, "include capture notes as metadata records")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if (*sourceId == "") == (*collectionId == "") || *path == "" || fs.NArg() != 0 {
+		return cliUsageErrorf("export-warc requires one of --subprimer or --collection & -o")
+	}
+
+	// write to a temp file so a failed export doesn't leave a partial WARC
+	f, err := ioutil.TempFile(filepath.Dir(*path), ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	progress := func(r ExportReport) {
+		c.progress("exported %d records", r.Records)
+	}
+	var r *ExportReport
+	if *collectionId != "" {
+		r, err = ExportCollectionWARC(c.s.DB, c.s.Store, f, *collectionId, c.s.Config.ImportContentDir, *notes, progress)
+	} else {
+		r, err = ExportWARC(c.s.DB, c.s.Store, f, *sourceId, c.s.Config.ImportContentDir, *notes, progress)
+	}
+	if err == ErrNotFound && *collectionId != "" {
+		f.Close()
+		return fmt.Errorf("collection not found: %s", *collectionId)
+	} else if err == ErrNotFound {
+		f.Close()
+		return fmt.Errorf("subprimer not found: %s", *sourceId)
+	} else if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), *path); err != nil {
+		return err
+	}
+	return c.result(r, func(w io.Writer) {
+		fmt.Fprintf(w, "wrote %d records to %s, %d captures aren't stored locally\n", r.Records, *path, r.Missing)
+	})
+}
+
+func cliImportMetadata(c *cliContext, args []string) error {
+	fs := c.flags("import-metadata")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return cliUsageErrorf("import-metadata takes a single file")
+	}
+
+	f, err := openMetadataImport(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := ImportMetadata(c.s.DB, f, func(read int) {
+		c.progress("read %d blocks", read)
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.result(r, func(w io.Writer) {
+		for _, m := range r.Mismatches {
+			fmt.Fprintf(w, "mismatch: %s hashes to %s\n", m.Expected, m.Got)
+		}
+		fmt.Fprintf(w, "imported %d metadata blocks, %d already stored, %d mismatched\n", r.Imported, r.Existing, len(r.Mismatches))
+	}); err != nil {
+		return err
+	}
+	if len(r.Mismatches) > 0 {
+		return fmt.Errorf("%d metadata blocks don't match their hash & weren't imported", len(r.Mismatches))
+	}
+	return nil
+}
+
+func cliBackfillAnchors(c *cliContext, args []string) error {
+	fs := c.flags("backfill-anchors")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return cliUsageErrorf("backfill-anchors takes no arguments")
+	}
+	if err := maintenance.Check(); err != nil {
+		return err
+	}
+
+	read, updated, err := BackfillLinkAnchors(c.s.DB, c.s.Config.ImportContentDir, func(read, updated int) {
+		c.progress("read %d captures", read)
+	})
+	if err != nil {
+		return err
+	}
+	res := map[string]int{"read": read, "updated": updated}
+	return c.result(res, func(w io.Writer) {
+		fmt.Fprintf(w, "re-extracted anchors from %d of %d captures, the rest aren't stored locally\n", updated, read)
+	})
+}
+
+func cliSubprimer(c *cliContext, args []string) error {
+	if len(args) == 0 {
+		return cliUsageErrorf("subprimer requires add or list")
+	}
+	switch args[0] {
+	case "add":
+		return cliSubprimerAdd(c, args[1:])
+	case "list":
+		return cliSubprimerList(c, args[1:])
+	}
+	return cliUsageErrorf("unknown subprimer command: %s", args[0])
+}
+
+// cliSubprimerAdd adds a subprimer & reconciles which urls fall under it
+// before returning
+func cliSubprimerAdd(c *cliContext, args []string) error {
+	fs := c.flags("subprimer add")
+	primerId := fs.String("primer", "", "id of the primer the subprimer belongs to")
+	title := fs.String("title", "", "title of the subprimer")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if *primerId == "" || fs.NArg() != 1 {
+		return cliUsageErrorf("subprimer add requires --primer & a url")
+	}
+	if err := maintenance.Check(); err != nil {
+		return err
+	}
+
+	p := &core.Primer{Id: *primerId}
+	if err := p.Read(c.s.Store); err == ErrNotFound {
+		return fmt.Errorf("primer not found: %s", *primerId)
+	} else if err != nil {
+		return err
+	}
+	s := &core.Source{Url: strings.TrimSpace(fs.Arg(0)), Title: *title, Primer: p, Crawl: true}
+	if err := checkWriteErr(s.Save(c.s.Store)); err != nil {
+		return err
+	}
+	if _, err := SnapshotSource(c.s.DB, s); err != nil {
+		return err
+	}
+
+	j, err := createReconcileJob(c.s.DB, s.Id, nil)
+	if err == ErrReconcileRunning {
+		c.progress("a membership reconciliation is already running, it won't include %s", s.Url)
+	} else if err != nil {
+		c.s.publishSourceUpdated(s.Id, false)
+		return err
+	} else {
+		c.progress("reconciling memberships")
+		reconcileJobs.run(c.s.DB, j)
+	}
+	// running servers hear about the new subprimer, & reconcile memberships if we didn't
+	c.s.publishSourceUpdated(s.Id, j != nil && j.Status == jobComplete)
+	if j != nil && j.Status != jobComplete {
+		return fmt.Errorf("subprimer added, but reconciling memberships failed: %s", j.Error)
+	}
+
+	return c.result(s, func(w io.Writer) {
+		fmt.Fprintf(w, "added subprimer %s %s\n", s.Id, s.Url)
+	})
+}
+
+func cliSubprimerList(c *cliContext, args []string) error {
+	fs := c.flags("subprimer list")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	sources := []*core.Source{}
+	for offset := 0; ; offset += 100 {
+		page, err := core.ListSources(c.s.Store, 100, offset)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, page...)
+		if len(page) < 100 {
+			break
+		}
+	}
+	return c.result(sources, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, s := range sources {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Id, s.Url, s.Title, s.Updated.Format(time.RFC3339))
+		}
+		tw.Flush()
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// runTestCLI runs a command against s, returning it's exit code & output
+func runTestCLI(s *Service, args ...string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := runCLI(args, stdout, stderr, func(bool) (*Service, error) { return s, nil })
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLIUsage(t *testing.T) {
+	cases := []struct {
+		args []string
+		code int
+		err  string
+	}{
+		{[]string{}, cliExitUsage, ""},
+		{[]string{"help"}, cliExitOk, ""},
+		{[]string{"--json", "nope"}, cliExitUsage, "unknown command: nope"},
+		{[]string{"--json", "archive"}, cliExitUsage, "archive takes a single url"},
+		{[]string{"--json", "gc", "--bogus"}, cliExitUsage, "flag provided but not defined: -bogus"},
+		{[]string{"export-warc", "--json", "-o", "out.warc.gz"}, cliExitUsage, "export-warc requires one of --subprimer or --collection & -o"},
+		{[]string{"export-warc", "--json", "--subprimer", "a", "--collection", "b", "-o", "out.warc.gz"}, cliExitUsage, "export-warc requires one of --subprimer or --collection & -o"},
+		{[]string{"--json", "import-metadata"}, cliExitUsage, "import-metadata takes a single file"},
+		{[]string{"--json", "subprimer", "remove"}, cliExitUsage, "unknown subprimer command: remove"},
+	}
+
+	for i, c := range cases {
+		code, stdout, stderr := runTestCLI(&Service{}, c.args...)
+		if code != c.code {
+			t.Errorf("case %d expected exit code %d, got: %d", i, c.code, code)
+		}
+		if stdout != "" {
+			t.Errorf("case %d expected no output, got: %s", i, stdout)
+		}
+		if c.err == "" {
+			continue
+		}
+		got := &cliError{}
+		if err := json.Unmarshal([]byte(stderr), got); err != nil {
+			t.Errorf("case %d expected a JSON error, got: %s", i, stderr)
+			continue
+		}
+		if got.Error != c.err {
+			t.Errorf("case %d expected error %q, got: %q", i, c.err, got.Error)
+		}
+	}
+}
+
+func TestWriteWARCResponse(t *testing.T) {
+	dir, hashes := storeTestBlocks(t, "<html>epa</html>")
+	defer os.RemoveAll(dir)
+	f, err := os.Open(filepath.Join(dir, hashes[0]))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+
+	fetched := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	u := &core.Url{
+		Url:     "https://www.epa.gov/",
+		Status:  200,
+		LastGet: &fetched,
+		Headers: []string{"Content-Type", "text/html", "Content-Encoding", "gzip", "Content-Length", "12"},
+	}
+	buf := &bytes.Buffer{}
+	infos := map[string]string{}
+	snapshot := func(url string) (string, error) { return "snapshot-hash", nil }
+	info, err := exportWARCInfo(buf, infos, snapshot, u.Url, fetched)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// each snapshot's warcinfo record is only written once
+	if again, _ := exportWARCInfo(buf, infos, snapshot, u.Url, fetched); again != info {
+		t.Errorf("expected the warcinfo record to be reused, got: %q %q", info, again)
+	}
+	n, err := writeWARCResponse(buf, u, f, info)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != int64(len("<html>epa</html>")) {
+		t.Errorf("expected %d bytes written, got: %d", len("<html>epa</html>"), n)
+	}
+
+	r, err := newWARCReader(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rec, err := r.next()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fields, _ := ioutil.ReadAll(rec.body)
+	if rec.header.Get("WARC-Type") != "warcinfo" || !strings.Contains(string(fields), "config-snapshot: snapshot-hash\r\n") {
+		t.Errorf("expected a warcinfo record with the config snapshot, got: %v %q", rec.header, fields)
+	}
+	rec, err = r.next()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if rec.header.Get("WARC-Warcinfo-ID") != "<urn:uuid:"+info+">" {
+		t.Errorf("expected the response to refer to it's warcinfo record, got: %v", rec.header)
+	}
+	if rec.header.Get("WARC-Target-URI") != u.Url || rec.header.Get("WARC-Date") != "2017-01-01T00:00:00Z" {
+		t.Errorf("unexpected record headers: %v", rec.header)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(rec.body), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "<html>epa</html>" {
+		t.Errorf("expected stored body, got: %s", body)
+	}
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Type") != "text/html" {
+		t.Errorf("expected transfer headers to be replaced, got: %v", res.Header)
+	}
+}
+
+func TestCLISubprimer(t *testing.T) {
+	defer resetTestData(appDB, "sources", "source_memberships", "membership_changes", "reconcile_jobs", "config_snapshots")
+	s := newTestService()
+	published := []*Event{}
+	s.Publish = func(e *Event) { published = append(published, e) }
+
+	code, stdout, stderr := runTestCLI(s, "--json", "subprimer", "add", "--primer", "5b1031f4-38a8-40b3-be91-c324bf686a87", "--title", "climate", "www.epa.gov/climatechange")
+	if code != cliExitOk {
+		t.Fatalf("expected subprimer add to succeed, got: %d %s", code, stderr)
+	}
+	added := &core.Source{}
+	if err := json.Unmarshal([]byte(stdout), added); err != nil {
+		t.Fatal(err.Error())
+	}
+	if added.Id == "" || added.Title != "climate" {
+		t.Errorf("unexpected subprimer: %s", stdout)
+	}
+	// memberships were reconciled by the command, so servers don't need to
+	if len(published) != 1 || published[0].Type != EventSourceUpdated || published[0].Subject != added.Id || !published[0].Data.(*SourceUpdate).SkipReconcile {
+		t.Errorf("expected a reconciled SOURCE_UPDATED event for the added subprimer, got: %v", published)
+	}
+
+	code, stdout, stderr = runTestCLI(s, "subprimer", "list", "--json")
+	if code != cliExitOk {
+		t.Fatalf("expected subprimer list to succeed, got: %d %s", code, stderr)
+	}
+	listed := []*core.Source{}
+	if err := json.Unmarshal([]byte(stdout), &listed); err != nil {
+		t.Fatal(err.Error())
+	}
+	found := false
+	for _, src := range listed {
+		found = found || src.Id == added.Id
+	}
+	if !found {
+		t.Errorf("expected added subprimer to be listed, got: %s", stdout)
+	}
+
+	if code, _, _ := runTestCLI(s, "--json", "subprimer", "add", "--primer", "not-a-primer", "www.epa.gov"); code != cliExitError {
+		t.Errorf("expected adding to a missing primer to fail, got: %d", code)
+	}
+}
+
+func TestCLIGC(t *testing.T) {
+	dir, hashes := storeTestBlocks(t, "<html>unreferenced</html>")
+	defer os.RemoveAll(dir)
+	temp := filepath.Join(dir, ".import-1")
+	if err := ioutil.WriteFile(temp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for _, path := range []string{filepath.Join(dir, hashes[0]), temp} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	s := newTestService()
+	s.Config.ImportContentDir = dir
+
+	code, stdout, stderr := runTestCLI(s, "--json", "gc", "--dry-run")
+	if code != cliExitOk {
+		t.Fatalf("expected gc to succeed, got: %d %s", code, stderr)
+	}
+	r := &GCReport{}
+	if err := json.Unmarshal([]byte(stdout), r); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(r.Unreferenced) != 1 || len(r.Temp) != 1 || r.Removed {
+		t.Errorf("unexpected dry run report: %s", stdout)
+	}
+	if _, err := os.Stat(temp); err != nil {
+		t.Errorf("expected dry run not to remove files, got: %s", err)
+	}
+
+	if code, _, stderr := runTestCLI(s, "gc"); code != cliExitOk {
+		t.Fatalf("expected gc to succeed, got: %d %s", code, stderr)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Errorf("expected gc to remove unreferenced files, got %d left", len(infos))
+	}
+}
@@ -8,18 +8,19 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 )
 
 const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
-	// Time allowed to read the next pong message from the peer.
+	// Time allowed to read the next pong message from the peer, until the
+	// connection's latency has been measured. see latency.go
 	pongWait = 60 * time.Second
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
 	// Maximum message size allowed from peer.
 	// Careful with this one, if messages exceed this size it seems the default
 	// behaviour is to close the connection.
@@ -40,11 +41,43 @@ var upgrader = websocket.Upgrader{
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
+	// id the server addresses the client by, eg: in server requests
+	id  string
 	hub *Room
-	// The websocket connection.
+	// The websocket connection, nil for clients using the poll transport
 	conn *websocket.Conn
 	// Buffered channel of outbound messages.
 	send chan []byte
+	// ip address the client connected from
+	addr string
+	// feature flags evaluated when the client said hello, a map[string]bool
+	flags atomic.Value
+	// key id the client said hello with, a string. what the client can see
+	// is limited to subprimers this key is a member of
+	keyId atomic.Value
+	// protocol version the client said hello with, an int. 0 for clients that
+	// haven't, or that predate versioning
+	protocol atomic.Value
+	// locale errors are rendered in, a string. the default locale if the
+	// client didn't ask for one saying hello
+	locale atomic.Value
+	// service the client's requests run against, the default service if nil
+	svc *Service
+	// api key the client connected with, nil if it didn't. clients with a key
+	// act for the key's user & are limited to it's scopes
+	apiKey *ApiKey
+	// measured latency of the websocket connection, nil for clients using the
+	// poll transport
+	latency *latencyTracker
+}
+
+// service returns the service a client's requests run against, the default
+// service for a nil client or one without a service of it's own
+func (c *Client) service() *Service {
+	if c != nil && c.svc != nil {
+		return c.svc
+	}
+	return defaultService()
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -58,8 +91,16 @@ func (c *Client) readPump() {
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadDeadline(time.Now().Add(c.latency.pongWait()))
+	c.conn.SetPongHandler(func(data string) error {
+		now := time.Now()
+		if rtt, ok := pongRtt(data, now); ok {
+			rttHistograms[rttPong].observe(rtt)
+			c.latency.observe(rtt)
+		}
+		c.conn.SetReadDeadline(now.Add(c.latency.pongWait()))
+		return nil
+	})
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
@@ -86,7 +127,8 @@ func (c *Client) readPump() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	period := c.latency.pingPeriod()
+	ticker := time.NewTicker(period)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -106,41 +148,61 @@ func (c *Client) writePump() {
 			if err != nil {
 				return
 			}
-			w.Write(message)
+			mw := meteredWriter{w, bandwidthServed}
+			mw.Write(message)
 
-			// Add queued chat messages to the current websocket message.
-			// n := len(c.send)
-			// for i := 0; i < n; i++ {
-			// 	w.Write(newline)
-			// 	w.Write(<-c.send)
-			// }
+			// Add queued messages to the current websocket message.
+			if c.flag(flagCoalescedFrames) {
+				n := len(c.send)
+				for i := 0; i < n; i++ {
+					mw.Write(newline)
+					mw.Write(<-c.send)
+				}
+			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if err := c.conn.WriteMessage(websocket.PingMessage, pingData(time.Now())); err != nil {
 				return
 			}
+			// the period follows the connection's latency
+			if p := c.latency.pingPeriod(); p != period {
+				period = p
+				ticker.Stop()
+				ticker = time.NewTicker(period)
+			}
 		}
 	}
 }
 
+// HandleAction runs an action envelope from the client, sending any immediate response
 func (c *Client) HandleAction(data []byte) {
+	if res := c.dispatch(data); res != nil {
+		c.SendResponse(res)
+	}
+}
+
+// dispatch runs an action envelope, returning the immediate response if there
+// is one. Responses that come later (eg: archiving progress) go through SendResponse.
+// dispatch is shared by all transports
+func (c *Client) dispatch(data []byte) *ClientResponse {
 	action := struct {
-		Type        string
-		RequestId   string
-		SilentError bool
-		Data        json.RawMessage
+		Type        string `json:"type"`
+		RequestId   string `json:"requestId"`
+		SilentError bool   `json:"silentError"`
+		// content token of the last response the client saw for this request
+		Token string          `json:"token"`
+		Data  json.RawMessage `json:"data"`
 	}{}
 	if err := json.Unmarshal(data, &action); err != nil {
 		log.Infof("error parsing action JSON: %s", err.Error())
-		c.SendResponse(&ClientResponse{
+		return &ClientResponse{
 			Type:  "PARSE_ERROR",
 			Error: fmt.Sprintf("action parsing error type: %s", err.Error()),
-		})
-		return
+		}
 	}
 	// TODO - This looks a lot like a muxer...
 	// if action.Type == "URL_ARCHIVE_REQUEST" {
@@ -159,13 +221,16 @@ func (c *Client) HandleAction(data []byte) {
 
 	if strings.HasSuffix(action.Type, "REQUEST") {
 		log.Infof("%s: %s", action.RequestId, action.Type)
-		c.HandleRequestAction(action.Type, action.RequestId, action.SilentError, action.Data)
-		return
+		return c.HandleRequestAction(action.Type, action.RequestId, action.SilentError, action.Token, action.Data)
 	}
 	log.Infof("unrecognized action: %s", action.Type)
+	return nil
 }
 
+// SendResponse queues a response for delivery over the client's transport
 func (c *Client) SendResponse(res *ClientResponse) {
+	pageResponse(res, c.protocolVersion())
+	localizeResponse(res, c.messageLocale())
 	// TODO - switch client to use "conn.SendJSON" for this stuff
 	data, err := json.Marshal(res)
 	if err != nil {
@@ -180,24 +245,215 @@ func (c *Client) SendResponse(res *ClientResponse) {
 	// }
 }
 
-func (c *Client) HandleRequestAction(req string, reqId string, silentError bool, data json.RawMessage) {
+// HandleRequestAction executes a request action, returning it's response. returns
+// nil for unknown request types
+func (c *Client) HandleRequestAction(req string, reqId string, silentError bool, lastToken string, data json.RawMessage) *ClientResponse {
 	for _, t := range ClientReqActions {
 		if t.Type() == req {
-			res := t.Parse(reqId, data).Exec()
+			act := t.Parse(reqId, data)
+			if cb, ok := act.(ClientBoundAction); ok {
+				cb.SetClient(c)
+			}
+			// writes are rejected outright during maintenance. writes that fail
+			// because they put us into maintenance get the same response
+			res := c.apiKeyResponse(act, reqId)
+			if res == nil {
+				res = maintenanceResponse(act, reqId)
+			}
+			if res == nil {
+				res = c.limitResponse(act, reqId)
+			}
+			if res == nil {
+				res = act.Exec()
+				if res.Error != "" {
+					if m := maintenanceResponse(act, reqId); m != nil {
+						res = m
+					}
+				}
+			}
+			pageResponse(res, c.protocolVersion())
+			localizeResponse(res, c.messageLocale())
+			if flags := c.featureFlags(); flags != nil {
+				countFlagged(flags, "requests")
+				if res.Error != "" {
+					countFlagged(flags, "errors")
+				}
+			}
+			if err := applyCacheHints(res, lastToken); err != nil {
+				log.Info(err.Error())
+			}
 			res.SilentError = silentError
-			c.SendResponse(res)
+			return res
 		}
 	}
+	return nil
+}
+
+// Subscribe adds the client to a topic in it's room
+func (c *Client) Subscribe(topic string) {
+	c.SubscribeFiltered(topic, nil)
+}
+
+// SubscribeFiltered adds the client to a topic, only sending it events filter
+// allows. subscribing again replaces the filter
+func (c *Client) SubscribeFiltered(topic string, filter *eventFilter) {
+	if c == nil || c.hub == nil {
+		return
+	}
+	c.hub.subscribe <- &subscription{client: c, topic: topic, filter: filter}
+}
+
+// Unsubscribe removes the client from a topic in it's room
+func (c *Client) Unsubscribe(topic string) {
+	if c == nil || c.hub == nil {
+		return
+	}
+	c.hub.unsubscribe <- &subscription{client: c, topic: topic}
+}
+
+// setFlags stores the feature flags evaluated for the client
+func (c *Client) setFlags(flags map[string]bool) {
+	c.flags.Store(flags)
+}
+
+// featureFlags returns the client's feature flags, nil if it hasn't said hello
+func (c *Client) featureFlags() map[string]bool {
+	if c == nil {
+		return nil
+	}
+	flags, _ := c.flags.Load().(map[string]bool)
+	return flags
+}
+
+// flag checks if a feature flag is on for the client
+func (c *Client) flag(name string) bool {
+	return c.featureFlags()[name]
+}
+
+// setKeyId stores the key id the client said hello with
+func (c *Client) setKeyId(keyId string) {
+	c.keyId.Store(keyId)
+}
+
+// setProtocol stores the protocol version the client said hello with
+func (c *Client) setProtocol(version int) {
+	c.protocol.Store(version)
+}
+
+// setLocale stores the locale the client's errors are rendered in
+func (c *Client) setLocale(locale string) {
+	c.locale.Store(locale)
+}
+
+// messageLocale returns the locale the client's errors are rendered in
+func (c *Client) messageLocale() string {
+	if c == nil {
+		return defaultLocale
+	}
+	if locale, ok := c.locale.Load().(string); ok {
+		return locale
+	}
+	return defaultLocale
+}
+
+// protocolVersion returns the protocol version the client said hello with
+func (c *Client) protocolVersion() int {
+	if c == nil {
+		return 0
+	}
+	version, _ := c.protocol.Load().(int)
+	return version
+}
+
+// archiveRequester identifies the client in the archive requests it makes: the
+// api key it connected with, or a hash of it's ip address
+func (c *Client) archiveRequester() string {
+	if c.apiKey != nil {
+		return c.apiKey.Id
+	}
+	return requesterHash(c.remoteIP())
+}
+
+// limitKeys are the keys the client's requests are counted under in each rate limit scope
+func (c *Client) limitKeys() limitKeys {
+	return limitKeys{limitScopeIP: c.remoteIP(), limitScopeRequester: c.archiveRequester()}
+}
+
+// limitResponse consults the rate limits an action consults before it's
+// executed, returning the response for it's refusal, nil if it's admitted
+func (c *Client) limitResponse(t ClientRequestAction, reqId string) *ClientResponse {
+	res, refusal := actionLimitResponse(c.service(), t, reqId, c.limitKeys())
+	if refusal != nil {
+		refusal.logUserAction(c.service().DB, c.requester(), time.Now())
+	}
+	return res
+}
+
+// requester returns the key id the client said hello with, "" if it hasn't
+func (c *Client) requester() string {
+	if c == nil {
+		return ""
+	}
+	keyId, _ := c.keyId.Load().(string)
+	return keyId
+}
+
+// identity returns the key id of the user the client's api key acts for, "" if
+// it didn't connect with one. unlike requester it can't be claimed saying hello,
+// so ownership & access checks are made against it
+func (c *Client) identity() string {
+	if c == nil || c.apiKey == nil {
+		return ""
+	}
+	return c.apiKey.KeyId
+}
+
+// remoteIP returns the ip address the client connected from
+func (c *Client) remoteIP() string {
+	if c == nil {
+		return ""
+	}
+	return c.addr
 }
 
 // serveWs handles websocket requests from the peer.
 func serveWs(hub *Room, w http.ResponseWriter, r *http.Request) {
+	s := defaultService()
+	s.Hub = hub
+	s.ServeWs(w, r)
+}
+
+// ServeWs handles websocket requests from a peer, joining the service's hub
+func (s *Service) ServeWs(w http.ResponseWriter, r *http.Request) {
+	if !s.Guardrails.accept() {
+		writeServerBusy(w, ErrServerFull)
+		return
+	}
+
+	// scripts can connect with an api key issued with the read scope
+	var key *ApiKey
+	if token := bearerToken(r); token != "" {
+		var err error
+		if key, err = authenticateApiKey(s.DB, token, apiScopeRead); err == ErrInvalidApiKey || err == ErrApiKeyScope {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			s.Log.Info(err.Error())
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Info(err)
+		s.Log.Info(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client := &Client{id: uuid.New(), hub: s.Hub, conn: conn, send: make(chan []byte, 256), addr: requestIP(r), svc: s, apiKey: key, latency: configuredLatencyTracker()}
+	if key != nil {
+		client.setKeyId(key.KeyId)
+		logApiKeyAction(s.DB, key.Id, "CONNECT", "", true, nil, s.Clock())
+	}
 	client.hub.register <- client
 	go client.writePump()
 	client.readPump()
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Clock skew
+//
+// Metadata chains are ordered by block timestamps, which come from the clock
+// of whichever instance wrote each block. if that clock is behind the one that
+// stamped a block's prev (an NTP hiccup, or skew between instances) the new
+// block would be stamped before it's prev, breaking history ordering & as-of
+// reads. instead blocks are stamped a second after their prev & marked skew
+// adjusted. bumps are bounded by maxChainSkew, writes that would need more
+// fail rather than stamping blocks far into the future. instances also
+// compare their clock to the database's when they start
+
+const (
+	// furthest ahead of the writer's clock a block is stamped to follow it's prev
+	maxChainSkew = 5 * time.Minute
+	// difference between the process & database clocks that's warned about on startup
+	clockSkewWarning = 2 * time.Second
+)
+
+// ErrClockSkew is returned when a block's prev is stamped further ahead of the
+// writer's clock than maxChainSkew
+var ErrClockSkew = fmt.Errorf("this server's clock is too far behind the metadata it's adding to, please try again later")
+
+// chainTimestamp stamps a block written at now that follows a block stamped
+// prev, nil if it starts a chain. blocks are stamped to the second, & always
+// after their prev. adjusted is set if now had to be bumped
+func chainTimestamp(now time.Time, prev *time.Time) (ts time.Time, adjusted bool, err error) {
+	ts = now.Round(time.Second).In(time.UTC)
+	if prev == nil || ts.After(*prev) {
+		return ts, false, nil
+	}
+	bumped := prev.Add(time.Second).In(time.UTC)
+	if bumped.Sub(ts) > maxChainSkew {
+		return ts, false, ErrClockSkew
+	}
+	return bumped, true, nil
+}
+
+// prevTimestamp reads the timestamp of a block's prev, nil if the block starts
+// a chain or it's prev doesn't exist
+func prevTimestamp(db sqlQueryable, prev string) (*time.Time, error) {
+	if prev == "" {
+		return nil, nil
+	}
+	var ts time.Time
+	err := db.QueryRow("select time_stamp from metadata where hash = $1", prev).Scan(&ts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &ts, nil
+}
+
+// databaseClockSkew is how far the database's clock is ahead of this
+// process's, measured from the middle of the query's round trip
+func databaseClockSkew(db sqlQueryable, now func() time.Time) (time.Duration, error) {
+	var dbNow time.Time
+	start := now()
+	if err := db.QueryRow("select clock_timestamp()").Scan(&dbNow); err != nil {
+		return 0, err
+	}
+	end := now()
+	return dbNow.Sub(start.Add(end.Sub(start) / 2)), nil
+}
+
+// warnClockSkew logs an error if this process's clock is more than
+// clockSkewWarning from the database's
+func warnClockSkew(db sqlQueryable) {
+	skew, err := databaseClockSkew(db, time.Now)
+	if err != nil {
+		log.Infof("error checking clock skew: %s", err.Error())
+		return
+	}
+	if skew > clockSkewWarning || skew < -clockSkewWarning {
+		log.Errorf("clock skew: the database's clock is %s ahead of this instance's (negative is behind). metadata written from here may need it's timestamps adjusted, check NTP", skew)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestChainTimestamp(t *testing.T) {
+	at := time.Date(2017, 1, 1, 0, 0, 10, 0, time.UTC)
+	before, same, after := at.Add(-3*time.Second), at, at.Add(3*time.Second)
+	far := at.Add(maxChainSkew + time.Minute)
+	cases := []struct {
+		now      time.Time
+		prev     *time.Time
+		ts       time.Time
+		adjusted bool
+		err      error
+	}{
+		{at, nil, at, false, nil},
+		{at.Add(400 * time.Millisecond), &before, at, false, nil},
+		// blocks are never stamped at or before their prev
+		{at, &same, at.Add(time.Second), true, nil},
+		{at, &after, after.Add(time.Second), true, nil},
+		{at, &far, at, false, ErrClockSkew},
+	}
+
+	for i, c := range cases {
+		ts, adjusted, err := chainTimestamp(c.now, c.prev)
+		if err != c.err {
+			t.Errorf("case %d expected error %v, got: %v", i, c.err, err)
+			continue
+		}
+		if err == nil && (!ts.Equal(c.ts) || adjusted != c.adjusted) {
+			t.Errorf("case %d expected %s (adjusted %t), got: %s (%t)", i, c.ts, c.adjusted, ts, adjusted)
+		}
+	}
+}
+
+func TestDatabaseClockSkew(t *testing.T) {
+	skew, err := databaseClockSkew(appDB, func() time.Time { return time.Now().Add(-time.Hour) })
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if skew < time.Hour-time.Minute || skew > time.Hour+time.Minute {
+		t.Errorf("expected the database to be an hour ahead, got: %s", skew)
+	}
+}
+
+func TestInsertMetadataClockSkew(t *testing.T) {
+	defer resetTestData(appDB, "metadata")
+	const subject = "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a"
+
+	svc := newTestService()
+	svc.Store = nil
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	svc.Clock = func() time.Time { return now }
+
+	write := func(prev string) (*core.Metadata, error) {
+		m := &core.Metadata{KeyId: "key", Subject: subject, Prev: prev, Meta: map[string]interface{}{"title": "EPA"}}
+		return m, svc.WriteMetadata(m)
+	}
+	first, err := write("")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the clock jumps back after an NTP correction
+	now = now.Add(-10 * time.Second)
+	second, err := write(first.Hash)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expect := first.Timestamp.Add(time.Second); !second.Timestamp.Equal(expect) {
+		t.Errorf("expected block to be stamped %s, got: %s", expect, second.Timestamp)
+	}
+	var adjusted bool
+	if err := appDB.QueryRow("select skew_adjusted from metadata where hash = $1", second.Hash).Scan(&adjusted); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !adjusted {
+		t.Errorf("expected block to be marked skew adjusted")
+	}
+
+	// skew adjusted blocks are valid
+	blocks, deleted, err := readChain(appDB, chainKey{KeyId: "key", Subject: subject}, first.Timestamp.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	found, err := checkChain(blocks, deleted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(blocks) != 2 || chainHealth(found) != chainHealthy {
+		t.Errorf("expected a healthy 2 block chain, got %d blocks: %v", len(blocks), found)
+	}
+
+	// clocks too far behind don't write at all
+	now = now.Add(-time.Hour)
+	if _, err := write(second.Hash); err != ErrClockSkew {
+		t.Errorf("expected error %q, got: %v", ErrClockSkew, err)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/lib/pq"
+)
+
+// Collections are hand-picked lists of urls that cut across subprimers. core
+// stores collections & their items, this file adds who can see & change them.
+// a collection's owner is it's creator, the only key that can edit it or it's
+// items. private collections are only visible to their owner, collections
+// without recorded access predate visibility & are public
+const (
+	collectionPublic  = "public"
+	collectionPrivate = "private"
+)
+
+// Collection membership changes, recorded in collection_changes
+const (
+	collectionAdded   = "added"
+	collectionRemoved = "removed"
+)
+
+// most collections listed in a page of CollectionsHandler
+const maxCollectionsPageSize = 50
+
+var (
+	// ErrCollectionOwner is returned when changing a collection that belongs to another key
+	ErrCollectionOwner = fmt.Errorf("only a collection's owner can change it")
+	// ErrCollectionAnonymous is returned when creating a collection without saying hello with a key
+	ErrCollectionAnonymous = fmt.Errorf("connect with an api key to create collections")
+	// ErrCollectionVisibility is returned for visibilities other than public & private
+	ErrCollectionVisibility = fmt.Errorf("collection visibility must be public or private")
+)
+
+// collectionDetail is a collection with who can see it. collection fields
+// are embedded so they serialize at the top level, same as a plain collection
+type collectionDetail struct {
+	*core.Collection
+	Visibility string `json:"visibility"`
+}
+
+// collectionAccess is who owns & can see a collection
+type collectionAccess struct {
+	Creator    string
+	Visibility string
+}
+
+// visibleTo checks if a key can see the collection, "" for anonymous clients
+func (a *collectionAccess) visibleTo(keyId string) bool {
+	return a.Visibility != collectionPrivate || (keyId != "" && keyId == a.Creator)
+}
+
+// readCollectionAccess reads who owns & can see a collection, ErrNotFound if
+// it doesn't exist
+func readCollectionAccess(db *sql.DB, id string) (*collectionAccess, error) {
+	a := &collectionAccess{}
+	err := db.QueryRow(`select c.creator, coalesce(a.visibility, $2) from collections c
+		left join collection_access a on a.collection_id = c.id
+		where c.id = $1`, id, collectionPublic).Scan(&a.Creator, &a.Visibility)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// canViewCollection checks if a key can see a collection. collections that
+// don't exist have nothing to hide
+func canViewCollection(db *sql.DB, id, keyId string) (bool, error) {
+	a, err := readCollectionAccess(db, id)
+	if err == ErrNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return a.visibleTo(keyId), nil
+}
+
+// checkCollectionOwner returns ErrCollectionOwner unless keyId owns the
+// collection. keyId must be the client's identity, not the key id it said
+// hello with
+func checkCollectionOwner(db *sql.DB, id, keyId string) error {
+	a, err := readCollectionAccess(db, id)
+	if err != nil {
+		return err
+	}
+	if keyId == "" || keyId != a.Creator {
+		return ErrCollectionOwner
+	}
+	return nil
+}
+
+// setCollectionVisibility records who can see a collection
+func setCollectionVisibility(db *sql.DB, id, visibility string, now time.Time) error {
+	if visibility != collectionPublic && visibility != collectionPrivate {
+		return ErrCollectionVisibility
+	}
+	_, err := db.Exec(`insert into collection_access (collection_id, updated, visibility) values ($1, $2, $3)
+		on conflict (collection_id) do update set visibility = excluded.visibility, updated = excluded.updated`,
+		id, now.Round(time.Second).In(time.UTC), visibility)
+	return checkWriteErr(err)
+}
+
+// listCollections reads a page of the collections keyId can see, newest
+// first. only collections by creator are listed if it's set
+func listCollections(db *sql.DB, keyId, creator string, limit, offset int) ([]*collectionDetail, error) {
+	if limit <= 0 || limit > maxPageSize+1 {
+		limit = maxPageSize + 1
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := db.Query(`select c.id, c.created, c.updated, c.creator, c.title, c.description, c.url, coalesce(a.visibility, $1)
+		from collections c left join collection_access a on a.collection_id = c.id
+		where (coalesce(a.visibility, $1) = $1 or ($2 != '' and c.creator = $2)) and ($3 = '' or c.creator = $3)
+		order by c.created desc, c.id limit $4 offset $5`, collectionPublic, keyId, creator, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := []*collectionDetail{}
+	for rows.Next() {
+		c := &collectionDetail{Collection: &core.Collection{}}
+		if err := rows.Scan(&c.Id, &c.Created, &c.Updated, &c.Creator, &c.Title, &c.Description, &c.Url, &c.Visibility); err != nil {
+			return nil, err
+		}
+		c.Created, c.Updated = c.Created.In(time.UTC), c.Updated.In(time.UTC)
+		collections = append(collections, c)
+	}
+	return collections, rows.Err()
+}
+
+// CollectionRef names a collection a url belongs to
+type CollectionRef struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// urlCollections lists the collections keyId can see that hold url
+func urlCollections(db *sql.DB, url, keyId string) ([]*CollectionRef, error) {
+	rows, err := db.Query(`select c.id, c.title from collection_items i
+		join urls on urls.id = i.url_id
+		join collections c on c.id = i.collection_id
+		left join collection_access a on a.collection_id = c.id
+		where urls.url = $1 and (coalesce(a.visibility, $2) = $2 or ($3 != '' and c.creator = $3))
+		order by c.title, c.id`, url, collectionPublic, keyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []*CollectionRef{}
+	for rows.Next() {
+		r := &CollectionRef{}
+		if err := rows.Scan(&r.Id, &r.Title); err != nil {
+			return nil, err
+		}
+		refs = append(refs, r)
+	}
+	return refs, rows.Err()
+}
+
+// CollectionChange is a change to a collection's membership, sent to clients
+// viewing the collection
+type CollectionChange struct {
+	CollectionId string `json:"collectionId"`
+	// added or removed
+	Change string   `json:"change"`
+	Urls   []string `json:"urls"`
+	// key of the owner who made the change
+	KeyId string `json:"keyId"`
+}
+
+// recordCollectionChange logs items being added to or removed from a
+// collection, with the hash of each url's latest capture at the time.
+// items are identified by url, or by url id if the url isn't set. returns
+// the change with the urls that were logged
+func recordCollectionChange(db *sql.DB, id, change, keyId string, items []*core.CollectionItem, now time.Time) (*CollectionChange, error) {
+	urls, ids := make([]string, len(items)), make([]string, len(items))
+	for i, item := range items {
+		urls[i], ids[i] = item.Url.Url, item.Url.Id
+	}
+	rows, err := db.Query(`insert into collection_changes (created, collection_id, url, hash, change, key_id)
+		select $1, $2, coalesce(urls.url, i.url), coalesce(urls.hash, ''), $3, $4
+		from unnest($5::text[], $6::text[]) as i(url, id)
+		left join urls on (i.url != '' and urls.url = i.url) or (i.url = '' and urls.id = i.id)
+		where coalesce(urls.url, i.url) != ''
+		returning url`, now.Round(time.Second).In(time.UTC), id, change, keyId, pq.Array(urls), pq.Array(ids))
+	if err != nil {
+		return nil, checkWriteErr(err)
+	}
+	defer rows.Close()
+
+	c := &CollectionChange{CollectionId: id, Change: change, KeyId: keyId, Urls: []string{}}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		c.Urls = append(c.Urls, url)
+	}
+	return c, rows.Err()
+}
+
+// collectionTopic is the topic name for changes to a collection's membership
+func collectionTopic(id string) string {
+	return "collection:" + id
+}
+
+// announceCollectionChange sends a membership change to every client viewing
+// the collection
+func announceCollectionChange(hub *Room, c *CollectionChange) {
+	if hub == nil || len(c.Urls) == 0 {
+		return
+	}
+	data, err := json.Marshal(&ClientResponse{
+		Type:      "COLLECTION_ITEMS_CHANGED",
+		RequestId: "server",
+		Schema:    "COLLECTION_CHANGE",
+		Id:        c.CollectionId,
+		Data:      c,
+	})
+	if err != nil {
+		log.Info(err.Error())
+		return
+	}
+	hub.publish <- &topicMessage{topic: collectionTopic(c.CollectionId), data: data, event: "COLLECTION_ITEMS_CHANGED", author: c.KeyId, contentChanged: true}
+}
+
+// changeCollectionItems adds or removes items from a collection on behalf of
+// it's owner, logging & announcing the change. logging & announcing happen
+// after the change is saved & are only logged if they fail
+func (s *Service) changeCollectionItems(id, keyId, change string, items []*core.CollectionItem) error {
+	if err := checkCollectionOwner(s.DB, id, keyId); err != nil {
+		return err
+	}
+	c := core.Collection{Id: id}
+	var err error
+	if change == collectionAdded {
+		err = c.SaveItems(s.Store, items)
+	} else {
+		err = c.DeleteItems(s.Store, items)
+	}
+	if err := checkWriteErr(err); err != nil {
+		return err
+	}
+
+	logged, err := recordCollectionChange(s.DB, id, change, keyId, items, s.Clock())
+	if err != nil {
+		s.Log.Infof("error logging change to collection %s: %s", id, err.Error())
+		return nil
+	}
+	announceCollectionChange(s.Hub, logged)
+	return nil
+}
+
+// CollectionsHandler lists public collections as JSON, newest first.
+// GET ?page=&pageSize=
+func CollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(r.FormValue("pageSize"))
+	if pageSize <= 0 || pageSize > maxCollectionsPageSize {
+		pageSize = maxCollectionsPageSize
+	}
+
+	collections, err := listCollections(appDB, "", "", pageSize, (page-1)*pageSize)
+	if err != nil {
+		log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"page": page, "pageSize": pageSize, "collections": collections})
+}
+
+// CollectionSubscribeAction subscribes a client to membership changes of a
+// collection, through an optional filter. subscribing again replaces the filter
+type CollectionSubscribeAction struct {
+	ReqAction
+	clientAction
+	CollectionId string              `json:"collectionId"`
+	Filter       *SubscriptionFilter `json:"filter"`
+}
+
+func (CollectionSubscribeAction) Type() string        { return "COLLECTION_SUBSCRIBE_REQUEST" }
+func (CollectionSubscribeAction) SuccessType() string { return "COLLECTION_SUBSCRIBE_SUCCESS" }
+func (CollectionSubscribeAction) FailureType() string { return "COLLECTION_SUBSCRIBE_FAILURE" }
+
+func (CollectionSubscribeAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &CollectionSubscribeAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *CollectionSubscribeAction) Exec() (res *ClientResponse) {
+	s := a.client.service()
+	acc, err := readCollectionAccess(s.DB, a.CollectionId)
+	if err == ErrNotFound || (err == nil && !acc.visibleTo(a.client.identity())) {
+		return notFoundResponse(a, a.RequestId, "collection", a.CollectionId)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	filter, err := compileFilter(a.Filter, a.client.requester())
+	if err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	a.client.SubscribeFiltered(collectionTopic(a.CollectionId), filter)
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Id:        a.CollectionId,
+		Filter:    filter.Filter(),
+	}
+}
+
+// CollectionUnsubscribeAction stops sending a client changes to a collection
+type CollectionUnsubscribeAction struct {
+	ReqAction
+	clientAction
+	CollectionId string `json:"collectionId"`
+}
+
+func (CollectionUnsubscribeAction) Type() string        { return "COLLECTION_UNSUBSCRIBE_REQUEST" }
+func (CollectionUnsubscribeAction) SuccessType() string { return "COLLECTION_UNSUBSCRIBE_SUCCESS" }
+func (CollectionUnsubscribeAction) FailureType() string { return "COLLECTION_UNSUBSCRIBE_FAILURE" }
+
+func (CollectionUnsubscribeAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &CollectionUnsubscribeAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *CollectionUnsubscribeAction) Exec() (res *ClientResponse) {
+	a.client.Unsubscribe(collectionTopic(a.CollectionId))
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Id:        a.CollectionId,
+	}
+}
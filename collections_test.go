@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestCollectionVisibleTo(t *testing.T) {
+	cases := []struct {
+		visibility string
+		keyId      string
+		visible    bool
+	}{
+		{collectionPublic, "", true},
+		{collectionPublic, "stranger", true},
+		{collectionPrivate, "", false},
+		{collectionPrivate, "stranger", false},
+		{collectionPrivate, "owner", true},
+	}
+
+	for i, c := range cases {
+		a := &collectionAccess{Creator: "owner", Visibility: c.visibility}
+		if got := a.visibleTo(c.keyId); got != c.visible {
+			t.Errorf("case %d expected visible to be %t, got: %t", i, c.visible, got)
+		}
+	}
+	// collections without a creator are never visible to anonymous clients when private
+	if (&collectionAccess{Visibility: collectionPrivate}).visibleTo("") {
+		t.Errorf("expected private collections without a creator to be hidden")
+	}
+}
+
+func TestCollectionOwnership(t *testing.T) {
+	defer resetTestData(appDB, "urls", "collections", "collection_items", "collection_access", "collection_changes")
+	wireTestStore()
+
+	hub := newRoom()
+	go hub.run()
+	svc := newTestService()
+	svc.Hub = hub
+	owner := &Client{addr: "127.0.0.1", svc: svc, hub: hub, send: make(chan []byte, 4), apiKey: &ApiKey{KeyId: "owner"}}
+	owner.setKeyId("owner")
+	stranger := &Client{addr: "127.0.0.1", svc: svc, hub: hub, send: make(chan []byte, 4), apiKey: &ApiKey{KeyId: "stranger"}}
+	stranger.setKeyId("stranger")
+	anon := &Client{addr: "127.0.0.1", svc: svc}
+	// saying hello with the owner's key id doesn't make a client the owner
+	claimer := &Client{addr: "127.0.0.1", svc: svc}
+	claimer.setKeyId("owner")
+	hub.register <- owner
+	hub.register <- stranger
+
+	exec := func(c *Client, a ClientAction, data string) *ClientResponse {
+		act := a.Parse("req", []byte(data))
+		act.(ClientBoundAction).SetClient(c)
+		return act.Exec()
+	}
+
+	for _, c := range []*Client{anon, claimer} {
+		if res := exec(c, SaveCollectionAction{}, `{"collection":{"title":"hurricanes"}}`); res.Error != ErrCollectionAnonymous.Error() {
+			t.Errorf("expected anonymous clients not to create collections, got: %s %s", res.Type, res.Error)
+		}
+	}
+	res := exec(owner, SaveCollectionAction{}, `{"collection":{"title":"2024 hurricane response","creator":"someone else"},"visibility":"private"}`)
+	if res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	created := res.Data.(*collectionDetail)
+	if created.Creator != "owner" || created.Visibility != collectionPrivate {
+		t.Errorf("expected collection to be owned by it's creator & private, got: %s %s", created.Creator, created.Visibility)
+	}
+	id := created.Id
+
+	// only the owner sees a private collection
+	for _, c := range []*Client{stranger, anon, claimer} {
+		if res := exec(c, FetchCollectionAction{}, `{"id":"`+id+`"}`); res.Code != notFoundErrCode {
+			t.Errorf("expected private collection to be hidden from %q, got: %s", c.requester(), res.Type)
+		}
+		if res := exec(c, CollectionItemsAction{}, `{"collectionId":"`+id+`","page":1,"pageSize":10}`); res.Code != notFoundErrCode {
+			t.Errorf("expected private collection items to be hidden from %q, got: %s", c.requester(), res.Type)
+		}
+		if res := exec(c, CollectionSubscribeAction{}, `{"collectionId":"`+id+`"}`); res.Code != notFoundErrCode {
+			t.Errorf("expected %q not to be able to subscribe to a private collection, got: %s", c.requester(), res.Type)
+		}
+	}
+	if listed, err := listCollections(appDB, "", "", 50, 0); err != nil {
+		t.Fatal(err.Error())
+	} else {
+		for _, c := range listed {
+			if c.Id == id {
+				t.Errorf("expected private collection not to be listed publicly")
+			}
+		}
+	}
+	if res := exec(owner, UserCollectionsAction{}, `{"creator":"owner","page":1,"pageSize":10}`); len(res.Data.(*Page).Items.([]*collectionDetail)) != 1 {
+		t.Errorf("expected owner to see their private collection, got: %v", res.Data)
+	}
+
+	// only the owner changes a collection
+	for _, c := range []struct {
+		action ClientAction
+		data   string
+	}{
+		{SaveCollectionAction{}, `{"collection":{"id":"` + id + `","title":"mine now"}}`},
+		{SaveCollectionItemsAction{}, `{"collectionId":"` + id + `","items":[{"url":"http://www.epa.gov/hurricanes"}]}`},
+		{DeleteCollectionItemsAction{}, `{"collectionId":"` + id + `","items":[{"url":"http://www.epa.gov/hurricanes"}]}`},
+		{DeleteCollectionAction{}, `{"id":"` + id + `"}`},
+	} {
+		if res := exec(stranger, c.action, c.data); res.Error != ErrCollectionOwner.Error() {
+			t.Errorf("%s: expected strangers to be refused, got: %s %s", c.action.Type(), res.Type, res.Error)
+		}
+		if res := exec(claimer, c.action, c.data); res.Error != ErrCollectionOwner.Error() {
+			t.Errorf("%s: expected unauthenticated clients to be refused, got: %s %s", c.action.Type(), res.Type, res.Error)
+		}
+	}
+
+	// membership changes are logged & sent to clients viewing the collection
+	if res := exec(owner, CollectionSubscribeAction{}, `{"collectionId":"`+id+`"}`); res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	if res := exec(owner, SaveCollectionItemsAction{}, `{"collectionId":"`+id+`","items":[{"url":"http://www.epa.gov/hurricanes","hash":"hurricane_hash"}]}`); res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	select {
+	case msg := <-owner.send:
+		got := struct {
+			Type string            `json:"type"`
+			Data *CollectionChange `json:"data"`
+		}{}
+		if err := json.Unmarshal(msg, &got); err != nil {
+			t.Fatal(err.Error())
+		}
+		if got.Type != "COLLECTION_ITEMS_CHANGED" || got.Data.Change != collectionAdded || len(got.Data.Urls) != 1 {
+			t.Errorf("unexpected change announcement: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected change to be announced")
+	}
+	var change, hash, keyId string
+	if err := appDB.QueryRow("select change, hash, key_id from collection_changes where collection_id = $1 and url = 'http://www.epa.gov/hurricanes'", id).Scan(&change, &hash, &keyId); err != nil {
+		t.Fatal(err.Error())
+	}
+	if change != collectionAdded || keyId != "owner" {
+		t.Errorf("unexpected change log: %s %s %s", change, hash, keyId)
+	}
+
+	// url details list collections the requester can see
+	u := &core.Url{Url: "http://www.epa.gov/hurricanes"}
+	if err := u.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if d := newUrlDetail(u, "owner"); len(d.Collections) != 1 || d.Collections[0].Id != id {
+		t.Errorf("expected url detail to list it's collection, got: %v", d.Collections)
+	}
+	if d := newUrlDetail(u, "stranger"); len(d.Collections) != 0 {
+		t.Errorf("expected url detail to hide private collections, got: %v", d.Collections)
+	}
+
+	// making the collection public shows it to everyone
+	if res := exec(owner, SaveCollectionAction{}, `{"collection":{"id":"`+id+`","title":"2024 hurricane response"},"visibility":"public"}`); res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	if res := exec(anon, FetchCollectionAction{}, `{"id":"`+id+`"}`); res.Error != "" || res.Data.(*collectionDetail).Creator != "owner" {
+		t.Errorf("expected public collection to be visible, got: %s %s", res.Type, res.Error)
+	}
+	if urls, err := collectionMemberUrls(appDB, id, "", 10); err != nil || len(urls) != 1 {
+		t.Errorf("expected collection members to be listed for export, got: %v %v", urls, err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// most column sets checked against the live database at once
+const columnCheckConcurrency = 4
+
+// columnSet is every column of a table, in the order rows are read. select lists
+// & scan targets are both built from it so they can't drift apart, & the live
+// table is checked against it at startup so schema changes can't silently
+// mis-scan into the wrong field
+type columnSet struct {
+	table   string
+	columns []string
+}
+
+// scanTargets maps column names to the values they're read into
+type scanTargets map[string]interface{}
+
+// checkedColumnSets lists the tables checked at startup
+var checkedColumnSets = []*columnSet{
+	metadataCols,
+	configSnapshotCols,
+	reconcileJobCols,
+	moderationCaseCols,
+	contentReportCols,
+	relationCols,
+	savedSearchCols,
+	chainHealthRunCols,
+	apiKeyCols,
+	announcementCols,
+	idleVerificationCols,
+	captureNoteCols,
+	outboxCols,
+	metaKeyRenameCols,
+}
+
+// String is the column list for a select statement
+func (cs *columnSet) String() string {
+	return strings.Join(cs.columns, ", ")
+}
+
+// scan reads a row selected with the set's column list into targets by column name
+func (cs *columnSet) scan(row sqlScannable, targets scanTargets) error {
+	if len(targets) != len(cs.columns) {
+		return fmt.Errorf("%s: scanning %d columns into %d targets", cs.table, len(cs.columns), len(targets))
+	}
+	dest := make([]interface{}, len(cs.columns))
+	for i, col := range cs.columns {
+		target, ok := targets[col]
+		if !ok {
+			return fmt.Errorf("%s: no scan target for column %s", cs.table, col)
+		}
+		dest[i] = target
+	}
+	return row.Scan(dest...)
+}
+
+// check compares the set against the live table, erroring if the table is
+// missing any of the set's columns or has columns the set doesn't know about
+func (cs *columnSet) check(db *sql.DB) error {
+	rows, err := db.Query("select column_name from information_schema.columns where table_schema = current_schema() and table_name = $1", cs.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	live := map[string]bool{}
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return err
+		}
+		live[col] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(live) == 0 {
+		return fmt.Errorf("table %s doesn't exist", cs.table)
+	}
+
+	var missing, unexpected []string
+	for _, col := range cs.columns {
+		if !live[col] {
+			missing = append(missing, col)
+		}
+		delete(live, col)
+	}
+	for col := range live {
+		unexpected = append(unexpected, col)
+	}
+	sort.Strings(unexpected)
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return nil
+	}
+	return fmt.Errorf("table %s doesn't have the expected columns. missing: [%s], unexpected: [%s]",
+		cs.table, strings.Join(missing, ", "), strings.Join(unexpected, ", "))
+}
+
+// columnSetErrors are the failed checks of column sets, in the order they're listed
+type columnSetErrors []error
+
+func (errs columnSetErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// checkColumnSets checks every table read with a column set against the live
+// database, columnCheckConcurrency at a time, returning every check that
+// failed as a columnSetErrors
+func checkColumnSets(db *sql.DB) error {
+	var (
+		results = make([]error, len(checkedColumnSets))
+		slots   = make(chan struct{}, columnCheckConcurrency)
+		wg      sync.WaitGroup
+	)
+	for i, cs := range checkedColumnSets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, cs *columnSet) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			results[i] = cs.check(db)
+		}(i, cs)
+	}
+	wg.Wait()
+
+	errs := columnSetErrors{}
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
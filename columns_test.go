@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fakeRow records what it's asked to scan into, writing each target's column
+// position into string targets
+type fakeRow struct {
+	dest []interface{}
+}
+
+func (r *fakeRow) Scan(dest ...interface{}) error {
+	r.dest = dest
+	for i, d := range dest {
+		if s, ok := d.(*string); ok {
+			*s = fmt.Sprintf("col%d", i)
+		}
+	}
+	return nil
+}
+
+func TestColumnSetScan(t *testing.T) {
+	cs := &columnSet{table: "things", columns: []string{"a", "b", "c"}}
+	if got := cs.String(); got != "a, b, c" {
+		t.Errorf("select list mismatch. expected: a, b, c, got: %s", got)
+	}
+
+	// targets are matched by name, not map order
+	var a, b, c string
+	if err := cs.scan(&fakeRow{}, scanTargets{"c": &c, "a": &a, "b": &b}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if a != "col0" || b != "col1" || c != "col2" {
+		t.Errorf("expected targets to be scanned in column order, got: %s %s %s", a, b, c)
+	}
+
+	cases := []struct {
+		targets scanTargets
+		err     string
+	}{
+		{scanTargets{"a": &a, "b": &b}, "scanning 3 columns into 2 targets"},
+		{scanTargets{"a": &a, "b": &b, "d": &c}, "no scan target for column c"},
+		{scanTargets{"a": &a, "b": &b, "c": &c, "d": &c}, "scanning 3 columns into 4 targets"},
+	}
+	for i, tc := range cases {
+		err := cs.scan(&fakeRow{}, tc.targets)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, tc.err, err)
+		}
+	}
+}
+
+func TestCheckColumnSets(t *testing.T) {
+	if err := checkColumnSets(appDB); err != nil {
+		t.Fatalf("expected test schema to match: %s", err.Error())
+	}
+
+	for _, cs := range checkedColumnSets {
+		if _, err := appDB.Exec(fmt.Sprintf("alter table %s add column decoy text", cs.table)); err != nil {
+			t.Fatal(err.Error())
+		}
+		err := checkColumnSets(appDB)
+		if _, dropErr := appDB.Exec(fmt.Sprintf("alter table %s drop column decoy", cs.table)); dropErr != nil {
+			t.Fatal(dropErr.Error())
+		}
+		if err == nil || !strings.Contains(err.Error(), "unexpected: [decoy]") {
+			t.Errorf("%s expected decoy column to be caught, got: %v", cs.table, err)
+		}
+	}
+
+	// every mismatch is reported, not just the first
+	tables := []string{checkedColumnSets[0].table, checkedColumnSets[len(checkedColumnSets)-1].table}
+	for _, table := range tables {
+		if _, err := appDB.Exec(fmt.Sprintf("alter table %s add column decoy text", table)); err != nil {
+			t.Fatal(err.Error())
+		}
+		defer appDB.Exec(fmt.Sprintf("alter table %s drop column decoy", table))
+	}
+	if errs, ok := checkColumnSets(appDB).(columnSetErrors); !ok || len(errs) != len(tables) {
+		t.Errorf("expected %d mismatched tables, got: %v", len(tables), errs)
+	}
+
+	missing := &columnSet{table: "relations", columns: append(append([]string{}, relationCols.columns...), "signature")}
+	if err := missing.check(appDB); err == nil || !strings.Contains(err.Error(), "missing: [signature]") {
+		t.Errorf("expected missing column to be caught, got: %v", err)
+	}
+	if err := (&columnSet{table: "no_such_table", columns: []string{"a"}}).check(appDB); err == nil {
+		t.Errorf("expected missing table to be caught")
+	}
+}
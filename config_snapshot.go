@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+var (
+	// ErrSnapshotHashMismatch is returned when a snapshot's config doesn't hash to it's stored hash
+	ErrSnapshotHashMismatch = fmt.Errorf("config snapshot hash doesn't match it's contents")
+	// ErrSnapshotBadSignature is returned when a signed snapshot fails signature verification
+	ErrSnapshotBadSignature = fmt.Errorf("config snapshot signature is invalid")
+)
+
+// snapshotSigner is the key used to sign config snapshots, configured by initConfig.
+// snapshots are stored unsigned if it's nil
+var snapshotSigner *ecdsa.PrivateKey
+
+// SourceConfig is the subset of a subprimer (source) that governs how it's
+// archived. Its canonical JSON encoding is what config snapshots hash & sign,
+// so fields must only ever be added, never renamed or reordered
+type SourceConfig struct {
+	SourceId      string                 `json:"sourceId"`
+	PrimerId      string                 `json:"primerId"`
+	Url           string                 `json:"url"`
+	Crawl         bool                   `json:"crawl"`
+	StaleDuration int64                  `json:"staleDuration"`
+	Meta          map[string]interface{} `json:"meta"`
+}
+
+// ConfigSnapshot is an immutable, content-addressed record of a subprimer's
+// configuration at a point in time
+type ConfigSnapshot struct {
+	// multihash of Config, hex-encoded
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	// source this snapshot was taken from
+	SourceId string `json:"sourceId"`
+	// canonical config bytes
+	Config json.RawMessage `json:"config"`
+	// base64 ASN.1 ECDSA signature of the sha256 of Config, empty if unsigned
+	Signature string `json:"signature"`
+	// base64 DER-encoded public key that produced Signature
+	PublicKey string `json:"publicKey"`
+}
+
+// ConfigChange is a single difference between two config snapshots
+type ConfigChange struct {
+	// dot-separated path to the changed value, eg: "meta.title"
+	Path string      `json:"path"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// NewSourceConfig extracts the archiving config from a source
+func NewSourceConfig(s *core.Source) *SourceConfig {
+	c := &SourceConfig{
+		SourceId:      s.Id,
+		Url:           s.Url,
+		Crawl:         s.Crawl,
+		StaleDuration: int64(s.StaleDuration),
+		Meta:          s.Meta,
+	}
+	if s.Primer != nil {
+		c.PrimerId = s.Primer.Id
+	}
+	return c
+}
+
+// canonicalConfig encodes a config deterministically. encoding/json writes
+// struct fields in declaration order & map keys sorted, which is all we need
+func canonicalConfig(c *SourceConfig) ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// hashContent returns the hex-encoded multihash of data under the configured
+// content hash algorithm, for content-addressing
+func hashContent(data []byte) (string, error) {
+	return hashContentWith(contentHashAlgorithm, data)
+}
+
+// hashContentWith hashes data with a named multihash algorithm
+func hashContentWith(alg string, data []byte) (string, error) {
+	h, err := newContentHasher(alg)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return h.Multihash()
+}
+
+// hashContentLike hashes data with the algorithm hash was made with, for
+// checking content against hashes made before the algorithm changed
+func hashContentLike(hash string, data []byte) (string, error) {
+	alg, err := hashAlgorithm(hash)
+	if err != nil {
+		return "", err
+	}
+	return hashContentWith(alg, data)
+}
+
+// NewConfigSnapshot canonicalizes, hashes & (if a signer is given) signs a source config
+func NewConfigSnapshot(c *SourceConfig, signer *ecdsa.PrivateKey) (*ConfigSnapshot, error) {
+	data, err := canonicalConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashContent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &ConfigSnapshot{
+		Hash:     hash,
+		Created:  time.Now().Round(time.Second).In(time.UTC),
+		SourceId: c.SourceId,
+		Config:   data,
+	}
+
+	if signer != nil {
+		if snap.Signature, snap.PublicKey, err = signData(signer, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return snap, nil
+}
+
+// signData signs the sha256 of data, returning a base64 ASN.1 ECDSA signature
+// & the base64 DER-encoded public key that checks it
+func signData(signer *ecdsa.PrivateKey, data []byte) (string, string, error) {
+	digest := sha256.Sum256(data)
+	sig, err := signer.Sign(rand.Reader, digest[:], nil)
+	if err != nil {
+		return "", "", err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&signer.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// validSignature checks a signature made by signData
+func validSignature(data []byte, signature, publicKey string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return false
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return false
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+
+	var esig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig, &esig); err != nil {
+		return false
+	}
+	digest := sha256.Sum256(data)
+	return ecdsa.Verify(pub, digest[:], esig.R, esig.S)
+}
+
+// Verify checks a snapshot's config hashes to it's hash, and that it's signature
+// (if any) is valid for it's public key. Callers that need to trust the signer
+// should also compare PublicKey against a known key
+func (s *ConfigSnapshot) Verify() error {
+	hash, err := hashContentLike(s.Hash, s.Config)
+	if err != nil {
+		return err
+	}
+	if hash != s.Hash {
+		return ErrSnapshotHashMismatch
+	}
+
+	if s.Signature != "" && !validSignature(s.Config, s.Signature, s.PublicKey) {
+		return ErrSnapshotBadSignature
+	}
+	return nil
+}
+
+// SnapshotSource stores a snapshot of a source's current config, returning the
+// existing snapshot if an identical config has already been stored
+func SnapshotSource(db *sql.DB, s *core.Source) (*ConfigSnapshot, error) {
+	snap, err := NewConfigSnapshot(NewSourceConfig(s), snapshotSigner)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, err := ReadConfigSnapshot(db, snap.Hash); err == nil {
+		return existing, nil
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	_, err = db.Exec("insert into config_snapshots (hash,created,source_id,config,signature,public_key) values ($1, $2, $3, $4, $5, $6) on conflict (hash) do nothing",
+		snap.Hash, snap.Created, snap.SourceId, []byte(snap.Config), snap.Signature, snap.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// configSnapshotCols are the columns of config_snapshots
+var configSnapshotCols = &columnSet{
+	table:   "config_snapshots",
+	columns: []string{"hash", "created", "source_id", "config", "signature", "public_key"},
+}
+
+// ReadConfigSnapshot reads a stored snapshot by hash
+func ReadConfigSnapshot(db *sql.DB, hash string) (*ConfigSnapshot, error) {
+	s, err := scanConfigSnapshot(db.QueryRow("select "+configSnapshotCols.String()+" from config_snapshots where hash = $1", hash))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return s, err
+}
+
+// scanConfigSnapshot reads a snapshot selected with configSnapshotCols
+func scanConfigSnapshot(row sqlScannable) (*ConfigSnapshot, error) {
+	s := &ConfigSnapshot{}
+	var config []byte
+	err := configSnapshotCols.scan(row, scanTargets{
+		"hash":       &s.Hash,
+		"created":    &s.Created,
+		"source_id":  &s.SourceId,
+		"config":     &config,
+		"signature":  &s.Signature,
+		"public_key": &s.PublicKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.Config = config
+	return s, nil
+}
+
+// snapshotForUrl snapshots the config of the source that governs archiving a url,
+// returning an empty hash if no source matches
+func snapshotForUrl(db *sql.DB, url string) (string, error) {
+	s, err := matchSource(db, url)
+	if err != nil || s == nil {
+		return "", err
+	}
+	snap, err := SnapshotSource(db, s)
+	if err != nil {
+		return "", err
+	}
+	return snap.Hash, nil
+}
+
+// DiffConfigSnapshots lists the differences between two snapshots, ordered by path
+func DiffConfigSnapshots(a, b *ConfigSnapshot) ([]*ConfigChange, error) {
+	var av, bv map[string]interface{}
+	if err := json.Unmarshal(a.Config, &av); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b.Config, &bv); err != nil {
+		return nil, err
+	}
+
+	changes := diffValues("", av, bv, []*ConfigChange{})
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// diffValues recursively compares decoded JSON values, descending into objects
+func diffValues(path string, a, b interface{}, changes []*ConfigChange) []*ConfigChange {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if !reflect.DeepEqual(a, b) {
+			changes = append(changes, &ConfigChange{Path: path, From: a, To: b})
+		}
+		return changes
+	}
+
+	keys := map[string]bool{}
+	for k := range am {
+		keys[k] = true
+	}
+	for k := range bm {
+		keys[k] = true
+	}
+	for k := range keys {
+		p := k
+		if path != "" {
+			p = path + "." + k
+		}
+		changes = diffValues(p, am[k], bm[k], changes)
+	}
+	return changes
+}
+
+// parseSnapshotSigningKey reads a PEM-encoded EC private key
+func parseSnapshotSigningKey(data string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("snapshot signing key must be a PEM-encoded EC private key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// FetchConfigSnapshotAction reads & verifies a config snapshot by hash
+type FetchConfigSnapshotAction struct {
+	ReqAction
+	Hash string `json:"hash"`
+}
+
+func (FetchConfigSnapshotAction) Type() string        { return "CONFIG_SNAPSHOT_FETCH_REQUEST" }
+func (FetchConfigSnapshotAction) SuccessType() string { return "CONFIG_SNAPSHOT_FETCH_SUCCESS" }
+func (FetchConfigSnapshotAction) FailureType() string { return "CONFIG_SNAPSHOT_FETCH_FAILURE" }
+
+func (FetchConfigSnapshotAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &FetchConfigSnapshotAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *FetchConfigSnapshotAction) Exec() (res *ClientResponse) {
+	snap, err := ReadConfigSnapshot(appDB, a.Hash)
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "configSnapshot", a.Hash)
+	} else if err == nil {
+		err = snap.Verify()
+	}
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "CONFIG_SNAPSHOT",
+		Id:        snap.Hash,
+		Data:      snap,
+	}
+}
+
+// DiffConfigSnapshotsAction compares two config snapshots
+type DiffConfigSnapshotsAction struct {
+	ReqAction
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (DiffConfigSnapshotsAction) Type() string        { return "CONFIG_SNAPSHOT_DIFF_REQUEST" }
+func (DiffConfigSnapshotsAction) SuccessType() string { return "CONFIG_SNAPSHOT_DIFF_SUCCESS" }
+func (DiffConfigSnapshotsAction) FailureType() string { return "CONFIG_SNAPSHOT_DIFF_FAILURE" }
+
+func (DiffConfigSnapshotsAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &DiffConfigSnapshotsAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *DiffConfigSnapshotsAction) Exec() (res *ClientResponse) {
+	snaps := make([]*ConfigSnapshot, 2)
+	for i, hash := range []string{a.From, a.To} {
+		snap, err := ReadConfigSnapshot(appDB, hash)
+		if err == ErrNotFound {
+			return notFoundResponse(a, a.RequestId, "configSnapshot", hash)
+		} else if err != nil {
+			log.Info(err.Error())
+			return &ClientResponse{
+				Type:      a.FailureType(),
+				RequestId: a.RequestId,
+				Error:     err.Error(),
+			}
+		}
+		snaps[i] = snap
+	}
+
+	changes, err := DiffConfigSnapshots(snaps[0], snaps[1])
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "CONFIG_CHANGE_ARRAY",
+		Data:      changes,
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestConfigSnapshotCanonical(t *testing.T) {
+	// key order in meta shouldn't effect the hash
+	a, err := NewConfigSnapshot(&SourceConfig{SourceId: "a", Url: "www.epa.gov", Meta: map[string]interface{}{"x": 1, "y": 2}}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := NewConfigSnapshot(&SourceConfig{SourceId: "a", Url: "www.epa.gov", Meta: map[string]interface{}{"y": 2, "x": 1}}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if a.Hash != b.Hash {
+		t.Errorf("expected equal configs to hash equally. %s != %s", a.Hash, b.Hash)
+	}
+
+	c, _ := NewConfigSnapshot(&SourceConfig{SourceId: "a", Url: "www.epa.gov", Crawl: true}, nil)
+	if a.Hash == c.Hash {
+		t.Errorf("expected different configs to have different hashes")
+	}
+	if err := a.Verify(); err != nil {
+		t.Errorf("unexpected error verifying unsigned snapshot: %s", err)
+	}
+}
+
+func TestConfigSnapshotSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	snap, err := NewConfigSnapshot(&SourceConfig{SourceId: "a", Url: "www.epa.gov"}, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := snap.Verify(); err != nil {
+		t.Errorf("unexpected error verifying signed snapshot: %s", err)
+	}
+
+	tampered := *snap
+	tampered.Config = json.RawMessage(`{"sourceId":"a","url":"www.evil.gov"}`)
+	if err := tampered.Verify(); err != ErrSnapshotHashMismatch {
+		t.Errorf("expected tampered config to fail verification. got: %v", err)
+	}
+
+	// re-hashing tampered config still fails on the signature
+	tampered.Hash, _ = hashContent(tampered.Config)
+	if err := tampered.Verify(); err != ErrSnapshotBadSignature {
+		t.Errorf("expected re-hashed config to fail signature verification. got: %v", err)
+	}
+
+	// a signature from a different key fails
+	resigned, _ := NewConfigSnapshot(&SourceConfig{SourceId: "a", Url: "www.epa.gov"}, other)
+	swapped := *snap
+	swapped.Signature = resigned.Signature
+	if err := swapped.Verify(); err != ErrSnapshotBadSignature {
+		t.Errorf("expected signature from another key to fail verification. got: %v", err)
+	}
+}
+
+func TestDiffConfigSnapshots(t *testing.T) {
+	a, _ := NewConfigSnapshot(&SourceConfig{SourceId: "a", Url: "www.epa.gov", Crawl: true, StaleDuration: int64(time.Hour), Meta: map[string]interface{}{"title": "EPA", "keep": true}}, nil)
+	b, _ := NewConfigSnapshot(&SourceConfig{SourceId: "a", Url: "www.epa.gov/haps", Crawl: true, StaleDuration: int64(time.Hour), Meta: map[string]interface{}{"title": "HAPS", "keep": true, "added": "x"}}, nil)
+
+	changes, err := DiffConfigSnapshots(a, b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := []string{"meta.added", "meta.title", "url"}
+	if len(changes) != len(expect) {
+		t.Fatalf("expected %d changes, got %d: %v", len(expect), len(changes), changes)
+	}
+	for i, path := range expect {
+		if changes[i].Path != path {
+			t.Errorf("case %d path mismatch. expected: %s, got: %s", i, path, changes[i].Path)
+		}
+	}
+	if changes[0].From != nil || changes[0].To != "x" {
+		t.Errorf("expected added value to diff from nil. got: %v -> %v", changes[0].From, changes[0].To)
+	}
+
+	if same, _ := DiffConfigSnapshots(a, a); len(same) != 0 {
+		t.Errorf("expected no changes diffing a snapshot with itself. got: %v", same)
+	}
+}
+
+func TestSnapshotForUrl(t *testing.T) {
+	defer resetTestData(appDB, "config_snapshots")
+
+	hash, err := snapshotForUrl(appDB, "http://www.epa.gov/haps/index.html")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	snap, err := ReadConfigSnapshot(appDB, hash)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if snap.SourceId != "590e001b-7060-4e54-bc81-c20c305a8155" {
+		t.Errorf("expected most specific source to be snapshotted. got: %s", snap.SourceId)
+	}
+	if err := snap.Verify(); err != nil {
+		t.Errorf("unexpected error verifying stored snapshot: %s", err)
+	}
+
+	again, err := snapshotForUrl(appDB, "http://www.epa.gov/haps/other.html")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if again != hash {
+		t.Errorf("expected unchanged config to reuse snapshot. %s != %s", again, hash)
+	}
+
+	if hash, err := snapshotForUrl(appDB, "http://unknown.example.com"); err != nil || hash != "" {
+		t.Errorf("expected no snapshot for url without a source. got: %s, %v", hash, err)
+	}
+
+	if _, err := ReadConfigSnapshot(appDB, "nope"); err != core.ErrNotFound {
+		t.Errorf("expected ErrNotFound reading missing snapshot. got: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	// unset & invalid ints don't stop later fields from loading
+	t.Setenv("WRITE_AUDIT_SAMPLE_PERCENT", "")
+	t.Setenv("REPLICA_TIMEOUT_SECONDS", "soon")
+	t.Setenv("GUARDRAIL_MAX_QUEUED", " 50 ")
+	t.Setenv("HTTP_AUTH_USERNAME", "user")
+	t.Setenv("TLS", "true")
+	t.Setenv("REPLICA_PEERS", "")
+	t.Setenv("FEATURE_FLAGS", "a=10, ,b=20,")
+
+	cfg := &config{Mode: TEST_MODE}
+	if err := loadConfig(cfg); err == nil {
+		t.Errorf("expected an error reading REPLICA_TIMEOUT_SECONDS")
+	}
+	if cfg.HttpAuthUsername != "user" || !cfg.TLS || cfg.GuardrailMaxQueued != 50 {
+		t.Errorf("expected fields after unreadable ints to load, got: %q %t %d", cfg.HttpAuthUsername, cfg.TLS, cfg.GuardrailMaxQueued)
+	}
+	if cfg.Mode != TEST_MODE || cfg.WriteAuditSamplePercent != 0 || cfg.ReplicaTimeoutSeconds != 0 {
+		t.Errorf("expected unset & unreadable fields to keep their value, got: %q %d %d", cfg.Mode, cfg.WriteAuditSamplePercent, cfg.ReplicaTimeoutSeconds)
+	}
+	if cfg.ReplicaPeers != nil || !reflect.DeepEqual(cfg.FeatureFlags, []string{"a=10", "b=20"}) {
+		t.Errorf("expected lists without empty entries, got: %q %q", cfg.ReplicaPeers, cfg.FeatureFlags)
+	}
+}
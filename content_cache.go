@@ -0,0 +1,376 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// EventUrlContentChanged is published when a capture of a url has a different
+// hash than the one before it
+const EventUrlContentChanged = "URL_CONTENT_CHANGED"
+
+const (
+	// number of urls the content cache holds before evicting the least recently used
+	contentCacheSize = 4096
+	// age after which a cached hash is still served, but refreshed in the background
+	contentCacheSoftTTL = 10 * time.Second
+	// age after which a cached hash isn't served at all, & is re-read before responding
+	contentCacheHardTTL = 2 * time.Minute
+)
+
+var (
+	// contentCacheStats exposes cache hit/miss/refresh counts at /debug/vars
+	contentCacheStats = expvar.NewMap("contentCache")
+	// contentCache is the package-level url -> latest capture hash cache
+	contentCache = newUrlContentCache(contentCacheSize, contentCacheSoftTTL, contentCacheHardTTL, func(url string) (string, error) {
+		return latestCaptureHash(appDB, url)
+	})
+)
+
+// UrlContent is the latest capture of a url
+type UrlContent struct {
+	Url string `json:"url"`
+	// hash of the latest capture
+	Hash string `json:"hash"`
+	// hash of the capture before it, only set on URL_CONTENT_CHANGED events
+	Prev string `json:"prev,omitempty"`
+}
+
+// eventUrlContent reads the url content from a URL_CONTENT_CHANGED event.
+// events from other instances carry it as decoded JSON
+func eventUrlContent(e *Event) (*UrlContent, error) {
+	if c, ok := e.Data.(*UrlContent); ok {
+		return c, nil
+	}
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	c := &UrlContent{}
+	err = json.Unmarshal(data, c)
+	return c, err
+}
+
+// publishContentChange publishes a URL_CONTENT_CHANGED event if a capture of u
+// changed it's hash from prev. the capture must be stored first
+func (s *Service) publishContentChange(u *core.Url, prev string) {
+	if u.Hash == "" || u.Hash == prev {
+		return
+	}
+	s.Publish(&Event{
+		Type:    EventUrlContentChanged,
+		Subject: u.Hash,
+		Data:    &UrlContent{Url: u.Url, Hash: u.Hash, Prev: prev},
+	})
+}
+
+// handleEvent invalidates the url a URL_CONTENT_CHANGED event is about. a
+// SUBJECT_SUPPRESSED event drops every url, it's subject can be the content
+// of any number of them
+func (c *urlContentCache) handleEvent(e *Event) {
+	if e.Type == EventSubjectSuppressed {
+		c.Purge()
+		return
+	}
+	if e.Type != EventUrlContentChanged {
+		return
+	}
+	if content, err := eventUrlContent(e); err != nil {
+		log.Infof("error reading %s event: %s", e.Type, err.Error())
+	} else {
+		c.Invalidate(content.Url)
+	}
+}
+
+// latestCaptureHash reads the current hash of a url's latest capture, following
+// hash aliases. returns ErrNotFound if the url hasn't been captured, or it's
+// content has been suppressed
+func latestCaptureHash(db *sql.DB, url string) (string, error) {
+	var hash sql.NullString
+	if err := db.QueryRow("select coalesce(a.new, u.hash) from urls u left join hash_aliases a on a.old = u.hash where u.url = $1 and coalesce(u.meta::jsonb->>'suppressed', '') <> 'true'", url).Scan(&hash); err == sql.ErrNoRows {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	if hash.String == "" {
+		return "", ErrNotFound
+	}
+	return hash.String, nil
+}
+
+// urlContentCache is an in-process LRU cache of url -> latest capture hash that
+// serves stale-while-revalidate. hashes younger than softTTL are served as-is,
+// ones younger than hardTTL are served while a single background read
+// refreshes them, & older ones are re-read before responding. Entries are
+// invalidated by URL_CONTENT_CHANGED events, and the cache is bypassed
+// entirely while events aren't being reliably received
+type urlContentCache struct {
+	sync.Mutex
+	size    int
+	softTTL time.Duration
+	hardTTL time.Duration
+	ll      *list.List
+	entries map[string]*list.Element
+	// gen is incremented on every invalidation. reads & refreshes only store
+	// their result if no invalidation happened while they were loading
+	gen uint64
+	// load reads a url's latest capture hash
+	load func(url string) (string, error)
+	// healthy reports weather invalidation events are being reliably received
+	healthy func() bool
+	// now reports the current time
+	now func() time.Time
+}
+
+// urlContentEntry is a cached hash for a single url
+type urlContentEntry struct {
+	url    string
+	hash   string
+	loaded time.Time
+	// refreshing is true while a background read of a stale entry is running
+	refreshing bool
+}
+
+func newUrlContentCache(size int, softTTL, hardTTL time.Duration, load func(url string) (string, error)) *urlContentCache {
+	return &urlContentCache{
+		size:    size,
+		softTTL: softTTL,
+		hardTTL: hardTTL,
+		ll:      list.New(),
+		entries: map[string]*list.Element{},
+		load:    load,
+		healthy: eventsHealthy,
+		now:     time.Now,
+	}
+}
+
+// Latest returns the hash of a url's latest capture. Not-found results aren't cached
+func (c *urlContentCache) Latest(url string) (string, error) {
+	if !c.healthy() {
+		contentCacheStats.Add("bypasses", 1)
+		return c.load(url)
+	}
+
+	c.Lock()
+	if el, ok := c.entries[url]; ok {
+		entry := el.Value.(*urlContentEntry)
+		age := c.now().Sub(entry.loaded)
+		if age < c.hardTTL {
+			c.ll.MoveToFront(el)
+			if age >= c.softTTL && !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(url, c.gen)
+				contentCacheStats.Add("staleHits", 1)
+			} else {
+				contentCacheStats.Add("hits", 1)
+			}
+			hash := entry.hash
+			c.Unlock()
+			return hash, nil
+		}
+		c.remove(el)
+		contentCacheStats.Add("expirations", 1)
+	}
+	gen := c.gen
+	c.Unlock()
+
+	contentCacheStats.Add("misses", 1)
+	hash, err := c.load(url)
+	if err != nil {
+		return "", err
+	}
+	c.store(url, hash, gen)
+	return hash, nil
+}
+
+// refresh re-reads a stale entry in the background
+func (c *urlContentCache) refresh(url string, gen uint64) {
+	contentCacheStats.Add("refreshes", 1)
+	hash, err := c.load(url)
+	if err != nil {
+		if err != ErrNotFound {
+			log.Infof("error refreshing content for %s: %s", url, err.Error())
+		}
+		c.Lock()
+		if el, ok := c.entries[url]; ok {
+			// the stale hash keeps being served until the hard TTL, the next read retries
+			el.Value.(*urlContentEntry).refreshing = false
+		}
+		c.Unlock()
+		return
+	}
+	c.store(url, hash, gen)
+}
+
+// store caches a hash read while the cache was at gen
+func (c *urlContentCache) store(url, hash string, gen uint64) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[url]
+	if c.gen != gen {
+		// an invalidation happened while loading, don't cache what might be stale.
+		// an entry still cached wasn't invalidated, so the next read can refresh it
+		if ok {
+			el.Value.(*urlContentEntry).refreshing = false
+		}
+		return
+	}
+	if ok {
+		entry := el.Value.(*urlContentEntry)
+		entry.hash, entry.loaded, entry.refreshing = hash, c.now(), false
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.entries[url] = c.ll.PushFront(&urlContentEntry{url: url, hash: hash, loaded: c.now()})
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+		contentCacheStats.Add("evictions", 1)
+	}
+}
+
+// snapshot lists cached hashes that haven't expired, most recently used first
+func (c *urlContentCache) snapshot() []*urlContentSnapshot {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	entries := []*urlContentSnapshot{}
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*urlContentEntry)
+		if now.Sub(entry.loaded) < c.hardTTL {
+			entries = append(entries, &urlContentSnapshot{Url: entry.url, Hash: entry.hash})
+		}
+	}
+	return entries
+}
+
+// restore caches hashes from a snapshot, least recently used first, leaving
+// urls that are already cached alone. restored hashes are stale, they're
+// served while they're refreshed until they reach the hard TTL
+func (c *urlContentCache) restore(entries []*urlContentSnapshot) {
+	c.Lock()
+	defer c.Unlock()
+	loaded := c.now().Add(-c.softTTL)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if _, ok := c.entries[e.Url]; ok {
+			continue
+		}
+		c.entries[e.Url] = c.ll.PushFront(&urlContentEntry{url: e.Url, hash: e.Hash, loaded: loaded})
+	}
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+// reconcile re-reads a url's cached hash, replacing it unless the url was
+// invalidated while reading & dropping it if the url is no longer captured
+func (c *urlContentCache) reconcile(url string) error {
+	c.Lock()
+	_, ok := c.entries[url]
+	gen := c.gen
+	c.Unlock()
+	if !ok {
+		return nil
+	}
+
+	hash, err := c.load(url)
+	if err == ErrNotFound {
+		c.Lock()
+		if el, ok := c.entries[url]; ok && c.gen == gen {
+			c.remove(el)
+		}
+		c.Unlock()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	c.store(url, hash, gen)
+	return nil
+}
+
+// Invalidate drops the cached hash for a url
+func (c *urlContentCache) Invalidate(url string) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	if el, ok := c.entries[url]; ok {
+		c.remove(el)
+	}
+	contentCacheStats.Add("invalidations", 1)
+}
+
+// Purge drops every cached hash
+func (c *urlContentCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	c.ll.Init()
+	c.entries = map[string]*list.Element{}
+	contentCacheStats.Add("purges", 1)
+}
+
+// remove an element from the cache, must be called with the lock held
+func (c *urlContentCache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*urlContentEntry).url)
+}
+
+// FetchUrlContentAction resolves a url to it's latest capture. the frontend asks
+// for this every time content is viewed, so it's answered from the service's
+// content cache
+type FetchUrlContentAction struct {
+	ReqAction
+	clientAction
+	Url string `json:"url"`
+}
+
+func (FetchUrlContentAction) Type() string        { return "URL_CONTENT_REQUEST" }
+func (FetchUrlContentAction) SuccessType() string { return "URL_CONTENT_SUCCESS" }
+func (FetchUrlContentAction) FailureType() string { return "URL_CONTENT_FAILURE" }
+
+func (FetchUrlContentAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &FetchUrlContentAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *FetchUrlContentAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	v, err := a.visibility()
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	if !v.Url(a.Url) {
+		return notFoundResponse(a, a.RequestId, "url", a.Url)
+	}
+	hash, err := svc.ContentCache.Latest(a.Url)
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "url", a.Url)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		Schema:    "URL_CONTENT",
+		RequestId: a.RequestId,
+		Data:      &UrlContent{Url: a.Url, Hash: hash},
+	}
+}
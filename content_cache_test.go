@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCaptures is a url -> latest capture hash lookup for content cache tests
+type fakeCaptures struct {
+	sync.Mutex
+	hashes map[string]string
+	loads  int
+}
+
+func (f *fakeCaptures) set(url, hash string) {
+	f.Lock()
+	defer f.Unlock()
+	f.hashes[url] = hash
+}
+
+func (f *fakeCaptures) load(url string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.loads++
+	if hash, ok := f.hashes[url]; ok {
+		return hash, nil
+	}
+	return "", ErrNotFound
+}
+
+func (f *fakeCaptures) loaded() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.loads
+}
+
+func TestUrlContentCacheStaleWhileRevalidate(t *testing.T) {
+	const url = "http://www.epa.gov"
+	captures := &fakeCaptures{hashes: map[string]string{url: "a"}}
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newUrlContentCache(10, 10*time.Second, time.Minute, captures.load)
+	c.healthy = func() bool { return true }
+	c.now = func() time.Time { return now }
+	refreshing := func() bool {
+		c.Lock()
+		defer c.Unlock()
+		el, ok := c.entries[url]
+		return ok && el.Value.(*urlContentEntry).refreshing
+	}
+
+	cases := []struct {
+		advance time.Duration
+		capture string
+		expect  string
+		loads   int
+	}{
+		// first read loads
+		{0, "", "a", 1},
+		{0, "", "a", 1},
+		// fresh hashes are served without reading, even if they've changed
+		{5 * time.Second, "b", "a", 1},
+		// stale hashes are served while they're refreshed in the background
+		{10 * time.Second, "", "a", 2},
+		{0, "", "b", 2},
+		// expired hashes are re-read before responding
+		{2 * time.Minute, "c", "c", 3},
+	}
+	for i, cs := range cases {
+		now = now.Add(cs.advance)
+		if cs.capture != "" {
+			captures.set(url, cs.capture)
+		}
+		got, err := c.Latest(url)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err.Error())
+		}
+		if got != cs.expect {
+			t.Errorf("case %d expected hash %s, got: %s", i, cs.expect, got)
+		}
+		// wait for any background refresh to be stored
+		for j := 0; j < 100 && refreshing(); j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := captures.loaded(); got != cs.loads {
+			t.Errorf("case %d expected %d loads, got: %d", i, cs.loads, got)
+		}
+	}
+
+	captures.set(url, "d")
+	c.Invalidate(url)
+	if got, _ := c.Latest(url); got != "d" {
+		t.Errorf("expected invalidation to drop cached hash, got: %s", got)
+	}
+
+	loads := captures.loaded()
+	c.Latest("http://www.epa.gov/missing")
+	c.Latest("http://www.epa.gov/missing")
+	if got := captures.loaded() - loads; got != 2 {
+		t.Errorf("expected not found results not to be cached. loads: %d", got)
+	}
+}
+
+// TestUrlContentChangedBeforeNotification checks a client told about a content
+// change by an event fetches the new capture, for events published locally &
+// by other instances
+func TestUrlContentChangedBeforeNotification(t *testing.T) {
+	const url = "http://www.epa.gov/content_changed"
+	captures := &fakeCaptures{hashes: map[string]string{url: "1220aaaa"}}
+	svc := newTestService()
+	svc.ContentCache = newUrlContentCache(contentCacheSize, contentCacheSoftTTL, contentCacheHardTTL, captures.load)
+	svc.ContentCache.healthy = func() bool { return true }
+	svc.Hub = newRoom()
+	go svc.Hub.run()
+
+	client := &Client{svc: svc, hub: svc.Hub, send: make(chan []byte, 4)}
+	svc.Hub.register <- client
+
+	fetch := func() string {
+		a := FetchUrlContentAction{}.Parse("1", json.RawMessage(`{"url":"`+url+`"}`))
+		a.(ClientBoundAction).SetClient(client)
+		res := a.Exec()
+		if res.Error != "" {
+			t.Fatal(res.Error)
+		}
+		return res.Data.(*UrlContent).Hash
+	}
+	// cache the current capture
+	if got := fetch(); got != "1220aaaa" {
+		t.Fatalf("expected current capture, got: %s", got)
+	}
+
+	cases := []struct {
+		hash    string
+		publish func(e *Event)
+	}{
+		{"1220bbbb", svc.Publish},
+		{"1220cccc", func(e *Event) {
+			e.Origin = "other-instance"
+			data, err := json.Marshal(e)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			svc.handleRemoteEvent(eventsChannelPrefix+e.Type, data)
+		}},
+	}
+	for i, c := range cases {
+		captures.set(url, c.hash)
+		c.publish(&Event{Type: EventUrlContentChanged, Subject: c.hash, Data: &UrlContent{Url: url, Hash: c.hash}})
+
+		select {
+		case msg := <-client.send:
+			res := &ClientResponse{}
+			if err := json.Unmarshal(msg, res); err != nil || res.Type != EventUrlContentChanged {
+				t.Fatalf("case %d expected %s notification, got: %s", i, EventUrlContentChanged, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("case %d timed out waiting for notification", i)
+		}
+		// fetch as soon as the notification arrives
+		if got := fetch(); got != c.hash {
+			t.Errorf("case %d expected notified client to fetch new capture %s, got: %s", i, c.hash, got)
+		}
+	}
+}
+
+func TestUrlContentCacheSuppression(t *testing.T) {
+	captures := &fakeCaptures{hashes: map[string]string{"http://a.gov": "a", "http://b.gov": "b"}}
+	c := newUrlContentCache(10, time.Minute, time.Hour, captures.load)
+	c.healthy = func() bool { return true }
+	c.Latest("http://a.gov")
+	c.Latest("http://b.gov")
+
+	// suppressed content isn't found by the loader, cached hashes must go
+	delete(captures.hashes, "http://a.gov")
+	c.handleEvent(&Event{Type: EventSubjectSuppressed, Subject: "a"})
+	if _, err := c.Latest("http://a.gov"); err != ErrNotFound {
+		t.Errorf("expected suppressed url to be re-read & not found, got: %v", err)
+	}
+	if hash, err := c.Latest("http://b.gov"); err != nil || hash != "b" {
+		t.Errorf("expected other urls to be re-read, got: %s %v", hash, err)
+	}
+	if captures.loaded() != 4 {
+		t.Errorf("expected every url to be re-read after a suppression, got %d loads", captures.loaded())
+	}
+}
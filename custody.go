@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/lib/pq"
+)
+
+// Custody reports
+//
+// A custody report gathers everything recorded about a single capture into
+// one document: who requested it & when, the subprimer config it was archived
+// under, how it was fetched, it's content hash & verifications, & any
+// moderation or suppression since. every entry carries the table & key of the
+// stored record it was read from, the record itself & it's sha256, so each can
+// be checked against the database. reports are signed with the snapshot
+// signing key. anything a report should hold but can't, eg: forensics for
+// captures made before they were recorded, is listed as a gap rather than
+// left out
+
+// kinds of custody entries & gaps
+const (
+	custodyRequest      = "request"
+	custodyCapture      = "capture"
+	custodyConfig       = "config"
+	custodyForensics    = "forensics"
+	custodyVerification = "verification"
+	custodyReplication  = "replication"
+	custodyModeration   = "moderation"
+	custodySuppression  = "suppression"
+	custodySignature    = "signature"
+)
+
+var (
+	// ErrCustodyRecordMismatch is returned when a custody entry's record doesn't hash to it's record hash
+	ErrCustodyRecordMismatch = fmt.Errorf("custody entry record doesn't match it's hash")
+	// ErrCustodyUnsigned is returned when verifying a report that wasn't signed
+	ErrCustodyUnsigned = fmt.Errorf("custody report isn't signed")
+	// ErrCustodyBadSignature is returned when a report fails signature verification
+	ErrCustodyBadSignature = fmt.Errorf("custody report signature is invalid")
+)
+
+// Report is a chain-of-custody report for a single capture
+type Report struct {
+	// hash the report was asked for
+	Hash string `json:"hash"`
+	// hash the content is known by now, after any re-hashing
+	CurrentHash string `json:"currentHash"`
+	// every hash the content has been known by
+	Aliases   []string  `json:"aliases"`
+	Generated time.Time `json:"generated"`
+	// urls captured with this content
+	Urls []string `json:"urls"`
+	// entries, oldest first
+	Entries []*CustodyEntry `json:"entries"`
+	Gaps    []*CustodyGap   `json:"gaps"`
+	// base64 ASN.1 ECDSA signature of the sha256 of the report's JSON encoding
+	// with Signature & PublicKey empty, see signData
+	Signature string `json:"signature"`
+	PublicKey string `json:"publicKey"`
+}
+
+// CustodyEntry is a single recorded event in a capture's custody
+type CustodyEntry struct {
+	Kind    string    `json:"kind"`
+	At      time.Time `json:"at"`
+	Summary string    `json:"summary"`
+	// table & key of the stored record, eg: "archive_requests/12"
+	Source string `json:"source"`
+	// the stored record, & the hex sha256 of it
+	Record     json.RawMessage `json:"record"`
+	RecordHash string          `json:"recordHash"`
+}
+
+// CustodyGap notes something a report can't show
+type CustodyGap struct {
+	Kind string `json:"kind"`
+	Note string `json:"note"`
+}
+
+// custodyReport collects a report's entries & gaps
+type custodyReport struct {
+	*Report
+	err error
+}
+
+// add records an entry, hashing it's record
+func (r *custodyReport) add(kind, source string, at time.Time, summary string, record interface{}) {
+	if r.err != nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		r.err = err
+		return
+	}
+	sum := sha256.Sum256(data)
+	r.Entries = append(r.Entries, &CustodyEntry{
+		Kind:       kind,
+		At:         at.In(time.UTC),
+		Summary:    summary,
+		Source:     source,
+		Record:     data,
+		RecordHash: hex.EncodeToString(sum[:]),
+	})
+}
+
+// gap notes something missing from the report
+func (r *custodyReport) gap(kind, note string, args ...interface{}) {
+	r.Gaps = append(r.Gaps, &CustodyGap{Kind: kind, Note: fmt.Sprintf(note, args...)})
+}
+
+// custodyRow is a stored record read for a report, by column name
+type custodyRow map[string]interface{}
+
+func (row custodyRow) str(col string) string {
+	s, _ := row[col].(string)
+	return s
+}
+
+func (row custodyRow) time(col string) time.Time {
+	t, _ := row[col].(time.Time)
+	return t
+}
+
+// readCustodyRows reads every column of the rows a query selects. text & json
+// columns come back as text & raw json, so records are hashed as they're stored
+func readCustodyRows(db sqlQueryable, query string, args ...interface{}) ([]custodyRow, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	read := []custodyRow{}
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := custodyRow{}
+		for i, col := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				if json.Valid(b) {
+					vals[i] = json.RawMessage(b)
+				} else {
+					vals[i] = string(b)
+				}
+			}
+			row[col] = vals[i]
+		}
+		read = append(read, row)
+	}
+	return read, rows.Err()
+}
+
+// CustodyReport assembles & signs a custody report for the capture of content
+// with captureHash, or any hash it's been known by, using s's signer. It
+// returns ErrNotFound if nothing was captured with it. content is checked
+// against s's store if it holds content, & hashed again if it's stored in
+// cfg.ImportContentDir
+func (s *Service) CustodyReport(captureHash string) (*Report, error) {
+	if !validHash(captureHash) {
+		return nil, ErrNotFound
+	}
+	db := s.DB
+	aliases, err := hashAliases(db, captureHash)
+	if err != nil {
+		return nil, err
+	}
+	current, err := currentHash(db, captureHash)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(aliases)
+
+	r := &custodyReport{Report: &Report{
+		Hash:        captureHash,
+		CurrentHash: current,
+		Aliases:     aliases,
+		Generated:   s.Clock().Round(time.Second).In(time.UTC),
+		Urls:        []string{},
+		Entries:     []*CustodyEntry{},
+		Gaps:        []*CustodyGap{},
+	}}
+
+	found, err := r.captures(db)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	for _, read := range []func(*sql.DB) error{r.requests, r.forensics, r.moderation} {
+		if err := read(db); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.verifications(db, s.Store); err != nil {
+		return nil, err
+	}
+	r.gap(custodyReplication, "replication & pin confirmations aren't recorded by this server")
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	sort.SliceStable(r.Entries, func(i, j int) bool { return r.Entries[i].At.Before(r.Entries[j].At) })
+	if err := r.sign(s.Signer); err != nil {
+		return nil, err
+	}
+	return r.Report, nil
+}
+
+// captures adds the urls & snapshots captured with the content, reporting
+// weather there were any
+func (r *custodyReport) captures(db *sql.DB) (bool, error) {
+	urls, err := readCustodyRows(db, "select * from urls where hash = any($1) order by url", pq.Array(r.Aliases))
+	if err != nil {
+		return false, err
+	}
+	for _, u := range urls {
+		url := u.str("url")
+		r.Urls = append(r.Urls, url)
+		at := u.time("last_get")
+		if at.IsZero() {
+			at = u.time("created")
+		}
+		r.add(custodyCapture, "urls/"+url, at, fmt.Sprintf("%s captured as %s, status %v", url, u.str("hash"), u["status"]), u)
+
+		var meta map[string]interface{}
+		if raw, ok := u["meta"].(json.RawMessage); ok {
+			json.Unmarshal(raw, &meta)
+		}
+		if meta[suppressedMetaKey] == true {
+			r.add(custodySuppression, "urls/"+url, u.time("updated"), fmt.Sprintf("%s suppressed by a moderator", url), u)
+		}
+	}
+
+	snapshots, err := readCustodyRows(db, "select * from snapshots where hash = any($1) order by created", pq.Array(r.Aliases))
+	if err != nil {
+		return false, err
+	}
+	captured := map[string]bool{}
+	for _, url := range r.Urls {
+		captured[url] = true
+	}
+	for _, s := range snapshots {
+		// content can be snapshotted under a url that's since captured something else
+		if url := s.str("url"); !captured[url] {
+			captured[url] = true
+			r.Urls = append(r.Urls, url)
+		}
+		at := s.time("created")
+		r.add(custodyCapture, fmt.Sprintf("snapshots/%s@%s", s.str("url"), at.Format(time.RFC3339)), at,
+			fmt.Sprintf("%s snapshot taken as %s, status %v", s.str("url"), s.str("hash"), s["status"]), s)
+	}
+	return len(urls) > 0 || len(snapshots) > 0, nil
+}
+
+// requests adds the archive requests for the captured urls & the config
+// snapshots they were made under
+func (r *custodyReport) requests(db *sql.DB) error {
+	requests, err := readCustodyRows(db, "select * from archive_requests where url = any($1) order by created, id", pq.Array(r.Urls))
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		r.gap(custodyRequest, "no archive request is recorded, captures made by crawls or before requests were recorded have none")
+	}
+
+	snapshots := map[string]bool{}
+	unsnapshotted := 0
+	for _, req := range requests {
+		by := "requested by " + req.str("user_id")
+		if req["anonymous"] == true {
+			by = "requested anonymously by requester " + req.str("requester")
+		} else if req.str("user_id") == "" {
+			by = "requested by " + req.str("requester")
+		}
+		if via := req.str("via"); via != "" {
+			by += " via " + via
+		}
+		r.add(custodyRequest, fmt.Sprintf("archive_requests/%v", req["id"]), req.time("created"), fmt.Sprintf("%s %s", req.str("url"), by), req)
+
+		if hash := req.str("config_snapshot"); hash != "" {
+			snapshots[hash] = true
+		} else {
+			unsnapshotted++
+		}
+	}
+	if unsnapshotted > 0 {
+		r.gap(custodyConfig, "%d archive request(s) have no config snapshot, the url didn't fall under a subprimer or was requested before snapshots were taken", unsnapshotted)
+	}
+
+	hashes := make([]string, 0, len(snapshots))
+	for hash := range snapshots {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		snap, err := ReadConfigSnapshot(db, hash)
+		if err == ErrNotFound {
+			r.gap(custodyConfig, "config snapshot %s is referenced by an archive request but isn't stored", hash)
+			continue
+		} else if err != nil {
+			return err
+		}
+		status := "verified"
+		if err := snap.Verify(); err != nil {
+			status = err.Error()
+		} else if snap.Signature == "" {
+			status = "verified, unsigned"
+		}
+		r.add(custodyConfig, "config_snapshots/"+hash, snap.Created, fmt.Sprintf("subprimer %s config snapshot %s (%s)", snap.SourceId, hash, status), snap)
+	}
+	return nil
+}
+
+// forensics adds the forensic records of fetches of the captured urls
+func (r *custodyReport) forensics(db *sql.DB) error {
+	records, err := readCustodyRows(db, "select * from fetch_forensics where url = any($1) order by created, hash", pq.Array(r.Urls))
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		r.gap(custodyForensics, "no forensic fetch record is stored, forensics are only recorded under subprimers that set %q & weren't recorded for older captures", forensicsMetaKey)
+	}
+	for _, f := range records {
+		r.add(custodyForensics, "fetch_forensics/"+f.str("hash"), f.time("created"), fmt.Sprintf("%s fetch recorded", f.str("url")), f)
+	}
+	return nil
+}
+
+// verifications adds the content's re-hashes, queued verification & a check
+// of the content as it's stored now
+func (r *custodyReport) verifications(db *sql.DB, store datastore.Datastore) error {
+	before := len(r.Entries)
+
+	aliases, err := readCustodyRows(db, "select * from hash_aliases where old = any($1) or new = any($1) order by created, old", pq.Array(r.Aliases))
+	if err != nil {
+		return err
+	}
+	for _, a := range aliases {
+		r.add(custodyVerification, "hash_aliases/"+a.str("old"), a.time("created"), fmt.Sprintf("content re-hashed from %s to %s", a.str("old"), a.str("new")), a)
+	}
+
+	queued, err := readCustodyRows(db, "select path, hash, size, hashed, created, updated from idle_verifications where hash = any($1) order by created, path", pq.Array(r.Aliases))
+	if err != nil {
+		return err
+	}
+	for _, q := range queued {
+		r.add(custodyVerification, "idle_verifications/"+q.str("path"), q.time("updated"), fmt.Sprintf("queued for verification, %v of %v bytes hashed", q["hashed"], q["size"]), q)
+	}
+
+	if cs, ok := store.(contentStore); ok {
+		has, err := cs.HasContent(r.CurrentHash)
+		if err != nil {
+			return err
+		}
+		if !has {
+			r.gap(custodyVerification, "content %s isn't held by the datastore", r.CurrentHash)
+		}
+	}
+
+	if dir := configuredContentDir(); dir != "" {
+		if err := r.verifyStored(db, dir); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Entries) == before {
+		r.gap(custodyVerification, "no verification of the content is recorded, verifiers only report mismatches & the content isn't stored locally to check")
+	}
+	return nil
+}
+
+// configuredContentDir is the directory content is stored in locally, empty if it isn't
+func configuredContentDir() string {
+	if cfg == nil {
+		return ""
+	}
+	return cfg.ImportContentDir
+}
+
+// verifyStored hashes the content as stored in dir now
+func (r *custodyReport) verifyStored(db *sql.DB, dir string) error {
+	f, err := openStoredContent(db, dir, r.CurrentHash)
+	if os.IsNotExist(err) {
+		r.gap(custodyVerification, "content %s isn't stored locally to check", r.CurrentHash)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	name := filepath.Base(f.Name())
+	alg, err := hashAlgorithm(name)
+	if err != nil {
+		return err
+	}
+	h, err := newContentHasher(alg)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	got, err := h.Multihash()
+	if err != nil {
+		return err
+	}
+
+	summary := fmt.Sprintf("stored content hashed to %s when the report was generated", got)
+	if got != name {
+		summary = fmt.Sprintf("stored content %s hashed to %s when the report was generated, it's been altered", name, got)
+	}
+	r.add(custodyVerification, "content/"+name, r.Generated, summary, map[string]interface{}{
+		"hash":     name,
+		"got":      got,
+		"verified": got == name,
+	})
+	return nil
+}
+
+// moderation adds moderation cases against the content or it's urls, & the
+// moderation log of each
+func (r *custodyReport) moderation(db *sql.DB) error {
+	subjects := append(append([]string{}, r.Aliases...), r.Urls...)
+	cases, err := readCustodyRows(db, "select * from moderation_cases where subject = any($1) order by created, id", pq.Array(subjects))
+	if err != nil {
+		return err
+	}
+	for _, c := range cases {
+		id := c.str("id")
+		r.add(custodyModeration, "moderation_cases/"+id, c.time("created"), fmt.Sprintf("moderation case opened against %s, %v report(s), %s", c.str("subject"), c["report_count"], c.str("status")), c)
+		if c.str("status") == caseSuppressed {
+			r.add(custodySuppression, "moderation_cases/"+id, c.time("updated"), fmt.Sprintf("%s suppressed: %s", c.str("subject"), c.str("resolution")), c)
+		}
+
+		entries, err := readCustodyRows(db, "select * from moderation_log where case_id = $1 order by created, id", id)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			r.add(custodyModeration, fmt.Sprintf("moderation_log/%v", e["id"]), e.time("created"), fmt.Sprintf("%s by %s on case %s", e.str("action"), e.str("actor"), id), e)
+		}
+	}
+	return nil
+}
+
+// signedData is what a report's signature signs
+func (r *Report) signedData() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = ""
+	unsigned.PublicKey = ""
+	return json.Marshal(&unsigned)
+}
+
+// sign signs the report with signer, noting the report is unsigned if signer is nil
+func (r *custodyReport) sign(signer *ecdsa.PrivateKey) error {
+	if signer == nil {
+		r.gap(custodySignature, "no signing key is configured, the report is unsigned")
+		return nil
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return err
+	}
+	r.Signature, r.PublicKey, err = signData(signer, data)
+	return err
+}
+
+// Verify checks each entry's record hashes to it's record hash, & the report's
+// signature is valid for it's public key. Callers that need to trust the
+// signer should also compare PublicKey against a known key
+func (r *Report) Verify() error {
+	for _, e := range r.Entries {
+		sum := sha256.Sum256(e.Record)
+		if hex.EncodeToString(sum[:]) != e.RecordHash {
+			return ErrCustodyRecordMismatch
+		}
+	}
+	if r.Signature == "" {
+		return ErrCustodyUnsigned
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return err
+	}
+	if !validSignature(data, r.Signature, r.PublicKey) {
+		return ErrCustodyBadSignature
+	}
+	return nil
+}
+
+// WriteText writes a human-readable form of the report. the signature covers
+// the report's JSON encoding, not this text
+func (r *Report) WriteText(w io.Writer) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Chain of custody for capture %s\n", r.Hash)
+	fmt.Fprintf(buf, "Generated:    %s\n", r.Generated.Format(time.RFC3339))
+	fmt.Fprintf(buf, "Current hash: %s\n", r.CurrentHash)
+	if len(r.Aliases) > 1 {
+		fmt.Fprintf(buf, "Known as:     %s\n", strings.Join(r.Aliases, ", "))
+	}
+	for _, url := range r.Urls {
+		fmt.Fprintf(buf, "Url:          %s\n", url)
+	}
+
+	fmt.Fprintf(buf, "\nEntries\n")
+	for i, e := range r.Entries {
+		fmt.Fprintf(buf, "%d. %s  %-12s %s\n", i+1, e.At.Format(time.RFC3339), e.Kind, e.Summary)
+		fmt.Fprintf(buf, "   record %s, sha256 %s\n", e.Source, e.RecordHash)
+	}
+
+	fmt.Fprintf(buf, "\nGaps\n")
+	if len(r.Gaps) == 0 {
+		fmt.Fprintf(buf, "none\n")
+	}
+	for _, g := range r.Gaps {
+		fmt.Fprintf(buf, "- %s: %s\n", g.Kind, g.Note)
+	}
+
+	fmt.Fprintf(buf, "\nSignature\n")
+	if r.Signature == "" {
+		fmt.Fprintf(buf, "unsigned\n")
+	} else {
+		fmt.Fprintf(buf, "ECDSA over the sha256 of the JSON form of this report, without it's signature & public key\n")
+		fmt.Fprintf(buf, "signature:  %s\npublic key: %s\n", r.Signature, r.PublicKey)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// CustodyReportHandler serves a custody report for the capture with the hash
+// param, as text if format=text & JSON otherwise
+func CustodyReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminConfigured(w) {
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	hash := r.FormValue("hash")
+	report, err := defaultService().CustodyReport(hash)
+	if err == ErrNotFound {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("no capture with hash %q", hash)})
+		return
+	} else if err != nil {
+		log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := report.WriteText(w); err != nil {
+			log.Info(err.Error())
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// CustodyReportAction reads a custody report for a capture, for admins
+type CustodyReportAction struct {
+	ReqAction
+	clientAction
+	Token string `json:"token"`
+	Hash  string `json:"hash"`
+}
+
+func (CustodyReportAction) Type() string        { return "CUSTODY_REPORT_REQUEST" }
+func (CustodyReportAction) SuccessType() string { return "CUSTODY_REPORT_SUCCESS" }
+func (CustodyReportAction) FailureType() string { return "CUSTODY_REPORT_FAILURE" }
+
+func (CustodyReportAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &CustodyReportAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *CustodyReportAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrNotModerator.Error(),
+		}
+	}
+
+	report, err := svc.CustodyReport(a.Hash)
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "capture", a.Hash)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "CUSTODY_REPORT",
+		Id:        report.Hash,
+		Data:      report,
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCustodyReportSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	newReport := func() *custodyReport {
+		r := &custodyReport{Report: &Report{Hash: "1220ab", CurrentHash: "1220ab", Generated: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}}
+		r.add(custodyRequest, "archive_requests/1", r.Generated, "http://www.epa.gov requested by key", map[string]interface{}{"id": 1, "user_id": "key"})
+		return r
+	}
+
+	r := newReport()
+	if err := r.sign(key); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := r.Verify(); err != nil {
+		t.Errorf("expected a signed report to verify, got: %s", err.Error())
+	}
+
+	r.Entries[0].Record = json.RawMessage(`{"id":1,"user_id":"someone else"}`)
+	if err := r.Verify(); err != ErrCustodyRecordMismatch {
+		t.Errorf("expected an altered record to fail verification, got: %v", err)
+	}
+
+	r = newReport()
+	r.sign(key)
+	r.Entries[0].Summary = "http://www.epa.gov requested by someone else"
+	if err := r.Verify(); err != ErrCustodyBadSignature {
+		t.Errorf("expected an altered report to fail verification, got: %v", err)
+	}
+
+	r = newReport()
+	r.sign(nil)
+	if err := r.Verify(); err != ErrCustodyUnsigned {
+		t.Errorf("expected an unsigned report not to verify, got: %v", err)
+	}
+	if len(r.Gaps) != 1 || r.Gaps[0].Kind != custodySignature {
+		t.Errorf("expected an unsigned report to say so, got gaps: %v", r.Gaps)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, expect := range []string{"requested by key", "archive_requests/1", r.Entries[0].RecordHash, "the report is unsigned"} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected text form to include %q, got:\n%s", expect, buf.String())
+		}
+	}
+}
+
+func TestCustodyReport(t *testing.T) {
+	const (
+		url  = "http://custody.example.com/data.csv"
+		hash = "1220c0ffee00000000000000000000000000000000000000000000000000000000ee"
+	)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	svc := newTestService()
+	svc.Signer = key
+	defer resetTestData(appDB, "archive_requests", "moderation_cases", "moderation_log")
+
+	if _, err := svc.CustodyReport(hash); err != ErrNotFound {
+		t.Errorf("expected hashes that weren't captured to be not found, got: %v", err)
+	}
+
+	if _, err := appDB.Exec("insert into urls (url,created,updated,last_get,status,hash) values ($1, '2017-01-01 00:00:02', '2017-01-01 00:00:02', '2017-01-01 00:00:02', 200, $2)", url, hash); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer appDB.Exec("delete from urls where url = $1", url)
+	if _, err := appDB.Exec("insert into archive_requests (created,url,user_id) values ('2017-01-01 00:00:01', $1, 'key')", url); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into moderation_cases (id,created,updated,subject,status,report_count,resolution) values
+		('7d6e5f4a-3b2c-4d1e-8f0a-9b8c7d6e5f4a', '2017-01-02 00:00:00', '2017-01-03 00:00:00', $1, 'suppressed', 2, 'not public')`, hash); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec("insert into moderation_log (created,case_id,actor,action) values ('2017-01-03 00:00:00', '7d6e5f4a-3b2c-4d1e-8f0a-9b8c7d6e5f4a', 'moderator', 'suppress')"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r, err := svc.CustodyReport(hash)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := r.Verify(); err != nil {
+		t.Errorf("expected the report to verify, got: %s", err.Error())
+	}
+
+	kinds := []string{}
+	for _, e := range r.Entries {
+		kinds = append(kinds, e.Kind)
+	}
+	expect := []string{custodyRequest, custodyCapture, custodyModeration, custodySuppression, custodyModeration}
+	if strings.Join(kinds, ",") != strings.Join(expect, ",") {
+		t.Errorf("expected entries %v, got: %v", expect, kinds)
+	}
+
+	// missing pieces are noted, not left out
+	gaps := map[string]bool{}
+	for _, g := range r.Gaps {
+		gaps[g.Kind] = true
+	}
+	for _, kind := range []string{custodyConfig, custodyForensics, custodyVerification, custodyReplication} {
+		if !gaps[kind] {
+			t.Errorf("expected a %s gap, got: %v", kind, r.Gaps)
+		}
+	}
+
+	svc.Config.ModerationToken = "matrix"
+	client := &Client{svc: svc}
+	if res := client.HandleRequestAction(CustodyReportAction{}.Type(), "req", false, "", json.RawMessage(`{"token":"wrong","hash":"`+hash+`"}`)); res.Error != ErrNotModerator.Error() {
+		t.Errorf("expected an invalid token to be refused, got: %q", res.Error)
+	}
+	res := client.HandleRequestAction(CustodyReportAction{}.Type(), "req", false, "", json.RawMessage(`{"token":"matrix","hash":"`+hash+`"}`))
+	if got, ok := res.Data.(*Report); !ok || len(got.Entries) != len(r.Entries) {
+		t.Errorf("expected the report, got: %v %s", res.Data, res.Error)
+	}
+}
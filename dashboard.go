@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// Landing dashboard
+//
+// The landing page renders recent archives, popular urls, archive stats, the
+// user's watchlist & archive requests, and announcements. DASHBOARD_REQUEST
+// assembles every section concurrently in one response. each section is capped
+// at dashboardCaps items & fails on it's own, so a slow or broken section is
+// reported in place without failing the others. personal sections are only
+// sent to clients that said hello with a key id. dashboards without them carry
+// cache hints, personal dashboards never do
+
+// dashboardVersion is the version of the Dashboard schema. bump it when
+// sections change shape
+const dashboardVersion = 1
+
+// dashboard sections
+const (
+	dashboardRecentArchives = "recentArchives"
+	dashboardPopularUrls    = "popularUrls"
+	dashboardStats          = "stats"
+	dashboardWatchlist      = "watchlist"
+	dashboardArchives       = "archiveRequests"
+	dashboardAnnouncements  = "announcements"
+)
+
+const (
+	// how long a section can take before it's reported as failed
+	dashboardSectionTimeout = 5 * time.Second
+	// how far back archive requests count towards a url's popularity
+	dashboardPopularWindow = 7 * 24 * time.Hour
+	// how long archive stats are reused before they're counted again
+	dashboardStatsTTL = 30 * time.Second
+)
+
+// dashboardCaps are the most items each list section holds
+var dashboardCaps = map[string]int{
+	dashboardRecentArchives: 12,
+	dashboardPopularUrls:    10,
+	dashboardWatchlist:      20,
+	dashboardArchives:       10,
+	dashboardAnnouncements:  5,
+}
+
+// dashboardPersonal are the sections only sent to clients with a key id
+var dashboardPersonal = map[string]bool{
+	dashboardWatchlist: true,
+	dashboardArchives:  true,
+}
+
+// ErrUnknownDashboardSection is returned when omitting a section that doesn't exist
+var ErrUnknownDashboardSection = fmt.Errorf("unknown dashboard section")
+
+// Dashboard is everything the landing page renders
+type Dashboard struct {
+	Version int `json:"version"`
+	// weather personal sections were assembled for the requester
+	Personalized bool `json:"personalized"`
+	// sections by name, omitted sections aren't listed
+	Sections map[string]*DashboardSection `json:"sections"`
+}
+
+// DashboardSection is one section of the dashboard
+type DashboardSection struct {
+	// set if the section couldn't be assembled, data is nil
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+	// the section had more items than it's cap
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// PopularUrl is a url archiving has been requested for often recently
+type PopularUrl struct {
+	Url   string `json:"url"`
+	Title string `json:"title"`
+	// hash of the latest capture, empty if it hasn't been captured
+	Hash string `json:"hash"`
+	// archive requests within dashboardPopularWindow
+	Requests int `json:"requests"`
+}
+
+// DashboardStats are archive-wide counts
+type DashboardStats struct {
+	Urls int64 `json:"urls"`
+	// urls that have been captured
+	Captured int64 `json:"captured"`
+	Sources  int64 `json:"sources"`
+	// urls captured in the last 24 hours
+	CapturedToday int64     `json:"capturedToday"`
+	Counted       time.Time `json:"counted"`
+}
+
+// DashboardArchiveRequest is an archive request a user made, with the state
+// of it's url
+type DashboardArchiveRequest struct {
+	Id      int64     `json:"id"`
+	Created time.Time `json:"created"`
+	Url     string    `json:"url"`
+	// status of the latest capture, 0 if it hasn't been captured
+	Status   int        `json:"status"`
+	Captured *time.Time `json:"captured,omitempty"`
+	Hash     string     `json:"hash"`
+}
+
+// Announcement is a notice shown on the dashboard
+type Announcement struct {
+	// one of ["notice","maintenance"]
+	Kind    string     `json:"kind"`
+	Message string     `json:"message"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// dashboardRequest says which sections to assemble, for whom
+type dashboardRequest struct {
+	svc     *Service
+	keyId   string
+	v       *Visibility
+	omitted map[string]bool
+}
+
+// dashboardSection assembles a section. list sections return cap+1 items at
+// most so truncation can be detected
+type dashboardSection func(r *dashboardRequest, cap int) (interface{}, int, error)
+
+// dashboardSections assemble each section
+var dashboardSections = map[string]dashboardSection{
+	dashboardRecentArchives: dashboardRecent,
+	dashboardPopularUrls:    dashboardPopular,
+	dashboardStats:          dashboardStatsSection,
+	dashboardWatchlist:      dashboardWatchlistSection,
+	dashboardArchives:       dashboardArchiveRequests,
+	dashboardAnnouncements:  dashboardAnnouncementsSection,
+}
+
+// assembleDashboard builds every section that isn't omitted concurrently
+func assembleDashboard(r *dashboardRequest) *Dashboard {
+	d := &Dashboard{Version: dashboardVersion, Personalized: r.keyId != "", Sections: map[string]*DashboardSection{}}
+
+	names := make([]string, 0, len(r.svc.DashboardSections))
+	for name := range r.svc.DashboardSections {
+		if r.omitted[name] || (dashboardPersonal[name] && r.keyId == "") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			section := assembleSection(r, name)
+			lock.Lock()
+			d.Sections[name] = section
+			lock.Unlock()
+		}(name)
+	}
+	wg.Wait()
+	return d
+}
+
+// assembleSection builds a single section, isolating errors & capping how long it takes
+func assembleSection(r *dashboardRequest, name string) *DashboardSection {
+	type result struct {
+		data interface{}
+		n    int
+		err  error
+	}
+	cap := dashboardCaps[name]
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{err: fmt.Errorf("%v", p)}
+			}
+		}()
+		data, n, err := r.svc.DashboardSections[name](r, cap)
+		done <- result{data, n, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			r.svc.Log.Infof("error assembling dashboard %s: %s", name, res.err.Error())
+			return &DashboardSection{Error: res.err.Error()}
+		}
+		return &DashboardSection{Data: res.data, Truncated: cap > 0 && res.n > cap}
+	case <-time.After(dashboardSectionTimeout):
+		r.svc.Log.Infof("dashboard %s timed out", name)
+		return &DashboardSection{Error: fmt.Sprintf("%s took too long", name)}
+	}
+}
+
+// dashboardRecent lists recently captured urls
+func dashboardRecent(r *dashboardRequest, cap int) (interface{}, int, error) {
+	urls, err := core.ContentUrls(r.svc.DB, cap+1, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	urls = unsuppressed(r.v.Urls(urls))
+	n := len(urls)
+	if n > cap {
+		urls = urls[:cap]
+	}
+	return urls, n, nil
+}
+
+// dashboardPopular lists the urls with the most recent archive requests
+func dashboardPopular(r *dashboardRequest, cap int) (interface{}, int, error) {
+	rows, err := r.svc.DB.Query(`select r.url, coalesce(u.title, ''), coalesce(u.hash, ''), count(1) as requests
+		from archive_requests r left join urls u on u.url = r.url
+		where r.created > $1 group by r.url, u.title, u.hash order by requests desc, r.url limit $2`,
+		r.svc.Clock().Add(-dashboardPopularWindow).In(time.UTC), cap+1)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	popular := []*PopularUrl{}
+	for rows.Next() {
+		p := &PopularUrl{}
+		if err := rows.Scan(&p.Url, &p.Title, &p.Hash, &p.Requests); err != nil {
+			return nil, 0, err
+		}
+		if r.v.Url(p.Url) {
+			popular = append(popular, p)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	n := len(popular)
+	if n > cap {
+		popular = popular[:cap]
+	}
+	return popular, n, nil
+}
+
+// dashboardStatsCache holds the last archive stats counted, they're the same for everyone
+type dashboardStatsCache struct {
+	sync.Mutex
+	stats *DashboardStats
+}
+
+// statsCache is the package-level dashboard stats cache
+var statsCache = &dashboardStatsCache{}
+
+// dashboardStatsSection counts the archive, reusing counts for dashboardStatsTTL
+func dashboardStatsSection(r *dashboardRequest, cap int) (interface{}, int, error) {
+	now, cache := r.svc.Clock(), r.svc.DashboardStats
+	cache.Lock()
+	defer cache.Unlock()
+	if s := cache.stats; s != nil && now.Sub(s.Counted) < dashboardStatsTTL {
+		return s, 0, nil
+	}
+
+	s := &DashboardStats{Counted: now.Round(time.Second).In(time.UTC)}
+	err := r.svc.DB.QueryRow(`select
+		(select count(1) from urls),
+		(select count(1) from urls where hash != ''),
+		(select count(1) from sources where coalesce(deleted, false) = false),
+		(select count(1) from urls where last_get > $1)`, now.Add(-24*time.Hour).In(time.UTC)).Scan(&s.Urls, &s.Captured, &s.Sources, &s.CapturedToday)
+	if err != nil {
+		return nil, 0, err
+	}
+	cache.stats = s
+	return s, 0, nil
+}
+
+// dashboardWatchlistSection lists the requester's saved searches
+func dashboardWatchlistSection(r *dashboardRequest, cap int) (interface{}, int, error) {
+	if r.svc.Config == nil || r.svc.Config.SavedSearchesPerUser <= 0 {
+		return nil, 0, ErrSavedSearchesDisabled
+	}
+	searches, err := ReadSavedSearches(r.svc.DB, r.keyId)
+	if err != nil {
+		return nil, 0, err
+	}
+	n := len(searches)
+	if n > cap {
+		searches = searches[:cap]
+	}
+	return searches, n, nil
+}
+
+// dashboardArchiveRequests lists the requester's archive requests, newest
+// first, including ones made with their api keys
+func dashboardArchiveRequests(r *dashboardRequest, cap int) (interface{}, int, error) {
+	rows, err := r.svc.DB.Query(`select r.id, r.created, r.url, coalesce(u.status, 0), u.last_get, coalesce(u.hash, '')
+		from archive_requests r left join urls u on u.url = r.url
+		where r.user_id = $1 or r.requester in (select id::text from api_keys where key_id = $1)
+		order by r.created desc, r.id desc limit $2`, r.keyId, cap+1)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	reqs := []*DashboardArchiveRequest{}
+	for rows.Next() {
+		req := &DashboardArchiveRequest{}
+		if err := rows.Scan(&req.Id, &req.Created, &req.Url, &req.Status, &req.Captured, &req.Hash); err != nil {
+			return nil, 0, err
+		}
+		if r.v.Url(req.Url) {
+			reqs = append(reqs, req)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	n := len(reqs)
+	if n > cap {
+		reqs = reqs[:cap]
+	}
+	return reqs, n, nil
+}
+
+// dashboardAnnouncementsSection lists configured announcements, after any maintenance underway
+func dashboardAnnouncementsSection(r *dashboardRequest, cap int) (interface{}, int, error) {
+	announcements := []*Announcement{}
+	if s := maintenance.Status(); s != nil {
+		until := s.Until
+		announcements = append(announcements, &Announcement{Kind: "maintenance", Message: s.Reason, Until: &until})
+	}
+	if r.svc.Config != nil {
+		for _, msg := range r.svc.Config.Announcements {
+			announcements = append(announcements, &Announcement{Kind: "notice", Message: msg})
+		}
+	}
+	n := len(announcements)
+	if n > cap {
+		announcements = announcements[:cap]
+	}
+	return announcements, n, nil
+}
+
+// DashboardAction assembles the landing dashboard. sections listed in omit
+// aren't assembled, so clients only pay for what they render
+type DashboardAction struct {
+	ReqAction
+	clientAction
+	Omit []string `json:"omit"`
+}
+
+func (DashboardAction) Type() string        { return "DASHBOARD_REQUEST" }
+func (DashboardAction) SuccessType() string { return "DASHBOARD_SUCCESS" }
+func (DashboardAction) FailureType() string { return "DASHBOARD_FAILURE" }
+
+func (DashboardAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &DashboardAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *DashboardAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+	svc := a.client.service()
+	omitted := map[string]bool{}
+	for _, name := range a.Omit {
+		if _, ok := svc.DashboardSections[name]; !ok {
+			return &ClientResponse{
+				Type:      a.FailureType(),
+				RequestId: a.RequestId,
+				Error:     fmt.Sprintf("%s: %s", ErrUnknownDashboardSection, name),
+			}
+		}
+		omitted[name] = true
+	}
+
+	keyId := a.client.requester()
+	v, err := loadVisibility(svc.DB, a.client.identity(), svc.Clock())
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	d := assembleDashboard(&dashboardRequest{svc: svc, keyId: keyId, v: v, omitted: omitted})
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "DASHBOARD",
+		Data:      d,
+		personal:  d.Personalized,
+	}
+}
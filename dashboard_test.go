@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAssembleDashboardIsolation(t *testing.T) {
+	svc := NewService(nil, nil, &config{Announcements: []string{"a", "b", "c", "d", "e", "f"}})
+	svc.DashboardSections = map[string]dashboardSection{
+		dashboardAnnouncements: dashboardAnnouncementsSection,
+		dashboardPopularUrls: func(r *dashboardRequest, cap int) (interface{}, int, error) {
+			return nil, 0, fmt.Errorf("database is gone")
+		},
+		dashboardRecentArchives: func(r *dashboardRequest, cap int) (interface{}, int, error) {
+			panic("recent archives broke")
+		},
+		dashboardWatchlist: dashboardWatchlistSection,
+		dashboardStats: func(r *dashboardRequest, cap int) (interface{}, int, error) {
+			return &DashboardStats{Urls: 1}, 0, nil
+		},
+	}
+
+	d := assembleDashboard(&dashboardRequest{svc: svc, omitted: map[string]bool{dashboardStats: true}})
+	if d.Version != dashboardVersion || d.Personalized {
+		t.Errorf("expected an anonymous version %d dashboard, got: %d %t", dashboardVersion, d.Version, d.Personalized)
+	}
+
+	// personal sections aren't assembled for anonymous requests, & omitted ones never are
+	if len(d.Sections) != 3 {
+		data, _ := json.Marshal(d.Sections)
+		t.Errorf("expected 3 sections, got: %s", data)
+	}
+	if s := d.Sections[dashboardPopularUrls]; s == nil || s.Error != "database is gone" {
+		t.Errorf("expected failing section to report it's error, got: %#v", s)
+	}
+	if s := d.Sections[dashboardRecentArchives]; s == nil || s.Error != "recent archives broke" {
+		t.Errorf("expected panicking section to report an error, got: %#v", s)
+	}
+	s := d.Sections[dashboardAnnouncements]
+	if s == nil || s.Error != "" || !s.Truncated {
+		t.Fatalf("expected announcements past the cap to be truncated, got: %#v", s)
+	}
+	if n := len(s.Data.([]*Announcement)); n != dashboardCaps[dashboardAnnouncements] {
+		t.Errorf("expected %d announcements, got: %d", dashboardCaps[dashboardAnnouncements], n)
+	}
+
+	d = assembleDashboard(&dashboardRequest{svc: svc, keyId: "key", omitted: map[string]bool{}})
+	if !d.Personalized || d.Sections[dashboardWatchlist] == nil || d.Sections[dashboardWatchlist].Error != ErrSavedSearchesDisabled.Error() {
+		t.Errorf("expected personal sections for requests with a key id, got: %#v", d.Sections[dashboardWatchlist])
+	}
+}
+
+func TestDashboardAction(t *testing.T) {
+	defer resetTestData(appDB, "urls", "archive_requests", "api_keys")
+
+	const key = "a1b2c3"
+	now := time.Now()
+	if _, err := appDB.Exec(`insert into urls (url,created,updated,last_get,status,hash) values
+		('http://www.epa.gov/a', $1, $1, $1, 200, '1220a'),
+		('http://www.epa.gov/b', $1, $1, null, 0, '')`, now); err != nil {
+		t.Fatal(err.Error())
+	}
+	apiKey, _, err := CreateApiKey(appDB, key, "ci", []string{apiScopeArchive}, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into archive_requests (created,url,user_id,requester) values
+		($1, 'http://www.epa.gov/a', '', 'ip'),
+		($1, 'http://www.epa.gov/a', $2, ''),
+		($1, 'http://www.epa.gov/b', '', $3)`, now, key, apiKey.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	svc := newTestService()
+	client := &Client{svc: svc}
+	exec := func(data string) (*ClientResponse, *Dashboard) {
+		a := DashboardAction{}.Parse("req", json.RawMessage(data))
+		a.(ClientBoundAction).SetClient(client)
+		res := a.Exec()
+		d, _ := res.Data.(*Dashboard)
+		return res, d
+	}
+
+	res, d := exec(`{}`)
+	if res.Error != "" || d == nil {
+		t.Fatalf("expected a dashboard, got: %s", res.Error)
+	}
+	if res.personal || d.Personalized || d.Sections[dashboardArchives] != nil {
+		t.Errorf("expected anonymous dashboards not to be personal")
+	}
+	popular, _ := d.Sections[dashboardPopularUrls].Data.([]*PopularUrl)
+	if len(popular) != 2 || popular[0].Url != "http://www.epa.gov/a" || popular[0].Requests != 2 || popular[0].Hash != "1220a" {
+		data, _ := json.Marshal(popular)
+		t.Errorf("expected epa.gov/a to be most popular, got: %s", data)
+	}
+	stats, _ := d.Sections[dashboardStats].Data.(*DashboardStats)
+	if stats == nil || stats.Urls != 2 || stats.Captured != 1 || stats.CapturedToday != 1 {
+		t.Errorf("expected 2 urls, 1 captured today, got: %#v", stats)
+	}
+
+	client.setKeyId(key)
+	res, d = exec(`{"omit":["popularUrls","stats","recentArchives"]}`)
+	if !res.personal || !d.Personalized || len(d.Sections) != 3 {
+		data, _ := json.Marshal(d)
+		t.Errorf("expected a personal dashboard with 3 sections, got: %s", data)
+	}
+	// archive requests made with the user's api keys are theirs too
+	reqs, _ := d.Sections[dashboardArchives].Data.([]*DashboardArchiveRequest)
+	if len(reqs) != 2 {
+		t.Errorf("expected 2 archive requests, got: %d", len(reqs))
+	}
+
+	if res, _ = exec(`{"omit":["weather"]}`); res.Type != (DashboardAction{}).FailureType() {
+		t.Errorf("expected omitting an unknown section to fail, got: %s", res.Type)
+	}
+}
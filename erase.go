@@ -0,0 +1,539 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// EraseMode is how a user's contributions are erased
+type EraseMode string
+
+const (
+	// EraseSuppress removes a user's contributions. Metadata blocks are kept as
+	// deleted, empty rows so chains that reference them stay intact
+	EraseSuppress EraseMode = "suppress"
+	// EraseAnonymize keeps a user's contributions, replacing their id with a
+	// pseudonym that can't be traced back to them. a metadata block's hash
+	// covers it's key id, so anonymized blocks can't be verified anymore. their
+	// pseudonym marks them as erased, & verifiers skip them
+	EraseAnonymize EraseMode = "anonymize"
+)
+
+// pseudonymPrefix starts the pseudonyms anonymized rows are attributed to.
+// metadata can't be written with a key id that has it, so a block that has
+// one was anonymized by an erasure
+const pseudonymPrefix = "anonymous:"
+
+// ErrReservedKeyId is returned writing metadata with a pseudonym as it's key id
+var ErrReservedKeyId = fmt.Errorf("key ids starting with %s are reserved for erased contributions", pseudonymPrefix)
+
+const (
+	eraseRunning  = "running"
+	eraseComplete = "complete"
+	eraseFailed   = "failed"
+
+	// rows changed per transaction
+	eraseBatchSize = 500
+	// reason recorded on metadata suppressed by an erasure
+	eraseDeletedReason = "erased at user request"
+)
+
+// eraseConfirmSecret keys confirmation tokens. tokens don't survive a restart
+var eraseConfirmSecret = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// EraseReport records an erasure & the rows it changed in each table. Reports
+// are kept in erase_jobs as evidence the erasure happened
+type EraseReport struct {
+	Id       string     `json:"id"`
+	Created  time.Time  `json:"created"`
+	Updated  time.Time  `json:"updated"`
+	Finished *time.Time `json:"finished,omitempty"`
+	UserId   string     `json:"userId"`
+	Mode     EraseMode  `json:"mode"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	// index of the step in eraseSteps being worked on, for resuming
+	Step int `json:"step"`
+	// rows changed per table
+	Counts map[string]int64 `json:"counts"`
+}
+
+// pseudonym replaces the user's id in anonymized rows. it's derived from the
+// erasure, not the user, so it can't be traced back to them
+func (r *EraseReport) pseudonym() string {
+	return pseudonymPrefix + r.Id
+}
+
+// erasedKeyId reports weather a key id is the pseudonym of an anonymized user
+func erasedKeyId(keyId string) bool {
+	return strings.HasPrefix(keyId, pseudonymPrefix)
+}
+
+// eraseStep changes one batch of a user's rows in a table, returning the
+// number of rows changed & any subjects whose metadata changed
+type eraseStep struct {
+	table string
+	batch func(tx *sql.Tx, r *EraseReport) (int64, []string, error)
+}
+
+// eraseSteps are run in order. Each table a user's contributions live in has
+// a step, collection items come before the collections they belong to & rows
+// found through a user's api keys come before the keys
+var eraseSteps = []eraseStep{
+	{"metadata", eraseMetadata},
+	{"relations", eraseRelations},
+	{"archive_requests", eraseArchiveRequests},
+	{"collection_items", eraseCollectionItems},
+	{"collections", eraseCollections},
+	{"saved_searches", eraseSavedSearches},
+	{"user_actions", eraseUserActions},
+	{"capture_notes", eraseCaptureNotes},
+	{"api_key_log", eraseApiKeyLog},
+	{"hook_archives", eraseHookArchives},
+	{"api_keys", eraseApiKeys},
+}
+
+func eraseMetadata(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if r.Mode == EraseSuppress {
+		// hash & prev are left in place so later blocks still chain
+		rows, err = tx.Query(`update metadata set deleted = true, deleted_reason = $2, meta = null
+			where hash in (select hash from metadata where key_id = $1 and (deleted = false or meta is not null) limit $3) returning subject`,
+			r.UserId, eraseDeletedReason, eraseBatchSize)
+	} else {
+		rows, err = tx.Query("update metadata set key_id = $2 where hash in (select hash from metadata where key_id = $1 limit $3) returning subject",
+			r.UserId, r.pseudonym(), eraseBatchSize)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		count    int64
+		subjects []string
+	)
+	for rows.Next() {
+		var subject string
+		if err := rows.Scan(&subject); err != nil {
+			return 0, nil, err
+		}
+		count++
+		subjects = append(subjects, subject)
+	}
+	return count, subjects, rows.Err()
+}
+
+func eraseRelations(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	if r.Mode == EraseSuppress {
+		res, err = tx.Exec("delete from relations where (subject, relation, target, key_id) in (select subject, relation, target, key_id from relations where key_id = $1 limit $2)",
+			r.UserId, eraseBatchSize)
+	} else {
+		res, err = tx.Exec("update relations set key_id = $2 where (subject, relation, target, key_id) in (select subject, relation, target, key_id from relations where key_id = $1 limit $3)",
+			r.UserId, r.pseudonym(), eraseBatchSize)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+func eraseArchiveRequests(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	replacement := ""
+	if r.Mode == EraseAnonymize {
+		replacement = r.pseudonym()
+	}
+	res, err := tx.Exec("update archive_requests set user_id = $2 where id in (select id from archive_requests where user_id = $1 limit $3)",
+		r.UserId, replacement, eraseBatchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+func eraseCollectionItems(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	// anonymized collections keep their items
+	if r.Mode == EraseAnonymize {
+		return 0, nil, nil
+	}
+	res, err := tx.Exec(`delete from collection_items where (collection_id, url_id) in (
+		select ci.collection_id, ci.url_id from collection_items ci join collections c on c.id = ci.collection_id where c.creator = $1 limit $2)`,
+		r.UserId, eraseBatchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+func eraseCollections(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	if r.Mode == EraseSuppress {
+		res, err = tx.Exec("delete from collections where id in (select id from collections where creator = $1 limit $2)", r.UserId, eraseBatchSize)
+	} else {
+		res, err = tx.Exec("update collections set creator = $2 where id in (select id from collections where creator = $1 limit $3)", r.UserId, r.pseudonym(), eraseBatchSize)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+// saved searches are private to their owner, so they're removed in both modes.
+// their matches go with them
+func eraseSavedSearches(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	res, err := tx.Exec("delete from saved_searches where id in (select id from saved_searches where owner = $1 limit $2)", r.UserId, eraseBatchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+// the action log records what a user did, not what they contributed, so it's
+// removed in both modes
+func eraseUserActions(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	res, err := tx.Exec("delete from user_actions where id in (select id from user_actions where user_id = $1 limit $2)", r.UserId, eraseBatchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+func eraseCaptureNotes(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	if r.Mode == EraseSuppress {
+		res, err = tx.Exec("delete from capture_notes where id in (select id from capture_notes where author = $1 limit $2)", r.UserId, eraseBatchSize)
+	} else {
+		res, err = tx.Exec("update capture_notes set author = $2 where id in (select id from capture_notes where author = $1 limit $3)", r.UserId, r.pseudonym(), eraseBatchSize)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+// api key logs record what a user's keys did, so they're removed in both modes
+func eraseApiKeyLog(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	res, err := tx.Exec(`delete from api_key_log where id in (select id from api_key_log
+		where api_key_id in (select id::text from api_keys where key_id = $1) limit $2)`, r.UserId, eraseBatchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+// archive hook requests keep the callbacks a user's keys asked for, they're
+// removed in both modes. the archive requests they made are erased with the rest
+func eraseHookArchives(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	res, err := tx.Exec(`delete from hook_archives where (api_key_id, idempotency_key) in (select api_key_id, idempotency_key from hook_archives
+		where api_key_id in (select id::text from api_keys where key_id = $1) limit $2)`, r.UserId, eraseBatchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+// api keys act as the user, so they're removed in both modes
+func eraseApiKeys(tx *sql.Tx, r *EraseReport) (int64, []string, error) {
+	res, err := tx.Exec("delete from api_keys where id in (select id from api_keys where key_id = $1 limit $2)", r.UserId, eraseBatchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := res.RowsAffected()
+	return count, nil, err
+}
+
+// EraseUserData removes (EraseSuppress) or anonymizes (EraseAnonymize) everything
+// attributed to userId: metadata blocks signed with it as their key id, the
+// relations they assert, archive requests & collections. Rows are changed in
+// batched transactions, each of which also saves progress, so calling
+// EraseUserData again after an interruption picks up where the last call stopped
+func EraseUserData(db *sql.DB, userId string, mode EraseMode) (*EraseReport, error) {
+	if userId == "" {
+		return nil, fmt.Errorf("userId is required")
+	}
+	if mode != EraseSuppress && mode != EraseAnonymize {
+		return nil, fmt.Errorf("invalid erase mode: %s", mode)
+	}
+	if err := maintenance.Check(); err != nil {
+		return nil, err
+	}
+
+	r, err := readRunningErasure(db, userId, mode)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		now := time.Now().Round(time.Second).In(time.UTC)
+		r = &EraseReport{Id: uuid.New(), Created: now, Updated: now, UserId: userId, Mode: mode, Status: eraseRunning, Counts: map[string]int64{}}
+		if _, err := db.Exec("insert into erase_jobs (id,created,updated,user_id,mode,status,step,counts) values ($1, $2, $2, $3, $4, $5, 0, '{}')",
+			r.Id, r.Created, r.UserId, string(r.Mode), r.Status); err != nil {
+			return nil, checkWriteErr(err)
+		}
+	}
+
+	if err := r.run(db); err != nil {
+		r.Status = eraseFailed
+		r.Error = err.Error()
+		// erasures interrupted by maintenance stay running so they can be resumed
+		if err != ErrMaintenanceMode {
+			if err := r.save(db); err != nil {
+				log.Info(err.Error())
+			}
+		}
+		return r, err
+	}
+	return r, nil
+}
+
+// readRunningErasure reads an unfinished erasure for a user & mode, nil if there isn't one
+func readRunningErasure(db *sql.DB, userId string, mode EraseMode) (*EraseReport, error) {
+	r := &EraseReport{}
+	var counts []byte
+	err := db.QueryRow("select id, created, updated, user_id, mode, status, step, counts from erase_jobs where user_id = $1 and mode = $2 and status = $3",
+		userId, string(mode), eraseRunning).Scan(&r.Id, &r.Created, &r.Updated, &r.UserId, &r.Mode, &r.Status, &r.Step, &counts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(counts, &r.Counts)
+	return r, err
+}
+
+// run works through the remaining steps a batch at a time
+func (r *EraseReport) run(db *sql.DB) error {
+	for r.Step < len(eraseSteps) {
+		step := eraseSteps[r.Step]
+		count, subjects, err := r.batch(db, step)
+		if err != nil {
+			return err
+		}
+		// metadata changed, drop cached reads & consensus
+		for _, subject := range subjects {
+			publishEvent(&Event{Type: EventMetadataDeleted, Subject: subject})
+		}
+		if count < eraseBatchSize {
+			r.Step++
+		}
+	}
+
+	finished := time.Now().Round(time.Second).In(time.UTC)
+	r.Finished = &finished
+	r.Status = eraseComplete
+	return r.save(db)
+}
+
+// batch runs one batch of a step, saving progress in the same transaction
+func (r *EraseReport) batch(db *sql.DB, step eraseStep) (int64, []string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, checkWriteErr(err)
+	}
+	defer tx.Rollback()
+
+	count, subjects, err := step.batch(tx, r)
+	if err != nil {
+		return 0, nil, checkWriteErr(err)
+	}
+
+	next := r.Step
+	if count < eraseBatchSize {
+		next++
+	}
+	counts := map[string]int64{}
+	for k, v := range r.Counts {
+		counts[k] = v
+	}
+	counts[step.table] += count
+
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return 0, nil, err
+	}
+	updated := time.Now().Round(time.Second).In(time.UTC)
+	if _, err := tx.Exec("update erase_jobs set updated = $2, step = $3, counts = $4 where id = $1", r.Id, updated, next, data); err != nil {
+		return 0, nil, checkWriteErr(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, checkWriteErr(err)
+	}
+
+	r.Counts = counts
+	r.Updated = updated
+	return count, subjects, nil
+}
+
+func (r *EraseReport) save(db *sql.DB) error {
+	r.Updated = time.Now().Round(time.Second).In(time.UTC)
+	counts, err := json.Marshal(r.Counts)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("update erase_jobs set updated = $2, finished = $3, status = $4, error = $5, step = $6, counts = $7 where id = $1",
+		r.Id, r.Updated, r.Finished, r.Status, r.Error, r.Step, counts)
+	return checkWriteErr(err)
+}
+
+// resumeErasures finishes running erasures that haven't been updated in
+// jobStaleAfter, which happens when the instance running them stops
+func resumeErasures(db *sql.DB) {
+	for {
+		userId, mode, err := claimStaleErasure(db, time.Now().Round(time.Second).In(time.UTC))
+		if err == sql.ErrNoRows {
+			return
+		} else if err != nil {
+			log.Infof("error reading erase jobs: %s", err.Error())
+			return
+		}
+		if _, err := EraseUserData(db, userId, mode); err != nil {
+			log.Infof("error resuming erasure: %s", err.Error())
+		}
+	}
+}
+
+// claimStaleErasure claims one stale erasure by updating it, so only one
+// instance resumes it. erasures are claimed one at a time so the rest don't
+// go stale again while waiting
+func claimStaleErasure(db *sql.DB, now time.Time) (userId string, mode EraseMode, err error) {
+	err = db.QueryRow("update erase_jobs set updated = $1 where id = (select id from erase_jobs where status = $2 and updated < $3 limit 1) and updated < $3 returning user_id, mode",
+		now, eraseRunning, now.Add(-jobStaleAfter)).Scan(&userId, &mode)
+	return
+}
+
+// eraseConfirmToken is the token an admin must echo back to run an erasure.
+// tokens are tied to the user & mode & expire within two hours
+func eraseConfirmToken(userId string, mode EraseMode, at time.Time) string {
+	mac := hmac.New(sha256.New, eraseConfirmSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", userId, mode, at.Truncate(time.Hour).Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validEraseConfirmToken(token, userId string, mode EraseMode) bool {
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(-time.Hour)} {
+		if hmac.Equal([]byte(token), []byte(eraseConfirmToken(userId, mode, at))) {
+			return true
+		}
+	}
+	return false
+}
+
+// EraseUserDataHandler erases a user's contributions. A request without a
+// confirmation token returns one, along with how many rows would change.
+// Sending the token back runs the erasure & returns it's report
+func EraseUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminConfigured(w) {
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := struct {
+		UserId  string    `json:"userId"`
+		Mode    EraseMode `json:"mode"`
+		Confirm string    `json:"confirm"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.UserId == "" || (req.Mode != EraseSuppress && req.Mode != EraseAnonymize) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "userId & a mode of suppress or anonymize are required"})
+		return
+	}
+
+	if req.Confirm == "" {
+		preview, err := eraseCounts(appDB, req.UserId)
+		if err != nil {
+			log.Info(err.Error())
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"confirm": eraseConfirmToken(req.UserId, req.Mode, time.Now()),
+			"counts":  preview,
+		})
+		return
+	}
+	if !validEraseConfirmToken(req.Confirm, req.UserId, req.Mode) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "invalid or expired confirmation token"})
+		return
+	}
+
+	report, err := EraseUserData(appDB, req.UserId, req.Mode)
+	if err == ErrMaintenanceMode {
+		writeMaintenanceError(w)
+		return
+	} else if err != nil {
+		log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "report": report})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// eraseCounts counts the rows attributed to a user in each table an erasure touches
+func eraseCounts(db *sql.DB, userId string) (map[string]int64, error) {
+	queries := map[string]string{
+		"metadata":         "select count(1) from metadata where key_id = $1",
+		"relations":        "select count(1) from relations where key_id = $1",
+		"archive_requests": "select count(1) from archive_requests where user_id = $1",
+		"collection_items": "select count(1) from collection_items ci join collections c on c.id = ci.collection_id where c.creator = $1",
+		"collections":      "select count(1) from collections where creator = $1",
+		"saved_searches":   "select count(1) from saved_searches where owner = $1",
+		"user_actions":     "select count(1) from user_actions where user_id = $1",
+		"capture_notes":    "select count(1) from capture_notes where author = $1",
+		"api_key_log":      "select count(1) from api_key_log where api_key_id in (select id::text from api_keys where key_id = $1)",
+		"hook_archives":    "select count(1) from hook_archives where api_key_id in (select id::text from api_keys where key_id = $1)",
+		"api_keys":         "select count(1) from api_keys where key_id = $1",
+	}
+	counts := map[string]int64{}
+	for table, q := range queries {
+		var count int64
+		if err := db.QueryRow(q, userId).Scan(&count); err != nil {
+			return nil, err
+		}
+		counts[table] = count
+	}
+	return counts, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestEraseConfirmToken(t *testing.T) {
+	token := eraseConfirmToken("key", EraseSuppress, time.Now())
+
+	cases := []struct {
+		token  string
+		userId string
+		mode   EraseMode
+		valid  bool
+	}{
+		{token, "key", EraseSuppress, true},
+		{token, "other", EraseSuppress, false},
+		{token, "key", EraseAnonymize, false},
+		{eraseConfirmToken("key", EraseSuppress, time.Now().Add(-time.Hour)), "key", EraseSuppress, true},
+		{eraseConfirmToken("key", EraseSuppress, time.Now().Add(-3*time.Hour)), "key", EraseSuppress, false},
+		{"", "key", EraseSuppress, false},
+	}
+
+	for i, c := range cases {
+		if got := validEraseConfirmToken(c.token, c.userId, c.mode); got != c.valid {
+			t.Errorf("case %d valid mismatch. expected: %t, got: %t", i, c.valid, got)
+		}
+	}
+}
+
+func TestEraseUserData(t *testing.T) {
+	defer resetTestData(appDB, "metadata", "archive_requests", "collections", "collection_items", "erase_jobs", "relations", "api_keys", "api_key_log", "hook_archives", "capture_notes")
+
+	if _, err := appDB.Exec(`insert into metadata (hash,time_stamp,key_id,subject,prev,meta,deleted) values
+		('a', '2017-01-01 00:00:01', 'erased', 'subject', '', '{"title":"EPA"}', false),
+		('b', '2017-01-01 00:00:02', 'erased', 'subject', 'a', '{"title":"EPA!"}', false),
+		('c', '2017-01-01 00:00:01', 'kept', 'subject', '', '{"title":"EPA"}', false)`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into archive_requests (url,user_id) values ('http://epa.gov', 'erased'), ('http://epa.gov', 'kept')`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into collections (id,created,updated,creator) values
+		('5f1c2b3a-4d5e-4f60-8a7b-9c0d1e2f3a4b', '2017-01-01 00:00:01', '2017-01-01 00:00:01', 'erased');
+		insert into collection_items (collection_id,url_id) values ('5f1c2b3a-4d5e-4f60-8a7b-9c0d1e2f3a4b', 'url')`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into api_keys (id,created,key_id,token_hash) values
+		('0c6d1b1e-3f0a-4b4e-9a55-2f1d7c3e8a01', '2017-01-01 00:00:01', 'erased', 'erased_token'),
+		('0c6d1b1e-3f0a-4b4e-9a55-2f1d7c3e8a02', '2017-01-01 00:00:01', 'kept', 'kept_token');
+		insert into api_key_log (created,api_key_id,action,allowed) values
+		('2017-01-01 00:00:01', '0c6d1b1e-3f0a-4b4e-9a55-2f1d7c3e8a01', 'URL_FETCH_REQUEST', true),
+		('2017-01-01 00:00:01', '0c6d1b1e-3f0a-4b4e-9a55-2f1d7c3e8a02', 'URL_FETCH_REQUEST', true);
+		insert into hook_archives (api_key_id,idempotency_key,created,url,callback,archive_request_id) values
+		('0c6d1b1e-3f0a-4b4e-9a55-2f1d7c3e8a01', 'once', '2017-01-01 00:00:01', 'http://epa.gov', 'https://example.com/done', 1)`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into capture_notes (id,created,capture,author,text) values
+		('4b0f9d2e-7a1c-4e3b-8f5d-6c2a1e0b9d01', '2017-01-01 00:00:01', 'capture', 'erased', 'cookie banner'),
+		('4b0f9d2e-7a1c-4e3b-8f5d-6c2a1e0b9d02', '2017-01-01 00:00:01', 'capture', 'kept', 'partial content')`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r, err := EraseUserData(appDB, "erased", EraseSuppress)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Status != eraseComplete || r.Finished == nil {
+		t.Errorf("expected erasure to complete, got status: %s", r.Status)
+	}
+	expect := map[string]int64{"metadata": 2, "relations": 0, "archive_requests": 1, "collection_items": 1, "collections": 1, "capture_notes": 1, "api_key_log": 1, "hook_archives": 1, "api_keys": 1}
+	for table, count := range expect {
+		if r.Counts[table] != count {
+			t.Errorf("%s count mismatch. expected: %d, got: %d", table, count, r.Counts[table])
+		}
+	}
+
+	remaining, err := eraseCounts(appDB, "erased")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// suppressed metadata keeps it's rows so chains stay intact
+	for table, count := range remaining {
+		if table != "metadata" && count != 0 {
+			t.Errorf("expected no %s left for erased user, got: %d", table, count)
+		}
+	}
+	var live int
+	if err := appDB.QueryRow("select count(1) from metadata where key_id = 'erased' and (deleted = false or meta is not null)").Scan(&live); err != nil {
+		t.Fatal(err.Error())
+	}
+	if live != 0 {
+		t.Errorf("expected erased metadata to be suppressed, %d blocks remain", live)
+	}
+
+	kept, err := eraseCounts(appDB, "kept")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if kept["metadata"] != 1 || kept["archive_requests"] != 1 || kept["capture_notes"] != 1 || kept["api_keys"] != 1 || kept["api_key_log"] != 1 {
+		t.Errorf("expected other users to be untouched, got: %v", kept)
+	}
+
+	// the report is stored
+	var status string
+	if err := appDB.QueryRow("select status from erase_jobs where id = $1", r.Id).Scan(&status); err != nil {
+		t.Fatal(err.Error())
+	}
+	if status != eraseComplete {
+		t.Errorf("expected stored report to be complete, got: %s", status)
+	}
+}
+
+func TestEraseAnonymize(t *testing.T) {
+	defer resetTestData(appDB, "metadata", "erase_jobs", "relations")
+
+	blocks := testChain(t, "EPA", "EPA!")
+	for _, m := range blocks {
+		m.KeyId = "anonymized"
+		m.Hash, _ = metadataHash(m)
+	}
+	blocks[1].Prev = blocks[0].Hash
+	blocks[1].Hash, _ = metadataHash(blocks[1])
+	for _, m := range blocks {
+		if _, err := importMetadataBlock(appDB, m); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	r, err := EraseUserData(appDB, "anonymized", EraseAnonymize)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Counts["metadata"] != 2 {
+		t.Errorf("expected 2 blocks anonymized, got: %d", r.Counts["metadata"])
+	}
+
+	// anonymized blocks are skipped by verifiers rather than failing them
+	v, err := VerifyMetadata(appDB, "", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(v.Mismatches) != 0 || v.Checked != 0 {
+		t.Errorf("expected anonymized blocks to be skipped, got %d checked & mismatches: %v", v.Checked, v.Mismatches)
+	}
+	m, err := scanMetadata(appDB.QueryRow("select "+metadataCols.String()+" from metadata where hash = $1", blocks[0].Hash))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if badge, _ := metadataBadge(m); m.KeyId != r.pseudonym() || badge != badgeErased {
+		t.Errorf("expected an erased block attributed to %s, got: %s %s", r.pseudonym(), m.KeyId, badge)
+	}
+
+	// pseudonyms can't be written with
+	if err := newTestService().WriteMetadata(&core.Metadata{KeyId: r.pseudonym(), Subject: "subject", Meta: map[string]interface{}{"title": "EPA"}}); err != ErrReservedKeyId {
+		t.Errorf("expected writing as a pseudonym to be refused, got: %v", err)
+	}
+}
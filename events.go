@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+// Event types published when data changes
+const (
+	EventMetadataAdded   = "METADATA_ADDED"
+	EventMetadataDeleted = "METADATA_DELETED"
+)
+
+// eventsChannelPrefix prefixes the redis channel events are published on,
+// the full channel name is the prefix + event type
+const eventsChannelPrefix = "events."
+
+// Event is a notification that something has changed. Events are delivered to
+// in-process listeners, broadcast to connected clients, and published to redis
+// (if configured) so other instances sharing a database see them too
+type Event struct {
+	// Type of event, eg: METADATA_ADDED
+	Type string `json:"type"`
+	// Subject hash this event concerns, if any
+	Subject string `json:"subject,omitempty"`
+	// Id of the instance that published the event
+	Origin string `json:"origin"`
+	// build version of the instance that published the event
+	Version string `json:"version,omitempty"`
+	// Event payload
+	Data interface{} `json:"data,omitempty"`
+}
+
+var (
+	// instanceId uniquely identifies this process among instances sharing a db
+	instanceId = uuid.New()
+
+	// listeners for all published events, called in-process & synchronously
+	eventListeners struct {
+		sync.RWMutex
+		fns []func(e *Event)
+	}
+
+	// pool of redis connections for publishing events, nil if redis isn't configured
+	eventsPool *redis.Pool
+	// eventsListening is 1 while the redis events subscription is live
+	eventsListening int32
+	// events being published to redis
+	eventsPublishing sync.WaitGroup
+)
+
+// addEventListener registers a func to be called for every event, both local & remote.
+// listeners must be fast & must not block, they're called in the publisher's goroutine
+func addEventListener(fn func(e *Event)) {
+	eventListeners.Lock()
+	eventListeners.fns = append(eventListeners.fns, fn)
+	eventListeners.Unlock()
+}
+
+// publishEvent publishes an event from the default service
+func publishEvent(e *Event) {
+	defaultService().publishEvent(e)
+}
+
+// publishEvent delivers an event to local listeners before returning, then
+// broadcasts it to s's clients & other instances
+func (s *Service) publishEvent(e *Event) {
+	e.Origin = instanceId
+	e.Version = buildVersion
+	s.deliverEvent(e)
+
+	if eventsPool != nil {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Infoln(err.Error())
+			return
+		}
+		eventsPublishing.Add(1)
+		go func() {
+			defer eventsPublishing.Done()
+			conn := eventsPool.Get()
+			defer conn.Close()
+			if _, err := conn.Do("PUBLISH", eventsChannelPrefix+e.Type, data); err != nil {
+				log.Infof("error publishing %s event: %s", e.Type, err.Error())
+			}
+		}()
+	}
+}
+
+// waitForEvents blocks until events being published to redis are sent
+func waitForEvents() {
+	eventsPublishing.Wait()
+}
+
+// deliverEvent calls all registered listeners & invalidates anything the event
+// changes in s's content cache, then broadcasts it to s's clients. listeners run
+// before the broadcast, so anyone told about a change reads the new state when
+// they ask for it
+func (s *Service) deliverEvent(e *Event) {
+	dispatchEvent(e)
+	if s.ContentCache != nil {
+		s.ContentCache.handleEvent(e)
+	}
+	if s.Rejections != nil {
+		s.Rejections.handleEvent(e)
+	}
+	s.broadcastEvent(e)
+}
+
+// dispatchEvent calls all registered listeners with an event
+func dispatchEvent(e *Event) {
+	eventListeners.RLock()
+	defer eventListeners.RUnlock()
+	for _, fn := range eventListeners.fns {
+		fn(e)
+	}
+}
+
+// broadcastEvent sends an event to all clients connected to the package-level room
+func broadcastEvent(e *Event) {
+	s := &Service{DB: appDB, Hub: room, Clock: time.Now}
+	s.broadcastEvent(e)
+}
+
+// broadcastEvent sends an event to all clients connected to s's hub.
+// events about content in a restricted subprimer only go to it's members
+func (s *Service) broadcastEvent(e *Event) {
+	if s.Hub == nil {
+		return
+	}
+	allow, err := broadcastAllowed(s.DB, e.Subject, s.Clock())
+	if err != nil {
+		log.Infof("error checking visibility of %s event, not broadcasting: %s", e.Type, err.Error())
+		return
+	}
+	data, err := json.Marshal(&ClientResponse{
+		Type:      e.Type,
+		RequestId: "server",
+		Schema:    "EVENT",
+		Data:      e,
+	})
+	if err != nil {
+		log.Infoln(err.Error())
+		return
+	}
+	if allow != nil {
+		s.Hub.filtered <- &filteredMessage{allow: allow, data: data}
+		return
+	}
+	s.Hub.broadcast <- data
+}
+
+// handleRemoteEvent processes an event published to redis for the default service
+func handleRemoteEvent(channel string, data []byte) {
+	defaultService().handleRemoteEvent(channel, data)
+}
+
+// handleRemoteEvent processes an event published to redis. Events this
+// instance published have already been handled & are skipped
+func (s *Service) handleRemoteEvent(channel string, data []byte) {
+	e := &Event{}
+	if err := json.Unmarshal(data, e); err != nil {
+		log.Infof("error parsing %s event: %s", channel, err.Error())
+		return
+	}
+	if e.Origin == instanceId {
+		return
+	}
+	s.deliverEvent(e)
+}
+
+// isEventChannel checks if a redis channel carries events
+func isEventChannel(channel string) bool {
+	return strings.HasPrefix(channel, eventsChannelPrefix)
+}
+
+// eventsHealthy reports weather this instance is reliably receiving events.
+// without redis there are no other instances to hear from, so local
+// delivery is all that's required
+func eventsHealthy() bool {
+	if cfg == nil || cfg.RedisUrl == "" {
+		return true
+	}
+	return atomic.LoadInt32(&eventsListening) == 1
+}
+
+// newEventsPool creates a redis connection pool for publishing events
+func newEventsPool(redisUrl string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", redisUrl,
+				redis.DialConnectTimeout(5*time.Second),
+				redis.DialWriteTimeout(5*time.Second),
+			)
+		},
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Feature flags gate protocol changes that are rolled out to a share of
+// connections before being turned on for everyone
+const (
+	// flagCoalescedFrames sends queued responses in one websocket frame,
+	// separated by newlines
+	flagCoalescedFrames = "coalescedFrames"
+)
+
+// knownFlags lists every flag code checks. flags not configured are off
+var knownFlags = []string{flagCoalescedFrames}
+
+var (
+	// featureFlagStats exposes connection, request & error counts by flag state at /debug/vars,
+	// eg: "coalescedFrames.on.errors"
+	featureFlagStats = expvar.NewMap("featureFlags")
+	// flagRollouts is the percent of connections each flag is on for, read from config
+	flagRollouts = map[string]int{}
+)
+
+// parseFlagRollouts reads flag rollouts from config in the form "name:percent"
+func parseFlagRollouts(entries []string) (map[string]int, error) {
+	rollouts := map[string]int{}
+	for _, e := range entries {
+		// config reads an unset list as [""]
+		if strings.TrimSpace(e) == "" {
+			continue
+		}
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid feature flag '%s', expected name:percent", e)
+		}
+		percent, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid feature flag '%s', percent must be between 0 & 100", e)
+		}
+		rollouts[strings.TrimSpace(parts[0])] = percent
+	}
+	return rollouts, nil
+}
+
+// readFlagRollouts reads the current rollout of every known flag. rollouts
+// in the database take precedence over config
+func readFlagRollouts(db *sql.DB) (map[string]int, error) {
+	rollouts := map[string]int{}
+	for _, name := range knownFlags {
+		rollouts[name] = flagRollouts[name]
+	}
+
+	rows, err := db.Query("select name, rollout from feature_flags")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name    string
+			rollout int
+		)
+		if err := rows.Scan(&name, &rollout); err != nil {
+			return nil, err
+		}
+		if _, ok := rollouts[name]; ok {
+			rollouts[name] = rollout
+		}
+	}
+	return rollouts, rows.Err()
+}
+
+// readFlagOverrides reads flags explicitly set for a key id
+func readFlagOverrides(db *sql.DB, keyId string) (map[string]bool, error) {
+	overrides := map[string]bool{}
+	if keyId == "" {
+		return overrides, nil
+	}
+	rows, err := db.Query("select flag, enabled from feature_flag_overrides where key_id = $1", keyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			flag    string
+			enabled bool
+		)
+		if err := rows.Scan(&flag, &enabled); err != nil {
+			return nil, err
+		}
+		overrides[flag] = enabled
+	}
+	return overrides, rows.Err()
+}
+
+// flagBucket places an id in one of 100 buckets for a flag. the same id
+// always lands in the same bucket, different flags bucket independently
+func flagBucket(flag, id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(flag + ":" + id))
+	return int(h.Sum32() % 100)
+}
+
+// evaluateFlags decides which flags are on for an id, applying overrides last
+func evaluateFlags(rollouts map[string]int, overrides map[string]bool, id string) map[string]bool {
+	flags := map[string]bool{}
+	for name, percent := range rollouts {
+		flags[name] = flagBucket(name, id) < percent
+	}
+	for name, enabled := range overrides {
+		if _, ok := flags[name]; ok {
+			flags[name] = enabled
+		}
+	}
+	return flags
+}
+
+// EvaluateFlags decides which flags are on for a connection. connections with
+// a key id are bucketed by it, so a person gets the same flags everywhere.
+// anonymous connections are bucketed by connId
+func EvaluateFlags(db *sql.DB, keyId, connId string) (map[string]bool, error) {
+	rollouts, err := readFlagRollouts(db)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := readFlagOverrides(db, keyId)
+	if err != nil {
+		return nil, err
+	}
+	id := keyId
+	if id == "" {
+		id = connId
+	}
+	return evaluateFlags(rollouts, overrides, id), nil
+}
+
+// countFlagged adds to a stat for each of a client's flags, labeled by it's state
+func countFlagged(flags map[string]bool, stat string) {
+	for name, on := range flags {
+		state := "off"
+		if on {
+			state = "on"
+		}
+		featureFlagStats.Add(name+"."+state+"."+stat, 1)
+	}
+}
+
+// HelloAction is the first request a client sends. flags are only turned on
+// for clients that say hello, older clients wouldn't know how to adapt to them.
+// the response describes the server, with a warning if the client was built
+// against a newer protocol than the server speaks. the key id a client says
+// hello with decides which restricted subprimers it can see, until the session
+// it authenticated with expires. active announcements the key hasn't dismissed
+// are sent with the response, each with it's room for the client to filter by
+type HelloAction struct {
+	ReqAction
+	clientAction
+	KeyId string `json:"keyId"`
+	// when the client's session token expires, if it has one. the client is
+	// sent TOKEN_REFRESH_REQUIRED shortly before
+	SessionExpires *time.Time `json:"sessionExpires,omitempty"`
+	// protocol version the client was built against, 0 for clients that predate versioning
+	ProtocolVersion int `json:"protocolVersion"`
+	// locale the client's errors are rendered in, eg: "es" or "es-MX". English if left blank
+	Locale string `json:"locale,omitempty"`
+}
+
+func (HelloAction) Type() string        { return "HELLO_REQUEST" }
+func (HelloAction) SuccessType() string { return "HELLO_SUCCESS" }
+func (HelloAction) FailureType() string { return "HELLO_FAILURE" }
+
+func (HelloAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &HelloAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *HelloAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		log.Info(a.err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+
+	// clients that connected with an api key act for it's user
+	if a.client != nil && a.client.apiKey != nil {
+		a.KeyId = a.client.apiKey.KeyId
+	}
+	flags, err := EvaluateFlags(appDB, a.KeyId, uuid.New())
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if a.client != nil {
+		a.client.setFlags(flags)
+		// the key id a client says hello with personalizes it's connection,
+		// it doesn't grant access. see Client.identity
+		a.client.setKeyId(a.KeyId)
+		a.client.setProtocol(a.ProtocolVersion)
+		a.client.setLocale(messages.resolve(a.Locale))
+		var expires time.Time
+		if a.SessionExpires != nil && a.KeyId != "" {
+			expires = *a.SessionExpires
+		}
+		sessions.Track(a.client, expires)
+	}
+	countFlagged(flags, "connections")
+
+	data := map[string]interface{}{"flags": flags, "server": serverInfo(), "locale": messages.resolve(a.Locale)}
+	if warning := protocolWarning(a.ProtocolVersion); warning != "" {
+		data["warning"] = warning
+	}
+	// a client shouldn't fail to connect over announcements
+	if list, err := ActiveAnnouncements(appDB, a.KeyId, time.Now()); err != nil {
+		log.Info(err.Error())
+	} else {
+		data["announcements"] = list
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Data:      data,
+	}
+}
+
+// FeatureFlagsHandler inspects & overrides a person's flags. GET ?keyId= lists
+// rollouts, overrides & evaluated flags for the key. POST sets an override,
+// {"keyId":"", "flag":"", "enabled":true}, or clears it if enabled is null
+func FeatureFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminConfigured(w) {
+		return
+	}
+
+	keyId := r.URL.Query().Get("keyId")
+	if r.Method == "POST" {
+		req := struct {
+			KeyId   string `json:"keyId"`
+			Flag    string `json:"flag"`
+			Enabled *bool  `json:"enabled"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if req.KeyId == "" || !isKnownFlag(req.Flag) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "keyId & a known flag are required"})
+			return
+		}
+		if err := setFlagOverride(appDB, req.KeyId, req.Flag, req.Enabled); err != nil {
+			log.Info(err.Error())
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		keyId = req.KeyId
+	} else if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rollouts, err := readFlagRollouts(appDB)
+	if err != nil {
+		log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	overrides, err := readFlagOverrides(appDB, keyId)
+	if err != nil {
+		log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	res := map[string]interface{}{"rollouts": rollouts}
+	if keyId != "" {
+		res["keyId"] = keyId
+		res["overrides"] = overrides
+		res["flags"] = evaluateFlags(rollouts, overrides, keyId)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// setFlagOverride sets a flag for a key id, clearing the override if enabled is nil
+func setFlagOverride(db *sql.DB, keyId, flag string, enabled *bool) error {
+	if enabled == nil {
+		_, err := db.Exec("delete from feature_flag_overrides where key_id = $1 and flag = $2", keyId, flag)
+		return checkWriteErr(err)
+	}
+	_, err := db.Exec(`insert into feature_flag_overrides (key_id, flag, enabled) values ($1, $2, $3)
+		on conflict (key_id, flag) do update set enabled = $3, updated = (now() at time zone 'utc')`, keyId, flag, *enabled)
+	return checkWriteErr(err)
+}
+
+func isKnownFlag(flag string) bool {
+	for _, name := range knownFlags {
+		if name == flag {
+			return true
+		}
+	}
+	return false
+}
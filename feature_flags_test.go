@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseFlagRollouts(t *testing.T) {
+	cases := []struct {
+		entries []string
+		expect  map[string]int
+		err     bool
+	}{
+		{nil, map[string]int{}, false},
+		{[]string{""}, map[string]int{}, false},
+		{[]string{"coalescedFrames:10", " other : 100"}, map[string]int{"coalescedFrames": 10, "other": 100}, false},
+		{[]string{"coalescedFrames"}, nil, true},
+		{[]string{"coalescedFrames:101"}, nil, true},
+		{[]string{"coalescedFrames:ten"}, nil, true},
+	}
+
+	for i, c := range cases {
+		got, err := parseFlagRollouts(c.entries)
+		if (err != nil) != c.err {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.expect) && !c.err {
+			t.Errorf("case %d rollouts mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestEvaluateFlags(t *testing.T) {
+	// rollouts are sticky per id & roughly match their percent
+	on := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("key_%d", i)
+		flags := evaluateFlags(map[string]int{"a": 25}, nil, id)
+		if flags["a"] != evaluateFlags(map[string]int{"a": 25}, nil, id)["a"] {
+			t.Errorf("expected evaluation to be stable for %s", id)
+		}
+		if flags["a"] {
+			on++
+		}
+	}
+	if on < 200 || on > 300 {
+		t.Errorf("expected roughly 25%% of ids to have the flag on, got %d of 1000", on)
+	}
+
+	cases := []struct {
+		rollouts  map[string]int
+		overrides map[string]bool
+		expect    map[string]bool
+	}{
+		{map[string]int{"a": 0, "b": 100}, nil, map[string]bool{"a": false, "b": true}},
+		{map[string]int{"a": 0, "b": 100}, map[string]bool{"a": true, "b": false}, map[string]bool{"a": true, "b": false}},
+		// overrides for flags that aren't defined are ignored
+		{map[string]int{"a": 0}, map[string]bool{"gone": true}, map[string]bool{"a": false}},
+	}
+
+	for i, c := range cases {
+		got := evaluateFlags(c.rollouts, c.overrides, "key")
+		if fmt.Sprint(got) != fmt.Sprint(c.expect) {
+			t.Errorf("case %d flags mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestClientFlags(t *testing.T) {
+	c := &Client{}
+	if c.flag(flagCoalescedFrames) {
+		t.Errorf("expected flags to be off before hello")
+	}
+	c.setFlags(map[string]bool{flagCoalescedFrames: true})
+	if !c.flag(flagCoalescedFrames) {
+		t.Errorf("expected flag to be on after it's set")
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
+)
+
+const (
+	// forensicsMetaKey is the source meta key that enables recording forensics
+	// for captures under that source, eg: {"recordForensics": true}
+	forensicsMetaKey = "recordForensics"
+	// urlForensicsMetaKey is the url meta key that references a url's latest forensic record
+	urlForensicsMetaKey = "forensics"
+)
+
+// FetchForensics is a record of how a capture was fetched, for provenance
+// beyond the response body itself
+type FetchForensics struct {
+	Url     string    `json:"url"`
+	Started time.Time `json:"started"`
+	// ip:port of the server that answered
+	RemoteAddr string `json:"remoteAddr"`
+	// addresses the host resolved to
+	DNSAnswers []string `json:"dnsAnswers"`
+	// empty for plain http
+	TLSVersion     string `json:"tlsVersion,omitempty"`
+	TLSCipherSuite uint16 `json:"tlsCipherSuite,omitempty"`
+	TLSServerName  string `json:"tlsServerName,omitempty"`
+	// hex sha256 fingerprints of the presented certificate chain, leaf first
+	CertFingerprints []string     `json:"certFingerprints,omitempty"`
+	Timing           *FetchTiming `json:"timing"`
+	Egress           *Egress      `json:"egress"`
+}
+
+// FetchTiming breaks down how long each phase of a fetch took. Phases that
+// didn't happen (eg: DNS for an ip address, or a reused connection) are zero
+type FetchTiming struct {
+	DNS          time.Duration `json:"dns"`
+	Connect      time.Duration `json:"connect"`
+	TLSHandshake time.Duration `json:"tlsHandshake"`
+	FirstByte    time.Duration `json:"firstByte"`
+	Total        time.Duration `json:"total"`
+}
+
+// Egress identifies where a fetch was made from
+type Egress struct {
+	Hostname  string `json:"hostname"`
+	LocalAddr string `json:"localAddr"`
+	// egress the fetch was routed through, "direct" or a proxy name & address.
+	// when proxied, RemoteAddr is the proxy's address
+	Route string `json:"route,omitempty"`
+}
+
+// forensicsRecorder collects forensics from httptrace hooks. hooks can fire
+// from multiple goroutines (eg: racing connection attempts), so it's locked
+type forensicsRecorder struct {
+	sync.Mutex
+	rec                                     *FetchForensics
+	dnsStart, connectStart, tlsStart, wrote time.Time
+}
+
+func newForensicsRecorder(url string) *forensicsRecorder {
+	hostname, _ := os.Hostname()
+	return &forensicsRecorder{
+		rec: &FetchForensics{
+			Url:     url,
+			Started: time.Now(),
+			Timing:  &FetchTiming{},
+			Egress:  &Egress{Hostname: hostname},
+		},
+	}
+}
+
+// trace returns hooks that record connection details. With redirects the
+// hooks fire once per request, leaving the details of the final request
+func (r *forensicsRecorder) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.Lock()
+			r.dnsStart = time.Now()
+			r.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			r.Lock()
+			defer r.Unlock()
+			r.rec.Timing.DNS = time.Since(r.dnsStart)
+			r.rec.DNSAnswers = make([]string, len(info.Addrs))
+			for i, a := range info.Addrs {
+				r.rec.DNSAnswers[i] = a.String()
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			r.Lock()
+			r.connectStart = time.Now()
+			r.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				return
+			}
+			r.Lock()
+			r.rec.Timing.Connect = time.Since(r.connectStart)
+			r.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			r.Lock()
+			r.tlsStart = time.Now()
+			r.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.Lock()
+			r.rec.Timing.TLSHandshake = time.Since(r.tlsStart)
+			r.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.Lock()
+			defer r.Unlock()
+			r.rec.RemoteAddr = info.Conn.RemoteAddr().String()
+			r.rec.Egress.LocalAddr = info.Conn.LocalAddr().String()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			r.Lock()
+			r.wrote = time.Now()
+			r.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			r.Lock()
+			r.rec.Timing.FirstByte = time.Since(r.wrote)
+			r.Unlock()
+		},
+	}
+}
+
+// gotResponse records the TLS state of a response
+func (r *forensicsRecorder) gotResponse(res *http.Response) {
+	if res.TLS == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.rec.TLSVersion = tlsVersionName(res.TLS.Version)
+	r.rec.TLSCipherSuite = res.TLS.CipherSuite
+	r.rec.TLSServerName = res.TLS.ServerName
+	r.rec.CertFingerprints = make([]string, len(res.TLS.PeerCertificates))
+	for i, cert := range res.TLS.PeerCertificates {
+		sum := sha256.Sum256(cert.Raw)
+		r.rec.CertFingerprints[i] = hex.EncodeToString(sum[:])
+	}
+}
+
+// finish stops the clock & returns the completed record
+func (r *forensicsRecorder) finish() *FetchForensics {
+	r.Lock()
+	defer r.Unlock()
+	r.rec.Timing.Total = time.Since(r.rec.Started)
+	r.rec.Started = r.rec.Started.In(time.UTC)
+	return r.rec
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionSSL30:
+		return "SSL 3.0"
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case 0x0304:
+		return "TLS 1.3"
+	}
+	return "unknown"
+}
+
+// matchSource finds the most specific source (subprimer) a url falls under, eg:
+// www.epa.gov/haps over www.epa.gov, returning nil if none match
+func matchSource(db *sql.DB, url string) (*core.Source, error) {
+	s := &core.Source{}
+	err := db.QueryRow("select id from sources where $1 ilike concat('%', url ,'%') and deleted = false order by length(url) desc limit 1", url).Scan(&s.Id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := s.Read(store); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// forensicsEnabled checks if captures under a source should record forensics
+func forensicsEnabled(s *core.Source) bool {
+	return s != nil && s.Meta[forensicsMetaKey] == true
+}
+
+// getUrl GET's a url with the default service over db, see Service.getUrl
+func getUrl(db *sql.DB, u *core.Url) ([]byte, []*core.Link, error) {
+	return defaultService().withDB(db).getUrl(u, nil)
+}
+
+// getUrl GET's a url through the egress it's source selects, recording
+// forensics if the source asks for them & extracting links from content other
+// than HTML. Otherwise it's equivalent to u.Get(store). rec records or replays
+// the fetch for archive jobs that ask for it, replays always GET, even if the
+// url was fetched recently
+func (s *Service) getUrl(u *core.Url, rec *fetchRecording) ([]byte, []*core.Link, error) {
+	db := s.DB
+	if !u.ShouldEnqueueGet() && (rec == nil || !rec.replay) {
+		return u.Get(s.Store)
+	}
+	src, err := matchSource(db, u.Url)
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := rec.egress(s.Egress, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	// replays reproduce what was captured, robots.txt was checked when it was recorded
+	if obeysRobots(src) && (rec == nil || !rec.replay) {
+		if err := robots.check(e, u.Url, time.Now()); err != nil {
+			return nil, nil, err
+		}
+	}
+	prev := u.Hash
+	defer bandwidth.crawlTurn()()
+
+	var (
+		body  []byte
+		links []*core.Link
+	)
+	if forensicsEnabled(src) {
+		body, links, err = getWithForensics(db, e, u)
+	} else {
+		body, links, err = getVia(s.Store, e, u)
+	}
+	if err == errNotModified {
+		return s.notModified(u)
+	} else if err != nil {
+		return body, links, err
+	}
+	auditCaptureRecord(s.Store, u)
+	searchWatcher.capture(src, u)
+	s.publishContentChange(u, prev)
+	if err := s.saveRenderCard(e, u, body); err != nil {
+		s.Log.Infof("error saving render card for %s: %s", u.Url, err.Error())
+	}
+
+	// the capture is already stored, failing to extract links or record where
+	// they were found shouldn't fail it
+	extracted, found, err := extractLinks(db, src, u, body)
+	if err != nil {
+		s.Log.Infof("error extracting links from %s: %s", u.Url, err.Error())
+	}
+	found, anchors, err := captureLinks(u, body, found)
+	if err != nil {
+		s.Log.Infof("error reading links from %s: %s", u.Url, err.Error())
+		return body, append(links, extracted...), nil
+	}
+	// core extracts HTML links in the background & can return before it's
+	// done, so the links it returns are replaced with every HTML link found
+	if docLinks, err := saveDocLinks(db, u, found); err != nil {
+		s.Log.Infof("error saving links from %s: %s", u.Url, err.Error())
+	} else {
+		links = docLinks
+	}
+	if err := saveLinkAnchors(db, u.Url, anchors); err != nil {
+		s.Log.Infof("error saving link anchors from %s: %s", u.Url, err.Error())
+	}
+	if err := recordCaptureLinks(db, u, body, found); err != nil {
+		s.Log.Infof("error recording link provenance for %s: %s", u.Url, err.Error())
+	}
+	return body, append(links, extracted...), nil
+}
+
+// errNotModified is returned by conditional GET's of urls that haven't changed
+// since they were last captured
+var errNotModified = fmt.Errorf("not modified")
+
+// getVia GET's a url through an egress, conditionally if it's been captured before
+func getVia(ds datastore.Datastore, e *egress, u *core.Url) ([]byte, []*core.Link, error) {
+	req, err := http.NewRequest("GET", u.Url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	conditional := setConditionalHeaders(req, u)
+	res, err := e.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conditional && res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		return nil, nil, errNotModified
+	}
+	return u.HandleGetResponse(ds, res)
+}
+
+// setConditionalHeaders makes req conditional on the validators u's last
+// capture recorded, reporting weather it has any
+func setConditionalHeaders(req *http.Request, u *core.Url) bool {
+	if u.LastGet == nil || u.Status != http.StatusOK {
+		return false
+	}
+	headers := u.HeadersMap()
+	if etag := headers["Etag"]; etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if modified := headers["Last-Modified"]; modified != "" {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// notModified records a conditional GET that found u unchanged, returning the
+// links it's last capture found. there's no body, the last capture stands
+func (s *Service) notModified(u *core.Url) ([]byte, []*core.Link, error) {
+	now := time.Now()
+	u.LastGet = &now
+	if err := checkWriteErr(u.Save(s.Store)); err != nil {
+		return nil, nil, err
+	}
+	links, err := core.ReadDstLinks(s.DB, u)
+	return nil, links, err
+}
+
+// getWithForensics GET's a url through an egress, recording a forensic record of the fetch
+func getWithForensics(db *sql.DB, e *egress, u *core.Url) ([]byte, []*core.Link, error) {
+	req, err := http.NewRequest("GET", u.Url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := newForensicsRecorder(u.Url)
+	r.rec.Egress.Route = e.String()
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), r.trace()))
+	conditional := setConditionalHeaders(req, u)
+
+	res, err := e.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conditional && res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		return nil, nil, errNotModified
+	}
+	r.gotResponse(res)
+
+	body, links, err := u.HandleGetResponse(store, res)
+	if err != nil {
+		return body, links, err
+	}
+
+	// the capture is already stored, failing to record forensics shouldn't fail it
+	if err := saveForensics(db, u, r.finish()); err != nil {
+		log.Infof("error saving forensics for %s: %s", u.Url, err.Error())
+	}
+	return body, links, nil
+}
+
+// saveForensics stores a forensic record content-addressed by it's hash &
+// references it from the url's meta
+func saveForensics(db *sql.DB, u *core.Url, f *FetchForensics) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	hash, err := hashContent(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("insert into fetch_forensics (hash,created,url,record) values ($1, $2, $3, $4) on conflict (hash) do nothing",
+		hash, time.Now().Round(time.Second).In(time.UTC), u.Url, data)
+	if err = checkWriteErr(err); err != nil {
+		return err
+	}
+	auditForensicsWrite(db, hash)
+
+	if u.Meta == nil {
+		u.Meta = map[string]interface{}{}
+	}
+	u.Meta[urlForensicsMetaKey] = hash
+	return checkWriteErr(u.Save(store))
+}
+
+// ReadForensics reads a forensic record by hash
+func ReadForensics(db *sql.DB, hash string) (*FetchForensics, error) {
+	var data []byte
+	err := db.QueryRow("select record from fetch_forensics where hash = $1", hash).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	f := &FetchForensics{}
+	err = json.Unmarshal(data, f)
+	return f, err
+}
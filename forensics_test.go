@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestForensicsRecorder(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r := newForensicsRecorder(server.URL)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), r.trace()))
+
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	r.gotResponse(res)
+	f := r.finish()
+
+	if f.RemoteAddr != server.Listener.Addr().String() {
+		t.Errorf("remote addr mismatch. expected: %s, got: %s", server.Listener.Addr().String(), f.RemoteAddr)
+	}
+	if f.Egress.LocalAddr == "" {
+		t.Errorf("expected egress local addr to be recorded")
+	}
+	if f.TLSVersion == "" || f.TLSVersion == "unknown" {
+		t.Errorf("expected tls version to be recorded, got: %s", f.TLSVersion)
+	}
+	sum := sha256.Sum256(server.Certificate().Raw)
+	if len(f.CertFingerprints) != 1 || f.CertFingerprints[0] != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected leaf certificate fingerprint to be recorded. got: %v", f.CertFingerprints)
+	}
+	if f.Timing.Total <= 0 || f.Timing.Total < f.Timing.FirstByte {
+		t.Errorf("expected total timing to cover time to first byte. got: %v", f.Timing)
+	}
+}
+
+func TestForensicsEnabled(t *testing.T) {
+	cases := []struct {
+		s      *core.Source
+		expect bool
+	}{
+		{nil, false},
+		{&core.Source{}, false},
+		{&core.Source{Meta: map[string]interface{}{forensicsMetaKey: false}}, false},
+		{&core.Source{Meta: map[string]interface{}{forensicsMetaKey: "true"}}, false},
+		{&core.Source{Meta: map[string]interface{}{forensicsMetaKey: true}}, true},
+	}
+
+	for i, c := range cases {
+		if got := forensicsEnabled(c.s); got != c.expect {
+			t.Errorf("case %d expected %t, got %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestSetConditionalHeaders(t *testing.T) {
+	captured := time.Now()
+	cases := []struct {
+		u           *core.Url
+		conditional bool
+		ifNoneMatch string
+		ifModified  string
+	}{
+		{&core.Url{Url: "http://a.com"}, false, "", ""},
+		{&core.Url{Url: "http://a.com", LastGet: &captured, Status: 200}, false, "", ""},
+		{&core.Url{Url: "http://a.com", LastGet: &captured, Status: 404, Headers: []string{"Etag", `"v1"`}}, false, "", ""},
+		{&core.Url{Url: "http://a.com", LastGet: &captured, Status: 200, Headers: []string{"Etag", `"v1"`}}, true, `"v1"`, ""},
+		{&core.Url{Url: "http://a.com", LastGet: &captured, Status: 200, Headers: []string{"Last-Modified", "Sun, 01 Jan 2017 00:00:00 GMT"}}, true, "", "Sun, 01 Jan 2017 00:00:00 GMT"},
+	}
+
+	for i, c := range cases {
+		req, _ := http.NewRequest("GET", c.u.Url, nil)
+		if got := setConditionalHeaders(req, c.u); got != c.conditional {
+			t.Errorf("case %d expected conditional to be %t", i, c.conditional)
+		}
+		if got := req.Header.Get("If-None-Match"); got != c.ifNoneMatch {
+			t.Errorf("case %d If-None-Match mismatch. expected: %q, got: %q", i, c.ifNoneMatch, got)
+		}
+		if got := req.Header.Get("If-Modified-Since"); got != c.ifModified {
+			t.Errorf("case %d If-Modified-Since mismatch. expected: %q, got: %q", i, c.ifModified, got)
+		}
+	}
+}
+
+func TestSaveForensics(t *testing.T) {
+	defer resetTestData(appDB, "urls", "fetch_forensics")
+
+	u := &core.Url{Url: "http://www.epa.gov"}
+	if err := u.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	f := &FetchForensics{Url: u.Url, RemoteAddr: "127.0.0.1:80", Timing: &FetchTiming{}, Egress: &Egress{}}
+	if err := saveForensics(appDB, u, f); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hash, ok := u.Meta[urlForensicsMetaKey].(string)
+	if !ok {
+		t.Fatalf("expected url meta to reference forensics. got: %v", u.Meta)
+	}
+	got, err := ReadForensics(appDB, hash)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.RemoteAddr != f.RemoteAddr {
+		t.Errorf("remote addr mismatch. expected: %s, got: %s", f.RemoteAddr, got.RemoteAddr)
+	}
+
+	if d := newUrlDetail(u, ""); d.Forensics == nil || d.Forensics.RemoteAddr != f.RemoteAddr {
+		t.Errorf("expected url detail to include forensics")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+)
+
+const (
+	// content younger than this isn't collected, an import may be about to
+	// record a capture that references it
+	gcMinAge = time.Hour
+	// temp files younger than this aren't collected, uploads & imports write
+	// to them for as long as they run
+	gcTempMinAge = 24 * time.Hour
+)
+
+// GCReport lists stored content that nothing references
+type GCReport struct {
+	// every file checked
+	Checked int `json:"checked"`
+	// content no capture or hash alias references
+	Unreferenced []string `json:"unreferenced"`
+	// temp files left by interrupted uploads, imports & rehash jobs
+	Temp []string `json:"temp"`
+	// bytes used by unreferenced content & temp files
+	Bytes int64 `json:"bytes"`
+	// false if files were listed but not removed
+	Removed bool `json:"removed"`
+}
+
+// CollectContent finds content stored in dir that no url, snapshot or hash
+// alias references, along with stale temp files, & removes them unless
+// dryRun is set. references are checked with HaveHashes, the same check
+// importers use to skip content that's already archived
+func CollectContent(db *sql.DB, store datastore.Datastore, dir string, now time.Time, dryRun bool) (*GCReport, error) {
+	if dir == "" {
+		return nil, ErrNoBlockStore
+	}
+	if !dryRun {
+		if err := maintenance.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	r := &GCReport{Unreferenced: []string{}, Temp: []string{}, Removed: !dryRun}
+	sizes := map[string]int64{}
+	candidates := []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		r.Checked++
+		age := now.Sub(info.ModTime())
+		if strings.HasPrefix(info.Name(), ".") {
+			if age >= gcTempMinAge {
+				r.Temp = append(r.Temp, info.Name())
+				r.Bytes += info.Size()
+			}
+			continue
+		}
+		if age >= gcMinAge {
+			candidates = append(candidates, info.Name())
+			sizes[info.Name()] = info.Size()
+		}
+	}
+
+	have, err := HaveHashes(db, store, candidates)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range candidates {
+		if !have[hash] {
+			r.Unreferenced = append(r.Unreferenced, hash)
+			r.Bytes += sizes[hash]
+		}
+	}
+
+	if dryRun {
+		return r, nil
+	}
+	for _, names := range [][]string{r.Unreferenced, r.Temp} {
+		for _, name := range names {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return r, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// collectHashes removes content stored in dir under any of hashes that
+// nothing references, returning the hashes removed. content that was never
+// stored locally is skipped
+func collectHashes(db *sql.DB, store datastore.Datastore, dir string, hashes []string) ([]string, error) {
+	have, err := HaveHashes(db, store, hashes)
+	if err != nil {
+		return nil, err
+	}
+	unreferenced := []string{}
+	for hash, ok := range have {
+		if !ok {
+			unreferenced = append(unreferenced, hash)
+		}
+	}
+	sort.Strings(unreferenced)
+
+	removed := []string{}
+	for _, hash := range unreferenced {
+		if err := os.Remove(filepath.Join(dir, hash)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		removed = append(removed, hash)
+	}
+	return removed, nil
+}
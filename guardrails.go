@@ -0,0 +1,242 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Guardrails
+//
+// Big imports on top of many websocket clients can run the process out of
+// memory, or starve pings until clients drop. the guardrail samples goroutines,
+// heap & the messages waiting to be sent to clients every
+// guardrailSampleInterval, & sheds load as the most pressured of them nears
+// it's limit (cfg.GuardrailMaxGoroutines, cfg.GuardrailMaxHeapMB &
+// cfg.GuardrailMaxQueued). load is shed in order, each level adding to the
+// last:
+//
+//   background:  at 80% leader tasks, idle verification & badge verification pause
+//   archives:    at 90% new archive requests are rejected with SERVER_BUSY
+//   connections: at 100% new websocket upgrades are refused with a Retry-After
+//
+// a level is only left once pressure falls guardrailHysteresisPoints below
+// where it starts, so shedding doesn't flap around a threshold. work already
+// under way carries on, & reads are never shed. transitions are logged, &
+// the guardrail's status is reported at /healthcheck & /readycheck
+
+const (
+	// serverBusyErrCode is set as the code of responses rejected to shed load
+	serverBusyErrCode = "SERVER_BUSY"
+
+	// how often load is sampled
+	guardrailSampleInterval = 2 * time.Second
+	// percentage points below a level's threshold pressure must fall to leave it
+	guardrailHysteresisPoints = 10
+	// how long clients refused a connection are asked to wait
+	guardrailRetryAfter = 30 * time.Second
+)
+
+// shedding levels, in the order load is shed
+const (
+	shedNone = iota
+	shedBackground
+	shedArchives
+	shedConnections
+)
+
+var (
+	// shedLevels names each shedding level
+	shedLevels = []string{"ok", "background", "archives", "connections"}
+	// shedThresholds is the pressure, in percent of a limit, each level starts at
+	shedThresholds = []int{0, 80, 90, 100}
+
+	// ErrServerBusy is returned for archive requests made while the server is shedding load
+	ErrServerBusy = fmt.Errorf("the server is too busy to take archive requests right now, please try again shortly")
+	// ErrServerFull is returned for websocket connections refused while the server is shedding load
+	ErrServerFull = fmt.Errorf("the server is too busy to take new connections right now, please try again shortly")
+
+	// guardrailStats exposes shedding counts at /debug/vars
+	guardrailStats = expvar.NewMap("guardrails")
+	// guardrails is the package-level guardrail
+	guardrails = newGuardrail()
+)
+
+// LoadSample is a reading of the resources the guardrail watches
+type LoadSample struct {
+	Goroutines int `json:"goroutines"`
+	// bytes of allocated heap objects
+	HeapBytes uint64 `json:"heapBytes"`
+	// messages waiting to be sent to clients
+	Queued int `json:"queued"`
+}
+
+// GuardrailStatus is the load being shed & the sample it was decided on
+type GuardrailStatus struct {
+	// one of "ok", "background", "archives", "connections"
+	Shedding string `json:"shedding"`
+	// percent of it's limit the most pressured resource is at
+	Pressure int         `json:"pressure"`
+	Load     *LoadSample `json:"load"`
+	// limits, 0 for resources that aren't limited
+	MaxGoroutines int    `json:"maxGoroutines"`
+	MaxHeapBytes  uint64 `json:"maxHeapBytes"`
+	MaxQueued     int    `json:"maxQueued"`
+	// when shedding last changed
+	Since time.Time `json:"since"`
+}
+
+// guardrail sheds load as resources near their limits
+type guardrail struct {
+	sync.RWMutex
+	// sample reads current load
+	sample func() *LoadSample
+	// limits, 0 for resources that aren't limited
+	maxGoroutines int
+	maxHeap       uint64
+	maxQueued     int
+	level         int
+	status        *GuardrailStatus
+	now           func() time.Time
+}
+
+func newGuardrail() *guardrail {
+	return &guardrail{
+		sample:        sampleLoad,
+		maxGoroutines: 10000,
+		maxQueued:     20000,
+		status:        &GuardrailStatus{Shedding: shedLevels[shedNone], Load: &LoadSample{}},
+		now:           time.Now,
+	}
+}
+
+// configure sets the guardrail's limits from config
+func (g *guardrail) configure(c *config) {
+	g.Lock()
+	defer g.Unlock()
+	g.maxGoroutines = c.GuardrailMaxGoroutines
+	g.maxHeap = uint64(c.GuardrailMaxHeapMB) << 20
+	g.maxQueued = c.GuardrailMaxQueued
+}
+
+// sampleLoad reads the process's goroutines & heap, & the default room's queued messages
+func sampleLoad() *LoadSample {
+	mem := &runtime.MemStats{}
+	runtime.ReadMemStats(mem)
+	s := &LoadSample{Goroutines: runtime.NumGoroutine(), HeapBytes: mem.HeapAlloc}
+	if room != nil {
+		s.Queued = room.queued()
+	}
+	return s
+}
+
+// run samples load every guardrailSampleInterval
+func (g *guardrail) run() {
+	for range time.Tick(guardrailSampleInterval) {
+		g.check()
+	}
+}
+
+// check samples load & sets the level of shedding, logging changes
+func (g *guardrail) check() {
+	s := g.sample()
+
+	g.Lock()
+	defer g.Unlock()
+	pressure := 0
+	percent := func(v, max uint64) {
+		if max > 0 && int(v*100/max) > pressure {
+			pressure = int(v * 100 / max)
+		}
+	}
+	percent(uint64(s.Goroutines), uint64(g.maxGoroutines))
+	percent(s.HeapBytes, g.maxHeap)
+	percent(uint64(s.Queued), uint64(g.maxQueued))
+
+	// rise to the highest level pressure has reached, only fall to the
+	// highest level pressure is still within hysteresis of
+	level := shedNone
+	for l := len(shedThresholds) - 1; l > shedNone; l-- {
+		if pressure >= shedThresholds[l] || (l <= g.level && pressure >= shedThresholds[l]-guardrailHysteresisPoints) {
+			level = l
+			break
+		}
+	}
+
+	since := g.status.Since
+	if level != g.level {
+		log.Infof("guardrails: shedding %s, was %s. pressure %d%%: %d goroutines, %d heap bytes, %d queued messages",
+			shedLevels[level], shedLevels[g.level], pressure, s.Goroutines, s.HeapBytes, s.Queued)
+		guardrailStats.Add("transitions", 1)
+		g.level = level
+		since = g.now().In(time.UTC)
+	}
+	g.status = &GuardrailStatus{
+		Shedding:      shedLevels[level],
+		Pressure:      pressure,
+		Load:          s,
+		MaxGoroutines: g.maxGoroutines,
+		MaxHeapBytes:  g.maxHeap,
+		MaxQueued:     g.maxQueued,
+		Since:         since,
+	}
+}
+
+// Level returns the current level of shedding
+func (g *guardrail) Level() int {
+	g.RLock()
+	defer g.RUnlock()
+	return g.level
+}
+
+// Status returns a copy of the guardrail's status
+func (g *guardrail) Status() *GuardrailStatus {
+	g.RLock()
+	defer g.RUnlock()
+	s := *g.status
+	return &s
+}
+
+// Check returns ErrServerBusy if archive requests aren't currently accepted
+func (g *guardrail) Check() error {
+	if g.Level() >= shedArchives {
+		guardrailStats.Add("archivesRejected", 1)
+		return ErrServerBusy
+	}
+	return nil
+}
+
+// background reports weather background jobs may run
+func (g *guardrail) background() bool {
+	return g.Level() < shedBackground
+}
+
+// waitBackground blocks background jobs while they're paused
+func (g *guardrail) waitBackground() {
+	for !g.background() {
+		time.Sleep(guardrailSampleInterval)
+	}
+}
+
+// accept checks a new websocket connection can be upgraded
+func (g *guardrail) accept() bool {
+	if g.Level() >= shedConnections {
+		guardrailStats.Add("connectionsRefused", 1)
+		return false
+	}
+	return true
+}
+
+// writeServerBusy responds to an http request rejected to shed load
+func writeServerBusy(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(guardrailRetryAfter/time.Second)))
+	writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+		"code":       serverBusyErrCode,
+		"error":      err.Error(),
+		"guardrails": guardrails.Status(),
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestGuardrail makes a guardrail with a limit of 100 goroutines, sampling
+// the goroutines *load says
+func newTestGuardrail(load *int) *guardrail {
+	g := newGuardrail()
+	g.maxGoroutines, g.maxQueued = 100, 0
+	g.sample = func() *LoadSample { return &LoadSample{Goroutines: *load} }
+	return g
+}
+
+func TestGuardrailShedding(t *testing.T) {
+	load := 0
+	g := newTestGuardrail(&load)
+
+	// load rises through each threshold, then falls through each hysteresis threshold
+	cases := []struct {
+		load  int
+		level int
+	}{
+		{50, shedNone},
+		{79, shedNone},
+		{80, shedBackground},
+		{89, shedBackground},
+		{90, shedArchives},
+		{100, shedConnections},
+		{91, shedConnections},
+		{90, shedConnections},
+		{89, shedArchives},
+		{80, shedArchives},
+		{79, shedBackground},
+		{85, shedBackground},
+		{70, shedBackground},
+		{69, shedNone},
+		// rising skips straight to the level pressure reached
+		{150, shedConnections},
+		{10, shedNone},
+	}
+
+	for i, c := range cases {
+		load = c.load
+		g.check()
+		if g.Level() != c.level {
+			t.Errorf("case %d expected %s at %d goroutines, got: %s", i, shedLevels[c.level], c.load, shedLevels[g.Level()])
+		}
+		if s := g.Status(); s.Shedding != shedLevels[c.level] || s.Pressure != c.load || s.Load.Goroutines != c.load {
+			t.Errorf("case %d unexpected status: %v", i, s)
+		}
+	}
+
+	// the most pressured resource decides
+	g.maxQueued = 10
+	g.sample = func() *LoadSample { return &LoadSample{Goroutines: 10, Queued: 9} }
+	g.check()
+	if g.Level() != shedArchives {
+		t.Errorf("expected queued messages to shed archives, got: %s", shedLevels[g.Level()])
+	}
+}
+
+func TestGuardrailShedsLoad(t *testing.T) {
+	defer maintenance.Leave(true)
+	maintenance.Leave(true)
+	load := 0
+	svc := newTestService()
+	svc.Guardrails = newTestGuardrail(&load)
+
+	client := &Client{svc: svc}
+	archive := func() *ClientResponse {
+		return client.HandleRequestAction(TrialArchiveAction{}.Type(), "req", false, "", json.RawMessage(`{"url":"http://www.epa.gov"}`))
+	}
+	connect := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		client.svc.ServeWs(w, httptest.NewRequest("GET", "/ws", nil))
+		return w
+	}
+	ready := func() int {
+		w := httptest.NewRecorder()
+		svc.serveReadiness(w, httptest.NewRequest("GET", "/readycheck", nil))
+		return w.Code
+	}
+
+	// background jobs pause first
+	load = 85
+	svc.Guardrails.check()
+	if svc.Guardrails.background() {
+		t.Errorf("expected background jobs to be paused")
+	}
+	if res := archive(); res.Code == serverBusyErrCode {
+		t.Errorf("expected archive requests to be accepted while only background jobs are shed")
+	}
+	v := &idleVerifier{load: func() (float64, float64) { return 0, 0 }, maxCrawl: 1, maxServe: 1, guardrails: svc.Guardrails}
+	if v.idle() {
+		t.Errorf("expected idle verification to pause")
+	}
+
+	// then new archive requests
+	load = 95
+	svc.Guardrails.check()
+	if res := archive(); res.Code != serverBusyErrCode {
+		t.Errorf("expected archive requests to be rejected with %s, got: %q", serverBusyErrCode, res.Code)
+	}
+	if w := connect(); w.Code == http.StatusServiceUnavailable {
+		t.Errorf("expected websocket upgrades to be attempted while archives are shed")
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("expected to stay ready while archives are shed, got: %d", code)
+	}
+
+	// then new connections
+	load = 100
+	svc.Guardrails.check()
+	w := connect()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("expected websocket upgrades to be refused with a Retry-After, got: %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready while refusing connections, got: %d", code)
+	}
+
+	// & recover once load falls
+	load = 10
+	svc.Guardrails.check()
+	if res := archive(); res.Code == serverBusyErrCode || !svc.Guardrails.background() || ready() != http.StatusOK {
+		t.Errorf("expected to recover once load falls")
+	}
+	if s := svc.Guardrails.Status(); s.Since.IsZero() || time.Since(s.Since) > time.Minute {
+		t.Errorf("expected the last transition to be recorded, got: %s", s.Since)
+	}
+}
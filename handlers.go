@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"time"
 )
 
 // templates is a collection of views for rendering with the renderTemplate function
@@ -16,8 +18,20 @@ var templates *template.Template
 // TODO - add Database connection & proper configuration checks here for more accurate
 // health reporting
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{ "status" : 200 }`))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     http.StatusOK,
+		"server":     serverInfo(),
+		"guardrails": guardrails.Status(),
+	})
+}
+
+// DebugVarsHandler serves expvar counters, which include the command line & cache,
+// bandwidth & rate limit stats, so it's only served when admin auth is configured
+func DebugVarsHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminConfigured(w) {
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
 }
 
 func UserProfileHandler(w http.ResponseWriter, r *http.Request) {
@@ -29,11 +43,22 @@ func UserProfileHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func ArchiveUrlHandler(w http.ResponseWriter, r *http.Request) {
+	if refusal, err := rateLimits.admit(defaultService(), nil, time.Now(), limitGuardrails); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if refusal != nil {
+		refusal.write(w)
+		return
+	}
 	done := func(err error) {}
-	res, _, err := ArchiveUrl(appDB, r.FormValue("url"), done)
-	if err != nil {
+	res, _, err := ArchiveUrl(appDB, r.FormValue("url"), ArchiveOpts{}, done)
+	if err == ErrMaintenanceMode {
+		writeMaintenanceError(w)
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, fmt.Sprintf("archive url '%s' error: %s", r.FormValue("url"), err.Error()))
+		// don't echo the submitted url back, it may contain sensitive query params
+		io.WriteString(w, fmt.Sprintf("archive url error: %s", err.Error()))
 		return
 	}
 
@@ -48,6 +73,15 @@ func ArchiveUrlHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Info(err.Error())
+	}
+}
+
 // WebappHandler renders the home page
 func WebappHandler(w http.ResponseWriter, r *http.Request) {
 	renderTemplate(w, "webapp.html", nil)
@@ -61,6 +95,16 @@ func HandleWebsocketUpgrade(w http.ResponseWriter, r *http.Request) {
 	serveWs(room, w, r)
 }
 
+// HandlePollActions accepts actions from clients that can't use websockets
+func HandlePollActions(w http.ResponseWriter, r *http.Request) {
+	serveActions(room, w, r)
+}
+
+// HandlePoll delivers queued messages to clients that can't use websockets
+func HandlePoll(w http.ResponseWriter, r *http.Request) {
+	servePoll(w, r)
+}
+
 // renderTemplate renders a template with the values of cfg.TemplateData
 func renderTemplate(w http.ResponseWriter, tmpl string, data map[string]interface{}) {
 	tmplData := map[string]interface{}{
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	"github.com/pborman/uuid"
+)
+
+// harnessQuiet is how long a websocket transcript must go without a message
+// before an archive job is considered finished
+var harnessQuiet = time.Second
+
+// testPage is a page served by a testSite. Bodies may reference the site's
+// address with "{{site}}"
+type testPage struct {
+	// defaults to 200
+	Status int
+	// defaults to text/html
+	ContentType string
+	Body        string
+	// pages with an ETag answer matching If-None-Match requests with a 304
+	ETag string
+	// path to redirect to with a 302, Body is ignored
+	RedirectTo string
+	// time to wait before answering
+	Latency time.Duration
+}
+
+// siteRequest is a request a testSite received
+type siteRequest struct {
+	Path   string
+	Header http.Header
+}
+
+// testSite is an in-process website for archive jobs to crawl. it's registered
+// as a source so it's urls can be archived, & records every request it gets
+type testSite struct {
+	*httptest.Server
+	sync.Mutex
+	pages    map[string]*testPage
+	robots   string
+	requests []siteRequest
+	sourceId string
+	// svc is the service jobs against the site run on
+	svc *Service
+}
+
+// newTestSite starts serving pages by path & registers the site as a source.
+// Close removes everything archived from the site
+func newTestSite(t *testing.T, pages map[string]*testPage) *testSite {
+	s := &testSite{pages: pages, svc: newTestService()}
+	s.Server = httptest.NewServer(s)
+	wireTestStore()
+
+	// test sites serve from loopback addresses the egress guard rejects
+	s.svc.Egress = newEgresses(true)
+	s.svc.FollowDelay = 0
+	s.sourceId = uuid.New()
+	host := strings.TrimPrefix(s.URL, "http://")
+	if _, err := s.svc.DB.Exec("insert into sources (id,created,updated,title,url,crawl,meta) values ($1, now(), now(), $2, $2, true, '{}')", s.sourceId, host); err != nil {
+		s.Server.Close()
+		t.Fatal(err.Error())
+	}
+	return s
+}
+
+var wireStore sync.Once
+
+// wireTestStore connects the datastore core reads & writes through to the test database
+func wireTestStore() {
+	wireStore.Do(func() {
+		sql_datastore.SetDB(appDB)
+		sql_datastore.Register(
+			&core.Url{},
+			&core.Link{},
+			&core.Primer{},
+			&core.Source{},
+			&core.Collection{},
+			&core.CollectionItem{},
+		)
+	})
+}
+
+// Url is the absolute url of a path on the site
+func (s *testSite) Url(path string) string {
+	return s.URL + path
+}
+
+// Robots sets the site's robots.txt
+func (s *testSite) Robots(robots string) {
+	s.Lock()
+	s.robots = robots
+	s.Unlock()
+}
+
+// SourceMeta sets the meta of the site's source
+func (s *testSite) SourceMeta(t *testing.T, meta string) {
+	if _, err := s.svc.DB.Exec("update sources set meta = $2 where id = $1", s.sourceId, meta); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// Page replaces the page served at a path
+func (s *testSite) Page(path string, page *testPage) {
+	s.Lock()
+	s.pages[path] = page
+	s.Unlock()
+}
+
+// Requests lists requests the site got for a path
+func (s *testSite) Requests(path string) (reqs []siteRequest) {
+	s.Lock()
+	defer s.Unlock()
+	for _, r := range s.requests {
+		if r.Path == path {
+			reqs = append(reqs, r)
+		}
+	}
+	return
+}
+
+func (s *testSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.requests = append(s.requests, siteRequest{Path: r.URL.Path, Header: r.Header})
+	page, robots := s.pages[r.URL.Path], s.robots
+	s.Unlock()
+
+	if r.URL.Path == "/robots.txt" && robots != "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(robots))
+		return
+	}
+	if page == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	time.Sleep(page.Latency)
+	if page.RedirectTo != "" {
+		http.Redirect(w, r, page.RedirectTo, http.StatusFound)
+		return
+	}
+	if page.ETag != "" {
+		w.Header().Set("ETag", page.ETag)
+		if r.Header.Get("If-None-Match") == page.ETag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	contentType := page.ContentType
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	status := page.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write([]byte(strings.Replace(page.Body, "{{site}}", s.URL, -1)))
+}
+
+// Close stops the site & removes it's source, urls & everything archived from them
+func (s *testSite) Close() {
+	s.Server.Close()
+	pattern := s.URL + "%"
+	for _, q := range []string{
+		"delete from link_events where src like $1",
+		"delete from link_sightings where src like $1",
+		"delete from links where src like $1 or dst like $1",
+		"delete from snapshots where url like $1",
+		"delete from archive_requests where url like $1",
+		"delete from urls where url like $1",
+	} {
+		s.svc.DB.Exec(q, pattern)
+	}
+	s.svc.DB.Exec("delete from sources where id = $1", s.sourceId)
+}
+
+// transcript is every message a client was sent during an archive job, in order
+type transcript []*ClientResponse
+
+// Types lists the type of each message
+func (tr transcript) Types() (types []string) {
+	for _, res := range tr {
+		types = append(types, res.Type)
+	}
+	return
+}
+
+// Find lists messages of a type
+func (tr transcript) Find(typ string) (found transcript) {
+	for _, res := range tr {
+		if res.Type == typ {
+			found = append(found, res)
+		}
+	}
+	return
+}
+
+// runArchiveJob archives a url on a service the way a websocket client does,
+// returning the messages the client was sent once the job has gone quiet
+func runArchiveJob(t *testing.T, svc *Service, url string) transcript {
+	c := &Client{send: make(chan []byte, 256), addr: "127.0.0.1", svc: svc}
+	svc.ArchiveUrlFor(c, "harness", url)
+
+	tr := transcript{}
+	for {
+		select {
+		case data := <-c.send:
+			res := &ClientResponse{}
+			if err := json.Unmarshal(data, res); err != nil {
+				t.Fatalf("error decoding message: %s", err.Error())
+			}
+			tr = append(tr, res)
+		case <-time.After(harnessQuiet):
+			return tr
+		}
+	}
+}
+
+// countRows runs a count query, failing the test on error
+func countRows(t *testing.T, query string, args ...interface{}) (count int) {
+	if err := appDB.QueryRow(query, args...).Scan(&count); err != nil {
+		t.Fatalf("error counting rows: %s", err.Error())
+	}
+	return
+}
+
+// readArchivedUrl reads a url back from the datastore, failing the test if it's missing
+func readArchivedUrl(t *testing.T, url string) *core.Url {
+	u := &core.Url{Url: url}
+	if err := u.Read(store); err != nil {
+		t.Fatalf("error reading %s: %s", url, err.Error())
+	}
+	return u
+}
+
+func TestHarnessArchiveHappyPath(t *testing.T) {
+	site := newTestSite(t, map[string]*testPage{
+		"/": {Body: `<html><head><title>Home</title></head><body>
+			<a href="/a">a</a><a href="{{site}}/b">b</a></body></html>`},
+		"/a": {Body: `<html><head><title>A</title></head><body>a</body></html>`},
+		"/b": {Body: "b", ContentType: "text/plain", Latency: 50 * time.Millisecond},
+	})
+	defer site.Close()
+
+	tr := runArchiveJob(t, site.svc, site.Url("/"))
+
+	types, linksType := tr.Types(), FetchOutboundLinksAct{}.SuccessType()
+	if len(types) < 2 || types[0] != "URL_ARCHIVE_SUCCESS" || types[1] != linksType {
+		t.Fatalf("unexpected transcript: %v", types)
+	}
+	if len(tr.Find("URL_SET_LOADING")) != 2 || len(tr.Find("URL_SET_SUCCESS")) != 2 {
+		t.Errorf("expected both links to be followed, got: %v", types)
+	}
+	if errs := tr.Find("URL_SET_ERROR"); len(errs) != 0 {
+		t.Errorf("expected no errors following links, got: %v", errs[0].Data)
+	}
+
+	if got := countRows(t, "select count(1) from archive_requests where url = $1", site.Url("/")); got != 1 {
+		t.Errorf("expected 1 archive request, got: %d", got)
+	}
+	if got := countRows(t, "select count(1) from links where src = $1 and dst in ($2, $3)", site.Url("/"), site.Url("/a"), site.Url("/b")); got != 2 {
+		t.Errorf("expected 2 links, got: %d", got)
+	}
+	if got := countRows(t, "select count(1) from link_sightings where src = $1", site.Url("/")); got != 2 {
+		t.Errorf("expected 2 link sightings, got: %d", got)
+	}
+
+	for path, title := range map[string]string{"/": "Home", "/a": "A", "/b": ""} {
+		u := readArchivedUrl(t, site.Url(path))
+		if u.Status != http.StatusOK || u.LastGet == nil {
+			t.Errorf("%s expected a successful GET, got status %d", path, u.Status)
+		}
+		if u.Title != title {
+			t.Errorf("%s title mismatch. expected: %s, got: %s", path, title, u.Title)
+		}
+		if got := len(site.Requests(path)); got != 1 {
+			t.Errorf("%s expected to be requested once, got: %d", path, got)
+		}
+	}
+}
+
+func TestHarnessArchiveRedirects(t *testing.T) {
+	site := newTestSite(t, map[string]*testPage{
+		"/old":   {RedirectTo: "/older"},
+		"/older": {RedirectTo: "/new"},
+		"/new":   {Body: `<html><head><title>New</title></head><body></body></html>`},
+	})
+	defer site.Close()
+
+	tr := runArchiveJob(t, site.svc, site.Url("/old"))
+	if types := tr.Types(); len(types) == 0 || types[0] != "URL_ARCHIVE_SUCCESS" {
+		t.Fatalf("unexpected transcript: %v", types)
+	}
+
+	// the requested url records the response at the end of the chain
+	u := readArchivedUrl(t, site.Url("/old"))
+	if u.Status != http.StatusOK || u.Title != "New" {
+		t.Errorf("expected redirect to be followed, got: %d %s", u.Status, u.Title)
+	}
+	for _, path := range []string{"/old", "/older", "/new"} {
+		if got := len(site.Requests(path)); got != 1 {
+			t.Errorf("%s expected to be requested once, got: %d", path, got)
+		}
+	}
+}
+
+func TestHarnessArchiveRobotsSitemap(t *testing.T) {
+	site := newTestSite(t, map[string]*testPage{
+		"/sitemap.xml": {ContentType: "application/xml", Body: `<urlset><url><loc>{{site}}/a</loc></url></urlset>`},
+		"/a":           {Body: `<html><body>a</body></html>`},
+	})
+	site.Robots("User-agent: *\nDisallow: /private\nSitemap: " + site.Url("/sitemap.xml"))
+	defer site.Close()
+
+	runArchiveJob(t, site.svc, site.Url("/robots.txt"))
+
+	// robots.txt leads to it's sitemap, & the sitemap to it's pages
+	if got := countRows(t, "select count(1) from links where src = $1 and dst = $2 and extractor = 'robots'", site.Url("/robots.txt"), site.Url("/sitemap.xml")); got != 1 {
+		t.Errorf("expected a link from robots.txt to the sitemap, got: %d", got)
+	}
+	if got := len(site.Requests("/sitemap.xml")); got != 1 {
+		t.Errorf("expected sitemap to be followed from robots.txt, got %d requests", got)
+	}
+}
+
+func TestHarnessArchiveRefetch(t *testing.T) {
+	site := newTestSite(t, map[string]*testPage{
+		"/data": {Body: "data", ContentType: "text/plain", ETag: `"v1"`},
+	})
+	defer site.Close()
+
+	runArchiveJob(t, site.svc, site.Url("/data"))
+	// archiving again before the capture is stale doesn't refetch it
+	runArchiveJob(t, site.svc, site.Url("/data"))
+	if got := len(site.Requests("/data")); got != 1 {
+		t.Fatalf("expected a fresh capture not to be refetched, got %d requests", got)
+	}
+	if got := countRows(t, "select count(1) from archive_requests where url = $1", site.Url("/data")); got != 2 {
+		t.Errorf("expected both archive requests to be recorded, got: %d", got)
+	}
+
+	u := readArchivedUrl(t, site.Url("/data"))
+	if u.HeadersMap()["Etag"] != `"v1"` {
+		t.Errorf("expected etag to be recorded, got: %v", u.HeadersMap())
+	}
+
+	// once stale it's fetched again
+	stale := time.Now().Add(-2 * core.StaleDuration)
+	u.LastGet = &stale
+	if err := u.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	runArchiveJob(t, site.svc, site.Url("/data"))
+	reqs := site.Requests("/data")
+	if len(reqs) != 2 {
+		t.Fatalf("expected a stale capture to be refetched, got %d requests", len(reqs))
+	}
+	// the refetch is conditional on the recorded etag, & the unchanged
+	// capture stands
+	if got := reqs[1].Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("expected refetch to send the recorded etag, got: %q", got)
+	}
+	u = readArchivedUrl(t, site.Url("/data"))
+	if u.LastGet == nil || u.LastGet.Before(stale.Add(core.StaleDuration)) {
+		t.Errorf("expected refetch to update last get, got: %v", u.LastGet)
+	}
+	if u.Status != http.StatusOK || u.ContentLength != int64(len("data")) {
+		t.Errorf("expected a not modified response to keep the capture, got: %d %d", u.Status, u.ContentLength)
+	}
+
+	// changed content is captured again
+	site.Page("/data", &testPage{Body: "new data", ContentType: "text/plain", ETag: `"v2"`})
+	u.LastGet = &stale
+	if err := u.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	runArchiveJob(t, site.svc, site.Url("/data"))
+	if got := len(site.Requests("/data")); got != 3 {
+		t.Fatalf("expected a stale capture to be refetched, got %d requests", got)
+	}
+	u = readArchivedUrl(t, site.Url("/data"))
+	if u.HeadersMap()["Etag"] != `"v2"` || u.ContentLength != int64(len("new data")) {
+		t.Errorf("expected changed content to be captured, got: %v %d", u.HeadersMap(), u.ContentLength)
+	}
+}
+
+func TestHarnessArchiveRobotsDenied(t *testing.T) {
+	site := newTestSite(t, map[string]*testPage{
+		"/":          {Body: `<html><body><a href="/public">public</a><a href="/private/a">private</a></body></html>`},
+		"/public":    {Body: `<html><body>public</body></html>`},
+		"/private/a": {Body: `<html><body>a</body></html>`},
+		"/private/b": {Body: `<html><body>b</body></html>`},
+	})
+	site.Robots("User-agent: *\nDisallow: /private\n")
+	site.SourceMeta(t, `{"obeyRobots": true}`)
+	defer site.Close()
+
+	// archiving a disallowed url fails without fetching it
+	tr := runArchiveJob(t, site.svc, site.Url("/private/b"))
+	if errs := tr.Find("URL_ARCHIVE_ERROR"); len(errs) != 1 || errs[0].Error != ErrRobotsDisallowed.Error() {
+		t.Errorf("expected archiving a disallowed url to fail, got: %v", tr.Types())
+	}
+	if got := len(site.Requests("/private/b")); got != 0 {
+		t.Errorf("expected a disallowed url not to be requested, got: %d", got)
+	}
+
+	// allowed links are followed, disallowed ones aren't
+	tr = runArchiveJob(t, site.svc, site.Url("/"))
+	if types := tr.Types(); len(types) == 0 || types[0] != "URL_ARCHIVE_SUCCESS" {
+		t.Fatalf("unexpected transcript: %v", types)
+	}
+	if errs := tr.Find("URL_SET_ERROR"); len(errs) != 1 {
+		t.Errorf("expected following the disallowed link to fail, got: %v", tr.Types())
+	}
+	for path, count := range map[string]int{"/": 1, "/public": 1, "/private/a": 0, "/robots.txt": 1} {
+		if got := len(site.Requests(path)); got != count {
+			t.Errorf("%s expected %d requests, got: %d", path, count, got)
+		}
+	}
+}
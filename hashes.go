@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/lib/pq"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// hashes checked per query
+	haveHashesBatchSize = 1000
+	// most hashes a single missing hashes request can check
+	maxMissingHashes = 100000
+	// longest hash accepted, hex multihashes of sha2-256 are 68 characters
+	maxHashLength = 128
+)
+
+// defaultHashAlgorithm is the multihash algorithm content is hashed with unless
+// configured otherwise. core hashes urls & metadata with it regardless
+const defaultHashAlgorithm = "sha2-256"
+
+// hashAlgorithms are the algorithms content can be hashed with, by multihash name
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha2-256": sha256.New,
+	"blake2b-256": func() hash.Hash {
+		// only errors for keys longer than 64 bytes
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+}
+
+// contentHashAlgorithm is the algorithm new content is hashed with, set from
+// cfg.ContentHashAlgorithm. content hashed with anything else can be re-hashed
+// with a rehash job, see rehash.go
+var contentHashAlgorithm = defaultHashAlgorithm
+
+// setContentHashAlgorithm sets the algorithm new content is hashed with,
+// defaulting to defaultHashAlgorithm if name is empty
+func setContentHashAlgorithm(name string) error {
+	if name == "" {
+		name = defaultHashAlgorithm
+	}
+	if hashAlgorithms[name] == nil {
+		return fmt.Errorf("unsupported content hash algorithm: %s", name)
+	}
+	contentHashAlgorithm = name
+	return nil
+}
+
+// contentHasher is a hash that sums to a hex multihash
+type contentHasher struct {
+	hash.Hash
+	alg string
+}
+
+// newContentHasher creates a hasher for a multihash algorithm name
+func newContentHasher(alg string) (*contentHasher, error) {
+	newHash := hashAlgorithms[alg]
+	if newHash == nil {
+		return nil, fmt.Errorf("unsupported content hash algorithm: %s", alg)
+	}
+	return &contentHasher{Hash: newHash(), alg: alg}, nil
+}
+
+// Multihash returns the hex-encoded multihash of everything written so far
+func (h *contentHasher) Multihash() (string, error) {
+	mhBuf, err := multihash.EncodeName(h.Sum(nil), h.alg)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(mhBuf), nil
+}
+
+// hashAlgorithm reads the name of the algorithm a hex multihash was made with
+func hashAlgorithm(hash string) (string, error) {
+	buf, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", err
+	}
+	dec, err := multihash.Decode(buf)
+	if err != nil {
+		return "", err
+	}
+	if hashAlgorithms[dec.Name] == nil {
+		return "", fmt.Errorf("unsupported content hash algorithm: %s", dec.Name)
+	}
+	return dec.Name, nil
+}
+
+// contentStore is implemented by datastores that hold content by it's hash.
+// HaveHashes checks them for hashes the database doesn't know about
+type contentStore interface {
+	HasContent(hash string) (bool, error)
+}
+
+// HaveHashes reports which of a list of content hashes have been captured, in
+// batches of haveHashesBatchSize. hashes are looked up in the urls & snapshots
+// hash indexes & hash aliases, & in the datastore if it holds content. hashes that aren't
+// captured are false in the returned map
+func HaveHashes(db sqlQueryable, store datastore.Datastore, hashes []string) (map[string]bool, error) {
+	have := make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		have[h] = false
+	}
+
+	for start := 0; start < len(hashes); start += haveHashesBatchSize {
+		end := start + haveHashesBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		// aliases are only recorded for content that's been captured
+		rows, err := db.Query(`select hash from urls where hash = any($1) union select hash from snapshots where hash = any($1)
+			union select old from hash_aliases where old = any($1) union select new from hash_aliases where new = any($1)`, pq.Array(hashes[start:end]))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var hash string
+			if err := rows.Scan(&hash); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			have[hash] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cs, ok := store.(contentStore); ok {
+		for hash, ok := range have {
+			if ok {
+				continue
+			}
+			found, err := cs.HasContent(hash)
+			if err != nil {
+				return nil, err
+			}
+			have[hash] = found
+		}
+	}
+	return have, nil
+}
+
+// validHash checks a hash is hex of a sensible length
+func validHash(hash string) bool {
+	if hash == "" || len(hash) > maxHashLength {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// MissingHashesHandler lists missing hashes with the default service, see Service.MissingHashesHandler
+func MissingHashesHandler(w http.ResponseWriter, r *http.Request) {
+	defaultService().MissingHashesHandler(w, r)
+}
+
+// MissingHashesHandler accepts a newline-delimited list of content hashes
+// (POST) & streams back the ones that haven't been captured, one per line, so
+// importers can skip sending content that's already archived. hashes are
+// checked haveHashesBatchSize at a time, so memory use doesn't depend on the
+// size of the list. lists of more than maxMissingHashes are rejected. a list
+// that turns out to be invalid after streaming has started aborts the
+// response, a truncated list of missing hashes would read as having the rest
+func (s *Service) MissingHashesHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.adminConfigured(w) {
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	maxBytes := int64(maxMissingHashes * (maxHashLength + 2))
+	if r.ContentLength > maxBytes {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("lists are limited to %d hashes", maxMissingHashes)})
+		return
+	}
+
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxBytes))
+	batch := make([]string, 0, haveHashesBatchSize)
+	count := 0
+	started := false
+	// fail responds with an error, or aborts the response if it's started
+	fail := func(status int, err error) {
+		s.Log.Infof("missing hashes: %s", err.Error())
+		if started {
+			panic(http.ErrAbortHandler)
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+	}
+	flush := func() bool {
+		have, err := HaveHashes(s.DB, s.Store, batch)
+		if err != nil {
+			fail(http.StatusInternalServerError, err)
+			return false
+		}
+		if !started {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		for _, hash := range batch {
+			if !have[hash] {
+				fmt.Fprintln(w, hash)
+			}
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		batch = batch[:0]
+		return true
+	}
+
+	for scanner.Scan() {
+		hash := strings.TrimSpace(scanner.Text())
+		if hash == "" {
+			continue
+		}
+		count++
+		if count > maxMissingHashes {
+			fail(http.StatusRequestEntityTooLarge, fmt.Errorf("lists are limited to %d hashes", maxMissingHashes))
+			return
+		}
+		if !validHash(hash) {
+			fail(http.StatusBadRequest, fmt.Errorf("hash %d isn't a valid hex hash", count))
+			return
+		}
+		if batch = append(batch, hash); len(batch) == haveHashesBatchSize && !flush() {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	if len(batch) > 0 || !started {
+		flush()
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestValidHash(t *testing.T) {
+	cases := []struct {
+		hash   string
+		expect bool
+	}{
+		{"1220459219b10032cc86dcdbc0f83aea15a9d3e1119e7b5170beaee233008ea2c2de", true},
+		{"1220ABCDEF", true},
+		{"", false},
+		{"1220'; drop table urls; --", false},
+		{strings.Repeat("a", maxHashLength+1), false},
+	}
+	for i, c := range cases {
+		if got := validHash(c.hash); got != c.expect {
+			t.Errorf("case %d expected %t, got: %t", i, c.expect, got)
+		}
+	}
+}
+
+// memContentStore is a datastore that holds content by hash
+type memContentStore struct {
+	datastore.Datastore
+	content map[string]bool
+}
+
+func (s memContentStore) HasContent(hash string) (bool, error) {
+	return s.content[hash], nil
+}
+
+func TestHaveHashes(t *testing.T) {
+	defer resetTestData(appDB, "urls", "snapshots")
+	const (
+		current = "1220459219b10032cc86dcdbc0f83aea15a9d3e1119e7b5170beaee233008ea2c2de"
+		older   = "1220aaaa000000000000000000000000000000000000000000000000000000000001"
+	)
+	if _, err := appDB.Exec("insert into snapshots (url,created,status,hash) values ('http://www.epa.gov', now(), 200, $1)", older); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// enough hashes to need more than one batch
+	hashes := []string{current, older}
+	for i := 0; i < haveHashesBatchSize*2; i++ {
+		hashes = append(hashes, fmt.Sprintf("1220bbbb%060d", i))
+	}
+	have, err := HaveHashes(appDB, store, hashes)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(have) != len(hashes) {
+		t.Errorf("expected an answer for each of %d hashes, got: %d", len(hashes), len(have))
+	}
+	if !have[current] || !have[older] {
+		t.Errorf("expected current & older captures to be had")
+	}
+	for _, h := range hashes[2:] {
+		if have[h] {
+			t.Errorf("expected %s to be missing", h)
+			break
+		}
+	}
+
+	// stores that hold content are checked for hashes the database doesn't have
+	have, err = HaveHashes(appDB, memContentStore{store, map[string]bool{hashes[2]: true}}, hashes)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !have[current] || !have[hashes[2]] || have[hashes[3]] {
+		t.Errorf("expected content store to be checked for missing hashes")
+	}
+}
+
+func TestMissingHashesHandler(t *testing.T) {
+	defer resetTestData(appDB, "urls")
+	// admin endpoints are refused while http auth isn't configured
+	w := httptest.NewRecorder()
+	NewService(appDB, store, &config{}).MissingHashesHandler(w, httptest.NewRequest("POST", "/admin/hashes/missing", strings.NewReader("")))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected unconfigured http auth to be refused, got: %d", w.Code)
+	}
+
+	svc := newTestService()
+	svc.Config.HttpAuthUsername, svc.Config.HttpAuthPassword = "admin", "admin"
+
+	const have = "1220459219b10032cc86dcdbc0f83aea15a9d3e1119e7b5170beaee233008ea2c2de"
+	missing := []string{}
+	for i := 0; i < haveHashesBatchSize+10; i++ {
+		missing = append(missing, fmt.Sprintf("1220cccc%060d", i))
+	}
+	body := have + "\n\n" + strings.Join(missing, "\r\n") + "\n"
+
+	cases := []struct {
+		method, body string
+		status       int
+		lines        int
+	}{
+		{"GET", "", http.StatusMethodNotAllowed, 0},
+		{"POST", "", http.StatusOK, 0},
+		{"POST", have, http.StatusOK, 0},
+		{"POST", body, http.StatusOK, len(missing)},
+		{"POST", "not a hash\n", http.StatusBadRequest, 0},
+	}
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		svc.MissingHashesHandler(w, httptest.NewRequest(c.method, "/admin/hashes/missing", strings.NewReader(c.body)))
+		if w.Code != c.status {
+			t.Errorf("case %d expected status %d, got: %d %s", i, c.status, w.Code, w.Body.String())
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		lines := strings.Fields(w.Body.String())
+		if len(lines) != c.lines {
+			t.Errorf("case %d expected %d missing hashes, got: %d", i, c.lines, len(lines))
+		}
+		for _, l := range lines {
+			if l == have {
+				t.Errorf("case %d: expected %s not to be listed as missing", i, have)
+			}
+		}
+	}
+}
+
+func TestContentHashAlgorithms(t *testing.T) {
+	defer setContentHashAlgorithm("")
+	data := []byte("hello")
+
+	cases := []struct {
+		alg    string
+		prefix string
+		err    bool
+	}{
+		{"", "1220", false},
+		{"sha2-256", "1220", false},
+		{"blake2b-256", "a0e40220", false},
+		{"md5", "", true},
+	}
+	for i, c := range cases {
+		if err := setContentHashAlgorithm(c.alg); (err != nil) != c.err {
+			t.Errorf("case %d expected error %t, got: %v", i, c.err, err)
+			continue
+		} else if c.err {
+			continue
+		}
+		hash, err := hashContent(data)
+		if err != nil {
+			t.Errorf("case %d: %s", i, err.Error())
+			continue
+		}
+		if !strings.HasPrefix(hash, c.prefix) {
+			t.Errorf("case %d expected a multihash starting %s, got: %s", i, c.prefix, hash)
+		}
+		// hashes made under any algorithm can still be checked
+		alg, err := hashAlgorithm(hash)
+		if err != nil {
+			t.Errorf("case %d: %s", i, err.Error())
+			continue
+		}
+		if again, err := hashContentLike(hash, data); err != nil || again != hash {
+			t.Errorf("case %d expected to re-hash %s with %s, got: %s %v", i, hash, alg, again, err)
+		}
+	}
+
+	if _, err := hashAlgorithm("not a hash"); err == nil {
+		t.Errorf("expected invalid hashes to error")
+	}
+}
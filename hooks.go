@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// Archive hooks
+//
+// POST /hooks/archive lets CI pipelines & CMS publish hooks archive a page
+// without speaking the websocket protocol. Requests authenticate with an api
+// key issued with the archive scope, & go through the same checks as
+// archiving from the webapp: maintenance, redaction, subprimers, the
+// bandwidth cap & the subprimer access of the user the key acts for. each
+// key is limited to HookArchivesPerMinute requests, apart from the limits on
+// interactive archiving.
+//
+// Every request carries an idempotency key. requests repeating a key the api
+// key has used before aren't archived again, they're answered with the
+// archive request the key was first used for. When a request names a
+// callback, the archive's summary is POST'ed to it through the outbox once
+// the page & the links it references have been fetched, so callbacks that are
+// down are retried
+
+const (
+	// most archive hook requests waiting to be processed
+	hookArchiveQueueSize = 64
+	// longest idempotency key accepted
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	// ErrHooksDisabled is returned for archive hook requests when they're turned off
+	ErrHooksDisabled = fmt.Errorf("archive hooks aren't available")
+	// ErrIdempotencyKeyRequired is returned for archive hook requests without a usable idempotency key
+	ErrIdempotencyKeyRequired = fmt.Errorf("archive hook requests need an idempotencyKey of at most %d characters", maxIdempotencyKeyLength)
+	// ErrIdempotencyKeyReused is returned when an idempotency key is repeated for a different url
+	ErrIdempotencyKeyReused = fmt.Errorf("this idempotencyKey was already used to archive a different url")
+	// ErrHookRateLimit is returned once an api key has used up it's archive hook requests for the minute
+	ErrHookRateLimit = fmt.Errorf("too many archive hook requests, please slow down")
+	// ErrHookBusy is returned when the archive hook queue is full
+	ErrHookBusy = fmt.Errorf("too many archive hook requests are waiting to be processed, please try again in a few minutes")
+)
+
+// hookLimits limits archive hook requests per api key. set when the server starts
+var hookLimits *rateLimiter
+
+// HookArchiveRequest is the body of an archive hook request
+type HookArchiveRequest struct {
+	Url string `json:"url"`
+	// url the archive's summary is POST'ed to once it's finished, if any
+	Callback       string `json:"callback"`
+	IdempotencyKey string `json:"idempotencyKey"`
+}
+
+// HookArchiveResponse answers an archive hook request
+type HookArchiveResponse struct {
+	// id of the archive request, clients can follow it's progress by
+	// subscribing to subject
+	Id      int64  `json:"id"`
+	Subject string `json:"subject"`
+	Url     string `json:"url"`
+	// set when the idempotency key was used before, & nothing new was archived
+	Replayed bool `json:"replayed"`
+}
+
+// HookArchiveResult is POST'ed to a request's callback once it's archive finishes
+type HookArchiveResult struct {
+	Id             int64  `json:"id"`
+	IdempotencyKey string `json:"idempotencyKey"`
+	Url            string `json:"url"`
+	// summary of what was captured, nil if the page couldn't be fetched
+	Summary *ArchiveSummary `json:"summary"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// readHookArchive reads the archive request an api key first used an
+// idempotency key for, returning ErrNotFound if it hasn't used it
+func readHookArchive(db *sql.DB, apiKeyId, idempotencyKey string) (id int64, url string, err error) {
+	err = db.QueryRow("select archive_request_id, url from hook_archives where api_key_id = $1 and idempotency_key = $2",
+		apiKeyId, idempotencyKey).Scan(&id, &url)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+// reserveHookArchive records the archive request an idempotency key is used
+// for, reporting false if the key was used concurrently
+func reserveHookArchive(db *sql.DB, apiKeyId string, req *HookArchiveRequest, url string, id int64, now time.Time) (bool, error) {
+	res, err := db.Exec(`insert into hook_archives (api_key_id,idempotency_key,created,url,callback,archive_request_id)
+		values ($1, $2, $3, $4, $5, $6) on conflict do nothing`,
+		apiKeyId, req.IdempotencyKey, now.Round(time.Second).In(time.UTC), url, req.Callback, id)
+	if err = checkWriteErr(err); err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// hookArchiveJob is an archive hook request waiting to be processed
+type hookArchiveJob struct {
+	svc *Service
+	// key id of the user the api key acts for
+	keyId          string
+	id             int64
+	idempotencyKey string
+	callback       string
+	url            *core.Url
+}
+
+// hookArchiveQueue holds archive hook requests, processed one at a time
+var hookArchiveQueue = make(chan *hookArchiveJob, hookArchiveQueueSize)
+
+// runHookArchives processes archive hook requests one at a time
+func runHookArchives() {
+	for job := range hookArchiveQueue {
+		job.run()
+	}
+}
+
+// run GET's the requested url & the links it references, publishing progress
+// to the request's subject & calling back with the result
+func (j *hookArchiveJob) run() {
+	res := &HookArchiveResult{Id: j.id, IdempotencyKey: j.idempotencyKey, Url: j.url.Url}
+	defer j.callBack(res)
+
+	manifest := j.svc.jobManifest(j.url.Url, nil)
+	class := archiveRetention(j.keyId)
+	j.publish("URL_SET_LOADING", false, map[string]interface{}{"url": j.url.Url, "loading": true})
+	prev := j.url.Hash
+	_, links, err := j.svc.getRetained(j.url, nil, class)
+	if err != nil {
+		j.svc.Log.Info(err.Error())
+		j.publish("URL_SET_ERROR", false, map[string]interface{}{"url": j.url.Url, "error": err.Error()})
+		res.Error = err.Error()
+		return
+	}
+	j.publish("URL_SET_SUCCESS", j.url.Hash != prev, map[string]interface{}{"url": j.url.Url, "success": true})
+
+	fetched := 0
+	for _, l := range links {
+		// urls outside of all subprimers aren't followed
+		if isOrphaned(l.Dst) {
+			continue
+		}
+		time.Sleep(j.svc.FollowDelay)
+		if _, _, err := j.svc.getRetained(l.Dst, nil, class); err != nil {
+			j.svc.Log.Info(err.Error())
+		} else {
+			fetched++
+		}
+	}
+	j.svc.summarizeArchive(j.url, manifest, len(links), fetched)
+
+	res.Summary = &ArchiveSummary{
+		Url:           j.url.Url,
+		ContentHash:   j.url.Hash,
+		ContentLength: j.url.ContentLength,
+		ContentType:   j.url.ContentType,
+		Status:        j.url.Status,
+		Links:         len(links),
+		LinksFetched:  fetched,
+		Manifest:      manifest,
+	}
+}
+
+// callBack queues a finished archive's result for the request's callback, if
+// any. callbacks are delivered as outbox webhooks, which are guarded against
+// internal addresses
+func (j *hookArchiveJob) callBack(res *HookArchiveResult) {
+	if j.callback == "" {
+		return
+	}
+	if err := queueHookCallback(j.svc.DB, j.callback, res, j.svc.Clock()); err != nil {
+		j.svc.Log.Infof("error queueing callback for archive request %d: %s", j.id, err.Error())
+	}
+}
+
+// queueHookCallback writes a callback to the outbox
+func queueHookCallback(db *sql.DB, url string, res *HookArchiveResult, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return checkWriteErr(err)
+	}
+	defer tx.Rollback()
+	if err := enqueueOutbox(tx, outboxWebhook, url, res, now); err != nil {
+		return checkWriteErr(err)
+	}
+	return checkWriteErr(tx.Commit())
+}
+
+// publish sends progress to every client subscribed to the request's subject
+func (j *hookArchiveJob) publish(typ string, changed bool, data interface{}) {
+	j.svc.publishArchiveProgress(j.id, typ, changed, data)
+}
+
+// HookArchiveHandler serves POST /hooks/archive with the default service
+func HookArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	defaultService().serveHookArchive(w, r)
+}
+
+// serveHookArchive validates & queues an archive hook request
+func (s *Service) serveHookArchive(w http.ResponseWriter, r *http.Request) {
+	if s.Config == nil || s.Config.HookArchivesPerMinute <= 0 || s.HookLimits == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": ErrHooksDisabled.Error()})
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, err := authenticateApiKey(s.DB, bearerToken(r), apiScopeArchive)
+	if err == ErrInvalidApiKey {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	} else if err == ErrApiKeyScope {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+
+	req := &HookArchiveRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	req.IdempotencyKey = strings.TrimSpace(req.IdempotencyKey)
+	req.Callback = strings.TrimSpace(req.Callback)
+	if req.IdempotencyKey == "" || len(req.IdempotencyKey) > maxIdempotencyKeyLength {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": ErrIdempotencyKeyRequired.Error()})
+		return
+	}
+	if req.Callback != "" {
+		if err := validWebhookUrl(req.Callback, s.Egress.allowInternal); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	// redact before anything else so the original url is never logged or stored
+	url, redacted, err := s.RedactArchivingUrl(req.Url)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// replays are answered before they count towards the rate limit
+	if id, prev, err := readHookArchive(s.DB, key.Id, req.IdempotencyKey); err == nil {
+		if prev != url {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": ErrIdempotencyKeyReused.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, &HookArchiveResponse{Id: id, Subject: archiveRequestSubject(id), Url: url, Replayed: true})
+		return
+	} else if err != ErrNotFound {
+		s.Log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+
+	// the key's budget isn't spent while the archive can't take requests
+	refusal, err := rateLimits.admit(s, limitKeys{limitScopeApiKey: key.Id}, s.Clock(), limitBandwidthCap, limitGuardrails, limitHookArchives)
+	if err != nil {
+		s.writeHookError(w, err)
+		return
+	}
+	if refusal != nil {
+		refusal.logUserAction(s.DB, key.KeyId, s.Clock())
+		refusal.write(w)
+		return
+	}
+	if status := maintenance.Status(); status != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"error": ErrMaintenanceMode.Error(), "code": maintenanceErrCode, "maintenance": status})
+		return
+	}
+	if err := s.ValidArchivingUrl(url); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.checkArchiveAccess(url, key.KeyId); err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	}
+	err = key.checkUrl(s.DB, url)
+	logApiKeyAction(s.DB, key.Id, "POST /hooks/archive", url, err == nil, err, s.Clock())
+	if err == ErrApiKeySubprimer {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": err.Error(), "code": apiKeyScopeErrCode, "apiKey": key.scope()})
+		return
+	} else if err != nil {
+		s.writeHookError(w, err)
+		return
+	}
+
+	id, err := s.recordArchiveRequest(url, archiveRequester{userId: key.KeyId, requester: key.Id})
+	if err != nil {
+		s.writeHookError(w, err)
+		return
+	}
+	reserved, err := reserveHookArchive(s.DB, key.Id, req, url, id, s.Clock())
+	if err != nil {
+		s.writeHookError(w, err)
+		return
+	}
+	if !reserved {
+		// the idempotency key was used concurrently, answer with the request that won
+		id, _, err := readHookArchive(s.DB, key.Id, req.IdempotencyKey)
+		if err != nil {
+			s.writeHookError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &HookArchiveResponse{Id: id, Subject: archiveRequestSubject(id), Url: url, Replayed: true})
+		return
+	}
+	u, err := s.readOrCreateUrl(url, redacted)
+	if err != nil {
+		s.writeHookError(w, err)
+		return
+	}
+
+	select {
+	case hookArchiveQueue <- &hookArchiveJob{svc: s, keyId: key.KeyId, id: id, idempotencyKey: req.IdempotencyKey, callback: req.Callback, url: u}:
+	default:
+		// free the idempotency key so the request can be retried
+		if _, err := s.DB.Exec("delete from hook_archives where api_key_id = $1 and idempotency_key = $2", key.Id, req.IdempotencyKey); err != nil {
+			s.Log.Info(err.Error())
+		}
+		w.Header().Set("Retry-After", "60")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": ErrHookBusy.Error()})
+		return
+	}
+
+	s.Log.Infof("archiving %s for api key %s", url, key.Id)
+	writeJSON(w, http.StatusAccepted, &HookArchiveResponse{Id: id, Subject: archiveRequestSubject(id), Url: url})
+}
+
+// writeHookError responds to an archive hook request that failed to write, or
+// was for a url that can't be archived
+func (s *Service) writeHookError(w http.ResponseWriter, err error) {
+	if err == ErrMaintenanceMode {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"error": err.Error(), "code": maintenanceErrCode, "maintenance": maintenance.Status()})
+		return
+	}
+	if rejectedForArchiving(err) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	s.Log.Info(err.Error())
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+}
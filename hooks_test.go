@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookArchiveDisabled(t *testing.T) {
+	svc := NewService(nil, nil, &config{})
+	w := httptest.NewRecorder()
+	svc.serveHookArchive(w, httptest.NewRequest("POST", "/hooks/archive", strings.NewReader(`{}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected archive hooks to be disabled, got: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHookArchive(t *testing.T) {
+	site := newTestSite(t, map[string]*testPage{
+		"/":  {Body: `<html><head><title>Published</title></head><body><a href="/a">a</a></body></html>`},
+		"/a": {Body: `<html><head><title>A</title></head><body></body></html>`},
+	})
+	defer site.Close()
+	svc := site.svc
+	svc.Config.HookArchivesPerMinute = 2
+	svc.HookLimits = newRateLimiter(2, time.Minute)
+	defer resetTestData(appDB, "api_keys", "hook_archives", "outbox")
+	defer svc.DB.Exec("delete from archive_requests where url like $1", site.URL+"%")
+
+	callbacks := make(chan *HookArchiveResult, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		res := &HookArchiveResult{}
+		json.Unmarshal(data, res)
+		callbacks <- res
+	}))
+	defer callback.Close()
+
+	_, token, err := CreateApiKey(svc.DB, "key", "ci", []string{apiScopeArchive}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	const unscoped = apiKeyTokenPrefix + "unscoped"
+	if _, err := svc.DB.Exec("insert into api_keys (id,created,key_id,token_hash,scopes) values ('0c8e3f9a-51a6-4f0e-9d53-53b8e7b6a0b4', now(), 'key', $1, '')", hashApiKeyToken(unscoped)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	post := func(token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/hooks/archive", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		svc.serveHookArchive(w, r)
+		return w
+	}
+	page := site.Url("/")
+	hook := `{"url":"` + page + `","idempotencyKey":"deploy-1","callback":"` + callback.URL + `"}`
+
+	cases := []struct {
+		token, body string
+		status      int
+	}{
+		{"", hook, http.StatusUnauthorized},
+		{unscoped, hook, http.StatusForbidden},
+		{token, `{"url":"` + page + `"}`, http.StatusBadRequest},
+		{token, `{"url":"` + page + `","idempotencyKey":"deploy-0","callback":"ftp://example.com"}`, http.StatusBadRequest},
+		{token, `{"url":"http://not.a.subprimer.gov","idempotencyKey":"deploy-0"}`, http.StatusUnprocessableEntity},
+	}
+	for i, c := range cases {
+		if w := post(c.token, c.body); w.Code != c.status {
+			t.Errorf("case %d expected status %d, got: %d %s", i, c.status, w.Code, w.Body.String())
+		}
+	}
+
+	w := post(token, hook)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected archive hook to be accepted, got: %d %s", w.Code, w.Body.String())
+	}
+	accepted := &HookArchiveResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), accepted); err != nil {
+		t.Fatal(err.Error())
+	}
+	if accepted.Id == 0 || accepted.Subject != archiveRequestSubject(accepted.Id) || accepted.Replayed {
+		t.Errorf("expected response to carry the archive request, got: %s", w.Body.String())
+	}
+
+	// replays are answered with the first request, & don't count towards the rate limit
+	w = post(token, hook)
+	replayed := &HookArchiveResponse{}
+	json.Unmarshal(w.Body.Bytes(), replayed)
+	if w.Code != http.StatusOK || !replayed.Replayed || replayed.Id != accepted.Id {
+		t.Errorf("expected replay to return archive request %d, got: %d %s", accepted.Id, w.Code, w.Body.String())
+	}
+	if w := post(token, `{"url":"`+site.Url("/a")+`","idempotencyKey":"deploy-1"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected reusing an idempotency key for another url to conflict, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := post(token, `{"url":"`+site.Url("/a")+`","idempotencyKey":"deploy-2"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected third request in a minute to be rate limited, got: %d %s", w.Code, w.Body.String())
+	}
+	if n := len(hookArchiveQueue); n != 1 {
+		t.Fatalf("expected 1 queued archive, got: %d", n)
+	}
+
+	job := <-hookArchiveQueue
+	job.run()
+	// callbacks are sent from the outbox
+	drainOutbox(t, newOutboxWorker(svc.DB, outboxWebhook, webhookSender(newWebhookClient(true))))
+	select {
+	case res := <-callbacks:
+		if res.Id != accepted.Id || res.IdempotencyKey != "deploy-1" || res.Error != "" {
+			t.Errorf("unexpected callback: %#v", res)
+		} else if res.Summary == nil || res.Summary.Status != 200 || res.Summary.Links != 1 || res.Summary.LinksFetched != 1 {
+			t.Errorf("expected callback to summarize the page & it's link, got: %#v", res.Summary)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected the callback to be called")
+	}
+	if reqs := site.Requests("/a"); len(reqs) != 1 {
+		t.Errorf("expected linked page to be archived once, got: %d", len(reqs))
+	}
+}
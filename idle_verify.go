@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"encoding"
+	"expvar"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Idle verification
+//
+// Hashing a multi-gigabyte capture keeps the write auditor busy for minutes,
+// holding up every write queued behind it. captures of at least
+// cfg.IdleVerifyMinMB are queued in the idle_verifications table instead, & an
+// idle-priority worker verifies them only while crawl & serve bandwidth, as
+// counted by the bandwidth meter, are under cfg.IdleVerifyCrawlKBps &
+// cfg.IdleVerifyServeKBps. files are hashed in chunks & load is checked after
+// each one, so the worker yields within a chunk of load rising. how far it got
+// is checkpointed along with the hash's state, so pausing or restarting picks
+// up where it left off instead of hashing a huge file from the start again.
+// algorithms that can't save their state start over. results are reported the
+// same way as the write auditor's
+
+const (
+	// bytes hashed between load checks
+	idleVerifyChunkSize = 4 << 20
+	// bytes hashed between checkpoints while load stays low
+	idleVerifyCheckpointBytes = 256 << 20
+	// how often the worker checks for load to drop & new captures to verify
+	idleVerifyPollInterval = 10 * time.Second
+	// shortest window bandwidth rates are measured over
+	idleVerifyRateWindow = time.Second
+)
+
+// idleVerifyStats exposes idle verification counts at /debug/vars
+var idleVerifyStats = expvar.NewMap("idleVerify")
+
+// idleVerification is a large capture waiting to be verified
+type idleVerification struct {
+	Path string
+	Hash string
+	Size int64
+	// bytes hashed so far
+	Hashed int64
+	// saved state of the hash after Hashed bytes, nil if it couldn't be saved
+	State   []byte
+	Created time.Time
+	Updated time.Time
+}
+
+// idleVerificationCols are the columns of idle_verifications
+var idleVerificationCols = &columnSet{
+	table:   "idle_verifications",
+	columns: []string{"path", "hash", "size", "hashed", "state", "created", "updated"},
+}
+
+func (v *idleVerification) scanTargets() scanTargets {
+	return scanTargets{
+		"path":    &v.Path,
+		"hash":    &v.Hash,
+		"size":    &v.Size,
+		"hashed":  &v.Hashed,
+		"state":   &v.State,
+		"created": &v.Created,
+		"updated": &v.Updated,
+	}
+}
+
+// queueIdleVerification queues a capture for the idle verifier. queueing a
+// path again starts it's verification over
+func queueIdleVerification(db *sql.DB, path, hash string, size int64, now time.Time) error {
+	now = now.Round(time.Second).In(time.UTC)
+	_, err := db.Exec(`insert into idle_verifications (`+idleVerificationCols.String()+`) values ($1, $2, $3, 0, null, $4, $4)
+		on conflict (path) do update set hash = excluded.hash, size = excluded.size, hashed = 0, state = null, updated = excluded.updated`,
+		path, hash, size, now)
+	if err == nil {
+		idleVerifyStats.Add("queued", 1)
+	}
+	return err
+}
+
+// idleVerifier verifies queued captures while the instance is idle
+type idleVerifier struct {
+	db *sql.DB
+	// load reports crawl & serve bandwidth in bytes per second
+	load func() (crawl, serve float64)
+	// bandwidth at or above which verification pauses, in bytes per second
+	maxCrawl, maxServe float64
+	// captures at least this big are queued
+	minSize         int64
+	chunkSize       int64
+	checkpointBytes int64
+	now             func() time.Time
+	// guardrails pause verification while they're shedding background jobs
+	guardrails *guardrail
+}
+
+var idleVerify = &idleVerifier{
+	load:            bandwidthRates.rates,
+	maxCrawl:        512 << 10,
+	maxServe:        2048 << 10,
+	minSize:         256 << 20,
+	chunkSize:       idleVerifyChunkSize,
+	checkpointBytes: idleVerifyCheckpointBytes,
+	now:             time.Now,
+	guardrails:      guardrails,
+}
+
+// configure sets the verifier's database & thresholds from config
+func (v *idleVerifier) configure(db *sql.DB, c *config) {
+	v.db = db
+	v.minSize = int64(c.IdleVerifyMinMB) << 20
+	v.maxCrawl = float64(c.IdleVerifyCrawlKBps << 10)
+	v.maxServe = float64(c.IdleVerifyServeKBps << 10)
+}
+
+// idle checks load is low enough to verify, & the guardrail isn't shedding
+// background jobs
+func (v *idleVerifier) idle() bool {
+	crawl, serve := v.load()
+	return crawl < v.maxCrawl && serve < v.maxServe && v.guardrails.background()
+}
+
+// run verifies queued captures, one at a time, while the instance is idle
+func (v *idleVerifier) run() {
+	for {
+		if v.idle() {
+			found, err := v.next()
+			if err != nil {
+				log.Infof("error verifying large capture: %s", err.Error())
+			} else if found {
+				continue
+			}
+		}
+		time.Sleep(idleVerifyPollInterval)
+	}
+}
+
+// next works on the oldest queued capture until it's verified or load rises,
+// reporting weather there was one
+func (v *idleVerifier) next() (bool, error) {
+	job := &idleVerification{}
+	err := idleVerificationCols.scan(v.db.QueryRow("select "+idleVerificationCols.String()+" from idle_verifications order by created, path limit 1"), job.scanTargets())
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, err = v.verify(job)
+	return true, err
+}
+
+// verify hashes a capture from it's last checkpoint, reporting weather it
+// finished. unfinished captures are checkpointed
+func (v *idleVerifier) verify(job *idleVerification) (bool, error) {
+	alg, err := hashAlgorithm(job.Hash)
+	if err != nil {
+		return true, v.finish(job, "", err)
+	}
+	h, err := newContentHasher(alg)
+	if err != nil {
+		return true, v.finish(job, "", err)
+	}
+	if job.Hashed > 0 {
+		if u, ok := h.Hash.(encoding.BinaryUnmarshaler); ok && job.State != nil && u.UnmarshalBinary(job.State) == nil {
+			idleVerifyStats.Add("resumed", 1)
+		} else {
+			idleVerifyStats.Add("restarted", 1)
+			job.Hashed = 0
+		}
+	}
+
+	f, err := os.Open(job.Path)
+	if err != nil {
+		return true, v.finish(job, "", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(job.Hashed, io.SeekStart); err != nil {
+		return true, v.finish(job, "", err)
+	}
+
+	checkpointed := job.Hashed
+	for {
+		n, err := io.CopyN(h, f, v.chunkSize)
+		job.Hashed += n
+		idleVerifyStats.Add("bytes", n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return true, v.finish(job, "", err)
+		}
+
+		if !v.idle() {
+			idleVerifyStats.Add("paused", 1)
+			return false, v.checkpoint(job, h)
+		}
+		if job.Hashed-checkpointed >= v.checkpointBytes {
+			if err := v.checkpoint(job, h); err != nil {
+				return false, err
+			}
+			checkpointed = job.Hashed
+		}
+	}
+
+	got, err := h.Multihash()
+	return true, v.finish(job, got, err)
+}
+
+// checkpoint saves how far a capture has been hashed
+func (v *idleVerifier) checkpoint(job *idleVerification, h *contentHasher) error {
+	job.State = nil
+	if m, ok := h.Hash.(encoding.BinaryMarshaler); ok {
+		state, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		job.State = state
+	}
+	job.Updated = v.now().Round(time.Second).In(time.UTC)
+	_, err := v.db.Exec("update idle_verifications set hashed = $3, state = $4, updated = $5 where path = $1 and hash = $2",
+		job.Path, job.Hash, job.Hashed, job.State, job.Updated)
+	return err
+}
+
+// finish reports a capture's verification & removes it from the queue, unless
+// it's been queued again with another hash since
+func (v *idleVerifier) finish(job *idleVerification, got string, err error) error {
+	if err != nil {
+		writeAuditStats.Add("errors", 1)
+		log.Infof("error verifying capture %s: %s", job.Hash, err.Error())
+	} else {
+		idleVerifyStats.Add("verified", 1)
+		reportAudit("capture", job.Hash, got)
+	}
+	_, err = v.db.Exec("delete from idle_verifications where path = $1 and hash = $2", job.Path, job.Hash)
+	return err
+}
+
+// bandwidthRate measures crawl & serve bandwidth from the bandwidth meter's
+// counters, over windows of at least idleVerifyRateWindow
+type bandwidthRate struct {
+	sync.Mutex
+	now func() time.Time
+	// when counters were last read, & what they were
+	at              time.Time
+	crawled, served int64
+	// rates over the last full window, in bytes per second
+	crawl, serve float64
+}
+
+var bandwidthRates = &bandwidthRate{now: time.Now}
+
+// rates returns crawl & serve bandwidth in bytes per second
+func (r *bandwidthRate) rates() (crawl, serve float64) {
+	r.Lock()
+	defer r.Unlock()
+	now := r.now()
+	crawled, served := bandwidthCount(bandwidthCrawl), bandwidthCount(bandwidthServed)
+	if r.at.IsZero() {
+		r.at, r.crawled, r.served = now, crawled, served
+	} else if elapsed := now.Sub(r.at); elapsed >= idleVerifyRateWindow {
+		r.crawl = float64(crawled-r.crawled) / elapsed.Seconds()
+		r.serve = float64(served-r.served) / elapsed.Seconds()
+		r.at, r.crawled, r.served = now, crawled, served
+	}
+	return r.crawl, r.serve
+}
+
+// bandwidthCount reads the bytes of a kind of bandwidth this instance has counted
+func bandwidthCount(kind string) int64 {
+	if v, ok := bandwidthStats.Get(kind).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
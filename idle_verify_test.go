@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBandwidthRate(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &bandwidthRate{now: func() time.Time { return now }}
+
+	if crawl, serve := r.rates(); crawl != 0 || serve != 0 {
+		t.Errorf("expected the first read to prime counters, got: %f %f", crawl, serve)
+	}
+	bandwidthStats.Add(bandwidthCrawl, 4000)
+	bandwidthStats.Add(bandwidthServed, 1000)
+
+	// rates aren't measured over windows shorter than idleVerifyRateWindow
+	now = now.Add(idleVerifyRateWindow / 2)
+	if crawl, _ := r.rates(); crawl != 0 {
+		t.Errorf("expected rates to wait for a full window, got: %f", crawl)
+	}
+	now = now.Add(idleVerifyRateWindow * 3 / 2)
+	if crawl, serve := r.rates(); crawl != 2000 || serve != 500 {
+		t.Errorf("expected 2000 & 500 bytes per second, got: %f %f", crawl, serve)
+	}
+}
+
+func TestIdleVerifierResume(t *testing.T) {
+	defer resetTestData(appDB, "idle_verifications")
+	dir, err := ioutil.TempDir("", "idle_verify")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	const chunk = 1024
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10*chunk/16)
+	h, _ := newContentHasher(defaultHashAlgorithm)
+	h.Write(data)
+	hash, _ := h.Multihash()
+	path := filepath.Join(dir, hash)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := queueIdleVerification(appDB, path, hash, int64(len(data)), time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// load rises after the fourth chunk
+	checks, busyAfter := 0, 3
+	v := &idleVerifier{
+		db: appDB,
+		load: func() (float64, float64) {
+			checks++
+			if checks > busyAfter {
+				return 1000, 0
+			}
+			return 0, 0
+		},
+		maxCrawl:        100,
+		maxServe:        100,
+		chunkSize:       chunk,
+		checkpointBytes: 1 << 20,
+		now:             time.Now,
+		guardrails:      newGuardrail(),
+	}
+	if found, err := v.next(); !found || err != nil {
+		t.Fatalf("expected a queued capture, got: %t %v", found, err)
+	}
+	job := &idleVerification{}
+	if err := idleVerificationCols.scan(appDB.QueryRow("select "+idleVerificationCols.String()+" from idle_verifications"), job.scanTargets()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if job.Hashed != 4*chunk || job.State == nil {
+		t.Fatalf("expected a checkpoint after 4 chunks, got: %d bytes", job.Hashed)
+	}
+
+	// resuming hashes on from the checkpoint. changing bytes before it proves
+	// they aren't read again: the capture still verifies
+	copy(data, bytes.Repeat([]byte("x"), 4*chunk))
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	verified, mismatches := auditCount("verified"), auditCount("mismatches")
+	checks, busyAfter = 0, 100
+	if found, err := v.next(); !found || err != nil {
+		t.Fatalf("expected the capture to be resumed, got: %t %v", found, err)
+	}
+	if auditCount("verified") != verified+1 || auditCount("mismatches") != mismatches {
+		t.Errorf("expected the resumed capture to verify")
+	}
+	if found, _ := v.next(); found {
+		t.Errorf("expected verified captures to leave the queue")
+	}
+
+	// verifying from the start finds the change
+	queueIdleVerification(appDB, path, hash, int64(len(data)), time.Now())
+	if _, err := v.next(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if auditCount("mismatches") != mismatches+1 {
+		t.Errorf("expected a changed capture to be reported")
+	}
+}
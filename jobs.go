@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	// states of a resumable job
+	jobRunning  = "running"
+	jobComplete = "complete"
+	jobFailed   = "failed"
+)
+
+// resumableJob is a job that works through items in order, in batches,
+// recording it's cursor & counts as it goes so it can be resumed if the
+// instance running it stops
+type resumableJob interface {
+	// scanTargets maps the job table's columns to the job's fields. every job
+	// table has id, created, updated, status, error & cursor columns
+	scanTargets() scanTargets
+	// batch processes the next batch, reporting weather the job is done
+	batch(db *sql.DB) (done bool, err error)
+	// summary describes the job's counts for logs
+	summary() string
+	// reportTo is the client progress is sent to, nil if it isn't reported
+	reportTo() *Client
+}
+
+// jobKind creates, runs & resumes the jobs stored in a table. only one job
+// runs at a time for each row of a partial unique index named <table>_running
+type jobKind struct {
+	// name jobs are logged with
+	name string
+	cols *columnSet
+	// returned when creating a job another running job conflicts with
+	errRunning error
+	// pause between batches so jobs don't monopolize the db
+	delay time.Duration
+	// prefix of the client response types progress is reported with, & the
+	// schema of reported jobs
+	reportType string
+	schema     string
+}
+
+// jobFields are the fields every job has, read & written through it's scan targets
+type jobFields struct {
+	id, status, err, cursor *string
+	created, updated        *time.Time
+}
+
+func fieldsOf(j resumableJob) jobFields {
+	t := j.scanTargets()
+	return jobFields{
+		id:      t["id"].(*string),
+		status:  t["status"].(*string),
+		err:     t["error"].(*string),
+		cursor:  t["cursor"].(*string),
+		created: t["created"].(*time.Time),
+		updated: t["updated"].(*time.Time),
+	}
+}
+
+// create records j as a new running job, returning k.errRunning if another
+// running job conflicts with it
+func (k *jobKind) create(db sqlExecable, j resumableJob) error {
+	f := fieldsOf(j)
+	now := time.Now().Round(time.Second).In(time.UTC)
+	*f.id, *f.created, *f.updated, *f.status = uuid.New(), now, now, jobRunning
+
+	t := j.scanTargets()
+	args := make([]interface{}, len(k.cols.columns))
+	params := make([]string, len(k.cols.columns))
+	for i, col := range k.cols.columns {
+		args[i] = t[col]
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	_, err := db.Exec("insert into "+k.cols.table+" ("+k.cols.String()+") values ("+strings.Join(params, ", ")+")", args...)
+	if err != nil {
+		if strings.Contains(err.Error(), k.cols.table+"_running") {
+			return k.errRunning
+		}
+		return checkWriteErr(err)
+	}
+	return nil
+}
+
+// resume restarts a running job that hasn't been updated in jobStaleAfter,
+// which happens when the instance running it stops, reading it into j. The
+// job is claimed by updating it, so only one instance resumes it
+func (k *jobKind) resume(db *sql.DB, j resumableJob) {
+	now := time.Now().Round(time.Second).In(time.UTC)
+	table := k.cols.table
+	err := k.cols.scan(db.QueryRow("update "+table+" set updated = $1 where id = (select id from "+table+" where status = $2 and updated < $3 limit 1) and updated < $3 returning "+k.cols.String(),
+		now, jobRunning, now.Add(-jobStaleAfter)), j.scanTargets())
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		log.Infof("error reading %s jobs: %s", k.name, err.Error())
+		return
+	}
+	f := fieldsOf(j)
+	log.Infof("resuming %s %s from %s", k.name, *f.id, *f.cursor)
+	k.run(db, j)
+}
+
+// run processes batches, saving & reporting progress after each, until the
+// job is done or fails
+func (k *jobKind) run(db *sql.DB, j resumableJob) {
+	f := fieldsOf(j)
+	for {
+		done, err := j.batch(db)
+		if err != nil {
+			k.fail(db, j, err)
+			return
+		}
+		if done {
+			*f.status = jobComplete
+		}
+		if err := k.save(db, j); err != nil {
+			k.fail(db, j, err)
+			return
+		}
+		k.report(j)
+		if done {
+			log.Infof("%s %s complete. %s", k.name, *f.id, j.summary())
+			return
+		}
+		time.Sleep(k.delay)
+	}
+}
+
+// save writes job progress, every column but id & created. db can be a
+// transaction to save progress along with the work it records
+func (k *jobKind) save(db sqlExecable, j resumableJob) error {
+	*fieldsOf(j).updated = time.Now().Round(time.Second).In(time.UTC)
+	t := j.scanTargets()
+	args := []interface{}{t["id"]}
+	sets := []string{}
+	for _, col := range k.cols.columns {
+		if col == "id" || col == "created" {
+			continue
+		}
+		args = append(args, t[col])
+		sets = append(sets, fmt.Sprintf("%s = $%d", col, len(args)))
+	}
+	_, err := db.Exec("update "+k.cols.table+" set "+strings.Join(sets, ", ")+" where id = $1", args...)
+	return checkWriteErr(err)
+}
+
+// fail marks a job as failed. jobs that fail because we've gone into
+// maintenance are left running so they resume on restart
+func (k *jobKind) fail(db *sql.DB, j resumableJob, err error) {
+	f := fieldsOf(j)
+	log.Infof("%s %s failed: %s", k.name, *f.id, err.Error())
+	*f.err = err.Error()
+	if err != ErrMaintenanceMode {
+		*f.status = jobFailed
+		if err := k.save(db, j); err != nil {
+			log.Info(err.Error())
+		}
+	}
+	k.report(j)
+}
+
+// report sends job progress to the client that started it
+func (k *jobKind) report(j resumableJob) {
+	c := j.reportTo()
+	if c == nil || room == nil {
+		return
+	}
+	f := fieldsOf(j)
+	t := k.reportType + "_PROGRESS"
+	switch *f.status {
+	case jobComplete:
+		t = k.reportType + "_COMPLETE"
+	case jobFailed:
+		t = k.reportType + "_FAILURE"
+	}
+	data, err := json.Marshal(&ClientResponse{
+		Type:      t,
+		RequestId: "server",
+		Schema:    k.schema,
+		Id:        *f.id,
+		Error:     *f.err,
+		Data:      j,
+	})
+	if err != nil {
+		log.Info(err.Error())
+		return
+	}
+	room.direct <- &directMessage{clients: []*Client{c}, data: data}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client latency
+//
+// Clients on slow mobile networks can take seconds to answer a ping, & were
+// disconnected by a fixed pongWait while still alive. each websocket
+// connection measures round trips from it's pings, which carry the time they
+// were sent for the pong to echo, & from the round trips clients measure
+// themselves & report with PING_REQUEST. the read deadline & ping period are
+// sized from a smoothed round trip time the same way TCP sizes it's
+// retransmission timeout, so consistently slow clients are given longer, up
+// to cfg.PongWaitMaxSeconds, & fast clients are pinged more often so dead ones
+// are noticed sooner, down to cfg.PongWaitMinSeconds. the wait only moves
+// once it's been more than latencyHysteresis from where it should be for
+// several round trips, so it settles rather than chasing every sample
+
+const (
+	// bounds on the read deadline when they aren't configured
+	defaultPongWaitMin = 20 * time.Second
+	defaultPongWaitMax = 180 * time.Second
+	// round trips measured before the wait adapts
+	latencyMinSamples = 5
+	// the wait is this many smoothed retransmission timeouts
+	latencyWaitTimeouts = 20
+	// fraction the wait has to be off by, for latencyMinSamples round trips in
+	// a row, before it changes
+	latencyHysteresis = 0.25
+)
+
+// rtt sources, the label of rtt metrics
+const (
+	rttPong   = "pong"
+	rttClient = "client"
+)
+
+// rttBuckets are the upper bounds of rtt histogram buckets
+var rttBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// rttHistogram counts measured round trips by bucket
+type rttHistogram struct {
+	// counts of rtts at most each of rttBuckets, & one for the rest
+	buckets []int64
+	count   int64
+	sumNs   int64
+}
+
+func newRttHistogram() *rttHistogram {
+	return &rttHistogram{buckets: make([]int64, len(rttBuckets)+1)}
+}
+
+func (h *rttHistogram) observe(rtt time.Duration) {
+	i := 0
+	for i < len(rttBuckets) && rtt > rttBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sumNs, int64(rtt))
+}
+
+// rttHistograms are measured round trips of every connection, by source
+var rttHistograms = map[string]*rttHistogram{
+	rttPong:   newRttHistogram(),
+	rttClient: newRttHistogram(),
+}
+
+// writeLatencyMetrics writes rtt histograms as prometheus metrics
+func writeLatencyMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP patchbay_client_rtt_seconds round trip times measured with websocket clients")
+	fmt.Fprintln(w, "# TYPE patchbay_client_rtt_seconds histogram")
+	for _, source := range []string{rttPong, rttClient} {
+		h := rttHistograms[source]
+		var cumulative int64
+		for i, le := range rttBuckets {
+			cumulative += atomic.LoadInt64(&h.buckets[i])
+			fmt.Fprintf(w, "patchbay_client_rtt_seconds_bucket{source=%q,le=\"%g\"} %d\n", source, le.Seconds(), cumulative)
+		}
+		count := atomic.LoadInt64(&h.count)
+		fmt.Fprintf(w, "patchbay_client_rtt_seconds_bucket{source=%q,le=\"+Inf\"} %d\n", source, count)
+		fmt.Fprintf(w, "patchbay_client_rtt_seconds_sum{source=%q} %g\n", source, time.Duration(atomic.LoadInt64(&h.sumNs)).Seconds())
+		fmt.Fprintf(w, "patchbay_client_rtt_seconds_count{source=%q} %d\n", source, count)
+	}
+}
+
+// ClientLatency is a connection's measured latency & the intervals it's
+// pinged at
+type ClientLatency struct {
+	// smoothed round trip time, 0 until one's been measured
+	RttMs int64 `json:"rttMs"`
+	// round trips measured
+	Samples int `json:"samples"`
+	// how long the server waits to hear from the client before disconnecting it
+	PongWaitMs int64 `json:"pongWaitMs"`
+	// how often the server pings the client
+	PingPeriodMs int64 `json:"pingPeriodMs"`
+}
+
+// latencyTracker sizes a connection's read deadline & ping period from it's
+// measured round trips. it's safe for concurrent use, pongs are read on the
+// read pump & pings sent from the write pump
+type latencyTracker struct {
+	sync.Mutex
+	min, max     time.Duration
+	srtt, rttvar time.Duration
+	// retransmission timeout, smoothed again so jittery round trips don't
+	// swing the wait
+	rto     time.Duration
+	samples int
+	// round trips in a row the wait has been off by more than latencyHysteresis
+	off  int
+	wait time.Duration
+}
+
+// newLatencyTracker creates a tracker bounded by min & max, starting at pongWait
+func newLatencyTracker(min, max time.Duration) *latencyTracker {
+	if min <= 0 {
+		min = defaultPongWaitMin
+	}
+	if max < min {
+		max = min
+	}
+	t := &latencyTracker{min: min, max: max}
+	t.wait = t.clamp(pongWait)
+	return t
+}
+
+// configuredLatencyTracker creates a tracker bounded by config
+func configuredLatencyTracker() *latencyTracker {
+	if cfg == nil {
+		return newLatencyTracker(defaultPongWaitMin, defaultPongWaitMax)
+	}
+	return newLatencyTracker(time.Duration(cfg.PongWaitMinSeconds)*time.Second, time.Duration(cfg.PongWaitMaxSeconds)*time.Second)
+}
+
+func (t *latencyTracker) clamp(d time.Duration) time.Duration {
+	if d < t.min {
+		return t.min
+	}
+	if d > t.max {
+		return t.max
+	}
+	return d
+}
+
+// observe records a round trip, reporting weather the wait changed. round
+// trips longer than the longest wait can't be real & are ignored
+func (t *latencyTracker) observe(rtt time.Duration) bool {
+	if t == nil || rtt <= 0 {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	if rtt > t.max {
+		return false
+	}
+
+	t.samples++
+	if t.samples == 1 {
+		t.srtt = rtt
+		t.rttvar = rtt / 2
+		t.rto = t.srtt + 4*t.rttvar
+	} else {
+		diff := t.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		t.rttvar = (3*t.rttvar + diff) / 4
+		t.srtt = (7*t.srtt + rtt) / 8
+		t.rto = (15*t.rto + t.srtt + 4*t.rttvar) / 16
+	}
+	if t.samples < latencyMinSamples {
+		return false
+	}
+
+	target := t.clamp(latencyWaitTimeouts * t.rto)
+	diff := target - t.wait
+	if diff < 0 {
+		diff = -diff
+	}
+	if target == t.wait || float64(diff) <= latencyHysteresis*float64(t.wait) && target != t.min && target != t.max {
+		t.off = 0
+		return false
+	}
+	if t.off++; t.off < latencyMinSamples {
+		return false
+	}
+	t.off = 0
+	t.wait = target
+	return true
+}
+
+// pongWait is how long to wait to hear from the client
+func (t *latencyTracker) pongWait() time.Duration {
+	if t == nil {
+		return pongWait
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.wait
+}
+
+// pingPeriod is how often to ping the client, less than pongWait so a pong
+// has time to come back
+func (t *latencyTracker) pingPeriod() time.Duration {
+	return (t.pongWait() * 9) / 10
+}
+
+// latency reports the tracker's measurements & intervals
+func (t *latencyTracker) latency() *ClientLatency {
+	wait := t.pongWait()
+	l := &ClientLatency{PongWaitMs: int64(wait / time.Millisecond), PingPeriodMs: int64(t.pingPeriod() / time.Millisecond)}
+	if t != nil {
+		t.Lock()
+		l.RttMs = int64(t.srtt / time.Millisecond)
+		l.Samples = t.samples
+		t.Unlock()
+	}
+	return l
+}
+
+// pingData is the payload of a ping sent at now, echoed back in it's pong
+func pingData(now time.Time) []byte {
+	return []byte(strconv.FormatInt(now.UnixNano(), 10))
+}
+
+// pongRtt is the round trip time of a pong received at now, false if it
+// doesn't echo a ping's payload
+func pongRtt(data string, now time.Time) (time.Duration, bool) {
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(time.Unix(0, sent)), true
+}
+
+// PingAction lets a client report a round trip time it measured, & returns
+// the intervals it's connection is pinged at
+type PingAction struct {
+	ReqAction
+	clientAction
+	// round trip time of the client's last PING_REQUEST, 0 if it hasn't measured one
+	RttMs int64 `json:"rttMs"`
+}
+
+func (PingAction) Type() string        { return "PING_REQUEST" }
+func (PingAction) SuccessType() string { return "PING_SUCCESS" }
+func (PingAction) FailureType() string { return "PING_FAILURE" }
+
+func (PingAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &PingAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *PingAction) Exec() (res *ClientResponse) {
+	var t *latencyTracker
+	if a.client != nil {
+		t = a.client.latency
+	}
+	if rtt := time.Duration(a.RttMs) * time.Millisecond; rtt > 0 {
+		rttHistograms[rttClient].observe(rtt)
+		t.observe(rtt)
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "CLIENT_LATENCY",
+		Data:      t.latency(),
+	}
+}
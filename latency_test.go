@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// simulatePeer feeds a tracker n round trips of about rtt, jittered by up to
+// jitter either way, returning how many times the wait changed
+func simulatePeer(t *latencyTracker, r *rand.Rand, n int, rtt, jitter time.Duration) int {
+	changes := 0
+	for i := 0; i < n; i++ {
+		d := rtt + time.Duration(r.Int63n(int64(2*jitter)+1)) - jitter
+		if t.observe(d) {
+			changes++
+		}
+	}
+	return changes
+}
+
+func TestLatencyTrackerAdapts(t *testing.T) {
+	min, max := 20*time.Second, 180*time.Second
+	cases := []struct {
+		rtt, jitter time.Duration
+		expectMin   time.Duration
+		expectMax   time.Duration
+	}{
+		// fast clients are pinged more often, down to the lower bound
+		{40 * time.Millisecond, 20 * time.Millisecond, min, min},
+		// slow but responsive clients are given longer
+		{3 * time.Second, time.Second, 60 * time.Second, max},
+		// but never more than the upper bound
+		{15 * time.Second, 5 * time.Second, max, max},
+	}
+
+	for i, c := range cases {
+		tr := newLatencyTracker(min, max)
+		r := rand.New(rand.NewSource(int64(i)))
+
+		simulatePeer(tr, r, latencyMinSamples-1, c.rtt, c.jitter)
+		if tr.pongWait() != pongWait {
+			t.Errorf("case %d expected the wait not to adapt before %d samples, got: %s", i, latencyMinSamples, tr.pongWait())
+		}
+
+		simulatePeer(tr, r, 100, c.rtt, c.jitter)
+		wait := tr.pongWait()
+		if wait < c.expectMin || wait > c.expectMax {
+			t.Errorf("case %d expected the wait to settle between %s & %s, got: %s", i, c.expectMin, c.expectMax, wait)
+		}
+		if tr.pingPeriod() >= wait {
+			t.Errorf("case %d expected pings more often than the wait, got: %s every %s", i, tr.pingPeriod(), wait)
+		}
+
+		// once settled, a steady peer doesn't move the wait back & forth
+		if changes := simulatePeer(tr, r, 500, c.rtt, c.jitter); changes > 1 {
+			t.Errorf("case %d expected the wait to converge, it changed %d times", i, changes)
+		}
+	}
+}
+
+func TestLatencyTrackerIgnoresBogusRtts(t *testing.T) {
+	tr := newLatencyTracker(20*time.Second, 180*time.Second)
+	for _, rtt := range []time.Duration{0, -time.Second, time.Hour} {
+		tr.observe(rtt)
+	}
+	if l := tr.latency(); l.Samples != 0 || l.PongWaitMs != int64(pongWait/time.Millisecond) {
+		t.Errorf("expected impossible round trips to be ignored, got: %#v", l)
+	}
+
+	// bounds that exclude the default wait are respected from the start
+	if wait := newLatencyTracker(90*time.Second, 120*time.Second).pongWait(); wait != 90*time.Second {
+		t.Errorf("expected the wait to start within bounds, got: %s", wait)
+	}
+
+	// clients without a tracker keep the default intervals
+	var none *latencyTracker
+	if none.observe(time.Second) || none.pongWait() != pongWait {
+		t.Errorf("expected a nil tracker to keep the default wait")
+	}
+}
+
+func TestPongRtt(t *testing.T) {
+	sent := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if rtt, ok := pongRtt(string(pingData(sent)), sent.Add(1500*time.Millisecond)); !ok || rtt != 1500*time.Millisecond {
+		t.Errorf("expected a 1.5s round trip, got: %s %t", rtt, ok)
+	}
+	if _, ok := pongRtt("", sent); ok {
+		t.Errorf("expected pongs without a ping's payload to be ignored")
+	}
+}
+
+func TestPingAction(t *testing.T) {
+	client := &Client{latency: newLatencyTracker(20*time.Second, 180*time.Second)}
+	var res *ClientResponse
+	for i := 0; i < 20; i++ {
+		act := PingAction{}.Parse("req", json.RawMessage(`{"rttMs":4000}`))
+		act.(ClientBoundAction).SetClient(client)
+		res = act.Exec()
+	}
+	l, ok := res.Data.(*ClientLatency)
+	if !ok || l.Samples != 20 || l.PongWaitMs <= int64(pongWait/time.Millisecond) {
+		t.Errorf("expected reported round trips to widen the wait, got: %#v %s", res.Data, res.Error)
+	}
+
+	buf := &bytes.Buffer{}
+	writeLatencyMetrics(buf)
+	if !strings.Contains(buf.String(), `patchbay_client_rtt_seconds_bucket{source="client",le="5"}`) {
+		t.Errorf("expected rtt histograms in metrics, got:\n%s", buf.String())
+	}
+}
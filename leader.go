@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	// leaderLeaseName is the lease held by the instance that runs watchdogs
+	leaderLeaseName = "leader"
+	// leaderLeaseTTL is how long the lease lasts without being renewed. if the
+	// leader fails another instance takes over within leaderLeaseTTL + leaderRenewInterval
+	leaderLeaseTTL = 15 * time.Second
+	// how often the leader renews the lease & followers check if it's expired
+	leaderRenewInterval = leaderLeaseTTL / 3
+	// jobStaleAfter is how long a running job can go without being updated before
+	// the leader decides the instance running it has stopped & resumes it
+	jobStaleAfter = time.Minute
+)
+
+// leader is this instance's claim on the leader lease, nil until the server starts
+var leader *leaderLease
+
+// LeaderStatus describes which instance is leading
+type LeaderStatus struct {
+	// this instance
+	Instance string `json:"instance"`
+	Leading  bool   `json:"leading"`
+	// instance holding the lease, empty if it's never been claimed
+	Leader string `json:"leader"`
+	// when the current leader claimed the lease
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// leaderLease elects one leader among instances sharing a database, so work
+// that should only happen once (like resuming interrupted jobs) isn't done by
+// every instance. The leader holds a row in the leases table & renews it
+// every leaderRenewInterval. Followers claim it once it expires
+type leaderLease struct {
+	db   *sql.DB
+	name string
+	id   string
+	ttl  time.Duration
+	// funcs called (in their own goroutine) each time the lease is renewed
+	tasks []func()
+
+	lock    sync.Mutex
+	leading bool
+	holder  string
+	since   time.Time
+}
+
+func newLeaderLease(db *sql.DB, name, id string, ttl time.Duration) *leaderLease {
+	return &leaderLease{db: db, name: name, id: id, ttl: ttl}
+}
+
+// run claims or renews the lease forever, running tasks while leading
+func (l *leaderLease) run() {
+	for {
+		l.tick()
+		time.Sleep(leaderRenewInterval)
+	}
+}
+
+// tick claims or renews the lease once, running tasks if this instance leads
+func (l *leaderLease) tick() {
+	if !l.claim() {
+		return
+	}
+	// tasks are background jobs, skipped while the guardrail sheds them
+	if !guardrails.background() {
+		return
+	}
+	for _, fn := range l.tasks {
+		go fn()
+	}
+}
+
+// claim atomically takes the lease if it's unclaimed or expired, or renews it
+// if this instance already holds it. timestamps come from the database so
+// instance clocks don't need to agree. errors step down, a leader that can't
+// reach the database can't be sure it still holds the lease
+func (l *leaderLease) claim() (leading bool) {
+	var (
+		holder string
+		since  time.Time
+	)
+	err := l.db.QueryRow(`insert into leases (name, holder, acquired, expires)
+		values ($1, $2, now() at time zone 'utc', (now() at time zone 'utc') + $3 * interval '1 millisecond')
+		on conflict (name) do update set
+			holder = excluded.holder,
+			acquired = case when leases.holder = excluded.holder then leases.acquired else excluded.acquired end,
+			expires = excluded.expires
+		where leases.holder = excluded.holder or leases.expires < (now() at time zone 'utc')
+		returning holder, acquired`, l.name, l.id, int64(l.ttl/time.Millisecond)).Scan(&holder, &since)
+	if err == sql.ErrNoRows {
+		// another instance holds the lease
+		err = l.db.QueryRow("select holder, acquired from leases where name = $1", l.name).Scan(&holder, &since)
+	}
+	if err != nil {
+		log.Infof("leader lease error: %s", err.Error())
+		l.set(false, "", time.Time{})
+		return false
+	}
+
+	leading = holder == l.id
+	l.set(leading, holder, since)
+	return leading
+}
+
+// set records the result of a claim, logging leadership changes
+func (l *leaderLease) set(leading bool, holder string, since time.Time) {
+	l.lock.Lock()
+	was := l.leading
+	l.leading, l.holder, l.since = leading, holder, since
+	l.lock.Unlock()
+
+	if leading && !was {
+		log.Infof("instance %s is now leader", l.id)
+	} else if !leading && was {
+		log.Infof("instance %s is no longer leader, lease held by: %s", l.id, holder)
+	}
+}
+
+// release gives up the lease if this instance holds it, so another instance
+// can take over without waiting for it to expire
+func (l *leaderLease) release() error {
+	if _, err := l.db.Exec("delete from leases where name = $1 and holder = $2", l.name, l.id); err != nil {
+		return err
+	}
+	l.set(false, "", time.Time{})
+	return nil
+}
+
+// Status reports the lease as of the last claim
+func (l *leaderLease) Status() *LeaderStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s := &LeaderStatus{Instance: l.id, Leading: l.leading, Leader: l.holder}
+	if !l.since.IsZero() {
+		since := l.since
+		s.Since = &since
+	}
+	return s
+}
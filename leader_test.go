@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestLeaderLease(t *testing.T) {
+	defer resetTestData(appDB, "leases")
+
+	a := newLeaderLease(appDB, "test", "a", time.Minute)
+	b := newLeaderLease(appDB, "test", "b", time.Minute)
+
+	if !a.claim() {
+		t.Fatalf("expected first instance to claim an unclaimed lease")
+	}
+	since := a.Status().Since
+	if b.claim() {
+		t.Errorf("expected second instance not to claim a held lease")
+	}
+	if s := b.Status(); s.Leading || s.Leader != "a" {
+		t.Errorf("expected second instance to report a as leader, got: %#v", s)
+	}
+	if !a.claim() {
+		t.Errorf("expected leader to renew it's lease")
+	}
+	if s := a.Status(); s.Since == nil || since == nil || !s.Since.Equal(*since) {
+		t.Errorf("expected renewing to keep the time leadership started")
+	}
+
+	if err := a.release(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !b.claim() {
+		t.Errorf("expected second instance to claim a released lease")
+	}
+	if a.claim() {
+		t.Errorf("expected released instance not to reclaim a held lease")
+	}
+
+	// leases that aren't renewed expire
+	c := newLeaderLease(appDB, "expiring", "c", time.Millisecond)
+	d := newLeaderLease(appDB, "expiring", "d", time.Minute)
+	if !c.claim() {
+		t.Fatalf("expected first instance to claim an unclaimed lease")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !d.claim() {
+		t.Errorf("expected an expired lease to be taken over")
+	}
+	if c.claim() {
+		t.Errorf("expected the old leader to step down")
+	}
+}
+
+func TestClaimStaleErasure(t *testing.T) {
+	defer resetTestData(appDB, "erase_jobs")
+
+	now := time.Now().Round(time.Second).In(time.UTC)
+	if _, err := appDB.Exec(`insert into erase_jobs (id,created,updated,user_id,mode,status,step,counts) values
+		('6e0d1c2b-3a4f-4e5d-9c8b-7a6f5e4d3c2b', $1, $1, 'stale', 'suppress', 'running', 0, '{}'),
+		('0a9b8c7d-6e5f-4a3b-8c2d-1e0f9a8b7c6d', $2, $2, 'fresh', 'suppress', 'running', 0, '{}')`,
+		now.Add(-2*jobStaleAfter), now); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	userId, mode, err := claimStaleErasure(appDB, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if userId != "stale" || mode != EraseSuppress {
+		t.Errorf("expected stale erasure to be claimed, got: %s %s", userId, mode)
+	}
+	// claimed erasures aren't stale anymore, & fresh ones are being run elsewhere
+	if _, _, err := claimStaleErasure(appDB, now); err != sql.ErrNoRows {
+		t.Errorf("expected no more erasures to claim, got: %v", err)
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Rate limits
+//
+// Every limit on how fast requests are taken is declared in rateLimits with
+// the scope it's counted in & what it allows, so total throughput can be
+// reasoned about in one place. limits are one of two kinds:
+//
+//   states:  refuse every request they're consulted for while they last, eg:
+//            archive requests while the crawl bandwidth cap is reached. states
+//            are global
+//   budgets: allow each key in their scope a number of requests per window,
+//            eg: an api key's archive hooks per minute. budgets are counted
+//            in memory, or from the records requests leave in the database
+//
+// scopes are what a budget is counted per: "ip" (a client's address),
+// "requester" (an api key, or a hashed ip address for anonymous clients) or
+// "apiKey" (an api key used over http).
+//
+// a request is admitted by consulting the limits that apply to it in the
+// order they're declared: states first, then budgets from the broadest scope
+// to the narrowest. the first limit to refuse decides the response, which
+// always carries the limit, it's scope & the seconds until it's worth
+// retrying, as details of websocket responses & a Retry-After header over
+// http. budgets counted in memory are only spent once every limit has
+// admitted a request, so a request one limit refuses doesn't use up another.
+// budgets counted in the database are spent by the request being recorded.
+// websocket actions consult the limits that don't depend on what they ask
+// for before they're executed, see actionLimits. daily archive quotas are
+// consulted once the request has been validated.
+//
+// LIMITS_STATUS_REQUEST reports the consumption of each limit to moderators,
+// & the same figures are exported at /metrics. queues archives wait in & the
+// once a day user export aren't rate limits, & aren't declared here
+
+// rate limit scopes
+const (
+	limitScopeGlobal    = "global"
+	limitScopeIP        = "ip"
+	limitScopeRequester = "requester"
+	limitScopeApiKey    = "apiKey"
+)
+
+// rate limit names, also the targets of rate_limited user actions
+const (
+	limitBandwidthCap   = "bandwidth_cap"
+	limitGuardrails     = "guardrails"
+	limitReads          = "reads"
+	limitContentReports = "content_reports"
+	limitTrialArchives  = "trial_archives"
+	limitLinkArchives   = "link_archives"
+	limitHookArchives   = "hook_archives"
+)
+
+// rateLimitedErrCode is set on refusals by budgets that don't have a code of their own
+const rateLimitedErrCode = "RATE_LIMITED"
+
+// rateLimitStats exposes admissions & refusals by limit at /debug/vars, eg: "reads.refused"
+var rateLimitStats = expvar.NewMap("rateLimits")
+
+// rateLimits is the package-level registry, in the order limits are consulted
+var rateLimits = &limitRegistry{limits: []*rateLimit{
+	{
+		name:    limitBandwidthCap,
+		scope:   limitScopeGlobal,
+		err:     ErrBandwidthCap,
+		code:    bandwidthCapErrCode,
+		applies: func(svc *Service) bool { return svc.Bandwidth.Check() != nil },
+		// caps are monthly
+		retry: func(now time.Time) time.Duration {
+			t := now.In(time.UTC)
+			return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC).Sub(t)
+		},
+		status: func(svc *Service) (string, string, interface{}) {
+			return "BANDWIDTH_STATUS", "bandwidth", svc.Bandwidth.Status()
+		},
+	},
+	{
+		name:    limitGuardrails,
+		scope:   limitScopeGlobal,
+		err:     ErrServerBusy,
+		code:    serverBusyErrCode,
+		applies: func(svc *Service) bool { return svc.Guardrails.Check() != nil },
+		retry:   func(now time.Time) time.Duration { return guardrailRetryAfter },
+		status: func(svc *Service) (string, string, interface{}) {
+			return "GUARDRAIL_STATUS", "guardrails", svc.Guardrails.Status()
+		},
+	},
+	{
+		name:   limitReads,
+		scope:  limitScopeIP,
+		err:    ErrBandwidthThrottled,
+		code:   bandwidthCapErrCode,
+		reason: "throttled",
+		// reads are only limited while they're throttled
+		applies: func(svc *Service) bool { return svc.Bandwidth.Status().ReadsThrottled },
+		limiter: func(svc *Service) *rateLimiter { return svc.Bandwidth.reads },
+		status: func(svc *Service) (string, string, interface{}) {
+			return "BANDWIDTH_STATUS", "bandwidth", svc.Bandwidth.Status()
+		},
+	},
+	{
+		name:    limitContentReports,
+		scope:   limitScopeRequester,
+		err:     ErrReportRateLimited,
+		code:    rateLimitedErrCode,
+		reason:  limitContentReports,
+		limiter: func(svc *Service) *rateLimiter { return svc.ReportLimiter },
+	},
+	{
+		name:   limitTrialArchives,
+		scope:  limitScopeRequester,
+		err:    ErrTrialLimit,
+		code:   trialLimitErrCode,
+		window: 24 * time.Hour,
+		budget: func(svc *Service) int { return svc.Config.TrialArchivesPerDay },
+		count: func(svc *Service, key string, since time.Time) (int, time.Time, error) {
+			return trialArchivesSince(svc.DB, key, since)
+		},
+		usage: func(svc *Service, since time.Time) (map[string]int, error) { return trialArchiveUsage(svc.DB, since) },
+	},
+	{
+		name:   limitLinkArchives,
+		scope:  limitScopeRequester,
+		err:    ErrLinkArchiveLimit,
+		code:   linkArchiveLimitErrCode,
+		window: 24 * time.Hour,
+		budget: func(svc *Service) int { return svc.Config.LinkArchivesPerDay },
+		count: func(svc *Service, key string, since time.Time) (int, time.Time, error) {
+			return linkArchivesSince(svc.DB, key, since)
+		},
+		usage: func(svc *Service, since time.Time) (map[string]int, error) { return linkArchiveUsage(svc.DB, since) },
+	},
+	{
+		name:    limitHookArchives,
+		scope:   limitScopeApiKey,
+		err:     ErrHookRateLimit,
+		code:    rateLimitedErrCode,
+		reason:  limitHookArchives,
+		limiter: func(svc *Service) *rateLimiter { return svc.HookLimits },
+	},
+}}
+
+// limitKeys are the keys a request is counted under, by scope
+type limitKeys map[string]string
+
+// rateLimit is a limit declared in the registry. states set retry, budgets
+// set either limiter, or window, budget, count & usage
+type rateLimit struct {
+	name  string
+	scope string
+	// refusals are reported with err & code, & reason as a detail for codes
+	// with more than one message
+	err    error
+	code   string
+	reason string
+	// applies reports weather the limit is consulted right now, limits without it always are
+	applies func(svc *Service) bool
+	// retry is how long a state is expected to last
+	retry func(now time.Time) time.Duration
+
+	// limiter counts budgets in memory, it's limit & window are the budget's
+	limiter func(svc *Service) *rateLimiter
+	// window, budget, count & usage count budgets from the database. count
+	// reads the requests a key made since a time & when the earliest was made,
+	// usage reads the requests every key made since a time
+	window time.Duration
+	budget func(svc *Service) int
+	count  func(svc *Service, key string, since time.Time) (int, time.Time, error)
+	usage  func(svc *Service, since time.Time) (map[string]int, error)
+
+	// status returns the schema & data attached to refusals, & the key the data
+	// is written under over http, if any
+	status func(svc *Service) (schema, key string, data interface{})
+}
+
+// used counts the requests a key has made in the window as of now, & returns
+// when the earliest of them was made
+func (l *rateLimit) used(svc *Service, key string, now time.Time) (int, time.Time, error) {
+	if l.limiter != nil {
+		used, earliest := l.limiter(svc).peek(key, now)
+		return used, earliest, nil
+	}
+	return l.count(svc, key, now.Add(-l.window))
+}
+
+// state reports weather the limit is a state rather than a budget
+func (l *rateLimit) state() bool {
+	return l.retry != nil
+}
+
+// period is the window a budget is counted over
+func (l *rateLimit) period(svc *Service) time.Duration {
+	if l.limiter != nil {
+		return l.limiter(svc).window
+	}
+	return l.window
+}
+
+// allowance is the budget each key has per window
+func (l *rateLimit) allowance(svc *Service) int {
+	if l.limiter != nil {
+		return l.limiter(svc).limit
+	}
+	return l.budget(svc)
+}
+
+// refuse creates a refusal by svc to retry after d
+func (l *rateLimit) refuse(svc *Service, d time.Duration) *LimitRefusal {
+	rateLimitStats.Add(l.name+".refused", 1)
+	retry := int((d + time.Second - 1) / time.Second)
+	if retry < 1 {
+		retry = 1
+	}
+	return &LimitRefusal{Limit: l.name, Scope: l.scope, RetryAfter: retry, limit: l, svc: svc}
+}
+
+// limitRegistry holds the declared limits, in the order they're consulted
+type limitRegistry struct {
+	limits []*rateLimit
+}
+
+// admit consults the named limits for a request counted under keys, in the
+// order they're declared, returning the first refusal, nil if every limit
+// admits it. budgets counted in memory are spent once every limit has admitted
+// the request. states & budgets are read from svc
+func (reg *limitRegistry) admit(svc *Service, keys limitKeys, now time.Time, names ...string) (*LimitRefusal, error) {
+	consult := map[string]bool{}
+	for _, name := range names {
+		consult[name] = true
+	}
+
+	spend := []*rateLimit{}
+	for _, l := range reg.limits {
+		if !consult[l.name] || l.applies != nil && !l.applies(svc) {
+			continue
+		}
+		if l.state() {
+			return l.refuse(svc, l.retry(now)), nil
+		}
+		used, earliest, err := l.used(svc, keys[l.scope], now)
+		if err != nil {
+			return nil, err
+		}
+		if used >= l.allowance(svc) {
+			return l.refuse(svc, earliest.Add(l.period(svc)).Sub(now)), nil
+		}
+		if l.limiter != nil {
+			spend = append(spend, l)
+		}
+	}
+
+	for i, l := range spend {
+		// another request can spend the last of a budget between checking & spending it
+		if !l.limiter(svc).allowAt(keys[l.scope], now) {
+			for _, spent := range spend[:i] {
+				spent.limiter(svc).unrecord(keys[spent.scope], now)
+			}
+			_, earliest := l.limiter(svc).peek(keys[l.scope], now)
+			return l.refuse(svc, earliest.Add(l.period(svc)).Sub(now)), nil
+		}
+	}
+	for _, name := range names {
+		rateLimitStats.Add(name+".admitted", 1)
+	}
+	return nil, nil
+}
+
+// LimitRefusal is a request refused by a rate limit
+type LimitRefusal struct {
+	// name & scope of the limit that refused the request
+	Limit string `json:"limit"`
+	Scope string `json:"scope"`
+	// seconds until the request is expected to be admitted
+	RetryAfter int `json:"retryAfter"`
+
+	limit *rateLimit
+	// svc the refusal's status is read from
+	svc *Service
+}
+
+func (r *LimitRefusal) Error() string {
+	return r.limit.err.Error()
+}
+
+// details are set on websocket responses to refused requests
+func (r *LimitRefusal) details() map[string]string {
+	d := map[string]string{"limit": r.Limit, "scope": r.Scope, "retryAfter": strconv.Itoa(r.RetryAfter)}
+	if r.limit.reason != "" {
+		d["reason"] = r.limit.reason
+	}
+	return d
+}
+
+// response is the response to a refused websocket action
+func (r *LimitRefusal) response(t ClientRequestAction, reqId string) *ClientResponse {
+	res := &ClientResponse{
+		Type:      t.FailureType(),
+		RequestId: reqId,
+		Error:     r.Error(),
+		Code:      r.limit.code,
+		Details:   r.details(),
+	}
+	if r.limit.status != nil {
+		res.Schema, _, res.Data = r.limit.status(r.svc)
+	}
+	return res
+}
+
+// write responds to a refused http request. refusals by states are
+// unavailable, refusals by budgets too many requests
+func (r *LimitRefusal) write(w http.ResponseWriter) {
+	status := http.StatusTooManyRequests
+	if r.limit.state() {
+		status = http.StatusServiceUnavailable
+	}
+	body := map[string]interface{}{
+		"error":      r.Error(),
+		"code":       r.limit.code,
+		"limit":      r.Limit,
+		"scope":      r.Scope,
+		"retryAfter": r.RetryAfter,
+	}
+	if r.limit.status != nil {
+		_, key, data := r.limit.status(r.svc)
+		body[key] = data
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(r.RetryAfter))
+	writeJSON(w, status, body)
+}
+
+// logUserAction records a refusal by a budget as a rate_limited action by userId
+func (r *LimitRefusal) logUserAction(db *sql.DB, userId string, now time.Time) {
+	if !r.limit.state() {
+		logUserAction(db, userId, userActionRateLimited, "", r.Limit, now)
+	}
+}
+
+// actionLimits lists the limits a websocket action consults before it's
+// executed: archive requests consult the bandwidth cap & guardrails, reads
+// (the actions listed in cacheMaxAge) consult the reads budget
+func actionLimits(t ClientRequestAction) []string {
+	if archiveActions[t.Type()] {
+		return []string{limitBandwidthCap, limitGuardrails}
+	}
+	if _, read := cacheMaxAge[t.SuccessType()]; read {
+		return []string{limitReads}
+	}
+	return nil
+}
+
+// actionLimitResponse consults the limits a websocket action consults before
+// it's executed, returning the response & refusal if it's refused
+func actionLimitResponse(svc *Service, t ClientRequestAction, reqId string, keys limitKeys) (*ClientResponse, *LimitRefusal) {
+	names := actionLimits(t)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	refusal, err := rateLimits.admit(svc, keys, time.Now(), names...)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: t.FailureType(), RequestId: reqId, Error: "internal server error"}, nil
+	} else if refusal == nil {
+		return nil, nil
+	}
+	return refusal.response(t, reqId), refusal
+}
+
+// LimitStatus is the consumption of a rate limit
+type LimitStatus struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+	// requests each key is allowed per window, 0 for states
+	Budget        int `json:"budget"`
+	WindowSeconds int `json:"windowSeconds"`
+	// weather the limit is consulted right now. limits that aren't don't
+	// refuse anything, eg: reads while they aren't throttled, or states that
+	// aren't in effect
+	Applies bool `json:"applies"`
+	// keys that made requests in the window, the requests they made, the most
+	// one key made, & keys that have used their whole budget
+	Keys      int `json:"keys"`
+	Used      int `json:"used"`
+	MostUsed  int `json:"mostUsed"`
+	Exhausted int `json:"exhausted"`
+}
+
+// Status reports the consumption of every limit as of now, in the order
+// they're consulted. states & budgets are read from svc
+func (reg *limitRegistry) Status(svc *Service, now time.Time) ([]*LimitStatus, error) {
+	statuses := make([]*LimitStatus, 0, len(reg.limits))
+	for _, l := range reg.limits {
+		s := &LimitStatus{Name: l.name, Scope: l.scope, Applies: true}
+		if l.state() {
+			// states are checked without counting them as refusals
+			switch l.name {
+			case limitBandwidthCap:
+				s.Applies = svc.Bandwidth.Status().State == bandwidthCapped
+			case limitGuardrails:
+				s.Applies = svc.Guardrails.Level() >= shedArchives
+			}
+			statuses = append(statuses, s)
+			continue
+		}
+		if l.limiter != nil && l.limiter(svc) == nil {
+			// hooks are disabled
+			s.Applies = false
+			statuses = append(statuses, s)
+			continue
+		}
+		s.WindowSeconds = int(l.period(svc) / time.Second)
+		if l.applies != nil {
+			s.Applies = l.applies(svc)
+		}
+
+		var (
+			used map[string]int
+			err  error
+		)
+		if l.limiter != nil {
+			used = l.limiter(svc).usage(now)
+		} else if svc.DB != nil && svc.Config != nil {
+			if used, err = l.usage(svc, now.Add(-l.window)); err != nil {
+				return nil, err
+			}
+		}
+		if l.limiter != nil || svc.Config != nil {
+			s.Budget = l.allowance(svc)
+		}
+		for _, n := range used {
+			s.Keys++
+			s.Used += n
+			if n > s.MostUsed {
+				s.MostUsed = n
+			}
+			if n >= s.Budget {
+				s.Exhausted++
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// writeLimitMetrics writes the consumption of every limit & refusal counts as
+// prometheus metrics
+func writeLimitMetrics(w io.Writer, statuses []*LimitStatus) {
+	count := func(key string) int64 {
+		if v, ok := rateLimitStats.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	gauges := []struct {
+		name, help string
+		value      func(s *LimitStatus) int
+	}{
+		{"patchbay_rate_limit_budget", "requests each key in a rate limit's scope is allowed per window", func(s *LimitStatus) int { return s.Budget }},
+		{"patchbay_rate_limit_keys", "keys that made requests within a rate limit's window", func(s *LimitStatus) int { return s.Keys }},
+		{"patchbay_rate_limit_used", "requests made within a rate limit's window", func(s *LimitStatus) int { return s.Used }},
+		{"patchbay_rate_limit_exhausted", "keys that have used their whole budget", func(s *LimitStatus) int { return s.Exhausted }},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+		for _, s := range statuses {
+			fmt.Fprintf(w, "%s{limit=%q,scope=%q} %d\n", g.name, s.Name, s.Scope, g.value(s))
+		}
+	}
+	fmt.Fprintln(w, "# HELP patchbay_rate_limit_applies rate limits being consulted, states that are in effect")
+	fmt.Fprintln(w, "# TYPE patchbay_rate_limit_applies gauge")
+	for _, s := range statuses {
+		applies := 0
+		if s.Applies {
+			applies = 1
+		}
+		fmt.Fprintf(w, "patchbay_rate_limit_applies{limit=%q,scope=%q} %d\n", s.Name, s.Scope, applies)
+	}
+	fmt.Fprintln(w, "# HELP patchbay_rate_limit_refused_total requests refused by a rate limit")
+	fmt.Fprintln(w, "# TYPE patchbay_rate_limit_refused_total counter")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "patchbay_rate_limit_refused_total{limit=%q,scope=%q} %d\n", s.Name, s.Scope, count(s.Name+".refused"))
+	}
+}
+
+// LimitsStatusAction reports the consumption of every rate limit to moderators
+type LimitsStatusAction struct {
+	ReqAction
+	clientAction
+	Token string `json:"token"`
+}
+
+func (LimitsStatusAction) Type() string        { return "LIMITS_STATUS_REQUEST" }
+func (LimitsStatusAction) SuccessType() string { return "LIMITS_STATUS_SUCCESS" }
+func (LimitsStatusAction) FailureType() string { return "LIMITS_STATUS_FAILURE" }
+
+func (LimitsStatusAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &LimitsStatusAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *LimitsStatusAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrNotModerator.Error(),
+		}
+	}
+
+	statuses, err := rateLimits.Status(svc, time.Now())
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "LIMIT_STATUS_ARRAY",
+		Data:      statuses,
+	}
+}
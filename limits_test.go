@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitAdmission(t *testing.T) {
+	svc := newTestService()
+	svc.HookLimits, svc.ReportLimiter = newRateLimiter(2, time.Minute), newRateLimiter(3, time.Hour)
+
+	now := time.Date(2017, 1, 15, 12, 0, 0, 0, time.UTC)
+	keys := limitKeys{limitScopeRequester: "127.0.0.1", limitScopeApiKey: "key"}
+	names := []string{limitBandwidthCap, limitContentReports, limitHookArchives}
+
+	cases := []struct {
+		at     time.Duration
+		limit  string
+		retry  int
+		hooks  int
+		report int
+	}{
+		{0, "", 0, 1, 1},
+		{time.Second, "", 0, 2, 2},
+		// a request one budget refuses doesn't spend the others
+		{2 * time.Second, limitHookArchives, 58, 2, 2},
+		{30 * time.Second, limitHookArchives, 30, 2, 2},
+		{time.Minute + time.Second/2, "", 0, 2, 3},
+		// the first limit to refuse decides, in the order they're declared
+		{time.Minute + time.Second, limitContentReports, 3539, 2, 3},
+	}
+	for i, c := range cases {
+		at := now.Add(c.at)
+		refusal, err := rateLimits.admit(svc, keys, at, names...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if c.limit == "" && refusal != nil {
+			t.Errorf("case %d expected request to be admitted, got refused by %s", i, refusal.Limit)
+		} else if c.limit != "" && (refusal == nil || refusal.Limit != c.limit || refusal.RetryAfter != c.retry) {
+			t.Errorf("case %d expected refusal by %s retrying after %ds, got: %#v", i, c.limit, c.retry, refusal)
+		}
+		if used, _ := svc.HookLimits.peek("key", at); used != c.hooks {
+			t.Errorf("case %d expected %d hook requests counted, got: %d", i, c.hooks, used)
+		}
+		if used, _ := svc.ReportLimiter.peek("127.0.0.1", at); used != c.report {
+			t.Errorf("case %d expected %d reports counted, got: %d", i, c.report, used)
+		}
+	}
+
+	// states are consulted before budgets & don't spend them
+	svc.Bandwidth.status.Store(&BandwidthStatus{State: bandwidthCapped})
+	refusal, _ := rateLimits.admit(svc, limitKeys{limitScopeApiKey: "other"}, now, names...)
+	if refusal == nil || refusal.Limit != limitBandwidthCap || refusal.Scope != limitScopeGlobal {
+		t.Fatalf("expected the bandwidth cap to refuse, got: %#v", refusal)
+	}
+	if used, _ := svc.HookLimits.peek("other", now); used != 0 {
+		t.Errorf("expected a refused request not to spend budgets, got %d hook requests", used)
+	}
+	// caps last until the start of next month
+	if refusal.RetryAfter != int((17*24*time.Hour-12*time.Hour)/time.Second) {
+		t.Errorf("expected the cap to last until next month, got: %ds", refusal.RetryAfter)
+	}
+	rec := httptest.NewRecorder()
+	refusal.write(rec)
+	if rec.Code != 503 || rec.Header().Get("Retry-After") != "1425600" || !strings.Contains(rec.Body.String(), `"bandwidth":`) {
+		t.Errorf("expected states to be unavailable with a Retry-After header, got: %d %q %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+	res := refusal.response(&TrialArchiveAction{}, "1")
+	if res.Code != bandwidthCapErrCode || res.Schema != "BANDWIDTH_STATUS" || res.Details["retryAfter"] != "1425600" || res.Details["reason"] != "" {
+		t.Errorf("expected a bandwidth cap response, got: %#v", res)
+	}
+	svc.Bandwidth.status.Store(&BandwidthStatus{State: bandwidthOk})
+
+	refusal, _ = rateLimits.admit(svc, keys, now.Add(time.Minute+time.Second), limitHookArchives)
+	if refusal == nil {
+		t.Fatal("expected the hook budget to refuse")
+	}
+	rec = httptest.NewRecorder()
+	refusal.write(rec)
+	body := map[string]interface{}{}
+	json.NewDecoder(bytes.NewReader(rec.Body.Bytes())).Decode(&body)
+	if rec.Code != 429 || body["code"] != rateLimitedErrCode || body["limit"] != limitHookArchives || body["scope"] != limitScopeApiKey || body["retryAfter"] != 1.0 {
+		t.Errorf("expected budgets to be too many requests, got: %d %s", rec.Code, rec.Body.String())
+	}
+	if res := refusal.response(&TrialArchiveAction{}, "1"); res.Error != ErrHookRateLimit.Error() || res.Details["reason"] != limitHookArchives || res.Details["scope"] != limitScopeApiKey {
+		t.Errorf("expected refusals to detail the limit, got: %#v", res)
+	}
+}
+
+func TestLimitStatus(t *testing.T) {
+	svc := newTestService()
+	svc.HookLimits, svc.ReportLimiter = newRateLimiter(2, time.Minute), newRateLimiter(3, time.Hour)
+
+	now := time.Now()
+	for _, key := range []string{"a", "a", "a", "b"} {
+		rateLimits.admit(svc, limitKeys{limitScopeApiKey: key}, now, limitHookArchives)
+	}
+	statuses, err := rateLimits.Status(svc, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(statuses) != len(rateLimits.limits) {
+		t.Fatalf("expected a status for every limit, got: %d", len(statuses))
+	}
+	var hooks *LimitStatus
+	for _, s := range statuses {
+		if s.Name == limitHookArchives {
+			hooks = s
+		}
+	}
+	// usage is aggregated, keys aren't reported
+	if data, _ := json.Marshal(hooks); string(data) != `{"name":"hook_archives","scope":"apiKey","budget":2,"windowSeconds":60,"applies":true,"keys":2,"used":3,"mostUsed":2,"exhausted":1}` {
+		t.Errorf("expected hook archive consumption, got: %s", data)
+	}
+
+	buf := &bytes.Buffer{}
+	writeLimitMetrics(buf, statuses)
+	if !strings.Contains(buf.String(), `patchbay_rate_limit_used{limit="hook_archives",scope="apiKey"} 3`) {
+		t.Errorf("expected hook archive metrics, got: %s", buf.String())
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+	"github.com/lib/pq"
+)
+
+const (
+	// longest anchor text stored for a link, in characters
+	maxAnchorTextLength = 256
+	// longest rel attribute stored for a link, in characters
+	maxAnchorRelLength = 64
+	// html urls read per page when backfilling anchors
+	anchorBackfillPageSize = 100
+)
+
+// linkAnchor is the context an HTML link was found in: the text of the
+// element that links & it's rel attribute. links found by other extractors
+// don't have anchors
+type linkAnchor struct {
+	Text string
+	Rel  string
+}
+
+// docLinkAnchors reads the anchor of every link in a parsed HTML document,
+// keyed by the same urls docLinkUrls lists. when a document links to the same
+// url more than once, the first anchor with text is kept
+func docLinkAnchors(base *url.URL, doc *goquery.Document) map[string]linkAnchor {
+	anchors := map[string]linkAnchor{}
+	doc.Find("[href]").Each(func(i int, s *goquery.Selection) {
+		val, _ := s.Attr("href")
+		address, err := base.Parse(val)
+		if err != nil {
+			return
+		}
+		dst := address.String()
+		if a, ok := anchors[dst]; ok && a.Text != "" {
+			return
+		}
+		rel, _ := s.Attr("rel")
+		anchors[dst] = linkAnchor{
+			Text: boundText(anchorText(s), maxAnchorTextLength),
+			Rel:  boundText(strings.ToLower(rel), maxAnchorRelLength),
+		}
+	})
+	return anchors
+}
+
+// anchorText is the text a link element shows, falling back to it's labels &
+// the alt text of images it wraps
+func anchorText(s *goquery.Selection) string {
+	if text := strings.TrimSpace(s.Text()); text != "" {
+		return text
+	}
+	for _, attr := range []string{"aria-label", "title"} {
+		if val, ok := s.Attr(attr); ok && strings.TrimSpace(val) != "" {
+			return val
+		}
+	}
+	alt, _ := s.Find("img[alt]").First().Attr("alt")
+	return alt
+}
+
+// boundText collapses whitespace in s & truncates it to max characters
+func boundText(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:max]))
+}
+
+// saveLinkAnchors sets the anchor of existing links from src. links are
+// saved first, by saveDocLinks or core, so anchors of links that don't exist
+// are dropped. captures that link the same way change nothing
+func saveLinkAnchors(db *sql.DB, src string, anchors map[string]linkAnchor) error {
+	if len(anchors) == 0 {
+		return nil
+	}
+	var dsts, texts, rels []string
+	for dst, a := range anchors {
+		dsts = append(dsts, dst)
+		texts = append(texts, a.Text)
+		rels = append(rels, a.Rel)
+	}
+	_, err := db.Exec(`update links set anchor_text = a.text, rel = a.rel
+		from unnest($2::text[], $3::text[], $4::text[]) as a(dst, text, rel)
+		where links.src = $1 and links.dst = a.dst and (links.anchor_text, links.rel) is distinct from (a.text, a.rel)`,
+		src, pq.Array(dsts), pq.Array(texts), pq.Array(rels))
+	return checkWriteErr(err)
+}
+
+// addLinkAnchors fills in the anchors of links being sent to clients
+func addLinkAnchors(db *sql.DB, details []*linkDetail) error {
+	if len(details) == 0 {
+		return nil
+	}
+	srcs := make([]string, len(details))
+	dsts := make([]string, len(details))
+	for i, d := range details {
+		if d.Src != nil {
+			srcs[i] = d.Src.Url
+		}
+		if d.Dst != nil {
+			dsts[i] = d.Dst.Url
+		}
+	}
+	rows, err := db.Query(`select links.src, links.dst, anchor_text, rel from links
+		join unnest($1::text[], $2::text[]) as l(src, dst) on links.src = l.src and links.dst = l.dst
+		where anchor_text != '' or rel != ''`, pq.Array(srcs), pq.Array(dsts))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	anchors := map[[2]string]linkAnchor{}
+	for rows.Next() {
+		var (
+			src, dst string
+			a        linkAnchor
+		)
+		if err := rows.Scan(&src, &dst, &a.Text, &a.Rel); err != nil {
+			return err
+		}
+		anchors[[2]string{src, dst}] = a
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i, d := range details {
+		a := anchors[[2]string{srcs[i], dsts[i]}]
+		d.AnchorText, d.Rel = a.Text, a.Rel
+	}
+	return nil
+}
+
+// readLinkDetails adds destination health & anchors to links. links are
+// still worth sending without anchors, so failing to read them is only logged
+func readLinkDetails(db *sql.DB, links []*core.Link, now time.Time) []*linkDetail {
+	details := newLinkDetails(links, now)
+	if err := addLinkAnchors(db, details); err != nil {
+		log.Infof("error reading link anchors: %s", err.Error())
+	}
+	return details
+}
+
+// urlSearchCols are core's url columns, qualified so they can be selected
+// alongside links
+const urlSearchCols = `urls.url, urls.created, urls.updated, last_head, last_get, status, content_type, content_sniff,
+  content_length, file_name, title, id, headers_took, download_took, headers, meta, hash`
+
+// SearchUrls finds urls that contain q, or that other pages link to with
+// anchor text matching q. inbound anchor text ranks urls, so urls others
+// describe with the query's terms come first
+func SearchUrls(db *sql.DB, q string, limit, offset int) ([]*core.Url, error) {
+	if limit <= 0 || limit > maxPageSize+1 {
+		limit = maxPageSize + 1
+	}
+
+	rows, err := db.Query(`with anchors as (
+		select dst, sum(ts_rank(to_tsvector('english', anchor_text), q)) as rank
+		from links, plainto_tsquery('english', $2) q
+		where to_tsvector('english', anchor_text) @@ q
+		group by dst
+	)
+	select `+urlSearchCols+` from urls
+	left join anchors on anchors.dst = urls.url
+	where urls.url ilike $1 or anchors.dst is not null
+	order by (urls.url ilike $1)::int + coalesce(anchors.rank, 0) desc, urls.url
+	limit $3 offset $4`, "%"+q+"%", q, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*core.Url{}
+	for rows.Next() {
+		u := &core.Url{}
+		if err := u.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		results = append(results, u)
+	}
+	return results, rows.Err()
+}
+
+// BackfillLinkAnchors re-extracts anchors from stored HTML captures, for links
+// saved before anchors were. only content stored in contentDir can be read.
+// progress is called with the number of urls read so far after each page
+func BackfillLinkAnchors(db *sql.DB, contentDir string, progress func(read, updated int)) (read, updated int, err error) {
+	if contentDir == "" {
+		return 0, 0, ErrNoBlockStore
+	}
+	cursor := ""
+	for {
+		rows, err := db.Query(`select url, hash from urls
+			where url > $1 and hash != '' and content_sniff in ('text/html; charset=utf-8', 'text/plain; charset=utf-8')
+			order by url limit $2`, cursor, anchorBackfillPageSize)
+		if err != nil {
+			return read, updated, err
+		}
+		page := []*core.Url{}
+		for rows.Next() {
+			u := &core.Url{}
+			if err := rows.Scan(&u.Url, &u.Hash); err != nil {
+				rows.Close()
+				return read, updated, err
+			}
+			page = append(page, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return read, updated, err
+		}
+
+		for _, u := range page {
+			cursor = u.Url
+			read++
+			ok, err := backfillUrlAnchors(db, contentDir, u)
+			if err != nil {
+				return read, updated, err
+			}
+			if ok {
+				updated++
+			}
+		}
+		if progress != nil {
+			progress(read, updated)
+		}
+		if len(page) < anchorBackfillPageSize {
+			return read, updated, nil
+		}
+	}
+}
+
+// backfillUrlAnchors saves anchors for links from a single stored capture,
+// reporting false if the capture isn't stored in contentDir
+func backfillUrlAnchors(db *sql.DB, contentDir string, u *core.Url) (bool, error) {
+	f, err := openStoredContent(db, contentDir, u.Hash)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	buf := &bytes.Buffer{}
+	_, err = buf.ReadFrom(&io.LimitedReader{R: f, N: maxImportLinkExtractSize})
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+
+	base, err := u.ParsedUrl()
+	if err != nil {
+		return false, nil
+	}
+	doc, err := goquery.NewDocumentFromReader(buf)
+	if err != nil {
+		return false, nil
+	}
+	return true, saveLinkAnchors(db, u.Url, docLinkAnchors(base, doc))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+)
+
+func TestDocLinkAnchors(t *testing.T) {
+	base, _ := url.Parse("http://epa.gov/a/")
+	body := `<html><body>
+		<a href="report.pdf" rel="NoFollow">  final
+			report </a>
+		<a href="report.pdf">again</a>
+		<a href="http://nasa.gov" title="NASA"></a>
+		<a href="/logo"><img src="logo.png" alt="EPA logo"></a>
+		<a href="/empty"></a>
+		<a href="/long">` + strings.Repeat("ab ", 200) + `</a>
+		<link rel="stylesheet" href="/style.css">
+	</body></html>`
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	anchors := docLinkAnchors(base, doc)
+	cases := []struct {
+		dst  string
+		text string
+		rel  string
+	}{
+		{"http://epa.gov/a/report.pdf", "final report", "nofollow"},
+		{"http://nasa.gov", "NASA", ""},
+		{"http://epa.gov/logo", "EPA logo", ""},
+		{"http://epa.gov/empty", "", ""},
+		{"http://epa.gov/style.css", "", "stylesheet"},
+	}
+	for i, c := range cases {
+		a, ok := anchors[c.dst]
+		if !ok {
+			t.Errorf("case %d expected an anchor for %s", i, c.dst)
+			continue
+		}
+		if a.Text != c.text || a.Rel != c.rel {
+			t.Errorf("case %d expected %q rel %q, got: %q rel %q", i, c.text, c.rel, a.Text, a.Rel)
+		}
+	}
+	if long := anchors["http://epa.gov/long"].Text; len(long) > maxAnchorTextLength {
+		t.Errorf("expected anchor text to be bounded to %d characters, got: %d", maxAnchorTextLength, len(long))
+	}
+}
+
+func TestSearchUrls(t *testing.T) {
+	defer resetTestData(appDB, "urls", "links")
+	for _, u := range []string{"http://epa.gov", "http://epa.gov/files/a.pdf", "http://epa.gov/files/b.pdf", "http://epa.gov/final"} {
+		if err := (&core.Url{Url: u}).Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	src := &core.Url{Url: "http://epa.gov"}
+	for _, dst := range []string{"http://epa.gov/files/a.pdf", "http://epa.gov/files/b.pdf", "http://epa.gov/final"} {
+		if _, err := saveExtractedLink(appDB, src, dst, "html"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := saveLinkAnchors(appDB, src.Url, map[string]linkAnchor{
+		"http://epa.gov/files/a.pdf": {Text: "Final Reports"},
+		"http://epa.gov/files/b.pdf": {Text: "budget"},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	results, err := SearchUrls(appDB, "final report", 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 1 || results[0].Url != "http://epa.gov/files/a.pdf" {
+		t.Errorf("expected inbound anchor text to match a.pdf, got: %v", results)
+	}
+
+	// urls matching both the query & inbound anchors rank above urls only matching one
+	if err := saveLinkAnchors(appDB, src.Url, map[string]linkAnchor{"http://epa.gov/final": {Text: "final"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if results, err = SearchUrls(appDB, "final", 10, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 2 || results[0].Url != "http://epa.gov/final" {
+		t.Errorf("expected url & anchor matches to rank first, got: %v", results)
+	}
+
+	details := readLinkDetails(appDB, []*core.Link{{Src: src, Dst: &core.Url{Url: "http://epa.gov/files/b.pdf"}}}, time.Now())
+	if details[0].AnchorText != "budget" {
+		t.Errorf("expected link details to include anchor text, got: %q", details[0].AnchorText)
+	}
+}
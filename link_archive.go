@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+const (
+	// quarantinedErrCode is set when archiving a quarantined destination without
+	// forcing it, so the frontend can ask for confirmation
+	quarantinedErrCode = "LINK_QUARANTINED"
+	// linkArchiveLimitErrCode is set when an ip address has used up it's link archives for the day
+	linkArchiveLimitErrCode = "LINK_ARCHIVE_LIMIT_REACHED"
+	// most link archive requests waiting to be processed
+	linkArchiveQueueSize = 64
+)
+
+var (
+	// ErrLinkArchiveDisabled is returned for link archive requests when they're turned off
+	ErrLinkArchiveDisabled = fmt.Errorf("archiving links on demand isn't available")
+	// ErrLinkNotFound is returned when archiving a link that hasn't been captured
+	ErrLinkNotFound = fmt.Errorf("link not found")
+	// ErrLinkQuarantined is returned when archiving a quarantined destination without force
+	ErrLinkQuarantined = fmt.Errorf("this link's destination is quarantined, archiving it must be forced")
+	// ErrLinkArchiveLimit is returned once an ip address has used up it's link archives for the day
+	ErrLinkArchiveLimit = fmt.Errorf("you've reached today's limit for archiving links")
+	// ErrLinkArchiveBusy is returned when the link archive queue is full
+	ErrLinkArchiveBusy = fmt.Errorf("too many links are waiting to be archived, please try again in a few minutes")
+)
+
+// LinkHealth describes how a link's destination fared the last time it was captured
+type LinkHealth struct {
+	// http status of the last capture, 0 if the destination has never been captured
+	LastStatus int `json:"lastStatus"`
+	// quarantined destinations have been suppressed by a moderator, & are only
+	// archived on demand when forced
+	Quarantined bool `json:"quarantined"`
+	// seconds since the last capture, rounded down to the minute so responses
+	// stay cacheable. nil if the destination has never been captured
+	CaptureAge *int64 `json:"captureAge,omitempty"`
+}
+
+// linkDetail is the wire format for links: a link with the health of it's
+// destination. Link fields are copied rather than embedded, core.Link's
+// untagged Hash field would otherwise serialize as "Hash"
+type linkDetail struct {
+	Hash    string      `json:"hash"`
+	Created time.Time   `json:"created"`
+	Updated time.Time   `json:"updated"`
+	Src     *core.Url   `json:"src"`
+	Dst     *core.Url   `json:"dst"`
+	Health  *LinkHealth `json:"health"`
+	// text & rel attribute of the HTML anchor, empty for links found by other extractors
+	AnchorText string `json:"anchorText,omitempty"`
+	Rel        string `json:"rel,omitempty"`
+}
+
+// isQuarantined checks if a url shouldn't be archived on demand without force
+func isQuarantined(u *core.Url) bool {
+	return isSuppressed(u)
+}
+
+// linkHealth reports the health of a link destination as of now
+func linkHealth(dst *core.Url, now time.Time) *LinkHealth {
+	h := &LinkHealth{}
+	if dst == nil {
+		return h
+	}
+	h.LastStatus = dst.Status
+	h.Quarantined = isQuarantined(dst)
+	if dst.LastGet != nil {
+		age := int64(now.Sub(*dst.LastGet).Truncate(time.Minute) / time.Second)
+		if age < 0 {
+			age = 0
+		}
+		h.CaptureAge = &age
+	}
+	return h
+}
+
+// newLinkDetails adds destination health to a list of links
+func newLinkDetails(links []*core.Link, now time.Time) []*linkDetail {
+	details := make([]*linkDetail, len(links))
+	for i, l := range links {
+		details[i] = &linkDetail{
+			Hash:    l.Hash,
+			Created: l.Created,
+			Updated: l.Updated,
+			Src:     l.Src,
+			Dst:     l.Dst,
+			Health:  linkHealth(l.Dst, now),
+		}
+	}
+	return details
+}
+
+// linkExists checks that a link from src to dst has been captured
+func linkExists(db *sql.DB, src, dst string) (exists bool, err error) {
+	err = db.QueryRow("select exists(select 1 from links where src = $1 and dst = $2)", src, dst).Scan(&exists)
+	return
+}
+
+// linkArchivesSince counts link archive requests from a requester since a
+// time, & returns when the earliest of them was made
+func linkArchivesSince(db *sql.DB, requester string, since time.Time) (count int, earliest time.Time, err error) {
+	err = db.QueryRow("select count(1), coalesce(min(created), $2) from archive_requests where via != '' and requester = $1 and created > $2",
+		requester, since.In(time.UTC)).Scan(&count, &earliest)
+	return
+}
+
+// linkArchiveUsage counts link archive requests from each requester since a time
+func linkArchiveUsage(db *sql.DB, since time.Time) (map[string]int, error) {
+	return countArchiveRequests(db, "select requester, count(1) from archive_requests where via != '' and created > $1 group by requester", since)
+}
+
+// archiveRequestSubject is the subject clients subscribe to for progress of an
+// archive request, see SubjectSubscribeAction
+func archiveRequestSubject(id int64) string {
+	return fmt.Sprintf("archive_request.%d", id)
+}
+
+// linkArchiveJob is a single link destination waiting to be archived
+type linkArchiveJob struct {
+	svc *Service
+	id  int64
+	url *core.Url
+}
+
+// linkArchiveQueue holds link archive requests, processed one at a time
+var linkArchiveQueue = make(chan *linkArchiveJob, linkArchiveQueueSize)
+
+// runLinkArchives processes link archive requests one at a time
+func runLinkArchives() {
+	for job := range linkArchiveQueue {
+		job.run()
+	}
+}
+
+// run GET's the link destination, publishing progress to the request's subject.
+// links the destination references aren't followed
+func (j *linkArchiveJob) run() {
+	j.publish("URL_SET_LOADING", false, map[string]interface{}{"url": j.url.Url, "loading": true})
+	prev := j.url.Hash
+	if _, _, err := j.svc.getRetained(j.url, nil, retentionEphemeral); err != nil {
+		j.svc.Log.Info(err.Error())
+		j.publish("URL_SET_ERROR", false, map[string]interface{}{"url": j.url.Url, "error": err.Error()})
+		return
+	}
+	j.publish("URL_SET_SUCCESS", j.url.Hash != prev, map[string]interface{}{"url": j.url.Url, "success": true})
+}
+
+// publish sends progress to every client subscribed to the request's subject
+func (j *linkArchiveJob) publish(typ string, changed bool, data interface{}) {
+	j.svc.publishArchiveProgress(j.id, typ, changed, data)
+}
+
+// publishArchiveProgress sends progress to every client subscribed to an
+// archive request's subject. changed is set for captures that changed a url's content
+func (s *Service) publishArchiveProgress(id int64, typ string, changed bool, data interface{}) {
+	if s.Hub == nil {
+		return
+	}
+	subject := archiveRequestSubject(id)
+	msg, err := json.Marshal(&ClientResponse{
+		Type:      typ,
+		RequestId: "server",
+		Id:        subject,
+		Data:      data,
+	})
+	if err != nil {
+		s.Log.Info(err.Error())
+		return
+	}
+	s.Hub.publish <- &topicMessage{topic: subjectTopic(subject), data: msg, event: typ, contentChanged: changed}
+}
+
+// ArchiveLinkAction archives a single destination from a page's outbound links.
+// the destination falls under the page's subprimer, so it doesn't need to match
+// one itself. Requests are limited per ip address per day, & quarantined
+// destinations must be forced
+type ArchiveLinkAction struct {
+	ReqAction
+	clientAction
+	// page the link was found on
+	Src string `json:"src"`
+	// link destination to archive
+	Dst   string `json:"dst"`
+	Force bool   `json:"force"`
+}
+
+func (ArchiveLinkAction) Type() string        { return "ARCHIVE_LINK_REQUEST" }
+func (ArchiveLinkAction) SuccessType() string { return "ARCHIVE_LINK_SUCCESS" }
+func (ArchiveLinkAction) FailureType() string { return "ARCHIVE_LINK_FAILURE" }
+
+func (ArchiveLinkAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &ArchiveLinkAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *ArchiveLinkAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		log.Info(a.err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+	if a.client == nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrLinkArchiveDisabled.Error()}
+	}
+	s := a.client.service()
+	if s.Config == nil || s.Config.LinkArchivesPerDay <= 0 {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrLinkArchiveDisabled.Error()}
+	}
+
+	exists, err := linkExists(s.DB, a.Src, a.Dst)
+	if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: "internal server error"}
+	}
+	if !exists {
+		res := notFoundResponse(a, a.RequestId, "link", a.Src+" "+a.Dst)
+		res.Error = ErrLinkNotFound.Error()
+		return res
+	}
+
+	dst := &core.Url{Url: a.Dst}
+	if err := dst.Read(s.Store); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "url", a.Dst)
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if isQuarantined(dst) && !a.Force {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrLinkQuarantined.Error(),
+			Code:      quarantinedErrCode,
+			Schema:    "LINK_HEALTH",
+			Data:      linkHealth(dst, s.Clock()),
+		}
+	}
+
+	// the page the link was found on must be archivable, the destination inherits it's subprimer
+	if err := s.ValidArchivingUrl(a.Src); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	for _, u := range []string{a.Src, dst.Url} {
+		if err := s.checkArchiveAccess(u, a.client.identity()); err != nil {
+			return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+		}
+	}
+
+	url, _, err := s.RedactArchivingUrl(dst.Url)
+	if err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	refusal, err := rateLimits.admit(s, a.client.limitKeys(), s.Clock(), limitLinkArchives)
+	if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: "internal server error"}
+	}
+	if refusal != nil {
+		refusal.logUserAction(s.DB, a.client.requester(), s.Clock())
+		return refusal.response(a, a.RequestId)
+	}
+
+	id, err := s.recordArchiveRequest(url, archiveRequester{userId: a.client.requester(), requester: a.client.archiveRequester(), via: a.Src})
+	if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	// subscribe the requester before the job can publish anything
+	subject := archiveRequestSubject(id)
+	a.client.Subscribe(subjectTopic(subject))
+	select {
+	case linkArchiveQueue <- &linkArchiveJob{svc: s, id: id, url: dst}:
+	default:
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrLinkArchiveBusy.Error()}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "ARCHIVE_REQUEST",
+		Id:        subject,
+		Data: map[string]interface{}{
+			"id":      id,
+			"subject": subject,
+			"url":     dst.Url,
+			"health":  linkHealth(dst, s.Clock()),
+		},
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestLinkHealth(t *testing.T) {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	captured := now.Add(-90 * time.Second)
+
+	cases := []struct {
+		dst         *core.Url
+		status      int
+		quarantined bool
+		age         int64
+	}{
+		{nil, 0, false, -1},
+		{&core.Url{Url: "http://epa.gov/never"}, 0, false, -1},
+		{&core.Url{Url: "http://epa.gov/ok", Status: 200, LastGet: &captured}, 200, false, 60},
+		{&core.Url{Url: "http://epa.gov/gone", Status: 404, LastGet: &now}, 404, false, 0},
+		{&core.Url{Url: "http://epa.gov/bad", Status: 200, LastGet: &now, Meta: map[string]interface{}{suppressedMetaKey: true}}, 200, true, 0},
+	}
+
+	for i, c := range cases {
+		h := linkHealth(c.dst, now)
+		if h.LastStatus != c.status || h.Quarantined != c.quarantined {
+			t.Errorf("case %d mismatch. expected: %d %t, got: %d %t", i, c.status, c.quarantined, h.LastStatus, h.Quarantined)
+		}
+		if c.age < 0 && h.CaptureAge != nil {
+			t.Errorf("case %d expected no capture age, got: %d", i, *h.CaptureAge)
+		} else if c.age >= 0 && (h.CaptureAge == nil || *h.CaptureAge != c.age) {
+			t.Errorf("case %d capture age mismatch. expected: %d, got: %v", i, c.age, h.CaptureAge)
+		}
+	}
+}
+
+func TestArchiveLinkDisabled(t *testing.T) {
+	svc := NewService(nil, nil, &config{})
+	a := ArchiveLinkAction{}.Parse("req", []byte(`{"src":"http://epa.gov","dst":"http://epa.gov/a"}`)).(*ArchiveLinkAction)
+	a.SetClient(&Client{addr: "127.0.0.1", svc: svc})
+	if res := a.Exec(); res.Type != a.FailureType() || res.Error != ErrLinkArchiveDisabled.Error() {
+		t.Errorf("expected link archiving to be disabled, got: %s %s", res.Type, res.Error)
+	}
+}
+
+func TestArchiveLink(t *testing.T) {
+	// the destination is outside every source, so can only be archived through the link
+	requests := 0
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`<html><head><title>Elsewhere</title></head><body></body></html>`))
+	}))
+	defer other.Close()
+
+	site := newTestSite(t, map[string]*testPage{})
+	defer site.Close()
+	svc := site.svc
+	svc.Config.LinkArchivesPerDay = 1
+	defer svc.DB.Exec("delete from urls where url like $1", other.URL+"%")
+	defer svc.DB.Exec("delete from archive_requests where url like $1", other.URL+"%")
+
+	src, dst := &core.Url{Url: site.Url("/")}, &core.Url{Url: other.URL + "/data"}
+	for _, u := range []*core.Url{src, dst} {
+		if err := u.Save(svc.Store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if _, err := svc.DB.Exec("insert into links (created,updated,src,dst) values (now(), now(), $1, $2)", src.Url, dst.Url); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	exec := func(data string) *ClientResponse {
+		a := ArchiveLinkAction{}.Parse("req", []byte(data)).(*ArchiveLinkAction)
+		a.SetClient(&Client{addr: "127.0.0.1", svc: svc})
+		return a.Exec()
+	}
+
+	if res := exec(`{"src":"` + src.Url + `","dst":"` + src.Url + `/missing"}`); res.Error != ErrLinkNotFound.Error() {
+		t.Errorf("expected missing link to fail, got: %s", res.Error)
+	}
+
+	if _, err := svc.DB.Exec(`update urls set meta = '{"suppressed":true}' where url = $1`, dst.Url); err != nil {
+		t.Fatal(err.Error())
+	}
+	if res := exec(`{"src":"` + src.Url + `","dst":"` + dst.Url + `"}`); res.Code != quarantinedErrCode {
+		t.Errorf("expected quarantined destination to require force, got: %s %s", res.Code, res.Error)
+	}
+
+	res := exec(`{"src":"` + src.Url + `","dst":"` + dst.Url + `","force":true}`)
+	if res.Type != "ARCHIVE_LINK_SUCCESS" {
+		t.Fatalf("expected forced link archive to succeed, got: %s", res.Error)
+	}
+	if res.Id == "" {
+		t.Errorf("expected response to carry the archive request subject")
+	}
+
+	job := <-linkArchiveQueue
+	job.run()
+	if requests != 1 {
+		t.Errorf("expected destination to be requested once, got: %d", requests)
+	}
+	if u := readArchivedUrl(t, dst.Url); u.Title != "Elsewhere" {
+		t.Errorf("expected destination to be archived, got title: %s", u.Title)
+	}
+	if got := countRows(t, "select count(1) from archive_requests where url = $1 and via = $2 and config_snapshot != ''", dst.Url, src.Url); got != 1 {
+		t.Errorf("expected archive request to inherit the page's subprimer, got %d matching requests", got)
+	}
+
+	if res := exec(`{"src":"` + src.Url + `","dst":"` + dst.Url + `","force":true}`); res.Code != linkArchiveLimitErrCode {
+		t.Errorf("expected second link archive to hit the daily limit, got: %s %s", res.Code, res.Error)
+	}
+}
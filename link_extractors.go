@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+const (
+	// linkExtractorsMetaKey is the source meta key that turns extractors on or off
+	// for captures under that source, eg: {"linkExtractors": {"json": true, "css": false}}
+	linkExtractorsMetaKey = "linkExtractors"
+	// most of a body extractors read, anything past this is ignored
+	maxExtractBytes = 2 << 20
+	// most links a single extractor can return for a body
+	maxExtractedLinks = 1000
+	// longest a single extractor can run for
+	extractTimeout = 2 * time.Second
+)
+
+// LinkExtractor finds urls in content other than HTML. HTML anchors are
+// extracted by core when a url is fetched & recorded as found by "html"
+type LinkExtractor interface {
+	// Name is recorded on each link the extractor finds
+	Name() string
+	// Match checks if the extractor understands a url's content.
+	// mediaType is the url's content type, without parameters
+	Match(u *url.URL, mediaType string) bool
+	// Extract returns raw urls found in body, which may be relative. Extract
+	// must return what it has found so far when ctx is done
+	Extract(ctx context.Context, body []byte) ([]string, error)
+	// Default reports weather the extractor runs when a source doesn't say
+	Default() bool
+}
+
+// linkExtractors are tried in order for every capture
+var linkExtractors = []LinkExtractor{
+	cssExtractor{},
+	feedExtractor{},
+	robotsExtractor{},
+	jsonExtractor{},
+}
+
+// extractorEnabled checks if a source has an extractor turned on
+func extractorEnabled(s *core.Source, e LinkExtractor) bool {
+	if s != nil {
+		if toggles, ok := s.Meta[linkExtractorsMetaKey].(map[string]interface{}); ok {
+			if on, ok := toggles[e.Name()].(bool); ok {
+				return on
+			}
+		}
+	}
+	return e.Default()
+}
+
+// extractLinks runs all enabled extractors that match a capture, saving a link
+// from u to every absolute http(s) url they find. found maps each url to the
+// extractor that found it
+func extractLinks(db *sql.DB, s *core.Source, u *core.Url, body []byte) (links []*core.Link, found map[string]string, err error) {
+	base, err := u.ParsedUrl()
+	if err != nil {
+		return nil, nil, err
+	}
+	mediaType, _, err := mime.ParseMediaType(u.ContentType)
+	if err != nil {
+		mediaType = ""
+	}
+	if len(body) > maxExtractBytes {
+		body = body[:maxExtractBytes]
+	}
+
+	links = []*core.Link{}
+	found = map[string]string{}
+	for _, e := range linkExtractors {
+		if !extractorEnabled(s, e) || !e.Match(base, mediaType) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), extractTimeout)
+		raw, err := e.Extract(ctx, body)
+		cancel()
+		if err != nil {
+			log.Infof("%s link extraction error for %s: %s", e.Name(), u.Url, err.Error())
+		}
+
+		for _, dst := range resolveLinks(base, raw) {
+			l, err := saveExtractedLink(db, u, dst, e.Name())
+			if err != nil {
+				return links, found, err
+			}
+			links = append(links, l)
+			found[dst] = e.Name()
+		}
+	}
+	return links, found, nil
+}
+
+// resolveLinks resolves raw urls against base, keeping unique absolute
+// http(s) urls without fragments
+func resolveLinks(base *url.URL, raw []string) (urls []string) {
+	seen := map[string]bool{}
+	for _, r := range raw {
+		u, err := base.Parse(strings.TrimSpace(r))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			continue
+		}
+		u.Fragment = ""
+		if s := u.String(); !seen[s] && s != base.String() {
+			seen[s] = true
+			urls = append(urls, s)
+		}
+	}
+	return
+}
+
+// saveExtractedLink creates a link from src to dst, creating dst if it doesn't
+// exist. links that already exist keep the extractor that first found them
+func saveExtractedLink(db *sql.DB, src *core.Url, dst, extractor string) (*core.Link, error) {
+	d := &core.Url{Url: dst}
+	if err := d.Read(store); err == ErrNotFound {
+		// core may be creating the same url in the background, losing that race is fine
+		if err := checkWriteErr(d.Save(store)); err != nil && d.Read(store) != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Round(time.Second).In(time.UTC)
+	_, err := db.Exec("insert into links (created,updated,src,dst,extractor) values ($1, $1, $2, $3, $4) on conflict (src, dst) do nothing",
+		now, src.Url, d.Url, extractor)
+	if err := checkWriteErr(err); err != nil {
+		return nil, err
+	}
+	return &core.Link{Created: now, Updated: now, Src: src, Dst: d}, nil
+}
+
+// saveDocLinks saves a link from u to every url found by "html" in a list from
+// captureLinks, returning them sorted by destination
+func saveDocLinks(db *sql.DB, u *core.Url, found map[string]string) ([]*core.Link, error) {
+	dsts := []string{}
+	for dst, extractor := range found {
+		if extractor == "html" {
+			dsts = append(dsts, dst)
+		}
+	}
+	sort.Strings(dsts)
+
+	links := make([]*core.Link, 0, len(dsts))
+	for _, dst := range dsts {
+		l, err := saveExtractedLink(db, u, dst, "html")
+		if err != nil {
+			return links, err
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// cssExtractor finds url(...) references & @import rules in stylesheets
+type cssExtractor struct{}
+
+var cssUrlPattern = regexp.MustCompile(`(?i)url\(\s*['"]?([^'")\s]+)['"]?\s*\)|@import\s+['"]([^'"]+)['"]`)
+
+func (cssExtractor) Name() string  { return "css" }
+func (cssExtractor) Default() bool { return true }
+func (cssExtractor) Match(u *url.URL, mediaType string) bool {
+	return mediaType == "text/css" || path.Ext(u.Path) == ".css"
+}
+func (cssExtractor) Extract(ctx context.Context, body []byte) (urls []string, err error) {
+	for _, m := range cssUrlPattern.FindAllSubmatch(body, maxExtractedLinks) {
+		if ctx.Err() != nil {
+			return urls, ctx.Err()
+		}
+		if ref := string(m[1]) + string(m[2]); !strings.HasPrefix(ref, "data:") {
+			urls = append(urls, ref)
+		}
+	}
+	return urls, nil
+}
+
+// feedExtractor finds entry links in RSS & Atom feeds, and page urls in sitemaps
+type feedExtractor struct{}
+
+func (feedExtractor) Name() string  { return "feed" }
+func (feedExtractor) Default() bool { return true }
+func (feedExtractor) Match(u *url.URL, mediaType string) bool {
+	switch mediaType {
+	case "application/rss+xml", "application/atom+xml", "application/xml", "text/xml":
+		return true
+	}
+	return false
+}
+func (feedExtractor) Extract(ctx context.Context, body []byte) (urls []string, err error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.Strict = false
+	// only the text of these elements is read
+	text := ""
+	for len(urls) < maxExtractedLinks {
+		if ctx.Err() != nil {
+			return urls, ctx.Err()
+		}
+		t, err := d.Token()
+		if err == io.EOF {
+			return urls, nil
+		} else if err != nil {
+			return urls, err
+		}
+
+		switch el := t.(type) {
+		case xml.StartElement:
+			text = ""
+			for _, attr := range el.Attr {
+				// atom <link href="">, rss <enclosure url="">
+				if (el.Name.Local == "link" && attr.Name.Local == "href") || (el.Name.Local == "enclosure" && attr.Name.Local == "url") {
+					urls = append(urls, attr.Value)
+				}
+			}
+		case xml.CharData:
+			text += string(el)
+		case xml.EndElement:
+			// rss <link>, sitemap <loc>
+			if (el.Name.Local == "link" || el.Name.Local == "loc") && strings.TrimSpace(text) != "" {
+				urls = append(urls, strings.TrimSpace(text))
+			}
+			text = ""
+		}
+	}
+	return urls, nil
+}
+
+// robotsExtractor finds sitemaps listed in robots.txt
+type robotsExtractor struct{}
+
+func (robotsExtractor) Name() string  { return "robots" }
+func (robotsExtractor) Default() bool { return true }
+func (robotsExtractor) Match(u *url.URL, mediaType string) bool {
+	return u.Path == "/robots.txt"
+}
+func (robotsExtractor) Extract(ctx context.Context, body []byte) (urls []string, err error) {
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for s.Scan() && len(urls) < maxExtractedLinks {
+		if ctx.Err() != nil {
+			return urls, ctx.Err()
+		}
+		line := strings.TrimSpace(s.Text())
+		if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(line[:i], "sitemap") {
+			urls = append(urls, strings.TrimSpace(line[i+1:]))
+		}
+	}
+	return urls, s.Err()
+}
+
+// jsonExtractor finds string values in JSON that are absolute urls. API
+// payloads are full of urls that aren't worth following, so it's off by default
+type jsonExtractor struct{}
+
+func (jsonExtractor) Name() string  { return "json" }
+func (jsonExtractor) Default() bool { return false }
+func (jsonExtractor) Match(u *url.URL, mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+func (jsonExtractor) Extract(ctx context.Context, body []byte) (urls []string, err error) {
+	var (
+		v     interface{}
+		visit func(v interface{}) error
+	)
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+
+	visit = func(v interface{}) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch val := v.(type) {
+		case string:
+			if u, err := url.Parse(val); err == nil && u.IsAbs() && u.Host != "" && len(urls) < maxExtractedLinks {
+				urls = append(urls, val)
+			}
+		case []interface{}:
+			for _, item := range val {
+				if err := visit(item); err != nil {
+					return err
+				}
+			}
+		case map[string]interface{}:
+			for _, item := range val {
+				if err := visit(item); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return urls, visit(v)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/datatogether/core"
+)
+
+func TestLinkExtractors(t *testing.T) {
+	cases := []struct {
+		e      LinkExtractor
+		body   string
+		expect []string
+	}{
+		{cssExtractor{}, `@import "reset.css"; body { background: url('/bg.png') } .a { background: url(data:image/png;base64,AA) }`, []string{"/bg.png", "reset.css"}},
+		{feedExtractor{}, `<rss><channel><link>http://epa.gov</link><item><link>http://epa.gov/a</link><enclosure url="http://epa.gov/a.mp3"/></item></channel></rss>`, []string{"http://epa.gov", "http://epa.gov/a", "http://epa.gov/a.mp3"}},
+		{feedExtractor{}, `<feed><entry><link href="http://epa.gov/b"/></entry></feed>`, []string{"http://epa.gov/b"}},
+		{feedExtractor{}, `<urlset><url><loc> http://epa.gov/c </loc></url></urlset>`, []string{"http://epa.gov/c"}},
+		{robotsExtractor{}, "User-agent: *\nDisallow: /private\nSitemap: http://epa.gov/sitemap.xml\n", []string{"http://epa.gov/sitemap.xml"}},
+		{jsonExtractor{}, `{"a":"http://epa.gov/d","b":["not a url","/relative",{"c":"https://epa.gov/e"}],"d":1}`, []string{"http://epa.gov/d", "https://epa.gov/e"}},
+	}
+
+	for i, c := range cases {
+		got, err := c.e.Extract(context.Background(), []byte(c.body))
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err.Error())
+			continue
+		}
+		if !sameStrings(got, c.expect) {
+			t.Errorf("case %d links mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestLinkExtractorMatch(t *testing.T) {
+	cases := []struct {
+		url, mediaType string
+		expect         []string
+	}{
+		{"http://epa.gov/style.css", "text/plain", []string{"css"}},
+		{"http://epa.gov/feed", "application/rss+xml", []string{"feed"}},
+		{"http://epa.gov/robots.txt", "text/plain", []string{"robots"}},
+		{"http://epa.gov/api", "application/vnd.api+json", []string{"json"}},
+		{"http://epa.gov/", "text/html", nil},
+	}
+
+	for i, c := range cases {
+		u, _ := url.Parse(c.url)
+		var got []string
+		for _, e := range linkExtractors {
+			if e.Match(u, c.mediaType) {
+				got = append(got, e.Name())
+			}
+		}
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("case %d extractor mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestExtractorEnabled(t *testing.T) {
+	toggled := &core.Source{Meta: map[string]interface{}{
+		linkExtractorsMetaKey: map[string]interface{}{"json": true, "css": false},
+	}}
+	cases := []struct {
+		s      *core.Source
+		e      LinkExtractor
+		expect bool
+	}{
+		{nil, cssExtractor{}, true},
+		{nil, jsonExtractor{}, false},
+		{toggled, cssExtractor{}, false},
+		{toggled, jsonExtractor{}, true},
+		{toggled, feedExtractor{}, true},
+	}
+
+	for i, c := range cases {
+		if got := extractorEnabled(c.s, c.e); got != c.expect {
+			t.Errorf("case %d enabled mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestResolveLinks(t *testing.T) {
+	base, _ := url.Parse("http://epa.gov/a/page")
+	got := resolveLinks(base, []string{"b", "/c#top", "/c", "mailto:a@epa.gov", "http://epa.gov/a/page", "https://nasa.gov"})
+	expect := []string{"http://epa.gov/a/b", "http://epa.gov/c", "https://nasa.gov"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("resolved links mismatch. expected: %v, got: %v", expect, got)
+	}
+}
+
+func TestExtractTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e := jsonExtractor{}
+	if _, err := e.Extract(ctx, []byte(`["http://epa.gov"]`)); err != context.Canceled {
+		t.Errorf("expected extraction to stop when it's context is done, got: %v", err)
+	}
+}
+
+// sameStrings compares string slices ignoring order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := map[string]int{}
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		if counts[s]--; counts[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
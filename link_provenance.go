@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+)
+
+// Link history events
+const (
+	linkAppeared    = "appeared"
+	linkDisappeared = "disappeared"
+)
+
+// LinkSighting is the discovery provenance of a link: which captures of it's
+// source it was first & last seen in, & when it stopped appearing if it has
+type LinkSighting struct {
+	Src          string     `json:"src"`
+	Dst          string     `json:"dst"`
+	Extractor    string     `json:"extractor"`
+	FirstSeen    time.Time  `json:"firstSeen"`
+	FirstCapture string     `json:"firstCapture"`
+	LastSeen     time.Time  `json:"lastSeen"`
+	LastCapture  string     `json:"lastCapture"`
+	Disappeared  *time.Time `json:"disappeared,omitempty"`
+}
+
+// LinkEvent records a capture in which a link appeared or disappeared
+type LinkEvent struct {
+	Event   string    `json:"event"`
+	Capture string    `json:"capture"`
+	At      time.Time `json:"at"`
+}
+
+// docLinkUrls lists the urls a parsed HTML document links to, resolved the
+// same way core resolves them when storing links
+func docLinkUrls(base *url.URL, doc *goquery.Document) (urls []string) {
+	doc.Find("[href]").Each(func(i int, s *goquery.Selection) {
+		val, _ := s.Attr("href")
+		if address, err := base.Parse(val); err == nil {
+			urls = append(urls, address.String())
+		}
+	})
+	return
+}
+
+// captureLinks lists every link found in a capture of u, keyed by destination
+// url with the name of the extractor that found it, along with the anchors of
+// HTML links. core extracts HTML links in the background, so they're found
+// again here rather than trusting what it returns
+func captureLinks(u *core.Url, body []byte, extracted map[string]string) (map[string]string, map[string]linkAnchor, error) {
+	found := map[string]string{}
+	anchors := map[string]linkAnchor{}
+	if u.ContentSniff == "text/html; charset=utf-8" || u.ContentSniff == "text/plain; charset=utf-8" {
+		base, err := u.ParsedUrl()
+		if err != nil {
+			return nil, nil, err
+		}
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, dst := range docLinkUrls(base, doc) {
+			found[dst] = "html"
+		}
+		anchors = docLinkAnchors(base, doc)
+	}
+	for dst, extractor := range extracted {
+		if _, ok := found[dst]; !ok {
+			found[dst] = extractor
+		}
+	}
+	return found, anchors, nil
+}
+
+// recordCaptureLinks records the provenance of links found in a fresh capture
+// of u, as listed by captureLinks
+func recordCaptureLinks(db *sql.DB, u *core.Url, body []byte, found map[string]string) error {
+	if u.LastGet == nil {
+		return nil
+	}
+	capture, err := hashContent(body)
+	if err != nil {
+		return err
+	}
+	return checkWriteErr(recordLinkSightings(db, u.Url, capture, *u.LastGet, found))
+}
+
+// recordLinkSightings updates the provenance of every link from src with a
+// capture taken at captured. links in found are seen, links previously seen
+// but missing from a newer capture are marked disappeared rather than deleted.
+// Recording the same capture twice changes nothing, & captures recorded out of
+// order (eg: from WARC imports) only move first & last seen outwards
+func recordLinkSightings(db *sql.DB, src, capture string, captured time.Time, found map[string]string) error {
+	captured = captured.Round(time.Second).In(time.UTC)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("select dst, first_seen, last_seen, disappeared from link_sightings where src = $1 for update", src)
+	if err != nil {
+		return err
+	}
+	existing := map[string]*LinkSighting{}
+	for rows.Next() {
+		s := &LinkSighting{Src: src}
+		if err := rows.Scan(&s.Dst, &s.FirstSeen, &s.LastSeen, &s.Disappeared); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[s.Dst] = s
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	event := func(dst, e string) error {
+		_, err := tx.Exec("insert into link_events (src,dst,event,capture,at) values ($1, $2, $3, $4, $5) on conflict do nothing",
+			src, dst, e, capture, captured)
+		return err
+	}
+
+	for dst, extractor := range found {
+		s, ok := existing[dst]
+		if !ok {
+			if _, err := tx.Exec(`insert into link_sightings (src,dst,extractor,first_seen,first_capture,last_seen,last_capture)
+				values ($1, $2, $3, $4, $5, $4, $5)`, src, dst, extractor, captured, capture); err != nil {
+				return err
+			}
+			if err := event(dst, linkAppeared); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if s.Disappeared != nil && !captured.Before(*s.Disappeared) {
+			if err := event(dst, linkAppeared); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("update link_sightings set disappeared = null, disappeared_capture = '' where src = $1 and dst = $2", src, dst); err != nil {
+				return err
+			}
+		}
+		if captured.Before(s.FirstSeen) {
+			if _, err := tx.Exec("update link_sightings set first_seen = $3, first_capture = $4 where src = $1 and dst = $2", src, dst, captured, capture); err != nil {
+				return err
+			}
+		}
+		if captured.After(s.LastSeen) {
+			if _, err := tx.Exec("update link_sightings set last_seen = $3, last_capture = $4 where src = $1 and dst = $2", src, dst, captured, capture); err != nil {
+				return err
+			}
+		}
+	}
+
+	for dst, s := range existing {
+		if _, ok := found[dst]; ok || s.Disappeared != nil || !captured.After(s.LastSeen) {
+			continue
+		}
+		if _, err := tx.Exec("update link_sightings set disappeared = $3, disappeared_capture = $4 where src = $1 and dst = $2", src, dst, captured, capture); err != nil {
+			return err
+		}
+		if err := event(dst, linkDisappeared); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// LinkHistory reads a link's provenance & the captures it appeared &
+// disappeared in, oldest first. captures are listed by their current hash, so
+// captures recorded before & after content was re-hashed read the same.
+// returns ErrNotFound for unseen links
+func LinkHistory(db *sql.DB, src, dst string) (*LinkSighting, []*LinkEvent, error) {
+	s := &LinkSighting{Src: src, Dst: dst}
+	err := db.QueryRow(`select extractor, first_seen, coalesce(f.new, first_capture), last_seen, coalesce(l.new, last_capture), disappeared from link_sightings
+		left join hash_aliases f on f.old = first_capture left join hash_aliases l on l.old = last_capture
+		where src = $1 and dst = $2`, src, dst).
+		Scan(&s.Extractor, &s.FirstSeen, &s.FirstCapture, &s.LastSeen, &s.LastCapture, &s.Disappeared)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := db.Query("select distinct event, coalesce(a.new, capture), at from link_events left join hash_aliases a on a.old = capture where src = $1 and dst = $2 order by at", src, dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	events := []*LinkEvent{}
+	for rows.Next() {
+		e := &LinkEvent{}
+		if err := rows.Scan(&e.Event, &e.Capture, &e.At); err != nil {
+			return nil, nil, err
+		}
+		events = append(events, e)
+	}
+	return s, events, rows.Err()
+}
+
+// LinkHistoryAction fetches when a link appeared & disappeared across captures of it's source
+type LinkHistoryAction struct {
+	ReqAction
+	clientAction
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+func (LinkHistoryAction) Type() string        { return "LINK_HISTORY_REQUEST" }
+func (LinkHistoryAction) SuccessType() string { return "LINK_HISTORY_SUCCESS" }
+func (LinkHistoryAction) FailureType() string { return "LINK_HISTORY_FAILURE" }
+
+func (LinkHistoryAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &LinkHistoryAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *LinkHistoryAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		log.Info(a.err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+
+	v, err := a.visibility()
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if !v.Url(a.Src) || !v.Url(a.Dst) {
+		return notFoundResponse(a, a.RequestId, "link", a.Src+" "+a.Dst)
+	}
+
+	sighting, events, err := LinkHistory(appDB, a.Src, a.Dst)
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "link", a.Src+" "+a.Dst)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "LINK_HISTORY",
+		Data: map[string]interface{}{
+			"link":   sighting,
+			"events": events,
+		},
+	}
+}
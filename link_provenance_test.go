@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestCaptureLinks(t *testing.T) {
+	u := &core.Url{Url: "http://epa.gov/a/", ContentSniff: "text/html; charset=utf-8"}
+	body := []byte(`<html><body><a href="b">b</a><a href="http://nasa.gov">nasa</a><link href="/style.css"></body></html>`)
+
+	found, anchors, err := captureLinks(u, body, map[string]string{"http://epa.gov/c": "css", "http://nasa.gov": "json"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := map[string]string{
+		"http://epa.gov/a/b":       "html",
+		"http://nasa.gov":          "html",
+		"http://epa.gov/style.css": "html",
+		"http://epa.gov/c":         "css",
+	}
+	if len(found) != len(expect) {
+		t.Errorf("expected %d links, got: %v", len(expect), found)
+	}
+	for dst, extractor := range expect {
+		if found[dst] != extractor {
+			t.Errorf("%s extractor mismatch. expected: %s, got: %s", dst, extractor, found[dst])
+		}
+	}
+	if anchors["http://nasa.gov"].Text != "nasa" || len(anchors) != 3 {
+		t.Errorf("expected anchors for html links only, got: %v", anchors)
+	}
+}
+
+func TestRecordLinkSightings(t *testing.T) {
+	defer resetTestData(appDB, "link_sightings", "link_events")
+
+	var (
+		src = "http://epa.gov"
+		dst = "http://epa.gov/data"
+		t1  = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		t2  = t1.Add(time.Hour)
+		t3  = t2.Add(time.Hour)
+	)
+	captures := []struct {
+		capture string
+		at      time.Time
+		found   map[string]string
+	}{
+		{"one", t1, map[string]string{dst: "html"}},
+		// recording the same capture twice changes nothing
+		{"one", t1, map[string]string{dst: "html"}},
+		{"two", t2, map[string]string{}},
+		{"three", t3, map[string]string{dst: "html"}},
+	}
+	for _, c := range captures {
+		if err := recordLinkSightings(appDB, src, c.capture, c.at, c.found); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	s, events, err := LinkHistory(appDB, src, dst)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !s.FirstSeen.Equal(t1) || !s.LastSeen.Equal(t3) || s.LastCapture != "three" || s.Disappeared != nil {
+		t.Errorf("unexpected sighting: %#v", s)
+	}
+
+	expect := []string{"one:appeared", "two:disappeared", "three:appeared"}
+	if len(events) != len(expect) {
+		t.Fatalf("expected %d events, got %d", len(expect), len(events))
+	}
+	for i, e := range events {
+		if got := e.Capture + ":" + e.Event; got != expect[i] {
+			t.Errorf("event %d mismatch. expected: %s, got: %s", i, expect[i], got)
+		}
+	}
+
+	// an older capture that's missing the link doesn't make it disappear
+	if err := recordLinkSightings(appDB, src, "zero", t1.Add(-time.Hour), map[string]string{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s, _, _ = LinkHistory(appDB, src, dst); s.Disappeared != nil {
+		t.Errorf("expected an older capture not to mark the link disappeared")
+	}
+}
@@ -55,6 +55,13 @@ func setupTestDatabase() func() {
 	return teardown
 }
 
+// newTestService creates a service over the test database with it's own copy
+// of the test config. tests change a service's fields rather than package globals
+func newTestService() *Service {
+	c := *cfg
+	return NewService(appDB, store, &c)
+}
+
 // WARNING - THIS ZAPS WHATEVER DB IT'S GIVEN. DO NOT CALL THIS SHIT.
 // used for testing only, returns a teardown func
 func initializeAppSchema(db *sql.DB) (func(), error) {
@@ -73,6 +80,47 @@ func initializeAppSchema(db *sql.DB) (func(), error) {
 		"create-snapshots",
 		"create-collections",
 		"create-archive_requests",
+		"create-config_snapshots",
+		"create-fetch_forensics",
+		"create-reconcile_jobs",
+		"create-source_memberships",
+		"create-membership_changes",
+		"create-moderation_cases",
+		"create-content_reports",
+		"create-moderation_log",
+		"create-meta_fields",
+		"create-erase_jobs",
+		"create-feature_flags",
+		"create-feature_flag_overrides",
+		"create-relations",
+		"create-link_sightings",
+		"create-link_events",
+		"create-fetch_recordings",
+		"create-fetch_exchanges",
+		"create-leases",
+		"create-saved_searches",
+		"create-saved_search_matches",
+		"create-bandwidth",
+		"create-hash_aliases",
+		"create-rehash_jobs",
+		"create-capture_retention",
+		"create-collection_access",
+		"create-collection_changes",
+		"create-chain_health_runs",
+		"create-api_keys",
+		"create-api_key_log",
+		"create-hook_archives",
+		"create-render_cards",
+		"create-render_favicons",
+		"create-user_exports",
+		"create-announcements",
+		"create-announcement_dismissals",
+		"create-idle_verifications",
+		"create-capture_notes",
+		"create-user_actions",
+		"create-outbox",
+		"create-meta_key_renames",
+		"create-cache_snapshots",
 		"create-uncrawlables",
 	} {
 		if _, err := schema.Exec(db, cmd); err != nil {
@@ -109,3 +157,18 @@ func resetTestData(db *sql.DB, tables ...string) error {
 	}
 	return nil
 }
+
+// drops test data from passed in tables without re-inserting it. callers
+// should defer resetTestData for any base data they remove
+func emptyTestData(db *sql.DB, tables ...string) error {
+	schema, err := dotsql.LoadFromFile("sql/test_data.sql")
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if _, err := schema.Exec(db, fmt.Sprintf("delete-%s", t)); err != nil {
+			return fmt.Errorf("error delete-%s: %s", t, err.Error())
+		}
+	}
+	return nil
+}
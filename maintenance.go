@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Event types broadcast to clients when maintenance mode changes
+const (
+	EventMaintenanceStarted = "MAINTENANCE_MODE_STARTED"
+	EventMaintenanceEnded   = "MAINTENANCE_MODE_ENDED"
+)
+
+const (
+	// maintenanceErrCode is set as the code of responses rejected during maintenance
+	maintenanceErrCode = "MAINTENANCE_MODE"
+	// reasons for entering maintenance mode
+	maintenanceReasonReadOnly  = "datastore is read-only"
+	maintenanceReasonScheduled = "scheduled maintenance"
+	// how often a read-only datastore is checked for writability
+	maintenanceProbeInterval = 30 * time.Second
+	// estimated duration of maintenance when the datastore unexpectedly goes read-only
+	maintenanceDefaultEstimate = 30 * time.Minute
+)
+
+// ErrMaintenanceMode is returned for writes attempted while in maintenance mode
+var ErrMaintenanceMode = fmt.Errorf("the archive is undergoing maintenance & isn't accepting changes right now, please try again later")
+
+// MaintenanceStatus describes a period of maintenance
+type MaintenanceStatus struct {
+	Reason  string    `json:"reason"`
+	Started time.Time `json:"started"`
+	// estimated end time of maintenance
+	Until time.Time `json:"until"`
+	// explicit maintenance is only ended by configuration, never by probing
+	explicit bool
+}
+
+// maintenanceMode tracks weather the service is in degraded, read-only operation.
+// while active, archiving & content writes are rejected, reads carry on as normal
+type maintenanceMode struct {
+	sync.RWMutex
+	// status is nil while not in maintenance
+	status *MaintenanceStatus
+}
+
+// maintenance is the package-level maintenance state
+var maintenance = &maintenanceMode{}
+
+// writeActions lists request types that are rejected during maintenance
+var writeActions = map[string]bool{
+	SaveMetadataAction{}.Type():          true,
+	SaveCollectionAction{}.Type():        true,
+	DeleteCollectionAction{}.Type():      true,
+	SaveCollectionItemsAction{}.Type():   true,
+	DeleteCollectionItemsAction{}.Type(): true,
+	TaskEnqueueAct{}.Type():              true,
+	ReportContentAction{}.Type():         true,
+	ResolveCaseAction{}.Type():           true,
+	SaveMetaFieldsAction{}.Type():        true,
+	DeleteMetaFieldsAction{}.Type():      true,
+	TrialArchiveAction{}.Type():          true,
+	ArchiveLinkAction{}.Type():           true,
+	SaveSavedSearchAction{}.Type():       true,
+	DeleteSavedSearchAction{}.Type():     true,
+	AddCaptureNoteAction{}.Type():        true,
+	DeleteCaptureNoteAction{}.Type():     true,
+	RequeueDeadLetterAction{}.Type():     true,
+	RenameMetaKeyAction{}.Type():         true,
+	SaveAnnouncementAction{}.Type():      true,
+	DeleteAnnouncementAction{}.Type():    true,
+	DismissAnnouncementAction{}.Type():   true,
+	UserExportAction{}.Type():            true,
+	ReconcileMembershipAction{}.Type():   true,
+}
+
+// Status returns a copy of the current maintenance status, nil if not in maintenance
+func (m *maintenanceMode) Status() *MaintenanceStatus {
+	m.RLock()
+	defer m.RUnlock()
+	if m.status == nil {
+		return nil
+	}
+	s := *m.status
+	return &s
+}
+
+// Check returns ErrMaintenanceMode if writes aren't currently accepted
+func (m *maintenanceMode) Check() error {
+	if m.Status() != nil {
+		return ErrMaintenanceMode
+	}
+	return nil
+}
+
+// Enter starts maintenance, reporting weather this changed the mode. Explicit
+// maintenance replaces any detected maintenance already in effect
+func (m *maintenanceMode) Enter(reason string, until time.Time, explicit bool) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.status != nil && (m.status.explicit || !explicit) {
+		return false
+	}
+	m.status = &MaintenanceStatus{
+		Reason:   reason,
+		Started:  time.Now().Round(time.Second).In(time.UTC),
+		Until:    until.Round(time.Second).In(time.UTC),
+		explicit: explicit,
+	}
+	return true
+}
+
+// Leave ends maintenance, reporting weather this changed the mode. Explicit
+// maintenance is only left if explicit is true
+func (m *maintenanceMode) Leave(explicit bool) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.status == nil || (m.status.explicit && !explicit) {
+		return false
+	}
+	m.status = nil
+	return true
+}
+
+// checkWriteErr inspects an error from a datastore write. errors caused by a
+// read-only datastore move the service into maintenance mode & are replaced
+// with ErrMaintenanceMode, all other errors are returned as-is
+func checkWriteErr(err error) error {
+	if err == nil || !isReadOnlyErr(err) {
+		return err
+	}
+
+	if maintenance.Enter(maintenanceReasonReadOnly, time.Now().Add(maintenanceDefaultEstimate), false) {
+		log.Infof("datastore is read-only, entering maintenance mode: %s", err.Error())
+		announceMaintenance()
+		if appDB != nil {
+			go watchReadOnly(appDB)
+		}
+	}
+	return ErrMaintenanceMode
+}
+
+// isReadOnlyErr checks if an error came from writing to a read-only datastore, either
+// a read-only postgres transaction or a read-only filesystem underneath it
+func isReadOnlyErr(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "25006" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "read-only file system")
+}
+
+// datastoreWritable probes weather the datastore currently accepts writes. The
+// probe writes a temp table in a transaction that's always rolled back
+func datastoreWritable(db *sql.DB) (bool, error) {
+	var readOnly string
+	if err := db.QueryRow("show transaction_read_only").Scan(&readOnly); err != nil {
+		return false, err
+	}
+	if readOnly == "on" {
+		return false, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("create temp table maintenance_probe (id integer) on commit drop"); err != nil {
+		if isReadOnlyErr(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// watchReadOnly probes the datastore until it's writable again, then leaves maintenance
+func watchReadOnly(db *sql.DB) {
+	ticker := time.NewTicker(maintenanceProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s := maintenance.Status(); s == nil || s.explicit {
+			return
+		}
+		writable, err := datastoreWritable(db)
+		if err != nil {
+			log.Infof("error probing datastore: %s", err.Error())
+			continue
+		}
+		if writable {
+			if maintenance.Leave(false) {
+				log.Info("datastore is writable, leaving maintenance mode")
+				announceMaintenance()
+			}
+			return
+		}
+	}
+}
+
+// startConfiguredMaintenance enters explicit maintenance if it's set in config
+func startConfiguredMaintenance(c *config) error {
+	if !c.MaintenanceMode {
+		return nil
+	}
+	until := time.Now().Add(maintenanceDefaultEstimate)
+	if c.MaintenanceUntil != "" {
+		t, err := time.Parse(time.RFC3339, c.MaintenanceUntil)
+		if err != nil {
+			return fmt.Errorf("MAINTENANCE_UNTIL must be an RFC3339 timestamp: %s", err.Error())
+		}
+		until = t
+	}
+	maintenance.Enter(maintenanceReasonScheduled, until, true)
+	log.Infof("starting in maintenance mode until %s", until.Format(time.RFC3339))
+	return nil
+}
+
+// announceMaintenance tells all connected clients the current maintenance state
+func announceMaintenance() {
+	e := &Event{Type: EventMaintenanceEnded, Origin: instanceId}
+	if s := maintenance.Status(); s != nil {
+		e.Type = EventMaintenanceStarted
+		e.Data = s
+	}
+	broadcastEvent(e)
+}
+
+// maintenanceResponse is the response for a write action rejected during
+// maintenance, nil if the action should proceed
+func maintenanceResponse(t ClientRequestAction, reqId string) *ClientResponse {
+	if !writeActions[t.Type()] {
+		return nil
+	}
+	s := maintenance.Status()
+	if s == nil {
+		return nil
+	}
+	return &ClientResponse{
+		Type:      t.FailureType(),
+		RequestId: reqId,
+		Error:     ErrMaintenanceMode.Error(),
+		Code:      maintenanceErrCode,
+		Schema:    "MAINTENANCE_STATUS",
+		Data:      s,
+	}
+}
+
+// ReadinessHandler reports weather this instance is ready for full service.
+// reads continue during maintenance, but the instance reports itself as unready
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	defaultService().serveReadiness(w, r)
+}
+
+// serveReadiness reports weather s is ready for full service
+func (s *Service) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	res := map[string]interface{}{"status": http.StatusOK, "guardrails": s.Guardrails.Status()}
+	if m := maintenance.Status(); m != nil {
+		res["status"] = http.StatusServiceUnavailable
+		res["code"] = maintenanceErrCode
+		res["maintenance"] = m
+	} else if s.Guardrails.Level() >= shedConnections {
+		// instances refusing connections aren't ready for more traffic
+		res["status"] = http.StatusServiceUnavailable
+		res["code"] = serverBusyErrCode
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res["status"].(int))
+	w.Write(data)
+}
+
+// writeMaintenanceError responds to an http request rejected during maintenance
+func writeMaintenanceError(w http.ResponseWriter) {
+	s := maintenance.Status()
+	if s != nil {
+		w.Header().Set("Retry-After", s.Until.Format(http.TimeFormat))
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"code":        maintenanceErrCode,
+		"error":       ErrMaintenanceMode.Error(),
+		"maintenance": s,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(data)
+}
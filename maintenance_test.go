@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	m := &maintenanceMode{}
+	until := time.Now().Add(time.Hour)
+
+	if !m.Enter(maintenanceReasonReadOnly, until, false) {
+		t.Errorf("expected entering maintenance to change mode")
+	}
+	if m.Enter(maintenanceReasonReadOnly, until, false) {
+		t.Errorf("expected entering maintenance twice to not change mode")
+	}
+	if m.Check() != ErrMaintenanceMode {
+		t.Errorf("expected check to fail during maintenance")
+	}
+
+	// explicit maintenance takes over & can't be left by probing
+	if !m.Enter(maintenanceReasonScheduled, until, true) {
+		t.Errorf("expected explicit maintenance to replace detected maintenance")
+	}
+	if m.Leave(false) {
+		t.Errorf("expected explicit maintenance to not be left implicitly")
+	}
+	if !m.Leave(true) || m.Status() != nil {
+		t.Errorf("expected explicit leave to end maintenance")
+	}
+	if m.Check() != nil {
+		t.Errorf("expected check to pass outside of maintenance")
+	}
+}
+
+func TestCheckWriteErr(t *testing.T) {
+	defer maintenance.Leave(true)
+
+	other := fmt.Errorf("duplicate key")
+	cases := []struct {
+		in     error
+		expect error
+	}{
+		{nil, nil},
+		{other, other},
+		{&pq.Error{Code: "25006", Message: "cannot execute INSERT in a read-only transaction"}, ErrMaintenanceMode},
+		{fmt.Errorf("could not extend file \"base/16384/16385\": Read-only file system"), ErrMaintenanceMode},
+	}
+
+	for i, c := range cases {
+		maintenance.Leave(true)
+		if got := checkWriteErr(c.in); got != c.expect {
+			t.Errorf("case %d error mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+		if active := maintenance.Status() != nil; active != (c.expect == ErrMaintenanceMode) {
+			t.Errorf("case %d expected maintenance active to be %t", i, !active)
+		}
+	}
+}
+
+func TestMaintenanceResponse(t *testing.T) {
+	defer maintenance.Leave(true)
+
+	write := SaveCollectionAction{}.Parse("req", []byte(`{}`))
+	read := FetchUrlAct{}.Parse("req", []byte(`{}`))
+
+	if maintenanceResponse(write, "req") != nil {
+		t.Errorf("expected writes to proceed outside of maintenance")
+	}
+
+	maintenance.Enter(maintenanceReasonScheduled, time.Now().Add(time.Hour), true)
+	res := maintenanceResponse(write, "req")
+	if res == nil || res.Code != maintenanceErrCode || res.Type != write.FailureType() {
+		t.Errorf("expected write to be rejected with %s. got: %v", maintenanceErrCode, res)
+	}
+	if maintenanceResponse(read, "req") != nil {
+		t.Errorf("expected reads to proceed during maintenance")
+	}
+	for _, a := range []ClientRequestAction{&SaveAnnouncementAction{}, &DeleteAnnouncementAction{}, &DismissAnnouncementAction{}, &UserExportAction{}, &ReconcileMembershipAction{}} {
+		if maintenanceResponse(a, "req") == nil {
+			t.Errorf("expected %s to be rejected during maintenance", a.Type())
+		}
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	defer maintenance.Leave(true)
+
+	cases := []struct {
+		maintenance bool
+		status      int
+	}{
+		{false, http.StatusOK},
+		{true, http.StatusServiceUnavailable},
+	}
+
+	for i, c := range cases {
+		maintenance.Leave(true)
+		if c.maintenance {
+			maintenance.Enter(maintenanceReasonScheduled, time.Now().Add(time.Hour), true)
+		}
+		w := httptest.NewRecorder()
+		ReadinessHandler(w, httptest.NewRequest("GET", "/readycheck", nil))
+		if w.Code != c.status {
+			t.Errorf("case %d status mismatch. expected: %d, got: %d", i, c.status, w.Code)
+		}
+	}
+}
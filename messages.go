@@ -0,0 +1,182 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Error messages
+//
+// A response's Code & Details are the machine readable contract of an error,
+// it's Error is for people. Error is rendered from a message catalog in the
+// locale the client asked for saying hello, so people can read it in their
+// language. catalogs are the json files in messages/, one per locale, named
+// by the locale, mapping message ids to templates. a message id is an error
+// code, or a code & a variant "CODE.variant" for codes with more than one
+// message, picked by the "reason" detail. templates fill {name} placeholders
+// from the response's details.
+//
+// locales fall back to their language without a region, "es-mx" to "es", &
+// then to English. responses without a code keep the English Error they were
+// built with. adding a locale is adding a file: every error code needs an
+// English message, & other locales can only translate messages English has
+// with the placeholders English uses. the catalog is checked when it's loaded,
+// & the server won't start if it's invalid
+
+// defaultLocale is the locale messages fall back to, every error code has a message in it
+const defaultLocale = "en"
+
+// messageFiles are the catalogs, one per locale
+//
+//go:embed messages/*.json
+var messageFiles embed.FS
+
+// errorCodes lists every code set on error responses
+var errorCodes = []string{
+	notFoundErrCode,
+	maintenanceErrCode,
+	bandwidthCapErrCode,
+	serverBusyErrCode,
+	suppressedErrCode,
+	quarantinedErrCode,
+	linkArchiveLimitErrCode,
+	captchaRequiredErrCode,
+	trialLimitErrCode,
+	apiKeyScopeErrCode,
+	rateLimitedErrCode,
+}
+
+// messageCatalog maps locales to message ids to templates
+type messageCatalog map[string]map[string]string
+
+// messages is the embedded catalog. messagesErr is checked at startup
+var messages, messagesErr = loadMessageCatalog(messageFiles, errorCodes)
+
+// messagePlaceholder matches a {name} placeholder in a template
+var messagePlaceholder = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+
+// loadMessageCatalog reads every messages/*.json file in files, checking each
+// of codes has a message in the default locale & that other locales only
+// translate default messages, with the same placeholders
+func loadMessageCatalog(files fs.FS, codes []string) (messageCatalog, error) {
+	paths, err := fs.Glob(files, "messages/*.json")
+	if err != nil {
+		return nil, err
+	}
+	c := messageCatalog{}
+	for _, p := range paths {
+		data, err := fs.ReadFile(files, p)
+		if err != nil {
+			return nil, err
+		}
+		locale := normalizeLocale(strings.TrimSuffix(path.Base(p), ".json"))
+		templates := map[string]string{}
+		if err := json.Unmarshal(data, &templates); err != nil {
+			return nil, fmt.Errorf("%s: %s", p, err.Error())
+		}
+		c[locale] = templates
+	}
+
+	en := c[defaultLocale]
+	if en == nil {
+		return nil, fmt.Errorf("no messages for the default locale %q", defaultLocale)
+	}
+	known := map[string]bool{}
+	for _, code := range codes {
+		if en[code] == "" {
+			return nil, fmt.Errorf("error code %s has no %s message", code, defaultLocale)
+		}
+		known[code] = true
+	}
+	for locale, templates := range c {
+		for id, tmpl := range templates {
+			if code := strings.SplitN(id, ".", 2)[0]; !known[code] {
+				return nil, fmt.Errorf("%s message %s isn't for a known error code", locale, id)
+			}
+			if locale == defaultLocale {
+				continue
+			}
+			if en[id] == "" {
+				return nil, fmt.Errorf("%s message %s has no %s message", locale, id, defaultLocale)
+			}
+			allowed := map[string]bool{}
+			for _, m := range messagePlaceholder.FindAllStringSubmatch(en[id], -1) {
+				allowed[m[1]] = true
+			}
+			for _, m := range messagePlaceholder.FindAllStringSubmatch(tmpl, -1) {
+				if !allowed[m[1]] {
+					return nil, fmt.Errorf("%s message %s uses {%s}, which the %s message doesn't", locale, id, m[1], defaultLocale)
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+// normalizeLocale lowercases a locale tag & separates it's parts with dashes, eg: "es_MX" -> "es-mx"
+func normalizeLocale(locale string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(locale)), "_", "-", -1)
+}
+
+// resolve picks the locale messages for a requested locale are rendered in,
+// the locale itself, it's language without a region, or the default locale
+func (c messageCatalog) resolve(locale string) string {
+	locale = normalizeLocale(locale)
+	for locale != "" {
+		if c[locale] != nil {
+			return locale
+		}
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return defaultLocale
+}
+
+// locales lists the catalog's locales
+func (c messageCatalog) locales() []string {
+	locales := make([]string, 0, len(c))
+	for locale := range c {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// render renders the message for an error code in locale, falling back to the
+// default locale, reporting weather there's a message for the code. variants
+// fall back to the default locale's variant before the code's message
+func (c messageCatalog) render(locale, code string, details map[string]string) (string, bool) {
+	ids := []string{code}
+	if reason := details["reason"]; reason != "" {
+		ids = []string{code + "." + reason, code}
+	}
+	for _, id := range ids {
+		for _, l := range []string{c.resolve(locale), defaultLocale} {
+			if tmpl, ok := c[l][id]; ok {
+				return messagePlaceholder.ReplaceAllStringFunc(tmpl, func(p string) string {
+					return details[p[1:len(p)-1]]
+				}), true
+			}
+		}
+	}
+	return "", false
+}
+
+// localizeResponse renders the error of a response with a code in locale
+func localizeResponse(res *ClientResponse, locale string) {
+	if res == nil || res.Code == "" || res.Error == "" {
+		return
+	}
+	if msg, ok := messages.render(locale, res.Code, res.Details); ok {
+		res.Error = msg
+	}
+}
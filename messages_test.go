@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMessageCatalog(t *testing.T) {
+	if messagesErr != nil {
+		t.Fatalf("expected the embedded catalog to be valid, got: %s", messagesErr.Error())
+	}
+
+	// every ...ErrCode constant in the package is listed in errorCodes, so the
+	// catalog check at startup covers it
+	listed := map[string]bool{}
+	for _, code := range errorCodes {
+		listed[code] = true
+	}
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".", func(fi os.FileInfo) bool { return !strings.HasSuffix(fi.Name(), "_test.go") }, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, f := range pkgs["main"].Files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			spec, ok := n.(*ast.ValueSpec)
+			if !ok {
+				return true
+			}
+			for i, name := range spec.Names {
+				if !strings.HasSuffix(name.Name, "ErrCode") || i >= len(spec.Values) {
+					continue
+				}
+				lit, ok := spec.Values[i].(*ast.BasicLit)
+				if !ok {
+					continue
+				}
+				if code, _ := strconv.Unquote(lit.Value); !listed[code] {
+					t.Errorf("expected %s (%s) to be listed in errorCodes", name.Name, code)
+				}
+			}
+			return true
+		})
+	}
+
+	// english messages read the same as the errors responses are built with
+	cases := []struct {
+		code    string
+		details map[string]string
+		expect  string
+	}{
+		{notFoundErrCode, map[string]string{"entity": "url", "id": "http://www.epa.gov"}, "url not found: http://www.epa.gov"},
+		{maintenanceErrCode, nil, ErrMaintenanceMode.Error()},
+		{bandwidthCapErrCode, nil, ErrBandwidthCap.Error()},
+		{bandwidthCapErrCode, map[string]string{"reason": "throttled"}, ErrBandwidthThrottled.Error()},
+		{serverBusyErrCode, nil, ErrServerBusy.Error()},
+		{suppressedErrCode, nil, ErrContentSuppressed.Error()},
+		{quarantinedErrCode, nil, ErrLinkQuarantined.Error()},
+		{linkArchiveLimitErrCode, nil, ErrLinkArchiveLimit.Error()},
+		{captchaRequiredErrCode, nil, ErrCaptchaRequired.Error()},
+		{trialLimitErrCode, nil, ErrTrialLimit.Error()},
+		{apiKeyScopeErrCode, nil, ErrApiKeyScope.Error()},
+		{apiKeyScopeErrCode, map[string]string{"reason": "subprimer"}, ErrApiKeySubprimer.Error()},
+		{rateLimitedErrCode, map[string]string{"reason": limitHookArchives}, ErrHookRateLimit.Error()},
+		{rateLimitedErrCode, map[string]string{"reason": limitContentReports}, ErrReportRateLimited.Error()},
+		// unknown variants fall back to the code's message
+		{apiKeyScopeErrCode, map[string]string{"reason": "unknown"}, ErrApiKeyScope.Error()},
+	}
+	for i, c := range cases {
+		got, ok := messages.render(defaultLocale, c.code, c.details)
+		if !ok || got != c.expect {
+			t.Errorf("case %d expected %q, got: %q", i, c.expect, got)
+		}
+	}
+
+	for _, locale := range []string{"es", "es-MX", "ES_mx"} {
+		if got := messages.resolve(locale); got != "es" {
+			t.Errorf("expected %s to resolve to es, got: %s", locale, got)
+		}
+	}
+	for _, locale := range []string{"", "fr", "fr-CA"} {
+		if got := messages.resolve(locale); got != defaultLocale {
+			t.Errorf("expected %q to fall back to %s, got: %s", locale, defaultLocale, got)
+		}
+	}
+
+	res := notFoundResponse(&FetchUrlAct{}, "1", "url", "http://www.epa.gov")
+	localizeResponse(res, "es-MX")
+	if res.Error != "no se encontró url: http://www.epa.gov" || res.Code != notFoundErrCode || res.Details["id"] != "http://www.epa.gov" {
+		t.Errorf("expected a spanish error with the same code & details, got: %q %s %v", res.Error, res.Code, res.Details)
+	}
+	// errors without a code aren't in the catalog
+	res = &ClientResponse{Error: "something went wrong"}
+	localizeResponse(res, "es")
+	if res.Error != "something went wrong" {
+		t.Errorf("expected uncoded errors to be left alone, got: %q", res.Error)
+	}
+}
+
+func TestLoadMessageCatalogErrors(t *testing.T) {
+	codes := []string{"NOT_FOUND", "SERVER_BUSY"}
+	en := `{"NOT_FOUND": "{entity} not found: {id}", "SERVER_BUSY": "busy", "SERVER_BUSY.later": "busy, try later"}`
+	cases := []struct {
+		files map[string]string
+		valid bool
+	}{
+		{map[string]string{"en.json": en, "es.json": `{"NOT_FOUND": "no se encontró {entity}: {id}", "SERVER_BUSY.later": "ocupado"}`}, true},
+		// locales are extended by adding files
+		{map[string]string{"en.json": en, "es.json": `{}`, "pt-BR.json": `{"SERVER_BUSY": "ocupado"}`}, true},
+		{map[string]string{"es.json": `{"NOT_FOUND": "no se encontró {entity}: {id}"}`}, false},
+		{map[string]string{"en.json": `{"NOT_FOUND": "{entity} not found: {id}"}`}, false},
+		{map[string]string{"en.json": en, "es.json": `{"NOT_FOUND": "no se encontró {thing}"}`}, false},
+		{map[string]string{"en.json": en, "es.json": `{"SERVER_BUSY.soon": "ocupado"}`}, false},
+		{map[string]string{"en.json": en, "es.json": `{"TEAPOT": "soy una tetera"}`}, false},
+		{map[string]string{"en.json": en, "es.json": `not json`}, false},
+	}
+
+	for i, c := range cases {
+		fsys := fstest.MapFS{}
+		for name, data := range c.files {
+			fsys["messages/"+name] = &fstest.MapFile{Data: []byte(data)}
+		}
+		cat, err := loadMessageCatalog(fsys, codes)
+		if c.valid && err != nil {
+			t.Errorf("case %d expected a valid catalog, got: %s", i, err.Error())
+		} else if !c.valid && err == nil {
+			t.Errorf("case %d expected an invalid catalog", i)
+		}
+		if c.valid && cat.resolve("pt-br") == "pt-br" {
+			if got, _ := cat.render("pt-BR", "NOT_FOUND", map[string]string{"entity": "url", "id": "x"}); got != "url not found: x" {
+				t.Errorf("case %d expected messages missing from a locale to fall back to english, got: %q", i, got)
+			}
+		}
+	}
+}
+
+func TestHelloLocale(t *testing.T) {
+	client := &Client{svc: newTestService()}
+	res := client.HandleRequestAction(HelloAction{}.Type(), "1", false, "", json.RawMessage(`{"locale":"es-MX"}`))
+	if data, ok := res.Data.(map[string]interface{}); !ok || data["locale"] != "es" {
+		t.Errorf("expected hello to answer with the locale errors are rendered in, got: %v %s", res.Data, res.Error)
+	}
+	res = client.HandleRequestAction(FetchUrlAct{}.Type(), "2", false, "", json.RawMessage(`{"url":"http://www.missing.example.com"}`))
+	if res.Code != notFoundErrCode || res.Error != "no se encontró url: http://www.missing.example.com" {
+		t.Errorf("expected a spanish not found error, got: %s %q", res.Code, res.Error)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// sourceOwnersMetaKey is the source meta key listing the key ids allowed to
+// manage the source's metadata field definitions, eg: {"owners": ["[keyId]"]}
+const sourceOwnersMetaKey = "owners"
+
+// ErrNotSourceOwner is returned when managing field definitions for a source
+// the key doesn't own
+var ErrNotSourceOwner = fmt.Errorf("only subprimer owners can manage metadata fields")
+
+// metaFieldInputs lists the input types a field can be rendered with
+var metaFieldInputs = map[string]bool{
+	"text":     true,
+	"textarea": true,
+	"url":      true,
+	"date":     true,
+	"number":   true,
+	"select":   true,
+	"checkbox": true,
+}
+
+// MetaField describes how the metadata editor should present a meta key.
+// Field definitions are presentation only, they don't change how metadata
+// is hashed or stored
+type MetaField struct {
+	Key   string `json:"key"`
+	Label string `json:"label"`
+	// one of metaFieldInputs, defaults to "text"
+	Input string `json:"input"`
+	Help  string `json:"help,omitempty"`
+	// choices for "select" inputs
+	Options []string `json:"options,omitempty"`
+}
+
+// validateMetaFields checks a list of field definitions, filling in defaults
+func validateMetaFields(fields []*MetaField) error {
+	keys := map[string]bool{}
+	for i, f := range fields {
+		if f.Key == "" {
+			return fmt.Errorf("field %d: key is required", i)
+		}
+		if keys[f.Key] {
+			return fmt.Errorf("field %d: duplicate key: %s", i, f.Key)
+		}
+		keys[f.Key] = true
+
+		if f.Input == "" {
+			f.Input = "text"
+		}
+		if !metaFieldInputs[f.Input] {
+			return fmt.Errorf("field %d: invalid input type: %s", i, f.Input)
+		}
+		if f.Input == "select" && len(f.Options) == 0 {
+			return fmt.Errorf("field %d: select inputs require options", i)
+		}
+		if f.Label == "" {
+			f.Label = f.Key
+		}
+	}
+	return nil
+}
+
+// ReadMetaFields reads the field definitions for a source, an empty list if
+// none are defined
+func ReadMetaFields(db *sql.DB, sourceId string) ([]*MetaField, error) {
+	var data []byte
+	err := db.QueryRow("select fields from meta_fields where source_id = $1", sourceId).Scan(&data)
+	if err == sql.ErrNoRows {
+		return []*MetaField{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	fields := []*MetaField{}
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+// SaveMetaFields replaces the field definitions for a source
+func SaveMetaFields(db *sql.DB, sourceId string, fields []*MetaField) error {
+	if err := validateMetaFields(fields); err != nil {
+		return err
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Round(time.Second).In(time.UTC)
+	_, err = db.Exec(`insert into meta_fields (source_id,created,updated,fields) values ($1, $2, $2, $3)
+		on conflict (source_id) do update set updated = $2, fields = $3`, sourceId, now, data)
+	return checkWriteErr(err)
+}
+
+// DeleteMetaFields removes the field definitions for a source, returning it's
+// editor to the fallback ordering
+func DeleteMetaFields(db *sql.DB, sourceId string) error {
+	_, err := db.Exec("delete from meta_fields where source_id = $1", sourceId)
+	return checkWriteErr(err)
+}
+
+// isSourceOwner checks if a key id is listed as an owner of a source
+func isSourceOwner(s *core.Source, keyId string) bool {
+	if s == nil || keyId == "" {
+		return false
+	}
+	owners, ok := s.Meta[sourceOwnersMetaKey].([]interface{})
+	if !ok {
+		return false
+	}
+	for _, o := range owners {
+		if o == keyId {
+			return true
+		}
+	}
+	return false
+}
+
+// orderedMetaFields lists the fields to render for a set of meta keys: defined
+// fields first in their defined order, followed by any keys without a
+// definition alphabetically
+func orderedMetaFields(defs []*MetaField, keys []string) []*MetaField {
+	fields := make([]*MetaField, 0, len(defs)+len(keys))
+	defined := map[string]bool{}
+	for _, f := range defs {
+		fields = append(fields, f)
+		defined[f.Key] = true
+	}
+
+	rest := []string{}
+	for _, key := range keys {
+		if !defined[key] {
+			rest = append(rest, key)
+			defined[key] = true
+		}
+	}
+	sort.Strings(rest)
+	for _, key := range rest {
+		fields = append(fields, &MetaField{Key: key, Label: key, Input: "text"})
+	}
+	return fields
+}
+
+// metaFieldsForUrl lists the fields to render when editing metadata for a
+// url's content, covering both the url's source definitions & any keys
+// already present in the content's metadata
+func metaFieldsForUrl(db *sql.DB, u *core.Url) ([]*MetaField, error) {
+	defs := []*MetaField{}
+	s, err := matchSource(db, u.Url)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		if defs, err = ReadMetaFields(db, s.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := []string{}
+	if u.Hash != "" {
+		consensus, err := metaCache.Consensus(db, u.Hash)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		for key := range consensus {
+			keys = append(keys, key)
+		}
+	}
+	return orderedMetaFields(defs, keys), nil
+}
+
+// FetchMetaFieldsAction reads the metadata field definitions for a subprimer
+type FetchMetaFieldsAction struct {
+	ReqAction
+	SourceId string `json:"sourceId"`
+}
+
+func (FetchMetaFieldsAction) Type() string        { return "META_FIELDS_FETCH_REQUEST" }
+func (FetchMetaFieldsAction) SuccessType() string { return "META_FIELDS_FETCH_SUCCESS" }
+func (FetchMetaFieldsAction) FailureType() string { return "META_FIELDS_FETCH_FAILURE" }
+
+func (FetchMetaFieldsAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &FetchMetaFieldsAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *FetchMetaFieldsAction) Exec() (res *ClientResponse) {
+	fields, err := ReadMetaFields(appDB, a.SourceId)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "META_FIELD_ARRAY",
+		Id:        a.SourceId,
+		Data:      fields,
+	}
+}
+
+// SaveMetaFieldsAction replaces the metadata field definitions for a subprimer
+type SaveMetaFieldsAction struct {
+	ReqAction
+	KeyId    string       `json:"keyId"`
+	SourceId string       `json:"sourceId"`
+	Fields   []*MetaField `json:"fields"`
+}
+
+func (SaveMetaFieldsAction) Type() string        { return "META_FIELDS_SAVE_REQUEST" }
+func (SaveMetaFieldsAction) SuccessType() string { return "META_FIELDS_SAVE_SUCCESS" }
+func (SaveMetaFieldsAction) FailureType() string { return "META_FIELDS_SAVE_FAILURE" }
+
+func (SaveMetaFieldsAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &SaveMetaFieldsAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *SaveMetaFieldsAction) Exec() (res *ClientResponse) {
+	err := checkSourceOwner(a.SourceId, a.KeyId)
+	if err == nil {
+		err = SaveMetaFields(appDB, a.SourceId, a.Fields)
+	}
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "META_FIELD_ARRAY",
+		Id:        a.SourceId,
+		Data:      a.Fields,
+	}
+}
+
+// DeleteMetaFieldsAction removes the metadata field definitions for a subprimer
+type DeleteMetaFieldsAction struct {
+	ReqAction
+	KeyId    string `json:"keyId"`
+	SourceId string `json:"sourceId"`
+}
+
+func (DeleteMetaFieldsAction) Type() string        { return "META_FIELDS_DELETE_REQUEST" }
+func (DeleteMetaFieldsAction) SuccessType() string { return "META_FIELDS_DELETE_SUCCESS" }
+func (DeleteMetaFieldsAction) FailureType() string { return "META_FIELDS_DELETE_FAILURE" }
+
+func (DeleteMetaFieldsAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &DeleteMetaFieldsAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *DeleteMetaFieldsAction) Exec() (res *ClientResponse) {
+	err := checkSourceOwner(a.SourceId, a.KeyId)
+	if err == nil {
+		err = DeleteMetaFields(appDB, a.SourceId)
+	}
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Id:        a.SourceId,
+	}
+}
+
+// checkSourceOwner reads a source, returning ErrNotSourceOwner unless keyId owns it
+func checkSourceOwner(sourceId, keyId string) error {
+	s := &core.Source{Id: sourceId}
+	if err := s.Read(store); err != nil {
+		return err
+	}
+	if !isSourceOwner(s, keyId) {
+		return ErrNotSourceOwner
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/datatogether/core"
+)
+
+func TestValidateMetaFields(t *testing.T) {
+	cases := []struct {
+		fields []*MetaField
+		err    string
+	}{
+		{[]*MetaField{}, ""},
+		{[]*MetaField{{Key: "title"}}, ""},
+		{[]*MetaField{{Key: ""}}, "field 0: key is required"},
+		{[]*MetaField{{Key: "title"}, {Key: "title"}}, "field 1: duplicate key: title"},
+		{[]*MetaField{{Key: "title", Input: "slider"}}, "field 0: invalid input type: slider"},
+		{[]*MetaField{{Key: "license", Input: "select"}}, "field 0: select inputs require options"},
+		{[]*MetaField{{Key: "license", Input: "select", Options: []string{"CC0", "CC-BY"}}}, ""},
+	}
+
+	for i, c := range cases {
+		err := validateMetaFields(c.fields)
+		if !(err == nil && c.err == "" || err != nil && err.Error() == c.err) {
+			t.Errorf("case %d error mismatch. expected: '%s', got: '%v'", i, c.err, err)
+		}
+	}
+
+	f := &MetaField{Key: "title"}
+	validateMetaFields([]*MetaField{f})
+	if f.Input != "text" || f.Label != "title" {
+		t.Errorf("expected input & label defaults, got: %s, %s", f.Input, f.Label)
+	}
+}
+
+func TestOrderedMetaFields(t *testing.T) {
+	defs := []*MetaField{{Key: "title"}, {Key: "description"}}
+	cases := []struct {
+		defs   []*MetaField
+		keys   []string
+		expect []string
+	}{
+		{nil, nil, []string{}},
+		{nil, []string{"title", "agency", "description"}, []string{"agency", "description", "title"}},
+		{defs, nil, []string{"title", "description"}},
+		{defs, []string{"zebra", "description", "agency"}, []string{"title", "description", "agency", "zebra"}},
+	}
+
+	for i, c := range cases {
+		got := orderedMetaFields(c.defs, c.keys)
+		if len(got) != len(c.expect) {
+			t.Errorf("case %d length mismatch. expected: %d, got: %d", i, len(c.expect), len(got))
+			continue
+		}
+		for j, f := range got {
+			if f.Key != c.expect[j] {
+				t.Errorf("case %d field %d mismatch. expected: %s, got: %s", i, j, c.expect[j], f.Key)
+			}
+		}
+	}
+}
+
+func TestIsSourceOwner(t *testing.T) {
+	s := &core.Source{Meta: map[string]interface{}{sourceOwnersMetaKey: []interface{}{"a", "b"}}}
+	cases := []struct {
+		s      *core.Source
+		keyId  string
+		expect bool
+	}{
+		{nil, "a", false},
+		{&core.Source{}, "a", false},
+		{s, "", false},
+		{s, "c", false},
+		{s, "b", true},
+	}
+
+	for i, c := range cases {
+		if got := isSourceOwner(c.s, c.keyId); got != c.expect {
+			t.Errorf("case %d: expected %t, got %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestMetaFields(t *testing.T) {
+	defer resetTestData(appDB, "meta_fields")
+
+	sourceId := "326fcfa0-d3e6-4b2d-8f95-e77220e16109"
+	fields, err := ReadMetaFields(appDB, sourceId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(fields) != 0 {
+		t.Errorf("expected no fields to be defined")
+	}
+
+	if err := SaveMetaFields(appDB, sourceId, []*MetaField{{Key: "title"}, {Key: "agency"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if fields, err = ReadMetaFields(appDB, sourceId); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(fields) != 2 || fields[0].Key != "title" || fields[1].Key != "agency" {
+		t.Errorf("expected fields to be read back in order")
+	}
+
+	if err := DeleteMetaFields(appDB, sourceId); err != nil {
+		t.Fatal(err.Error())
+	}
+	if fields, err = ReadMetaFields(appDB, sourceId); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(fields) != 0 {
+		t.Errorf("expected fields to be deleted")
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// Metadata key renames
+//
+// Curators sometimes standardize field names after the fact, "agency_name"
+// should have been "publisher", across hundreds of subjects. a rename writes
+// a new metadata block for each subject under a subprimer the curator has
+// described, moving the value from one key to another. history isn't touched,
+// blocks are written by the curator's key through the same NextMetadata path
+// as any other edit, so each one chains from the block it renames.
+//
+// subjects that already have the new key with the same value are merged, the
+// old key is dropped. subjects where the new key has a different value are
+// conflicts, they're left alone & reported for the curator to settle by hand.
+//
+// renames are requested twice. the first request is a dry run that returns
+// the plan: every subject that'll be renamed, merged or conflict, & a hash of
+// it. only a request that echoes the hash back starts the rename, & only if
+// planning again gives the same hash, so nothing is written that the curator
+// hasn't seen. renames run as a job in batches, reporting progress & resuming
+// from it's cursor if interrupted. each subject's block is written on it's
+// own, subjects are checked again as they're written so edits made since the
+// plan are never overwritten, & renaming a subject twice changes nothing
+
+const (
+	// number of subjects renamed per batch
+	metaKeyRenameBatchSize = 100
+	// pause between batches so renames don't monopolize the db
+	metaKeyRenameBatchDelay = 500 * time.Millisecond
+
+	// what a rename does to a subject
+	metaKeyUnchanged = ""
+	metaKeyRenamed   = "renamed"
+	metaKeyMerged    = "merged"
+	metaKeyConflict  = "conflict"
+)
+
+var (
+	// ErrNotRenameOwner is returned when renaming keys in another key's subprimer
+	ErrNotRenameOwner = fmt.Errorf("only subprimer owners can rename metadata keys")
+	// ErrMetaKeyRenameRunning is returned when renaming keys in a subprimer that's already being renamed
+	ErrMetaKeyRenameRunning = fmt.Errorf("a metadata key rename is already running for this subprimer")
+	// ErrMetaKeyRenamePlanChanged is returned when the confirmed plan no longer matches the subprimer's metadata
+	ErrMetaKeyRenamePlanChanged = fmt.Errorf("metadata has changed since the rename was planned, review the new plan & confirm it")
+)
+
+// metaKeyRenameJobs runs rename jobs, one at a time per subprimer
+var metaKeyRenameJobs = &jobKind{
+	name:       "metadata key rename",
+	cols:       metaKeyRenameCols,
+	errRunning: ErrMetaKeyRenameRunning,
+	delay:      metaKeyRenameBatchDelay,
+	reportType: "METADATA_KEY_RENAME",
+	schema:     "METADATA_KEY_RENAME_JOB",
+}
+
+// MetaKeyChange is what renaming a key does to a single subject
+type MetaKeyChange struct {
+	Subject string `json:"subject"`
+	// value of the key being renamed
+	Value interface{} `json:"value"`
+	// value the new key already has, set for merges & conflicts
+	Existing interface{} `json:"existing,omitempty"`
+}
+
+// MetaKeyRenamePlan is the dry run of a rename, listing what it'll do to
+// every subject that has the key
+type MetaKeyRenamePlan struct {
+	SourceId  string           `json:"sourceId"`
+	KeyId     string           `json:"keyId"`
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Renames   []*MetaKeyChange `json:"renames"`
+	Merges    []*MetaKeyChange `json:"merges"`
+	Conflicts []*MetaKeyChange `json:"conflicts"`
+	// hash of the plan, echoed back to confirm it
+	Hash string `json:"hash"`
+}
+
+// hash calculates the plan's hash, the sha256 of it's json without the hash
+func (p *MetaKeyRenamePlan) hash() (string, error) {
+	cp := *p
+	cp.Hash = ""
+	data, err := json.Marshal(&cp)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// renameMetaKey works out what renaming from to to does to a block's meta,
+// returning the meta of the block to write for renames & merges. meta isn't
+// modified
+func renameMetaKey(meta map[string]interface{}, from, to string) (next map[string]interface{}, change string) {
+	value, ok := meta[from]
+	if !ok {
+		return nil, metaKeyUnchanged
+	}
+	change = metaKeyRenamed
+	if existing, ok := meta[to]; ok {
+		if !reflect.DeepEqual(existing, value) {
+			return nil, metaKeyConflict
+		}
+		change = metaKeyMerged
+	}
+
+	next = make(map[string]interface{}, len(meta))
+	for key, v := range meta {
+		if key != from {
+			next[key] = v
+		}
+	}
+	next[to] = value
+	return next, change
+}
+
+// checkMetaKeyRename validates the keys of a rename
+func checkMetaKeyRename(from, to string) error {
+	if from == "" || to == "" {
+		return fmt.Errorf("from & to keys are required")
+	}
+	if from == to {
+		return fmt.Errorf("from & to keys are the same")
+	}
+	if isReservedMetaKey(from) || isReservedMetaKey(to) {
+		return ErrReservedMetaKey
+	}
+	return nil
+}
+
+// metaKeyRenameSubjects reads the next page of subjects under a subprimer
+// that keyId has described, in order, after cursor
+func metaKeyRenameSubjects(db sqlQueryable, sourceId, keyId, after string, limit int) ([]string, error) {
+	rows, err := db.Query(`select distinct u.hash from source_memberships sm
+		join urls u on u.url = sm.url
+		join metadata m on m.subject = u.hash and m.key_id = $2 and not coalesce(m.deleted, false)
+		where sm.source_id = $1 and u.hash > $3
+		order by u.hash limit $4`, sourceId, keyId, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subjects := []string{}
+	for rows.Next() {
+		var subject string
+		if err := rows.Scan(&subject); err != nil {
+			return nil, err
+		}
+		subjects = append(subjects, subject)
+	}
+	return subjects, rows.Err()
+}
+
+// PlanMetaKeyRename works out what renaming from to to in keyId's metadata
+// does to every subject under a subprimer, without writing anything
+func PlanMetaKeyRename(db *sql.DB, sourceId, keyId, from, to string) (*MetaKeyRenamePlan, error) {
+	if err := checkMetaKeyRename(from, to); err != nil {
+		return nil, err
+	}
+	p := &MetaKeyRenamePlan{
+		SourceId:  sourceId,
+		KeyId:     keyId,
+		From:      from,
+		To:        to,
+		Renames:   []*MetaKeyChange{},
+		Merges:    []*MetaKeyChange{},
+		Conflicts: []*MetaKeyChange{},
+	}
+
+	for cursor := ""; ; {
+		subjects, err := metaKeyRenameSubjects(db, sourceId, keyId, cursor, metaKeyRenameBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, subject := range subjects {
+			m, err := core.LatestMetadata(db, keyId, subject)
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			c := &MetaKeyChange{Subject: subject, Value: m.Meta[from], Existing: m.Meta[to]}
+			switch _, change := renameMetaKey(m.Meta, from, to); change {
+			case metaKeyRenamed:
+				c.Existing = nil
+				p.Renames = append(p.Renames, c)
+			case metaKeyMerged:
+				p.Merges = append(p.Merges, c)
+			case metaKeyConflict:
+				p.Conflicts = append(p.Conflicts, c)
+			}
+		}
+		if len(subjects) < metaKeyRenameBatchSize {
+			break
+		}
+		cursor = subjects[len(subjects)-1]
+	}
+
+	hash, err := p.hash()
+	if err != nil {
+		return nil, err
+	}
+	p.Hash = hash
+	return p, nil
+}
+
+// metaKeyChanges is a list of changes stored as a json column
+type metaKeyChanges []*MetaKeyChange
+
+// Scan implements sql.Scanner
+func (c *metaKeyChanges) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	case nil:
+		*c = metaKeyChanges{}
+		return nil
+	}
+	return fmt.Errorf("can't scan %T into metadata key changes", src)
+}
+
+// Value implements driver.Valuer
+func (c metaKeyChanges) Value() (driver.Value, error) {
+	if c == nil {
+		c = metaKeyChanges{}
+	}
+	data, err := json.Marshal(c)
+	return string(data), err
+}
+
+// MetaKeyRenameJob renames a metadata key across a subprimer's subjects.
+// jobs record their progress after each batch, so an interrupted job can be resumed
+type MetaKeyRenameJob struct {
+	Id       string    `json:"id"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	SourceId string    `json:"sourceId"`
+	// key who's blocks are renamed & written
+	KeyId string `json:"keyId"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	// hash of the confirmed plan
+	Plan   string `json:"plan"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// last subject checked, subjects are checked in order
+	Cursor string `json:"cursor"`
+	// counts of subjects checked, renamed & merged
+	Checked int `json:"checked"`
+	Renamed int `json:"renamed"`
+	Merged  int `json:"merged"`
+	// subjects skipped because the new key has a different value
+	Conflicts metaKeyChanges `json:"conflicts"`
+
+	// client to send progress updates to, if any
+	client *Client
+}
+
+// StartMetaKeyRename creates & runs a rename job for a confirmed plan in the
+// background. progress is reported to c if it's not nil
+func StartMetaKeyRename(db *sql.DB, p *MetaKeyRenamePlan, c *Client) (*MetaKeyRenameJob, error) {
+	j, err := createMetaKeyRenameJob(db, p, c)
+	if err != nil {
+		return nil, err
+	}
+	// return a copy, the job is modified as it runs
+	cp := *j
+	go metaKeyRenameJobs.run(db, j)
+	return &cp, nil
+}
+
+// createMetaKeyRenameJob records a new running job, returning
+// ErrMetaKeyRenameRunning if another is running for the subprimer
+func createMetaKeyRenameJob(db *sql.DB, p *MetaKeyRenamePlan, c *Client) (*MetaKeyRenameJob, error) {
+	j := &MetaKeyRenameJob{
+		SourceId:  p.SourceId,
+		KeyId:     p.KeyId,
+		From:      p.From,
+		To:        p.To,
+		Plan:      p.Hash,
+		Conflicts: metaKeyChanges{},
+		client:    c,
+	}
+
+	// a partial unique index on source_id allows one running job per subprimer
+	if err := metaKeyRenameJobs.create(db, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// metaKeyRenameCols are the columns of meta_key_renames
+var metaKeyRenameCols = &columnSet{
+	table:   "meta_key_renames",
+	columns: []string{"id", "created", "updated", "source_id", "key_id", "from_key", "to_key", "plan", "status", "error", "cursor", "checked", "renamed", "merged", "conflicts"},
+}
+
+// scanTargets maps metaKeyRenameCols to the job's fields
+func (j *MetaKeyRenameJob) scanTargets() scanTargets {
+	return scanTargets{
+		"id":        &j.Id,
+		"created":   &j.Created,
+		"updated":   &j.Updated,
+		"source_id": &j.SourceId,
+		"key_id":    &j.KeyId,
+		"from_key":  &j.From,
+		"to_key":    &j.To,
+		"plan":      &j.Plan,
+		"status":    &j.Status,
+		"error":     &j.Error,
+		"cursor":    &j.Cursor,
+		"checked":   &j.Checked,
+		"renamed":   &j.Renamed,
+		"merged":    &j.Merged,
+		"conflicts": &j.Conflicts,
+	}
+}
+
+// resumeMetaKeyRenames restarts a rename job the instance running it stopped
+// before it finished
+func resumeMetaKeyRenames(db *sql.DB) {
+	metaKeyRenameJobs.resume(db, &MetaKeyRenameJob{})
+}
+
+// batch renames the next batch of subjects, reporting weather all subjects are done
+func (j *MetaKeyRenameJob) batch(db *sql.DB) (done bool, err error) {
+	subjects, err := metaKeyRenameSubjects(db, j.SourceId, j.KeyId, j.Cursor, metaKeyRenameBatchSize)
+	if err != nil {
+		return false, err
+	}
+	for _, subject := range subjects {
+		if err := j.renameSubject(db, subject); err != nil {
+			return false, err
+		}
+		j.Cursor = subject
+	}
+	return len(subjects) < metaKeyRenameBatchSize, nil
+}
+
+// renameSubject writes a block renaming the key in a subject's latest block.
+// blocks are written one at a time, a batch interrupted part way through is
+// checked again when it's resumed, which is why renamed subjects have to be
+// left unchanged by a second rename
+func (j *MetaKeyRenameJob) renameSubject(db *sql.DB, subject string) error {
+	m, err := core.NextMetadata(db, j.KeyId, subject)
+	if err != nil {
+		return err
+	}
+	j.Checked++
+
+	next, change := renameMetaKey(m.Meta, j.From, j.To)
+	switch change {
+	case metaKeyUnchanged:
+		return nil
+	case metaKeyConflict:
+		// conflicts are found in order, a resumed batch can find them again
+		if n := len(j.Conflicts); n == 0 || j.Conflicts[n-1].Subject < subject {
+			j.Conflicts = append(j.Conflicts, &MetaKeyChange{Subject: subject, Value: m.Meta[j.From], Existing: m.Meta[j.To]})
+		}
+		return nil
+	}
+
+	m.Meta = next
+	if err := WriteMetadata(m); err != nil {
+		return err
+	}
+	if change == metaKeyMerged {
+		j.Merged++
+	} else {
+		j.Renamed++
+	}
+	return nil
+}
+
+// summary describes the job's counts for logs
+func (j *MetaKeyRenameJob) summary() string {
+	return fmt.Sprintf("checked: %d, renamed: %d, merged: %d, conflicts: %d", j.Checked, j.Renamed, j.Merged, len(j.Conflicts))
+}
+
+// reportTo is the client that started the job, if any
+func (j *MetaKeyRenameJob) reportTo() *Client {
+	return j.client
+}
+
+// RenameMetaKeyAction renames a metadata key in the requester's metadata
+// across a subprimer's subjects. without a plan hash it's a dry run returning
+// the plan, with the plan's hash it starts the rename
+type RenameMetaKeyAction struct {
+	ReqAction
+	clientAction
+	SourceId string `json:"sourceId"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	// hash of the plan returned by a dry run, empty for a dry run
+	Plan string `json:"plan"`
+}
+
+func (RenameMetaKeyAction) Type() string        { return "METADATA_KEY_RENAME_REQUEST" }
+func (RenameMetaKeyAction) SuccessType() string { return "METADATA_KEY_RENAME_SUCCESS" }
+func (RenameMetaKeyAction) FailureType() string { return "METADATA_KEY_RENAME_FAILURE" }
+
+func (RenameMetaKeyAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &RenameMetaKeyAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *RenameMetaKeyAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+	s := &core.Source{Id: a.SourceId}
+	if err := s.Read(store); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "source", a.SourceId)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	keyId := a.client.requester()
+	if !isSourceOwner(s, keyId) {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrNotRenameOwner.Error()}
+	}
+
+	plan, err := PlanMetaKeyRename(appDB, a.SourceId, keyId, a.From, a.To)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if a.Plan == "" {
+		return &ClientResponse{
+			Type:      a.SuccessType(),
+			RequestId: a.RequestId,
+			Schema:    "METADATA_KEY_RENAME_PLAN",
+			Id:        a.SourceId,
+			Data:      plan,
+		}
+	}
+	if a.Plan != plan.Hash {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrMetaKeyRenamePlanChanged.Error(), Schema: "METADATA_KEY_RENAME_PLAN", Data: plan}
+	}
+
+	j, err := StartMetaKeyRename(appDB, plan, a.client)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "METADATA_KEY_RENAME_JOB",
+		Id:        j.Id,
+		Data:      j,
+	}
+}
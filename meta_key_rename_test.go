@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/datatogether/core"
+)
+
+func TestRenameMetaKey(t *testing.T) {
+	cases := []struct {
+		meta   map[string]interface{}
+		change string
+		expect map[string]interface{}
+	}{
+		{map[string]interface{}{"title": "a"}, metaKeyUnchanged, nil},
+		{map[string]interface{}{"title": "a", "agency_name": "EPA"}, metaKeyRenamed, map[string]interface{}{"title": "a", "publisher": "EPA"}},
+		{map[string]interface{}{"agency_name": "EPA", "publisher": "EPA"}, metaKeyMerged, map[string]interface{}{"publisher": "EPA"}},
+		{map[string]interface{}{"agency_name": []interface{}{"EPA"}, "publisher": []interface{}{"EPA"}}, metaKeyMerged, map[string]interface{}{"publisher": []interface{}{"EPA"}}},
+		{map[string]interface{}{"agency_name": "EPA", "publisher": "NOAA"}, metaKeyConflict, nil},
+		// renaming a renamed block changes nothing, so resumed jobs don't write twice
+		{map[string]interface{}{"publisher": "EPA"}, metaKeyUnchanged, nil},
+	}
+
+	for i, c := range cases {
+		before, _ := json.Marshal(c.meta)
+		next, change := renameMetaKey(c.meta, "agency_name", "publisher")
+		if change != c.change {
+			t.Errorf("case %d expected change %q, got: %q", i, c.change, change)
+		}
+		got, _ := json.Marshal(next)
+		expect, _ := json.Marshal(c.expect)
+		if string(got) != string(expect) {
+			t.Errorf("case %d expected meta %s, got: %s", i, expect, got)
+		}
+		if after, _ := json.Marshal(c.meta); string(after) != string(before) {
+			t.Errorf("case %d expected meta not to be modified, got: %s", i, after)
+		}
+	}
+
+	for i, keys := range [][2]string{{"", "publisher"}, {"publisher", "publisher"}, {"agency_name", reservedMetaPrefix + "publisher"}} {
+		if err := checkMetaKeyRename(keys[0], keys[1]); err == nil {
+			t.Errorf("case %d expected renaming %q to %q to be refused", i, keys[0], keys[1])
+		}
+	}
+}
+
+func TestMetaKeyRename(t *testing.T) {
+	defer resetTestData(appDB, "urls", "source_memberships", "metadata", "meta_key_renames")
+	const (
+		source   = "8e7d6c5b-4a39-4281-9a0b-1c2d3e4f5a6b"
+		renamed  = "1220aa00000000000000000000000000000000000000000000000000000000000001"
+		merged   = "1220aa00000000000000000000000000000000000000000000000000000000000002"
+		conflict = "1220aa00000000000000000000000000000000000000000000000000000000000003"
+	)
+	if _, err := appDB.Exec(`insert into sources (id,created,updated,title,url,crawl,meta) values
+		($1, now(), now(), 'renames', 'renames.example.com', true, '{"owners":["curator"]}')`, source); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer appDB.Exec("delete from sources where id = $1", source)
+	if _, err := appDB.Exec(`insert into urls (url,created,updated,last_get,hash) values
+		('http://renames.example.com/1', now(), now(), now(), $1),
+		('http://renames.example.com/2', now(), now(), now(), $2),
+		('http://renames.example.com/3', now(), now(), now(), $3)`, renamed, merged, conflict); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into source_memberships (url,source_id) values
+		('http://renames.example.com/1', $1),
+		('http://renames.example.com/2', $1),
+		('http://renames.example.com/3', $1)`, source); err != nil {
+		t.Fatal(err.Error())
+	}
+	for subject, meta := range map[string]map[string]interface{}{
+		renamed:  {"title": "one", "agency_name": "EPA"},
+		merged:   {"agency_name": "EPA", "publisher": "EPA"},
+		conflict: {"agency_name": "EPA", "publisher": "NOAA"},
+	} {
+		m, err := core.NextMetadata(appDB, "curator", subject)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		m.Meta = meta
+		if err := WriteMetadata(m); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	p, err := PlanMetaKeyRename(appDB, source, "curator", "agency_name", "publisher")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(p.Renames) != 1 || p.Renames[0].Subject != renamed || len(p.Merges) != 1 || p.Merges[0].Subject != merged || len(p.Conflicts) != 1 || p.Conflicts[0].Subject != conflict {
+		data, _ := json.Marshal(p)
+		t.Errorf("expected a rename, merge & conflict, got: %s", data)
+	}
+
+	// dry runs write nothing, & the plan has to be echoed back to start a rename
+	client := &Client{svc: newTestService()}
+	client.setKeyId("curator")
+	act := RenameMetaKeyAction{}.Parse("1", json.RawMessage(`{"sourceId":"`+source+`","from":"agency_name","to":"publisher"}`))
+	act.(ClientBoundAction).SetClient(client)
+	if res := act.Exec(); res.Schema != "METADATA_KEY_RENAME_PLAN" || res.Data.(*MetaKeyRenamePlan).Hash != p.Hash {
+		t.Errorf("expected a dry run to return the plan, got: %v %s", res.Data, res.Error)
+	}
+	act = RenameMetaKeyAction{}.Parse("2", json.RawMessage(`{"sourceId":"`+source+`","from":"agency_name","to":"publisher","plan":"stale"}`))
+	act.(ClientBoundAction).SetClient(client)
+	if res := act.Exec(); res.Error != ErrMetaKeyRenamePlanChanged.Error() {
+		t.Errorf("expected a plan that doesn't match to be refused, got: %q", res.Error)
+	}
+	other := &Client{svc: newTestService()}
+	other.setKeyId("someone else")
+	act = RenameMetaKeyAction{}.Parse("3", json.RawMessage(`{"sourceId":"`+source+`","from":"agency_name","to":"publisher"}`))
+	act.(ClientBoundAction).SetClient(other)
+	if res := act.Exec(); res.Error != ErrNotRenameOwner.Error() {
+		t.Errorf("expected only owners to rename keys, got: %q", res.Error)
+	}
+
+	j, err := createMetaKeyRenameJob(appDB, p, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := createMetaKeyRenameJob(appDB, p, nil); err != ErrMetaKeyRenameRunning {
+		t.Errorf("expected one rename at a time per subprimer, got: %v", err)
+	}
+	metaKeyRenameJobs.run(appDB, j)
+	if j.Status != jobComplete || j.Checked != 3 || j.Renamed != 1 || j.Merged != 1 || len(j.Conflicts) != 1 {
+		t.Errorf("expected a complete rename, got: %#v", j)
+	}
+
+	expect := map[string]string{
+		renamed:  `{"publisher":"EPA","title":"one"}`,
+		merged:   `{"publisher":"EPA"}`,
+		conflict: `{"agency_name":"EPA","publisher":"NOAA"}`,
+	}
+	for subject, meta := range expect {
+		m, err := core.LatestMetadata(appDB, "curator", subject)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if got, _ := json.Marshal(m.Meta); string(got) != meta {
+			t.Errorf("expected %s to have meta %s, got: %s", subject, meta, got)
+		}
+	}
+	// history is kept, renames are new blocks chained to the old ones
+	if blocks, err := core.MetadataBySubject(appDB, renamed); err != nil || len(blocks) != 2 {
+		t.Errorf("expected the renamed subject to have 2 blocks, got: %d %v", len(blocks), err)
+	}
+
+	// running the job again from the start, as if it were interrupted, writes nothing more
+	read := &MetaKeyRenameJob{}
+	if err := metaKeyRenameCols.scan(appDB.QueryRow("select "+metaKeyRenameCols.String()+" from meta_key_renames where id = $1", j.Id), read.scanTargets()); err != nil {
+		t.Fatal(err.Error())
+	}
+	read.Cursor, read.Status = "", jobRunning
+	metaKeyRenameJobs.run(appDB, read)
+	if read.Renamed != 1 || read.Merged != 1 || len(read.Conflicts) != 1 {
+		t.Errorf("expected a resumed rename not to rename subjects again, got: %#v", read)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/datatogether/core"
+)
+
+const (
+	// reservedMetaPrefix marks meta keys written by the system rather than
+	// asserted by people, eg: "_pb:provenance"
+	reservedMetaPrefix = "_pb:"
+	// metaAttributionKey records who a system write of human-visible keys is
+	// attributed to
+	metaAttributionKey = reservedMetaPrefix + "attribution"
+)
+
+var (
+	// ErrReservedMetaKey is returned when a person's metadata sets a reserved key
+	ErrReservedMetaKey = fmt.Errorf("meta keys starting with %s are reserved for the system", reservedMetaPrefix)
+	// ErrUnattributedSystemMeta is returned when a system write sets non-reserved keys without attribution
+	ErrUnattributedSystemMeta = fmt.Errorf("system metadata can only set keys outside %s with attribution", reservedMetaPrefix)
+)
+
+// isReservedMetaKey checks if a meta key is in the system namespace
+func isReservedMetaKey(key string) bool {
+	return strings.HasPrefix(key, reservedMetaPrefix)
+}
+
+// checkHumanMeta returns ErrReservedMetaKey if meta sets any reserved keys
+func checkHumanMeta(meta map[string]interface{}) error {
+	for key := range meta {
+		if isReservedMetaKey(key) {
+			return ErrReservedMetaKey
+		}
+	}
+	return nil
+}
+
+// checkSystemMeta returns ErrUnattributedSystemMeta if meta sets keys outside
+// the reserved namespace without attribution
+func checkSystemMeta(meta map[string]interface{}, attribution string) error {
+	if attribution != "" {
+		return nil
+	}
+	for key := range meta {
+		if !isReservedMetaKey(key) {
+			return ErrUnattributedSystemMeta
+		}
+	}
+	return nil
+}
+
+// withoutReservedKeys returns a copy of a block with reserved keys removed,
+// leaving the original untouched
+func withoutReservedKeys(m *core.Metadata) *core.Metadata {
+	cp := *m
+	cp.Meta = map[string]interface{}{}
+	for key, val := range m.Meta {
+		if !isReservedMetaKey(key) {
+			cp.Meta[key] = val
+		}
+	}
+	return &cp
+}
+
+// MetaKeyViolation is an existing metadata block that breaks the reserved key rules
+type MetaKeyViolation struct {
+	Hash    string   `json:"hash"`
+	KeyId   string   `json:"keyId"`
+	Subject string   `json:"subject"`
+	Keys    []string `json:"keys"`
+}
+
+// auditReservedMetaKeys finds existing blocks that set reserved keys without
+// attribution. Blocks written before keys were reserved were all written by
+// people, so any reserved key in one is a violation. Blocks are only
+// reported, never changed: they're hashed & can't be rewritten
+func auditReservedMetaKeys(db *sql.DB) ([]*MetaKeyViolation, error) {
+	rows, err := db.Query("select hash, key_id, subject, meta from metadata where deleted = false order by time_stamp")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	violations := []*MetaKeyViolation{}
+	for rows.Next() {
+		var (
+			v    = &MetaKeyViolation{}
+			data []byte
+			meta = map[string]interface{}{}
+		)
+		if err := rows.Scan(&v.Hash, &v.KeyId, &v.Subject, &data); err != nil {
+			return nil, err
+		}
+		if data != nil {
+			if err := json.Unmarshal(data, &meta); err != nil {
+				return nil, err
+			}
+		}
+		if meta[metaAttributionKey] != nil {
+			continue
+		}
+
+		for key := range meta {
+			if isReservedMetaKey(key) {
+				v.Keys = append(v.Keys, key)
+			}
+		}
+		if len(v.Keys) > 0 {
+			sort.Strings(v.Keys)
+			violations = append(violations, v)
+		}
+	}
+	return violations, rows.Err()
+}
+
+// ReservedMetaKeysAuditHandler reports existing metadata blocks that break
+// the reserved meta key rules
+func ReservedMetaKeysAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminConfigured(w) {
+		return
+	}
+	violations, err := auditReservedMetaKeys(appDB)
+	if err != nil {
+		log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"violations": violations})
+}
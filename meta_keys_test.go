@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/datatogether/core"
+)
+
+func TestCheckHumanMeta(t *testing.T) {
+	cases := []struct {
+		meta map[string]interface{}
+		err  error
+	}{
+		{nil, nil},
+		{map[string]interface{}{"title": "EPA"}, nil},
+		{map[string]interface{}{"pb:title": "EPA"}, nil},
+		{map[string]interface{}{"title": "EPA", "_pb:provenance": "import"}, ErrReservedMetaKey},
+	}
+
+	for i, c := range cases {
+		if err := checkHumanMeta(c.meta); err != c.err {
+			t.Errorf("case %d error mismatch. expected: %v, got: %v", i, c.err, err)
+		}
+	}
+}
+
+func TestCheckSystemMeta(t *testing.T) {
+	cases := []struct {
+		meta        map[string]interface{}
+		attribution string
+		err         error
+	}{
+		{map[string]interface{}{"_pb:provenance": "import"}, "", nil},
+		{map[string]interface{}{"title": "EPA"}, "", ErrUnattributedSystemMeta},
+		{map[string]interface{}{"title": "EPA", "_pb:provenance": "import"}, "", ErrUnattributedSystemMeta},
+		{map[string]interface{}{"title": "EPA"}, "keyId", nil},
+	}
+
+	for i, c := range cases {
+		if err := checkSystemMeta(c.meta, c.attribution); err != c.err {
+			t.Errorf("case %d error mismatch. expected: %v, got: %v", i, c.err, err)
+		}
+	}
+}
+
+func TestWithoutReservedKeys(t *testing.T) {
+	m := &core.Metadata{Subject: "a", Meta: map[string]interface{}{"title": "EPA", "_pb:provenance": "import"}}
+	got := withoutReservedKeys(m)
+	if len(got.Meta) != 1 || got.Meta["title"] != "EPA" {
+		t.Errorf("expected only human keys, got: %v", got.Meta)
+	}
+	if got.Subject != "a" {
+		t.Errorf("expected other fields to be copied")
+	}
+	if len(m.Meta) != 2 {
+		t.Errorf("expected original block to be untouched")
+	}
+}
+
+func TestAuditReservedMetaKeys(t *testing.T) {
+	defer resetTestData(appDB, "metadata")
+
+	// written directly, as WriteMetadata won't allow it
+	if _, err := appDB.Exec(`insert into metadata (hash,time_stamp,key_id,subject,prev,meta,deleted) values
+		('a', '2017-01-01 00:00:01', 'key', 'subject', '', '{"title":"EPA","_pb:template":"x"}', false),
+		('b', '2017-01-01 00:00:01', 'key', 'subject', '', '{"title":"EPA","_pb:attribution":"key"}', false)`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	violations, err := auditReservedMetaKeys(appDB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(violations) != 1 || violations[0].Hash != "a" || violations[0].Keys[0] != "_pb:template" {
+		t.Errorf("expected unattributed block to be reported, got: %v", violations)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/datatogether/core"
+)
+
+// Verification badges
+//
+// Metadata read responses carry a badge for each block saying weather it
+// matches it's hash, so clients don't have to check blocks themselves. blocks
+// are verified lazily the first time they're read & the result is memoized by
+// hash for the life of the process. verifying is cheap, but lists can be long,
+// so each response verifies at most metadataBadgeBudget blocks. the rest are
+// sent as unverified & queued for a background verifier, later reads of them
+// get their badge from the memo
+
+const (
+	// block matches it's hash
+	badgeVerified = "verified"
+	// block hasn't been verified yet, it's queued to be
+	badgeUnverified = "unverified"
+	// block's hash isn't a sha2-256 multihash, so it predates hashes that can be checked
+	badgeLegacy = "legacy"
+	// block doesn't match it's hash
+	badgeFailed = "failed"
+	// block was anonymized by an erasure, so it no longer has the key id it was hashed with
+	badgeErased = "erased"
+
+	// most blocks verified while answering a single read
+	metadataBadgeBudget = 25
+	// most blocks waiting for the background verifier. blocks past this are
+	// verified when they're next read
+	metadataBadgeQueueSize = 4096
+)
+
+// metadataDetail is the wire format for metadata blocks in read responses: a
+// block with it's verification badge
+type metadataDetail struct {
+	*core.Metadata
+	Verification string `json:"verification"`
+}
+
+// MetadataBadgeStats reports the badge memo & background verifier
+type MetadataBadgeStats struct {
+	// blocks with a memoized badge
+	Memoized int `json:"memoized"`
+	// blocks waiting for the background verifier
+	Pending int `json:"pending"`
+	// reads answered from the memo, & reads that weren't
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// verifications by the badge they gave
+	Verified int64 `json:"verified"`
+	Failed   int64 `json:"failed"`
+	Legacy   int64 `json:"legacy"`
+	// blocks sent unverified because the read's budget was spent
+	Deferred int64 `json:"deferred"`
+	// deferred blocks the queue had no room for
+	Dropped int64 `json:"dropped"`
+}
+
+// badgeVerifier memoizes verification badges by block hash
+type badgeVerifier struct {
+	sync.Mutex
+	badges  map[string]string
+	pending map[string]bool
+	queue   chan *core.Metadata
+	budget  int
+	stats   MetadataBadgeStats
+}
+
+var metadataBadges = newBadgeVerifier(metadataBadgeBudget, metadataBadgeQueueSize)
+
+func init() {
+	expvar.Publish("metadataBadges", expvar.Func(func() interface{} { return metadataBadges.Stats() }))
+}
+
+func newBadgeVerifier(budget, queueSize int) *badgeVerifier {
+	return &badgeVerifier{
+		badges:  map[string]string{},
+		pending: map[string]bool{},
+		queue:   make(chan *core.Metadata, queueSize),
+		budget:  budget,
+	}
+}
+
+// run verifies queued blocks
+func (b *badgeVerifier) run() {
+	for m := range b.queue {
+		guardrails.waitBackground()
+		b.Lock()
+		_, done := b.badges[m.Hash]
+		b.Unlock()
+		if !done {
+			b.verify(m)
+		}
+		b.Lock()
+		delete(b.pending, m.Hash)
+		b.Unlock()
+	}
+}
+
+// Details badges blocks for a read response, verifying up to the budget
+func (b *badgeVerifier) Details(blocks []*core.Metadata) []*metadataDetail {
+	budget := b.budget
+	details := make([]*metadataDetail, len(blocks))
+	for i, m := range blocks {
+		badge, ok := b.memoized(m.Hash)
+		if !ok && budget > 0 {
+			budget--
+			badge = b.verify(m)
+		} else if !ok {
+			badge = badgeUnverified
+			b.enqueue(m)
+		}
+		details[i] = &metadataDetail{Metadata: m, Verification: badge}
+	}
+	return details
+}
+
+// Detail badges a single block
+func (b *badgeVerifier) Detail(m *core.Metadata) *metadataDetail {
+	return b.Details([]*core.Metadata{m})[0]
+}
+
+// memoized reads a block's badge from the memo
+func (b *badgeVerifier) memoized(hash string) (string, bool) {
+	b.Lock()
+	defer b.Unlock()
+	badge, ok := b.badges[hash]
+	if ok {
+		b.stats.Hits++
+	} else {
+		b.stats.Misses++
+	}
+	return badge, ok
+}
+
+// verify badges a block & memoizes it. failures are logged
+func (b *badgeVerifier) verify(m *core.Metadata) string {
+	badge, got := metadataBadge(m)
+	if badge == badgeFailed {
+		log.Errorf("metadata verification failed: block %s by %s about %s stamped %s hashes to %s", m.Hash, m.KeyId, m.Subject, m.Timestamp, got)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.badges[m.Hash] = badge
+	switch badge {
+	case badgeVerified:
+		b.stats.Verified++
+	case badgeFailed:
+		b.stats.Failed++
+	case badgeLegacy:
+		b.stats.Legacy++
+	}
+	return badge
+}
+
+// enqueue queues a block for the background verifier. never blocks
+func (b *badgeVerifier) enqueue(m *core.Metadata) {
+	b.Lock()
+	defer b.Unlock()
+	b.stats.Deferred++
+	if b.pending[m.Hash] {
+		return
+	}
+	select {
+	case b.queue <- m:
+		b.pending[m.Hash] = true
+	default:
+		b.stats.Dropped++
+	}
+}
+
+// Stats reports the memo & verifier
+func (b *badgeVerifier) Stats() MetadataBadgeStats {
+	b.Lock()
+	defer b.Unlock()
+	s := b.stats
+	s.Memoized = len(b.badges)
+	s.Pending = len(b.pending)
+	return s
+}
+
+// metadataBadge checks a block against it's hash, returning it's badge & the
+// hash it's contents have, if it could be computed
+func metadataBadge(m *core.Metadata) (badge, got string) {
+	if erasedKeyId(m.KeyId) {
+		return badgeErased, ""
+	}
+	if alg, err := hashAlgorithm(m.Hash); err != nil || alg != defaultHashAlgorithm {
+		return badgeLegacy, ""
+	}
+	got, err := metadataHash(m)
+	if err != nil {
+		return badgeFailed, err.Error()
+	}
+	if got != m.Hash {
+		return badgeFailed, got
+	}
+	return badgeVerified, got
+}
+
+// writeMetadataBadgeMetrics writes badge memo & verifier stats as prometheus metrics
+func writeMetadataBadgeMetrics(w io.Writer, s MetadataBadgeStats) {
+	fmt.Fprintln(w, "# HELP patchbay_metadata_badges_memoized metadata blocks with a memoized verification badge")
+	fmt.Fprintln(w, "# TYPE patchbay_metadata_badges_memoized gauge")
+	fmt.Fprintf(w, "patchbay_metadata_badges_memoized %d\n", s.Memoized)
+	fmt.Fprintln(w, "# HELP patchbay_metadata_badges_pending metadata blocks waiting to be verified in the background")
+	fmt.Fprintln(w, "# TYPE patchbay_metadata_badges_pending gauge")
+	fmt.Fprintf(w, "patchbay_metadata_badges_pending %d\n", s.Pending)
+	fmt.Fprintln(w, "# HELP patchbay_metadata_badge_lookups_total badge lookups by weather they were memoized")
+	fmt.Fprintln(w, "# TYPE patchbay_metadata_badge_lookups_total counter")
+	fmt.Fprintf(w, "patchbay_metadata_badge_lookups_total{result=\"hit\"} %d\n", s.Hits)
+	fmt.Fprintf(w, "patchbay_metadata_badge_lookups_total{result=\"miss\"} %d\n", s.Misses)
+	fmt.Fprintln(w, "# HELP patchbay_metadata_verifications_total metadata blocks verified by the badge they got")
+	fmt.Fprintln(w, "# TYPE patchbay_metadata_verifications_total counter")
+	fmt.Fprintf(w, "patchbay_metadata_verifications_total{badge=%q} %d\n", badgeVerified, s.Verified)
+	fmt.Fprintf(w, "patchbay_metadata_verifications_total{badge=%q} %d\n", badgeFailed, s.Failed)
+	fmt.Fprintf(w, "patchbay_metadata_verifications_total{badge=%q} %d\n", badgeLegacy, s.Legacy)
+	fmt.Fprintln(w, "# HELP patchbay_metadata_badges_deferred_total metadata blocks sent unverified because a read's budget was spent")
+	fmt.Fprintln(w, "# TYPE patchbay_metadata_badges_deferred_total counter")
+	fmt.Fprintf(w, "patchbay_metadata_badges_deferred_total %d\n", s.Deferred)
+	fmt.Fprintln(w, "# HELP patchbay_metadata_badges_dropped_total deferred blocks the background verifier had no room for")
+	fmt.Fprintln(w, "# TYPE patchbay_metadata_badges_dropped_total counter")
+	fmt.Fprintf(w, "patchbay_metadata_badges_dropped_total %d\n", s.Dropped)
+}
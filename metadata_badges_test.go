@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// newTestBlock makes a metadata block with a correct hash
+func newTestBlock(t *testing.T, title string) *core.Metadata {
+	m := &core.Metadata{
+		Timestamp: time.Date(2017, 1, 1, 0, 0, 1, 0, time.UTC),
+		KeyId:     "key",
+		Subject:   "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+		Meta:      map[string]interface{}{"title": title},
+	}
+	var err error
+	if m.Hash, err = metadataHash(m); err != nil {
+		t.Fatal(err.Error())
+	}
+	return m
+}
+
+func TestMetadataBadge(t *testing.T) {
+	tampered := newTestBlock(t, "EPA")
+	tampered.Meta["title"] = "not EPA"
+	blake := newTestBlock(t, "EPA")
+	blake.Hash = "a0e402200000000000000000000000000000000000000000000000000000000000000000"
+	anonymized := newTestBlock(t, "EPA")
+	anonymized.KeyId = (&EraseReport{Id: "5f1c2b3a-4d5e-4f60-8a7b-9c0d1e2f3a4b"}).pseudonym()
+
+	cases := []struct {
+		block *core.Metadata
+		badge string
+	}{
+		{newTestBlock(t, "EPA"), badgeVerified},
+		{tampered, badgeFailed},
+		{&core.Metadata{Subject: "a"}, badgeLegacy},
+		{&core.Metadata{Hash: "not a multihash"}, badgeLegacy},
+		{blake, badgeLegacy},
+		{anonymized, badgeErased},
+	}
+	for i, c := range cases {
+		if got, _ := metadataBadge(c.block); got != c.badge {
+			t.Errorf("case %d expected badge %s, got: %s", i, c.badge, got)
+		}
+	}
+}
+
+func TestBadgeVerifier(t *testing.T) {
+	b := newBadgeVerifier(2, 1)
+	tampered := newTestBlock(t, "tampered")
+	tampered.Meta["title"] = "changed"
+	blocks := []*core.Metadata{newTestBlock(t, "a"), tampered, newTestBlock(t, "c"), newTestBlock(t, "d")}
+
+	// past the budget blocks are unverified, & queued while there's room
+	details := b.Details(blocks)
+	for i, badge := range []string{badgeVerified, badgeFailed, badgeUnverified, badgeUnverified} {
+		if details[i].Verification != badge {
+			t.Errorf("block %d expected badge %s, got: %s", i, badge, details[i].Verification)
+		}
+	}
+	s := b.Stats()
+	if s.Memoized != 2 || s.Pending != 1 || s.Deferred != 2 || s.Dropped != 1 || s.Failed != 1 {
+		t.Errorf("expected 2 memoized, 1 pending & 1 dropped, got: %#v", s)
+	}
+
+	go b.run()
+	defer close(b.queue)
+	for start := time.Now(); b.Stats().Pending > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for the background verifier")
+		}
+	}
+
+	// memoized blocks don't count towards the budget
+	details = b.Details(blocks)
+	for i, badge := range []string{badgeVerified, badgeFailed, badgeVerified, badgeVerified} {
+		if details[i].Verification != badge {
+			t.Errorf("second read: block %d expected badge %s, got: %s", i, badge, details[i].Verification)
+		}
+	}
+	if s = b.Stats(); s.Verified != 3 || s.Hits != 3 || s.Memoized != 4 {
+		t.Errorf("expected 3 memo hits & each block verified once, got: %#v", s)
+	}
+
+	buf := &bytes.Buffer{}
+	writeMetadataBadgeMetrics(buf, s)
+	for _, line := range []string{
+		"patchbay_metadata_badges_memoized 4",
+		`patchbay_metadata_badge_lookups_total{result="hit"} 3`,
+		`patchbay_metadata_verifications_total{badge="failed"} 1`,
+		"patchbay_metadata_badges_dropped_total 1",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+const (
+	// number of subjects the metadata cache holds before evicting the least recently used
+	metadataCacheSize = 2048
+	// longest a cached value is served before it's re-read, regardless of events
+	metadataCacheTTL = 5 * time.Minute
+)
+
+var (
+	// metadataCacheStats exposes cache hit/miss/invalidation counts at /debug/vars
+	metadataCacheStats = expvar.NewMap("metadataCache")
+	// metaCache is the package-level metadata cache
+	metaCache = newMetadataCache(metadataCacheSize, metadataCacheTTL)
+)
+
+func init() {
+	addEventListener(func(e *Event) {
+		switch e.Type {
+		case EventMetadataAdded, EventMetadataDeleted:
+			metaCache.Invalidate(e.Subject)
+			// reads of the subject's hash aliases include it's metadata too
+			if appDB == nil {
+				return
+			}
+			aliases, err := hashAliases(appDB, e.Subject)
+			if err != nil {
+				log.Infof("error reading hash aliases of %s: %s", e.Subject, err.Error())
+				return
+			}
+			for _, alias := range aliases {
+				if alias != e.Subject {
+					metaCache.Invalidate(alias)
+				}
+			}
+		}
+	})
+}
+
+// metadataCache is an in-process LRU cache of per-subject metadata reads with a TTL.
+// Entries are invalidated by METADATA_ADDED & METADATA_DELETED events, and
+// the cache is bypassed entirely while events aren't being reliably received
+type metadataCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	ll      *list.List
+	entries map[string]*list.Element
+	// gen is incremented on every invalidation. reads only store their result if
+	// no invalidation happened while they were loading, otherwise a read racing
+	// a write could cache stale data
+	gen uint64
+	// healthy reports weather invalidation events are being reliably received
+	healthy func() bool
+}
+
+// subjectCacheEntry holds all cached values for a single subject
+type subjectCacheEntry struct {
+	subject string
+	expires time.Time
+	values  map[string]interface{}
+}
+
+func newMetadataCache(size int, ttl time.Duration) *metadataCache {
+	return &metadataCache{
+		size:    size,
+		ttl:     ttl,
+		ll:      list.New(),
+		entries: map[string]*list.Element{},
+		healthy: eventsHealthy,
+	}
+}
+
+// Consensus returns the consensus metadata for a subject
+func (c *metadataCache) Consensus(db *sql.DB, subject string) (map[string][]interface{}, error) {
+	v, err := c.get(subject, "consensus", func() (interface{}, error) {
+		return calcConsensus(db, subject)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string][]interface{}), nil
+}
+
+// LatestMetadata returns the most recent metadata block for a keyId & subject,
+// returning ErrNotFound if none exists. Not-found results aren't cached
+func (c *metadataCache) LatestMetadata(db *sql.DB, keyId, subject string) (*core.Metadata, error) {
+	v, err := c.get(subject, "latest:"+keyId, func() (interface{}, error) {
+		return latestMetadataForSubject(db, keyId, subject)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*core.Metadata), nil
+}
+
+// get reads a value for a subject from the cache, calling load on a miss
+func (c *metadataCache) get(subject, field string, load func() (interface{}, error)) (interface{}, error) {
+	if !c.healthy() {
+		metadataCacheStats.Add("bypasses", 1)
+		return load()
+	}
+
+	c.Lock()
+	if el, ok := c.entries[subject]; ok {
+		entry := el.Value.(*subjectCacheEntry)
+		if time.Now().Before(entry.expires) {
+			if v, ok := entry.values[field]; ok {
+				c.ll.MoveToFront(el)
+				c.Unlock()
+				metadataCacheStats.Add("hits", 1)
+				return v, nil
+			}
+		} else {
+			c.remove(el)
+			metadataCacheStats.Add("expirations", 1)
+		}
+	}
+	gen := c.gen
+	c.Unlock()
+
+	metadataCacheStats.Add("misses", 1)
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.store(subject, field, v, gen)
+	return v, nil
+}
+
+// store caches a value read while the cache was at gen
+func (c *metadataCache) store(subject, field string, v interface{}, gen uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.gen != gen {
+		// an invalidation happened while loading, don't cache what might be stale
+		return
+	}
+
+	if el, ok := c.entries[subject]; ok {
+		el.Value.(*subjectCacheEntry).values[field] = v
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.entries[subject] = c.ll.PushFront(&subjectCacheEntry{
+		subject: subject,
+		expires: time.Now().Add(c.ttl),
+		values:  map[string]interface{}{field: v},
+	})
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+		metadataCacheStats.Add("evictions", 1)
+	}
+}
+
+// consensusSnapshot lists cached consensus values that haven't expired, most
+// recently used first
+func (c *metadataCache) consensusSnapshot() []*consensusSnapshot {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	entries := []*consensusSnapshot{}
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*subjectCacheEntry)
+		if v, ok := entry.values["consensus"].(map[string][]interface{}); ok && now.Before(entry.expires) {
+			entries = append(entries, &consensusSnapshot{Subject: entry.subject, Values: v})
+		}
+	}
+	return entries
+}
+
+// restoreConsensus caches consensus values from a snapshot, least recently used
+// first, leaving subjects that are already cached alone
+func (c *metadataCache) restoreConsensus(entries []*consensusSnapshot) {
+	c.Lock()
+	defer c.Unlock()
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if _, ok := c.entries[e.Subject]; ok {
+			continue
+		}
+		c.entries[e.Subject] = c.ll.PushFront(&subjectCacheEntry{
+			subject: e.Subject,
+			expires: time.Now().Add(c.ttl),
+			values:  map[string]interface{}{"consensus": e.Values},
+		})
+	}
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+// reconcileConsensus re-reads a subject's cached consensus, replacing it unless
+// the subject was invalidated while reading
+func (c *metadataCache) reconcileConsensus(subject string, load func(subject string) (map[string][]interface{}, error)) error {
+	c.Lock()
+	el, ok := c.entries[subject]
+	if ok {
+		_, ok = el.Value.(*subjectCacheEntry).values["consensus"]
+	}
+	gen := c.gen
+	c.Unlock()
+	if !ok {
+		// evicted or invalidated since it was restored, the next read loads it
+		return nil
+	}
+
+	v, err := load(subject)
+	if err != nil {
+		return err
+	}
+	c.store(subject, "consensus", v, gen)
+	return nil
+}
+
+// Invalidate drops all cached values for a subject
+func (c *metadataCache) Invalidate(subject string) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	if el, ok := c.entries[subject]; ok {
+		c.remove(el)
+	}
+	metadataCacheStats.Add("invalidations", 1)
+}
+
+// remove an element from the cache, must be called with the lock held
+func (c *metadataCache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*subjectCacheEntry).subject)
+}
+
+// Len returns the number of subjects currently cached
+func (c *metadataCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.ll.Len()
+}
+
+// calcConsensus reads all metadata for a subject & sums it into consensus values
+func calcConsensus(db *sql.DB, subject string) (map[string][]interface{}, error) {
+	blocks, err := MetadataForSubject(db, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	// system-generated keys aren't assertions, so they don't count towards consensus.
+	// blocks written about aliases of the subject count towards it
+	for i, b := range blocks {
+		blocks[i] = withoutReservedKeys(b)
+		blocks[i].Subject = subject
+	}
+
+	c, values, err := core.SumConsensus(subject, blocks)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Metadata(values)
+}
+
+// WriteMetadata writes a person's metadata block with the default service, see Service.WriteMetadata
+func WriteMetadata(m *core.Metadata) error {
+	return defaultService().WriteMetadata(m)
+}
+
+// WriteSystemMetadata writes a system-generated metadata block with the default
+// service, see Service.WriteSystemMetadata
+func WriteSystemMetadata(m *core.Metadata, attribution string) error {
+	return defaultService().WriteSystemMetadata(m, attribution)
+}
+
+// WriteMetadata writes a person's metadata block to the store & publishes a METADATA_ADDED
+// event. Cached reads for the subject are invalidated before WriteMetadata returns.
+// People can't set reserved meta keys. Captures of the subject become permanent
+func (s *Service) WriteMetadata(m *core.Metadata) error {
+	if err := checkHumanMeta(m.Meta); err != nil {
+		return err
+	}
+	if err := s.writeMetadata(m); err != nil {
+		return err
+	}
+	s.promoteCapturesFor(m.Subject, m.KeyId)
+	return nil
+}
+
+// WriteSystemMetadata writes a system-generated metadata block. System blocks can
+// set keys outside the reserved namespace only if attributed, eg: to the person
+// who accepted a suggestion
+func (s *Service) WriteSystemMetadata(m *core.Metadata, attribution string) error {
+	if err := checkSystemMeta(m.Meta, attribution); err != nil {
+		return err
+	}
+	if attribution != "" {
+		if m.Meta == nil {
+			m.Meta = map[string]interface{}{}
+		}
+		m.Meta[metaAttributionKey] = attribution
+	}
+	if err := s.writeMetadata(m); err != nil {
+		return err
+	}
+	// attributed blocks are written for a person, so they count as their interest
+	s.promoteCapturesFor(m.Subject, attribution)
+	return nil
+}
+
+func (s *Service) writeMetadata(m *core.Metadata) error {
+	// metadata about content that's been re-hashed is written about it's current hash
+	subject, err := currentHash(s.DB, m.Subject)
+	if err != nil {
+		return err
+	}
+	m.Subject = subject
+	if err := checkRelations(s.DB, m); err != nil {
+		return err
+	}
+	if err := checkWriteErr(s.insertMetadata(m)); err != nil {
+		return err
+	}
+	// the block is written, failing to index it's relations shouldn't fail it
+	if err := indexRelations(s.DB, m); err != nil {
+		s.Log.Infof("error indexing relations for %s: %s", m.Hash, checkWriteErr(err).Error())
+	}
+	auditMetadataWrite(s.DB, m)
+	s.Publish(&Event{
+		Type:    EventMetadataAdded,
+		Subject: m.Subject,
+		Data:    m,
+	})
+	return nil
+}
+
+// insertMetadata stamps, hashes & inserts a block. core stamps blocks with the
+// process clock when it writes them, so blocks are written here instead to
+// keep them after their prev, see chainTimestamp
+func (s *Service) insertMetadata(m *core.Metadata) error {
+	if erasedKeyId(m.KeyId) {
+		return ErrReservedKeyId
+	}
+	prev, err := prevTimestamp(s.DB, m.Prev)
+	if err != nil {
+		return err
+	}
+	ts, adjusted, err := chainTimestamp(s.Clock(), prev)
+	if err != nil {
+		s.Log.Errorf("clock skew: not writing metadata about %s by %s, it's prev is stamped %s", m.Subject, m.KeyId, prev.Format(time.RFC3339))
+		return err
+	}
+	if adjusted {
+		s.Log.Infof("clock skew: stamping metadata about %s by %s at %s, %s ahead of this instance's clock", m.Subject, m.KeyId, ts.Format(time.RFC3339), ts.Sub(s.Clock()))
+	}
+
+	m.Timestamp = ts
+	if m.Hash, err = metadataHash(m); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(m.Meta)
+	if err != nil {
+		return err
+	}
+	if _, err := s.DB.Exec("insert into metadata (hash,time_stamp,key_id,subject,prev,meta,deleted,skew_adjusted) values ($1, $2, $3, $4, $5, $6, false, $7)",
+		m.Hash, m.Timestamp, m.KeyId, m.Subject, m.Prev, meta, adjusted); err != nil {
+		return err
+	}
+	logUserAction(s.DB, m.KeyId, userActionMetadata, "", m.Subject, s.Clock())
+
+	// TODO - this is a straight set carried over from core, should be derived from consensus
+	if title, ok := m.Meta["title"].(string); ok && title != "" && s.Store != nil {
+		go func() {
+			u := &core.Url{Hash: m.Subject}
+			if err := u.Read(s.Store); err != nil {
+				return
+			}
+			u.Title = title
+			u.Save(s.Store)
+		}()
+	}
+	return nil
+}
+
+// metadataCols are the columns of metadata. core reads metadata with it's own
+// column lists, these are what patchbay reads it with
+var metadataCols = &columnSet{
+	table:   "metadata",
+	columns: []string{"hash", "time_stamp", "key_id", "subject", "prev", "meta", "deleted", "deleted_reason"},
+}
+
+// scanMetadata reads a metadata block selected with metadataCols
+func scanMetadata(row sqlScannable) (*core.Metadata, error) {
+	m := &core.Metadata{}
+	var (
+		meta    []byte
+		deleted sql.NullBool
+		reason  string
+	)
+	err := metadataCols.scan(row, scanTargets{
+		"hash":           &m.Hash,
+		"time_stamp":     &m.Timestamp,
+		"key_id":         &m.KeyId,
+		"subject":        &m.Subject,
+		"prev":           &m.Prev,
+		"meta":           &meta,
+		"deleted":        &deleted,
+		"deleted_reason": &reason,
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		if err := json.Unmarshal(meta, &m.Meta); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestMetadataCacheGet(t *testing.T) {
+	c := newMetadataCache(2, time.Minute)
+	loads := 0
+	load := func(v string) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			loads++
+			return v, nil
+		}
+	}
+
+	if v, _ := c.get("a", "consensus", load("one")); v != "one" {
+		t.Errorf("expected first read to load. got: %v", v)
+	}
+	if v, _ := c.get("a", "consensus", load("two")); v != "one" || loads != 1 {
+		t.Errorf("expected second read to hit cache. got: %v, loads: %d", v, loads)
+	}
+
+	c.Invalidate("a")
+	if v, _ := c.get("a", "consensus", load("three")); v != "three" {
+		t.Errorf("expected read after invalidation to load. got: %v", v)
+	}
+
+	// adding two more subjects should evict the least recently used
+	c.get("b", "consensus", load("b"))
+	c.get("c", "consensus", load("c"))
+	if c.Len() != 2 {
+		t.Errorf("expected cache to hold 2 subjects, got: %d", c.Len())
+	}
+	loads = 0
+	c.get("a", "consensus", load("a"))
+	if loads != 1 {
+		t.Errorf("expected evicted subject to be re-loaded")
+	}
+
+	// errors aren't cached
+	c.get("d", "consensus", func() (interface{}, error) { return nil, fmt.Errorf("boom") })
+	if v, err := c.get("d", "consensus", load("d")); err != nil || v != "d" {
+		t.Errorf("expected error to not be cached. got: %v, %v", v, err)
+	}
+}
+
+func TestMetadataCacheTTL(t *testing.T) {
+	c := newMetadataCache(10, time.Millisecond)
+	c.get("a", "consensus", func() (interface{}, error) { return "stale", nil })
+	time.Sleep(time.Millisecond * 5)
+	if v, _ := c.get("a", "consensus", func() (interface{}, error) { return "fresh", nil }); v != "fresh" {
+		t.Errorf("expected expired entry to be re-loaded. got: %v", v)
+	}
+}
+
+func TestMetadataCacheInvalidateDuringLoad(t *testing.T) {
+	c := newMetadataCache(10, time.Minute)
+	c.get("a", "consensus", func() (interface{}, error) {
+		// a write lands while we're reading
+		c.Invalidate("a")
+		return "stale", nil
+	})
+	if v, _ := c.get("a", "consensus", func() (interface{}, error) { return "fresh", nil }); v != "fresh" {
+		t.Errorf("expected value loaded during an invalidation to not be cached. got: %v", v)
+	}
+}
+
+func TestMetadataCacheBypass(t *testing.T) {
+	c := newMetadataCache(10, time.Minute)
+	c.healthy = func() bool { return false }
+	loads := 0
+	load := func() (interface{}, error) {
+		loads++
+		return loads, nil
+	}
+	c.get("a", "consensus", load)
+	c.get("a", "consensus", load)
+	if loads != 2 {
+		t.Errorf("expected cache to be bypassed while events are unhealthy. loads: %d", loads)
+	}
+}
+
+func TestMetadataEventInvalidation(t *testing.T) {
+	metaCache.get("event_subject", "consensus", func() (interface{}, error) { return "cached", nil })
+	dispatchEvent(&Event{Type: EventMetadataAdded, Subject: "event_subject"})
+	if v, _ := metaCache.get("event_subject", "consensus", func() (interface{}, error) { return "fresh", nil }); v != "fresh" {
+		t.Errorf("expected METADATA_ADDED event to invalidate cache. got: %v", v)
+	}
+}
+
+func TestWriteMetadataReadThrough(t *testing.T) {
+	defer resetTestData(appDB, "metadata")
+	subject := "1220c4ecbbb5bc1bbe3a2ffae3cf6d8b71aacfb3c5e1ee06b12f1b4b4f5b0f1fe8a0"
+	keyId := "test_key_id"
+
+	// prime the cache
+	if _, err := metaCache.Consensus(appDB, subject); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := metaCache.LatestMetadata(appDB, keyId, subject); err != nil && err != core.ErrNotFound {
+		t.Fatal(err.Error())
+	}
+
+	m, err := core.NextMetadata(appDB, keyId, subject)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	m.Meta = map[string]interface{}{"title": "written title"}
+	if err := WriteMetadata(m); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	latest, err := metaCache.LatestMetadata(appDB, keyId, subject)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if latest.Hash != m.Hash {
+		t.Errorf("expected latest read to reflect write. expected hash: %s, got: %s", m.Hash, latest.Hash)
+	}
+
+	consensus, err := metaCache.Consensus(appDB, subject)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(consensus["title"]) == 0 || consensus["title"][0] != "written title" {
+		t.Errorf("expected consensus read to reflect write. got: %v", consensus)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// how many blocks between import progress reports
+const metadataImportProgressInterval = 500
+
+// ErrNoExportMetadata is returned when importing from a zip without a metadata.ndjson file
+var ErrNoExportMetadata = fmt.Errorf("zip doesn't contain metadata.ndjson, is it a patchbay export?")
+
+// MetadataImport summarizes loading metadata blocks
+type MetadataImport struct {
+	Imported int `json:"imported"`
+	// blocks that were already stored
+	Existing int `json:"existing"`
+	// blocks that don't match their hash, which aren't imported
+	Mismatches []*HashMismatch `json:"mismatches"`
+}
+
+// ImportMetadata loads metadata blocks from r, a stream of JSON blocks like
+// the metadata.ndjson file of a user export. blocks are stored as they are,
+// keeping their timestamps, so each is checked against it's hash first.
+// blocks that are already stored are skipped, so imports can be re-run.
+// progress is called with the number of blocks read every so often
+func ImportMetadata(db *sql.DB, r io.Reader, progress func(read int)) (*MetadataImport, error) {
+	res := &MetadataImport{Mismatches: []*HashMismatch{}}
+	dec := json.NewDecoder(r)
+	for read := 1; ; read++ {
+		m := &core.Metadata{}
+		if err := dec.Decode(m); err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return res, err
+		}
+
+		if erasedKeyId(m.KeyId) {
+			return res, ErrReservedKeyId
+		}
+		hash, err := metadataHash(m)
+		if err != nil {
+			return res, err
+		}
+		if hash != m.Hash {
+			res.Mismatches = append(res.Mismatches, &HashMismatch{Kind: "metadata", Expected: m.Hash, Got: hash})
+			continue
+		}
+		imported, err := importMetadataBlock(db, m)
+		if err != nil {
+			return res, err
+		}
+		if imported {
+			res.Imported++
+		} else {
+			res.Existing++
+		}
+
+		if progress != nil && read%metadataImportProgressInterval == 0 {
+			progress(read)
+		}
+	}
+}
+
+// importMetadataBlock inserts a block that isn't already stored, indexing it's
+// relations. reports weather the block was inserted
+func importMetadataBlock(db *sql.DB, m *core.Metadata) (bool, error) {
+	meta, err := json.Marshal(m.Meta)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec(`insert into metadata (hash,time_stamp,key_id,subject,prev,meta,deleted)
+		select $1, $2, $3, $4, $5, $6, false where not exists (select 1 from metadata where hash = $1)`,
+		m.Hash, m.Timestamp.In(time.UTC), m.KeyId, m.Subject, m.Prev, meta)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := indexRelations(db, m); err != nil {
+		log.Infof("error indexing relations for %s: %s", m.Hash, err.Error())
+	}
+	return true, nil
+}
+
+// openMetadataImport opens the blocks to import from a file, either a user
+// export zip or the JSON blocks themselves
+func openMetadataImport(path string) (io.ReadCloser, error) {
+	z, err := zip.OpenReader(path)
+	if err == zip.ErrFormat {
+		return os.Open(path)
+	} else if err != nil {
+		return nil, err
+	}
+	for _, f := range z.File {
+		if f.Name == "metadata.ndjson" {
+			r, err := f.Open()
+			if err != nil {
+				z.Close()
+				return nil, err
+			}
+			return &zipMember{ReadCloser: r, z: z}, nil
+		}
+	}
+	z.Close()
+	return nil, ErrNoExportMetadata
+}
+
+// zipMember reads one file of a zip, closing the zip with it
+type zipMember struct {
+	io.ReadCloser
+	z *zip.ReadCloser
+}
+
+func (m *zipMember) Close() error {
+	m.ReadCloser.Close()
+	return m.z.Close()
+}
@@ -78,3 +78,20 @@ func authMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 	// no-auth middware func
 	return middleware(handler)
 }
+
+// adminConfigured checks that http auth is configured before serving an admin
+// endpoint, writing a 403 if it isn't. authMiddleware lets requests through
+// when it's unconfigured, which isn't fine for endpoints that change or expose
+// archive data or server internals
+func adminConfigured(w http.ResponseWriter) bool {
+	return defaultService().adminConfigured(w)
+}
+
+// adminConfigured checks s's config has http auth configured, see adminConfigured
+func (s *Service) adminConfigured(w http.ResponseWriter) bool {
+	if s.Config == nil || s.Config.HttpAuthUsername == "" || s.Config.HttpAuthPassword == "" {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin endpoints require http auth to be configured"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// states of a moderation case
+	caseOpen       = "open"
+	caseSuppressed = "suppressed"
+	caseDismissed  = "dismissed"
+
+	// url meta key set on urls whose content has been suppressed
+	suppressedMetaKey = "suppressed"
+	// code set on responses for suppressed content
+	suppressedErrCode = "CONTENT_SUPPRESSED"
+
+	// EventSubjectSuppressed is published when a moderator suppresses a subject
+	EventSubjectSuppressed = "SUBJECT_SUPPRESSED"
+
+	// longest free-text fields accepted in a report
+	maxReportDetails = 4000
+	maxReportContact = 256
+)
+
+var (
+	// ErrReportRateLimited is returned when a reporter has submitted too many reports
+	ErrReportRateLimited = fmt.Errorf("too many reports, please try again later")
+	// ErrNotModerator is returned for moderation actions without a valid moderation token
+	ErrNotModerator = fmt.Errorf("moderation requires a valid moderation token")
+	// ErrModeratorIdentity is returned for resolving cases without an api key to
+	// attribute the resolution to
+	ErrModeratorIdentity = fmt.Errorf("resolving cases requires connecting with an api key")
+	// ErrContentSuppressed is returned when reading content that has been suppressed
+	ErrContentSuppressed = fmt.Errorf("this content has been removed")
+
+	// reportCategories lists accepted report reasons
+	reportCategories = map[string]bool{
+		"illegal":       true,
+		"personal_info": true,
+		"copyright":     true,
+		"harassment":    true,
+		"malware":       true,
+		"other":         true,
+	}
+
+	// reportLimiter limits report submission per reporter
+	reportLimiter = newReportLimiter()
+)
+
+// newReportLimiter creates a limiter allowing each reporter 10 reports an hour
+func newReportLimiter() *rateLimiter {
+	return newRateLimiter(10, time.Hour)
+}
+
+// ContentReport is a single report from a visitor about archived content
+type ContentReport struct {
+	Id       int       `json:"id"`
+	Created  time.Time `json:"created"`
+	CaseId   string    `json:"caseId"`
+	Subject  string    `json:"subject"`
+	Category string    `json:"category"`
+	Details  string    `json:"details"`
+	// optional way to reach the reporter
+	Contact string `json:"contact,omitempty"`
+}
+
+// ModerationCase groups all reports against a subject until it's resolved
+type ModerationCase struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// content hash (or url if the content hasn't been hashed) being reported
+	Subject     string           `json:"subject"`
+	Status      string           `json:"status"`
+	ReportCount int              `json:"reportCount"`
+	Resolution  string           `json:"resolution,omitempty"`
+	Reports     []*ContentReport `json:"reports,omitempty"`
+}
+
+// moderationCaseCols are the columns of moderation_cases
+var moderationCaseCols = &columnSet{
+	table:   "moderation_cases",
+	columns: []string{"id", "created", "updated", "subject", "status", "report_count", "resolution"},
+}
+
+// scanTargets maps moderationCaseCols to the case's fields
+func (c *ModerationCase) scanTargets() scanTargets {
+	return scanTargets{
+		"id":           &c.Id,
+		"created":      &c.Created,
+		"updated":      &c.Updated,
+		"subject":      &c.Subject,
+		"status":       &c.Status,
+		"report_count": &c.ReportCount,
+		"resolution":   &c.Resolution,
+	}
+}
+
+// contentReportCols are the columns of content_reports
+var contentReportCols = &columnSet{
+	table:   "content_reports",
+	columns: []string{"id", "created", "case_id", "subject", "category", "details", "contact"},
+}
+
+// scanTargets maps contentReportCols to the report's fields
+func (r *ContentReport) scanTargets() scanTargets {
+	return scanTargets{
+		"id":       &r.Id,
+		"created":  &r.Created,
+		"case_id":  &r.CaseId,
+		"subject":  &r.Subject,
+		"category": &r.Category,
+		"details":  &r.Details,
+		"contact":  &r.Contact,
+	}
+}
+
+// validate checks & cleans up a report before it's stored
+func (r *ContentReport) validate() error {
+	r.Subject = strings.TrimSpace(r.Subject)
+	if r.Subject == "" {
+		return fmt.Errorf("subject is required")
+	}
+	if !reportCategories[r.Category] {
+		return fmt.Errorf("invalid report category: %s", r.Category)
+	}
+	if len(r.Details) > maxReportDetails {
+		return fmt.Errorf("details must be under %d characters", maxReportDetails)
+	}
+	if len(r.Contact) > maxReportContact {
+		return fmt.Errorf("contact must be under %d characters", maxReportContact)
+	}
+	return nil
+}
+
+// SubmitReport records a report, adding it to the open case for it's subject or
+// creating a new case. reporters are rate limited by keys, which aren't stored
+func SubmitReport(db *sql.DB, keys limitKeys, r *ContentReport) (*ModerationCase, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	if err := maintenance.Check(); err != nil {
+		return nil, err
+	}
+	if refusal, err := rateLimits.admit(defaultService().withDB(db), keys, time.Now(), limitContentReports); err != nil {
+		return nil, err
+	} else if refusal != nil {
+		return nil, refusal
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Round(time.Second).In(time.UTC)
+	c := &ModerationCase{}
+	// a partial unique index keeps one open case per subject, so concurrent
+	// reports against the same subject land in the same case
+	row := tx.QueryRow(`insert into moderation_cases (id,created,updated,subject,status,report_count) values ($1, $2, $2, $3, $4, 1)
+		on conflict (subject) where status = 'open' do update set updated = $2, report_count = moderation_cases.report_count + 1
+		returning `+moderationCaseCols.String(),
+		uuid.New(), now, r.Subject, caseOpen)
+	err = moderationCaseCols.scan(row, c.scanTargets())
+	if err != nil {
+		return nil, checkWriteErr(err)
+	}
+
+	r.CaseId = c.Id
+	r.Created = now
+	err = tx.QueryRow("insert into content_reports (created,case_id,subject,category,details,contact) values ($1, $2, $3, $4, $5, $6) returning id",
+		r.Created, r.CaseId, r.Subject, r.Category, r.Details, r.Contact).Scan(&r.Id)
+	if err != nil {
+		return nil, checkWriteErr(err)
+	}
+
+	if err := auditModeration(tx, c.Id, "", "report", r.Category); err != nil {
+		return nil, checkWriteErr(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, checkWriteErr(err)
+	}
+	return c, nil
+}
+
+// OpenCases lists open cases with their reports, most reported first
+func OpenCases(db *sql.DB, limit, offset int) ([]*ModerationCase, error) {
+	rows, err := db.Query("select "+moderationCaseCols.String()+" from moderation_cases where status = $1 order by report_count desc, created limit $2 offset $3",
+		caseOpen, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	cases := []*ModerationCase{}
+	for rows.Next() {
+		c := &ModerationCase{}
+		if err := moderationCaseCols.scan(rows, c.scanTargets()); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	rows.Close()
+
+	for _, c := range cases {
+		if c.Reports, err = caseReports(db, c.Id); err != nil {
+			return nil, err
+		}
+	}
+	return cases, nil
+}
+
+func caseReports(db *sql.DB, caseId string) ([]*ContentReport, error) {
+	rows, err := db.Query("select "+contentReportCols.String()+" from content_reports where case_id = $1 order by created", caseId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []*ContentReport{}
+	for rows.Next() {
+		r := &ContentReport{}
+		if err := contentReportCols.scan(rows, r.scanTargets()); err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// ResolveCase closes an open case by suppressing it's subject or dismissing it's reports
+func ResolveCase(db *sql.DB, caseId, resolution, moderator, note string) (*ModerationCase, error) {
+	if resolution != caseSuppressed && resolution != caseDismissed {
+		return nil, fmt.Errorf("resolution must be one of: %s, %s", caseSuppressed, caseDismissed)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	c := &ModerationCase{}
+	row := tx.QueryRow("update moderation_cases set status = $2, resolution = $3, updated = $4 where id = $1 and status = $5 returning "+moderationCaseCols.String(),
+		caseId, resolution, note, time.Now().Round(time.Second).In(time.UTC), caseOpen)
+	err = moderationCaseCols.scan(row, c.scanTargets())
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no open case with id: %s", caseId)
+	} else if err != nil {
+		return nil, checkWriteErr(err)
+	}
+
+	if resolution == caseSuppressed {
+		if err := suppressSubject(tx, c.Subject); err != nil {
+			return nil, checkWriteErr(err)
+		}
+	}
+	if err := auditModeration(tx, c.Id, moderator, resolution, note); err != nil {
+		return nil, checkWriteErr(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, checkWriteErr(err)
+	}
+
+	if resolution == caseSuppressed {
+		// metadata for the subject was soft-deleted, drop caches & tell watchers
+		publishEvent(&Event{Type: EventMetadataDeleted, Subject: c.Subject})
+		publishEvent(&Event{Type: EventSubjectSuppressed, Subject: c.Subject})
+		announceSuppressed(c.Subject)
+	}
+	return c, nil
+}
+
+// suppressSubject hides content by flagging it's urls & soft-deleting it's metadata.
+// nothing is removed, so suppression can be reversed by hand if made in error
+func suppressSubject(tx *sql.Tx, subject string) error {
+	if _, err := tx.Exec(`update urls set meta = (coalesce(meta::jsonb, '{}'::jsonb) || '{"suppressed":true}'::jsonb)::json where hash = $1 or url = $1`, subject); err != nil {
+		return err
+	}
+	_, err := tx.Exec("update metadata set deleted = true where subject = $1", subject)
+	return err
+}
+
+// auditModeration records an entry in the moderation log
+func auditModeration(tx *sql.Tx, caseId, actor, action, note string) error {
+	_, err := tx.Exec("insert into moderation_log (created,case_id,actor,action,note) values ($1, $2, $3, $4, $5)",
+		time.Now().Round(time.Second).In(time.UTC), caseId, actor, action, note)
+	return err
+}
+
+// announceSuppressed tells clients watching a subject that it's been suppressed
+func announceSuppressed(subject string) {
+	if room == nil {
+		return
+	}
+	data, err := json.Marshal(&ClientResponse{
+		Type:      "CONTENT_SUPPRESSED",
+		RequestId: "server",
+		Id:        subject,
+		Code:      suppressedErrCode,
+	})
+	if err != nil {
+		log.Info(err.Error())
+		return
+	}
+	room.publish <- &topicMessage{topic: subjectTopic(subject), data: data, event: "CONTENT_SUPPRESSED", contentChanged: true}
+}
+
+// isSuppressed checks if a url's content has been suppressed by a moderator
+func isSuppressed(u *core.Url) bool {
+	return u.Meta[suppressedMetaKey] == true
+}
+
+// contentSuppressed checks if content has been suppressed by a moderator
+// under any url it was captured from, including urls captured under a hash
+// that's since been re-hashed to it
+func contentSuppressed(db sqlQueryable, hash string) (bool, error) {
+	suppressed := false
+	err := db.QueryRow(`select exists(select 1 from urls where (hash = $1 or hash in (select old from hash_aliases where new = $1))
+		and coalesce(meta::jsonb->>'suppressed', '') = 'true')`, hash).Scan(&suppressed)
+	return suppressed, err
+}
+
+// unsuppressed filters a list of urls to ones whose content hasn't been suppressed
+func unsuppressed(urls []*core.Url) []*core.Url {
+	kept := make([]*core.Url, 0, len(urls))
+	for _, u := range urls {
+		if !isSuppressed(u) {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// validModerationToken checks a token against the configured moderation token.
+// moderation is disabled entirely if no token is configured
+func validModerationToken(c *config, token string) bool {
+	if c == nil || c.ModerationToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.ModerationToken)) == 1
+}
+
+// ReportContentHandler accepts content reports from a public html form
+func ReportContentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := &ContentReport{
+		Subject:  r.FormValue("subject"),
+		Category: r.FormValue("category"),
+		Details:  r.FormValue("details"),
+		Contact:  r.FormValue("contact"),
+	}
+	ip := requestIP(r)
+	c, err := SubmitReport(appDB, limitKeys{limitScopeIP: ip, limitScopeRequester: requesterHash(ip)}, report)
+	if refusal, ok := err.(*LimitRefusal); ok {
+		refusal.write(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"caseId": c.Id})
+	case ErrMaintenanceMode:
+		writeMaintenanceError(w)
+	default:
+		log.Info(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+	}
+}
+
+// ReportContentAction reports archived content for moderation
+type ReportContentAction struct {
+	ReqAction
+	clientAction
+	ContentReport
+}
+
+func (ReportContentAction) Type() string        { return "REPORT_CONTENT_REQUEST" }
+func (ReportContentAction) SuccessType() string { return "REPORT_CONTENT_SUCCESS" }
+func (ReportContentAction) FailureType() string { return "REPORT_CONTENT_FAILURE" }
+
+func (ReportContentAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &ReportContentAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *ReportContentAction) Exec() (res *ClientResponse) {
+	c, err := SubmitReport(appDB, a.client.limitKeys(), &a.ContentReport)
+	if refusal, ok := err.(*LimitRefusal); ok {
+		return refusal.response(a, a.RequestId)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	// reporters only learn the case id, not other reports against the subject
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Id:        c.Id,
+	}
+}
+
+// ModerationQueueAction lists open moderation cases
+type ModerationQueueAction struct {
+	ReqAction
+	pageRequest
+	clientAction
+	Token string `json:"token"`
+}
+
+func (ModerationQueueAction) Type() string        { return "MODERATION_QUEUE_REQUEST" }
+func (ModerationQueueAction) SuccessType() string { return "MODERATION_QUEUE_SUCCESS" }
+func (ModerationQueueAction) FailureType() string { return "MODERATION_QUEUE_FAILURE" }
+
+func (ModerationQueueAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &ModerationQueueAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *ModerationQueueAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrNotModerator.Error(),
+		}
+	}
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	cases, err := OpenCases(svc.DB, a.fetch(), a.offset)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "MODERATION_CASE_ARRAY",
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      newPage(&a.pageRequest, cases),
+	}
+}
+
+// ResolveCaseAction suppresses or dismisses a moderation case
+type ResolveCaseAction struct {
+	ReqAction
+	clientAction
+	Token  string `json:"token"`
+	CaseId string `json:"caseId"`
+	// one of "suppressed" or "dismissed"
+	Resolution string `json:"resolution"`
+	Note       string `json:"note"`
+}
+
+func (ResolveCaseAction) Type() string        { return "MODERATION_RESOLVE_REQUEST" }
+func (ResolveCaseAction) SuccessType() string { return "MODERATION_RESOLVE_SUCCESS" }
+func (ResolveCaseAction) FailureType() string { return "MODERATION_RESOLVE_FAILURE" }
+
+func (ResolveCaseAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &ResolveCaseAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *ResolveCaseAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrNotModerator.Error(),
+		}
+	}
+
+	// the token is shared by every moderator, the audit log records who they
+	// are by the key they connected with
+	moderator := a.client.identity()
+	if moderator == "" {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrModeratorIdentity.Error(),
+		}
+	}
+
+	c, err := ResolveCase(svc.DB, a.CaseId, a.Resolution, moderator, a.Note)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "MODERATION_CASE",
+		Id:        c.Id,
+		Data:      c,
+	}
+}
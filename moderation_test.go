@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, time.Hour)
+	cases := []struct {
+		key    string
+		expect bool
+	}{
+		{"a", true},
+		{"a", true},
+		{"b", true},
+		{"a", false},
+		{"b", true},
+		{"b", false},
+	}
+
+	for i, c := range cases {
+		if got := l.Allow(c.key); got != c.expect {
+			t.Errorf("case %d key %s: expected %t, got %t", i, c.key, c.expect, got)
+		}
+	}
+
+	l = newRateLimiter(1, time.Millisecond*10)
+	l.Allow("a")
+	time.Sleep(time.Millisecond * 20)
+	if !l.Allow("a") {
+		t.Errorf("expected hits outside the window to be forgotten")
+	}
+}
+
+func TestContentReportValidate(t *testing.T) {
+	cases := []struct {
+		report *ContentReport
+		err    string
+	}{
+		{&ContentReport{Subject: "", Category: "other"}, "subject is required"},
+		{&ContentReport{Subject: "  ", Category: "other"}, "subject is required"},
+		{&ContentReport{Subject: "hash", Category: "boring"}, "invalid report category: boring"},
+		{&ContentReport{Subject: "hash", Category: "other", Details: strings.Repeat("a", maxReportDetails+1)}, "details must be under 4000 characters"},
+		{&ContentReport{Subject: "hash", Category: "other", Contact: strings.Repeat("a", maxReportContact+1)}, "contact must be under 256 characters"},
+		{&ContentReport{Subject: " hash ", Category: "personal_info"}, ""},
+	}
+
+	for i, c := range cases {
+		err := c.report.validate()
+		if !(err == nil && c.err == "" || err != nil && err.Error() == c.err) {
+			t.Errorf("case %d error mismatch. expected: '%s', got: '%v'", i, c.err, err)
+		}
+	}
+}
+
+func TestUnsuppressed(t *testing.T) {
+	urls := []*core.Url{
+		{Url: "http://a.gov"},
+		{Url: "http://b.gov", Meta: map[string]interface{}{suppressedMetaKey: true}},
+		{Url: "http://c.gov", Meta: map[string]interface{}{"redacted": true}},
+	}
+	got := unsuppressed(urls)
+	if len(got) != 2 || got[0].Url != "http://a.gov" || got[1].Url != "http://c.gov" {
+		t.Errorf("expected suppressed urls to be left out, got: %v", got)
+	}
+}
+
+func TestValidModerationToken(t *testing.T) {
+	if validModerationToken(&config{}, "") {
+		t.Errorf("expected blank token to be rejected when moderation is disabled")
+	}
+
+	conf := &config{ModerationToken: "secret"}
+	cases := []struct {
+		token  string
+		expect bool
+	}{
+		{"", false},
+		{"nope", false},
+		{"secret", true},
+	}
+	for i, c := range cases {
+		if got := validModerationToken(conf, c.token); got != c.expect {
+			t.Errorf("case %d: expected %t, got %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestModerationCase(t *testing.T) {
+	defer resetTestData(appDB, "urls", "metadata", "moderation_cases", "content_reports", "moderation_log")
+
+	subject := "12207b06510193276b5fd9ad2fc55dcc004ada557d9259ca3505478bfef0b16ed977"
+	a, err := SubmitReport(appDB, limitKeys{limitScopeRequester: "127.0.0.1"}, &ContentReport{Subject: subject, Category: "personal_info"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := SubmitReport(appDB, limitKeys{limitScopeRequester: "127.0.0.2"}, &ContentReport{Subject: subject, Category: "other", Details: "phone numbers"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if a.Id != b.Id {
+		t.Errorf("expected reports against the same subject to share a case")
+	}
+	if b.ReportCount != 2 {
+		t.Errorf("expected report count of 2, got %d", b.ReportCount)
+	}
+
+	cases, err := OpenCases(appDB, 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(cases) != 1 || len(cases[0].Reports) != 2 {
+		t.Fatalf("expected one open case with two reports")
+	}
+
+	if _, err := ResolveCase(appDB, a.Id, caseSuppressed, "moderator", "contains personal info"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ResolveCase(appDB, a.Id, caseDismissed, "moderator", ""); err == nil {
+		t.Errorf("expected resolving a closed case to error")
+	}
+
+	u := &core.Url{Hash: subject}
+	if err := appDB.QueryRow("select url from urls where hash = $1", subject).Scan(&u.Url); err == nil {
+		if err := u.Read(store); err != nil {
+			t.Fatal(err.Error())
+		}
+		if !isSuppressed(u) {
+			t.Errorf("expected url to be flagged suppressed")
+		}
+	}
+
+	var deleted bool
+	if err := appDB.QueryRow("select deleted from metadata where subject = $1", subject).Scan(&deleted); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !deleted {
+		t.Errorf("expected metadata for suppressed subject to be deleted")
+	}
+
+	var entries int
+	if err := appDB.QueryRow("select count(1) from moderation_log where case_id = $1", a.Id).Scan(&entries); err != nil {
+		t.Fatal(err.Error())
+	}
+	if entries != 3 {
+		t.Errorf("expected 3 audit log entries, got %d", entries)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/datatogether/core"
+)
+
+// Not found
+//
+// Reads of a single entity (a url, a source, a saved search) return ErrNotFound
+// when it doesn't exist, & actions answer with a NOT_FOUND code that echoes
+// back what was asked for. Reads of a list return an empty list instead, a
+// list with nothing in it isn't missing. Lists scoped to a single entity that
+// check it exists first (a source's urls, a saved search's matches) report
+// that entity as not found.
+
+const (
+	// notFoundErrCode is set on responses for entities that don't exist
+	notFoundErrCode = "NOT_FOUND"
+)
+
+// ErrNotFound is returned by reads of a single entity that doesn't exist. It's
+// core's error, so reads through core & through this package compare equal
+var ErrNotFound = core.ErrNotFound
+
+// NotFound describes an entity a request asked for that doesn't exist
+type NotFound struct {
+	// kind of entity, eg: "url", "source", "savedSearch"
+	Entity string `json:"entity"`
+	// identifier the request used. identifiers made of more than one field are
+	// space-separated, in the order the request lists them
+	Id string `json:"id"`
+}
+
+// notFoundResponse is the failure response for a request for an entity that
+// doesn't exist
+func notFoundResponse(t ClientRequestAction, reqId, entity, id string) *ClientResponse {
+	return &ClientResponse{
+		Type:      t.FailureType(),
+		RequestId: reqId,
+		Error:     fmt.Sprintf("%s not found: %s", entity, id),
+		Code:      notFoundErrCode,
+		Details:   map[string]string{"entity": entity, "id": id},
+		Schema:    "NOT_FOUND",
+		Data:      &NotFound{Entity: entity, Id: id},
+	}
+}
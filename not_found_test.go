@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestReadActionsNotFound(t *testing.T) {
+	seeded := []string{"primers", "sources", "urls", "links", "metadata", "snapshots", "collections", "archive_requests", "uncrawlables"}
+	defer resetTestData(appDB, seeded...)
+	empty := append([]string{"collection_items", "config_snapshots", "moderation_cases", "meta_fields", "relations", "link_sightings", "link_events", "saved_searches", "saved_search_matches", "announcements", "user_actions", "outbox"}, seeded...)
+	if err := emptyTestData(appDB, empty...); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	svc := newTestService()
+	svc.Config.ModerationToken = "matrix"
+	svc.Config.SavedSearchesPerUser = 10
+	client := &Client{addr: "127.0.0.1", svc: svc}
+
+	const (
+		url  = "http://www.missing.example.com"
+		hash = "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a"
+		id   = "6f1b7c3e-2a4d-4e8f-9b0a-1c2d3e4f5a6b"
+	)
+
+	// request data for every read action, & the code it should respond with.
+	// single entities are NOT_FOUND, lists are empty
+	cases := map[string]struct {
+		data string
+		code string
+	}{
+		SearchReqAct{}.Type():                    {`{"query":"missing","page":1,"pageSize":10}`, ""},
+		FetchUrlAct{}.Type():                     {`{"url":"` + url + `"}`, notFoundErrCode},
+		FetchCollectionsAction{}.Type():          {`{"page":1,"pageSize":10}`, ""},
+		FetchInboundLinksAct{}.Type():            {`{"url":"` + url + `"}`, ""},
+		FetchOutboundLinksAct{}.Type():           {`{"url":"` + url + `"}`, ""},
+		FetchContentUrlsAction{}.Type():          {`{"hash":"` + hash + `"}`, ""},
+		FetchMetadataAction{}.Type():             {`{"keyId":"key","subject":"` + hash + `"}`, notFoundErrCode},
+		FetchPrimersAction{}.Type():              {`{}`, ""},
+		FetchPrimerAction{}.Type():               {`{"id":"` + id + `"}`, notFoundErrCode},
+		FetchSourcesAction{}.Type():              {`{"page":1,"pageSize":10}`, ""},
+		FetchSourceAction{}.Type():               {`{"id":"` + id + `"}`, notFoundErrCode},
+		FetchSourceUrlsAction{}.Type():           {`{"id":"` + id + `"}`, notFoundErrCode},
+		FetchSourceAttributedUrlsAction{}.Type(): {`{"id":"` + id + `"}`, notFoundErrCode},
+		FetchConsensusAction{}.Type():            {`{"subject":"` + hash + `"}`, ""},
+		FetchCollectionAction{}.Type():           {`{"id":"` + id + `"}`, notFoundErrCode},
+		UserCollectionsAction{}.Type():           {`{"creator":"key","page":1,"pageSize":10}`, ""},
+		MetadataByKeyRequest{}.Type():            {`{"key":"key","page":1,"pageSize":10}`, ""},
+		SuggestMetadataAction{}.Type():           {`{"subject":"` + hash + `"}`, notFoundErrCode},
+		FetchConfigSnapshotAction{}.Type():       {`{"hash":"` + hash + `"}`, notFoundErrCode},
+		DiffConfigSnapshotsAction{}.Type():       {`{"from":"` + hash + `","to":"` + hash + `"}`, notFoundErrCode},
+		FetchRecentContentUrlsAction{}.Type():    {`{"page":1,"pageSize":10}`, ""},
+		CollectionItemsAction{}.Type():           {`{"collectionId":"` + id + `","page":1,"pageSize":10}`, ""},
+		ModerationQueueAction{}.Type():           {`{"token":"matrix"}`, ""},
+		FetchMetaFieldsAction{}.Type():           {`{"sourceId":"` + id + `"}`, ""},
+		CapabilitiesAction{}.Type():              {`{"url":"` + url + `","keyId":"key"}`, ""},
+		HelloAction{}.Type():                     {`{"keyId":"key"}`, ""},
+		SubjectRelationsAction{}.Type():          {`{"subject":"` + hash + `"}`, ""},
+		LinkHistoryAction{}.Type():               {`{"src":"` + url + `","dst":"` + url + `/data"}`, notFoundErrCode},
+		ServerInfoAction{}.Type():                {`{}`, ""},
+		FetchSavedSearchesAction{}.Type():        {`{"keyId":"key"}`, ""},
+		FetchSearchMatchesAction{}.Type():        {`{"keyId":"key","id":"` + id + `"}`, notFoundErrCode},
+		MetadataHistoryAction{}.Type():           {`{"subject":"` + hash + `","hideSystem":true}`, ""},
+		CollectionSubscribeAction{}.Type():       {`{"collectionId":"` + id + `"}`, notFoundErrCode},
+		ChainHealthAction{}.Type():               {`{"token":"matrix","recheck":"` + id + `"}`, notFoundErrCode},
+		SubprimerPlanAction{}.Type():             {`{"sourceId":"` + id + `"}`, notFoundErrCode},
+		RenderCardAction{}.Type():                {`{"url":"` + url + `"}`, notFoundErrCode},
+		DashboardAction{}.Type():                 {`{}`, ""},
+		UserExportAction{}.Type():                {`{}`, ""},
+		AnnouncementsAction{}.Type():             {`{"token":"matrix"}`, ""},
+		SaveAnnouncementAction{}.Type():          {`{"token":"matrix","announcement":{"id":"` + id + `","message":"missing"}}`, notFoundErrCode},
+		DeleteAnnouncementAction{}.Type():        {`{"token":"matrix","id":"` + id + `"}`, notFoundErrCode},
+		DismissAnnouncementAction{}.Type():       {`{"id":"` + id + `"}`, notFoundErrCode},
+		CaptureNotesAction{}.Type():              {`{"capture":"` + hash + `"}`, notFoundErrCode},
+		ListUserActivityAction{}.Type():          {`{"token":"matrix","page":1,"pageSize":10}`, ""},
+		UserActivitySummaryAction{}.Type():       {`{"token":"matrix","userId":"missing"}`, notFoundErrCode},
+		OutboxDeadLettersAction{}.Type():         {`{"token":"matrix","page":1,"pageSize":10}`, ""},
+		LimitsStatusAction{}.Type():              {`{"token":"matrix"}`, ""},
+		CustodyReportAction{}.Type():             {`{"token":"matrix","hash":"` + hash + `"}`, notFoundErrCode},
+	}
+
+	// actions that aren't writes, but don't read from the database either
+	notReads := map[string]bool{
+		CreateUserAct{}.Type():               true,
+		SaveUserAct{}.Type():                 true,
+		SessionLoginAct{}.Type():             true,
+		SessionLogoutAct{}.Type():            true,
+		SessionKeysAct{}.Type():              true,
+		MsgReqAct{}.Type():                   true,
+		SubjectSubscribeAction{}.Type():      true,
+		SubjectUnsubscribeAction{}.Type():    true,
+		EditStartAction{}.Type():             true,
+		EditHeartbeatAction{}.Type():         true,
+		EditStopAction{}.Type():              true,
+		ServerReplyAction{}.Type():           true,
+		CollectionUnsubscribeAction{}.Type(): true,
+		WhoAmIAction{}.Type():                true,
+		PingAction{}.Type():                  true,
+		// tasks are read from the tasks service
+		TasksRequestAct{}.Type(): true,
+	}
+
+	for _, a := range ClientReqActions {
+		// writes are only covered if they have a case
+		c, ok := cases[a.Type()]
+		if !ok && (writeActions[a.Type()] || notReads[a.Type()]) {
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: read action isn't covered, add it to cases", a.Type())
+			continue
+		}
+
+		act := a.Parse("req", []byte(c.data))
+		if cb, ok := act.(ClientBoundAction); ok {
+			cb.SetClient(client)
+		}
+		res := act.Exec()
+
+		if res.Code != c.code {
+			t.Errorf("%s: expected code '%s', got: '%s' (%s)", a.Type(), c.code, res.Code, res.Error)
+			continue
+		}
+		if c.code == notFoundErrCode {
+			nf, ok := res.Data.(*NotFound)
+			if res.Type != act.FailureType() || !ok || nf.Entity == "" || nf.Id == "" {
+				t.Errorf("%s: expected not found failure echoing the entity & id, got: %#v", a.Type(), res)
+			}
+			continue
+		}
+
+		if res.Type != act.SuccessType() || res.Error != "" {
+			t.Errorf("%s: expected success, got: %s %s", a.Type(), res.Type, res.Error)
+			continue
+		}
+		if strings.HasSuffix(res.Schema, "_ARRAY") {
+			items := res.Data
+			if pg, ok := items.(*Page); ok {
+				items = pg.Items
+			}
+			data, err := json.Marshal(items)
+			if err != nil {
+				t.Errorf("%s: %s", a.Type(), err.Error())
+			} else if string(data) != "[]" {
+				t.Errorf("%s: expected an empty list, got: %s", a.Type(), data)
+			}
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Outbox
+//
+// Deliveries to systems outside patchbay are written to the outbox table in
+// the same transaction as the change that triggers them, so a change is never
+// committed without it's delivery or delivered without being committed. each
+// destination type registers a sender & gets a worker that claims due
+// deliveries & sends them, one at a time, oldest first.
+//
+// a claim pushes a delivery's next attempt outboxClaimTimeout into the
+// future. if the instance dies mid-send, the delivery is claimed again once
+// that passes, by whichever instance gets to it first. sends carry the
+// delivery's key (see outboxKey), so a destination that got the first send
+// before the crash can recognize the second. failed sends are retried with
+// backoff, & are dead-lettered after outboxMaxAttempts, to be requeued by a
+// moderator once the destination is fixed.
+//
+// each worker keeps a circuitBreaker per destination host. while a host's
+// breaker is open, it's deliveries are put off without using up attempts.
+// delivery counts & latency are exposed at /debug/vars under "outbox"
+
+// outbox statuses
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxDead      = "dead"
+)
+
+const (
+	// attempts a delivery gets before it's dead-lettered
+	outboxMaxAttempts = 10
+	// backoff between attempts
+	outboxBackoffBase = 30 * time.Second
+	outboxBackoffMax  = 6 * time.Hour
+	// how long a claimed delivery waits before it's claimed again, should the
+	// instance sending it die
+	outboxClaimTimeout = 2 * time.Minute
+	// how often workers look for due deliveries when there aren't any
+	outboxPollInterval = 5 * time.Second
+	// failures in a row that open a host's breaker, & how long it stays open
+	outboxBreakerThreshold = 5
+	outboxBreakerCooldown  = 5 * time.Minute
+)
+
+var (
+	// ErrUnknownOutboxDestination is returned when writing a delivery for a destination without a sender
+	ErrUnknownOutboxDestination = fmt.Errorf("unknown outbox destination")
+
+	// outboxStats exposes delivery counts & latency per destination at /debug/vars
+	outboxStats = expvar.NewMap("outbox")
+	// outboxSenders sends deliveries, by destination type
+	outboxSenders = map[string]func(d *OutboxDelivery) error{}
+)
+
+// registerOutboxDestination adds a destination type & it's sender. it must be
+// called from init
+func registerOutboxDestination(destination string, send func(d *OutboxDelivery) error) {
+	outboxSenders[destination] = send
+}
+
+// OutboxDelivery is a payload to deliver to an external system
+type OutboxDelivery struct {
+	Id      int64     `json:"id"`
+	Created time.Time `json:"created"`
+	// destination type, eg: "webhook"
+	Destination string `json:"destination"`
+	// where it's delivered to within the destination, eg: the webhook's url
+	Target      string          `json:"target"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	// one of "pending", "delivered", "dead"
+	Status    string     `json:"status"`
+	LastError string     `json:"lastError,omitempty"`
+	Delivered *time.Time `json:"delivered,omitempty"`
+}
+
+// outboxCols are the columns of outbox
+var outboxCols = &columnSet{
+	table:   "outbox",
+	columns: []string{"id", "created", "destination", "target", "payload", "attempts", "next_attempt", "status", "last_error", "delivered"},
+}
+
+// scanTargets maps outboxCols to the delivery's fields
+func (d *OutboxDelivery) scanTargets() scanTargets {
+	return scanTargets{
+		"id":           &d.Id,
+		"created":      &d.Created,
+		"destination":  &d.Destination,
+		"target":       &d.Target,
+		"payload":      (*[]byte)(&d.Payload),
+		"attempts":     &d.Attempts,
+		"next_attempt": &d.NextAttempt,
+		"status":       &d.Status,
+		"last_error":   &d.LastError,
+		"delivered":    &d.Delivered,
+	}
+}
+
+// outboxKey identifies a delivery to it's destination, so repeat sends of
+// the same delivery can be told apart from new ones
+func outboxKey(d *OutboxDelivery) string {
+	return "outbox-" + strconv.FormatInt(d.Id, 10)
+}
+
+// enqueueOutbox writes a delivery within tx, to be sent once tx commits
+func enqueueOutbox(tx *sql.Tx, destination, target string, payload interface{}, now time.Time) error {
+	if outboxSenders[destination] == nil {
+		return ErrUnknownOutboxDestination
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	now = now.Round(time.Second).In(time.UTC)
+	_, err = tx.Exec("insert into outbox (created,destination,target,payload,next_attempt,status) values ($1, $2, $3, $4, $1, $5)",
+		now, destination, target, data, outboxPending)
+	return err
+}
+
+// ReadDeadLetters reads dead-lettered deliveries, newest first. an empty
+// destination reads them for every destination
+func ReadDeadLetters(db *sql.DB, destination string, limit, offset int) ([]*OutboxDelivery, error) {
+	rows, err := db.Query("select "+outboxCols.String()+" from outbox where status = $1 and ($2 = '' or destination = $2) order by created desc, id desc limit $3 offset $4",
+		outboxDead, destination, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*OutboxDelivery{}
+	for rows.Next() {
+		d := &OutboxDelivery{}
+		if err := outboxCols.scan(rows, d.scanTargets()); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RequeueDeadLetter gives a dead-lettered delivery a fresh set of attempts,
+// starting now. returns ErrNotFound if there isn't a dead delivery with id
+func RequeueDeadLetter(db *sql.DB, id int64, now time.Time) (*OutboxDelivery, error) {
+	d := &OutboxDelivery{}
+	err := outboxCols.scan(db.QueryRow("update outbox set status = $2, attempts = 0, next_attempt = $3 where id = $1 and status = $4 returning "+outboxCols.String(),
+		id, outboxPending, now.Round(time.Second).In(time.UTC), outboxDead), d.scanTargets())
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return d, checkWriteErr(err)
+}
+
+// outboxWorker sends the deliveries for one destination type
+type outboxWorker struct {
+	db          *sql.DB
+	destination string
+	send        func(d *OutboxDelivery) error
+	// breakers by destination host
+	breakers map[string]*circuitBreaker
+	now      func() time.Time
+}
+
+func newOutboxWorker(db *sql.DB, destination string, send func(d *OutboxDelivery) error) *outboxWorker {
+	return &outboxWorker{
+		db:          db,
+		destination: destination,
+		send:        send,
+		breakers:    map[string]*circuitBreaker{},
+		now:         time.Now,
+	}
+}
+
+// runOutbox starts a worker for every destination type
+func runOutbox(db *sql.DB) {
+	for destination, send := range outboxSenders {
+		go newOutboxWorker(db, destination, send).run()
+	}
+}
+
+// run sends deliveries as they come due
+func (w *outboxWorker) run() {
+	for {
+		claimed, err := w.deliverNext()
+		if err != nil {
+			log.Infof("outbox: error delivering to %s: %s", w.destination, err.Error())
+		}
+		if !claimed || err != nil {
+			time.Sleep(outboxPollInterval)
+		}
+	}
+}
+
+// claim takes the oldest due delivery, pushing it's next attempt back by
+// outboxClaimTimeout so no other worker takes it while it's sent. returns
+// nil if nothing's due
+func (w *outboxWorker) claim(now time.Time) (*OutboxDelivery, error) {
+	d := &OutboxDelivery{}
+	err := outboxCols.scan(w.db.QueryRow(`update outbox set attempts = attempts + 1, next_attempt = $4
+		where id = (select id from outbox where destination = $1 and status = $2 and next_attempt <= $3 order by next_attempt, id limit 1)
+		and status = $2 and next_attempt <= $3 returning `+outboxCols.String(),
+		w.destination, outboxPending, now.In(time.UTC), now.Add(outboxClaimTimeout).Round(time.Second).In(time.UTC)), d.scanTargets())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return d, err
+}
+
+// breaker returns the breaker for a delivery's host
+func (w *outboxWorker) breaker(d *OutboxDelivery) *circuitBreaker {
+	host := d.Target
+	if u, err := url.Parse(d.Target); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	b := w.breakers[host]
+	if b == nil {
+		b = newCircuitBreaker(outboxBreakerThreshold, outboxBreakerCooldown)
+		w.breakers[host] = b
+	}
+	return b
+}
+
+// deliverNext claims & sends the oldest due delivery, reporting weather there was one
+func (w *outboxWorker) deliverNext() (bool, error) {
+	now := w.now()
+	d, err := w.claim(now)
+	if err != nil || d == nil {
+		return false, err
+	}
+	stat := func(key string, delta int64) { outboxStats.Add(w.destination+"."+key, delta) }
+
+	b := w.breaker(d)
+	if ok, retry := b.allow(now); !ok {
+		// put off without using up an attempt
+		_, err := w.db.Exec("update outbox set attempts = attempts - 1, next_attempt = $2 where id = $1", d.Id, retry.Round(time.Second).In(time.UTC))
+		stat("deferred", 1)
+		return true, err
+	}
+
+	sent := time.Now()
+	if sendErr := w.send(d); sendErr != nil {
+		stat("failed", 1)
+		if b.failure(now) {
+			stat("breakerOpened", 1)
+			log.Infof("outbox: %s deliveries to %s failed %d times in a row, pausing them for %s", w.destination, d.Target, b.failures, outboxBreakerCooldown)
+		}
+		status, next := outboxPending, now.Add(backoff(d.Attempts, outboxBackoffBase, outboxBackoffMax))
+		if d.Attempts >= outboxMaxAttempts {
+			status = outboxDead
+			stat("deadLettered", 1)
+			log.Infof("outbox: dead-lettering %s delivery %d to %s after %d attempts: %s", w.destination, d.Id, d.Target, d.Attempts, sendErr.Error())
+		}
+		_, err := w.db.Exec("update outbox set status = $2, next_attempt = $3, last_error = $4 where id = $1",
+			d.Id, status, next.Round(time.Second).In(time.UTC), sendErr.Error())
+		return true, err
+	}
+
+	b.success()
+	delivered := now.Round(time.Second).In(time.UTC)
+	stat("delivered", 1)
+	stat("sendMicros", int64(time.Since(sent)/time.Microsecond))
+	stat("latencyMicros", int64(delivered.Sub(d.Created)/time.Microsecond))
+	_, err = w.db.Exec("update outbox set status = $2, delivered = $3, last_error = '' where id = $1", d.Id, outboxDelivered, delivered)
+	return true, err
+}
+
+// OutboxDeadLettersAction lists dead-lettered deliveries for moderators
+type OutboxDeadLettersAction struct {
+	ReqAction
+	pageRequest
+	clientAction
+	Token string `json:"token"`
+	// only list deliveries to this destination type, if set
+	Destination string `json:"destination"`
+}
+
+func (OutboxDeadLettersAction) Type() string        { return "OUTBOX_DEAD_LETTERS_REQUEST" }
+func (OutboxDeadLettersAction) SuccessType() string { return "OUTBOX_DEAD_LETTERS_SUCCESS" }
+func (OutboxDeadLettersAction) FailureType() string { return "OUTBOX_DEAD_LETTERS_FAILURE" }
+
+func (OutboxDeadLettersAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &OutboxDeadLettersAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *OutboxDeadLettersAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrNotModerator.Error(),
+		}
+	}
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	deliveries, err := ReadDeadLetters(svc.DB, a.Destination, a.fetch(), a.offset)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "OUTBOX_DELIVERY_ARRAY",
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      newPage(&a.pageRequest, deliveries),
+	}
+}
+
+// RequeueDeadLetterAction requeues a dead-lettered delivery
+type RequeueDeadLetterAction struct {
+	ReqAction
+	clientAction
+	Token string `json:"token"`
+	Id    int64  `json:"id"`
+}
+
+func (RequeueDeadLetterAction) Type() string        { return "OUTBOX_REQUEUE_REQUEST" }
+func (RequeueDeadLetterAction) SuccessType() string { return "OUTBOX_REQUEUE_SUCCESS" }
+func (RequeueDeadLetterAction) FailureType() string { return "OUTBOX_REQUEUE_FAILURE" }
+
+func (RequeueDeadLetterAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &RequeueDeadLetterAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *RequeueDeadLetterAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrNotModerator.Error(),
+		}
+	}
+
+	d, err := RequeueDeadLetter(svc.DB, a.Id, time.Now())
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "dead letter", strconv.FormatInt(a.Id, 10))
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "OUTBOX_DELIVERY",
+		Data:      d,
+	}
+}
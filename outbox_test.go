@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhook is a webhook that counts deliveries by idempotency key
+type testWebhook struct {
+	*httptest.Server
+	sync.Mutex
+	status     int
+	deliveries map[string]int
+}
+
+func newTestWebhook() *testWebhook {
+	h := &testWebhook{status: http.StatusOK, deliveries: map[string]int{}}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Lock()
+		defer h.Unlock()
+		h.deliveries[r.Header.Get("Idempotency-Key")]++
+		w.WriteHeader(h.status)
+	}))
+	return h
+}
+
+func (h *testWebhook) setStatus(status int) {
+	h.Lock()
+	defer h.Unlock()
+	h.status = status
+}
+
+func (h *testWebhook) count() (deliveries int, keys int) {
+	h.Lock()
+	defer h.Unlock()
+	for _, n := range h.deliveries {
+		deliveries += n
+	}
+	return deliveries, len(h.deliveries)
+}
+
+// drainOutbox delivers everything due, returning the number of deliveries claimed
+func drainOutbox(t *testing.T, w *outboxWorker) int {
+	claimed := 0
+	for {
+		ok, err := w.deliverNext()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !ok {
+			return claimed
+		}
+		claimed++
+	}
+}
+
+func enqueueTestDelivery(t *testing.T, target string, commit bool, now time.Time) {
+	tx, err := appDB.Begin()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer tx.Rollback()
+	if err := enqueueOutbox(tx, outboxWebhook, target, map[string]string{"hello": "webhook"}, now); err != nil {
+		t.Fatal(err.Error())
+	}
+	if commit {
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestOutboxCrashRecovery(t *testing.T) {
+	defer resetTestData(appDB, "outbox")
+	if err := emptyTestData(appDB, "outbox"); err != nil {
+		t.Fatal(err.Error())
+	}
+	hook := newTestWebhook()
+	defer hook.Close()
+
+	now := time.Now().Round(time.Second)
+	worker := func(at time.Time) *outboxWorker {
+		w := newOutboxWorker(appDB, outboxWebhook, outboxSenders[outboxWebhook])
+		w.now = func() time.Time { return at }
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		enqueueTestDelivery(t, hook.URL, true, now)
+	}
+	// deliveries written by a change that's rolled back are never sent
+	enqueueTestDelivery(t, hook.URL, false, now)
+
+	// an instance claims a delivery, then dies before sending it
+	if d, err := worker(now).claim(now); err != nil || d == nil {
+		t.Fatalf("expected to claim a delivery, got: %v %v", d, err)
+	}
+
+	// after a restart the rest are delivered, but the claimed one waits out it's claim
+	if n := drainOutbox(t, worker(now)); n != 2 {
+		t.Errorf("expected 2 deliveries after a restart, got: %d", n)
+	}
+	if n := drainOutbox(t, worker(now.Add(outboxClaimTimeout+time.Second))); n != 1 {
+		t.Errorf("expected the claimed delivery once it's claim ran out, got: %d", n)
+	}
+	// & nothing is sent twice by another restart
+	if n := drainOutbox(t, worker(now.Add(time.Hour))); n != 0 {
+		t.Errorf("expected delivered deliveries not to be resent, got: %d", n)
+	}
+
+	if deliveries, keys := hook.count(); deliveries != 3 || keys != 3 {
+		t.Errorf("expected 3 deliveries, each sent once, got: %d sends of %d deliveries", deliveries, keys)
+	}
+	var pending int
+	if err := appDB.QueryRow("select count(1) from outbox where status != $1", outboxDelivered).Scan(&pending); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pending != 0 {
+		t.Errorf("expected every delivery to be delivered, %d aren't", pending)
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	defer resetTestData(appDB, "outbox")
+	if err := emptyTestData(appDB, "outbox"); err != nil {
+		t.Fatal(err.Error())
+	}
+	hook := newTestWebhook()
+	defer hook.Close()
+	hook.setStatus(http.StatusInternalServerError)
+
+	now := time.Now().Round(time.Second)
+	w := newOutboxWorker(appDB, outboxWebhook, outboxSenders[outboxWebhook])
+	w.now = func() time.Time { return now }
+
+	// deliveries to a host who's breaker is open are put off without using an attempt
+	u, _ := url.Parse(hook.URL)
+	open := newCircuitBreaker(1, time.Hour)
+	open.failure(now)
+	w.breakers[u.Host] = open
+	enqueueTestDelivery(t, hook.URL, true, now)
+	if n := drainOutbox(t, w); n != 1 {
+		t.Fatalf("expected the delivery to be claimed, got: %d", n)
+	}
+	if deliveries, _ := hook.count(); deliveries != 0 {
+		t.Errorf("expected no sends while the breaker is open, got: %d", deliveries)
+	}
+	var attempts int
+	var next time.Time
+	if err := appDB.QueryRow("select attempts, next_attempt from outbox").Scan(&attempts, &next); err != nil {
+		t.Fatal(err.Error())
+	}
+	if attempts != 0 || !next.Equal(now.Add(time.Hour).In(time.UTC)) {
+		t.Errorf("expected the delivery to wait for the breaker without using an attempt, got: %d attempts, next at %s", attempts, next)
+	}
+	delete(w.breakers, u.Host)
+
+	// failing sends are retried until they're dead-lettered
+	for i := 0; i < outboxMaxAttempts; i++ {
+		now = now.Add(outboxBackoffMax + outboxBreakerCooldown + time.Hour)
+		if n := drainOutbox(t, w); n != 1 {
+			t.Fatalf("attempt %d expected the delivery to be retried, got: %d", i+1, n)
+		}
+	}
+	now = now.Add(outboxBackoffMax + outboxBreakerCooldown + time.Hour)
+	if n := drainOutbox(t, w); n != 0 {
+		t.Errorf("expected dead letters not to be retried, got: %d", n)
+	}
+	if deliveries, _ := hook.count(); deliveries != outboxMaxAttempts {
+		t.Errorf("expected %d sends, got: %d", outboxMaxAttempts, deliveries)
+	}
+
+	svc := newTestService()
+	svc.Config.ModerationToken = "matrix"
+	client := &Client{svc: svc}
+	res := client.HandleRequestAction(OutboxDeadLettersAction{}.Type(), "req", false, "", json.RawMessage(`{"token":"matrix","destination":"webhook"}`))
+	dead, ok := res.Data.([]*OutboxDelivery)
+	if !ok || len(dead) != 1 || dead[0].Status != outboxDead || dead[0].Attempts != outboxMaxAttempts || dead[0].LastError != "webhook responded 500" {
+		t.Fatalf("expected the dead letter, got: %v %s", res.Data, res.Error)
+	}
+
+	// requeued deliveries get a fresh set of attempts
+	if res := client.HandleRequestAction(RequeueDeadLetterAction{}.Type(), "req", false, "", json.RawMessage(`{"token":"wrong","id":1}`)); res.Error != ErrNotModerator.Error() {
+		t.Errorf("expected an invalid token to be refused, got: %q", res.Error)
+	}
+	if res := client.HandleRequestAction(RequeueDeadLetterAction{}.Type(), "req", false, "", json.RawMessage(`{"token":"matrix","id":-1}`)); res.Code != notFoundErrCode {
+		t.Errorf("expected requeuing a missing dead letter to be not found, got: %q", res.Code)
+	}
+	data, _ := json.Marshal(map[string]interface{}{"token": "matrix", "id": dead[0].Id})
+	res = client.HandleRequestAction(RequeueDeadLetterAction{}.Type(), "req", false, "", data)
+	if d, ok := res.Data.(*OutboxDelivery); !ok || d.Status != outboxPending || d.Attempts != 0 {
+		t.Fatalf("expected the delivery to be requeued, got: %v %s", res.Data, res.Error)
+	}
+	hook.setStatus(http.StatusOK)
+	w = newOutboxWorker(appDB, outboxWebhook, outboxSenders[outboxWebhook])
+	w.now = func() time.Time { return time.Now().Add(time.Second) }
+	if n := drainOutbox(t, w); n != 1 {
+		t.Errorf("expected the requeued delivery to be sent, got: %d", n)
+	}
+	if deliveries, keys := hook.count(); deliveries != outboxMaxAttempts+1 || keys != 1 {
+		t.Errorf("expected every send to carry the same key, got: %d sends, %d keys", deliveries, keys)
+	}
+}
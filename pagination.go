@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Pagination
+//
+// List actions take the same paging fields & answer with a Page: a page of
+// items, & enough about where they sit in the list to ask for the next page.
+// pages are asked for by number, or by the cursor the page before returned as
+// nextCursor. cursors are opaque to clients, & take precedence over page
+// numbers. page sizes are clamped here, so every list has the same limits.
+//
+// Clients that said hello with a protocol version before pageProtocolVersion
+// are sent the bare item array with an _ARRAY schema, as they were before
+// pages. newer clients get the page with a _PAGE schema. paginatedActions lists
+// the actions that changed, & is reported in SERVER_INFO
+
+const (
+	// page size used when a request doesn't ask for one
+	defaultPageSize = 50
+	// largest page any list returns
+	maxPageSize = 100
+	// first protocol version list actions are answered with pages in
+	pageProtocolVersion = 11
+)
+
+// ErrInvalidCursor is returned for list requests with a cursor the server didn't issue
+var ErrInvalidCursor = fmt.Errorf("invalid page cursor")
+
+// pageRequest holds the paging fields list actions take
+type pageRequest struct {
+	// 1-indexed page number, ignored if cursor is set
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
+	Cursor   string `json:"cursor"`
+	// offset of the page in the list, set by window
+	offset int
+}
+
+// window clamps the page size & works out where the page starts. it must be
+// called before the page is read
+func (p *pageRequest) window() error {
+	if p.PageSize <= 0 {
+		p.PageSize = defaultPageSize
+	} else if p.PageSize > maxPageSize {
+		p.PageSize = maxPageSize
+	}
+	if p.Cursor != "" {
+		offset, err := strconv.Atoi(p.Cursor)
+		if err != nil || offset < 0 {
+			return ErrInvalidCursor
+		}
+		p.offset = offset
+		p.Page = offset/p.PageSize + 1
+		return nil
+	}
+	if p.Page < 1 {
+		p.Page = 1
+	}
+	p.offset = (p.Page - 1) * p.PageSize
+	return nil
+}
+
+// fetch is the number of items to read for a page: one more than it holds,
+// to tell if there's another page
+func (p *pageRequest) fetch() int {
+	return p.PageSize + 1
+}
+
+// Page is a page of a list
+type Page struct {
+	// a slice of the list's items
+	Items interface{} `json:"items"`
+	// items in the whole list, null when it isn't known without counting
+	Total *int `json:"total"`
+	// cursor of this page & the next, empty if there isn't a next page
+	Cursor     string `json:"cursor"`
+	NextCursor string `json:"nextCursor"`
+	PageSize   int    `json:"pageSize"`
+	HasMore    bool   `json:"hasMore"`
+}
+
+// newPage makes a page of items read with p.fetch() as the limit & p.offset as
+// the offset, dropping the extra item read to tell if there's another page
+func newPage(p *pageRequest, items interface{}) *Page {
+	v := reflect.ValueOf(items)
+	if v.Len() == 0 {
+		// empty lists are sent as [], not null
+		v = reflect.MakeSlice(v.Type(), 0, 0)
+	}
+	page := &Page{
+		Cursor:   strconv.Itoa(p.offset),
+		PageSize: p.PageSize,
+		HasMore:  v.Len() > p.PageSize,
+	}
+	if page.HasMore {
+		v = v.Slice(0, p.PageSize)
+		page.NextCursor = strconv.Itoa(p.offset + p.PageSize)
+	} else if v.Len() > 0 || p.offset == 0 {
+		// the last page knows where the list ends. pages past it don't
+		total := p.offset + v.Len()
+		page.Total = &total
+	}
+	page.Items = v.Interface()
+	return page
+}
+
+// slicePage makes a page of a list that's read whole
+func slicePage(p *pageRequest, items interface{}) *Page {
+	v := reflect.ValueOf(items)
+	start, end := p.offset, p.offset+p.fetch()
+	if start > v.Len() {
+		start = v.Len()
+	}
+	if end > v.Len() {
+		end = v.Len()
+	}
+	page := newPage(p, v.Slice(start, end).Interface())
+	total := v.Len()
+	page.Total = &total
+	return page
+}
+
+// wholePage makes a single page of a whole list, for lists the server pushes
+func wholePage(items interface{}) *Page {
+	n := reflect.ValueOf(items).Len()
+	return newPage(&pageRequest{PageSize: n}, items)
+}
+
+// filter replaces a page's items with the ones the requester can see. totals
+// would count hidden items, so filtered pages don't report one
+func (pg *Page) filter(items interface{}) *Page {
+	pg.Items = items
+	pg.Total = nil
+	return pg
+}
+
+// PaginatedAction is a list action answered with a Page since pageProtocolVersion
+type PaginatedAction struct {
+	Type string `json:"type"`
+	// schema of the page, & of the bare array older clients are sent
+	Schema      string `json:"schema"`
+	ItemsSchema string `json:"itemsSchema"`
+	Since       int    `json:"since"`
+}
+
+// paginatedActions are reported in SERVER_INFO
+var paginatedActions = func() []*PaginatedAction {
+	list := []*PaginatedAction{}
+	for _, a := range []struct {
+		action ClientAction
+		schema string
+	}{
+		{SearchReqAct{}, "SEARCH_RESULT_ARRAY"},
+		{FetchInboundLinksAct{}, "LINK_ARRAY"},
+		{FetchOutboundLinksAct{}, "LINK_ARRAY"},
+		{FetchRecentContentUrlsAction{}, "URL_ARRAY"},
+		{FetchPrimersAction{}, "PRIMER_ARRAY"},
+		{FetchSourcesAction{}, "SOURCE_ARRAY"},
+		{FetchSourceUrlsAction{}, "URL_ARRAY"},
+		{FetchSourceAttributedUrlsAction{}, "URL_ARRAY"},
+		{FetchCollectionsAction{}, "COLLECTION_ARRAY"},
+		{UserCollectionsAction{}, "COLLECTION_ARRAY"},
+		{CollectionItemsAction{}, "COLLECTION_ITEM_ARRAY"},
+		{MetadataByKeyRequest{}, "METADATA_ARRAY"},
+		{MetadataHistoryAction{}, "METADATA_ARRAY"},
+		{ModerationQueueAction{}, "MODERATION_CASE_ARRAY"},
+		{FetchSearchMatchesAction{}, "SAVED_SEARCH_MATCH_ARRAY"},
+		{TasksRequestAct{}, "TASK_ARRAY"},
+	} {
+		list = append(list, &PaginatedAction{
+			Type:        a.action.Type(),
+			Schema:      pageSchema(a.schema),
+			ItemsSchema: a.schema,
+			Since:       pageProtocolVersion,
+		})
+	}
+	return list
+}()
+
+// pageSchema is the schema of a page of items with an _ARRAY schema. page
+// schemas are returned as is, so responses can be prepared more than once
+func pageSchema(itemsSchema string) string {
+	if !strings.HasSuffix(itemsSchema, "_ARRAY") {
+		return itemsSchema
+	}
+	return strings.TrimSuffix(itemsSchema, "_ARRAY") + "_PAGE"
+}
+
+// pageResponse prepares a response carrying a page for a client, sending
+// clients that predate pages the bare item array
+func pageResponse(res *ClientResponse, protocol int) {
+	pg, ok := res.Data.(*Page)
+	if !ok {
+		return
+	}
+	if protocol < pageProtocolVersion {
+		res.Data = pg.Items
+		return
+	}
+	res.Schema = pageSchema(res.Schema)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPageWindow(t *testing.T) {
+	cases := []struct {
+		req                    pageRequest
+		page, pageSize, offset int
+		err                    error
+	}{
+		{pageRequest{}, 1, defaultPageSize, 0, nil},
+		{pageRequest{Page: 3, PageSize: 10}, 3, 10, 20, nil},
+		{pageRequest{Page: -1, PageSize: 10}, 1, 10, 0, nil},
+		{pageRequest{PageSize: 5000}, 1, maxPageSize, 0, nil},
+		// cursors take precedence over page numbers
+		{pageRequest{Page: 9, PageSize: 10, Cursor: "30"}, 4, 10, 30, nil},
+		{pageRequest{Cursor: "-10"}, 0, defaultPageSize, 0, ErrInvalidCursor},
+		{pageRequest{Cursor: "page two"}, 0, defaultPageSize, 0, ErrInvalidCursor},
+	}
+
+	for i, c := range cases {
+		p := c.req
+		if err := p.window(); err != c.err {
+			t.Errorf("case %d expected error %v, got: %v", i, c.err, err)
+			continue
+		}
+		if c.err != nil {
+			continue
+		}
+		if p.Page != c.page || p.PageSize != c.pageSize || p.offset != c.offset {
+			t.Errorf("case %d expected page %d, size %d, offset %d, got: %d, %d, %d", i, c.page, c.pageSize, c.offset, p.Page, p.PageSize, p.offset)
+		}
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	list := []string{"a", "b", "c", "d", "e"}
+	cases := []struct {
+		req        pageRequest
+		items      []string
+		hasMore    bool
+		nextCursor string
+		total      int
+	}{
+		// newPage is handed a page & one more item, if there is one
+		{pageRequest{PageSize: 2}, list[0:3], true, "2", -1},
+		{pageRequest{PageSize: 2, Cursor: "2"}, list[2:5], true, "4", -1},
+		{pageRequest{PageSize: 2, Cursor: "4"}, list[4:5], false, "", 5},
+		{pageRequest{PageSize: 2, Page: 4}, list[5:], false, "", -1},
+	}
+
+	for i, c := range cases {
+		p := c.req
+		if err := p.window(); err != nil {
+			t.Fatal(err.Error())
+		}
+		pg := newPage(&p, c.items)
+		if pg.HasMore != c.hasMore || pg.NextCursor != c.nextCursor {
+			t.Errorf("case %d expected hasMore %t & next cursor %q, got: %t %q", i, c.hasMore, c.nextCursor, pg.HasMore, pg.NextCursor)
+		}
+		if n := len(pg.Items.([]string)); n > p.PageSize {
+			t.Errorf("case %d expected at most %d items, got: %d", i, p.PageSize, n)
+		}
+		if c.total < 0 && pg.Total != nil {
+			t.Errorf("case %d expected no total, got: %d", i, *pg.Total)
+		} else if c.total >= 0 && (pg.Total == nil || *pg.Total != c.total) {
+			t.Errorf("case %d expected total %d, got: %v", i, c.total, pg.Total)
+		}
+	}
+
+	// pages of lists read whole know their total
+	p := &pageRequest{PageSize: 2, Page: 2}
+	p.window()
+	pg := slicePage(p, list)
+	if items := pg.Items.([]string); len(items) != 2 || items[0] != "c" || !pg.HasMore || pg.Total == nil || *pg.Total != 5 {
+		t.Errorf("unexpected slice page: %#v", pg)
+	}
+	p = &pageRequest{PageSize: 2, Page: 9}
+	p.window()
+	if data, _ := json.Marshal(slicePage(p, list).Items); string(data) != "[]" {
+		t.Errorf("expected pages past the end to be empty, got: %s", data)
+	}
+	if pg := pg.filter([]string{"c"}); pg.Total != nil {
+		t.Errorf("expected filtered pages not to report a total")
+	}
+}
+
+func TestPageResponse(t *testing.T) {
+	respond := func() *ClientResponse {
+		p := &pageRequest{}
+		p.window()
+		return &ClientResponse{Type: "COLLECTIONS_FETCH_SUCCESS", Schema: "COLLECTION_ARRAY", Data: newPage(p, []string{"a"})}
+	}
+
+	// clients that predate pages get the items
+	for _, protocol := range []int{0, pageProtocolVersion - 1} {
+		res := respond()
+		pageResponse(res, protocol)
+		if items, ok := res.Data.([]string); !ok || len(items) != 1 || res.Schema != "COLLECTION_ARRAY" {
+			t.Errorf("protocol %d: expected bare items, got: %s %#v", protocol, res.Schema, res.Data)
+		}
+	}
+
+	res := respond()
+	pageResponse(res, pageProtocolVersion)
+	pageResponse(res, pageProtocolVersion)
+	if _, ok := res.Data.(*Page); !ok || res.Schema != "COLLECTION_PAGE" {
+		t.Errorf("expected a page, got: %s %#v", res.Schema, res.Data)
+	}
+
+	// the protocol version a client says hello with decides
+	c := &Client{}
+	if c.protocolVersion() != 0 {
+		t.Errorf("expected clients that haven't said hello to speak protocol 0")
+	}
+	c.setProtocol(pageProtocolVersion)
+	if c.protocolVersion() != pageProtocolVersion {
+		t.Errorf("expected client protocol version %d, got: %d", pageProtocolVersion, c.protocolVersion())
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// The poll transport carries the same action envelopes as the websocket for
+// networks that block websocket upgrades. Actions are POSTed to /actions,
+// which returns the immediate response. Everything else the server sends
+// (archiving progress, presence, broadcasts) is queued in the session's outbox
+// & collected by long-polling /poll
+const (
+	// how long a poll waits for new messages before returning empty
+	pollWait = 25 * time.Second
+	// sessions that haven't made a request in this long are closed
+	pollSessionTimeout = 2 * time.Minute
+	// sessions that haven't made a request since the one that opened them are
+	// closed sooner, clients that don't send the session id back open one for
+	// every request
+	pollAbandonedTimeout = 30 * time.Second
+	// most open sessions for a single ip address
+	maxPollSessionsPerIP = 16
+	// most messages held for a session. sessions that fall further behind are
+	// closed, same as websocket clients that can't keep up
+	maxOutboxSize = 256
+	// header that carries the session id on /actions responses
+	pollSessionHeader = "X-Session"
+)
+
+// ErrTooManyPollSessions is returned opening a session for an ip address that
+// already has maxPollSessionsPerIP open
+var ErrTooManyPollSessions = fmt.Errorf("too many open sessions, please reuse your session id")
+
+// pollSession is a client connected over the poll transport
+type pollSession struct {
+	sync.Mutex
+	id     string
+	client *Client
+	// undelivered messages, oldest first
+	outbox []*outboxMessage
+	// sequence number of the last queued message
+	seq      int64
+	lastSeen time.Time
+	// weather the session has been used since the request that opened it
+	used   bool
+	closed bool
+	// closed & replaced each time a message is queued, waking waiting polls
+	wake chan struct{}
+}
+
+// outboxMessage is a queued server message
+type outboxMessage struct {
+	Seq  int64           `json:"seq"`
+	Data json.RawMessage `json:"data"`
+}
+
+// pollResponse is the body of a /poll response
+type pollResponse struct {
+	Messages []*outboxMessage `json:"messages"`
+}
+
+// pollSessions tracks open poll sessions by id
+type pollSessions struct {
+	sync.Mutex
+	sessions map[string]*pollSession
+}
+
+var polling = &pollSessions{sessions: map[string]*pollSession{}}
+
+// open starts a new session, registering it's client in a room. returns
+// ErrTooManyPollSessions if addr has too many sessions open
+func (p *pollSessions) open(hub *Room, addr string) (*pollSession, error) {
+	s := &pollSession{
+		id:       uuid.New(),
+		client:   &Client{id: uuid.New(), hub: hub, send: make(chan []byte, 256), addr: addr},
+		lastSeen: time.Now(),
+		wake:     make(chan struct{}),
+	}
+	p.Lock()
+	open := 0
+	for _, other := range p.sessions {
+		if other.client.addr == addr {
+			open++
+		}
+	}
+	if open >= maxPollSessionsPerIP {
+		p.Unlock()
+		return nil, ErrTooManyPollSessions
+	}
+	p.sessions[s.id] = s
+	p.Unlock()
+
+	hub.register <- s.client
+	go s.pump(p)
+	return s, nil
+}
+
+// get returns an open session by id, marking it as seen. nil if the session
+// doesn't exist or has closed
+func (p *pollSessions) get(id string) *pollSession {
+	p.Lock()
+	s := p.sessions[id]
+	p.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.lastSeen = time.Now()
+	s.used = true
+	return s
+}
+
+func (p *pollSessions) remove(id string) {
+	p.Lock()
+	delete(p.sessions, id)
+	p.Unlock()
+}
+
+// run closes sessions that have stopped polling
+func (p *pollSessions) run() {
+	for now := range time.Tick(pollAbandonedTimeout / 3) {
+		p.expire(now.Add(-pollSessionTimeout), now.Add(-pollAbandonedTimeout))
+	}
+}
+
+// expire unregisters sessions last seen before cutoff, & sessions that haven't
+// been used since they were opened before abandoned. sessions are removed
+// once the room lets go of their client
+func (p *pollSessions) expire(cutoff, abandoned time.Time) {
+	p.Lock()
+	stale := []*pollSession{}
+	for _, s := range p.sessions {
+		s.Lock()
+		if s.lastSeen.Before(cutoff) || !s.used && s.lastSeen.Before(abandoned) {
+			stale = append(stale, s)
+		}
+		s.Unlock()
+	}
+	p.Unlock()
+
+	for _, s := range stale {
+		s.client.hub.unregister <- s.client
+	}
+}
+
+// pump moves messages from the client's send channel into the outbox until
+// the room closes the channel
+func (s *pollSession) pump(p *pollSessions) {
+	for data := range s.client.send {
+		if !s.queue(data) {
+			s.client.hub.unregister <- s.client
+		}
+	}
+
+	s.Lock()
+	s.closed = true
+	close(s.wake)
+	s.Unlock()
+	p.remove(s.id)
+}
+
+// queue adds a message to the outbox, reporting false if the outbox is full
+func (s *pollSession) queue(data []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.outbox) >= maxOutboxSize {
+		return false
+	}
+	s.seq++
+	s.outbox = append(s.outbox, &outboxMessage{Seq: s.seq, Data: json.RawMessage(data)})
+	close(s.wake)
+	s.wake = make(chan struct{})
+	return true
+}
+
+// after returns queued messages with a sequence number above seq, along with
+// a channel that closes when more arrive. messages at or below seq have been
+// received by the client & are dropped
+func (s *pollSession) after(seq int64) ([]*outboxMessage, <-chan struct{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+	i := 0
+	for i < len(s.outbox) && s.outbox[i].Seq <= seq {
+		i++
+	}
+	s.outbox = s.outbox[i:]
+	msgs := make([]*outboxMessage, len(s.outbox))
+	copy(msgs, s.outbox)
+	return msgs, s.wake, s.closed
+}
+
+// serveActions handles action envelopes POSTed by poll transport clients.
+// requests without a known session open a new one, the session id is returned
+// in the X-Session header
+func serveActions(hub *Room, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		log.Info(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s := polling.get(r.URL.Query().Get("session"))
+	if s == nil {
+		if s, err = polling.open(hub, requestIP(r)); err != nil {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(pollAbandonedTimeout/time.Second)))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	w.Header().Set(pollSessionHeader, s.id)
+
+	res := s.client.dispatch(data)
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(meteredWriter{w, bandwidthServed}).Encode(res); err != nil {
+		log.Info(err.Error())
+	}
+}
+
+// servePoll returns a session's queued messages after the seq param, waiting
+// up to pollWait for messages if none are queued
+func servePoll(w http.ResponseWriter, r *http.Request) {
+	s := polling.get(r.URL.Query().Get("session"))
+	if s == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown session"})
+		return
+	}
+	seq, _ := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+
+	timeout := time.NewTimer(pollWait)
+	defer timeout.Stop()
+
+	var msgs []*outboxMessage
+	for {
+		var wake <-chan struct{}
+		var closed bool
+		msgs, wake, closed = s.after(seq)
+		if len(msgs) > 0 {
+			break
+		}
+		if closed {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		select {
+		case <-wake:
+			continue
+		case <-timeout.C:
+		case <-r.Context().Done():
+			return
+		}
+		break
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(meteredWriter{w, bandwidthServed}).Encode(&pollResponse{Messages: msgs}); err != nil {
+		log.Info(err.Error())
+	}
+}
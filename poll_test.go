@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollSessions(t *testing.T) {
+	hub := newRoom()
+	go hub.run()
+	p := &pollSessions{sessions: map[string]*pollSession{}}
+
+	opened := []*pollSession{}
+	for i := 0; i < maxPollSessionsPerIP; i++ {
+		s, err := p.open(hub, "10.0.0.1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		opened = append(opened, s)
+	}
+	if _, err := p.open(hub, "10.0.0.1"); err != ErrTooManyPollSessions {
+		t.Errorf("expected ErrTooManyPollSessions, got: %v", err)
+	}
+	if _, err := p.open(hub, "10.0.0.2"); err != nil {
+		t.Errorf("expected other ip addresses to open sessions, got: %v", err)
+	}
+
+	// sessions used after they were opened aren't abandoned
+	if p.get(opened[0].id) == nil {
+		t.Fatalf("expected open session to be found")
+	}
+	now := time.Now()
+	p.expire(now.Add(-pollSessionTimeout), now.Add(time.Second))
+
+	remaining := func() int {
+		p.Lock()
+		defer p.Unlock()
+		return len(p.sessions)
+	}
+	for deadline := time.Now().Add(time.Second); remaining() > 1 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if remaining() != 1 || p.get(opened[0].id) == nil {
+		t.Errorf("expected only the used session to remain, got %d sessions", remaining())
+	}
+	if _, err := p.open(hub, "10.0.0.1"); err != nil {
+		t.Errorf("expected closing abandoned sessions to make room, got: %v", err)
+	}
+}
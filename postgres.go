@@ -77,24 +77,12 @@ func initializeDatabase(db *sql.DB) error {
 	if err != nil {
 		return err
 	}
-
-	for _, cmd := range []string{
-		"drop-all",
-		"create-primers",
-		"create-sources",
-		"create-urls",
-		"create-links",
-		"create-metadata",
-		"create-snapshots",
-		"create-collections",
-		"create-archive_requests",
-		"create-uncrawlables",
-		"create-collection_items",
-	} {
-		if _, err := schema.Exec(db, cmd); err != nil {
-			fmt.Println(cmd, "error:", err)
-			return err
-		}
+	if _, err := schema.Exec(db, "drop-all"); err != nil {
+		fmt.Println("drop-all error:", err)
+		return err
+	}
+	if err := migrateDatabase(db); err != nil {
+		return err
 	}
 
 	if err := insertTestData(
@@ -131,3 +119,76 @@ func insertTestData(db *sql.DB, tables ...string) error {
 	}
 	return nil
 }
+
+// schemaCreateCmds are the commands in sql/schema.sql that create tables &
+// their indexes, ordered so tables are created before tables that reference them
+var schemaCreateCmds = []string{
+	"create-primers",
+	"create-sources",
+	"create-urls",
+	"create-links",
+	"create-metadata",
+	"create-snapshots",
+	"create-collections",
+	"create-archive_requests",
+	"create-config_snapshots",
+	"create-fetch_forensics",
+	"create-reconcile_jobs",
+	"create-source_memberships",
+	"create-membership_changes",
+	"create-moderation_cases",
+	"create-content_reports",
+	"create-moderation_log",
+	"create-meta_fields",
+	"create-erase_jobs",
+	"create-feature_flags",
+	"create-feature_flag_overrides",
+	"create-relations",
+	"create-link_sightings",
+	"create-link_events",
+	"create-fetch_recordings",
+	"create-fetch_exchanges",
+	"create-leases",
+	"create-saved_searches",
+	"create-saved_search_matches",
+	"create-bandwidth",
+	"create-hash_aliases",
+	"create-rehash_jobs",
+	"create-capture_retention",
+	"create-collection_access",
+	"create-collection_changes",
+	"create-chain_health_runs",
+	"create-api_keys",
+	"create-api_key_log",
+	"create-hook_archives",
+	"create-render_cards",
+	"create-render_favicons",
+	"create-user_exports",
+	"create-announcements",
+	"create-announcement_dismissals",
+	"create-idle_verifications",
+	"create-capture_notes",
+	"create-user_actions",
+	"create-outbox",
+	"create-meta_key_renames",
+	"create-cache_snapshots",
+	"create-uncrawlables",
+	"create-collection_items",
+}
+
+// migrateDatabase creates the tables, columns & indexes in sql/schema.sql the
+// database doesn't have. every command is "if not exists", so it's safe to run
+// against an up-to-date database. columns added to tables that predate them are
+// added with an ALTER TABLE after the table's CREATE TABLE
+func migrateDatabase(db *sql.DB) error {
+	schema, err := dotsql.LoadFromFile(packagePath("/sql/schema.sql"))
+	if err != nil {
+		return err
+	}
+	for _, cmd := range schemaCreateCmds {
+		if _, err := schema.Exec(db, cmd); err != nil {
+			return fmt.Errorf("%s: %s", cmd, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// editors that haven't sent a heartbeat within this window are dropped
+	editHeartbeatTimeout = 45 * time.Second
+	// max number of simultaneous editors tracked for a single subject
+	maxEditorsPerSubject = 16
+)
+
+var (
+	// ErrTooManyEditors is returned when a subject already has maxEditorsPerSubject editors
+	ErrTooManyEditors = fmt.Errorf("too many people are editing this subject, please try again later")
+	// ErrNotEditing is returned for heartbeats from editors that aren't registered,
+	// clients should respond by sending a new EDIT_START_REQUEST
+	ErrNotEditing = fmt.Errorf("not currently editing this subject")
+	// ErrEditorIdTaken is returned for requests using an editorId registered by
+	// someone else
+	ErrEditorIdTaken = fmt.Errorf("editorId is in use by another editor")
+)
+
+// Editor is a person with a metadata editor open for a subject
+type Editor struct {
+	// EditorId is chosen by the client & should be stable across reconnects
+	EditorId string `json:"editorId"`
+	// Display name, eg: "Alice"
+	Name     string    `json:"name"`
+	Started  time.Time `json:"started"`
+	LastSeen time.Time `json:"lastSeen"`
+	// connection the editor is currently using
+	client *Client
+	// identity of the client that started editing, "" if it didn't connect with
+	// an api key. other connections with the same identity can take over
+	owner string
+}
+
+// ownedBy reports weather c can act for an editor: it's the editor's connection,
+// or a connection authenticated as the same user
+func (e *Editor) ownedBy(c *Client) bool {
+	return e.client == c || (e.owner != "" && e.owner == c.identity())
+}
+
+// editingPresence tracks who is editing metadata for each subject. presence
+// is ephemeral & never persisted
+type editingPresence struct {
+	sync.Mutex
+	// subject hash -> editorId -> editor
+	subjects map[string]map[string]*Editor
+}
+
+// editing is the package-level editing presence tracker
+var editing = newEditingPresence()
+
+func newEditingPresence() *editingPresence {
+	return &editingPresence{subjects: map[string]map[string]*Editor{}}
+}
+
+// Start registers an editor for a subject. Starting with an editorId that's
+// already registered by the same user (eg: after a reconnect) takes over the
+// existing entry. changed reports weather the list of editors is different as a result
+func (p *editingPresence) Start(c *Client, subject, editorId, name string) (changed bool, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	editors := p.subjects[subject]
+	if e, ok := editors[editorId]; ok {
+		if !e.ownedBy(c) {
+			return false, ErrEditorIdTaken
+		}
+		changed = e.Name != name
+		e.Name = name
+		e.LastSeen = now
+		e.client = c
+		return changed, nil
+	}
+
+	if len(editors) >= maxEditorsPerSubject {
+		return false, ErrTooManyEditors
+	}
+	if editors == nil {
+		editors = map[string]*Editor{}
+		p.subjects[subject] = editors
+	}
+	editors[editorId] = &Editor{
+		EditorId: editorId,
+		Name:     name,
+		Started:  now,
+		LastSeen: now,
+		client:   c,
+		owner:    c.identity(),
+	}
+	return true, nil
+}
+
+// Heartbeat keeps an editor registered
+func (p *editingPresence) Heartbeat(c *Client, subject, editorId string) error {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.subjects[subject][editorId]
+	if !ok {
+		return ErrNotEditing
+	}
+	if !e.ownedBy(c) {
+		return ErrEditorIdTaken
+	}
+	e.LastSeen = time.Now()
+	e.client = c
+	return nil
+}
+
+// Stop removes an editor from a subject, reporting weather it was registered.
+// editors can only be stopped by their owner
+func (p *editingPresence) Stop(c *Client, subject, editorId string) (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.subjects[subject][editorId]
+	if !ok {
+		return false, nil
+	}
+	if !e.ownedBy(c) {
+		return false, ErrEditorIdTaken
+	}
+	p.delete(subject, editorId)
+	return true, nil
+}
+
+// Editors lists the current editors for a subject, ordered by start time
+func (p *editingPresence) Editors(subject string) []*Editor {
+	p.Lock()
+	defer p.Unlock()
+
+	editors := make([]*Editor, 0, len(p.subjects[subject]))
+	for _, e := range p.subjects[subject] {
+		cp := *e
+		cp.client = nil
+		editors = append(editors, &cp)
+	}
+	sort.Slice(editors, func(i, j int) bool { return editors[i].Started.Before(editors[j].Started) })
+	return editors
+}
+
+// clientGone removes all editors using a connection, returning the subjects that changed
+func (p *editingPresence) clientGone(c *Client) (subjects []string) {
+	p.Lock()
+	defer p.Unlock()
+	for subject, editors := range p.subjects {
+		for id, e := range editors {
+			if e.client == c {
+				p.delete(subject, id)
+				subjects = append(subjects, subject)
+			}
+		}
+	}
+	return
+}
+
+// expire removes editors that haven't been seen since before cutoff,
+// returning the subjects that changed
+func (p *editingPresence) expire(cutoff time.Time) (subjects []string) {
+	p.Lock()
+	defer p.Unlock()
+	for subject, editors := range p.subjects {
+		for id, e := range editors {
+			if e.LastSeen.Before(cutoff) {
+				p.delete(subject, id)
+				subjects = append(subjects, subject)
+			}
+		}
+	}
+	return
+}
+
+// delete an editor, must be called with the lock held
+func (p *editingPresence) delete(subject, editorId string) {
+	delete(p.subjects[subject], editorId)
+	if len(p.subjects[subject]) == 0 {
+		delete(p.subjects, subject)
+	}
+}
+
+// run periodically expires editors who've stopped sending heartbeats
+func (p *editingPresence) run() {
+	ticker := time.NewTicker(editHeartbeatTimeout / 3)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, subject := range p.expire(now.Add(-editHeartbeatTimeout)) {
+			announceEditors(subject, nil)
+		}
+	}
+}
+
+// handleClientGone is registered with the room to drop editors when their connection closes
+func (p *editingPresence) handleClientGone(c *Client) {
+	for _, subject := range p.clientGone(c) {
+		announceEditors(subject, nil)
+	}
+}
+
+// announceEditors sends the current list of editors to every client viewing a
+// subject, except the sender
+func announceEditors(subject string, sender *Client) {
+	if room == nil {
+		return
+	}
+	data, err := json.Marshal(&ClientResponse{
+		Type:      "EDITORS_CHANGED",
+		RequestId: "server",
+		Schema:    "EDITOR_ARRAY",
+		Id:        subject,
+		Data:      editing.Editors(subject),
+	})
+	if err != nil {
+		log.Info(err.Error())
+		return
+	}
+	room.publish <- &topicMessage{topic: subjectTopic(subject), sender: sender, data: data, event: "EDITORS_CHANGED", author: sender.requester()}
+}
+
+// EditStartAction announces that a client has opened a metadata editor for a subject
+type EditStartAction struct {
+	ReqAction
+	clientAction
+	Subject  string `json:"subject"`
+	EditorId string `json:"editorId"`
+	Name     string `json:"name"`
+}
+
+func (EditStartAction) Type() string        { return "EDIT_START_REQUEST" }
+func (EditStartAction) SuccessType() string { return "EDIT_START_SUCCESS" }
+func (EditStartAction) FailureType() string { return "EDIT_START_FAILURE" }
+
+func (EditStartAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &EditStartAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *EditStartAction) Exec() (res *ClientResponse) {
+	if a.Subject == "" || a.EditorId == "" {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     "subject and editorId are required",
+		}
+	}
+
+	if visible, err := a.canSee(a.Subject); err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	} else if !visible {
+		return notFoundResponse(a, a.RequestId, "content", a.Subject)
+	}
+
+	changed, err := editing.Start(a.client, a.Subject, a.EditorId, a.Name)
+	if err != nil {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	a.client.Subscribe(subjectTopic(a.Subject))
+	if changed {
+		announceEditors(a.Subject, a.client)
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "EDITOR_ARRAY",
+		Id:        a.Subject,
+		Data:      editing.Editors(a.Subject),
+	}
+}
+
+// EditHeartbeatAction keeps a client's editing presence alive
+type EditHeartbeatAction struct {
+	ReqAction
+	clientAction
+	Subject  string `json:"subject"`
+	EditorId string `json:"editorId"`
+}
+
+func (EditHeartbeatAction) Type() string        { return "EDIT_HEARTBEAT_REQUEST" }
+func (EditHeartbeatAction) SuccessType() string { return "EDIT_HEARTBEAT_SUCCESS" }
+func (EditHeartbeatAction) FailureType() string { return "EDIT_HEARTBEAT_FAILURE" }
+
+func (EditHeartbeatAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &EditHeartbeatAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *EditHeartbeatAction) Exec() (res *ClientResponse) {
+	if err := editing.Heartbeat(a.client, a.Subject, a.EditorId); err != nil {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Id:        a.Subject,
+	}
+}
+
+// EditStopAction announces that a client has closed a metadata editor
+type EditStopAction struct {
+	ReqAction
+	clientAction
+	Subject  string `json:"subject"`
+	EditorId string `json:"editorId"`
+}
+
+func (EditStopAction) Type() string        { return "EDIT_STOP_REQUEST" }
+func (EditStopAction) SuccessType() string { return "EDIT_STOP_SUCCESS" }
+func (EditStopAction) FailureType() string { return "EDIT_STOP_FAILURE" }
+
+func (EditStopAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &EditStopAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *EditStopAction) Exec() (res *ClientResponse) {
+	stopped, err := editing.Stop(a.client, a.Subject, a.EditorId)
+	if err != nil {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	if stopped {
+		announceEditors(a.Subject, a.client)
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Id:        a.Subject,
+	}
+}
+
+// SubjectSubscribeAction subscribes a client to activity for a subject, through
+// an optional filter. subscribing again replaces the filter
+type SubjectSubscribeAction struct {
+	ReqAction
+	clientAction
+	Subject string              `json:"subject"`
+	Filter  *SubscriptionFilter `json:"filter"`
+}
+
+func (SubjectSubscribeAction) Type() string        { return "SUBJECT_SUBSCRIBE_REQUEST" }
+func (SubjectSubscribeAction) SuccessType() string { return "SUBJECT_SUBSCRIBE_SUCCESS" }
+func (SubjectSubscribeAction) FailureType() string { return "SUBJECT_SUBSCRIBE_FAILURE" }
+
+func (SubjectSubscribeAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &SubjectSubscribeAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *SubjectSubscribeAction) Exec() (res *ClientResponse) {
+	// activity on hidden content is only sent to members
+	if visible, err := a.canSee(a.Subject); err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	} else if !visible {
+		return notFoundResponse(a, a.RequestId, "content", a.Subject)
+	}
+	filter, err := compileFilter(a.Filter, a.client.requester())
+	if err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	a.client.SubscribeFiltered(subjectTopic(a.Subject), filter)
+	// registered users watching a subject keep it's captures
+	if keyId := a.client.requester(); keyId != "" {
+		a.client.service().promoteCapturesFor(a.Subject, keyId)
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "EDITOR_ARRAY",
+		Id:        a.Subject,
+		Data:      editing.Editors(a.Subject),
+		Filter:    filter.Filter(),
+	}
+}
+
+// SubjectUnsubscribeAction stops sending a client activity for a subject
+type SubjectUnsubscribeAction struct {
+	ReqAction
+	clientAction
+	Subject string `json:"subject"`
+}
+
+func (SubjectUnsubscribeAction) Type() string        { return "SUBJECT_UNSUBSCRIBE_REQUEST" }
+func (SubjectUnsubscribeAction) SuccessType() string { return "SUBJECT_UNSUBSCRIBE_SUCCESS" }
+func (SubjectUnsubscribeAction) FailureType() string { return "SUBJECT_UNSUBSCRIBE_FAILURE" }
+
+func (SubjectUnsubscribeAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &SubjectUnsubscribeAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *SubjectUnsubscribeAction) Exec() (res *ClientResponse) {
+	a.client.Unsubscribe(subjectTopic(a.Subject))
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Id:        a.Subject,
+	}
+}
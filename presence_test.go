@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEditingPresence(t *testing.T) {
+	p := newEditingPresence()
+	alice, bob := &Client{apiKey: &ApiKey{KeyId: "alice_key"}}, &Client{}
+
+	if changed, err := p.Start(alice, "subject", "alice", "Alice"); err != nil || !changed {
+		t.Errorf("expected first start to change editors. changed: %t, err: %v", changed, err)
+	}
+	if changed, _ := p.Start(bob, "subject", "bob", "Bob"); !changed {
+		t.Errorf("expected second editor to change editors")
+	}
+	if editors := p.Editors("subject"); len(editors) != 2 || editors[0].EditorId != "alice" {
+		t.Errorf("expected two editors ordered by start. got: %v", editors)
+	}
+
+	// alice reconnects on a new connection & re-announces
+	aliceAgain := &Client{apiKey: &ApiKey{KeyId: "alice_key"}}
+	if changed, _ := p.Start(aliceAgain, "subject", "alice", "Alice"); changed {
+		t.Errorf("expected re-announcing an existing editor to not change editors")
+	}
+	// the old connection unregistering shouldn't remove alice
+	if subjects := p.clientGone(alice); len(subjects) != 0 {
+		t.Errorf("expected stale connection to not remove editors. removed from: %v", subjects)
+	}
+	if len(p.Editors("subject")) != 2 {
+		t.Errorf("expected two editors after reconnect")
+	}
+
+	// other connections can't use an editorId someone else registered
+	mallory := &Client{}
+	if _, err := p.Start(mallory, "subject", "alice", "Mallory"); err != ErrEditorIdTaken {
+		t.Errorf("expected start with another editor's id to error. got: %v", err)
+	}
+	if err := p.Heartbeat(mallory, "subject", "bob"); err != ErrEditorIdTaken {
+		t.Errorf("expected heartbeat for another editor to error. got: %v", err)
+	}
+	if stopped, err := p.Stop(mallory, "subject", "bob"); stopped || err != ErrEditorIdTaken {
+		t.Errorf("expected stop for another editor to error. stopped: %t, err: %v", stopped, err)
+	}
+	// anonymous editors can't be taken over from a new connection
+	if _, err := p.Start(&Client{}, "subject", "bob", "Bob"); err != ErrEditorIdTaken {
+		t.Errorf("expected start from a new anonymous connection to error. got: %v", err)
+	}
+
+	if subjects := p.clientGone(bob); len(subjects) != 1 {
+		t.Errorf("expected bob's connection closing to remove him")
+	}
+
+	if err := p.Heartbeat(bob, "subject", "bob"); err != ErrNotEditing {
+		t.Errorf("expected heartbeat from removed editor to error. got: %v", err)
+	}
+	if err := p.Heartbeat(aliceAgain, "subject", "alice"); err != nil {
+		t.Errorf("unexpected heartbeat error: %s", err)
+	}
+
+	if stopped, err := p.Stop(aliceAgain, "subject", "alice"); !stopped || err != nil {
+		t.Errorf("expected stop to remove alice")
+	}
+	if len(p.subjects) != 0 {
+		t.Errorf("expected empty subjects to be removed from presence map. got: %v", p.subjects)
+	}
+}
+
+func TestEditingPresenceExpire(t *testing.T) {
+	p := newEditingPresence()
+	p.Start(&Client{}, "a", "alice", "Alice")
+	p.Start(&Client{}, "b", "bob", "Bob")
+	p.subjects["a"]["alice"].LastSeen = time.Now().Add(-editHeartbeatTimeout * 2)
+
+	subjects := p.expire(time.Now().Add(-editHeartbeatTimeout))
+	if len(subjects) != 1 || subjects[0] != "a" {
+		t.Errorf("expected only subject a to expire. got: %v", subjects)
+	}
+	if len(p.Editors("b")) != 1 {
+		t.Errorf("expected bob to remain")
+	}
+}
+
+func TestEditingPresenceCap(t *testing.T) {
+	p := newEditingPresence()
+	for i := 0; i < maxEditorsPerSubject; i++ {
+		if _, err := p.Start(&Client{}, "subject", fmt.Sprintf("editor_%d", i), ""); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if _, err := p.Start(&Client{}, "subject", "one_too_many", ""); err != ErrTooManyEditors {
+		t.Errorf("expected ErrTooManyEditors, got: %v", err)
+	}
+	// existing editors can still re-announce
+	if _, err := p.Start(p.subjects["subject"]["editor_0"].client, "subject", "editor_0", ""); err != nil {
+		t.Errorf("unexpected error re-announcing at cap: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows up to limit events per key within a sliding window
+type rateLimiter struct {
+	sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: map[string][]time.Time{}}
+}
+
+// Allow records an event for key, reporting weather it's within the limit.
+// events that exceed the limit aren't recorded
+func (l *rateLimiter) Allow(key string) bool {
+	return l.allowAt(key, time.Now())
+}
+
+// allowAt records an event for key at now, see Allow
+func (l *rateLimiter) allowAt(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	cutoff := now.Add(-l.window)
+	hits := l.inWindow(key, cutoff)
+
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false
+	}
+	l.hits[key] = append(hits, now)
+
+	// keep the map from growing without bound by occasionally dropping idle keys
+	if len(l.hits) > 10000 {
+		for k, h := range l.hits {
+			if len(h) == 0 || h[len(h)-1].Before(cutoff) {
+				delete(l.hits, k)
+			}
+		}
+	}
+	return true
+}
+
+// inWindow returns the events recorded for key after cutoff, must be called with the lock held
+func (l *rateLimiter) inWindow(key string, cutoff time.Time) []time.Time {
+	hits := l.hits[key]
+	i := 0
+	for i < len(hits) && hits[i].Before(cutoff) {
+		i++
+	}
+	return hits[i:]
+}
+
+// peek counts the events recorded for key within the window as of now, &
+// returns when the earliest of them was recorded
+func (l *rateLimiter) peek(key string, now time.Time) (int, time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	hits := l.inWindow(key, now.Add(-l.window))
+	if len(hits) == 0 {
+		return 0, now
+	}
+	return len(hits), hits[0]
+}
+
+// unrecord removes the last event recorded for key at now, returning budget
+// spent on a request that was refused by something else
+func (l *rateLimiter) unrecord(key string, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	hits := l.hits[key]
+	for i := len(hits) - 1; i >= 0; i-- {
+		if hits[i].Equal(now) {
+			l.hits[key] = append(hits[:i:i], hits[i+1:]...)
+			return
+		}
+	}
+}
+
+// usage counts the events recorded for each key within the window as of now
+func (l *rateLimiter) usage(now time.Time) map[string]int {
+	l.Lock()
+	defer l.Unlock()
+	cutoff := now.Add(-l.window)
+	used := map[string]int{}
+	for key := range l.hits {
+		if n := len(l.inWindow(key, cutoff)); n > 0 {
+			used[key] = n
+		}
+	}
+	return used
+}
+
+// requestIP returns the ip address of an http request's remote end
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+const (
+	// number of urls checked per reconciliation batch
+	reconcileBatchSize = 500
+	// pause between batches so reconciliation doesn't monopolize the db
+	reconcileBatchDelay = 500 * time.Millisecond
+
+	// changes recorded in membership_changes
+	membershipAdded   = "added"
+	membershipRemoved = "removed"
+
+	// url meta key set on urls that don't fall under any subprimer. orphaned urls
+	// are flagged rather than deleted, and aren't fetched when following links
+	orphanedMetaKey = "orphaned"
+)
+
+// EventSourceUpdated is published when a subprimer (source) changes, it's
+// subject is the source id & it's data a *SourceUpdate
+const EventSourceUpdated = "SOURCE_UPDATED"
+
+// SourceUpdate describes a change to a subprimer (source)
+type SourceUpdate struct {
+	// SkipReconcile is set when memberships don't need reconciling for the
+	// change, because it can't affect them or the publisher reconciled them itself
+	SkipReconcile bool `json:"skipReconcile,omitempty"`
+}
+
+// eventSourceUpdate reads the source update from a SOURCE_UPDATED event.
+// events from other instances carry it as decoded JSON
+func eventSourceUpdate(e *Event) (*SourceUpdate, error) {
+	if u, ok := e.Data.(*SourceUpdate); ok {
+		return u, nil
+	}
+	u := &SourceUpdate{}
+	if e.Data == nil {
+		return u, nil
+	}
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, u)
+	return u, err
+}
+
+// publishSourceUpdated publishes EventSourceUpdated for a source that's been saved
+func (s *Service) publishSourceUpdated(sourceId string, skipReconcile bool) {
+	s.Publish(&Event{
+		Type:    EventSourceUpdated,
+		Subject: sourceId,
+		Data:    &SourceUpdate{SkipReconcile: skipReconcile},
+	})
+}
+
+// ErrReconcileRunning is returned when starting a job while another is running
+var ErrReconcileRunning = fmt.Errorf("a membership reconciliation job is already running")
+
+// reconcileJobs runs reconciliation jobs, one at a time
+var reconcileJobs = &jobKind{
+	name:       "membership reconciliation",
+	cols:       reconcileJobCols,
+	errRunning: ErrReconcileRunning,
+	delay:      reconcileBatchDelay,
+	reportType: "MEMBERSHIP_RECONCILE",
+	schema:     "RECONCILE_JOB",
+}
+
+func init() {
+	// source changes can alter which urls fall under it. every instance hears
+	// the event, only one will succeed in starting a job
+	addEventListener(func(e *Event) {
+		if e.Type != EventSourceUpdated || appDB == nil {
+			return
+		}
+		if u, err := eventSourceUpdate(e); err != nil {
+			log.Infof("error reading source update: %s", err.Error())
+		} else if u.SkipReconcile {
+			return
+		}
+		go func() {
+			if _, err := StartReconcileJob(appDB, e.Subject, nil); err != nil && err != ErrReconcileRunning {
+				log.Infof("error starting membership reconciliation: %s", err.Error())
+			}
+		}()
+	})
+}
+
+// ReconcileJob re-evaluates which subprimers (sources) every url belongs to.
+// jobs record their progress after each batch, so an interrupted job can be resumed
+type ReconcileJob struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// source whose change triggered the job, empty for manually started jobs
+	SourceId string `json:"sourceId"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	// last url processed, urls are processed in order
+	Cursor string `json:"cursor"`
+	// counts of urls checked, memberships added & removed, and urls newly flagged as orphaned
+	Checked  int `json:"checked"`
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Orphaned int `json:"orphaned"`
+
+	// client to send progress updates to, if any
+	client *Client
+	// source id -> config snapshot hash, changes are recorded with the snapshot that caused them
+	snapshots map[string]string
+	matcher   *sourceMatcher
+}
+
+// sourceMatcher matches urls against source url patterns, using the same
+// case-insensitive containment rule as ValidArchivingUrl
+type sourceMatcher struct {
+	ids      []string
+	patterns []string
+}
+
+func newSourceMatcher(sources []*core.Source) *sourceMatcher {
+	m := &sourceMatcher{}
+	for _, s := range sources {
+		if s.Url == "" {
+			continue
+		}
+		m.ids = append(m.ids, s.Id)
+		m.patterns = append(m.patterns, strings.ToLower(s.Url))
+	}
+	return m
+}
+
+// Match returns the ids of all sources a url falls under
+func (m *sourceMatcher) Match(url string) (ids []string) {
+	url = strings.ToLower(url)
+	for i, p := range m.patterns {
+		if strings.Contains(url, p) {
+			ids = append(ids, m.ids[i])
+		}
+	}
+	return
+}
+
+// StartReconcileJob creates & runs a reconciliation job in the background.
+// progress is reported to c if it's not nil
+func StartReconcileJob(db *sql.DB, sourceId string, c *Client) (*ReconcileJob, error) {
+	j, err := createReconcileJob(db, sourceId, c)
+	if err != nil {
+		return nil, err
+	}
+	// return a copy, the job is modified as it runs
+	cp := *j
+	go reconcileJobs.run(db, j)
+	return &cp, nil
+}
+
+// createReconcileJob records a new running job, returning ErrReconcileRunning
+// if another job is running
+func createReconcileJob(db *sql.DB, sourceId string, c *Client) (*ReconcileJob, error) {
+	// a partial unique index on status allows only one running job at a time
+	j := &ReconcileJob{SourceId: sourceId, client: c}
+	if err := reconcileJobs.create(db, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// reconcileJobCols are the columns of reconcile_jobs
+var reconcileJobCols = &columnSet{
+	table:   "reconcile_jobs",
+	columns: []string{"id", "created", "updated", "source_id", "status", "error", "cursor", "checked", "added", "removed", "orphaned"},
+}
+
+// scanTargets maps reconcileJobCols to the job's fields
+func (j *ReconcileJob) scanTargets() scanTargets {
+	return scanTargets{
+		"id":        &j.Id,
+		"created":   &j.Created,
+		"updated":   &j.Updated,
+		"source_id": &j.SourceId,
+		"status":    &j.Status,
+		"error":     &j.Error,
+		"cursor":    &j.Cursor,
+		"checked":   &j.Checked,
+		"added":     &j.Added,
+		"removed":   &j.Removed,
+		"orphaned":  &j.Orphaned,
+	}
+}
+
+// resumeReconcileJobs restarts a reconciliation job the instance running it
+// stopped before it finished
+func resumeReconcileJobs(db *sql.DB) {
+	reconcileJobs.resume(db, &ReconcileJob{})
+}
+
+// prepare compiles source patterns & snapshots each source's config
+func (j *ReconcileJob) prepare(db *sql.DB) error {
+	sources := []*core.Source{}
+	for offset := 0; ; offset += 100 {
+		page, err := core.ListSources(store, 100, offset)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, page...)
+		if len(page) < 100 {
+			break
+		}
+	}
+
+	j.matcher = newSourceMatcher(sources)
+	j.snapshots = map[string]string{}
+	for _, s := range sources {
+		snap, err := SnapshotSource(db, s)
+		if err != nil {
+			return err
+		}
+		j.snapshots[s.Id] = snap.Hash
+	}
+	return nil
+}
+
+// batch reconciles the next batch of urls, reporting weather all urls are done.
+// the first batch a job runs prepares it
+func (j *ReconcileJob) batch(db *sql.DB) (done bool, err error) {
+	if j.matcher == nil {
+		if err := j.prepare(db); err != nil {
+			return false, err
+		}
+	}
+
+	rows, err := db.Query("select url, coalesce(meta->>'orphaned', '') = 'true' from urls where url > $1 order by url limit $2", j.Cursor, reconcileBatchSize)
+	if err != nil {
+		return false, err
+	}
+	orphaned := map[string]bool{}
+	urls := []string{}
+	for rows.Next() {
+		var url string
+		var o bool
+		if err := rows.Scan(&url, &o); err != nil {
+			rows.Close()
+			return false, err
+		}
+		urls = append(urls, url)
+		orphaned[url] = o
+	}
+	rows.Close()
+	if len(urls) == 0 {
+		return true, nil
+	}
+
+	// urls are ordered, so existing memberships for the batch are a range
+	last := urls[len(urls)-1]
+	current, err := readMemberships(db, j.Cursor, last)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	// count into a copy so a failed batch doesn't change the job's counts
+	counts := *j
+	for _, url := range urls {
+		if err := counts.reconcileUrl(tx, url, current[url], orphaned[url]); err != nil {
+			tx.Rollback()
+			return false, checkWriteErr(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, checkWriteErr(err)
+	}
+
+	j.Checked, j.Added, j.Removed, j.Orphaned = counts.Checked, counts.Added, counts.Removed, counts.Orphaned
+	j.Cursor = last
+	return len(urls) < reconcileBatchSize, nil
+}
+
+// reconcileUrl brings a single url's memberships in line with the compiled patterns
+func (j *ReconcileJob) reconcileUrl(tx *sql.Tx, url string, current map[string]bool, orphaned bool) error {
+	j.Checked++
+	now := time.Now().Round(time.Second).In(time.UTC)
+	want := map[string]bool{}
+	for _, id := range j.matcher.Match(url) {
+		want[id] = true
+		if current[id] {
+			continue
+		}
+		if _, err := tx.Exec("insert into source_memberships (url,source_id,snapshot,created) values ($1, $2, $3, $4)", url, id, j.snapshots[id], now); err != nil {
+			return err
+		}
+		if err := j.recordChange(tx, url, id, membershipAdded, now); err != nil {
+			return err
+		}
+		j.Added++
+	}
+
+	for id := range current {
+		if want[id] {
+			continue
+		}
+		if _, err := tx.Exec("delete from source_memberships where url = $1 and source_id = $2", url, id); err != nil {
+			return err
+		}
+		if err := j.recordChange(tx, url, id, membershipRemoved, now); err != nil {
+			return err
+		}
+		j.Removed++
+	}
+
+	if len(want) == 0 && !orphaned {
+		if _, err := tx.Exec(`update urls set meta = (coalesce(meta::jsonb, '{}'::jsonb) || '{"orphaned":true}'::jsonb)::json where url = $1`, url); err != nil {
+			return err
+		}
+		j.Orphaned++
+	} else if len(want) > 0 && orphaned {
+		if _, err := tx.Exec("update urls set meta = (meta::jsonb - 'orphaned')::json where url = $1", url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *ReconcileJob) recordChange(tx *sql.Tx, url, sourceId, change string, created time.Time) error {
+	// sources that have been removed entirely have no snapshot
+	_, err := tx.Exec("insert into membership_changes (created,job_id,url,source_id,change,snapshot) values ($1, $2, $3, $4, $5, $6)",
+		created, j.Id, url, sourceId, change, j.snapshots[sourceId])
+	return err
+}
+
+// readMemberships reads source memberships for urls in the range (after, through]
+func readMemberships(db *sql.DB, after, through string) (map[string]map[string]bool, error) {
+	rows, err := db.Query("select url, source_id from source_memberships where url > $1 and url <= $2", after, through)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	m := map[string]map[string]bool{}
+	for rows.Next() {
+		var url, id string
+		if err := rows.Scan(&url, &id); err != nil {
+			return nil, err
+		}
+		if m[url] == nil {
+			m[url] = map[string]bool{}
+		}
+		m[url][id] = true
+	}
+	return m, nil
+}
+
+// summary describes the job's counts for logs
+func (j *ReconcileJob) summary() string {
+	return fmt.Sprintf("checked: %d, added: %d, removed: %d, orphaned: %d", j.Checked, j.Added, j.Removed, j.Orphaned)
+}
+
+// reportTo is the client that started the job, if any
+func (j *ReconcileJob) reportTo() *Client {
+	return j.client
+}
+
+// isOrphaned checks if a url has been flagged as not belonging to any subprimer
+func isOrphaned(u *core.Url) bool {
+	return u.Meta[orphanedMetaKey] == true
+}
+
+// ReconcileMembershipAction manually starts a membership reconciliation job,
+// it requires a moderation token
+type ReconcileMembershipAction struct {
+	ReqAction
+	clientAction
+	Token string `json:"token"`
+	// optional source that changed
+	SourceId string `json:"sourceId"`
+}
+
+func (ReconcileMembershipAction) Type() string        { return "MEMBERSHIP_RECONCILE_REQUEST" }
+func (ReconcileMembershipAction) SuccessType() string { return "MEMBERSHIP_RECONCILE_SUCCESS" }
+func (ReconcileMembershipAction) FailureType() string { return "MEMBERSHIP_RECONCILE_FAILURE" }
+
+func (ReconcileMembershipAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &ReconcileMembershipAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *ReconcileMembershipAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrNotModerator.Error()}
+	}
+
+	j, err := StartReconcileJob(svc.DB, a.SourceId, a.client)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "RECONCILE_JOB",
+		Id:        j.Id,
+		Data:      j,
+	}
+}
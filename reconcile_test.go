@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/datatogether/core"
+)
+
+func TestSourceMatcher(t *testing.T) {
+	m := newSourceMatcher([]*core.Source{
+		{Id: "epa", Url: "www.epa.gov"},
+		{Id: "haps", Url: "www.epa.gov/haps"},
+		{Id: "census", Url: "www.Census.gov"},
+		{Id: "empty", Url: ""},
+	})
+
+	cases := []struct {
+		url    string
+		expect []string
+	}{
+		{"http://www.epa.gov", []string{"epa"}},
+		{"http://www.epa.gov/haps/index.html", []string{"epa", "haps"}},
+		{"https://WWW.CENSUS.GOV/data", []string{"census"}},
+		{"http://example.com", nil},
+	}
+
+	for i, c := range cases {
+		if got := m.Match(c.url); !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("case %d match mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestEventSourceUpdate(t *testing.T) {
+	cases := []struct {
+		data interface{}
+		skip bool
+	}{
+		{nil, false},
+		{&SourceUpdate{SkipReconcile: true}, true},
+		// events from other instances carry decoded JSON
+		{map[string]interface{}{"skipReconcile": true}, true},
+		{map[string]interface{}{}, false},
+	}
+
+	for i, c := range cases {
+		u, err := eventSourceUpdate(&Event{Type: EventSourceUpdated, Data: c.data})
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if u.SkipReconcile != c.skip {
+			t.Errorf("case %d expected skipReconcile %t, got: %t", i, c.skip, u.SkipReconcile)
+		}
+	}
+}
+
+func TestReconcileJob(t *testing.T) {
+	defer resetTestData(appDB, "urls", "config_snapshots", "reconcile_jobs", "source_memberships", "membership_changes")
+
+	j := &ReconcileJob{Id: "8b14f3d6-882f-4dd5-92f8-abaac220864f", Status: jobRunning}
+	if _, err := appDB.Exec("insert into reconcile_jobs (id,status) values ($1, $2)", j.Id, j.Status); err != nil {
+		t.Fatal(err.Error())
+	}
+	reconcileJobs.run(appDB, j)
+	if j.Status != jobComplete {
+		t.Fatalf("expected job to complete. status: %s, error: %s", j.Status, j.Error)
+	}
+
+	var count int
+	if err := appDB.QueryRow("select count(1) from source_memberships").Scan(&count); err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != j.Added {
+		t.Errorf("expected %d memberships, got %d", j.Added, count)
+	}
+
+	// imgur urls in test data don't fall under any source
+	u := &core.Url{Url: "https://i.imgur.com/LJf4LzX.jpg"}
+	if err := u.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !isOrphaned(u) {
+		t.Errorf("expected url outside all sources to be flagged as orphaned")
+	}
+
+	// running again with no changes should change nothing
+	again := &ReconcileJob{Id: "9c14f3d6-882f-4dd5-92f8-abaac220864f", Status: jobRunning}
+	if _, err := appDB.Exec("insert into reconcile_jobs (id,status) values ($1, $2)", again.Id, again.Status); err != nil {
+		t.Fatal(err.Error())
+	}
+	reconcileJobs.run(appDB, again)
+	if again.Added != 0 || again.Removed != 0 || again.Orphaned != 0 {
+		t.Errorf("expected second run to make no changes. got: %d added, %d removed, %d orphaned", again.Added, again.Removed, again.Orphaned)
+	}
+}
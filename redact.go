@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/datatogether/core"
+)
+
+// redactedValue replaces the value of sensitive query params when redacting in "mask" mode
+const redactedValue = "REDACTED"
+
+var (
+	// ErrUrlCredentials is returned for urls that contain userinfo credentials.
+	// these urls are refused outright, never stored
+	ErrUrlCredentials = fmt.Errorf("urls containing credentials (eg: user:password@host) cannot be archived")
+	// ErrInvalidArchivingUrl is returned for urls that can't be parsed. It deliberately
+	// doesn't echo the url back, as the url may contain sensitive info
+	ErrInvalidArchivingUrl = fmt.Errorf("invalid url")
+
+	// defaultRedactParams is the deny-list of query param names used when none are configured
+	defaultRedactParams = []string{"token", "key", "session", "auth"}
+)
+
+// urlRedactor strips or masks sensitive query parameters from urls before
+// they're written anywhere
+type urlRedactor struct {
+	// deny-listed param names, lowercase
+	names map[string]bool
+	// params with names matching any of these patterns are also redacted
+	patterns []*regexp.Regexp
+	// if true values are replaced with redactedValue, otherwise the param is removed
+	mask bool
+}
+
+// redactor is the package-level redactor, configured by initConfig
+var redactor = mustUrlRedactor(nil, nil, "")
+
+// newUrlRedactor creates a redactor from a deny-list of param names, a list of regex
+// patterns, and a mode of either "mask" or "strip". empty names uses defaultRedactParams
+func newUrlRedactor(names, patterns []string, mode string) (*urlRedactor, error) {
+	r := &urlRedactor{names: map[string]bool{}}
+
+	switch mode {
+	case "", "strip":
+	case "mask":
+		r.mask = true
+	default:
+		return nil, fmt.Errorf("invalid redaction mode: '%s', must be either 'strip' or 'mask'", mode)
+	}
+
+	// config reads an unset list as [""], which would match every param
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			r.names[strings.ToLower(name)] = true
+		}
+	}
+	if len(r.names) == 0 {
+		for _, name := range defaultRedactParams {
+			r.names[name] = true
+		}
+	}
+
+	for _, p := range patterns {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern '%s': %s", p, err.Error())
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	return r, nil
+}
+
+func mustUrlRedactor(names, patterns []string, mode string) *urlRedactor {
+	r, err := newUrlRedactor(names, patterns, mode)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// sensitive reports weather a query param name should be redacted. deny-listed names
+// match case-insensitively, either as the whole name or as a component of a
+// name delimited by "_", "-" or ".", so "key" matches both "KEY" and "api_key"
+func (r *urlRedactor) sensitive(name string) bool {
+	lower := strings.ToLower(name)
+	if r.names[lower] {
+		return true
+	}
+	for _, part := range strings.FieldsFunc(lower, func(c rune) bool { return c == '_' || c == '-' || c == '.' }) {
+		if r.names[part] {
+			return true
+		}
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact normalizes a url string, removing any sensitive query parameters & the
+// fragment (which can carry tokens in oauth-style flows). It returns the
+// redacted url & the names of any params that were redacted. Urls with userinfo
+// credentials are refused with ErrUrlCredentials. Errors never contain the input url.
+func (r *urlRedactor) Redact(rawurl string) (string, []string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil {
+		return "", nil, ErrInvalidArchivingUrl
+	}
+	// only absolute web urls can be archived
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", nil, ErrInvalidArchivingUrl
+	}
+	if u.User != nil {
+		return "", nil, ErrUrlCredentials
+	}
+
+	redacted := []string{}
+	if u.RawQuery != "" {
+		// work on the raw query to preserve param order & encoding
+		params := strings.Split(u.RawQuery, "&")
+		kept := make([]string, 0, len(params))
+		for _, param := range params {
+			rawName := param
+			if i := strings.IndexAny(param, "="); i >= 0 {
+				rawName = param[:i]
+			}
+			name, err := url.QueryUnescape(rawName)
+			if err != nil {
+				name = rawName
+			}
+
+			if !r.sensitive(name) {
+				kept = append(kept, param)
+				continue
+			}
+
+			redacted = append(redacted, name)
+			if r.mask {
+				kept = append(kept, rawName+"="+redactedValue)
+			}
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	normalized, err := core.NormalizeURLString(u.String())
+	if err != nil {
+		return "", nil, ErrInvalidArchivingUrl
+	}
+	return normalized, redacted, nil
+}
+
+// RedactArchivingUrl runs the package redactor on a url submitted for archiving
+func RedactArchivingUrl(rawurl string) (string, []string, error) {
+	return defaultService().RedactArchivingUrl(rawurl)
+}
+
+// RedactArchivingUrl runs the service's redactor on a url submitted for archiving.
+// urls rejected recently are rejected again without redacting, see archiveRejections
+func (s *Service) RedactArchivingUrl(rawurl string) (string, []string, error) {
+	if err := s.Rejections.check(rejectedInvalid, rawurl); err != nil {
+		return "", nil, err
+	}
+	redacted, params, err := s.Redactor.Redact(rawurl)
+	if err != nil {
+		if rejectedForArchiving(err) {
+			s.Rejections.add(rejectedInvalid, rawurl, err)
+		}
+		return "", nil, err
+	}
+	if len(params) > 0 {
+		s.Log.Infof("redacted %d sensitive query param(s) from url: %s", len(params), redacted)
+	}
+	return redacted, params, nil
+}
+
+// markRedacted records on a url that query params were redacted before storage
+func markRedacted(u *core.Url, params []string) {
+	if len(params) == 0 {
+		return
+	}
+	if u.Meta == nil {
+		u.Meta = map[string]interface{}{}
+	}
+	u.Meta["redacted"] = true
+	u.Meta["redactedParams"] = params
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	// "github.com/datatogether/task-mgmt/tasks"
 	"github.com/garyburd/redigo/redis"
 	// "net"
@@ -71,13 +72,17 @@ func SubscribeTaskProgress() (err error) {
 
 	log.Infoln("connected to redis")
 	psc := redis.PubSubConn{Conn: conn}
-	if err = psc.PSubscribe("tasks.*"); err != nil {
+	if err = psc.PSubscribe("tasks.*", eventsChannelPrefix+"*"); err != nil {
 		return err
 	}
 	defer psc.PUnsubscribe()
 
+	atomic.StoreInt32(&eventsListening, 1)
+
 	go func() {
 		defer wg.Done()
+		// once we stop receiving, events from other instances are being missed
+		defer atomic.StoreInt32(&eventsListening, 0)
 		for {
 			switch v := psc.Receive().(type) {
 			case redis.Message:
@@ -101,6 +106,10 @@ func SubscribeTaskProgress() (err error) {
 				}
 			case redis.PMessage:
 				// log.Infof("PMessage: %s %s %s\n", v.Pattern, v.Channel, v.Data)
+				if isEventChannel(v.Channel) {
+					handleRemoteEvent(v.Channel, v.Data)
+					continue
+				}
 
 				// TODO - other types of messages will eventually come through
 				// here...
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/lib/pq"
+)
+
+// EventHashAliased is published when content is re-hashed & an alias from it's
+// old hash to it's new one is recorded. it's subject is the old hash
+const EventHashAliased = "HASH_ALIASED"
+
+const (
+	// number of blocks listed per rehash batch
+	rehashBatchSize = 100
+	// blocks re-hashed per second unless a job asks for another rate
+	rehashDefaultRate = 20
+)
+
+var (
+	// ErrRehashRunning is returned when starting a job while another is running
+	ErrRehashRunning = fmt.Errorf("a rehash job is already running")
+	// ErrRehashMismatch is returned when a stored block doesn't hash to the hash it's stored under
+	ErrRehashMismatch = fmt.Errorf("stored content doesn't match it's hash")
+	// ErrNoBlockStore is returned when starting a job without content to re-hash
+	ErrNoBlockStore = fmt.Errorf("no content is stored locally, set ImportContentDir to re-hash it")
+)
+
+// rehashJobs runs rehash jobs, one at a time. they're throttled by rate
+// rather than pausing between batches, & aren't reported to clients
+var rehashJobs = &jobKind{
+	name:       "rehash",
+	cols:       rehashJobCols,
+	errRunning: ErrRehashRunning,
+}
+
+func init() {
+	addEventListener(func(e *Event) {
+		if e.Type != EventHashAliased {
+			return
+		}
+		a, err := eventHashAlias(e)
+		if err != nil {
+			log.Infof("error reading %s event: %s", e.Type, err.Error())
+			return
+		}
+		// reads of either hash now include metadata about the other. cached
+		// content hashes are left to expire, both hashes are of the same bytes
+		metaCache.Invalidate(a.Old)
+		metaCache.Invalidate(a.New)
+	})
+}
+
+// HashAlias records that content known by an old hash has been re-hashed to a
+// new one. both hashes are of identical bytes
+type HashAlias struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// eventHashAlias reads the alias from a HASH_ALIASED event. events from other
+// instances carry it as decoded JSON
+func eventHashAlias(e *Event) (*HashAlias, error) {
+	if a, ok := e.Data.(*HashAlias); ok {
+		return a, nil
+	}
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	a := &HashAlias{}
+	err = json.Unmarshal(data, a)
+	return a, err
+}
+
+// recordHashAlias records old as an alias of new. aliases of old are re-pointed
+// at new in the same transaction, so every alias points at a current hash &
+// reads never follow more than one
+func recordHashAlias(tx *sql.Tx, old, new string) error {
+	if _, err := tx.Exec("update hash_aliases set new = $2 where new = $1", old, new); err != nil {
+		return err
+	}
+	_, err := tx.Exec("insert into hash_aliases (old,new,created) values ($1, $2, $3) on conflict (old) do update set new = $2",
+		old, new, time.Now().Round(time.Second).In(time.UTC))
+	return err
+}
+
+// currentHash follows hash to the hash it's content was re-hashed to, returning
+// hash itself if it hasn't been
+func currentHash(db sqlQueryable, hash string) (string, error) {
+	var current string
+	err := db.QueryRow("select coalesce((select new from hash_aliases where old = $1), $1)", hash).Scan(&current)
+	return current, err
+}
+
+// hashAliases lists every hash content has been known by: hash itself, the
+// current hash it's been re-hashed to & any other hashes aliased to that.
+// subjects that aren't content hashes are returned on their own
+func hashAliases(db sqlQueryable, hash string) ([]string, error) {
+	rows, err := db.Query(`with current as (select coalesce((select new from hash_aliases where old = $1), $1) as hash)
+		select hash from current union select old from hash_aliases where new = (select hash from current)`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := []string{}
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, rows.Err()
+}
+
+// MetadataForSubject reads the metadata written about a subject, following
+// hash aliases so metadata written about content before it was re-hashed is
+// included. blocks keep the subject they were written with
+func MetadataForSubject(db sqlQueryable, subject string) ([]*core.Metadata, error) {
+	subjects, err := hashAliases(db, subject)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("select "+metadataCols.String()+" from metadata where subject = any($1) and deleted = false and meta is not null", pq.Array(subjects))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []*core.Metadata{}
+	for rows.Next() {
+		m, err := scanMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, m)
+	}
+	return blocks, rows.Err()
+}
+
+// latestMetadataForSubject reads the most recent metadata block for a keyId &
+// subject, following hash aliases. returns ErrNotFound if none exists
+func latestMetadataForSubject(db sqlQueryable, keyId, subject string) (*core.Metadata, error) {
+	subjects, err := hashAliases(db, subject)
+	if err != nil {
+		return nil, err
+	}
+	return scanMetadata(db.QueryRow("select "+metadataCols.String()+" from metadata where key_id = $1 and subject = any($2) order by time_stamp desc limit 1",
+		keyId, pq.Array(subjects)))
+}
+
+// blockStore is content stored by it's hash that can be re-hashed
+type blockStore interface {
+	// Blocks lists up to limit stored hashes that sort after cursor, in order
+	Blocks(after string, limit int) ([]string, error)
+	// Rehash stores a block under it's hash with alg, returning the new hash.
+	// returns ErrRehashMismatch if the block doesn't match the hash it's stored under
+	Rehash(hash, alg string) (string, error)
+}
+
+// dirBlocks is a directory of content named by it's hash, like the bodies WARC
+// imports write to cfg.ImportContentDir
+type dirBlocks string
+
+// Blocks lists the hashes in the directory, skipping temp files
+func (d dirBlocks) Blocks(after string, limit int) ([]string, error) {
+	f, err := os.Open(string(d))
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	hashes := []string{}
+	for _, name := range names {
+		if name <= after || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if hashes = append(hashes, name); len(hashes) == limit {
+			break
+		}
+	}
+	return hashes, nil
+}
+
+// Rehash streams a block through hashers for it's current & new algorithms at
+// once, writing it to a temp file as it goes. the copy is only stored under the
+// new hash if the old hash matches, so both hashes are of the same bytes. the
+// old block is kept, reads by it's hash still work
+func (d dirBlocks) Rehash(hash, alg string) (string, error) {
+	oldAlg, err := hashAlgorithm(hash)
+	if err != nil {
+		return "", err
+	}
+	old, err := newContentHasher(oldAlg)
+	if err != nil {
+		return "", err
+	}
+	next, err := newContentHasher(alg)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(filepath.Join(string(d), hash))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	tmp, err := ioutil.TempFile(string(d), ".rehash-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(io.MultiWriter(tmp, old, next), f); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if sum, err := old.Multihash(); err != nil {
+		return "", err
+	} else if sum != hash {
+		return "", ErrRehashMismatch
+	}
+	newHash, err := next.Multihash()
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(string(d), newHash)
+	if _, err := os.Stat(path); err == nil {
+		// already stored, by an interrupted job or an import. check it's intact
+		return newHash, d.verify(newHash)
+	}
+	return newHash, os.Rename(tmp.Name(), path)
+}
+
+// verify checks a stored block hashes to the hash it's stored under
+func (d dirBlocks) verify(hash string) error {
+	alg, err := hashAlgorithm(hash)
+	if err != nil {
+		return err
+	}
+	h, err := newContentHasher(alg)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(string(d), hash))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum, err := h.Multihash(); err != nil {
+		return err
+	} else if sum != hash {
+		return ErrRehashMismatch
+	}
+	return nil
+}
+
+// RehashJob re-hashes stored content with an algorithm, recording an alias from
+// each old hash to it's new one. blocks are checked in order & progress is
+// saved with each alias, so an interrupted job can be resumed
+type RehashJob struct {
+	Id        string    `json:"id"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	Algorithm string    `json:"algorithm"`
+	// most blocks re-hashed per second
+	Rate   int    `json:"rate"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// last block checked
+	Cursor string `json:"cursor"`
+	// counts of blocks checked, re-hashed, already hashed with Algorithm, & that
+	// didn't match the hash they're stored under. mismatched blocks aren't aliased
+	Checked    int `json:"checked"`
+	Rehashed   int `json:"rehashed"`
+	Current    int `json:"current"`
+	Mismatched int `json:"mismatched"`
+
+	blocks blockStore
+}
+
+// rehashJobCols are the columns of rehash_jobs
+var rehashJobCols = &columnSet{
+	table:   "rehash_jobs",
+	columns: []string{"id", "created", "updated", "algorithm", "rate", "status", "error", "cursor", "checked", "rehashed", "current", "mismatched"},
+}
+
+// scanTargets maps rehashJobCols to the job's fields
+func (j *RehashJob) scanTargets() scanTargets {
+	return scanTargets{
+		"id":         &j.Id,
+		"created":    &j.Created,
+		"updated":    &j.Updated,
+		"algorithm":  &j.Algorithm,
+		"rate":       &j.Rate,
+		"status":     &j.Status,
+		"error":      &j.Error,
+		"cursor":     &j.Cursor,
+		"checked":    &j.Checked,
+		"rehashed":   &j.Rehashed,
+		"current":    &j.Current,
+		"mismatched": &j.Mismatched,
+	}
+}
+
+// configuredBlocks is the block store content is re-hashed in, nil if content
+// isn't stored locally
+func configuredBlocks() blockStore {
+	if cfg == nil || cfg.ImportContentDir == "" {
+		return nil
+	}
+	return dirBlocks(cfg.ImportContentDir)
+}
+
+// StartRehashJob creates & runs a job re-hashing blocks with alg in the
+// background, at up to rate blocks per second. a job started after one that
+// failed with the same algorithm picks up where it stopped
+func StartRehashJob(db *sql.DB, blocks blockStore, alg string, rate int) (*RehashJob, error) {
+	if blocks == nil {
+		return nil, ErrNoBlockStore
+	}
+	if hashAlgorithms[alg] == nil {
+		return nil, fmt.Errorf("unsupported content hash algorithm: %s", alg)
+	}
+	if rate <= 0 {
+		rate = rehashDefaultRate
+	}
+	if err := maintenance.Check(); err != nil {
+		return nil, err
+	}
+
+	j := &RehashJob{Algorithm: alg, Rate: rate, blocks: blocks}
+	prev := &RehashJob{}
+	err := rehashJobCols.scan(db.QueryRow("select "+rehashJobCols.String()+" from rehash_jobs where algorithm = $1 order by created desc limit 1", alg), prev.scanTargets())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && prev.Status == jobFailed {
+		j.Cursor, j.Checked, j.Rehashed, j.Current, j.Mismatched = prev.Cursor, prev.Checked, prev.Rehashed, prev.Current, prev.Mismatched
+	}
+
+	// a partial unique index on status allows only one running job at a time
+	if err := rehashJobs.create(db, j); err != nil {
+		return nil, err
+	}
+
+	// return a copy, the job is modified as it runs
+	cp := *j
+	go rehashJobs.run(db, j)
+	return &cp, nil
+}
+
+// resumeRehashJobs restarts a rehash job the instance running it stopped
+// before it finished
+func resumeRehashJobs(db *sql.DB) {
+	blocks := configuredBlocks()
+	if blocks == nil {
+		return
+	}
+	rehashJobs.resume(db, &RehashJob{blocks: blocks})
+}
+
+// batch re-hashes the next batch of blocks, reporting weather all blocks are done
+func (j *RehashJob) batch(db *sql.DB) (done bool, err error) {
+	hashes, err := j.blocks.Blocks(j.Cursor, rehashBatchSize)
+	if err != nil {
+		return false, err
+	}
+	interval := time.Second / time.Duration(j.Rate)
+	for _, hash := range hashes {
+		if err := maintenance.Check(); err != nil {
+			return false, err
+		}
+		started := time.Now()
+		if err := j.rehash(db, hash); err != nil {
+			return false, err
+		}
+		if wait := interval - time.Since(started); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return len(hashes) < rehashBatchSize, nil
+}
+
+// rehash re-hashes a single block, recording it's alias & the job's progress
+// in one transaction. a block that's interrupted between being stored under
+// it's new hash & being aliased is re-hashed again when the job resumes
+func (j *RehashJob) rehash(db *sql.DB, hash string) error {
+	counts := *j
+	counts.Checked++
+	counts.Cursor = hash
+
+	var alias *HashAlias
+	if alg, err := hashAlgorithm(hash); err != nil {
+		// not content, eg: a stray file
+		log.Infof("rehash %s skipping %s: %s", j.Id, hash, err.Error())
+	} else if alg == j.Algorithm {
+		counts.Current++
+	} else if newHash, err := j.blocks.Rehash(hash, j.Algorithm); err == ErrRehashMismatch {
+		log.Infof("rehash %s: %s doesn't match it's content, not aliasing it", j.Id, hash)
+		counts.Mismatched++
+	} else if err != nil {
+		return err
+	} else {
+		alias = &HashAlias{Old: hash, New: newHash}
+		counts.Rehashed++
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return checkWriteErr(err)
+	}
+	defer tx.Rollback()
+	if alias != nil {
+		if err := recordHashAlias(tx, alias.Old, alias.New); err != nil {
+			return checkWriteErr(err)
+		}
+	}
+	if err := rehashJobs.save(tx, &counts); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return checkWriteErr(err)
+	}
+
+	j.Updated, j.Cursor, j.Checked, j.Rehashed, j.Current, j.Mismatched = counts.Updated, counts.Cursor, counts.Checked, counts.Rehashed, counts.Current, counts.Mismatched
+	if alias != nil {
+		publishEvent(&Event{Type: EventHashAliased, Subject: alias.Old, Data: alias})
+	}
+	return nil
+}
+
+// summary describes the job's counts for logs
+func (j *RehashJob) summary() string {
+	return fmt.Sprintf("checked: %d, rehashed: %d, current: %d, mismatched: %d", j.Checked, j.Rehashed, j.Current, j.Mismatched)
+}
+
+// reportTo is nil, rehash jobs are started over http & aren't reported
+func (j *RehashJob) reportTo() *Client {
+	return nil
+}
+
+// readRehashJobs reads the most recent rehash jobs, newest first
+func readRehashJobs(db *sql.DB, limit int) ([]*RehashJob, error) {
+	rows, err := db.Query("select "+rehashJobCols.String()+" from rehash_jobs order by created desc limit $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*RehashJob{}
+	for rows.Next() {
+		j := &RehashJob{}
+		if err := rehashJobCols.scan(rows, j.scanTargets()); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// RehashHandler reports the progress of recent rehash jobs (GET), or starts a
+// job re-hashing stored content with the configured algorithm (POST). posted
+// jobs can ask for a rate in blocks per second
+func RehashHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminConfigured(w) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		jobs, err := readRehashJobs(appDB, 10)
+		if err != nil {
+			log.Info(err.Error())
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	case "POST":
+		req := struct {
+			Rate int `json:"rate"`
+		}{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		j, err := StartRehashJob(appDB, configuredBlocks(), contentHashAlgorithm, req.Rate)
+		switch err {
+		case nil:
+			writeJSON(w, http.StatusAccepted, j)
+		case ErrMaintenanceMode:
+			writeMaintenanceError(w)
+		case ErrRehashRunning:
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		case ErrNoBlockStore:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		default:
+			log.Info(err.Error())
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
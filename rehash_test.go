@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// storeTestBlocks writes bodies to a temp dir named by their sha2-256 hash
+func storeTestBlocks(t *testing.T, bodies ...string) (string, []string) {
+	dir, err := ioutil.TempDir("", "patchbay_rehash")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hashes := []string{}
+	for _, b := range bodies {
+		hash, _, err := storeImportedBody(dir, bytes.NewReader([]byte(b)))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		hashes = append(hashes, hash)
+	}
+	return dir, hashes
+}
+
+func TestDirBlocksRehash(t *testing.T) {
+	dir, hashes := storeTestBlocks(t, "<html>epa</html>", "<html>noaa</html>")
+	defer os.RemoveAll(dir)
+	blocks := dirBlocks(dir)
+
+	listed, err := blocks.Blocks("", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(listed) != 2 {
+		t.Fatalf("expected 2 blocks, got: %v", listed)
+	}
+
+	newHash, err := blocks.Rehash(hashes[0], "blake2b-256")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expect, _ := hashContentWith("blake2b-256", []byte("<html>epa</html>")); newHash != expect {
+		t.Errorf("expected new hash %s, got: %s", expect, newHash)
+	}
+	for _, hash := range []string{hashes[0], newHash} {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, hash)); err != nil || string(data) != "<html>epa</html>" {
+			t.Errorf("expected %s to be stored, got: %s %v", hash, data, err)
+		}
+	}
+	// re-hashing again checks the stored copy
+	if again, err := blocks.Rehash(hashes[0], "blake2b-256"); err != nil || again != newHash {
+		t.Errorf("expected re-hashing twice to give the same hash, got: %s %v", again, err)
+	}
+
+	// blocks that don't match their hash aren't re-hashed
+	if err := ioutil.WriteFile(filepath.Join(dir, hashes[1]), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := blocks.Rehash(hashes[1], "blake2b-256"); err != ErrRehashMismatch {
+		t.Errorf("expected corrupt block to be a mismatch, got: %v", err)
+	}
+	if listed, _ := blocks.Blocks("", 10); len(listed) != 3 {
+		t.Errorf("expected corrupt block not to be stored under a new hash, got: %v", listed)
+	}
+}
+
+func TestHashAliasResolution(t *testing.T) {
+	defer resetTestData(appDB, "metadata", "hash_aliases")
+	const (
+		old     = "1220459219b10032cc86dcdbc0f83aea15a9d3e1119e7b5170beaee233008ea2c2de"
+		mid     = "1220aaaa000000000000000000000000000000000000000000000000000000000001"
+		current = "a0e40220bbbb000000000000000000000000000000000000000000000000000000000001"
+	)
+	if err := WriteMetadata(&core.Metadata{KeyId: "key", Subject: old, Meta: map[string]interface{}{"title": "EPA"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// aliases recorded one after another collapse onto the current hash
+	for _, a := range []HashAlias{{old, mid}, {mid, current}} {
+		tx, err := appDB.Begin()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := recordHashAlias(tx, a.Old, a.New); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if got, err := currentHash(appDB, old); err != nil || got != current {
+		t.Errorf("expected %s to resolve to %s, got: %s %v", old, current, got, err)
+	}
+
+	for i, subject := range []string{old, mid, current} {
+		blocks, err := MetadataForSubject(appDB, subject)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(blocks) != 1 || blocks[0].Subject != old {
+			t.Errorf("case %d expected metadata written about %s, got: %v", i, old, blocks)
+		}
+		c, err := calcConsensus(appDB, subject)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(c["title"]) != 1 {
+			t.Errorf("case %d expected aliased metadata to count towards consensus, got: %v", i, c)
+		}
+	}
+
+	// new writes about old hashes are written about the current one
+	m := &core.Metadata{KeyId: "key", Subject: old, Meta: map[string]interface{}{"title": "EPA!"}}
+	if err := WriteMetadata(m); err != nil {
+		t.Fatal(err.Error())
+	}
+	if m.Subject != current {
+		t.Errorf("expected write to be re-pointed at %s, got: %s", current, m.Subject)
+	}
+	latest, err := metaCache.LatestMetadata(appDB, "key", old)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if latest.Hash != m.Hash {
+		t.Errorf("expected latest metadata to follow aliases")
+	}
+}
+
+func TestRehashJob(t *testing.T) {
+	defer resetTestData(appDB, "hash_aliases", "rehash_jobs")
+	dir, hashes := storeTestBlocks(t, "<html>epa</html>", "<html>noaa</html>", "<html>nasa</html>")
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, hashes[2]), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := StartRehashJob(appDB, nil, "blake2b-256", 0); err != ErrNoBlockStore {
+		t.Errorf("expected jobs to need a block store, got: %v", err)
+	}
+	j, err := StartRehashJob(appDB, dirBlocks(dir), "blake2b-256", 1000)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := StartRehashJob(appDB, dirBlocks(dir), "blake2b-256", 1000); err != ErrRehashRunning {
+		t.Errorf("expected only one job to run at a time, got: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		jobs, err := readRehashJobs(appDB, 1)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if j = jobs[0]; j.Status != jobRunning {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if j.Status != jobComplete || j.Checked != 3 || j.Rehashed != 2 || j.Mismatched != 1 {
+		t.Errorf("unexpected job progress: %#v", j)
+	}
+	for i, hash := range hashes {
+		current, err := currentHash(appDB, hash)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if aliased := current != hash; aliased != (i < 2) {
+			t.Errorf("case %d expected aliased to be %t, got: %s", i, i < 2, current)
+		}
+	}
+
+	// blocks already hashed with the algorithm are counted as current
+	j, err = StartRehashJob(appDB, dirBlocks(dir), "blake2b-256", 1000)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 100 && j.Status == jobRunning; i++ {
+		time.Sleep(20 * time.Millisecond)
+		jobs, _ := readRehashJobs(appDB, 1)
+		j = jobs[0]
+	}
+	if j.Current != 2 || j.Rehashed != 2 {
+		t.Errorf("unexpected job progress: %#v", j)
+	}
+}
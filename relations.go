@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// Relation keys are meta keys whose values are the hashes of other subjects,
+// either a single hash or a list of them
+const (
+	relationSupersedes   = "supersedes"
+	relationSupersededBy = "supersededBy"
+	relationRelatedTo    = "relatedTo"
+	relationPartOf       = "partOf"
+)
+
+var relationKeys = []string{relationSupersedes, relationSupersededBy, relationRelatedTo, relationPartOf}
+
+// ErrSupersedesCycle is returned when a supersedes relation would make a subject supersede itself
+var ErrSupersedesCycle = fmt.Errorf("supersedes relations can't form a cycle")
+
+// Relation is a link between two subjects asserted by a metadata block
+type Relation struct {
+	Subject  string    `json:"subject"`
+	Relation string    `json:"relation"`
+	Target   string    `json:"target"`
+	KeyId    string    `json:"keyId"`
+	Hash     string    `json:"hash"`
+	Created  time.Time `json:"created"`
+}
+
+// metaRelations reads the relations a block of meta asserts from subject
+func metaRelations(subject string, meta map[string]interface{}) ([]*Relation, error) {
+	rels := []*Relation{}
+	for _, key := range relationKeys {
+		val, ok := meta[key]
+		if !ok || val == nil {
+			continue
+		}
+
+		var targets []interface{}
+		switch v := val.(type) {
+		case string:
+			targets = []interface{}{v}
+		case []interface{}:
+			targets = v
+		default:
+			return nil, fmt.Errorf("%s must be a subject hash or a list of them", key)
+		}
+
+		for _, t := range targets {
+			target, ok := t.(string)
+			if !ok || target == "" {
+				return nil, fmt.Errorf("%s must be a subject hash or a list of them", key)
+			}
+			if target == subject {
+				return nil, fmt.Errorf("a subject can't be %s itself", key)
+			}
+			rels = append(rels, &Relation{Subject: subject, Relation: key, Target: target})
+		}
+	}
+	return rels, nil
+}
+
+// checkRelations validates the relations a block asserts: targets must be
+// existing subjects & supersedes chains can't loop back on themselves. The
+// block replaces any relations the same key asserted for the subject before
+func checkRelations(db *sql.DB, m *core.Metadata) error {
+	rels, err := metaRelations(m.Subject, m.Meta)
+	if err != nil || len(rels) == 0 {
+		return err
+	}
+
+	for _, r := range rels {
+		var exists bool
+		if err := db.QueryRow(`select exists(select 1 from urls where hash = $1) or exists(select 1 from metadata where subject = $1 and deleted = false)`,
+			r.Target).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s references unknown subject: %s", r.Relation, r.Target)
+		}
+	}
+
+	// a block can only add edges into or out of it's own subject, so a cycle
+	// means something the subject supersedes already leads back to it, or to
+	// something the block says supersedes it
+	var (
+		replaces   []string
+		replacedBy []string
+	)
+	for _, r := range rels {
+		switch r.Relation {
+		case relationSupersedes:
+			replaces = append(replaces, r.Target)
+		case relationSupersededBy:
+			replacedBy = append(replacedBy, r.Target)
+		}
+	}
+	for _, older := range replaces {
+		for _, newer := range append([]string{m.Subject}, replacedBy...) {
+			cycle := older == newer
+			if !cycle {
+				if cycle, err = supersedesChain(db, m, older, newer); err != nil {
+					return err
+				}
+			}
+			if cycle {
+				return ErrSupersedesCycle
+			}
+		}
+	}
+	for _, newer := range replacedBy {
+		cycle, err := supersedesChain(db, m, m.Subject, newer)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrSupersedesCycle
+		}
+	}
+	return nil
+}
+
+// supersedesChain checks if from already supersedes to, directly or through a
+// chain. relations m replaces are left out
+func supersedesChain(db *sql.DB, m *core.Metadata, from, to string) (found bool, err error) {
+	err = db.QueryRow(`with recursive edges as (
+			select subject as newer, target as older from relations where relation = $3 and not (subject = $4 and key_id = $5)
+			union all
+			select target, subject from relations where relation = $6 and not (subject = $4 and key_id = $5)
+		), chain as (
+			select older from edges where newer = $1
+			union
+			select e.older from edges e join chain c on e.newer = c.older
+		)
+		select exists(select 1 from chain where older = $2)`,
+		from, to, relationSupersedes, m.Subject, m.KeyId, relationSupersededBy).Scan(&found)
+	return
+}
+
+// indexRelations replaces the relations a key asserts for a subject with
+// those in it's latest block
+func indexRelations(db *sql.DB, m *core.Metadata) error {
+	rels, err := metaRelations(m.Subject, m.Meta)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("delete from relations where subject = $1 and key_id = $2", m.Subject, m.KeyId); err != nil {
+		return err
+	}
+	for _, r := range rels {
+		if _, err := tx.Exec("insert into relations (subject,relation,target,key_id,hash,created) values ($1, $2, $3, $4, $5, $6) on conflict do nothing",
+			r.Subject, r.Relation, r.Target, m.KeyId, m.Hash, m.Timestamp.In(time.UTC)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SubjectRelations reads relations from a subject (outgoing) & to it (incoming)
+func SubjectRelations(db *sql.DB, subject string) (outgoing, incoming []*Relation, err error) {
+	if outgoing, err = readRelations(db, "select "+relationCols.String()+" from relations where subject = $1 order by created", subject); err != nil {
+		return
+	}
+	incoming, err = readRelations(db, "select "+relationCols.String()+" from relations where target = $1 order by created", subject)
+	return
+}
+
+// relationCols are the columns of relations
+var relationCols = &columnSet{
+	table:   "relations",
+	columns: []string{"subject", "relation", "target", "key_id", "hash", "created"},
+}
+
+// scanTargets maps relationCols to the relation's fields
+func (r *Relation) scanTargets() scanTargets {
+	return scanTargets{
+		"subject":  &r.Subject,
+		"relation": &r.Relation,
+		"target":   &r.Target,
+		"key_id":   &r.KeyId,
+		"hash":     &r.Hash,
+		"created":  &r.Created,
+	}
+}
+
+func readRelations(db *sql.DB, query string, args ...interface{}) ([]*Relation, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rels := []*Relation{}
+	for rows.Next() {
+		r := &Relation{}
+		if err := relationCols.scan(rows, r.scanTargets()); err != nil {
+			return nil, err
+		}
+		rels = append(rels, r)
+	}
+	return rels, rows.Err()
+}
+
+// visibleRelations drops relations that lead to or from hidden content. a
+// hidden subject has no relations
+func visibleRelations(v *Visibility, subject string, outgoing, incoming []*Relation) ([]*Relation, []*Relation, error) {
+	if visible, err := v.Subject(subject); err != nil || !visible {
+		return []*Relation{}, []*Relation{}, err
+	}
+	out := make([]*Relation, 0, len(outgoing))
+	for _, r := range outgoing {
+		visible, err := v.Subject(r.Target)
+		if err != nil {
+			return nil, nil, err
+		}
+		if visible {
+			out = append(out, r)
+		}
+	}
+	in := make([]*Relation, 0, len(incoming))
+	for _, r := range incoming {
+		visible, err := v.Subject(r.Subject)
+		if err != nil {
+			return nil, nil, err
+		}
+		if visible {
+			in = append(in, r)
+		}
+	}
+	return out, in, nil
+}
+
+// SubjectRelationsAction fetches the relations to & from a subject
+type SubjectRelationsAction struct {
+	ReqAction
+	clientAction
+	Subject string `json:"subject"`
+}
+
+func (SubjectRelationsAction) Type() string        { return "SUBJECT_RELATIONS_REQUEST" }
+func (SubjectRelationsAction) SuccessType() string { return "SUBJECT_RELATIONS_SUCCESS" }
+func (SubjectRelationsAction) FailureType() string { return "SUBJECT_RELATIONS_FAILURE" }
+
+func (SubjectRelationsAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &SubjectRelationsAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *SubjectRelationsAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		log.Info(a.err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+
+	outgoing, incoming, err := SubjectRelations(appDB, a.Subject)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	v, err := a.visibility()
+	if err == nil {
+		outgoing, incoming, err = visibleRelations(v, a.Subject, outgoing, incoming)
+	}
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "RELATIONS",
+		Data: map[string]interface{}{
+			"subject":  a.Subject,
+			"outgoing": outgoing,
+			"incoming": incoming,
+		},
+	}
+}
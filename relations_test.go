@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestMetaRelations(t *testing.T) {
+	cases := []struct {
+		meta   map[string]interface{}
+		expect int
+		err    bool
+	}{
+		{map[string]interface{}{"title": "EPA"}, 0, false},
+		{map[string]interface{}{"supersedes": "b"}, 1, false},
+		{map[string]interface{}{"relatedTo": []interface{}{"b", "c"}, "partOf": "d"}, 3, false},
+		{map[string]interface{}{"supersedes": nil}, 0, false},
+		{map[string]interface{}{"supersedes": 5}, 0, true},
+		{map[string]interface{}{"relatedTo": []interface{}{"b", 5}}, 0, true},
+		{map[string]interface{}{"supersedes": "a"}, 0, true},
+	}
+
+	for i, c := range cases {
+		rels, err := metaRelations("a", c.meta)
+		if (err != nil) != c.err {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if len(rels) != c.expect {
+			t.Errorf("case %d relation count mismatch. expected: %d, got: %d", i, c.expect, len(rels))
+		}
+	}
+}
+
+func TestCheckRelations(t *testing.T) {
+	defer resetTestData(appDB, "metadata", "relations")
+
+	if _, err := appDB.Exec(`insert into metadata (hash,time_stamp,key_id,subject,prev,meta,deleted) values
+		('1', '2017-01-01 00:00:01', 'key', 'a', '', '{}', false),
+		('2', '2017-01-01 00:00:01', 'key', 'b', '', '{}', false),
+		('3', '2017-01-01 00:00:01', 'key', 'c', '', '{}', false)`); err != nil {
+		t.Fatal(err.Error())
+	}
+	// a supersedes b, b supersedes c
+	for _, m := range []*core.Metadata{
+		{Hash: "4", KeyId: "key", Subject: "a", Timestamp: time.Now(), Meta: map[string]interface{}{"supersedes": "b"}},
+		{Hash: "5", KeyId: "key", Subject: "b", Timestamp: time.Now(), Meta: map[string]interface{}{"supersedes": "c"}},
+	} {
+		if err := indexRelations(appDB, m); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	cases := []struct {
+		subject, keyId string
+		meta           map[string]interface{}
+		err            error
+	}{
+		{"c", "key", map[string]interface{}{"relatedTo": "a"}, nil},
+		{"c", "key", map[string]interface{}{"supersedes": "a"}, ErrSupersedesCycle},
+		{"a", "key", map[string]interface{}{"supersededBy": "c"}, ErrSupersedesCycle},
+		{"c", "other", map[string]interface{}{"supersededBy": "a", "supersedes": "a"}, ErrSupersedesCycle},
+		// replacing the key's own relation for a subject can't cycle with it
+		{"b", "key", map[string]interface{}{"supersedes": "c"}, nil},
+	}
+
+	for i, c := range cases {
+		m := &core.Metadata{KeyId: c.keyId, Subject: c.subject, Meta: c.meta}
+		if err := checkRelations(appDB, m); err != c.err {
+			t.Errorf("case %d error mismatch. expected: %v, got: %v", i, c.err, err)
+		}
+	}
+
+	if err := checkRelations(appDB, &core.Metadata{Subject: "a", Meta: map[string]interface{}{"relatedTo": "missing"}}); err == nil {
+		t.Errorf("expected relations to unknown subjects to be rejected")
+	}
+
+	outgoing, incoming, err := SubjectRelations(appDB, "b")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(outgoing) != 1 || outgoing[0].Target != "c" || len(incoming) != 1 || incoming[0].Subject != "a" {
+		t.Errorf("unexpected relations for b. outgoing: %v, incoming: %v", outgoing, incoming)
+	}
+}
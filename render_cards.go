@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+)
+
+// Render cards
+//
+// Screenshotting captures would need a browser, so HTML captures get a render
+// card instead: the page's first heading & paragraph, the theme color it
+// declares & it's favicon, which the frontend draws as a preview tile. cards
+// are stored per capture, keyed by url & capture hash. favicons are fetched
+// through the capture's egress, capped at renderFaviconMaxBytes & stored
+// content-addressed, so sites sharing an icon store it once. generating a
+// card never fails the capture it's made from
+
+const (
+	// largest favicon fetched for a render card
+	renderFaviconMaxBytes = 64 * 1024
+	// how long a favicon fetch is reused by captures of pages that use the same
+	// icon, so crawling a site doesn't fetch it's favicon with every page
+	renderFaviconReuse = 24 * time.Hour
+	// longest heading kept, in characters
+	renderHeadingMax = 200
+	// longest paragraph kept, in characters
+	renderParagraphMax = 500
+)
+
+// renderFaviconTypes are the sniffed content types favicons are kept with.
+// svg icons can carry scripts, so they're left out
+var renderFaviconTypes = map[string]bool{
+	"image/x-icon": true,
+	"image/png":    true,
+	"image/gif":    true,
+	"image/jpeg":   true,
+	"image/webp":   true,
+	"image/bmp":    true,
+}
+
+// renderColorMetas are the meta names pages declare colors with, in order of preference
+var renderColorMetas = []string{"theme-color", "msapplication-TileColor", "msapplication-navbutton-color"}
+
+// RenderCard is a preview of an HTML capture
+type RenderCard struct {
+	Url string `json:"url"`
+	// hash of the capture the card was made from
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	// text of the first heading, empty if the page has none
+	Heading string `json:"heading,omitempty"`
+	// text of the first paragraph, empty if the page has none
+	Paragraph string `json:"paragraph,omitempty"`
+	// hex color the page declares with a theme-color meta tag, eg: "#1a2b3c"
+	ThemeColor string `json:"themeColor,omitempty"`
+	// nil if the page's favicon couldn't be fetched
+	Favicon *RenderFavicon `json:"favicon,omitempty"`
+}
+
+// RenderFavicon is a favicon stored for render cards, served at /favicons/{hash}
+type RenderFavicon struct {
+	Hash string `json:"hash"`
+	// where the favicon was fetched from
+	Url         string `json:"url"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+}
+
+// extractRenderCard reads a card from an HTML document, returning it with the
+// url of the page's favicon. pages that don't link a favicon use /favicon.ico
+func extractRenderCard(base *url.URL, doc *goquery.Document) (*RenderCard, string) {
+	card := &RenderCard{
+		Heading:   firstText(doc.Find("h1, h2, h3, h4, h5, h6"), renderHeadingMax),
+		Paragraph: firstText(doc.Find("p"), renderParagraphMax),
+	}
+
+	for _, name := range renderColorMetas {
+		doc.Find("meta[name]").EachWithBreak(func(i int, el *goquery.Selection) bool {
+			if !strings.EqualFold(el.AttrOr("name", ""), name) {
+				return true
+			}
+			// colors for a media query, like dark mode, are only used if nothing else is declared
+			_, media := el.Attr("media")
+			if media && card.ThemeColor != "" {
+				return true
+			}
+			if c := renderColor(el.AttrOr("content", "")); c != "" {
+				card.ThemeColor = c
+				return media
+			}
+			return true
+		})
+		if card.ThemeColor != "" {
+			break
+		}
+	}
+
+	favicon := ""
+	doc.Find("link[rel][href]").EachWithBreak(func(i int, el *goquery.Selection) bool {
+		for _, rel := range strings.Fields(el.AttrOr("rel", "")) {
+			if strings.EqualFold(rel, "icon") {
+				if u, err := base.Parse(strings.TrimSpace(el.AttrOr("href", ""))); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+					u.Fragment = ""
+					favicon = u.String()
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if favicon == "" {
+		favicon = (&url.URL{Scheme: base.Scheme, Host: base.Host, Path: "/favicon.ico"}).String()
+	}
+	return card, favicon
+}
+
+// firstText is the whitespace-collapsed text of the first element in sel that
+// has any, truncated to max characters
+func firstText(sel *goquery.Selection, max int) (text string) {
+	sel.EachWithBreak(func(i int, el *goquery.Selection) bool {
+		text = strings.Join(strings.Fields(el.Text()), " ")
+		return text == ""
+	})
+	if utf8.RuneCountInString(text) > max {
+		text = strings.TrimSpace(string([]rune(text)[:max-1])) + "…"
+	}
+	return
+}
+
+// renderColor normalizes a hex color to lowercase "#rrggbb", returning "" for
+// anything else so cards can't carry arbitrary CSS
+func renderColor(c string) string {
+	c = strings.ToLower(strings.TrimSpace(c))
+	if len(c) != 4 && len(c) != 7 || c[0] != '#' {
+		return ""
+	}
+	for _, r := range c[1:] {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return ""
+		}
+	}
+	if len(c) == 4 {
+		c = string([]byte{'#', c[1], c[1], c[2], c[2], c[3], c[3]})
+	}
+	return c
+}
+
+// saveRenderCard generates & stores a render card for a fresh HTML capture of
+// u, fetching it's favicon through e. captures that aren't HTML are skipped, as
+// is everything if render cards are turned off
+func (s *Service) saveRenderCard(e *egress, u *core.Url, body []byte) error {
+	if s.Config != nil && s.Config.SkipRenderCards || u.ContentSniff != "text/html; charset=utf-8" || u.Hash == "" {
+		return nil
+	}
+	base, err := u.ParsedUrl()
+	if err != nil {
+		return err
+	}
+	if len(body) > maxExtractBytes {
+		body = body[:maxExtractBytes]
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	card, favicon := extractRenderCard(base, doc)
+	card.Url = u.Url
+	card.Hash = u.Hash
+	card.Created = s.Clock().Round(time.Second).In(time.UTC)
+	if card.Favicon, err = s.renderFavicon(e, favicon, card.Created); err != nil {
+		s.Log.Infof("error fetching favicon %s: %s", favicon, err.Error())
+	}
+	return writeRenderCard(s.DB, card, favicon)
+}
+
+// renderFavicon reads a favicon for a card, reusing the last fetch of the same
+// url within renderFaviconReuse. failed fetches are reused too, returning nil
+func (s *Service) renderFavicon(e *egress, favicon string, now time.Time) (*RenderFavicon, error) {
+	var data []byte
+	err := s.DB.QueryRow("select card from render_cards where favicon_url = $1 and created > $2 order by created desc limit 1",
+		favicon, now.Add(-renderFaviconReuse)).Scan(&data)
+	if err == nil {
+		prev := &RenderCard{}
+		if err := json.Unmarshal(data, prev); err != nil {
+			return nil, err
+		}
+		return prev.Favicon, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	f, data, err := fetchFavicon(e, favicon)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.DB.Exec("insert into render_favicons (hash,created,content_type,data) values ($1, $2, $3, $4) on conflict (hash) do nothing",
+		f.Hash, now, f.ContentType, data)
+	if err = checkWriteErr(err); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// fetchFavicon GET's a favicon through an egress, checking it's an image no
+// larger than renderFaviconMaxBytes
+func fetchFavicon(e *egress, favicon string) (*RenderFavicon, []byte, error) {
+	req, err := http.NewRequest("GET", favicon, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := e.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("favicon responded with status %d", res.StatusCode)
+	}
+	if res.ContentLength > renderFaviconMaxBytes {
+		return nil, nil, fmt.Errorf("favicon is larger than %d bytes", renderFaviconMaxBytes)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, renderFaviconMaxBytes+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > renderFaviconMaxBytes {
+		return nil, nil, fmt.Errorf("favicon is larger than %d bytes", renderFaviconMaxBytes)
+	}
+	contentType := http.DetectContentType(data)
+	if !renderFaviconTypes[contentType] {
+		return nil, nil, fmt.Errorf("favicon isn't an image: %s", contentType)
+	}
+	hash, err := hashContent(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &RenderFavicon{Hash: hash, Url: favicon, ContentType: contentType, Size: len(data)}, data, nil
+}
+
+// writeRenderCard stores a card, replacing any card made from the same capture
+func writeRenderCard(db *sql.DB, card *RenderCard, favicon string) error {
+	data, err := json.Marshal(card)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`insert into render_cards (url,hash,created,favicon_url,card) values ($1, $2, $3, $4, $5)
+		on conflict (url, hash) do update set created = $3, favicon_url = $4, card = $5`,
+		card.Url, card.Hash, card.Created, favicon, data)
+	return checkWriteErr(err)
+}
+
+// ReadRenderCard reads the card made from a capture of a url. captures that
+// have been rehashed are found by their old hash. returns ErrNotFound if the
+// capture doesn't have a card
+func ReadRenderCard(db *sql.DB, url, hash string) (*RenderCard, error) {
+	var data []byte
+	err := db.QueryRow(`select card from render_cards where url = $1
+		and (hash = $2 or hash in (select old from hash_aliases where new = $2))
+		order by created desc limit 1`, url, hash).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	card := &RenderCard{}
+	if err := json.Unmarshal(data, card); err != nil {
+		return nil, err
+	}
+	card.Hash = hash
+	return card, nil
+}
+
+// RenderFaviconHandler serves stored favicons at /favicons/{hash}. favicons
+// are content-addressed, so they're cached forever
+func RenderFaviconHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var (
+		contentType string
+		data        []byte
+	)
+	hash := strings.TrimPrefix(r.URL.Path, "/favicons/")
+	err := appDB.QueryRow("select content_type, data from render_favicons where hash = $1", hash).Scan(&contentType, &data)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Info(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(data)
+}
+
+// RenderCardAction reads the render card of a url's capture, the latest
+// capture if hash is empty
+type RenderCardAction struct {
+	ReqAction
+	clientAction
+	Url  string `json:"url"`
+	Hash string `json:"hash"`
+}
+
+func (RenderCardAction) Type() string        { return "RENDER_CARD_REQUEST" }
+func (RenderCardAction) SuccessType() string { return "RENDER_CARD_SUCCESS" }
+func (RenderCardAction) FailureType() string { return "RENDER_CARD_FAILURE" }
+
+func (RenderCardAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &RenderCardAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *RenderCardAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	v, err := a.visibility()
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	if !v.Url(a.Url) {
+		return notFoundResponse(a, a.RequestId, "url", a.Url)
+	}
+
+	hash := a.Hash
+	if hash == "" {
+		if hash, err = svc.ContentCache.Latest(a.Url); err == ErrNotFound {
+			return notFoundResponse(a, a.RequestId, "url", a.Url)
+		} else if err != nil {
+			log.Info(err.Error())
+			return &ClientResponse{
+				Type:      a.FailureType(),
+				RequestId: a.RequestId,
+				Error:     err.Error(),
+			}
+		}
+	}
+	card, err := ReadRenderCard(svc.DB, a.Url, hash)
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "renderCard", a.Url)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		Schema:    "RENDER_CARD",
+		RequestId: a.RequestId,
+		Data:      card,
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+)
+
+func TestExtractRenderCard(t *testing.T) {
+	base, _ := url.Parse("http://www.epa.gov/climate/index.html")
+	cases := []struct {
+		fixture   string
+		heading   string
+		paragraph string
+		color     string
+		favicon   string
+	}{
+		{"complete.html", "Climate Change", "Climate change is happening. Our science explains why.", "#0071bc", "http://www.epa.gov/sites/favicon.png"},
+		{"no_heading.html", "", "Data & tools for the public.", "#ffcc00", "https://cdn.epa.gov/icon.ico"},
+		{"no_paragraph.html", "Datasets", "", "#0071bc", "http://www.epa.gov/climate/favicon.gif"},
+		// colors that aren't hex are dropped
+		{"no_color.html", "Reports", "Annual reports.", "", "http://www.epa.gov/favicon.png"},
+		// pages without a usable icon link fall back to /favicon.ico
+		{"no_favicon.html", "Newsroom", "Press releases.", "#0071bc", "http://www.epa.gov/favicon.ico"},
+		{"empty.html", "", "", "", "http://www.epa.gov/favicon.ico"},
+	}
+
+	for i, c := range cases {
+		f, err := os.Open(filepath.Join("testdata/render_cards", c.fixture))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		doc, err := goquery.NewDocumentFromReader(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		card, favicon := extractRenderCard(base, doc)
+		if card.Heading != c.heading {
+			t.Errorf("case %d (%s) expected heading %q, got: %q", i, c.fixture, c.heading, card.Heading)
+		}
+		if card.Paragraph != c.paragraph {
+			t.Errorf("case %d (%s) expected paragraph %q, got: %q", i, c.fixture, c.paragraph, card.Paragraph)
+		}
+		if card.ThemeColor != c.color {
+			t.Errorf("case %d (%s) expected color %q, got: %q", i, c.fixture, c.color, card.ThemeColor)
+		}
+		if favicon != c.favicon {
+			t.Errorf("case %d (%s) expected favicon %s, got: %s", i, c.fixture, c.favicon, favicon)
+		}
+	}
+}
+
+func TestRenderColor(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{"#0071BC", "#0071bc"},
+		{" #abc ", "#aabbcc"},
+		{"#abcd", ""},
+		{"#gggggg", ""},
+		{"red", ""},
+		{"rgb(0,0,0)", ""},
+		{"", ""},
+	}
+	for i, c := range cases {
+		if got := renderColor(c.in); got != c.out {
+			t.Errorf("case %d expected %q, got: %q", i, c.out, got)
+		}
+	}
+}
+
+func TestSaveRenderCard(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 64)
+	site := newTestSite(t, map[string]*testPage{
+		"/":          {Body: `<html><head><link rel="icon" href="/icon.png"></head><body><h1>Home</h1><p>Welcome.</p></body></html>`},
+		"/about":     {Body: `<html><head><link rel="icon" href="/icon.png"></head><body><h1>About</h1></body></html>`},
+		"/big":       {Body: `<html><head><link rel="icon" href="/big.png"></head><body><h1>Big</h1></body></html>`},
+		"/svg":       {Body: `<html><head><link rel="icon" href="/icon.svg"></head><body><h1>Vector</h1></body></html>`},
+		"/data.json": {ContentType: "application/json", Body: `{"h1":"not html"}`},
+		"/icon.png":  {ContentType: "image/png", Body: png},
+		"/big.png":   {ContentType: "image/png", Body: png + strings.Repeat("\x00", renderFaviconMaxBytes)},
+		"/icon.svg":  {ContentType: "image/svg+xml", Body: `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`},
+	})
+	defer site.Close()
+	defer resetTestData(appDB, "render_cards", "render_favicons")
+	svc := site.svc
+
+	capture := func(path string) *core.Url {
+		u := &core.Url{Url: site.Url(path)}
+		if _, _, err := svc.getUrl(u, nil); err != nil {
+			t.Fatal(err.Error())
+		}
+		return u
+	}
+
+	u := capture("/")
+	card, err := ReadRenderCard(svc.DB, u.Url, u.Hash)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if card.Heading != "Home" || card.Paragraph != "Welcome." || card.Favicon == nil {
+		t.Fatalf("expected a card with a favicon, got: %#v", card)
+	}
+	if card.Favicon.ContentType != "image/png" || card.Favicon.Size != len(png) || card.Favicon.Url != site.Url("/icon.png") {
+		t.Errorf("expected a %d byte png favicon from /icon.png, got: %#v", len(png), card.Favicon)
+	}
+
+	w := httptest.NewRecorder()
+	RenderFaviconHandler(w, httptest.NewRequest("GET", "/favicons/"+card.Favicon.Hash, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || !bytes.Equal(w.Body.Bytes(), []byte(png)) {
+		t.Errorf("expected the favicon to be served, got: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// pages sharing an icon reuse it's fetch
+	u = capture("/about")
+	if card, err = ReadRenderCard(svc.DB, u.Url, u.Hash); err != nil {
+		t.Fatal(err.Error())
+	}
+	if card.Paragraph != "" || card.Favicon == nil {
+		t.Errorf("expected a card without a paragraph reusing the favicon, got: %#v", card)
+	}
+	if reqs := site.Requests("/icon.png"); len(reqs) != 1 {
+		t.Errorf("expected the favicon to be fetched once, got: %d fetches", len(reqs))
+	}
+
+	// favicons that are too large or aren't images are left off, but the card is kept
+	for _, path := range []string{"/big", "/svg"} {
+		u = capture(path)
+		if card, err = ReadRenderCard(svc.DB, u.Url, u.Hash); err != nil {
+			t.Errorf("%s: %s", path, err.Error())
+		} else if card.Favicon != nil {
+			t.Errorf("%s: expected no favicon, got: %#v", path, card.Favicon)
+		}
+	}
+
+	// captures that aren't html don't get cards
+	u = capture("/data.json")
+	if _, err := ReadRenderCard(svc.DB, u.Url, u.Hash); err != ErrNotFound {
+		t.Errorf("expected captures that aren't html not to get a card, got: %v", err)
+	}
+
+	svc.Config.SkipRenderCards = true
+	svc.DB.Exec("delete from render_cards")
+	u = capture("/")
+	if _, err := ReadRenderCard(svc.DB, u.Url, u.Hash); err != ErrNotFound {
+		t.Errorf("expected render cards to be skipped, got: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+var (
+	// ErrRecordingDisabled is returned when an archive job asks to be recorded
+	// but fetch recording isn't turned on
+	ErrRecordingDisabled = fmt.Errorf("fetch recording is disabled")
+)
+
+// ErrReplayMiss is returned when a replayed job makes a request that wasn't recorded
+type ErrReplayMiss struct {
+	Recording, Url string
+}
+
+func (e ErrReplayMiss) Error() string {
+	return fmt.Sprintf("replay miss: recording %s has no response for %s", e.Recording, e.Url)
+}
+
+// ArchiveOpts configures an archive job
+type ArchiveOpts struct {
+	// Record persists every request & response the job makes, requires fetch
+	// recording to be enabled in config
+	Record bool
+	// Replay serves the job's fetches from the recording with this hash instead
+	// of the network. urls are fetched even if they were fetched recently
+	Replay string
+}
+
+// crawlManifest describes an archive job as it started. a recording is keyed
+// by the hash of it's manifest
+type crawlManifest struct {
+	Url            string    `json:"url"`
+	ConfigSnapshot string    `json:"configSnapshot"`
+	Started        time.Time `json:"started"`
+}
+
+// fetchRecording is the set of request/response pairs an archive job made,
+// either being recorded or replayed
+type fetchRecording struct {
+	db     *sql.DB
+	Hash   string
+	replay bool
+}
+
+// recordedExchange is a single recorded response
+type recordedExchange struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// newFetchRecording starts a recording for an archive job, or opens an
+// existing one for replay
+func (s *Service) newFetchRecording(url string, opts ArchiveOpts) (*fetchRecording, error) {
+	db := s.DB
+	if opts.Replay != "" {
+		var exists bool
+		if err := db.QueryRow("select exists(select 1 from fetch_recordings where hash = $1)", opts.Replay).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrNotFound
+		}
+		s.Log.Infof("replaying %s from recording %s", url, opts.Replay)
+		return &fetchRecording{db: db, Hash: opts.Replay, replay: true}, nil
+	}
+	if !opts.Record {
+		return nil, nil
+	}
+	if s.Config == nil || !s.Config.RecordFetches {
+		return nil, ErrRecordingDisabled
+	}
+
+	manifest, hash, err := s.newCrawlManifest(url)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("insert into fetch_recordings (hash,created,url,manifest) values ($1, $2, $3, $4)",
+		hash, s.Clock().Round(time.Second).In(time.UTC), url, manifest)
+	if err := checkWriteErr(err); err != nil {
+		return nil, err
+	}
+	s.Log.Infof("recording fetches of %s as %s", url, hash)
+	return &fetchRecording{db: db, Hash: hash}, nil
+}
+
+// newCrawlManifest describes an archive job of url starting now, returning the
+// manifest & it's hash
+func (s *Service) newCrawlManifest(url string) ([]byte, string, error) {
+	snapshot, err := snapshotForUrl(s.DB, url)
+	if err != nil {
+		return nil, "", err
+	}
+	manifest, err := json.Marshal(crawlManifest{Url: url, ConfigSnapshot: snapshot, Started: s.Clock().In(time.UTC)})
+	if err != nil {
+		return nil, "", err
+	}
+	hash, err := hashContent(manifest)
+	return manifest, hash, err
+}
+
+// egress picks the egress for fetches under a source, routed through the
+// recording. replays never touch the network
+func (r *fetchRecording) egress(es *egresses, s *core.Source) (*egress, error) {
+	if r != nil && r.replay {
+		return &egress{name: egressReplay, client: &http.Client{Transport: r}}, nil
+	}
+	e, err := es.forSource(s)
+	if err != nil || r == nil {
+		return e, err
+	}
+	return e.withTransport(func(next http.RoundTripper) http.RoundTripper {
+		return &recordingTransport{rec: r, next: next}
+	}), nil
+}
+
+// exchangeKey identifies a request within a recording. urls are redacted so
+// sensitive query params are never stored
+func exchangeKey(req *http.Request) (string, error) {
+	url, _, err := redactor.Redact(req.URL.String())
+	return url, err
+}
+
+// RoundTrip serves a request from the recording
+func (r *fetchRecording) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := exchangeKey(req)
+	if err != nil {
+		return nil, err
+	}
+	ex, err := r.read(req.Method, key)
+	if err == ErrNotFound {
+		return nil, ErrReplayMiss{Recording: r.Hash, Url: key}
+	} else if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        ex.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(ex.Body)),
+		ContentLength: int64(len(ex.Body)),
+		Request:       req,
+	}, nil
+}
+
+func (r *fetchRecording) read(method, url string) (*recordedExchange, error) {
+	var header []byte
+	ex := &recordedExchange{}
+	err := r.db.QueryRow("select status, header, body from fetch_exchanges where recording = $1 and method = $2 and url = $3", r.Hash, method, url).
+		Scan(&ex.Status, &header, &ex.Body)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return ex, json.Unmarshal(header, &ex.Header)
+}
+
+// write stores a response, replacing any earlier response to the same request
+func (r *fetchRecording) write(method, url string, ex *recordedExchange) error {
+	header, err := json.Marshal(ex.Header)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`insert into fetch_exchanges (recording,method,url,created,status,header,body) values ($1, $2, $3, $4, $5, $6, $7)
+		on conflict (recording,method,url) do update set created = $4, status = $5, header = $6, body = $7`,
+		r.Hash, method, url, time.Now().Round(time.Second).In(time.UTC), ex.Status, header, ex.Body)
+	return checkWriteErr(err)
+}
+
+// recordingTransport records every response that passes through it, including
+// each hop of a redirect
+type recordingTransport struct {
+	rec  *fetchRecording
+	next http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	key, err := exchangeKey(req)
+	if err != nil {
+		return nil, err
+	}
+	header, err := recordedHeader(req, res.Header)
+	if err != nil {
+		return nil, err
+	}
+	// failing to record shouldn't fail the fetch, but the replay will miss it
+	if err := t.rec.write(req.Method, key, &recordedExchange{Status: res.StatusCode, Header: header, Body: body}); err != nil {
+		log.Infof("error recording %s: %s", key, err.Error())
+	}
+	return res, nil
+}
+
+// recordedHeader copies response headers for recording, redacting redirect
+// targets & dropping cookies
+func recordedHeader(req *http.Request, h http.Header) (http.Header, error) {
+	rec := http.Header{}
+	for key, vals := range h {
+		if key == "Set-Cookie" {
+			continue
+		}
+		rec[key] = append([]string{}, vals...)
+	}
+	if loc := rec.Get("Location"); loc != "" {
+		target, err := req.URL.Parse(loc)
+		if err != nil {
+			return nil, err
+		}
+		redacted, _, err := redactor.Redact(target.String())
+		if err != nil {
+			return nil, err
+		}
+		rec.Set("Location", redacted)
+	}
+	return rec, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestRecordedHeader(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://epa.gov/a?token=secret", nil)
+	h := http.Header{
+		"Content-Type": {"text/html"},
+		"Set-Cookie":   {"session=secret"},
+		"Location":     {"/b?key=secret&page=2"},
+	}
+
+	got, err := recordedHeader(req, h)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Get("Set-Cookie") != "" {
+		t.Errorf("expected cookies to be dropped")
+	}
+	if got.Get("Content-Type") != "text/html" {
+		t.Errorf("expected content type to be kept, got: %s", got.Get("Content-Type"))
+	}
+	loc, _ := url.Parse(got.Get("Location"))
+	if loc.Host != "epa.gov" || loc.Query().Get("key") == "secret" || loc.Query().Get("page") != "2" {
+		t.Errorf("expected location to be resolved & redacted, got: %s", got.Get("Location"))
+	}
+}
+
+func TestNewFetchRecordingDisabled(t *testing.T) {
+	svc := newTestService()
+	svc.Config.RecordFetches = false
+
+	if rec, err := svc.newFetchRecording("http://epa.gov", ArchiveOpts{}); rec != nil || err != nil {
+		t.Errorf("expected no recording without opts, got: %v %v", rec, err)
+	}
+	if _, err := svc.newFetchRecording("http://epa.gov", ArchiveOpts{Record: true}); err != ErrRecordingDisabled {
+		t.Errorf("expected recording to be disabled, got: %v", err)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	defer resetTestData(appDB, "fetch_recordings", "fetch_exchanges")
+
+	site := newTestSite(t, map[string]*testPage{
+		"/":    {Body: `<html><head><title>Before</title></head><body><a href="/old">old</a></body></html>`},
+		"/old": {RedirectTo: "/new?token=secret"},
+		"/new": {Body: `<html><head><title>New</title></head><body></body></html>`},
+	})
+	defer site.Close()
+	svc := site.svc
+	svc.Config.RecordFetches = true
+
+	if _, err := svc.ArchiveUrlSync(site.Url("/"), ArchiveOpts{Record: true}); err != nil {
+		t.Fatal(err.Error())
+	}
+	var hash string
+	if err := svc.DB.QueryRow("select hash from fetch_recordings where url = $1", site.Url("/")).Scan(&hash); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := countRows(t, "select count(1) from fetch_exchanges where recording = $1", hash); got != 3 {
+		t.Errorf("expected every hop to be recorded, got: %d", got)
+	}
+	if got := countRows(t, "select count(1) from fetch_exchanges where url like '%secret%'"); got != 0 {
+		t.Errorf("expected sensitive params to be redacted from recordings")
+	}
+
+	// the live site changes, but replays serve what was recorded
+	site.Lock()
+	site.pages["/"].Body = `<html><head><title>After</title></head><body></body></html>`
+	site.Unlock()
+	requests := len(site.Requests("/"))
+	if _, err := svc.ArchiveUrlSync(site.Url("/"), ArchiveOpts{Replay: hash}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := len(site.Requests("/")); got != requests {
+		t.Errorf("expected replay not to touch the network, got %d new requests", got-requests)
+	}
+	if u := readArchivedUrl(t, site.Url("/")); u.Title != "Before" {
+		t.Errorf("expected replay to serve the recorded response, got title: %s", u.Title)
+	}
+	if u := readArchivedUrl(t, site.Url("/old")); u.Title != "New" {
+		t.Errorf("expected replay to follow recorded redirects, got title: %s", u.Title)
+	}
+
+	// requests that weren't recorded fail loudly
+	rec := &fetchRecording{db: svc.DB, Hash: hash, replay: true}
+	u := &core.Url{Url: site.Url("/unrecorded")}
+	now := time.Now()
+	u.LastGet = &now
+	_, _, err := svc.getUrl(u, rec)
+	if uerr, ok := err.(*url.Error); !ok {
+		t.Errorf("expected replay miss, got: %v", err)
+	} else if _, ok := uerr.Err.(ErrReplayMiss); !ok {
+		t.Errorf("expected replay miss, got: %s", err.Error())
+	}
+
+	if _, err = svc.ArchiveUrlSync(site.Url("/"), ArchiveOpts{Replay: "missing"}); err != core.ErrNotFound {
+		t.Errorf("expected replaying a missing recording to fail, got: %v", err)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replica read-through
+//
+// Content is stored in cfg.ImportContentDir by it's hash. an instance can be
+// missing content another has, it's been swept locally, or the instance is
+// new & still syncing. when cfg.ReplicaPeers lists other instances, content
+// that isn't stored locally is fetched from them in order, verified against
+// it's multihash, written through to the local store & then served. peers are
+// asked with replicaFetchHeader set, so they only serve what they store
+// themselves & peers listing each other can't loop.
+//
+// content that doesn't hash to what was asked for is corrupt. it's never
+// written or served, an alert is published & the next peer is tried. each
+// peer has a circuitBreaker, peers that keep failing aren't asked until
+// they've had time to recover. peers that answer they don't have the content
+// aren't failing. fetches are limited to cfg.ReplicaTimeoutSeconds &
+// cfg.ReplicaMaxMB
+
+const (
+	// failures in a row that open a peer's breaker, & how long it stays open
+	replicaBreakerThreshold = 5
+	replicaBreakerCooldown  = time.Minute
+	// header set on requests for content from peers
+	replicaFetchHeader = "X-Patchbay-Replica"
+)
+
+// EventReplicaCorrupt is published when content fetched from a peer doesn't
+// hash to what was asked for
+const EventReplicaCorrupt = "REPLICA_CORRUPT"
+
+// replicaStats exposes replica read-through counts at /debug/vars
+var replicaStats = expvar.NewMap("replicas")
+
+// errReplicaMissing is returned when a peer doesn't have content
+var errReplicaMissing = fmt.Errorf("peer doesn't have the content")
+
+// ReplicaCorruption describes content from a peer that failed verification
+type ReplicaCorruption struct {
+	Peer     string `json:"peer"`
+	Expected string `json:"expected"`
+	Got      string `json:"got"`
+}
+
+func (c *ReplicaCorruption) Error() string {
+	return fmt.Sprintf("content from %s is corrupt. expected: %s, got: %s", c.Peer, c.Expected, c.Got)
+}
+
+// replicaTooLargeError is returned when content from a peer is over the size cap
+type replicaTooLargeError struct {
+	peer     string
+	maxBytes int64
+}
+
+func (e *replicaTooLargeError) Error() string {
+	return fmt.Sprintf("content from %s is larger than %d bytes", e.peer, e.maxBytes)
+}
+
+// replicaPeer is an instance content can be fetched from
+type replicaPeer struct {
+	// base url, which can include credentials for the peer's admin endpoints
+	url string
+	// url without credentials, for logs & metrics
+	name    string
+	breaker *circuitBreaker
+}
+
+// replicaSet fetches content missing locally from peer instances. it's safe
+// for concurrent use
+type replicaSet struct {
+	sync.Mutex
+	peers    []*replicaPeer
+	client   *http.Client
+	maxBytes int64
+	now      func() time.Time
+	publish  func(e *Event)
+}
+
+// replicas are the configured peers, nil if there are none
+var replicas *replicaSet
+
+// newReplicaSet creates a set of peers, returning nil if there are none.
+// environment variables in peer urls are expanded so credentials needn't be kept in config
+func newReplicaSet(urls []string, timeout time.Duration, maxBytes int64) (*replicaSet, error) {
+	rs := &replicaSet{
+		client:   &http.Client{Timeout: timeout},
+		maxBytes: maxBytes,
+		now:      time.Now,
+		publish:  publishEvent,
+	}
+	for _, raw := range urls {
+		// config reads an unset list as [""]
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		u, err := url.Parse(strings.TrimRight(os.ExpandEnv(raw), "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid replica peer: %s", err.Error())
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid replica peer, expected an http(s) url: %s", raw)
+		}
+		p := &replicaPeer{url: u.String(), breaker: newCircuitBreaker(replicaBreakerThreshold, replicaBreakerCooldown)}
+		u.User = nil
+		p.name = u.String()
+		rs.peers = append(rs.peers, p)
+	}
+	if len(rs.peers) == 0 {
+		return nil, nil
+	}
+	return rs, nil
+}
+
+// configuredReplicas creates the set of peers listed in c
+func configuredReplicas(c *config) (*replicaSet, error) {
+	if c == nil {
+		return nil, nil
+	}
+	return newReplicaSet(c.ReplicaPeers, time.Duration(c.ReplicaTimeoutSeconds)*time.Second, int64(c.ReplicaMaxMB)<<20)
+}
+
+// open opens content stored in dir, fetching it from peers if it isn't. the
+// error satisfies os.IsNotExist if neither dir nor any peer has it
+func (rs *replicaSet) open(db *sql.DB, dir, hash string) (*os.File, error) {
+	f, err := openStoredContent(db, dir, hash)
+	if rs == nil || dir == "" {
+		return f, err
+	}
+	replicaStats.Add("reads", 1)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+	replicaStats.Add("misses", 1)
+	return rs.fetch(dir, hash)
+}
+
+// fetch asks each peer for content in turn, writing the first verified copy
+// to dir & returning it opened
+func (rs *replicaSet) fetch(dir, hash string) (*os.File, error) {
+	hash = strings.ToLower(hash)
+	alg, err := hashAlgorithm(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range rs.peers {
+		if !rs.allow(p) {
+			replicaStats.Add("breakerOpen", 1)
+			continue
+		}
+		f, err := rs.fetchFrom(p, dir, hash, alg)
+		switch err := err.(type) {
+		case nil:
+			rs.result(p, true)
+			replicaStats.Add("fetched", 1)
+			return f, nil
+		case *ReplicaCorruption:
+			rs.result(p, false)
+			replicaStats.Add("corrupt", 1)
+			log.Error(err.Error())
+			rs.publish(&Event{Type: EventReplicaCorrupt, Subject: hash, Data: err})
+		case *replicaTooLargeError:
+			replicaStats.Add("tooLarge", 1)
+			log.Info(err.Error())
+		default:
+			if err == errReplicaMissing {
+				rs.result(p, true)
+				replicaStats.Add("notFound", 1)
+				continue
+			}
+			rs.result(p, false)
+			replicaStats.Add("failures", 1)
+			log.Infof("error fetching %s from %s: %s", hash, p.name, err.Error())
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// fetchFrom fetches content from a peer into a temporary file, moving it into
+// place under hash only once it's verified
+func (rs *replicaSet) fetchFrom(p *replicaPeer, dir, hash, alg string) (*os.File, error) {
+	req, err := http.NewRequest("GET", p.url+"/admin/content/"+hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(replicaFetchHeader, "1")
+	res, err := rs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errReplicaMissing
+	default:
+		return nil, fmt.Errorf("unexpected response status: %d", res.StatusCode)
+	}
+	if res.ContentLength > rs.maxBytes {
+		return nil, &replicaTooLargeError{peer: p.name, maxBytes: rs.maxBytes}
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".replica-")
+	if err != nil {
+		return nil, err
+	}
+	// the temporary file is removed unless it's been moved into place
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h, err := newContentHasher(alg)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(res.Body, rs.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > rs.maxBytes {
+		return nil, &replicaTooLargeError{peer: p.name, maxBytes: rs.maxBytes}
+	}
+	got, err := h.Multihash()
+	if err != nil {
+		return nil, err
+	}
+	if got != hash {
+		return nil, &ReplicaCorruption{Peer: p.name, Expected: hash, Got: got}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, hash)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// allow checks a peer's breaker
+func (rs *replicaSet) allow(p *replicaPeer) bool {
+	rs.Lock()
+	defer rs.Unlock()
+	ok, _ := p.breaker.allow(rs.now())
+	return ok
+}
+
+// result records the outcome of asking a peer on it's breaker
+func (rs *replicaSet) result(p *replicaPeer, ok bool) {
+	rs.Lock()
+	defer rs.Unlock()
+	if ok {
+		p.breaker.success()
+	} else if p.breaker.failure(rs.now()) {
+		log.Infof("replica peer %s failed %d times in a row, not asking it for %s", p.name, replicaBreakerThreshold, replicaBreakerCooldown)
+	}
+}
+
+// writeReplicaMetrics writes replica read-through counts & breaker states as
+// prometheus metrics
+func writeReplicaMetrics(w io.Writer, rs *replicaSet) {
+	count := func(key string) int64 {
+		if v, ok := replicaStats.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	fmt.Fprintln(w, "# HELP patchbay_replica_reads_total content reads that can fall back to replica peers")
+	fmt.Fprintln(w, "# TYPE patchbay_replica_reads_total counter")
+	fmt.Fprintf(w, "patchbay_replica_reads_total %d\n", count("reads"))
+	fmt.Fprintln(w, "# HELP patchbay_replica_fallbacks_total content reads that missed locally & were asked of peers, by result")
+	fmt.Fprintln(w, "# TYPE patchbay_replica_fallbacks_total counter")
+	fmt.Fprintf(w, "patchbay_replica_fallbacks_total{result=\"miss\"} %d\n", count("misses"))
+	for _, key := range []string{"fetched", "notFound", "failures", "corrupt", "tooLarge", "breakerOpen"} {
+		fmt.Fprintf(w, "patchbay_replica_fallbacks_total{result=%q} %d\n", key, count(key))
+	}
+	if rs == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP patchbay_replica_breaker_open replica peers not being asked for content after failing repeatedly")
+	fmt.Fprintln(w, "# TYPE patchbay_replica_breaker_open gauge")
+	for _, p := range rs.peers {
+		open := 0
+		if !rs.allow(p) {
+			open = 1
+		}
+		fmt.Fprintf(w, "patchbay_replica_breaker_open{peer=%q} %d\n", p.name, open)
+	}
+}
+
+// ContentHandler serves /admin/content with the default service
+func ContentHandler(w http.ResponseWriter, r *http.Request) {
+	defaultService().serveContent(w, r)
+}
+
+// serveContent serves stored content at GET /admin/content/{hash}, fetching
+// it from replica peers if it isn't stored locally. requests from peers are
+// only served from local storage. content a moderator suppressed isn't served
+func (s *Service) serveContent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.adminConfigured(w) {
+		return
+	}
+	hash := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/admin/content/"))
+	if !validHash(hash) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid hash"})
+		return
+	}
+	if s.Config == nil || s.Config.ImportContentDir == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": ErrNoBlockStore.Error()})
+		return
+	}
+
+	if suppressed, err := contentSuppressed(s.DB, hash); err != nil {
+		s.Log.Info(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if suppressed {
+		writeJSON(w, http.StatusGone, map[string]string{"error": ErrContentSuppressed.Error()})
+		return
+	}
+
+	rs := s.Replicas
+	if r.Header.Get(replicaFetchHeader) != "" {
+		rs = nil
+	}
+	f, err := rs.open(s.DB, s.Config.ImportContentDir, hash)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(meteredWriter{w, bandwidthServed}, f); err != nil {
+		s.Log.Info(err.Error())
+	}
+}
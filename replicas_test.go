@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replicaHash hashes data the way content is stored
+func replicaHash(t *testing.T, data string) string {
+	h, err := newContentHasher(contentHashAlgorithm)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	h.Write([]byte(data))
+	hash, err := h.Multihash()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return hash
+}
+
+func TestReplicaFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patchbay_replicas")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		good    = replicaHash(t, "good content")
+		corrupt = replicaHash(t, "what was asked for")
+		large   = replicaHash(t, strings.Repeat("a", 64))
+		missing = replicaHash(t, "nobody has this")
+		broken  = replicaHash(t, "the peer is down")
+	)
+	requests := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get(replicaFetchHeader) == "" {
+			t.Errorf("expected peers to be asked with %s set", replicaFetchHeader)
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/admin/content/") {
+		case good:
+			w.Write([]byte("good content"))
+		case corrupt:
+			w.Write([]byte("something else"))
+		case large:
+			// streamed without a length, so the cap is enforced while reading
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("a", 64)))
+		case broken:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer peer.Close()
+
+	rs, err := newReplicaSet([]string{peer.URL + "/"}, time.Second, 32)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	rs.now = func() time.Time { return now }
+	events := []*Event{}
+	rs.publish = func(e *Event) { events = append(events, e) }
+
+	f, err := rs.fetch(dir, good)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(data) != "good content" {
+		t.Errorf("expected fetched content, got: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, good)); err != nil {
+		t.Errorf("expected fetched content to be written through, got: %s", err.Error())
+	}
+
+	for _, hash := range []string{corrupt, large, missing} {
+		if _, err := rs.fetch(dir, hash); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be served, got: %v", hash, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, hash)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be written, got: %v", hash, err)
+		}
+	}
+	if len(events) != 1 || events[0].Type != EventReplicaCorrupt || events[0].Data.(*ReplicaCorruption).Expected != corrupt {
+		t.Errorf("expected an alert for corrupt content only, got: %v", events)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected temporary files to be removed, got %d files", len(files))
+	}
+
+	// a peer that doesn't have content isn't failing, so the corrupt response
+	// no longer counts. the breaker opens after threshold failures in a row
+	for i := 0; i < replicaBreakerThreshold; i++ {
+		rs.fetch(dir, broken)
+	}
+	before := requests
+	if _, err := rs.fetch(dir, replicaHash(t, "asked while the breaker's open")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be fetched while the breaker's open, got: %v", err)
+	}
+	if requests != before {
+		t.Errorf("expected the peer not to be asked while it's breaker is open, got %d requests", requests-before)
+	}
+	now = now.Add(replicaBreakerCooldown)
+	os.Remove(filepath.Join(dir, good))
+	if f, err := rs.fetch(dir, good); err != nil {
+		t.Errorf("expected the peer to be asked again once the breaker cools down, got: %s", err.Error())
+	} else {
+		f.Close()
+	}
+
+	if _, err := newReplicaSet([]string{"peer.example.com"}, time.Second, 32); err == nil {
+		t.Errorf("expected peers without a scheme to be refused")
+	}
+	if rs, err := newReplicaSet(nil, time.Second, 32); rs != nil || err != nil {
+		t.Errorf("expected no peers to configure no replica set, got: %v %v", rs, err)
+	}
+	if rs, err := configuredReplicas(&config{ReplicaPeers: []string{""}}); rs != nil || err != nil {
+		t.Errorf("expected empty peers to be skipped, got: %v %v", rs, err)
+	}
+}
+
+func TestReplicaFallback(t *testing.T) {
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", "patchbay_replicas")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+
+	// two instances sharing a database, each with it's own content
+	primary, secondary := newTestService(), newTestService()
+	primary.Config.ImportContentDir, secondary.Config.ImportContentDir = dirs[0], dirs[1]
+	for _, svc := range []*Service{primary, secondary} {
+		svc.Config.HttpAuthUsername, svc.Config.HttpAuthPassword = "admin", "admin"
+	}
+	peer := httptest.NewServer(http.HandlerFunc(primary.serveContent))
+	defer peer.Close()
+	rs, err := newReplicaSet([]string{peer.URL}, time.Second, 1<<20)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	secondary.Replicas = rs
+	// the primary lists the secondary too, requests from peers mustn't loop
+	back := httptest.NewServer(http.HandlerFunc(secondary.serveContent))
+	defer back.Close()
+	if primary.Replicas, err = newReplicaSet([]string{back.URL}, time.Second, 1<<20); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	const body = "content only the primary has"
+	hash := replicaHash(t, body)
+	if err := ioutil.WriteFile(filepath.Join(dirs[0], hash), []byte(body), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	secondary.serveContent(w, httptest.NewRequest("GET", "/admin/content/"+hash, nil))
+	if w.Code != http.StatusOK || w.Body.String() != body {
+		t.Errorf("expected the secondary to serve content from the primary, got: %d %q", w.Code, w.Body.String())
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dirs[1], hash)); err != nil || string(data) != body {
+		t.Errorf("expected content to be written through to the secondary, got: %q %v", data, err)
+	}
+
+	missing := replicaHash(t, "content neither instance has")
+	w = httptest.NewRecorder()
+	secondary.serveContent(w, httptest.NewRequest("GET", "/admin/content/"+missing, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected content neither instance has to be not found, got: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	secondary.serveContent(w, httptest.NewRequest("GET", "/admin/content/not-a-hash", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid hashes to be refused, got: %d", w.Code)
+	}
+
+	// suppressed content isn't served, locally or to peers
+	const url = "http://www.epa.gov/replicated"
+	defer appDB.Exec("delete from urls where url = $1", url)
+	if _, err := appDB.Exec(`insert into urls (url,created,updated,hash,meta) values ($1, now(), now(), $2, '{"suppressed":true}')`, url, hash); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, svc := range []*Service{primary, secondary} {
+		w = httptest.NewRecorder()
+		svc.serveContent(w, httptest.NewRequest("GET", "/admin/content/"+hash, nil))
+		if w.Code != http.StatusGone {
+			t.Errorf("expected suppressed content to be gone, got: %d", w.Code)
+		}
+	}
+
+	// admin endpoints aren't served without http auth
+	secondary.Config.HttpAuthUsername = ""
+	w = httptest.NewRecorder()
+	secondary.serveContent(w, httptest.NewRequest("GET", "/admin/content/"+missing, nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected content not to be served without http auth, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
+	"github.com/lib/pq"
+)
+
+// Retention classes. every capture made by an archive request has one, captures
+// made any other way (eg: crawls & imports) are standard & never expire
+const (
+	// permanent captures are never removed. captures become permanent when a
+	// registered user writes metadata about them or watches them
+	retentionPermanent = "permanent"
+	// standard captures are archives registered users ask for
+	retentionStandard = "standard"
+	// ephemeral captures are anonymous archives & single links archived on
+	// demand, which are removed once they expire unless someone shows interest
+	retentionEphemeral = "ephemeral"
+)
+
+const (
+	// how long ephemeral captures are kept unless configured
+	defaultEphemeralExpiry = 30 * 24 * time.Hour
+	// expired captures removed per transaction
+	retentionSweepBatchSize = 100
+)
+
+// retentionExpiry is how long captures of each class are kept, classes that
+// aren't listed are kept forever
+var retentionExpiry = map[string]time.Duration{retentionEphemeral: defaultEphemeralExpiry}
+
+// parseRetentionExpiry reads expiries in the form "class:duration", layered
+// over the defaults
+func parseRetentionExpiry(entries []string) (map[string]time.Duration, error) {
+	expiry := map[string]time.Duration{retentionEphemeral: defaultEphemeralExpiry}
+	for _, e := range entries {
+		// config reads an unset list as [""]
+		if strings.TrimSpace(e) == "" {
+			continue
+		}
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retention expiry '%s', expected class:duration", e)
+		}
+		class := strings.TrimSpace(parts[0])
+		if class != retentionStandard && class != retentionEphemeral {
+			return nil, fmt.Errorf("invalid retention expiry '%s', class must be standard or ephemeral", e)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid retention expiry '%s', expected a duration like 720h", e)
+		}
+		expiry[class] = d
+	}
+	return expiry, nil
+}
+
+// configureRetention sets how long captures are kept from config
+func configureRetention(entries []string) error {
+	expiry, err := parseRetentionExpiry(entries)
+	if err != nil {
+		return err
+	}
+	retentionExpiry = expiry
+	return nil
+}
+
+// archiveRetention picks the class of captures made by an archive request.
+// requests from people who haven't said hello with a key are ephemeral
+func archiveRetention(requester string) string {
+	if requester == "" {
+		return retentionEphemeral
+	}
+	return retentionStandard
+}
+
+// retainCapture records the retention class of a capture of url made at now.
+// captures only move to longer lived classes, & ephemeral classes are only
+// recorded for a url's first capture, so an anonymous archive never shortens
+// the life of content that's already archived
+func retainCapture(db *sql.DB, url string, first bool, class string, now time.Time) error {
+	if class == retentionEphemeral && !first {
+		return nil
+	}
+	now = now.Round(time.Second).In(time.UTC)
+	var expires *time.Time
+	if d := retentionExpiry[class]; d > 0 {
+		t := now.Add(d)
+		expires = &t
+	}
+	_, err := db.Exec(`insert into capture_retention (url,created,updated,class,expires) values ($1, $2, $2, $3, $4)
+		on conflict (url) do update set class = excluded.class, expires = excluded.expires, updated = excluded.updated
+		where capture_retention.class = $5 and excluded.class = $6`,
+		url, now, class, expires, retentionEphemeral, retentionStandard)
+	return checkWriteErr(err)
+}
+
+// getRetained GET's a url like getUrl, recording the retention class of the
+// capture. the capture is already stored, failing to record it's class is only logged
+func (s *Service) getRetained(u *core.Url, rec *fetchRecording, class string) ([]byte, []*core.Link, error) {
+	first := u.LastGet == nil
+	body, links, err := s.getUrl(u, rec)
+	if err == nil && u.LastGet != nil {
+		if err := retainCapture(s.DB, u.Url, first, class, s.Clock()); err != nil {
+			s.Log.Infof("error recording retention of %s: %s", u.Url, err.Error())
+		}
+	}
+	return body, links, err
+}
+
+// promoteCaptures makes captures of subject permanent on behalf of a
+// registered user. subject is a url or content hash, captures of any of the
+// hash's aliases are promoted. returns the number of captures promoted
+func promoteCaptures(db *sql.DB, subject, keyId string, now time.Time) (int64, error) {
+	if keyId == "" || subject == "" {
+		return 0, nil
+	}
+	hashes, err := hashAliases(db, subject)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(`update capture_retention set class = $3, expires = null, promoted_by = $4, updated = $5
+		where class != $3 and (url = $1 or url in (select url from urls where hash = any($2)) or url in (select url from snapshots where hash = any($2)))`,
+		subject, pq.Array(hashes), retentionPermanent, keyId, now.Round(time.Second).In(time.UTC))
+	if err := checkWriteErr(err); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// promoteCapturesFor promotes captures for a registered user, logging errors.
+// promotion never fails the request that caused it
+func (s *Service) promoteCapturesFor(subject, keyId string) {
+	if n, err := promoteCaptures(s.DB, subject, keyId, s.Clock()); err != nil {
+		s.Log.Infof("error promoting captures of %s: %s", subject, err.Error())
+	} else if n > 0 {
+		s.Log.Infof("%s made %d captures of %s permanent", keyId, n, subject)
+	}
+}
+
+// RetentionSweep reports what a sweep of expired captures removed
+type RetentionSweep struct {
+	// captures past their expiry
+	Expired int `json:"expired"`
+	// urls removed along with their capture
+	UrlsRemoved int `json:"urlsRemoved"`
+	// urls other pages link to, kept without their capture
+	UrlsCleared int `json:"urlsCleared"`
+	// snapshots of expired captures removed
+	Snapshots int64 `json:"snapshots"`
+	// hashes of stored content no longer referenced, removed by gc
+	Content []string `json:"content"`
+}
+
+// SweepExpiredCaptures removes captures past their expiry: snapshots, outbound
+// links & link provenance are deleted, & the url is deleted too unless other
+// pages link to it. content the captures referenced that nothing else does is
+// handed to gc when contentDir is set. permanent captures are never touched
+func SweepExpiredCaptures(db *sql.DB, store datastore.Datastore, contentDir string, now time.Time) (*RetentionSweep, error) {
+	if err := maintenance.Check(); err != nil {
+		return nil, err
+	}
+	r := &RetentionSweep{Content: []string{}}
+	released := []string{}
+	for {
+		n, hashes, err := sweepCaptureBatch(db, now.Round(time.Second).In(time.UTC), r)
+		if err != nil {
+			return r, checkWriteErr(err)
+		}
+		released = append(released, hashes...)
+		if n < retentionSweepBatchSize {
+			break
+		}
+	}
+
+	if contentDir != "" && len(released) > 0 {
+		removed, err := collectHashes(db, store, contentDir, released)
+		r.Content = append(r.Content, removed...)
+		if err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// sweepCaptureBatch removes a batch of expired captures in a transaction,
+// returning how many it removed & the content hashes they referenced
+func sweepCaptureBatch(db *sql.DB, now time.Time, r *RetentionSweep) (int, []string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	// rows are locked so a promotion can't land between reading & removing a capture
+	rows, err := tx.Query(`select url from capture_retention where class != $1 and expires <= $2
+		order by expires limit $3 for update skip locked`, retentionPermanent, now, retentionSweepBatchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	urls := []string{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		urls = append(urls, url)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	hashes := []string{}
+	removed, cleared := 0, 0
+	var snapshots int64
+	for _, url := range urls {
+		hrows, err := tx.Query("select hash from urls where url = $1 and hash != '' union select hash from snapshots where url = $1 and hash != ''", url)
+		if err != nil {
+			return 0, nil, err
+		}
+		for hrows.Next() {
+			var hash string
+			if err := hrows.Scan(&hash); err != nil {
+				hrows.Close()
+				return 0, nil, err
+			}
+			hashes = append(hashes, hash)
+		}
+		hrows.Close()
+		if err := hrows.Err(); err != nil {
+			return 0, nil, err
+		}
+
+		res, err := tx.Exec("delete from snapshots where url = $1", url)
+		if err != nil {
+			return 0, nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, nil, err
+		}
+		snapshots += n
+		for _, q := range []string{
+			"delete from links where src = $1",
+			"delete from link_sightings where src = $1",
+			"delete from link_events where src = $1",
+			"delete from capture_retention where url = $1",
+			"delete from render_cards where url = $1",
+		} {
+			if _, err := tx.Exec(q, url); err != nil {
+				return 0, nil, err
+			}
+		}
+
+		var linked bool
+		if err := tx.QueryRow("select exists(select 1 from links where dst = $1)", url).Scan(&linked); err != nil {
+			return 0, nil, err
+		}
+		if linked {
+			// deleting the url would delete links from pages that are still archived
+			if _, err := tx.Exec(`update urls set last_head = null, last_get = null, status = 0, content_type = '', content_sniff = '',
+				content_length = 0, file_name = '', title = '', headers_took = 0, download_took = 0, headers = null, hash = ''
+				where url = $1`, url); err != nil {
+				return 0, nil, err
+			}
+			cleared++
+		} else {
+			if _, err := tx.Exec("delete from urls where url = $1", url); err != nil {
+				return 0, nil, err
+			}
+			removed++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	r.Expired += len(urls)
+	r.UrlsRemoved += removed
+	r.UrlsCleared += cleared
+	r.Snapshots += snapshots
+	return len(urls), hashes, nil
+}
+
+// sweepCaptures is the leader task that removes expired captures
+func sweepCaptures(db *sql.DB, now time.Time) {
+	r, err := SweepExpiredCaptures(db, store, cfg.ImportContentDir, now)
+	if err == ErrMaintenanceMode {
+		return
+	} else if err != nil {
+		log.Infof("error sweeping expired captures: %s", err.Error())
+	}
+	if r != nil && r.Expired > 0 {
+		log.Infof("removed %d expired captures: %d urls removed, %d urls kept for their inbound links, %d snapshots, %d content files",
+			r.Expired, r.UrlsRemoved, r.UrlsCleared, r.Snapshots, len(r.Content))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestParseRetentionExpiry(t *testing.T) {
+	cases := []struct {
+		entries   []string
+		ephemeral time.Duration
+		standard  time.Duration
+		err       bool
+	}{
+		{nil, defaultEphemeralExpiry, 0, false},
+		{[]string{""}, defaultEphemeralExpiry, 0, false},
+		{[]string{"ephemeral:168h", "standard:8760h"}, 168 * time.Hour, 8760 * time.Hour, false},
+		{[]string{" ephemeral : 0 "}, 0, 0, false},
+		{[]string{"permanent:24h"}, 0, 0, true},
+		{[]string{"ephemeral"}, 0, 0, true},
+		{[]string{"ephemeral:a week"}, 0, 0, true},
+		{[]string{"ephemeral:-1h"}, 0, 0, true},
+	}
+
+	for i, c := range cases {
+		got, err := parseRetentionExpiry(c.entries)
+		if (err != nil) != c.err {
+			t.Errorf("case %d expected error to be %t, got: %v", i, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got[retentionEphemeral] != c.ephemeral || got[retentionStandard] != c.standard {
+			t.Errorf("case %d expected ephemeral %s & standard %s, got: %v", i, c.ephemeral, c.standard, got)
+		}
+	}
+}
+
+// captureRetention reads the class of url's capture, "" if it isn't recorded
+func captureRetention(t *testing.T, url string) string {
+	var class string
+	if err := appDB.QueryRow("select class from capture_retention where url = $1", url).Scan(&class); err != nil && err != sql.ErrNoRows {
+		t.Fatal(err.Error())
+	}
+	return class
+}
+
+func TestCapturePromotion(t *testing.T) {
+	defer resetTestData(appDB, "urls", "snapshots", "capture_retention", "metadata")
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	const hash = "1220459219b10032cc86dcdbc0f83aea15a9d3e1119e7b5170beaee233008ea2c2de"
+	for _, url := range []string{"http://epa.gov/trial", "http://epa.gov/watched", "http://epa.gov/archived"} {
+		u := &core.Url{Url: url, Hash: hash, LastGet: &now, Status: 200}
+		if url == "http://epa.gov/watched" {
+			u.Hash = ""
+		}
+		if err := u.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	steps := []struct {
+		url   string
+		first bool
+		class string
+		// class after the step
+		expect string
+	}{
+		// anonymous archives of urls that were already captured don't shorten their life
+		{"http://epa.gov/archived", false, retentionEphemeral, ""},
+		{"http://epa.gov/trial", true, retentionEphemeral, retentionEphemeral},
+		{"http://epa.gov/watched", true, retentionEphemeral, retentionEphemeral},
+		// registered users archiving an ephemeral capture make it standard
+		{"http://epa.gov/archived", true, retentionStandard, retentionStandard},
+		// & captures never move back
+		{"http://epa.gov/archived", true, retentionEphemeral, retentionStandard},
+	}
+	for i, s := range steps {
+		if err := retainCapture(appDB, s.url, s.first, s.class, now); err != nil {
+			t.Fatal(err.Error())
+		}
+		if got := captureRetention(t, s.url); got != s.expect {
+			t.Errorf("step %d expected %s to be %q, got: %q", i, s.url, s.expect, got)
+		}
+	}
+
+	// anonymous requesters can't promote
+	if n, err := promoteCaptures(appDB, hash, "", now); err != nil || n != 0 {
+		t.Errorf("expected anonymous promotion to do nothing, got: %d %v", n, err)
+	}
+
+	// metadata about the content makes every capture of it permanent
+	s := newTestService()
+	if err := s.WriteMetadata(&core.Metadata{KeyId: "key", Subject: hash, Meta: map[string]interface{}{"title": "EPA"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, url := range []string{"http://epa.gov/trial", "http://epa.gov/archived"} {
+		if got := captureRetention(t, url); got != retentionPermanent {
+			t.Errorf("expected metadata to make %s permanent, got: %q", url, got)
+		}
+	}
+	if got := captureRetention(t, "http://epa.gov/watched"); got != retentionEphemeral {
+		t.Errorf("expected captures of other content to stay ephemeral, got: %q", got)
+	}
+
+	// watching a url makes it permanent too
+	if n, err := promoteCaptures(appDB, "http://epa.gov/watched", "key", now); err != nil || n != 1 {
+		t.Errorf("expected watching to promote 1 capture, got: %d %v", n, err)
+	}
+}
+
+func TestSweepExpiredCaptures(t *testing.T) {
+	defer resetTestData(appDB, "urls", "links", "snapshots", "capture_retention")
+	dir, hashes := storeTestBlocks(t, "<html>trial</html>", "<html>kept</html>", "<html>linked</html>")
+	defer os.RemoveAll(dir)
+
+	then := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	urls := []string{"http://epa.gov/trial", "http://epa.gov/kept", "http://epa.gov/linked", "http://epa.gov"}
+	for i, url := range urls {
+		u := &core.Url{Url: url, LastGet: &then, Status: 200}
+		if i < len(hashes) {
+			u.Hash = hashes[i]
+		}
+		if err := u.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := core.WriteSnapshot(store, u); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// a standard page links to the last ephemeral capture
+	if _, err := saveExtractedLink(appDB, &core.Url{Url: "http://epa.gov"}, "http://epa.gov/linked", "html"); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, url := range urls[:3] {
+		if err := retainCapture(appDB, url, true, retentionEphemeral, then); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if _, err := promoteCaptures(appDB, "http://epa.gov/kept", "key", then); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// nothing has expired yet
+	r, err := SweepExpiredCaptures(appDB, store, dir, then.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Expired != 0 {
+		t.Errorf("expected no captures to expire, got: %#v", r)
+	}
+
+	r, err = SweepExpiredCaptures(appDB, store, dir, then.Add(defaultEphemeralExpiry))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Expired != 2 || r.UrlsRemoved != 1 || r.UrlsCleared != 1 || r.Snapshots != 2 || len(r.Content) != 2 {
+		t.Errorf("unexpected sweep: %#v", r)
+	}
+
+	if err := (&core.Url{Url: "http://epa.gov/trial"}).Read(store); err != ErrNotFound {
+		t.Errorf("expected expired url to be removed, got: %v", err)
+	}
+	linked := &core.Url{Url: "http://epa.gov/linked"}
+	if err := linked.Read(store); err != nil || linked.Hash != "" || linked.LastGet != nil {
+		t.Errorf("expected linked url to be kept without it's capture, got: %#v %v", linked, err)
+	}
+	if exists, err := linkExists(appDB, "http://epa.gov", "http://epa.gov/linked"); err != nil || !exists {
+		t.Errorf("expected links to the cleared url to be kept, got: %v", err)
+	}
+	if got := captureRetention(t, "http://epa.gov/kept"); got != retentionPermanent {
+		t.Errorf("expected permanent capture to be untouched, got: %q", got)
+	}
+	for i, hash := range hashes {
+		_, err := ioutil.ReadFile(filepath.Join(dir, hash))
+		if removed := os.IsNotExist(err); removed != (i != 1) {
+			t.Errorf("case %d expected content removed to be %t, got: %v", i, i != 1, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Retries
+//
+// backoff spaces out retries of work that failed against something outside
+// patchbay, & circuitBreaker stops retrying against a destination that keeps
+// failing until it's had time to recover. neither is safe for concurrent use,
+// callers retrying from more than one goroutine keep one each
+
+// backoff is how long to wait before retrying after attempt (counting from 1)
+// failed: base doubled for each attempt after the first, capped at max. the
+// wait is jittered between half & all of that, so retries of work that failed
+// together spread out
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// circuitBreaker opens after threshold failures in a row, refusing attempts
+// until cooldown has passed. once it has, attempts are let through again &
+// the first failure reopens it
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports weather an attempt can be made at now, & if not, when one can be
+func (b *circuitBreaker) allow(now time.Time) (bool, time.Time) {
+	if now.Before(b.openUntil) {
+		return false, b.openUntil
+	}
+	return true, now
+}
+
+// success closes the breaker
+func (b *circuitBreaker) success() {
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// failure counts a failed attempt made at now, reporting weather it opened the breaker
+func (b *circuitBreaker) failure(now time.Time) bool {
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{1, 5 * time.Second, 10 * time.Second},
+		{2, 10 * time.Second, 20 * time.Second},
+		{4, 40 * time.Second, 80 * time.Second},
+		// capped
+		{10, 30 * time.Minute, time.Hour},
+		{1000, 30 * time.Minute, time.Hour},
+	}
+
+	for i, c := range cases {
+		for j := 0; j < 20; j++ {
+			if d := backoff(c.attempt, 10*time.Second, time.Hour); d < c.min || d > c.max {
+				t.Errorf("case %d expected backoff between %s & %s, got: %s", i, c.min, c.max, d)
+				break
+			}
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(3, time.Minute)
+
+	// failures in a row open the breaker, a success resets the count
+	b.failure(now)
+	b.failure(now)
+	b.success()
+	if b.failure(now) || b.failure(now) {
+		t.Errorf("expected a success to reset failures")
+	}
+	if !b.failure(now) {
+		t.Errorf("expected the third failure in a row to open the breaker")
+	}
+	if ok, retry := b.allow(now.Add(time.Second)); ok || !retry.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the breaker to refuse attempts until %s, got: %t %s", now.Add(time.Minute), ok, retry)
+	}
+
+	// after cooldown an attempt is let through, & a failure reopens it
+	now = now.Add(time.Minute)
+	if ok, _ := b.allow(now); !ok {
+		t.Errorf("expected an attempt to be allowed after cooldown")
+	}
+	if !b.failure(now) {
+		t.Errorf("expected a failure after cooldown to reopen the breaker")
+	}
+	b.success()
+	if ok, _ := b.allow(now); !ok {
+		t.Errorf("expected a success to close the breaker")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+const (
+	// robotsMetaKey is the source meta key that makes captures under that
+	// source obey the robots.txt of the site they're from, eg: {"obeyRobots": true}
+	robotsMetaKey = "obeyRobots"
+	// how long a site's robots.txt is used before it's fetched again
+	robotsCacheTTL = time.Hour
+	// largest robots.txt read, the rest is ignored
+	maxRobotsSize = 512 * 1024
+)
+
+// ErrRobotsDisallowed is returned when capturing a url it's site's robots.txt disallows
+var ErrRobotsDisallowed = fmt.Errorf("robots.txt disallows archiving this url")
+
+// obeysRobots checks if captures under a source should obey robots.txt
+func obeysRobots(s *core.Source) bool {
+	return s != nil && s.Meta[robotsMetaKey] == true
+}
+
+// robotsRules are the allow & disallow path prefixes robots.txt lists for
+// every user agent ("User-agent: *")
+type robotsRules struct {
+	allow, disallow []string
+}
+
+// parseRobots reads the rules for every user agent from a robots.txt
+func parseRobots(body []byte) *robotsRules {
+	r := &robotsRules{}
+	var (
+		// weather the current group applies to every user agent
+		everyone bool
+		// weather the current group has rules yet, a user-agent line after
+		// rules starts a new group
+		grouped bool
+	)
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "user-agent":
+			if grouped {
+				everyone, grouped = false, false
+			}
+			if value == "*" {
+				everyone = true
+			}
+		case "allow", "disallow":
+			grouped = true
+			if !everyone || value == "" {
+				continue
+			}
+			if key == "allow" {
+				r.allow = append(r.allow, value)
+			} else {
+				r.disallow = append(r.disallow, value)
+			}
+		}
+	}
+	return r
+}
+
+// allows checks a path against the rules. the longest matching prefix wins,
+// allow wins ties
+func (r *robotsRules) allows(path string) bool {
+	longest := func(prefixes []string) (n int) {
+		for _, p := range prefixes {
+			if strings.HasPrefix(path, p) && len(p) > n {
+				n = len(p)
+			}
+		}
+		return
+	}
+	return longest(r.disallow) <= longest(r.allow)
+}
+
+// robotsCache keeps the rules of each site's robots.txt, by scheme & host
+type robotsCache struct {
+	sync.Mutex
+	sites map[string]*robotsEntry
+}
+
+type robotsEntry struct {
+	rules   *robotsRules
+	fetched time.Time
+}
+
+// robots is the package-level robots.txt cache
+var robots = &robotsCache{sites: map[string]*robotsEntry{}}
+
+// check returns ErrRobotsDisallowed if the robots.txt of rawurl's site
+// disallows it, fetching robots.txt through e if it isn't cached. sites
+// without a robots.txt allow everything. robots.txt itself is always allowed
+func (c *robotsCache) check(e *egress, rawurl string, now time.Time) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Path == "/robots.txt" {
+		return nil
+	}
+	site := u.Scheme + "://" + u.Host
+
+	c.Lock()
+	entry := c.sites[site]
+	c.Unlock()
+	if entry == nil || now.Sub(entry.fetched) > robotsCacheTTL {
+		rules, err := fetchRobots(e, site)
+		if err != nil {
+			return err
+		}
+		entry = &robotsEntry{rules: rules, fetched: now}
+		c.Lock()
+		c.sites[site] = entry
+		c.Unlock()
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if !entry.rules.allows(path) {
+		return ErrRobotsDisallowed
+	}
+	return nil
+}
+
+// fetchRobots reads the rules of a site's robots.txt. a missing robots.txt
+// allows everything, server errors are returned so they aren't cached
+func fetchRobots(e *egress, site string) (*robotsRules, error) {
+	req, err := http.NewRequest("GET", site+"/robots.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := e.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 500:
+		return nil, fmt.Errorf("error reading %s/robots.txt: %s", site, res.Status)
+	case res.StatusCode != http.StatusOK:
+		return &robotsRules{}, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxRobotsSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseRobots(body), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRobotsRules(t *testing.T) {
+	r := parseRobots([]byte(`# comments are ignored
+User-agent: somebot
+Disallow: /
+
+User-agent: otherbot
+User-agent: *
+Disallow: /private # trailing comment
+Allow: /private/public
+Disallow:
+`))
+
+	cases := []struct {
+		path  string
+		allow bool
+	}{
+		{"/", true},
+		{"/index.html", true},
+		{"/private", false},
+		{"/private/a", false},
+		{"/private/public", true},
+		{"/private/public/a", true},
+		{"/privately", false},
+	}
+	for i, c := range cases {
+		if got := r.allows(c.path); got != c.allow {
+			t.Errorf("case %d %s expected allows to be %t", i, c.path, c.allow)
+		}
+	}
+
+	if !parseRobots(nil).allows("/private") {
+		t.Errorf("expected an empty robots.txt to allow everything")
+	}
+}
+
+func TestRobotsCache(t *testing.T) {
+	var (
+		robotsStatus = http.StatusOK
+		requests     int
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(robotsStatus)
+		w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+	}))
+	defer s.Close()
+
+	rc := &robotsCache{sites: map[string]*robotsEntry{}}
+	e := newEgress(egressDirect, nil, true)
+	now := time.Now()
+
+	cases := []struct {
+		url      string
+		now      time.Time
+		err      error
+		requests int
+	}{
+		{s.URL + "/robots.txt", now, nil, 0},
+		{s.URL + "/private/a", now, ErrRobotsDisallowed, 1},
+		{s.URL + "/public", now, nil, 1},
+		{s.URL + "/public", now.Add(robotsCacheTTL * 2), nil, 2},
+	}
+	for i, c := range cases {
+		if err := rc.check(e, c.url, c.now); err != c.err {
+			t.Errorf("case %d error mismatch. expected: %v, got: %v", i, c.err, err)
+		}
+		if requests != c.requests {
+			t.Errorf("case %d expected %d robots.txt requests, got: %d", i, c.requests, requests)
+		}
+	}
+
+	// a missing robots.txt allows everything
+	robotsStatus = http.StatusNotFound
+	rc = &robotsCache{sites: map[string]*robotsEntry{}}
+	if err := rc.check(e, s.URL+"/private/a", now); err != nil {
+		t.Errorf("expected a missing robots.txt to allow everything, got: %s", err.Error())
+	}
+}
@@ -4,47 +4,336 @@
 
 package main
 
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// roomDeliveryShards is how many workers send messages to a room's clients.
+	// each client is sent to by a single shard, so it's messages stay in order
+	roomDeliveryShards = 16
+	// most deliveries waiting on a shard before the hub blocks
+	roomShardQueueSize = 256
+)
+
+var (
+	// roomStats exposes message fan-out counts & latency at /debug/vars
+	roomStats = expvar.NewMap("room")
+	// messages delivered for the most recent fan-out
+	roomLastDeliveries = new(expvar.Int)
+)
+
+func init() {
+	roomStats.Set("lastFanoutDeliveries", roomLastDeliveries)
+}
+
 // room maintains the set of active clients and broadcasts messages to the
 // clients.
 type Room struct {
 	// Registered clients.
 	clients map[*Client]bool
+	// Registered clients by id, clients without an id aren't listed
+	ids map[string]*Client
+	// Clients subscribed to each topic, eg: "subject:[hash]", & the filter
+	// each subscription's events must pass. nil filters allow every event
+	topics map[string]map[*Client]*eventFilter
 	// Inbound messages from the clients.
 	broadcast chan []byte
+	// Messages for all clients subscribed to a topic
+	publish chan *topicMessage
+	// Messages for specific clients
+	direct chan *directMessage
+	// Messages for every client a filter allows
+	filtered chan *filteredMessage
+	// Subscribe & unsubscribe requests from clients
+	subscribe   chan *subscription
+	unsubscribe chan *subscription
 	// Register requests from the clients.
 	register chan *Client
 	// Unregister requests from clients.
 	unregister chan *Client
+	// Server requests for specific clients, & the requests awaiting replies
+	requests chan *outboundRequest
+	replies  *pendingReplies
+	// funcs called (in their own goroutine) each time a client leaves the room
+	onUnregister []func(c *Client)
+	// workers that send messages to clients, & the shard each client is sent to by
+	shards      []*deliveryShard
+	clientShard map[*Client]*deliveryShard
+	nextShard   int
+	// registered clients, readable outside the run loop to count the messages
+	// waiting to be sent to them
+	registered sync.Map
+}
+
+// topicMessage is a message for all subscribers of a topic, except the sender
+// & subscribers who's filters don't allow it
+type topicMessage struct {
+	topic  string
+	sender *Client
+	data   []byte
+	// type of event the message carries
+	event string
+	// key id of the user who caused the event, if any
+	author string
+	// weather the event changed content, see SubscriptionFilter
+	contentChanged bool
+	// level of the event, if it's more severe than it's type's
+	severity int
+}
+
+// directMessage is a message for a list of specific clients
+type directMessage struct {
+	clients []*Client
+	data    []byte
+}
+
+// filteredMessage is a message for every client allow returns true for. allow
+// is called from the run loop, so it must be fast & must not block
+type filteredMessage struct {
+	allow func(c *Client) bool
+	data  []byte
+}
+
+// subscription connects a client to a topic
+type subscription struct {
+	client *Client
+	topic  string
+	filter *eventFilter
 }
 
 func newRoom() *Room {
-	return &Room{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+	h := &Room{
+		broadcast:   make(chan []byte),
+		publish:     make(chan *topicMessage),
+		direct:      make(chan *directMessage),
+		filtered:    make(chan *filteredMessage),
+		subscribe:   make(chan *subscription),
+		unsubscribe: make(chan *subscription),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		requests:    make(chan *outboundRequest),
+		replies:     &pendingReplies{requests: map[string]*pendingReply{}},
+		clients:     make(map[*Client]bool),
+		ids:         make(map[string]*Client),
+		topics:      make(map[string]map[*Client]*eventFilter),
+		clientShard: make(map[*Client]*deliveryShard),
 	}
+	for i := 0; i < roomDeliveryShards; i++ {
+		h.shards = append(h.shards, &deliveryShard{
+			hub:     h,
+			queue:   make(chan *delivery, roomShardQueueSize),
+			dropped: map[*Client]bool{},
+		})
+	}
+	return h
 }
 
 func (h *Room) run() {
+	for _, shard := range h.shards {
+		go shard.run()
+	}
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			h.registered.Store(client, true)
+			if client.id != "" {
+				h.ids[client.id] = client
+			}
+			h.clientShard[client] = h.shards[h.nextShard]
+			h.nextShard = (h.nextShard + 1) % len(h.shards)
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.remove(client)
 			}
 		case message := <-h.broadcast:
+			clients := make([]*Client, 0, len(h.clients))
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
+				clients = append(clients, client)
+			}
+			h.fanout(clients, message)
+		case msg := <-h.publish:
+			clients := make([]*Client, 0, len(h.topics[msg.topic]))
+			for client, filter := range h.topics[msg.topic] {
+				if client != msg.sender && filter.allows(msg) {
+					clients = append(clients, client)
+				}
+			}
+			h.fanout(clients, msg.data)
+		case msg := <-h.direct:
+			clients := make([]*Client, 0, len(msg.clients))
+			for _, client := range msg.clients {
+				if h.clients[client] {
+					clients = append(clients, client)
+				}
+			}
+			h.fanout(clients, msg.data)
+		case msg := <-h.filtered:
+			clients := []*Client{}
+			for client := range h.clients {
+				if msg.allow(client) {
+					clients = append(clients, client)
+				}
+			}
+			h.fanout(clients, msg.data)
+		case sub := <-h.subscribe:
+			if !h.clients[sub.client] {
+				continue
+			}
+			if h.topics[sub.topic] == nil {
+				h.topics[sub.topic] = map[*Client]*eventFilter{}
+			}
+			// subscribing again replaces the subscription's filter
+			h.topics[sub.topic][sub.client] = sub.filter
+		case sub := <-h.unsubscribe:
+			h.removeSubscription(sub.client, sub.topic)
+		case out := <-h.requests:
+			h.sendRequest(out)
+		}
+	}
+}
+
+// fanout hands a message to the shards of each client it's for. the message
+// is marshaled once by the sender & shared by every delivery. must only be
+// called from the run loop
+func (h *Room) fanout(clients []*Client, data []byte) {
+	if len(clients) == 0 {
+		return
+	}
+	groups := map[*deliveryShard][]*Client{}
+	for _, client := range clients {
+		shard := h.clientShard[client]
+		groups[shard] = append(groups[shard], client)
+	}
+	f := &fanout{start: time.Now(), shards: int32(len(groups))}
+	for shard, clients := range groups {
+		shard.queue <- &delivery{clients: clients, data: data, fanout: f}
+	}
+}
+
+// remove a client, all it's subscriptions & any server requests waiting on it,
+// must only be called from the run loop. the client's shard closes it's send
+// channel once earlier messages are sent
+func (h *Room) remove(client *Client) {
+	delete(h.clients, client)
+	h.registered.Delete(client)
+	if h.ids[client.id] == client {
+		delete(h.ids, client.id)
+	}
+	h.replies.clientGone(client)
+	for topic := range h.topics {
+		h.removeSubscription(client, topic)
+	}
+	if shard, ok := h.clientShard[client]; ok {
+		delete(h.clientShard, client)
+		shard.queue <- &delivery{clients: []*Client{client}}
+	}
+	for _, fn := range h.onUnregister {
+		go fn(client)
+	}
+}
+
+func (h *Room) removeSubscription(client *Client, topic string) {
+	if subs, ok := h.topics[topic]; ok {
+		delete(subs, client)
+		if len(subs) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+}
+
+// queued counts messages waiting to be sent: deliveries queued on shards &
+// messages in client send buffers. safe to call from any goroutine
+func (h *Room) queued() int {
+	n := 0
+	for _, shard := range h.shards {
+		n += len(shard.queue)
+	}
+	h.registered.Range(func(c, _ interface{}) bool {
+		n += len(c.(*Client).send)
+		return true
+	})
+	return n
+}
+
+// subjectTopic is the topic name for activity concerning a subject hash
+func subjectTopic(subject string) string {
+	return "subject:" + subject
+}
+
+// delivery is a message for a shard to send to some of it's clients. deliveries
+// without data close the clients' send channels instead
+type delivery struct {
+	clients []*Client
+	data    []byte
+	fanout  *fanout
+}
+
+// fanout tracks a message's delivery across shards
+type fanout struct {
+	start time.Time
+	// shards yet to finish delivering
+	shards    int32
+	delivered int64
+}
+
+// done records a shard finishing it's part of the fan-out. the last shard to
+// finish records the fan-out's latency & delivery count
+func (f *fanout) done(delivered int) {
+	total := atomic.AddInt64(&f.delivered, int64(delivered))
+	if atomic.AddInt32(&f.shards, -1) != 0 {
+		return
+	}
+	roomStats.Add("fanouts", 1)
+	roomStats.Add("fanoutMicros", int64(time.Since(f.start)/time.Microsecond))
+	roomStats.Add("deliveries", total)
+	roomLastDeliveries.Set(total)
+}
+
+// deliveryShard sends messages to a subset of a room's clients, so one slow
+// client's messages can't hold up clients on other shards
+type deliveryShard struct {
+	hub   *Room
+	queue chan *delivery
+	// clients dropped for falling behind, whose send channels are already closed.
+	// only touched by run
+	dropped map[*Client]bool
+}
+
+func (s *deliveryShard) run() {
+	for d := range s.queue {
+		if d.data == nil {
+			for _, client := range d.clients {
+				if s.dropped[client] {
+					delete(s.dropped, client)
+				} else {
 					close(client.send)
-					delete(h.clients, client)
 				}
 			}
+			continue
+		}
+
+		delivered := 0
+		for _, client := range d.clients {
+			if s.dropped[client] {
+				continue
+			}
+			select {
+			case client.send <- d.data:
+				delivered++
+			default:
+				// the client's send buffer is full, drop it. the hub is told
+				// from another goroutine, it may be blocked sending to this shard
+				s.dropped[client] = true
+				close(client.send)
+				roomStats.Add("dropped", 1)
+				go func(c *Client) { s.hub.unregister <- c }(client)
+			}
 		}
+		d.fanout.done(delivered)
 	}
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoomOrdering(t *testing.T) {
+	hub := newRoom()
+	go hub.run()
+
+	clients := make([]*Client, 40)
+	for i := range clients {
+		clients[i] = &Client{hub: hub, send: make(chan []byte, 256)}
+		hub.register <- clients[i]
+	}
+
+	for i := 0; i < 100; i++ {
+		hub.broadcast <- []byte(fmt.Sprintf("%d", i))
+	}
+
+	for i, c := range clients {
+		for j := 0; j < 100; j++ {
+			select {
+			case msg := <-c.send:
+				if string(msg) != fmt.Sprintf("%d", j) {
+					t.Fatalf("client %d expected message %d, got: %s", i, j, msg)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("client %d timed out waiting for message %d", i, j)
+			}
+		}
+	}
+}
+
+func TestRoomSlowClient(t *testing.T) {
+	hub := newRoom()
+	go hub.run()
+
+	unregistered := make(chan *Client, 1)
+	hub.onUnregister = append(hub.onUnregister, func(c *Client) { unregistered <- c })
+
+	// slow never reads, so it's buffer fills after the first message
+	slow := &Client{hub: hub, send: make(chan []byte, 1)}
+	hub.register <- slow
+	fast := make([]*Client, roomDeliveryShards)
+	for i := range fast {
+		fast[i] = &Client{hub: hub, send: make(chan []byte, 256)}
+		hub.register <- fast[i]
+	}
+
+	for i := 0; i < 10; i++ {
+		hub.broadcast <- []byte(fmt.Sprintf("%d", i))
+	}
+
+	for i, c := range fast {
+		for j := 0; j < 10; j++ {
+			select {
+			case <-c.send:
+			case <-time.After(time.Second):
+				t.Fatalf("client %d timed out waiting for message %d", i, j)
+			}
+		}
+	}
+
+	select {
+	case c := <-unregistered:
+		if c != slow {
+			t.Errorf("expected slow client to be unregistered")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected slow client to be dropped")
+	}
+	if msg, ok := <-slow.send; !ok || string(msg) != "0" {
+		t.Errorf("expected slow client to get the first message, got: %s", msg)
+	}
+	if _, ok := <-slow.send; ok {
+		t.Errorf("expected slow client's send channel to be closed")
+	}
+}
+
+func BenchmarkRoomFanout(b *testing.B) {
+	for _, subscribers := range []int{100, 1000, 5000} {
+		b.Run(fmt.Sprintf("%d", subscribers), func(b *testing.B) {
+			hub := newRoom()
+			go hub.run()
+
+			var wg sync.WaitGroup
+			for i := 0; i < subscribers; i++ {
+				c := &Client{hub: hub, send: make(chan []byte, 256)}
+				hub.register <- c
+				go func() {
+					for range c.send {
+						wg.Done()
+					}
+				}()
+			}
+
+			msg := []byte(`{"type":"BENCHMARK"}`)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				wg.Add(subscribers)
+				hub.broadcast <- msg
+				wg.Wait()
+			}
+		})
+	}
+}
+
+func TestRoomFiltered(t *testing.T) {
+	hub := newRoom()
+	go hub.run()
+
+	member := &Client{hub: hub, send: make(chan []byte, 4)}
+	member.setKeyId("member")
+	stranger := &Client{hub: hub, send: make(chan []byte, 4)}
+	hub.register <- member
+	hub.register <- stranger
+
+	hub.filtered <- &filteredMessage{allow: func(c *Client) bool { return c.requester() == "member" }, data: []byte("secret")}
+	hub.broadcast <- []byte("public")
+
+	for _, expect := range []string{"secret", "public"} {
+		select {
+		case msg := <-member.send:
+			if string(msg) != expect {
+				t.Errorf("expected member to get %s, got: %s", expect, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("member timed out waiting for %s", expect)
+		}
+	}
+	select {
+	case msg := <-stranger.send:
+		if string(msg) != "public" {
+			t.Errorf("expected stranger to only get public messages, got: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stranger timed out waiting for public message")
+	}
+}
+
+func TestRoomQueued(t *testing.T) {
+	hub := newRoom()
+	go hub.run()
+
+	clients := make([]*Client, 3)
+	for i := range clients {
+		clients[i] = &Client{hub: hub, send: make(chan []byte, 8)}
+		hub.register <- clients[i]
+	}
+	for i := 0; i < 2; i++ {
+		hub.broadcast <- []byte(fmt.Sprintf("%d", i))
+	}
+
+	// deliveries are handed to shards in the background
+	deadline := time.Now().Add(time.Second)
+	for hub.queued() != 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := hub.queued(); n != 6 {
+		t.Errorf("expected 6 queued messages, got: %d", n)
+	}
+
+	<-clients[0].send
+	hub.unregister <- clients[1]
+	deadline = time.Now().Add(time.Second)
+	for hub.queued() != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := hub.queued(); n != 3 {
+		t.Errorf("expected sent & unregistered clients' messages not to count, got: %d", n)
+	}
+}
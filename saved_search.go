@@ -0,0 +1,755 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// EventSavedSearchesChanged is published whenever a saved search is saved
+	// or deleted, so every instance reloads it's index
+	EventSavedSearchesChanged = "SAVED_SEARCHES_CHANGED"
+
+	// most writes & captures waiting to be checked against saved searches
+	savedSearchQueueSize = 1024
+	// most urls checked for a single metadata write
+	savedSearchUrlLimit = 100
+)
+
+var (
+	// ErrSavedSearchesDisabled is returned for saved search requests when they're turned off
+	ErrSavedSearchesDisabled = fmt.Errorf("saved searches aren't available")
+	// ErrSavedSearchLimit is returned when saving more searches than a user is allowed
+	ErrSavedSearchLimit = fmt.Errorf("you've reached the limit for saved searches, please delete one first")
+	// ErrSavedSearchEmpty is returned for searches that would match everything
+	ErrSavedSearchEmpty = fmt.Errorf("saved searches need a subprimer, tag or query")
+	// ErrWebhooksDisabled is returned when saving a search with a webhook while they're turned off
+	ErrWebhooksDisabled = fmt.Errorf("saved search webhooks aren't available")
+)
+
+// savedSearchStats exposes saved search evaluation counts at /debug/vars
+var savedSearchStats = expvar.NewMap("savedSearches")
+
+// savedSearchTagKeys are the metadata keys tags are read from. values can be a
+// single string or a list of strings
+var savedSearchTagKeys = []string{"tags", "keywords"}
+
+// SavedSearch is a standing query. Researchers are notified each time a url
+// first matches it, either when it's captured or when metadata is written for
+// it's content. Every filter that's set must match
+type SavedSearch struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// key id of the researcher who saved the search
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	// subprimer matching urls must fall under, empty for any
+	SourceId string `json:"sourceId"`
+	// tag metadata must have, see savedSearchTagKeys. empty for any
+	Tag string `json:"tag"`
+	// text matching urls, titles or metadata values must contain
+	Query string `json:"query"`
+	// url matches are POST'ed to, if any
+	Webhook string `json:"webhook,omitempty"`
+	// inactive searches are kept but not evaluated
+	Active bool `json:"active"`
+}
+
+// SavedSearchMatch is a url that matched a saved search
+type SavedSearchMatch struct {
+	SearchId string `json:"searchId"`
+	Url      string `json:"url"`
+	// content hash of the url when it matched, if it had been captured
+	Subject string    `json:"subject,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// savedSearchCols are the columns of saved_searches
+var savedSearchCols = &columnSet{
+	table:   "saved_searches",
+	columns: []string{"id", "created", "updated", "owner", "name", "source_id", "tag", "query", "webhook", "active"},
+}
+
+// scanTargets maps savedSearchCols to the search's fields
+func (s *SavedSearch) scanTargets() scanTargets {
+	return scanTargets{
+		"id":        &s.Id,
+		"created":   &s.Created,
+		"updated":   &s.Updated,
+		"owner":     &s.Owner,
+		"name":      &s.Name,
+		"source_id": &s.SourceId,
+		"tag":       &s.Tag,
+		"query":     &s.Query,
+		"webhook":   &s.Webhook,
+		"active":    &s.Active,
+	}
+}
+
+// savedSearchSubject is the subject clients subscribe to for a search's
+// matches, see SubjectSubscribeAction
+func savedSearchSubject(id string) string {
+	return "saved_search." + id
+}
+
+// validate cleans up a search's filters, checking it can't match everything
+// & it's webhook (if any) is valid, see validWebhookUrl
+func (s *SavedSearch) validate(webhooks, allowInternal bool) error {
+	s.Name = strings.TrimSpace(s.Name)
+	s.SourceId = strings.TrimSpace(s.SourceId)
+	s.Tag = strings.ToLower(strings.TrimSpace(s.Tag))
+	s.Query = strings.TrimSpace(s.Query)
+	s.Webhook = strings.TrimSpace(s.Webhook)
+	if s.SourceId == "" && s.Tag == "" && s.Query == "" {
+		return ErrSavedSearchEmpty
+	}
+	if s.Webhook == "" {
+		return nil
+	}
+	if !webhooks {
+		return ErrWebhooksDisabled
+	}
+	return validWebhookUrl(s.Webhook, allowInternal)
+}
+
+// searchCandidate is a url being checked against saved searches
+type searchCandidate struct {
+	url      string
+	title    string
+	subject  string
+	sourceId string
+	// metadata just written for the url's content, nil for captures
+	meta map[string]interface{}
+}
+
+// tags lists the candidate's metadata tags, lowercased
+func (c *searchCandidate) tags() (tags []string) {
+	for _, key := range savedSearchTagKeys {
+		switch v := c.meta[key].(type) {
+		case string:
+			tags = append(tags, strings.ToLower(v))
+		case []interface{}:
+			for _, t := range v {
+				if s, ok := t.(string); ok {
+					tags = append(tags, strings.ToLower(s))
+				}
+			}
+		case []string:
+			for _, s := range v {
+				tags = append(tags, strings.ToLower(s))
+			}
+		}
+	}
+	return
+}
+
+// searchTextMatches checks if s contains query, ignoring case. it's the
+// same test SEARCH_REQUEST makes against urls
+func searchTextMatches(query, s string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(query))
+}
+
+// matches checks a candidate against every filter the search sets. the query
+// is checked against the url, title & string metadata values
+func (s *SavedSearch) matches(c *searchCandidate) bool {
+	if !s.Active {
+		return false
+	}
+	if s.SourceId != "" && s.SourceId != c.sourceId {
+		return false
+	}
+	if s.Tag != "" {
+		found := false
+		for _, t := range c.tags() {
+			if t == s.Tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if s.Query == "" || searchTextMatches(s.Query, c.url) || searchTextMatches(s.Query, c.title) {
+		return true
+	}
+	for _, v := range c.meta {
+		if str, ok := v.(string); ok && searchTextMatches(s.Query, str) {
+			return true
+		}
+	}
+	return false
+}
+
+// savedSearchIndex holds active searches by the most selective filter they
+// set, so each write or capture is only checked against searches it could match
+type savedSearchIndex struct {
+	bySource map[string][]*SavedSearch
+	byTag    map[string][]*SavedSearch
+	// searches with only a query
+	any []*SavedSearch
+}
+
+func newSavedSearchIndex(searches []*SavedSearch) *savedSearchIndex {
+	idx := &savedSearchIndex{bySource: map[string][]*SavedSearch{}, byTag: map[string][]*SavedSearch{}}
+	for _, s := range searches {
+		switch {
+		case !s.Active:
+		case s.SourceId != "":
+			idx.bySource[s.SourceId] = append(idx.bySource[s.SourceId], s)
+		case s.Tag != "":
+			idx.byTag[s.Tag] = append(idx.byTag[s.Tag], s)
+		default:
+			idx.any = append(idx.any, s)
+		}
+	}
+	return idx
+}
+
+// candidates lists the searches a candidate could match. each search is
+// listed once, but still needs checking with matches
+func (idx *savedSearchIndex) candidates(c *searchCandidate) []*SavedSearch {
+	searches := append([]*SavedSearch{}, idx.any...)
+	if c.sourceId != "" {
+		searches = append(searches, idx.bySource[c.sourceId]...)
+	}
+	seen := map[string]bool{}
+	for _, t := range c.tags() {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		searches = append(searches, idx.byTag[t]...)
+	}
+	return searches
+}
+
+// savedSearchWatcher checks metadata writes & captures made by this instance
+// against saved searches, in the background. Checks are queued without
+// blocking & dropped if the queue is full
+type savedSearchWatcher struct {
+	// db to read searches from & record matches in. nil turns watching off
+	db *sql.DB
+	// room live matches are published to, if any
+	hub   *Room
+	queue chan func() []*searchCandidate
+	// webhooks are only called if they're turned on
+	webhooks bool
+
+	lock  sync.RWMutex
+	index *savedSearchIndex
+}
+
+// searchWatcher is the package-level saved search watcher
+var searchWatcher = newSavedSearchWatcher()
+
+func newSavedSearchWatcher() *savedSearchWatcher {
+	return &savedSearchWatcher{
+		queue: make(chan func() []*searchCandidate, savedSearchQueueSize),
+		index: newSavedSearchIndex(nil),
+	}
+}
+
+func init() {
+	addEventListener(func(e *Event) {
+		switch e.Type {
+		case EventMetadataAdded:
+			// remote writes are checked by the instance that made them
+			if m, ok := e.Data.(*core.Metadata); ok && e.Origin == instanceId {
+				searchWatcher.metadata(m)
+			}
+		case EventSavedSearchesChanged:
+			go searchWatcher.reload()
+		}
+	})
+}
+
+// reload reads every active search into a new index
+func (w *savedSearchWatcher) reload() {
+	if w.db == nil {
+		return
+	}
+	searches, err := readActiveSavedSearches(w.db)
+	if err != nil {
+		log.Infof("error reading saved searches: %s", err.Error())
+		return
+	}
+	w.lock.Lock()
+	w.index = newSavedSearchIndex(searches)
+	w.lock.Unlock()
+}
+
+// run checks queued writes & captures until the queue is closed
+func (w *savedSearchWatcher) run() {
+	for read := range w.queue {
+		w.check(read())
+	}
+}
+
+// enqueue queues a func that reads the candidates to check
+func (w *savedSearchWatcher) enqueue(read func() []*searchCandidate) {
+	if w.db == nil {
+		return
+	}
+	select {
+	case w.queue <- read:
+	default:
+		savedSearchStats.Add("dropped", 1)
+	}
+}
+
+// capture queues a newly captured url to be checked
+func (w *savedSearchWatcher) capture(src *core.Source, u *core.Url) {
+	c := &searchCandidate{url: u.Url, title: u.Title, subject: u.Hash}
+	if src != nil {
+		c.sourceId = src.Id
+	}
+	w.enqueue(func() []*searchCandidate { return []*searchCandidate{c} })
+}
+
+// metadata queues every url with the block's subject as it's content to be checked
+func (w *savedSearchWatcher) metadata(m *core.Metadata) {
+	db := w.db
+	w.enqueue(func() []*searchCandidate {
+		rows, err := db.Query("select url, title from urls where hash = $1 limit $2", m.Subject, savedSearchUrlLimit)
+		if err != nil {
+			log.Infof("error reading urls for %s: %s", m.Subject, err.Error())
+			return nil
+		}
+		defer rows.Close()
+
+		candidates := []*searchCandidate{}
+		for rows.Next() {
+			c := &searchCandidate{subject: m.Subject, meta: m.Meta}
+			if err := rows.Scan(&c.url, &c.title); err != nil {
+				log.Info(err.Error())
+				return nil
+			}
+			candidates = append(candidates, c)
+		}
+		rows.Close()
+
+		for _, c := range candidates {
+			src, err := matchSource(db, c.url)
+			if err != nil {
+				log.Info(err.Error())
+				continue
+			}
+			if src != nil {
+				c.sourceId = src.Id
+			}
+		}
+		return candidates
+	})
+}
+
+// check delivers every search each candidate matches
+func (w *savedSearchWatcher) check(candidates []*searchCandidate) {
+	w.lock.RLock()
+	idx := w.index
+	w.lock.RUnlock()
+
+	for _, c := range candidates {
+		savedSearchStats.Add("checked", 1)
+		for _, s := range idx.candidates(c) {
+			savedSearchStats.Add("evaluated", 1)
+			if s.matches(c) {
+				w.deliver(s, c)
+			}
+		}
+	}
+}
+
+// deliver records a match, notifying the owner if it's the first time the
+// url has matched the search. webhooks are written to the outbox along with
+// the match
+func (w *savedSearchWatcher) deliver(s *SavedSearch, c *searchCandidate) {
+	now := time.Now()
+	m := &SavedSearchMatch{SearchId: s.Id, Url: c.url, Subject: c.subject, Created: now.Round(time.Second).In(time.UTC)}
+
+	// matches in subprimers the owner can't see are kept, but not announced.
+	// they're listed once the owner can see them
+	v, err := loadVisibility(w.db, s.Owner, now)
+	if err != nil {
+		log.Infof("error checking saved search match visibility: %s", err.Error())
+		return
+	}
+	visible := v.Url(m.Url)
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		log.Infof("error recording saved search match: %s", checkWriteErr(err).Error())
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("insert into saved_search_matches (search_id,url,subject,created) values ($1, $2, $3, $4) on conflict (search_id, url) do nothing",
+		m.SearchId, m.Url, m.Subject, m.Created)
+	if err != nil {
+		log.Infof("error recording saved search match: %s", checkWriteErr(err).Error())
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return
+	}
+	if visible && s.Webhook != "" && w.webhooks {
+		if err := enqueueOutbox(tx, outboxWebhook, s.Webhook, savedSearchWebhookPayload(s, m), now); err != nil {
+			log.Infof("error queueing webhook for saved search %s: %s", s.Id, checkWriteErr(err).Error())
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Infof("error recording saved search match: %s", checkWriteErr(err).Error())
+		return
+	}
+	savedSearchStats.Add("matches", 1)
+	if !visible {
+		return
+	}
+
+	if w.hub != nil {
+		subject := savedSearchSubject(s.Id)
+		data, err := json.Marshal(&ClientResponse{
+			Type:      "SAVED_SEARCH_MATCH",
+			RequestId: "server",
+			Schema:    "SAVED_SEARCH_MATCH",
+			Id:        subject,
+			Data:      m,
+		})
+		if err != nil {
+			log.Info(err.Error())
+		} else {
+			w.hub.publish <- &topicMessage{topic: subjectTopic(subject), data: data, event: "SAVED_SEARCH_MATCH", contentChanged: true}
+		}
+	}
+}
+
+// savedSearchWebhookPayload is what's POST'd to a search's webhook for a match
+func savedSearchWebhookPayload(s *SavedSearch, m *SavedSearchMatch) map[string]interface{} {
+	return map[string]interface{}{
+		"search": map[string]string{"id": s.Id, "name": s.Name},
+		"match":  m,
+	}
+}
+
+// readActiveSavedSearches reads every search that's being watched
+func readActiveSavedSearches(db *sql.DB) ([]*SavedSearch, error) {
+	return querySavedSearches(db, "select "+savedSearchCols.String()+" from saved_searches where active = true")
+}
+
+// ReadSavedSearches reads a user's saved searches, newest first
+func ReadSavedSearches(db *sql.DB, owner string) ([]*SavedSearch, error) {
+	return querySavedSearches(db, "select "+savedSearchCols.String()+" from saved_searches where owner = $1 order by created desc", owner)
+}
+
+func querySavedSearches(db *sql.DB, query string, args ...interface{}) ([]*SavedSearch, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []*SavedSearch{}
+	for rows.Next() {
+		s := &SavedSearch{}
+		if err := savedSearchCols.scan(rows, s.scanTargets()); err != nil {
+			return nil, err
+		}
+		searches = append(searches, s)
+	}
+	return searches, rows.Err()
+}
+
+// ReadSavedSearch reads a search, returning ErrNotFound unless owner saved it
+func ReadSavedSearch(db *sql.DB, id, owner string) (*SavedSearch, error) {
+	s := &SavedSearch{}
+	err := savedSearchCols.scan(db.QueryRow("select "+savedSearchCols.String()+" from saved_searches where id = $1 and owner = $2", id, owner), s.scanTargets())
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return s, err
+}
+
+// SaveSavedSearch creates a search if it has no id, updating it otherwise.
+// users can save up to limit searches. webhooks to internal addresses are
+// refused unless allowInternal is set
+func SaveSavedSearch(db *sql.DB, s *SavedSearch, limit int, webhooks, allowInternal bool) error {
+	if err := s.validate(webhooks, allowInternal); err != nil {
+		return err
+	}
+	now := time.Now().Round(time.Second).In(time.UTC)
+	s.Updated = now
+
+	if s.Id != "" {
+		res, err := db.Exec("update saved_searches set updated = $3, name = $4, source_id = $5, tag = $6, query = $7, webhook = $8, active = $9 where id = $1 and owner = $2",
+			s.Id, s.Owner, s.Updated, s.Name, s.SourceId, s.Tag, s.Query, s.Webhook, s.Active)
+		if err != nil {
+			return checkWriteErr(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+		return db.QueryRow("select created from saved_searches where id = $1", s.Id).Scan(&s.Created)
+	}
+
+	var count int
+	if err := db.QueryRow("select count(1) from saved_searches where owner = $1", s.Owner).Scan(&count); err != nil {
+		return err
+	}
+	if count >= limit {
+		return ErrSavedSearchLimit
+	}
+	s.Id = uuid.New()
+	s.Created = now
+	_, err := db.Exec("insert into saved_searches ("+savedSearchCols.String()+") values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		s.Id, s.Created, s.Updated, s.Owner, s.Name, s.SourceId, s.Tag, s.Query, s.Webhook, s.Active)
+	return checkWriteErr(err)
+}
+
+// DeleteSavedSearch removes a search & it's matches
+func DeleteSavedSearch(db *sql.DB, id, owner string) error {
+	res, err := db.Exec("delete from saved_searches where id = $1 and owner = $2", id, owner)
+	if err != nil {
+		return checkWriteErr(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReadSavedSearchMatches reads a search's matches, newest first
+func ReadSavedSearchMatches(db *sql.DB, id string, limit, offset int) ([]*SavedSearchMatch, error) {
+	rows, err := db.Query("select search_id, url, subject, created from saved_search_matches where search_id = $1 order by created desc, url limit $2 offset $3", id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []*SavedSearchMatch{}
+	for rows.Next() {
+		m := &SavedSearchMatch{}
+		if err := rows.Scan(&m.SearchId, &m.Url, &m.Subject, &m.Created); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// savedSearchService returns the service a saved search action runs with, or
+// an error if saved searches are turned off
+func savedSearchService(c *Client) (*Service, error) {
+	if c == nil {
+		return nil, ErrSavedSearchesDisabled
+	}
+	s := c.service()
+	if s.Config == nil || s.Config.SavedSearchesPerUser <= 0 {
+		return nil, ErrSavedSearchesDisabled
+	}
+	return s, nil
+}
+
+// FetchSavedSearchesAction lists a user's saved searches
+type FetchSavedSearchesAction struct {
+	ReqAction
+	clientAction
+	KeyId string `json:"keyId"`
+}
+
+func (FetchSavedSearchesAction) Type() string        { return "SAVED_SEARCHES_FETCH_REQUEST" }
+func (FetchSavedSearchesAction) SuccessType() string { return "SAVED_SEARCHES_FETCH_SUCCESS" }
+func (FetchSavedSearchesAction) FailureType() string { return "SAVED_SEARCHES_FETCH_FAILURE" }
+
+func (FetchSavedSearchesAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &FetchSavedSearchesAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *FetchSavedSearchesAction) Exec() (res *ClientResponse) {
+	s, err := savedSearchService(a.client)
+	if err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	searches, err := ReadSavedSearches(s.DB, a.KeyId)
+	if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "SAVED_SEARCH_ARRAY",
+		Data:      searches,
+	}
+}
+
+// SaveSavedSearchAction creates or updates a saved search. The requester is
+// subscribed to the search's matches
+type SaveSavedSearchAction struct {
+	ReqAction
+	clientAction
+	KeyId  string       `json:"keyId"`
+	Search *SavedSearch `json:"search"`
+}
+
+func (SaveSavedSearchAction) Type() string        { return "SAVED_SEARCH_SAVE_REQUEST" }
+func (SaveSavedSearchAction) SuccessType() string { return "SAVED_SEARCH_SAVE_SUCCESS" }
+func (SaveSavedSearchAction) FailureType() string { return "SAVED_SEARCH_SAVE_FAILURE" }
+
+func (SaveSavedSearchAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	// searches are active unless they say otherwise
+	a := &SaveSavedSearchAction{Search: &SavedSearch{Active: true}}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *SaveSavedSearchAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+	s, err := savedSearchService(a.client)
+	if err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if a.Search == nil || a.KeyId == "" {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: "keyId & search are required"}
+	}
+
+	a.Search.Owner = a.KeyId
+	if err := SaveSavedSearch(s.DB, a.Search, s.Config.SavedSearchesPerUser, s.Config.SavedSearchWebhooks, s.Egress.allowInternal); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "savedSearch", a.Search.Id)
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	s.Publish(&Event{Type: EventSavedSearchesChanged})
+
+	subject := savedSearchSubject(a.Search.Id)
+	a.client.Subscribe(subjectTopic(subject))
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "SAVED_SEARCH",
+		Id:        subject,
+		Data:      a.Search,
+	}
+}
+
+// DeleteSavedSearchAction removes a saved search & it's matches
+type DeleteSavedSearchAction struct {
+	ReqAction
+	clientAction
+	KeyId string `json:"keyId"`
+	Id    string `json:"id"`
+}
+
+func (DeleteSavedSearchAction) Type() string        { return "SAVED_SEARCH_DELETE_REQUEST" }
+func (DeleteSavedSearchAction) SuccessType() string { return "SAVED_SEARCH_DELETE_SUCCESS" }
+func (DeleteSavedSearchAction) FailureType() string { return "SAVED_SEARCH_DELETE_FAILURE" }
+
+func (DeleteSavedSearchAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &DeleteSavedSearchAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *DeleteSavedSearchAction) Exec() (res *ClientResponse) {
+	s, err := savedSearchService(a.client)
+	if err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if err := DeleteSavedSearch(s.DB, a.Id, a.KeyId); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "savedSearch", a.Id)
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	s.Publish(&Event{Type: EventSavedSearchesChanged})
+
+	a.client.Unsubscribe(subjectTopic(savedSearchSubject(a.Id)))
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Id:        a.Id,
+	}
+}
+
+// FetchSearchMatchesAction lists the urls that have matched a saved search
+type FetchSearchMatchesAction struct {
+	ReqAction
+	clientAction
+	pageRequest
+	KeyId string `json:"keyId"`
+	Id    string `json:"id"`
+}
+
+func (FetchSearchMatchesAction) Type() string        { return "SAVED_SEARCH_MATCHES_REQUEST" }
+func (FetchSearchMatchesAction) SuccessType() string { return "SAVED_SEARCH_MATCHES_SUCCESS" }
+func (FetchSearchMatchesAction) FailureType() string { return "SAVED_SEARCH_MATCHES_FAILURE" }
+
+func (FetchSearchMatchesAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &FetchSearchMatchesAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *FetchSearchMatchesAction) Exec() (res *ClientResponse) {
+	s, err := savedSearchService(a.client)
+	if err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if _, err := ReadSavedSearch(s.DB, a.Id, a.KeyId); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "savedSearch", a.Id)
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	matches, err := ReadSavedSearchMatches(s.DB, a.Id, a.fetch(), a.offset)
+	if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	v, err := loadVisibility(s.DB, a.client.identity(), s.Clock())
+	if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	page := newPage(&a.pageRequest, matches)
+	visible := make([]*SavedSearchMatch, 0, len(matches))
+	for _, m := range page.Items.([]*SavedSearchMatch) {
+		if v.Url(m.Url) {
+			visible = append(visible, m)
+		}
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "SAVED_SEARCH_MATCH_ARRAY",
+		Id:        savedSearchSubject(a.Id),
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      page.filter(visible),
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestSavedSearchMatches(t *testing.T) {
+	noaa := &SavedSearch{Active: true, SourceId: "noaa", Query: "sea level"}
+	tagged := &SavedSearch{Active: true, Tag: "climate"}
+	inactive := &SavedSearch{Query: "sea level"}
+
+	cases := []struct {
+		search *SavedSearch
+		c      *searchCandidate
+		match  bool
+	}{
+		{noaa, &searchCandidate{url: "http://www.noaa.gov/sea-level", sourceId: "noaa", meta: map[string]interface{}{"title": "Sea Level Rise"}}, true},
+		{noaa, &searchCandidate{url: "http://www.noaa.gov/tides", sourceId: "noaa", meta: map[string]interface{}{"description": "global SEA LEVEL data"}}, true},
+		{noaa, &searchCandidate{url: "http://www.noaa.gov/tides", sourceId: "noaa", title: "Sea level trends"}, true},
+		{noaa, &searchCandidate{url: "http://www.noaa.gov/tides", sourceId: "noaa", meta: map[string]interface{}{"title": "Tides"}}, false},
+		{noaa, &searchCandidate{url: "http://www.epa.gov/sea-level", sourceId: "epa"}, false},
+		{tagged, &searchCandidate{url: "http://www.epa.gov", meta: map[string]interface{}{"keywords": []interface{}{"Climate", "air"}}}, true},
+		{tagged, &searchCandidate{url: "http://www.epa.gov", meta: map[string]interface{}{"tags": "climate"}}, true},
+		{tagged, &searchCandidate{url: "http://www.epa.gov/climate", meta: map[string]interface{}{"keywords": []interface{}{"air"}}}, false},
+		{tagged, &searchCandidate{url: "http://www.epa.gov/climate"}, false},
+		{inactive, &searchCandidate{url: "http://www.noaa.gov/sea-level"}, false},
+	}
+
+	for i, c := range cases {
+		if got := c.search.matches(c.c); got != c.match {
+			t.Errorf("case %d match mismatch. expected: %t, got: %t", i, c.match, got)
+		}
+	}
+}
+
+func TestSavedSearchIndex(t *testing.T) {
+	bySource := &SavedSearch{Id: "source", Active: true, SourceId: "noaa", Tag: "climate"}
+	byTag := &SavedSearch{Id: "tag", Active: true, Tag: "climate"}
+	byQuery := &SavedSearch{Id: "query", Active: true, Query: "sea level"}
+	inactive := &SavedSearch{Id: "inactive", SourceId: "noaa"}
+	idx := newSavedSearchIndex([]*SavedSearch{bySource, byTag, byQuery, inactive})
+
+	cases := []struct {
+		c      *searchCandidate
+		expect []string
+	}{
+		{&searchCandidate{}, []string{"query"}},
+		{&searchCandidate{sourceId: "noaa"}, []string{"query", "source"}},
+		{&searchCandidate{sourceId: "epa", meta: map[string]interface{}{"keywords": []interface{}{"climate", "Climate"}}}, []string{"query", "tag"}},
+		{&searchCandidate{sourceId: "noaa", meta: map[string]interface{}{"tags": "climate"}}, []string{"query", "source", "tag"}},
+	}
+
+	for i, c := range cases {
+		got := idx.candidates(c.c)
+		if len(got) != len(c.expect) {
+			t.Errorf("case %d expected %d candidates, got: %d", i, len(c.expect), len(got))
+			continue
+		}
+		for j, s := range got {
+			if s.Id != c.expect[j] {
+				t.Errorf("case %d candidate %d mismatch. expected: %s, got: %s", i, j, c.expect[j], s.Id)
+			}
+		}
+	}
+}
+
+func TestSavedSearchValidate(t *testing.T) {
+	cases := []struct {
+		search   *SavedSearch
+		webhooks bool
+		internal bool
+		err      string
+	}{
+		{&SavedSearch{Query: " sea level "}, false, false, ""},
+		{&SavedSearch{Name: "everything"}, false, false, ErrSavedSearchEmpty.Error()},
+		{&SavedSearch{Tag: "climate", Webhook: "https://93.184.216.34/hook"}, false, false, ErrWebhooksDisabled.Error()},
+		{&SavedSearch{Tag: "climate", Webhook: "https://93.184.216.34/hook"}, true, false, ""},
+		{&SavedSearch{Tag: "climate", Webhook: "ftp://example.com/hook"}, true, false, "invalid webhook url: ftp://example.com/hook"},
+		{&SavedSearch{Tag: "climate", Webhook: "http://169.254.169.254/latest/meta-data"}, true, false, ErrForbiddenTarget.Error()},
+		{&SavedSearch{Tag: "climate", Webhook: "http://127.0.0.1:8080/hook"}, true, false, ErrForbiddenTarget.Error()},
+		{&SavedSearch{Tag: "climate", Webhook: "http://127.0.0.1:8080/hook"}, true, true, ""},
+	}
+
+	for i, c := range cases {
+		err := c.search.validate(c.webhooks, c.internal)
+		if (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, err)
+		}
+	}
+}
+
+func TestSavedSearchesDisabled(t *testing.T) {
+	svc := NewService(nil, nil, &config{})
+	a := FetchSavedSearchesAction{}.Parse("req", []byte(`{"keyId":"key"}`)).(*FetchSavedSearchesAction)
+	a.SetClient(&Client{addr: "127.0.0.1", svc: svc})
+	if res := a.Exec(); res.Type != a.FailureType() || res.Error != ErrSavedSearchesDisabled.Error() {
+		t.Errorf("expected saved searches to be disabled, got: %s %s", res.Type, res.Error)
+	}
+}
+
+func TestSavedSearchWatch(t *testing.T) {
+	defer resetTestData(appDB, "saved_searches", "saved_search_matches", "outbox")
+	defer appDB.Exec("delete from urls where url = 'http://www.noaa.gov/sea-level'")
+
+	hooked := make(chan map[string]interface{}, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body := map[string]interface{}{}
+		json.Unmarshal(data, &body)
+		hooked <- body
+	}))
+	defer hook.Close()
+
+	svc := newTestService()
+	// the test webhook serves from a loopback address the guard refuses
+	svc.Egress = newEgresses(true)
+	svc.Config.SavedSearchesPerUser = 1
+	svc.Config.SavedSearchWebhooks = true
+	exec := func(data string) *ClientResponse {
+		a := SaveSavedSearchAction{}.Parse("req", []byte(data)).(*SaveSavedSearchAction)
+		a.SetClient(&Client{addr: "127.0.0.1", svc: svc})
+		return a.Exec()
+	}
+
+	res := exec(`{"keyId":"key","search":{"name":"sea level","query":"sea level","webhook":"` + hook.URL + `"}}`)
+	if res.Type != "SAVED_SEARCH_SAVE_SUCCESS" {
+		t.Fatalf("expected search to save, got: %s", res.Error)
+	}
+	search := res.Data.(*SavedSearch)
+	if !search.Active {
+		t.Errorf("expected new searches to be active")
+	}
+	if res := exec(`{"keyId":"key","search":{"query":"tides"}}`); res.Error != ErrSavedSearchLimit.Error() {
+		t.Errorf("expected second search to hit the limit, got: %s", res.Error)
+	}
+
+	if _, err := appDB.Exec("insert into urls (url,created,updated,hash,title) values ('http://www.noaa.gov/sea-level', now(), now(), 'sea_level_subject', '')"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := newSavedSearchWatcher()
+	w.db = appDB
+	w.webhooks = true
+	w.reload()
+	m := &core.Metadata{Subject: "sea_level_subject", Meta: map[string]interface{}{"title": "Sea Level Rise"}}
+	for i := 0; i < 2; i++ {
+		w.metadata(m)
+		read := <-w.queue
+		w.check(read())
+	}
+	// webhooks are sent from the outbox
+	outbox := newOutboxWorker(appDB, outboxWebhook, webhookSender(newWebhookClient(true)))
+	for {
+		claimed, err := outbox.deliverNext()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !claimed {
+			break
+		}
+	}
+
+	matches, err := ReadSavedSearchMatches(appDB, search.Id, 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(matches) != 1 || matches[0].Url != "http://www.noaa.gov/sea-level" {
+		t.Errorf("expected one match, got: %d", len(matches))
+	}
+
+	select {
+	case body := <-hooked:
+		if match, ok := body["match"].(map[string]interface{}); !ok || match["url"] != "http://www.noaa.gov/sea-level" {
+			t.Errorf("unexpected webhook body: %v", body)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected webhook to be called")
+	}
+	select {
+	case <-hooked:
+		t.Errorf("expected repeat matches not to call the webhook")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/datatogether/core"
@@ -9,8 +10,14 @@ import (
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// longest shutdown waits for requests in flight to finish
+const shutdownTimeout = 20 * time.Second
+
 var (
 	// cfg is the global configuration for the server. It's read in at startup from
 	// the config.json file and enviornment variables, see config.go for more info.
@@ -35,9 +42,19 @@ func init() {
 	log.Formatter = &logrus.TextFormatter{
 		ForceColors: true,
 	}
+	log.AddHook(versionHook{})
 }
 
 func main() {
+	// arguments run a maintenance command instead of the server, see cli.go
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr, setupCLI))
+	}
+
+	if messagesErr != nil {
+		panic(fmt.Errorf("message catalog error: %s", messagesErr.Error()))
+	}
+
 	var err error
 	cfg, err = initConfig(os.Getenv("GOLANG_ENV"))
 	if err != nil {
@@ -46,15 +63,19 @@ func main() {
 	}
 
 	connectToAppDb()
-	sql_datastore.SetDB(appDB)
-	sql_datastore.Register(
-		&core.Url{},
-		&core.Link{},
-		&core.Primer{},
-		&core.Source{},
-		&core.Collection{},
-		&core.CollectionItem{},
-	)
+	if err := checkColumnSets(appDB); err != nil {
+		// tables that don't match can't be read safely, report every mismatch & stop
+		log.Fatalf("database schema error: %s", err.Error())
+	}
+	warnClockSkew(appDB)
+	if err := startConfiguredMaintenance(cfg); err != nil {
+		panic(fmt.Errorf("server configuration error: %s", err.Error()))
+	}
+	setupStore(appDB)
+
+	if cfg.RedisUrl != "" {
+		eventsPool = newEventsPool(cfg.RedisUrl)
+	}
 
 	go func() {
 		if err := SubscribeTaskProgress(); err != nil {
@@ -62,22 +83,114 @@ func main() {
 		}
 	}()
 
+	// only the leader resumes interrupted jobs, lifts embargoes, sweeps expired
+	// captures & exports & samples chain health, so they aren't done by every instance
+	leader = newLeaderLease(appDB, leaderLeaseName, instanceId, leaderLeaseTTL)
+	leader.tasks = append(leader.tasks, func() { resumeReconcileJobs(appDB) }, func() { resumeErasures(appDB) }, func() { liftEmbargoes(appDB, time.Now()) }, func() { resumeRehashJobs(appDB) }, func() { resumeMetaKeyRenames(appDB) }, func() { sweepCaptures(appDB, time.Now()) }, func() { runChainHealth(appDB, time.Now()) }, func() { sweepUserExports(appDB, time.Now()) }, func() { removeEndedAnnouncements(appDB, time.Now()) })
+	go leader.run()
+
 	room = newRoom()
+	room.onUnregister = append(room.onUnregister, editing.handleClientGone, sessions.handleClientGone)
 	go room.run()
+	go sessions.run()
+	go editing.run()
+	go polling.run()
+	auditor.sampleRate = float64(cfg.WriteAuditSamplePercent) / 100
+	go auditor.run()
+	go metadataBadges.run()
+	go announcements.run(defaultService())
+	idleVerify.configure(appDB, cfg)
+	go idleVerify.run()
+	if cfg.ConsensusTitles {
+		titles.db = appDB
+		go titles.run()
+	}
+	if cfg.SavedSearchesPerUser > 0 {
+		searchWatcher.db = appDB
+		searchWatcher.hub = room
+		searchWatcher.webhooks = cfg.SavedSearchWebhooks
+		searchWatcher.reload()
+		go searchWatcher.run()
+	}
+	go runTrialArchives()
+	go runLinkArchives()
+	hookLimits = newRateLimiter(cfg.HookArchivesPerMinute, time.Minute)
+	go runHookArchives()
+	runOutbox(appDB)
+	go archiveRejections.run()
+	go egressRoutes.run()
+	bandwidth.configure(appDB, cfg)
+	go bandwidth.run()
+	guardrails.configure(cfg)
+	go guardrails.run()
+	startCacheSnapshots(appDB, cfg)
 
 	s := &http.Server{}
 	// connect mux to server
 	s.Handler = NewServerRoutes()
+	flushed := make(chan struct{})
+	go flushOnShutdown(s, flushed)
 
 	// print notable config settings
 	printConfigInfo()
 
 	// fire it up!
-	log.Infof("🌎 starting server on port %s in %s mode", cfg.Port, cfg.Mode)
+	log.Infof("🌎 starting server version %s (schema %d) on port %s in %s mode", buildVersion, schemaVersion, cfg.Port, cfg.Mode)
 
-	// start server wrapped in a log.Fatal b/c http.ListenAndServe will not
-	// return unless there's an error
-	log.Fatal(StartServer(cfg, s))
+	// http.ListenAndServe only returns without an error once shutdown has
+	// started, wait for queued work to be written before exiting
+	if err := StartServer(cfg, s); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-flushed
+}
+
+// setupStore points the datastore at db & registers the models stored in it
+func setupStore(db *sql.DB) {
+	sql_datastore.SetDB(db)
+	sql_datastore.Register(
+		&core.Url{},
+		&core.Link{},
+		&core.Primer{},
+		&core.Source{},
+		&core.Collection{},
+		&core.CollectionItem{},
+	)
+}
+
+// flushOnShutdown waits for an interrupt or termination signal, stops s
+// accepting requests & waits for the ones in flight, then writes any queued
+// work that would otherwise be lost, closing flushed when it's done
+func flushOnShutdown(s *http.Server, flushed chan struct{}) {
+	defer close(flushed)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	log.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Info(err.Error())
+	}
+	if leader != nil {
+		if err := leader.release(); err != nil {
+			log.Info(err.Error())
+		}
+	}
+	if cfg.ConsensusTitles {
+		if err := titles.Flush(10 * time.Second); err != nil {
+			log.Info(err.Error())
+		}
+	}
+	if err := bandwidth.flush(); err != nil {
+		log.Info(err.Error())
+	}
+	if cfg != nil && cfg.CacheSnapshots {
+		if err := saveCacheSnapshot(appDB, time.Now()); err != nil {
+			log.Info(err.Error())
+		}
+	}
 }
 
 // NewServerRoutes returns a Muxer that has all API routes.
@@ -87,6 +200,21 @@ func NewServerRoutes() *http.ServeMux {
 	m.HandleFunc("/.well-known/acme-challenge/", CertbotHandler)
 	m.Handle("/profile", middleware(UserProfileHandler))
 	m.Handle("/healthcheck", middleware(HealthCheckHandler))
+	m.Handle("/readycheck", middleware(ReadinessHandler))
+	m.Handle("/report", middleware(ReportContentHandler))
+	m.Handle("/collections", middleware(CollectionsHandler))
+	m.Handle("/debug/vars", authMiddleware(DebugVarsHandler))
+	m.Handle("/admin/imports", authMiddleware(ImportWARCHandler))
+	m.Handle("/admin/audit/reserved-meta-keys", authMiddleware(ReservedMetaKeysAuditHandler))
+	m.Handle("/admin/erase", authMiddleware(EraseUserDataHandler))
+	m.Handle("/admin/flags", authMiddleware(FeatureFlagsHandler))
+	m.Handle("/admin/hashes/missing", authMiddleware(MissingHashesHandler))
+	m.Handle("/admin/bandwidth", authMiddleware(BandwidthHandler))
+	m.Handle("/admin/rehash", authMiddleware(RehashHandler))
+	m.Handle("/metrics", authMiddleware(ChainHealthMetricsHandler))
+	m.Handle("/admin/api-keys", authMiddleware(ApiKeysHandler))
+	m.Handle("/admin/custody", authMiddleware(CustodyReportHandler))
+	m.Handle("/admin/content/", authMiddleware(ContentHandler))
 
 	m.Handle("/", middleware(WebappHandler))
 	m.Handle("/url", middleware(WebappHandler))
@@ -106,6 +234,12 @@ func NewServerRoutes() *http.ServeMux {
 	m.Handle("/tasks/", middleware(WebappHandler))
 
 	m.Handle("/ws", middleware(HandleWebsocketUpgrade))
+	m.Handle("/actions", middleware(HandlePollActions))
+	m.Handle("/poll", middleware(HandlePoll))
+	m.Handle("/hooks/archive", middleware(HookArchiveHandler))
+	m.Handle("/favicons/", middleware(RenderFaviconHandler))
+	m.Handle("/exports", middleware(UserExportHandler))
+	m.Handle("/exports/", middleware(UserExportHandler))
 
 	return m
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Server requests
+//
+// Most traffic is a client asking & the server answering. server requests go
+// the other way: the server sends a client an envelope with a serverRequestId,
+// & when replyExpected is set the client answers with a SERVER_REPLY_REQUEST
+// carrying the same id. clients tell server requests apart from responses by
+// the serverRequestId field. the first server request is TOKEN_REFRESH_REQUIRED,
+// sent when the session a client said hello with nears expiry
+
+const (
+	// how long a client has to answer a TOKEN_REFRESH_REQUIRED request
+	serverRequestTimeout = 30 * time.Second
+	// how long before a session expires it's client is asked to refresh it's token
+	tokenRefreshWindow = 5 * time.Minute
+	// how often sessions are checked for nearing expiry
+	sessionCheckInterval = 30 * time.Second
+)
+
+var (
+	// ErrClientDisconnected is returned by server requests to clients that
+	// aren't in the room, or that leave before replying
+	ErrClientDisconnected = fmt.Errorf("client isn't connected")
+	// ErrNoServerRequest is returned for replies to server requests that have
+	// already been answered, timed out, or were sent to another client
+	ErrNoServerRequest = fmt.Errorf("no server request is waiting for this reply")
+)
+
+// ServerRequest is an envelope the server sends to ask a client for something
+type ServerRequest struct {
+	ServerRequestId string      `json:"serverRequestId"`
+	Type            string      `json:"type"`
+	Data            interface{} `json:"data,omitempty"`
+	// weather the server waits for a SERVER_REPLY_REQUEST
+	ReplyExpected bool `json:"replyExpected"`
+}
+
+// ServerReply is a client's answer to a server request. clients that can't do
+// what was asked reply with an error
+type ServerReply struct {
+	ServerRequestId string          `json:"serverRequestId"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// outboundRequest is a server request for the run loop to send to a client.
+// the run loop checks the client is in the room & registers the pending reply
+// before sending, so a client leaving can't strand the requester
+type outboundRequest struct {
+	clientId string
+	id       string
+	data     []byte
+	// nil when no reply is expected
+	replies chan *ServerReply
+	// receives weather the client was in the room
+	sent chan bool
+}
+
+// pendingReply is a server request waiting for it's reply
+type pendingReply struct {
+	client  *Client
+	replies chan *ServerReply
+}
+
+// pendingReplies tracks server requests waiting for replies by id
+type pendingReplies struct {
+	sync.Mutex
+	requests map[string]*pendingReply
+}
+
+func (p *pendingReplies) add(id string, c *Client, replies chan *ServerReply) {
+	p.Lock()
+	p.requests[id] = &pendingReply{client: c, replies: replies}
+	p.Unlock()
+}
+
+func (p *pendingReplies) remove(id string) {
+	p.Lock()
+	delete(p.requests, id)
+	p.Unlock()
+}
+
+// resolve hands a reply from c to the request waiting for it
+func (p *pendingReplies) resolve(c *Client, reply *ServerReply) error {
+	p.Lock()
+	defer p.Unlock()
+	r := p.requests[reply.ServerRequestId]
+	if r == nil || r.client != c {
+		return ErrNoServerRequest
+	}
+	delete(p.requests, reply.ServerRequestId)
+	r.replies <- reply
+	return nil
+}
+
+// clientGone fails every request waiting on c with a nil reply
+func (p *pendingReplies) clientGone(c *Client) {
+	p.Lock()
+	defer p.Unlock()
+	for id, r := range p.requests {
+		if r.client == c {
+			delete(p.requests, id)
+			r.replies <- nil
+		}
+	}
+}
+
+// RequestFromClient sends a server request to a client in the room. requests
+// that expect a reply wait for it until ctx is done, returning ctx's error.
+// requests that don't return a nil reply once sent
+func (h *Room) RequestFromClient(ctx context.Context, clientId string, req *ServerRequest) (*ServerReply, error) {
+	if req.ServerRequestId == "" {
+		req.ServerRequestId = uuid.New()
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &outboundRequest{clientId: clientId, id: req.ServerRequestId, data: data, sent: make(chan bool, 1)}
+	if req.ReplyExpected {
+		out.replies = make(chan *ServerReply, 1)
+		defer h.replies.remove(req.ServerRequestId)
+	}
+	select {
+	case h.requests <- out:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !<-out.sent {
+		return nil, ErrClientDisconnected
+	}
+	if out.replies == nil {
+		return nil, nil
+	}
+
+	select {
+	case reply := <-out.replies:
+		if reply == nil {
+			return nil, ErrClientDisconnected
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sendRequest delivers a server request, must only be called from the run loop
+func (h *Room) sendRequest(out *outboundRequest) {
+	c := h.ids[out.clientId]
+	if c == nil || out.clientId == "" {
+		out.sent <- false
+		return
+	}
+	if out.replies != nil {
+		h.replies.add(out.id, c, out.replies)
+	}
+	h.fanout([]*Client{c}, out.data)
+	out.sent <- true
+}
+
+// ServerReplyAction answers a server request
+type ServerReplyAction struct {
+	ReqAction
+	clientAction
+	ServerReply
+}
+
+func (ServerReplyAction) Type() string        { return "SERVER_REPLY_REQUEST" }
+func (ServerReplyAction) SuccessType() string { return "SERVER_REPLY_SUCCESS" }
+func (ServerReplyAction) FailureType() string { return "SERVER_REPLY_FAILURE" }
+
+func (ServerReplyAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &ServerReplyAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, &a.ServerReply)
+	return a
+}
+
+func (a *ServerReplyAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		log.Info(a.err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+	if a.client == nil || a.client.hub == nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrNoServerRequest.Error()}
+	}
+	reply := a.ServerReply
+	if err := a.client.hub.replies.resolve(a.client, &reply); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{Type: a.SuccessType(), RequestId: a.RequestId, Id: a.ServerRequestId}
+}
+
+// session is the expiry of the token a client said hello with
+type session struct {
+	expires time.Time
+	// weather the client has been asked to refresh the token for this expiry
+	asked bool
+}
+
+// sessionTracker asks clients to refresh their token before the session they
+// said hello with expires. clients that let it expire lose their key id, & see
+// what anonymous clients see until they say hello again. tokens are the
+// client's business, the server only trusts the expiry it's told
+type sessionTracker struct {
+	sync.Mutex
+	sessions map[*Client]*session
+	// how long clients have to reply to TOKEN_REFRESH_REQUIRED
+	timeout time.Duration
+}
+
+var sessions = &sessionTracker{sessions: map[*Client]*session{}, timeout: serverRequestTimeout}
+
+// Track records when a client's session expires, a zero time stops tracking it
+func (t *sessionTracker) Track(c *Client, expires time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	if expires.IsZero() {
+		delete(t.sessions, c)
+		return
+	}
+	t.sessions[c] = &session{expires: expires}
+}
+
+// Expires returns when a client's session expires, the zero time if it isn't tracked
+func (t *sessionTracker) Expires(c *Client) time.Time {
+	t.Lock()
+	defer t.Unlock()
+	if s := t.sessions[c]; s != nil {
+		return s.expires
+	}
+	return time.Time{}
+}
+
+// handleClientGone stops tracking a client that left the room
+func (t *sessionTracker) handleClientGone(c *Client) {
+	t.Track(c, time.Time{})
+}
+
+// run checks sessions every sessionCheckInterval
+func (t *sessionTracker) run() {
+	for now := range time.Tick(sessionCheckInterval) {
+		t.check(now)
+	}
+}
+
+// check asks clients whose sessions expire within tokenRefreshWindow to refresh
+// their token, once per expiry, & drops the key id of clients whose sessions
+// have expired
+func (t *sessionTracker) check(now time.Time) {
+	due, expired := []*Client{}, []*Client{}
+	t.Lock()
+	for c, s := range t.sessions {
+		if !now.Before(s.expires) {
+			delete(t.sessions, c)
+			expired = append(expired, c)
+		} else if !s.asked && s.expires.Sub(now) <= tokenRefreshWindow {
+			s.asked = true
+			due = append(due, c)
+		}
+	}
+	t.Unlock()
+
+	for _, c := range expired {
+		log.Infof("session for %s expired", c.requester())
+		c.setKeyId("")
+	}
+	for _, c := range due {
+		go t.refresh(c)
+	}
+}
+
+// refresh sends a client TOKEN_REFRESH_REQUIRED, extending it's session to
+// the expiry it replies with
+func (t *sessionTracker) refresh(c *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	expires := t.Expires(c)
+	reply, err := c.hub.RequestFromClient(ctx, c.id, &ServerRequest{
+		Type:          "TOKEN_REFRESH_REQUIRED",
+		Data:          map[string]interface{}{"sessionExpires": expires},
+		ReplyExpected: true,
+	})
+	if err != nil {
+		log.Infof("error asking %s to refresh it's token: %s", c.requester(), err.Error())
+		return
+	}
+	if reply.Error != "" {
+		log.Infof("%s couldn't refresh it's token: %s", c.requester(), reply.Error)
+		return
+	}
+
+	refreshed := struct {
+		SessionExpires time.Time `json:"sessionExpires"`
+	}{}
+	if err := json.Unmarshal(reply.Data, &refreshed); err != nil {
+		log.Infof("error reading token refresh from %s: %s", c.requester(), err.Error())
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if s := t.sessions[c]; s != nil && refreshed.SessionExpires.After(s.expires) {
+		t.sessions[c] = &session{expires: refreshed.SessionExpires}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// readServerRequest waits for the next server request sent to c
+func readServerRequest(t *testing.T, c *Client) *ServerRequest {
+	select {
+	case msg := <-c.send:
+		req := &ServerRequest{}
+		if err := json.Unmarshal(msg, req); err != nil {
+			t.Fatal(err.Error())
+		}
+		return req
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a server request")
+	}
+	return nil
+}
+
+// replyToServer sends a reply the way a client would, returning the response
+func replyToServer(c *Client, id string, data string) *ClientResponse {
+	reply, _ := json.Marshal(map[string]interface{}{
+		"type":      "SERVER_REPLY_REQUEST",
+		"requestId": "1",
+		"data":      &ServerReply{ServerRequestId: id, Data: json.RawMessage(data)},
+	})
+	return c.dispatch(reply)
+}
+
+func TestRequestFromClient(t *testing.T) {
+	hub := newRoom()
+	go hub.run()
+	alice := &Client{id: "alice", hub: hub, send: make(chan []byte, 4)}
+	bob := &Client{id: "bob", hub: hub, send: make(chan []byte, 4)}
+	hub.register <- alice
+	hub.register <- bob
+
+	// reply
+	go func() {
+		req := readServerRequest(t, alice)
+		if res := replyToServer(alice, req.ServerRequestId, `{"ok":true}`); res.Type != "SERVER_REPLY_SUCCESS" {
+			t.Errorf("expected reply to succeed, got: %s %s", res.Type, res.Error)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	reply, err := hub.RequestFromClient(ctx, "alice", &ServerRequest{Type: "PING", ReplyExpected: true})
+	cancel()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(reply.Data) != `{"ok":true}` {
+		t.Errorf("expected reply data, got: %s", reply.Data)
+	}
+
+	// requests that don't expect a reply return once sent
+	if reply, err := hub.RequestFromClient(context.Background(), "bob", &ServerRequest{Type: "NOTICE"}); reply != nil || err != nil {
+		t.Errorf("expected no reply, got: %v %v", reply, err)
+	}
+	if req := readServerRequest(t, bob); req.Type != "NOTICE" || req.ReplyExpected {
+		t.Errorf("unexpected server request: %#v", req)
+	}
+
+	// timeout. only the client that was asked can answer, & late replies are refused
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = hub.RequestFromClient(ctx, "alice", &ServerRequest{ServerRequestId: "late", Type: "PING", ReplyExpected: true})
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected request to time out, got: %v", err)
+	}
+	readServerRequest(t, alice)
+	for _, c := range []*Client{bob, alice} {
+		if res := replyToServer(c, "late", `{}`); res.Error != ErrNoServerRequest.Error() {
+			t.Errorf("expected reply from %s to be refused, got: %s %s", c.id, res.Type, res.Error)
+		}
+	}
+
+	// disconnected clients
+	if _, err := hub.RequestFromClient(context.Background(), "carol", &ServerRequest{Type: "PING", ReplyExpected: true}); err != ErrClientDisconnected {
+		t.Errorf("expected requests to unknown clients to fail, got: %v", err)
+	}
+	go func() {
+		readServerRequest(t, bob)
+		hub.unregister <- bob
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	_, err = hub.RequestFromClient(ctx, "bob", &ServerRequest{Type: "PING", ReplyExpected: true})
+	cancel()
+	if err != ErrClientDisconnected {
+		t.Errorf("expected clients leaving to fail their requests, got: %v", err)
+	}
+	if _, err := hub.RequestFromClient(context.Background(), "bob", &ServerRequest{Type: "PING"}); err != ErrClientDisconnected {
+		t.Errorf("expected requests to clients that left to fail, got: %v", err)
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	hub := newRoom()
+	go hub.run()
+	c := &Client{id: "alice", hub: hub, send: make(chan []byte, 4)}
+	c.setKeyId("key")
+	hub.register <- c
+
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker := &sessionTracker{sessions: map[*Client]*session{}, timeout: time.Second}
+	tracker.Track(c, now.Add(time.Hour))
+	tracker.check(now)
+	select {
+	case msg := <-c.send:
+		t.Fatalf("expected sessions far from expiry not to be refreshed, got: %s", msg)
+	default:
+	}
+
+	// nearing expiry, the client is asked once & extends it's session
+	tracker.Track(c, now.Add(time.Minute))
+	tracker.check(now)
+	req := readServerRequest(t, c)
+	if req.Type != "TOKEN_REFRESH_REQUIRED" || !req.ReplyExpected {
+		t.Errorf("unexpected server request: %#v", req)
+	}
+	tracker.check(now.Add(time.Second))
+	if res := replyToServer(c, req.ServerRequestId, `{"sessionExpires":"2017-01-01T02:00:00Z"}`); res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	refreshed := now.Add(2 * time.Hour)
+	for i := 0; i < 100 && !tracker.Expires(c).Equal(refreshed); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := tracker.Expires(c); !got.Equal(refreshed) {
+		t.Errorf("expected session to be extended to %s, got: %s", refreshed, got)
+	}
+	select {
+	case msg := <-c.send:
+		t.Errorf("expected a single refresh request, got: %s", msg)
+	default:
+	}
+
+	// expired sessions lose their key
+	tracker.check(refreshed)
+	if c.requester() != "" || !tracker.Expires(c).IsZero() {
+		t.Errorf("expected expired session to be dropped, got key %q", c.requester())
+	}
+}
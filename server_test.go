@@ -8,10 +8,6 @@ import (
 	"testing"
 )
 
-func init() {
-	cfg = &config{}
-}
-
 func TestServerRoutes(t *testing.T) {
 	cases := []struct {
 		method, endpoint string
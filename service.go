@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"database/sql"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/sirupsen/logrus"
+)
+
+// Service holds what archiving, metadata writes & websocket connections run
+// against. Package-level functions use the default service, which is bound to
+// the package globals, so existing callers are unchanged while tests & programs
+// embedding patchbay can run isolated services side by side
+type Service struct {
+	DB     *sql.DB
+	Store  datastore.Datastore
+	Config *config
+	Log    *logrus.Logger
+	// Hub is the room websocket clients join
+	Hub *Room
+	// Publish dispatches an event to listeners, connected clients & other instances
+	Publish func(e *Event)
+	// Clock reports the current time
+	Clock func() time.Time
+	// Egress routes captures are fetched through
+	Egress *egresses
+	// Captcha verifies anonymous archive requests, nil if captchas are disabled
+	Captcha CaptchaVerifier
+	// Redactor strips sensitive query params from urls submitted for archiving
+	Redactor *urlRedactor
+	// Rejections remembers urls recently rejected for archiving, invalidated by
+	// events the service delivers
+	Rejections *rejectionCache
+	// FollowDelay is how long archiving waits between GET's of the links a page references
+	FollowDelay time.Duration
+	// Replicas are peers content missing locally is fetched from, nil if there are none
+	Replicas *replicaSet
+	// ContentCache caches the hash of each url's latest capture, invalidated by
+	// events the service delivers
+	ContentCache *urlContentCache
+	// Signer signs custody reports, nil if reports aren't signed
+	Signer *ecdsa.PrivateKey
+	// Guardrails sheds load while the instance is overloaded
+	Guardrails *guardrail
+	// Bandwidth meters bandwidth against the monthly caps & throttles reads
+	Bandwidth *bandwidthMeter
+	// HookLimits limits archive hook requests per api key, nil while hooks are disabled
+	HookLimits *rateLimiter
+	// ReportLimiter limits content reports per reporter ip
+	ReportLimiter *rateLimiter
+	// Announcements broadcasts announcements to the Hub's clients
+	Announcements *announcer
+	// DashboardSections assemble each section of the dashboard by name
+	DashboardSections map[string]dashboardSection
+	// DashboardStats holds the last archive stats the dashboard counted
+	DashboardStats *dashboardStatsCache
+}
+
+// NewService creates a service over a database, datastore & config, using
+// package defaults for everything else. the service doesn't share egress routes,
+// a hub, caches, guardrails or rate limits with the package globals, &
+// publishes events to it's own clients
+func NewService(db *sql.DB, ds datastore.Datastore, c *config) *Service {
+	s := &Service{
+		DB:          db,
+		Store:       ds,
+		Config:      c,
+		Log:         log,
+		Clock:       time.Now,
+		Egress:      newEgresses(false),
+		Redactor:    mustUrlRedactor(nil, nil, ""),
+		Rejections:  newRejectionCache(archiveRejectionTTL, archiveRejectionLimit),
+		FollowDelay: defaultFollowDelay,
+		ContentCache: newUrlContentCache(contentCacheSize, contentCacheSoftTTL, contentCacheHardTTL, func(url string) (string, error) {
+			return latestCaptureHash(db, url)
+		}),
+		Signer:            snapshotSigner,
+		Guardrails:        newGuardrail(),
+		Bandwidth:         newBandwidthMeter(),
+		ReportLimiter:     newReportLimiter(),
+		Announcements:     newAnnouncer(),
+		DashboardSections: dashboardSections,
+		DashboardStats:    &dashboardStatsCache{},
+	}
+	s.Publish = s.publishEvent
+	if c != nil && c.HookArchivesPerMinute > 0 {
+		s.HookLimits = newRateLimiter(c.HookArchivesPerMinute, time.Minute)
+	}
+	return s
+}
+
+// defaultService is the service package-level functions use, bound to the package globals
+func defaultService() *Service {
+	return &Service{
+		DB:                appDB,
+		Store:             store,
+		Config:            cfg,
+		Log:               log,
+		Hub:               room,
+		Publish:           publishEvent,
+		Clock:             time.Now,
+		Egress:            egressRoutes,
+		Captcha:           captcha,
+		Redactor:          redactor,
+		Rejections:        archiveRejections,
+		FollowDelay:       defaultFollowDelay,
+		Replicas:          replicas,
+		ContentCache:      contentCache,
+		Signer:            snapshotSigner,
+		Guardrails:        guardrails,
+		Bandwidth:         bandwidth,
+		HookLimits:        hookLimits,
+		ReportLimiter:     reportLimiter,
+		Announcements:     announcements,
+		DashboardSections: dashboardSections,
+		DashboardStats:    statsCache,
+	}
+}
+
+// withDB copies a service, swapping it's database
+func (s *Service) withDB(db *sql.DB) *Service {
+	c := *s
+	c.DB = db
+	return &c
+}
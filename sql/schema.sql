@@ -1,5 +1,5 @@
 -- name: drop-all
-DROP TABLE IF EXISTS urls, links, primers, sources, subprimers, alerts, context, metadata, supress_alerts, snapshots, collections, collection_items, archive_requests, uncrawlables, data_repos;
+DROP TABLE IF EXISTS urls, links, primers, sources, subprimers, alerts, context, metadata, supress_alerts, snapshots, collections, collection_items, archive_requests, uncrawlables, data_repos, config_snapshots, fetch_forensics, reconcile_jobs, source_memberships, membership_changes, moderation_cases, content_reports, moderation_log, meta_fields, erase_jobs, feature_flags, feature_flag_overrides, relations, link_sightings, link_events, fetch_recordings, fetch_exchanges, leases, saved_searches, saved_search_matches, bandwidth, hash_aliases, rehash_jobs, capture_retention, collection_access, collection_changes, chain_health_runs, api_keys, hook_archives, render_cards, render_favicons, user_exports, announcements, announcement_dismissals, idle_verifications, api_key_log, capture_notes, user_actions, outbox, meta_key_renames, cache_snapshots;
 
 -- name: create-primers
 CREATE TABLE IF NOT EXISTS primers (
@@ -52,6 +52,7 @@ CREATE TABLE IF NOT EXISTS urls (
   meta             json,
   hash             text NOT NULL default ''
 );
+CREATE INDEX IF NOT EXISTS urls_hash ON urls (hash);
 
 -- name: create-links
 CREATE TABLE IF NOT EXISTS links (
@@ -59,8 +60,15 @@ CREATE TABLE IF NOT EXISTS links (
   updated          timestamp NOT NULL,
   src              text NOT NULL references urls(url) ON DELETE CASCADE,
   dst              text NOT NULL references urls(url) ON DELETE CASCADE,
+  extractor        text NOT NULL default 'html', -- link extractor that found this link, see link_extractors.go
+  anchor_text      text NOT NULL default '', -- text of the html anchor, see link_anchors.go
+  rel              text NOT NULL default '', -- rel attribute of the html anchor
   PRIMARY KEY      (src, dst)
 );
+ALTER TABLE links ADD COLUMN IF NOT EXISTS extractor text NOT NULL default 'html';
+ALTER TABLE links ADD COLUMN IF NOT EXISTS anchor_text text NOT NULL default '';
+ALTER TABLE links ADD COLUMN IF NOT EXISTS rel text NOT NULL default '';
+CREATE INDEX IF NOT EXISTS links_anchor_text ON links USING gin (to_tsvector('english', anchor_text));
 
 -- name: create-metadata
 CREATE TABLE IF NOT EXISTS metadata (
@@ -70,8 +78,13 @@ CREATE TABLE IF NOT EXISTS metadata (
   subject          text NOT NULL,
   prev             text NOT NULL default '',
   meta             json,
-  deleted          boolean default false
+  deleted          boolean default false,
+  deleted_reason   text NOT NULL default '',
+  -- stamped a second after prev because the writer's clock was behind it's
+  skew_adjusted    boolean NOT NULL default false
 );
+ALTER TABLE metadata ADD COLUMN IF NOT EXISTS deleted_reason text NOT NULL default '';
+ALTER TABLE metadata ADD COLUMN IF NOT EXISTS skew_adjusted boolean NOT NULL default false;
 
 -- name: create-snapshots
 CREATE TABLE IF NOT EXISTS snapshots (
@@ -82,6 +95,7 @@ CREATE TABLE IF NOT EXISTS snapshots (
   meta             json,
   hash             text NOT NULL DEFAULT ''
 );
+CREATE INDEX IF NOT EXISTS snapshots_hash ON snapshots (hash);
 
 -- name: create-collections
 CREATE TABLE IF NOT EXISTS collections (
@@ -134,7 +148,475 @@ CREATE TABLE IF NOT EXISTS archive_requests (
   id               serial primary key,
   created          timestamp NOT NULL default (now() at time zone 'utc'),
   url              text NOT NULL,
-  user_id          text NOT NULL default ''
+  user_id          text NOT NULL default '',
+  config_snapshot  text NOT NULL default '',
+  anonymous        boolean NOT NULL default false,
+  requester        text NOT NULL default '', -- hashed ip address of anonymous & link archive requests, api key id of archive hook requests
+  via              text NOT NULL default '' -- page a link archive request was made from
+);
+ALTER TABLE archive_requests ADD COLUMN IF NOT EXISTS config_snapshot text NOT NULL default '';
+ALTER TABLE archive_requests ADD COLUMN IF NOT EXISTS anonymous boolean NOT NULL default false;
+ALTER TABLE archive_requests ADD COLUMN IF NOT EXISTS requester text NOT NULL default '';
+ALTER TABLE archive_requests ADD COLUMN IF NOT EXISTS via text NOT NULL default '';
+
+-- name: create-config_snapshots
+CREATE TABLE IF NOT EXISTS config_snapshots (
+  hash             text PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  source_id        text NOT NULL default '',
+  config           bytea NOT NULL,
+  signature        text NOT NULL default '',
+  public_key       text NOT NULL default ''
+);
+
+-- name: create-fetch_forensics
+CREATE TABLE IF NOT EXISTS fetch_forensics (
+  hash             text PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  url              text NOT NULL,
+  record           json NOT NULL
+);
+
+-- name: create-reconcile_jobs
+CREATE TABLE IF NOT EXISTS reconcile_jobs (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  source_id        text NOT NULL default '',
+  status           text NOT NULL default '',
+  error            text NOT NULL default '',
+  cursor           text NOT NULL default '',
+  checked          integer NOT NULL default 0,
+  added            integer NOT NULL default 0,
+  removed          integer NOT NULL default 0,
+  orphaned         integer NOT NULL default 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS reconcile_jobs_running ON reconcile_jobs (status) WHERE status = 'running';
+
+-- name: create-source_memberships
+CREATE TABLE IF NOT EXISTS source_memberships (
+  url              text NOT NULL,
+  source_id        text NOT NULL,
+  snapshot         text NOT NULL default '',
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  PRIMARY KEY      (url, source_id)
+);
+
+-- name: create-membership_changes
+CREATE TABLE IF NOT EXISTS membership_changes (
+  id               serial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  job_id           text NOT NULL default '',
+  url              text NOT NULL,
+  source_id        text NOT NULL,
+  change           text NOT NULL,
+  snapshot         text NOT NULL default ''
+);
+
+-- name: create-moderation_cases
+CREATE TABLE IF NOT EXISTS moderation_cases (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  subject          text NOT NULL,
+  status           text NOT NULL default 'open',
+  report_count     integer NOT NULL default 0,
+  resolution       text NOT NULL default ''
+);
+CREATE UNIQUE INDEX IF NOT EXISTS moderation_cases_open ON moderation_cases (subject) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS moderation_cases_subject ON moderation_cases (subject);
+
+-- name: create-content_reports
+CREATE TABLE IF NOT EXISTS content_reports (
+  id               serial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  case_id          text NOT NULL,
+  subject          text NOT NULL,
+  category         text NOT NULL,
+  details          text NOT NULL default '',
+  contact          text NOT NULL default ''
+);
+
+-- name: create-moderation_log
+CREATE TABLE IF NOT EXISTS moderation_log (
+  id               serial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  case_id          text NOT NULL,
+  actor            text NOT NULL default '',
+  action           text NOT NULL,
+  note             text NOT NULL default ''
+);
+
+-- name: create-meta_fields
+CREATE TABLE IF NOT EXISTS meta_fields (
+  source_id        text PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  fields           json NOT NULL
+);
+
+-- name: create-erase_jobs
+CREATE TABLE IF NOT EXISTS erase_jobs (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  finished         timestamp,
+  user_id          text NOT NULL,
+  mode             text NOT NULL,
+  status           text NOT NULL,
+  step             integer NOT NULL default 0,
+  counts           json NOT NULL,
+  error            text NOT NULL default ''
+);
+CREATE INDEX IF NOT EXISTS erase_jobs_user_id ON erase_jobs (user_id, status);
+
+-- name: create-feature_flags
+CREATE TABLE IF NOT EXISTS feature_flags (
+  name             text PRIMARY KEY NOT NULL,
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  rollout          integer NOT NULL default 0 -- percent of connections the flag is on for
+);
+
+-- name: create-feature_flag_overrides
+CREATE TABLE IF NOT EXISTS feature_flag_overrides (
+  key_id           text NOT NULL,
+  flag             text NOT NULL,
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  enabled          boolean NOT NULL,
+  PRIMARY KEY      (key_id, flag)
+);
+
+-- name: create-relations
+CREATE TABLE IF NOT EXISTS relations (
+  subject          text NOT NULL,
+  relation         text NOT NULL,
+  target           text NOT NULL,
+  key_id           text NOT NULL,
+  hash             text NOT NULL, -- metadata block asserting the relation
+  created          timestamp NOT NULL,
+  PRIMARY KEY      (subject, relation, target, key_id)
+);
+CREATE INDEX IF NOT EXISTS relations_target ON relations (target);
+
+-- name: create-link_sightings
+CREATE TABLE IF NOT EXISTS link_sightings (
+  src                  text NOT NULL,
+  dst                  text NOT NULL,
+  extractor            text NOT NULL default 'html',
+  first_seen           timestamp NOT NULL,
+  first_capture        text NOT NULL default '', -- hash of the capture of src the link was first seen in
+  last_seen            timestamp NOT NULL,
+  last_capture         text NOT NULL default '',
+  disappeared          timestamp,
+  disappeared_capture  text NOT NULL default '',
+  PRIMARY KEY          (src, dst)
+);
+
+-- name: create-link_events
+CREATE TABLE IF NOT EXISTS link_events (
+  src              text NOT NULL,
+  dst              text NOT NULL,
+  event            text NOT NULL,
+  capture          text NOT NULL,
+  at               timestamp NOT NULL,
+  PRIMARY KEY      (src, dst, capture, event)
+);
+
+-- name: create-fetch_recordings
+CREATE TABLE IF NOT EXISTS fetch_recordings (
+  hash             text PRIMARY KEY NOT NULL, -- hash of the crawl manifest
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  url              text NOT NULL,
+  manifest         json NOT NULL
+);
+
+-- name: create-fetch_exchanges
+CREATE TABLE IF NOT EXISTS fetch_exchanges (
+  recording        text NOT NULL references fetch_recordings(hash) ON DELETE CASCADE,
+  method           text NOT NULL,
+  url              text NOT NULL, -- redacted request url
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  status           integer NOT NULL,
+  header           json NOT NULL,
+  body             bytea NOT NULL,
+  PRIMARY KEY      (recording, method, url)
+);
+
+-- name: create-leases
+CREATE TABLE IF NOT EXISTS leases (
+  name             text PRIMARY KEY NOT NULL,
+  holder           text NOT NULL, -- id of the instance holding the lease
+  acquired         timestamp NOT NULL,
+  expires          timestamp NOT NULL
+);
+
+-- name: create-saved_searches
+CREATE TABLE IF NOT EXISTS saved_searches (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  owner            text NOT NULL, -- key id of the researcher who saved the search
+  name             text NOT NULL default '',
+  source_id        text NOT NULL default '', -- subprimer matches must fall under, empty for any
+  tag              text NOT NULL default '',
+  query            text NOT NULL default '',
+  webhook          text NOT NULL default '',
+  active           boolean NOT NULL default true
+);
+CREATE INDEX IF NOT EXISTS saved_searches_owner ON saved_searches (owner);
+
+-- name: create-saved_search_matches
+CREATE TABLE IF NOT EXISTS saved_search_matches (
+  search_id        UUID NOT NULL references saved_searches(id) ON DELETE CASCADE,
+  url              text NOT NULL,
+  subject          text NOT NULL default '', -- content hash of the url when it matched
+  created          timestamp NOT NULL,
+  PRIMARY KEY      (search_id, url)
+);
+
+-- name: create-bandwidth
+CREATE TABLE IF NOT EXISTS bandwidth (
+  day              date NOT NULL, -- utc
+  kind             text NOT NULL, -- one of crawl, served
+  bytes            bigint NOT NULL default 0,
+  PRIMARY KEY      (day, kind)
+);
+
+-- name: create-hash_aliases
+CREATE TABLE IF NOT EXISTS hash_aliases (
+  old              text PRIMARY KEY NOT NULL, -- hash content was known by before it was re-hashed
+  new              text NOT NULL, -- current hash of the same bytes, aliases never chain
+  created          timestamp NOT NULL default (now() at time zone 'utc')
+);
+CREATE INDEX IF NOT EXISTS hash_aliases_new ON hash_aliases (new);
+
+-- name: create-rehash_jobs
+CREATE TABLE IF NOT EXISTS rehash_jobs (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  algorithm        text NOT NULL, -- multihash name content is re-hashed with
+  rate             integer NOT NULL, -- most blocks re-hashed per second
+  status           text NOT NULL,
+  error            text NOT NULL default '',
+  cursor           text NOT NULL default '', -- last block checked, blocks are checked in order
+  checked          integer NOT NULL default 0,
+  rehashed         integer NOT NULL default 0,
+  current          integer NOT NULL default 0,
+  mismatched       integer NOT NULL default 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS rehash_jobs_running ON rehash_jobs (status) WHERE status = 'running';
+
+-- name: create-capture_retention
+CREATE TABLE IF NOT EXISTS capture_retention (
+  url              text PRIMARY KEY NOT NULL references urls(url) ON DELETE CASCADE,
+  created          timestamp NOT NULL,
+  updated          timestamp NOT NULL,
+  class            text NOT NULL, -- one of permanent, standard, ephemeral. see retention.go
+  expires          timestamp, -- null if the capture doesn't expire
+  promoted_by      text NOT NULL default '' -- key id of the person who made the capture permanent
+);
+CREATE INDEX IF NOT EXISTS capture_retention_expires ON capture_retention (expires) WHERE class != 'permanent';
+
+-- name: create-collection_access
+CREATE TABLE IF NOT EXISTS collection_access (
+  collection_id    UUID PRIMARY KEY NOT NULL references collections(id) ON DELETE CASCADE,
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  visibility       text NOT NULL default 'public'
+);
+
+-- name: create-collection_changes
+CREATE TABLE IF NOT EXISTS collection_changes (
+  id               serial PRIMARY KEY,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  collection_id    UUID NOT NULL,
+  url              text NOT NULL,
+  hash             text NOT NULL default '',
+  change           text NOT NULL,
+  key_id           text NOT NULL default ''
+);
+CREATE INDEX IF NOT EXISTS collection_changes_collection ON collection_changes (collection_id, created);
+
+-- name: create-chain_health_runs
+CREATE TABLE IF NOT EXISTS chain_health_runs (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL,
+  seed             bigint NOT NULL,
+  sample_size      integer NOT NULL,
+  sampled          integer NOT NULL,
+  healthy          integer NOT NULL,
+  broken           integer NOT NULL,
+  forked           integer NOT NULL,
+  unverifiable     integer NOT NULL,
+  causes           json NOT NULL,
+  examples         json NOT NULL
+);
+CREATE INDEX IF NOT EXISTS chain_health_runs_created ON chain_health_runs (created);
+
+-- name: create-api_keys
+CREATE TABLE IF NOT EXISTS api_keys (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL,
+  key_id           text NOT NULL, -- key id of the user the api key acts for
+  name             text NOT NULL default '',
+  token_hash       text UNIQUE NOT NULL, -- sha256 of the key's token, tokens aren't stored
+  scopes           text NOT NULL default '', -- space separated, see apiKeyScopes
+  revoked          timestamp,
+  subprimers       text NOT NULL default '' -- space separated ids of the sources the key is limited to
+);
+
+-- name: create-api_key_log
+CREATE TABLE IF NOT EXISTS api_key_log (
+  id               bigserial PRIMARY KEY,
+  created          timestamp NOT NULL,
+  api_key_id       text NOT NULL,
+  action           text NOT NULL, -- action type, or the endpoint for http requests
+  target           text NOT NULL default '', -- urls or subprimers the action was checked against
+  allowed          boolean NOT NULL,
+  error            text NOT NULL default ''
+);
+CREATE INDEX IF NOT EXISTS api_key_log_api_key_id ON api_key_log (api_key_id, created);
+
+-- name: create-hook_archives
+CREATE TABLE IF NOT EXISTS hook_archives (
+  api_key_id       text NOT NULL,
+  idempotency_key  text NOT NULL,
+  created          timestamp NOT NULL,
+  url              text NOT NULL,
+  callback         text NOT NULL default '',
+  archive_request_id integer NOT NULL,
+  PRIMARY KEY      (api_key_id, idempotency_key)
+);
+
+-- name: create-render_cards
+CREATE TABLE IF NOT EXISTS render_cards (
+  url              text NOT NULL,
+  hash             text NOT NULL,
+  created          timestamp NOT NULL,
+  favicon_url      text NOT NULL default '',
+  card             json NOT NULL,
+  PRIMARY KEY      (url, hash)
+);
+CREATE INDEX IF NOT EXISTS render_cards_favicon_url ON render_cards (favicon_url, created);
+
+-- name: create-render_favicons
+CREATE TABLE IF NOT EXISTS render_favicons (
+  hash             text PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL,
+  content_type     text NOT NULL,
+  data             bytea NOT NULL
+);
+
+-- name: create-user_exports
+CREATE TABLE IF NOT EXISTS user_exports (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL,
+  user_id          text NOT NULL,
+  status           text NOT NULL default 'preparing', -- one of preparing, ready, streamed, expired, failed
+  hash             text NOT NULL default '', -- multihash of the prepared zip, named by it in UserExportDir
+  size             bigint NOT NULL default 0,
+  expires          timestamp,
+  error            text NOT NULL default ''
+);
+CREATE INDEX IF NOT EXISTS user_exports_user_id ON user_exports (user_id, created);
+CREATE INDEX IF NOT EXISTS user_exports_hash ON user_exports (hash);
+
+-- name: create-announcements
+CREATE TABLE IF NOT EXISTS announcements (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL,
+  updated          timestamp NOT NULL,
+  message          text NOT NULL,
+  severity         text NOT NULL default 'info', -- one of info, warning, critical
+  starts           timestamp NOT NULL,
+  ends             timestamp, -- null for announcements that last until they're deleted
+  room             text NOT NULL default '' -- topic the announcement is for, empty for every client
+);
+CREATE INDEX IF NOT EXISTS announcements_ends ON announcements (ends);
+
+-- name: create-announcement_dismissals
+CREATE TABLE IF NOT EXISTS announcement_dismissals (
+  announcement_id  UUID NOT NULL references announcements(id) ON DELETE CASCADE,
+  key_id           text NOT NULL,
+  created          timestamp NOT NULL,
+  PRIMARY KEY (announcement_id, key_id)
+);
+
+-- name: create-idle_verifications
+CREATE TABLE IF NOT EXISTS idle_verifications (
+  path             text PRIMARY KEY NOT NULL, -- file the capture is stored in
+  hash             text NOT NULL,
+  size             bigint NOT NULL,
+  hashed           bigint NOT NULL default 0, -- bytes hashed as of the last checkpoint
+  state            bytea, -- saved hash state after hashed bytes
+  created          timestamp NOT NULL,
+  updated          timestamp NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idle_verifications_created ON idle_verifications (created);
+
+-- name: create-capture_notes
+CREATE TABLE IF NOT EXISTS capture_notes (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL,
+  capture          text NOT NULL, -- hash of the captured content
+  author           text NOT NULL, -- key id of the user that wrote the note
+  text             text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS capture_notes_capture ON capture_notes (capture, created);
+
+-- name: create-user_actions
+CREATE TABLE IF NOT EXISTS user_actions (
+  id               bigserial PRIMARY KEY,
+  created          timestamp NOT NULL,
+  user_id          text NOT NULL, -- key id of the user that acted
+  action           text NOT NULL, -- one of archive, metadata, rate_limited
+  subprimer        text NOT NULL default '', -- id of the subprimer an archived url falls under
+  target           text NOT NULL default '' -- url archived, subject of metadata, or the limit that was hit
+);
+CREATE INDEX IF NOT EXISTS user_actions_created ON user_actions (created);
+CREATE INDEX IF NOT EXISTS user_actions_user_id ON user_actions (user_id, created);
+
+-- name: create-outbox
+CREATE TABLE IF NOT EXISTS outbox (
+  id               bigserial PRIMARY KEY,
+  created          timestamp NOT NULL,
+  destination      text NOT NULL, -- destination type, eg: webhook
+  target           text NOT NULL default '', -- where the payload goes within the destination, eg: a webhook url
+  payload          json NOT NULL,
+  attempts         integer NOT NULL default 0,
+  next_attempt     timestamp NOT NULL,
+  status           text NOT NULL, -- one of pending, delivered, dead
+  last_error       text NOT NULL default '',
+  delivered        timestamp
+);
+CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (destination, next_attempt) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS outbox_status ON outbox (status, created);
+
+-- name: create-meta_key_renames
+CREATE TABLE IF NOT EXISTS meta_key_renames (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL,
+  updated          timestamp NOT NULL,
+  source_id        text NOT NULL, -- subprimer who's subjects are renamed
+  key_id           text NOT NULL, -- key of the curator who's blocks are written
+  from_key         text NOT NULL,
+  to_key           text NOT NULL,
+  plan             text NOT NULL, -- hash of the dry run plan that was confirmed
+  status           text NOT NULL,
+  error            text NOT NULL default '',
+  cursor           text NOT NULL default '', -- last subject checked, subjects are checked in order
+  checked          integer NOT NULL default 0,
+  renamed          integer NOT NULL default 0,
+  merged           integer NOT NULL default 0,
+  conflicts        json NOT NULL default '[]'
+);
+CREATE UNIQUE INDEX IF NOT EXISTS meta_key_renames_running ON meta_key_renames (source_id) WHERE status = 'running';
+
+-- name: create-cache_snapshots
+CREATE TABLE IF NOT EXISTS cache_snapshots (
+  name             text PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL,
+  data             bytea NOT NULL -- binary encoded cache state, see cache_snapshot.go
 );
 
 -- name: create-data_repos
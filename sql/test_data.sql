@@ -112,6 +112,252 @@ delete from uncrawlables;
 -- name: delete-archive_requests
 delete from archive_requests;
 
+-- name: insert-config_snapshots
+-- insert into config_snapshots values
+--  ('1220...','2017-01-01 00:00:01','326fcfa0-d3e6-4b2d-8f95-e77220e16109','{}','','');
+-- name: delete-config_snapshots
+delete from config_snapshots;
+
+-- name: insert-fetch_forensics
+-- insert into fetch_forensics values
+--  ('1220...','2017-01-01 00:00:01','https://www.epa.gov','{}');
+-- name: delete-fetch_forensics
+delete from fetch_forensics;
+
+-- name: insert-reconcile_jobs
+-- insert into reconcile_jobs values
+--  ('8b14f3d6-882f-4dd5-92f8-abaac220864f','2017-01-01 00:00:01','2017-01-01 00:00:01','','complete','','',0,0,0,0);
+-- name: delete-reconcile_jobs
+delete from reconcile_jobs;
+
+-- name: insert-source_memberships
+-- insert into source_memberships values
+--  ('http://www.epa.gov','326fcfa0-d3e6-4b2d-8f95-e77220e16109','','2017-01-01 00:00:01');
+-- name: delete-source_memberships
+delete from source_memberships;
+
+-- name: insert-membership_changes
+-- insert into membership_changes values
+--  (1,'2017-01-01 00:00:01','','http://www.epa.gov','326fcfa0-d3e6-4b2d-8f95-e77220e16109','added','');
+-- name: delete-membership_changes
+delete from membership_changes;
+
+-- name: insert-moderation_cases
+-- insert into moderation_cases values
+--  ('4d5c3e1a-6f2b-4b8e-9c1d-2a3b4c5d6e7f','2017-01-01 00:00:01','2017-01-01 00:00:01','1220b3a3e2a2ab2d7f1e1d8a9d1f7f2c3b4a5e6d7c8b9a0f1e2d3c4b5a6978','open',1,'');
+-- name: delete-moderation_cases
+delete from moderation_cases;
+
+-- name: insert-content_reports
+-- insert into content_reports values
+--  (1,'2017-01-01 00:00:01','4d5c3e1a-6f2b-4b8e-9c1d-2a3b4c5d6e7f','1220b3a3e2a2ab2d7f1e1d8a9d1f7f2c3b4a5e6d7c8b9a0f1e2d3c4b5a6978','personal_info','','');
+-- name: delete-content_reports
+delete from content_reports;
+
+-- name: insert-moderation_log
+-- insert into moderation_log values
+--  (1,'2017-01-01 00:00:01','4d5c3e1a-6f2b-4b8e-9c1d-2a3b4c5d6e7f','','report','personal_info');
+-- name: delete-moderation_log
+delete from moderation_log;
+
+-- name: insert-meta_fields
+-- insert into meta_fields values
+--  ('326fcfa0-d3e6-4b2d-8f95-e77220e16109','2017-01-01 00:00:01','2017-01-01 00:00:01','[{"key":"title","label":"Title","input":"text"}]');
+-- name: delete-meta_fields
+delete from meta_fields;
+
+-- name: insert-erase_jobs
+-- insert into erase_jobs values
+--  ('7c1d2e3f-4a5b-4c6d-8e9f-0a1b2c3d4e5f','2017-01-01 00:00:01','2017-01-01 00:00:01','2017-01-01 00:00:01','key','suppress','complete',4,'{"metadata":1}','');
+-- name: delete-erase_jobs
+delete from erase_jobs;
+
+-- name: insert-feature_flags
+-- insert into feature_flags values
+--  ('coalescedFrames','2017-01-01 00:00:01',10);
+-- name: delete-feature_flags
+delete from feature_flags;
+
+-- name: insert-feature_flag_overrides
+-- insert into feature_flag_overrides values
+--  ('key','coalescedFrames','2017-01-01 00:00:01',true);
+-- name: delete-feature_flag_overrides
+delete from feature_flag_overrides;
+
+-- name: insert-relations
+-- insert into relations values
+--  ('12207b06510193276b5fd9ad2fc55dcc004ada557d9259ca3505478bfef0b16ed977','supersedes','1220af06510193276b5fd9ad2fc55dcc004ada557d9259ca3505478bfef0b12ed988','key','1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a','2017-01-01 00:00:01');
+-- name: delete-relations
+delete from relations;
+
+-- name: insert-link_sightings
+-- insert into link_sightings values
+--  ('http://www.epa.gov','http://www.epa.gov/data','html','2017-01-01 00:00:01','1220...','2017-01-01 00:00:01','1220...',null,'');
+-- name: delete-link_sightings
+delete from link_sightings;
+
+-- name: insert-link_events
+-- insert into link_events values
+--  ('http://www.epa.gov','http://www.epa.gov/data','appeared','1220...','2017-01-01 00:00:01');
+-- name: delete-link_events
+delete from link_events;
+
+-- name: insert-fetch_recordings
+-- insert into fetch_recordings values
+--  ('1220...','2017-01-01 00:00:01','https://www.epa.gov','{}');
+-- name: delete-fetch_recordings
+delete from fetch_recordings;
+
+-- name: insert-fetch_exchanges
+-- insert into fetch_exchanges values
+--  ('1220...','GET','https://www.epa.gov','2017-01-01 00:00:01',200,'{}','');
+-- name: delete-fetch_exchanges
+delete from fetch_exchanges;
+
+-- name: insert-leases
+-- insert into leases values
+--  ('leader','host-1-5f2c9a1b','2017-01-01 00:00:01','2017-01-01 00:00:16');
+-- name: delete-leases
+delete from leases;
+
+-- name: insert-saved_searches
+-- insert into saved_searches values
+--  ('3b2a1c0d-9e8f-4a7b-8c6d-5e4f3a2b1c0d','2017-01-01 00:00:01','2017-01-01 00:00:01','key','sea level','','','sea level','',true);
+-- name: delete-saved_searches
+delete from saved_searches;
+
+-- name: insert-saved_search_matches
+-- insert into saved_search_matches values
+--  ('3b2a1c0d-9e8f-4a7b-8c6d-5e4f3a2b1c0d','http://www.noaa.gov/sea-level','1220...','2017-01-01 00:00:01');
+-- name: delete-saved_search_matches
+delete from saved_search_matches;
+
+-- name: insert-bandwidth
+-- insert into bandwidth values
+--  ('2017-01-01','crawl',1024);
+-- name: delete-bandwidth
+delete from bandwidth;
+
+-- name: insert-hash_aliases
+-- insert into hash_aliases values
+--  ('1220459219b10032cc86dcdbc0f83aea15a9d3e1119e7b5170beaee233008ea2c2de','b220...','2017-01-01 00:00:01');
+-- name: delete-hash_aliases
+delete from hash_aliases;
+
+-- name: insert-rehash_jobs
+-- insert into rehash_jobs values
+--  ('5c1d7a3e-2b4f-4e6a-9c8d-7f6e5d4c3b2a','2017-01-01 00:00:01','2017-01-01 00:00:01','blake2b-256',50,'running','','',0,0,0,0);
+-- name: delete-rehash_jobs
+delete from rehash_jobs;
+
+-- name: insert-capture_retention
+-- insert into capture_retention values
+--  ('http://www.epa.gov','2017-01-01 00:00:01','2017-01-01 00:00:01','ephemeral','2017-01-31 00:00:01','');
+-- name: delete-capture_retention
+delete from capture_retention;
+
+-- name: insert-collection_access
+-- insert into collection_access values
+
+-- name: delete-collection_access
+delete from collection_access;
+
+-- name: insert-collection_changes
+-- insert into collection_changes values
+
+-- name: delete-collection_changes
+delete from collection_changes;
+
+-- name: insert-chain_health_runs
+-- insert into chain_health_runs values
+
+-- name: delete-chain_health_runs
+delete from chain_health_runs;
+
+-- name: insert-api_keys
+-- insert into api_keys values
+--  ('6a7c6f7e-8a32-4bb0-9d3c-2a5f8c0f1e11','2017-01-01 00:00:01','key','ci','...','archive',null,'');
+-- name: delete-api_keys
+delete from api_keys;
+
+-- name: insert-api_key_log
+-- insert into api_key_log (created,api_key_id,action,target,allowed,error) values
+--   ('2017-01-01 00:00:01','6a7c6f7e-8a32-4bb0-9d3c-2a5f8c0f1e11','URL_FETCH_REQUEST','http://www.epa.gov',true,'');
+-- name: delete-api_key_log
+delete from api_key_log;
+
+-- name: insert-hook_archives
+-- insert into hook_archives values
+--  ('6a7c6f7e-8a32-4bb0-9d3c-2a5f8c0f1e11','deploy-42','2017-01-01 00:00:01','http://www.epa.gov','',1);
+-- name: delete-hook_archives
+delete from hook_archives;
+
+-- name: insert-render_cards
+-- insert into render_cards values
+--   ('http://www.epa.gov','1220a','2017-01-01 00:00:01','http://www.epa.gov/favicon.ico','{"heading":"EPA"}');
+-- name: delete-render_cards
+delete from render_cards;
+
+-- name: insert-render_favicons
+-- insert into render_favicons values
+--   ('1220b','2017-01-01 00:00:01','image/x-icon','\x00000100');
+-- name: delete-render_favicons
+delete from render_favicons;
+
+-- name: insert-user_exports
+-- insert into user_exports values
+--   ('0b8f3c1e-4d2a-4f6b-9a7e-1c2d3e4f5a6b','2017-01-01 00:00:01','a1b2c3','ready','1220c',1024,'2017-01-01 06:00:01','');
+-- name: delete-user_exports
+delete from user_exports;
+
+-- name: insert-announcements
+-- insert into announcements values
+--   ('6f1d2c3b-4a5e-4f60-8b7c-9d0e1f2a3b4c','2017-01-01 00:00:01','2017-01-01 00:00:01','down for maintenance at 5pm','warning','2017-01-01 00:00:01',null,'');
+-- name: delete-announcements
+delete from announcements;
+
+-- name: insert-announcement_dismissals
+-- insert into announcement_dismissals values
+--   ('6f1d2c3b-4a5e-4f60-8b7c-9d0e1f2a3b4c','a1b2c3','2017-01-01 00:00:02');
+-- name: delete-announcement_dismissals
+delete from announcement_dismissals;
+
+-- name: insert-idle_verifications
+-- insert into idle_verifications values
+--   ('/captures/1220b','1220b',536870912,268435456,null,'2017-01-01 00:00:01','2017-01-01 00:00:02');
+-- name: delete-idle_verifications
+delete from idle_verifications;
+
+-- name: insert-capture_notes
+-- insert into capture_notes values
+--   ('2c9e4f1a-7b3d-4e5f-8a6b-0c1d2e3f4a5b','2017-01-01 00:00:01','1220b','a1b2c3','this fetch got a cookie banner');
+-- name: delete-capture_notes
+delete from capture_notes;
+
+-- name: insert-user_actions
+-- insert into user_actions (created,user_id,action,subprimer,target) values
+--   ('2017-01-01 00:00:01','a1b2c3','archive','','http://www.epa.gov');
+-- name: delete-user_actions
+delete from user_actions;
+
+-- name: insert-outbox
+-- insert into outbox (created,destination,target,payload,next_attempt,status) values
+--   ('2017-01-01 00:00:01','webhook','https://example.com/hook','{}','2017-01-01 00:00:01','pending');
+-- name: delete-outbox
+delete from outbox;
+
+-- name: insert-meta_key_renames
+-- insert into meta_key_renames (id,created,updated,source_id,key_id,from_key,to_key,plan,status) values
+--   ('4f3e2d1c-0b9a-4876-9543-210fedcba987','2017-01-01 00:00:01','2017-01-01 00:00:01','5b1031f4-38a8-40b3-be91-c324bf686a87','a1b2c3','agency_name','publisher','','running');
+-- name: delete-meta_key_renames
+delete from meta_key_renames;
+
+-- name: insert-cache_snapshots
+-- insert into cache_snapshots (name,created,data) values
+--   ('caches','2017-01-01 00:00:01','');
+-- name: delete-cache_snapshots
+delete from cache_snapshots;
+
 -- name: insert-data_repos
 insert into data_repos
   (id,created,updated,title,description,url)
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// Recrawl planning
+//
+// Subprimers are recrawled every staleDuration. before scheduling recrawls of
+// a large subprimer owners can ask what it'll cost: how many requests, bytes
+// & how long each recrawl takes, & how it adds to the recrawls other
+// subprimers are scheduled for. plans are estimated from the subprimer's
+// existing captures & the server's politeness settings, nothing is fetched.
+//
+// Recrawls are assumed to archive every url in the subprimer the way
+// archiving does today: one GET of the url, & a GET of each link on html
+// pages, waiting FollowDelay before each link. all scheduled recrawls are
+// assumed to share a single crawler, so recrawls that together take longer
+// than they have exceed the crawler's capacity
+
+const (
+	// recrawl interval planned for subprimers without a staleDuration
+	defaultPlanInterval = 7 * 24 * time.Hour
+	// month recrawl estimates are totalled over
+	planMonth = 30 * 24 * time.Hour
+	// figures assumed for subprimers without captures to estimate from
+	defaultPlanPageBytes    = 100 << 10
+	defaultPlanLinksPerPage = 20
+	defaultPlanFetch        = time.Second
+)
+
+// ErrNotPlanOwner is returned when planning recrawls of another key's subprimer
+var ErrNotPlanOwner = fmt.Errorf("only subprimer owners can plan recrawls")
+
+// SubprimerPlan estimates what recrawling a subprimer on a schedule costs
+type SubprimerPlan struct {
+	SourceId string `json:"sourceId"`
+	// seconds between recrawls
+	Interval int64 `json:"interval"`
+	// urls in the subprimer, & how many of them have been captured
+	Urls     int `json:"urls"`
+	Captured int `json:"captured"`
+
+	// estimates for each recrawl. wallClock is in seconds
+	Requests  int64 `json:"requests"`
+	Bytes     int64 `json:"bytes"`
+	WallClock int64 `json:"wallClock"`
+	// estimates for a 30 day month of recrawls
+	MonthlyRequests int64 `json:"monthlyRequests"`
+	MonthlyBytes    int64 `json:"monthlyBytes"`
+
+	// subprimers sharing urls with this one
+	Overlaps []*PlanOverlap `json:"overlaps"`
+	// share of the crawler's time recrawls of every scheduled subprimer take
+	// with this plan, more than 1 can't be kept up with
+	Utilization          float64 `json:"utilization"`
+	ExceedsQueueCapacity bool    `json:"exceedsQueueCapacity"`
+	// bytes recrawls of every scheduled subprimer crawl in a month with this
+	// plan, & the crawl cap they're held to. 0 if crawling isn't capped
+	ScheduledMonthlyBytes int64 `json:"scheduledMonthlyBytes"`
+	CrawlCap              int64 `json:"crawlCap"`
+	ExceedsBandwidthCap   bool  `json:"exceedsBandwidthCap"`
+
+	Assumptions *PlanAssumptions `json:"assumptions"`
+}
+
+// PlanOverlap is a subprimer that shares urls with a planned one
+type PlanOverlap struct {
+	SourceId   string `json:"sourceId"`
+	Title      string `json:"title"`
+	SharedUrls int    `json:"sharedUrls"`
+	// seconds between the subprimer's recrawls, 0 if it isn't crawled
+	Interval int64 `json:"interval"`
+}
+
+// PlanAssumptions are the figures a plan is estimated from
+type PlanAssumptions struct {
+	// average size of a captured page
+	AvgPageBytes int64 `json:"avgPageBytes"`
+	// average links on a captured html page
+	LinksPerPage float64 `json:"linksPerPage"`
+	// share of captured pages that are html
+	HtmlShare float64 `json:"htmlShare"`
+	// average milliseconds a fetch takes, from fetch forensics
+	AvgFetchMillis int64 `json:"avgFetchMillis"`
+	// milliseconds archiving waits before following each link
+	FollowDelayMillis int64 `json:"followDelayMillis"`
+	// each assumption in words, & where defaults stood in for history
+	Notes []string `json:"notes"`
+}
+
+// planStats summarizes a subprimer's captures
+type planStats struct {
+	urls, captured, html, links int
+	pageBytes                   float64
+	fetch                       time.Duration
+}
+
+// readPlanStats summarizes the captures of the urls in a subprimer
+func readPlanStats(db *sql.DB, sourceId string) (*planStats, error) {
+	st := &planStats{}
+	err := db.QueryRow(`select count(1),
+		count(u.url) filter (where u.last_get is not null and u.content_length > 0),
+		count(u.url) filter (where u.last_get is not null and u.content_length > 0 and u.content_type like 'text/html%'),
+		coalesce(avg(u.content_length) filter (where u.last_get is not null and u.content_length > 0), 0)
+		from source_memberships m left join urls u on u.url = m.url
+		where m.source_id = $1`, sourceId).Scan(&st.urls, &st.captured, &st.html, &st.pageBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.QueryRow(`select count(1) from links l
+		join source_memberships m on m.url = l.src where m.source_id = $1`, sourceId).Scan(&st.links); err != nil {
+		return nil, err
+	}
+	var fetchNanos float64
+	if err := db.QueryRow(`select coalesce(avg((f.record->'timing'->>'total')::bigint), 0) from fetch_forensics f
+		join source_memberships m on m.url = f.url where m.source_id = $1`, sourceId).Scan(&fetchNanos); err != nil {
+		return nil, err
+	}
+	st.fetch = time.Duration(fetchNanos)
+	return st, nil
+}
+
+// assumptions works out the figures a subprimer's recrawls are estimated
+// from, falling back to defaults where there's no history
+func (st *planStats) assumptions(followDelay time.Duration) *PlanAssumptions {
+	a := &PlanAssumptions{
+		AvgPageBytes:      int64(st.pageBytes),
+		HtmlShare:         1,
+		LinksPerPage:      defaultPlanLinksPerPage,
+		AvgFetchMillis:    int64(st.fetch / time.Millisecond),
+		FollowDelayMillis: int64(followDelay / time.Millisecond),
+		Notes:             []string{},
+	}
+	note := func(format string, args ...interface{}) {
+		a.Notes = append(a.Notes, fmt.Sprintf(format, args...))
+	}
+
+	if st.captured > 0 {
+		a.HtmlShare = float64(st.html) / float64(st.captured)
+		note("pages average %d bytes, from %d captured urls", a.AvgPageBytes, st.captured)
+		note("%.0f%% of pages are html & have their links followed", a.HtmlShare*100)
+	} else {
+		a.AvgPageBytes = defaultPlanPageBytes
+		note("no urls have been captured, pages are assumed to average %d bytes & all be html", a.AvgPageBytes)
+	}
+	if st.html > 0 {
+		a.LinksPerPage = float64(st.links) / float64(st.html)
+		note("html pages average %.1f links, from %d captured html pages", a.LinksPerPage, st.html)
+	} else {
+		note("no html pages have been captured, pages are assumed to average %d links", defaultPlanLinksPerPage)
+	}
+	if st.fetch > 0 {
+		note("fetches average %dms, from fetch forensics", a.AvgFetchMillis)
+	} else {
+		a.AvgFetchMillis = int64(defaultPlanFetch / time.Millisecond)
+		note("no fetches have been recorded, fetches are assumed to take %dms", a.AvgFetchMillis)
+	}
+	note("archiving waits %dms before following each link", a.FollowDelayMillis)
+	note("pages reached by following links are assumed to be the same size as the subprimer's pages")
+	return a
+}
+
+// planEstimate is the cost of one recrawl
+type planEstimate struct {
+	requests, bytes int64
+	wallClock       time.Duration
+}
+
+// estimateRecrawl works out what one recrawl of urls costs under a's assumptions
+func estimateRecrawl(urls int, a *PlanAssumptions) planEstimate {
+	followed := int64(math.Ceil(float64(urls) * a.HtmlShare * a.LinksPerPage))
+	requests := int64(urls) + followed
+	return planEstimate{
+		requests:  requests,
+		bytes:     requests * a.AvgPageBytes,
+		wallClock: time.Duration(requests)*time.Duration(a.AvgFetchMillis)*time.Millisecond + time.Duration(followed)*time.Duration(a.FollowDelayMillis)*time.Millisecond,
+	}
+}
+
+// perMonth scales a figure for each recrawl to a month of recrawls
+func perMonth(n int64, interval time.Duration) int64 {
+	return int64(float64(n) * float64(planMonth) / float64(interval))
+}
+
+// PlanSubprimer estimates recrawling s every interval, along with the
+// recrawls other subprimers are scheduled for. followDelay is the politeness
+// delay between links, crawlCap the monthly crawl cap in bytes, 0 if uncapped
+func PlanSubprimer(db *sql.DB, s *core.Source, interval, followDelay time.Duration, crawlCap int64) (*SubprimerPlan, error) {
+	if interval <= 0 {
+		interval = s.StaleDuration
+	}
+	if interval <= 0 {
+		interval = defaultPlanInterval
+	}
+
+	st, err := readPlanStats(db, s.Id)
+	if err != nil {
+		return nil, err
+	}
+	a := st.assumptions(followDelay)
+	est := estimateRecrawl(st.urls, a)
+	p := &SubprimerPlan{
+		SourceId:        s.Id,
+		Interval:        int64(interval / time.Second),
+		Urls:            st.urls,
+		Captured:        st.captured,
+		Requests:        est.requests,
+		Bytes:           est.bytes,
+		WallClock:       int64(est.wallClock / time.Second),
+		MonthlyRequests: perMonth(est.requests, interval),
+		MonthlyBytes:    perMonth(est.bytes, interval),
+		Overlaps:        []*PlanOverlap{},
+		CrawlCap:        crawlCap,
+		Assumptions:     a,
+	}
+	p.Utilization = float64(est.wallClock) / float64(interval)
+	p.ScheduledMonthlyBytes = p.MonthlyBytes
+
+	// every other subprimer that's crawled is recrawled every staleDuration
+	rows, err := db.Query("select id, title, crawl, stale_duration from sources where coalesce(deleted, false) = false and id::text != $1 order by id", s.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type scheduled struct {
+		id, title string
+		interval  time.Duration
+	}
+	others := []*scheduled{}
+	for rows.Next() {
+		var (
+			o       = &scheduled{}
+			crawl   sql.NullBool
+			staleMs int64
+		)
+		if err := rows.Scan(&o.id, &o.title, &crawl, &staleMs); err != nil {
+			return nil, err
+		}
+		if crawl.Bool && staleMs > 0 {
+			o.interval = time.Duration(staleMs) * time.Millisecond
+		}
+		others = append(others, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	shared, err := sharedUrls(db, s.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range others {
+		if n := shared[o.id]; n > 0 {
+			p.Overlaps = append(p.Overlaps, &PlanOverlap{SourceId: o.id, Title: o.title, SharedUrls: n, Interval: int64(o.interval / time.Second)})
+		}
+		if o.interval == 0 {
+			continue
+		}
+		ost, err := readPlanStats(db, o.id)
+		if err != nil {
+			return nil, err
+		}
+		oest := estimateRecrawl(ost.urls, ost.assumptions(followDelay))
+		p.Utilization += float64(oest.wallClock) / float64(o.interval)
+		p.ScheduledMonthlyBytes += perMonth(oest.bytes, o.interval)
+	}
+
+	p.ExceedsQueueCapacity = p.Utilization > 1
+	p.ExceedsBandwidthCap = crawlCap > 0 && p.ScheduledMonthlyBytes > crawlCap
+	return p, nil
+}
+
+// sharedUrls counts the urls a subprimer shares with each other subprimer, by id
+func sharedUrls(db *sql.DB, sourceId string) (map[string]int, error) {
+	rows, err := db.Query(`select b.source_id, count(1) from source_memberships a
+		join source_memberships b on b.url = a.url and b.source_id != a.source_id
+		where a.source_id = $1 group by b.source_id`, sourceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shared := map[string]int{}
+	for rows.Next() {
+		var (
+			id string
+			n  int
+		)
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		shared[id] = n
+	}
+	return shared, rows.Err()
+}
+
+// SubprimerPlanAction estimates what recrawling a subprimer costs, for it's owners
+type SubprimerPlanAction struct {
+	ReqAction
+	clientAction
+	SourceId string `json:"sourceId"`
+	// seconds between recrawls, the subprimer's staleDuration if 0
+	Interval int64 `json:"interval"`
+}
+
+func (SubprimerPlanAction) Type() string        { return "SUBPRIMER_PLAN_REQUEST" }
+func (SubprimerPlanAction) SuccessType() string { return "SUBPRIMER_PLAN_SUCCESS" }
+func (SubprimerPlanAction) FailureType() string { return "SUBPRIMER_PLAN_FAILURE" }
+
+func (SubprimerPlanAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &SubprimerPlanAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *SubprimerPlanAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+	s := &core.Source{Id: a.SourceId}
+	if err := s.Read(store); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "source", a.SourceId)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if !isSourceOwner(s, a.client.requester()) {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrNotPlanOwner.Error()}
+	}
+
+	svc := a.client.service()
+	plan, err := PlanSubprimer(svc.DB, s, time.Duration(a.Interval)*time.Second, svc.FollowDelay, bandwidth.crawlCap)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "SUBPRIMER_PLAN",
+		Id:        a.SourceId,
+		Data:      plan,
+	}
+}
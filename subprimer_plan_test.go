@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestPlanAssumptions(t *testing.T) {
+	cases := []struct {
+		st           planStats
+		pageBytes    int64
+		linksPerPage float64
+		htmlShare    float64
+		fetchMillis  int64
+	}{
+		// subprimers without history fall back to defaults
+		{planStats{urls: 10}, defaultPlanPageBytes, defaultPlanLinksPerPage, 1, 1000},
+		{planStats{urls: 10, captured: 4, html: 2, links: 10, pageBytes: 2048, fetch: 250 * time.Millisecond}, 2048, 5, 0.5, 250},
+		// captures that aren't html don't say how many links pages have
+		{planStats{urls: 10, captured: 4, pageBytes: 2048}, 2048, defaultPlanLinksPerPage, 0, 1000},
+	}
+
+	for i, c := range cases {
+		a := c.st.assumptions(3 * time.Second)
+		if a.AvgPageBytes != c.pageBytes || a.LinksPerPage != c.linksPerPage || a.HtmlShare != c.htmlShare || a.AvgFetchMillis != c.fetchMillis {
+			t.Errorf("case %d expected %d bytes, %.1f links, %.2f html & %dms fetches, got: %d, %.1f, %.2f, %dms", i,
+				c.pageBytes, c.linksPerPage, c.htmlShare, c.fetchMillis, a.AvgPageBytes, a.LinksPerPage, a.HtmlShare, a.AvgFetchMillis)
+		}
+		if a.FollowDelayMillis != 3000 {
+			t.Errorf("case %d expected a 3000ms follow delay, got: %d", i, a.FollowDelayMillis)
+		}
+		if len(a.Notes) == 0 {
+			t.Errorf("case %d expected assumptions to be noted", i)
+		}
+	}
+}
+
+func TestEstimateRecrawl(t *testing.T) {
+	a := &PlanAssumptions{AvgPageBytes: 1024, LinksPerPage: 3, HtmlShare: 0.5, AvgFetchMillis: 500, FollowDelayMillis: 3000}
+	cases := []struct {
+		urls      int
+		requests  int64
+		bytes     int64
+		wallClock time.Duration
+	}{
+		{0, 0, 0, 0},
+		// 4.5 links are rounded up to 5
+		{3, 8, 8192, 19 * time.Second},
+		{100, 250, 256000, 125*time.Second + 450*time.Second},
+	}
+
+	for i, c := range cases {
+		est := estimateRecrawl(c.urls, a)
+		if est.requests != c.requests || est.bytes != c.bytes || est.wallClock != c.wallClock {
+			t.Errorf("case %d expected %d requests, %d bytes & %s, got: %d, %d, %s", i, c.requests, c.bytes, c.wallClock, est.requests, est.bytes, est.wallClock)
+		}
+	}
+
+	if n := perMonth(10, 24*time.Hour); n != 300 {
+		t.Errorf("expected daily recrawls to run 30 times a month, got: %d", n)
+	}
+}
+
+func TestPlanSubprimer(t *testing.T) {
+	defer resetTestData(appDB, "urls", "links", "source_memberships", "fetch_forensics")
+
+	const (
+		epa    = "326fcfa0-d3e6-4b2d-8f95-e77220e16109"
+		census = "440d9779-406c-4015-8f2d-404b04ead3a2"
+	)
+	if _, err := appDB.Exec(`insert into urls (url,created,updated,last_get,content_type,content_length) values
+		('http://www.epa.gov/a', now(), now(), now(), 'text/html; charset=utf-8', 1024),
+		('http://www.epa.gov/b.pdf', now(), now(), now(), 'application/pdf', 3072),
+		('http://www.epa.gov/c', now(), now(), null, '', 0),
+		('http://www.epa.gov/1', now(), now(), null, '', 0),
+		('http://www.epa.gov/2', now(), now(), null, '', 0),
+		('http://www.epa.gov/3', now(), now(), null, '', 0)`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into links (created,updated,src,dst) values
+		(now(), now(), 'http://www.epa.gov/a', 'http://www.epa.gov/1'),
+		(now(), now(), 'http://www.epa.gov/a', 'http://www.epa.gov/2'),
+		(now(), now(), 'http://www.epa.gov/a', 'http://www.epa.gov/3')`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into source_memberships (url,source_id) values
+		('http://www.epa.gov/a', $1),
+		('http://www.epa.gov/b.pdf', $1),
+		('http://www.epa.gov/c', $1),
+		('http://www.epa.gov/a', $2)`, epa, census); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into fetch_forensics (hash,url,record) values
+		('1220a', 'http://www.epa.gov/a', '{"timing":{"total":400000000}}'),
+		('1220b', 'http://www.epa.gov/b.pdf', '{"timing":{"total":600000000}}')`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s := &core.Source{Id: epa}
+	p, err := PlanSubprimer(appDB, s, 24*time.Hour, 3*time.Second, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// 3 urls, 2 captured averaging 2048 bytes, half of them html with 3 links,
+	// & fetches averaging 500ms
+	if p.Urls != 3 || p.Captured != 2 {
+		t.Errorf("expected 3 urls & 2 captures, got: %d, %d", p.Urls, p.Captured)
+	}
+	if p.Requests != 8 || p.Bytes != 16384 || p.WallClock != 19 {
+		t.Errorf("expected 8 requests, 16384 bytes & 19 seconds, got: %d, %d, %d", p.Requests, p.Bytes, p.WallClock)
+	}
+	if p.MonthlyRequests != 240 || p.MonthlyBytes != 491520 {
+		t.Errorf("expected 240 requests & 491520 bytes a month, got: %d, %d", p.MonthlyRequests, p.MonthlyBytes)
+	}
+	if len(p.Overlaps) != 1 || p.Overlaps[0].SourceId != census || p.Overlaps[0].SharedUrls != 1 || p.Overlaps[0].Interval != 43200 {
+		data, _ := json.Marshal(p.Overlaps)
+		t.Errorf("expected plan to overlap census.gov's 12 hour recrawls, got: %s", data)
+	}
+
+	// census.gov recrawls it's 1 url every 12 hours, taking 10.6 seconds & 4096 bytes
+	if p.ScheduledMonthlyBytes != 491520+245760 {
+		t.Errorf("expected %d bytes to be scheduled a month, got: %d", 491520+245760, p.ScheduledMonthlyBytes)
+	}
+	if expect := 19.0/86400 + 10.6/43200; p.Utilization < expect-1e-9 || p.Utilization > expect+1e-9 {
+		t.Errorf("expected utilization %f, got: %f", expect, p.Utilization)
+	}
+	if p.ExceedsBandwidthCap || p.ExceedsQueueCapacity {
+		t.Errorf("expected plan to fit, got: %#v", p)
+	}
+
+	p, err = PlanSubprimer(appDB, s, 10*time.Second, 3*time.Second, 500000)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !p.ExceedsBandwidthCap || !p.ExceedsQueueCapacity {
+		t.Errorf("expected recrawls every 10 seconds to exceed the crawl cap & crawler, got: %t, %t", p.ExceedsBandwidthCap, p.ExceedsQueueCapacity)
+	}
+
+	// subprimers without a staleDuration are planned weekly
+	p, err = PlanSubprimer(appDB, s, 0, 3*time.Second, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if p.Interval != int64(defaultPlanInterval/time.Second) {
+		t.Errorf("expected a weekly interval, got: %d", p.Interval)
+	}
+
+	// only owners can plan recrawls
+	res := (SubprimerPlanAction{}).Parse("1", json.RawMessage(`{"sourceId":"`+epa+`"}`)).Exec()
+	if res.Error != ErrNotPlanOwner.Error() {
+		t.Errorf("expected error %q, got: %q", ErrNotPlanOwner.Error(), res.Error)
+	}
+}
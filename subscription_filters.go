@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Subscription filters
+//
+// Busy topics send clients more events than they want. Clients can declare a
+// filter when they subscribe to a subject or collection, & the room only
+// delivers events the filter allows. filters are compiled once at subscribe
+// time & stored with the subscription, so checking one during fan-out is a
+// few map lookups. subscribing again replaces the filter, subscribing without
+// one sends every event. subscribe acknowledgements echo the active filter
+
+const (
+	severityInfo = iota
+	severityWarning
+	severityCritical
+)
+
+// severities maps severity names to levels
+var severities = map[string]int{
+	"info":     severityInfo,
+	"warning":  severityWarning,
+	"critical": severityCritical,
+}
+
+// eventSeverities are the levels of events that aren't info
+var eventSeverities = map[string]int{
+	"URL_SET_ERROR":      severityWarning,
+	"CONTENT_SUPPRESSED": severityCritical,
+}
+
+// topicEvents are the event types published to subject & collection topics
+var topicEvents = map[string]bool{
+	"EDITORS_CHANGED":          true,
+	"CONTENT_SUPPRESSED":       true,
+	"SAVED_SEARCH_MATCH":       true,
+	"URL_SET_LOADING":          true,
+	"URL_SET_SUCCESS":          true,
+	"URL_SET_ERROR":            true,
+	"COLLECTION_ITEMS_CHANGED": true,
+	"ANNOUNCEMENT":             true,
+	"ANNOUNCEMENT_EXPIRED":     true,
+}
+
+// ErrInvalidSubscriptionFilter is returned when subscribing with a filter that can't match events
+var ErrInvalidSubscriptionFilter = fmt.Errorf("invalid subscription filter")
+
+// SubscriptionFilter picks which of a topic's events a subscriber is sent.
+// every condition that's set must hold
+type SubscriptionFilter struct {
+	// event types to send, every type if empty
+	Types []string `json:"types"`
+	// least severe events to send, one of ["info","warning","critical"]. default "info"
+	MinSeverity string `json:"minSeverity"`
+	// only send events that change content: captures that changed a url's
+	// content, collection membership changes, matches & suppression
+	ContentChanged bool `json:"contentChanged"`
+	// don't send events caused by the subscriber's own writes
+	ExcludeOwn bool `json:"excludeOwn"`
+}
+
+// eventFilter is a compiled SubscriptionFilter
+type eventFilter struct {
+	types          map[string]bool
+	minSeverity    int
+	contentChanged bool
+	// key id of the subscriber, events it authored are dropped if set
+	excludeAuthor string
+	// filter as the subscriber declared it, normalized
+	wire *SubscriptionFilter
+}
+
+// compileFilter checks a filter, compiling it for a subscriber. nil filters
+// compile to nil, which allows every event
+func compileFilter(f *SubscriptionFilter, keyId string) (*eventFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	wire := &SubscriptionFilter{Types: []string{}, MinSeverity: f.MinSeverity, ContentChanged: f.ContentChanged, ExcludeOwn: f.ExcludeOwn}
+	if wire.MinSeverity == "" {
+		wire.MinSeverity = "info"
+	}
+	severity, ok := severities[wire.MinSeverity]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown severity %q", ErrInvalidSubscriptionFilter, f.MinSeverity)
+	}
+
+	ef := &eventFilter{minSeverity: severity, contentChanged: f.ContentChanged, wire: wire}
+	if len(f.Types) > 0 {
+		ef.types = map[string]bool{}
+		for _, t := range f.Types {
+			if !topicEvents[t] {
+				return nil, fmt.Errorf("%s: unknown event type %q", ErrInvalidSubscriptionFilter, t)
+			}
+			if !ef.types[t] {
+				ef.types[t] = true
+				wire.Types = append(wire.Types, t)
+			}
+		}
+	}
+	if f.ExcludeOwn {
+		ef.excludeAuthor = keyId
+	}
+	return ef, nil
+}
+
+// allows checks a filter lets a message through. nil filters allow everything
+func (f *eventFilter) allows(msg *topicMessage) bool {
+	if f == nil {
+		return true
+	}
+	if f.types != nil && !f.types[msg.event] {
+		return false
+	}
+	if f.minSeverity > severityInfo && msg.level() < f.minSeverity {
+		return false
+	}
+	if f.contentChanged && !msg.contentChanged {
+		return false
+	}
+	if f.excludeAuthor != "" && msg.author == f.excludeAuthor {
+		return false
+	}
+	return true
+}
+
+// level is the severity of a message's event
+func (msg *topicMessage) level() int {
+	if msg.severity > eventSeverities[msg.event] {
+		return msg.severity
+	}
+	return eventSeverities[msg.event]
+}
+
+// Filter is the filter to echo to the subscriber, nil if it allows everything
+func (f *eventFilter) Filter() *SubscriptionFilter {
+	if f == nil {
+		return nil
+	}
+	return f.wire
+}
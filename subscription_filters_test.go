@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileFilter(t *testing.T) {
+	cases := []struct {
+		filter *SubscriptionFilter
+		err    string
+		wire   string
+	}{
+		{nil, "", ""},
+		{&SubscriptionFilter{}, "", "[] info"},
+		{&SubscriptionFilter{Types: []string{"URL_SET_ERROR", "URL_SET_ERROR", "EDITORS_CHANGED"}, MinSeverity: "warning"}, "", "[URL_SET_ERROR EDITORS_CHANGED] warning"},
+		{&SubscriptionFilter{MinSeverity: "loud"}, `unknown severity "loud"`, ""},
+		{&SubscriptionFilter{Types: []string{"METADATA_ADDED"}}, `unknown event type "METADATA_ADDED"`, ""},
+	}
+
+	for i, c := range cases {
+		f, err := compileFilter(c.filter, "key")
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("case %d expected error containing %q, got: %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err.Error())
+			continue
+		}
+		wire := ""
+		if w := f.Filter(); w != nil {
+			wire = strings.Join([]string{"[" + strings.Join(w.Types, " ") + "]", w.MinSeverity}, " ")
+		}
+		if wire != c.wire {
+			t.Errorf("case %d expected filter to echo as %q, got: %q", i, c.wire, wire)
+		}
+	}
+}
+
+func TestEventFilterAllows(t *testing.T) {
+	compile := func(f *SubscriptionFilter) *eventFilter {
+		ef, err := compileFilter(f, "me")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return ef
+	}
+	editors := &topicMessage{event: "EDITORS_CHANGED", author: "me"}
+	failed := &topicMessage{event: "URL_SET_ERROR"}
+	suppressed := &topicMessage{event: "CONTENT_SUPPRESSED", contentChanged: true}
+	changed := &topicMessage{event: "COLLECTION_ITEMS_CHANGED", author: "someone", contentChanged: true}
+	announced := &topicMessage{event: "ANNOUNCEMENT", severity: severityCritical}
+
+	cases := []struct {
+		filter *eventFilter
+		msg    *topicMessage
+		allow  bool
+	}{
+		{nil, editors, true},
+		{compile(&SubscriptionFilter{}), editors, true},
+		{compile(&SubscriptionFilter{Types: []string{"URL_SET_ERROR"}}), failed, true},
+		{compile(&SubscriptionFilter{Types: []string{"URL_SET_ERROR"}}), editors, false},
+		{compile(&SubscriptionFilter{MinSeverity: "warning"}), failed, true},
+		{compile(&SubscriptionFilter{MinSeverity: "warning"}), editors, false},
+		{compile(&SubscriptionFilter{MinSeverity: "critical"}), failed, false},
+		{compile(&SubscriptionFilter{MinSeverity: "critical"}), suppressed, true},
+		{compile(&SubscriptionFilter{ContentChanged: true}), changed, true},
+		{compile(&SubscriptionFilter{ContentChanged: true}), editors, false},
+		{compile(&SubscriptionFilter{ExcludeOwn: true}), editors, false},
+		{compile(&SubscriptionFilter{ExcludeOwn: true}), changed, true},
+		{compile(&SubscriptionFilter{MinSeverity: "critical"}), announced, true},
+	}
+
+	for i, c := range cases {
+		if got := c.filter.allows(c.msg); got != c.allow {
+			t.Errorf("case %d expected allows to be %t, got: %t", i, c.allow, got)
+		}
+	}
+
+	// anonymous subscribers have no writes of their own to exclude
+	anon, _ := compileFilter(&SubscriptionFilter{ExcludeOwn: true}, "")
+	if !anon.allows(&topicMessage{event: "EDITORS_CHANGED"}) {
+		t.Errorf("expected anonymous subscribers to get events without an author")
+	}
+}
+
+func TestRoomSubscriptionFilters(t *testing.T) {
+	hub := newRoom()
+	go hub.run()
+
+	everything := &Client{hub: hub, send: make(chan []byte, 8)}
+	quiet := &Client{hub: hub, send: make(chan []byte, 8)}
+	hub.register <- everything
+	hub.register <- quiet
+
+	warnings, _ := compileFilter(&SubscriptionFilter{MinSeverity: "warning", ExcludeOwn: true}, "quiet")
+	topic := subjectTopic("subject")
+	everything.Subscribe(topic)
+	quiet.SubscribeFiltered(topic, warnings)
+
+	publish := func(msgs ...*topicMessage) {
+		for _, m := range msgs {
+			m.topic = topic
+			m.data = []byte(m.event)
+			hub.publish <- m
+		}
+		// the broadcast is delivered after every publish, marking the end of them
+		hub.broadcast <- []byte("END")
+	}
+	received := func(c *Client) []string {
+		got := []string{}
+		for {
+			select {
+			case msg := <-c.send:
+				if string(msg) == "END" {
+					return got
+				}
+				got = append(got, string(msg))
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for messages, got: %v", got)
+			}
+		}
+	}
+
+	publish(
+		&topicMessage{event: "EDITORS_CHANGED"},
+		&topicMessage{event: "URL_SET_ERROR", author: "quiet"},
+		&topicMessage{event: "URL_SET_ERROR"},
+		&topicMessage{event: "CONTENT_SUPPRESSED"},
+	)
+	if got := strings.Join(received(everything), ","); got != "EDITORS_CHANGED,URL_SET_ERROR,URL_SET_ERROR,CONTENT_SUPPRESSED" {
+		t.Errorf("expected unfiltered subscriber to get every event, got: %s", got)
+	}
+	if got := strings.Join(received(quiet), ","); got != "URL_SET_ERROR,CONTENT_SUPPRESSED" {
+		t.Errorf("expected filtered subscriber to only get other's warnings, got: %s", got)
+	}
+
+	// subscribing again replaces the filter
+	critical, _ := compileFilter(&SubscriptionFilter{MinSeverity: "critical"}, "quiet")
+	quiet.SubscribeFiltered(topic, critical)
+	publish(&topicMessage{event: "URL_SET_ERROR"}, &topicMessage{event: "CONTENT_SUPPRESSED"})
+	received(everything)
+	if got := strings.Join(received(quiet), ","); got != "CONTENT_SUPPRESSED" {
+		t.Errorf("expected re-subscribing to replace the filter, got: %s", got)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+)
+
+const (
+	// maxSuggestBytes caps the number of bytes of stored content read when
+	// generating metadata suggestions. Every extractor only works on this prefix.
+	maxSuggestBytes = 512 * 1024
+	// suggestTimeout is the longest a single extractor is allowed to run before
+	// we give up & return an empty suggestion
+	suggestTimeout = 3 * time.Second
+)
+
+// metadataExtractor pulls suggested metadata from a prefix of a file's bytes.
+// extractors should return an error if they can't make sense of the data,
+// SuggestMetadata takes care of degrading to an empty suggestion
+type metadataExtractor func(data []byte) (map[string]interface{}, error)
+
+// SuggestMetadata generates suggested metadata for a url from the first bytes
+// of it's stored content, selecting an extractor by sniffed content type.
+// SuggestMetadata never errors, returning an empty map if no suggestions can be made
+func SuggestMetadata(u *core.Url, r io.Reader) map[string]interface{} {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSuggestBytes))
+	if err != nil && len(data) == 0 {
+		log.Infof("suggest metadata read error for %s: %s", u.Url, err.Error())
+		return map[string]interface{}{}
+	}
+
+	extract := extractorFor(u, data)
+	if extract == nil {
+		return map[string]interface{}{}
+	}
+
+	type result struct {
+		meta map[string]interface{}
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		meta, err := extract(data)
+		done <- result{meta, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil || res.meta == nil {
+			if res.err != nil {
+				log.Infof("suggest metadata extraction error for %s: %s", u.Url, res.err.Error())
+			}
+			return map[string]interface{}{}
+		}
+		return res.meta
+	case <-time.After(suggestTimeout):
+		log.Infof("suggest metadata extraction timed out for %s", u.Url)
+		return map[string]interface{}{}
+	}
+}
+
+// extractorFor picks an extractor based on the content type header, falling
+// back to sniffing the data & finally the file extension
+func extractorFor(u *core.Url, data []byte) metadataExtractor {
+	sniff := http.DetectContentType(data)
+	ct := strings.ToLower(u.ContentType)
+	ext := strings.ToLower(filepath.Ext(u.FileName))
+	if ext == "" {
+		ext = strings.ToLower(filepath.Ext(u.Url))
+	}
+
+	switch {
+	case sniff == "application/pdf" || strings.HasPrefix(ct, "application/pdf"):
+		return extractPdfMetadata
+	case strings.HasPrefix(ct, "application/json") || ext == ".json":
+		return extractJsonMetadata
+	case strings.HasPrefix(ct, "text/csv") || ext == ".csv":
+		return extractCsvMetadata
+	case strings.HasPrefix(sniff, "text/html") || strings.HasPrefix(ct, "text/html"):
+		return extractHtmlMetadata
+	}
+	return nil
+}
+
+// extractHtmlMetadata suggests title & description from an html document
+func extractHtmlMetadata(data []byte) (map[string]interface{}, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]interface{}{}
+	if title := strings.TrimSpace(doc.Find("title").First().Text()); title != "" {
+		meta["title"] = title
+	}
+	if desc, ok := doc.Find(`meta[name="description"]`).First().Attr("content"); ok && desc != "" {
+		meta["description"] = strings.TrimSpace(desc)
+	}
+	return meta, nil
+}
+
+// extractCsvMetadata suggests column names & count from the header row of a csv file
+func extractCsvMetadata(data []byte) (map[string]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) == 0 {
+		return nil, fmt.Errorf("csv has no header row")
+	}
+
+	columns := make([]interface{}, len(header))
+	for i, col := range header {
+		columns[i] = strings.TrimSpace(col)
+	}
+
+	return map[string]interface{}{
+		"columns":     columns,
+		"columnCount": len(header),
+	}, nil
+}
+
+// extractJsonMetadata suggests the top-level keys of a json object. Because
+// only a prefix of the file is read, keys found before the data runs out are
+// kept, but malformed json yields an error
+func extractJsonMetadata(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return nil, fmt.Errorf("json top-level value is not an object")
+	}
+
+	keys := []interface{}{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return jsonKeysOrError(keys, err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected json token: %v", tok)
+		}
+		// skip over the value without holding on to it
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			keys = append(keys, key)
+			return jsonKeysOrError(keys, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return map[string]interface{}{"keys": keys}, nil
+}
+
+// jsonKeysOrError keeps keys found when json was truncated by the read limit
+func jsonKeysOrError(keys []interface{}, err error) (map[string]interface{}, error) {
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && len(keys) > 0 {
+		return map[string]interface{}{"keys": keys}, nil
+	}
+	return nil, err
+}
+
+var (
+	pdfInfoKeys = map[string]string{
+		"Title":        "title",
+		"Author":       "author",
+		"CreationDate": "created",
+	}
+	pdfInfoEntry = regexp.MustCompile(`/(Title|Author|CreationDate)\s*(\(|<)`)
+	pdfDate      = regexp.MustCompile(`^D:(\d{4})(\d{2})?(\d{2})?(\d{2})?(\d{2})?(\d{2})?`)
+)
+
+// extractPdfMetadata reads document info (title, author, creation date) from
+// a pdf. Only uncompressed info dictionaries in the read prefix are found,
+// which covers the common case of the info dictionary sitting near the header
+func extractPdfMetadata(data []byte) (map[string]interface{}, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return nil, fmt.Errorf("missing pdf header")
+	}
+
+	meta := map[string]interface{}{}
+	for _, loc := range pdfInfoEntry.FindAllSubmatchIndex(data, -1) {
+		key := pdfInfoKeys[string(data[loc[2]:loc[3]])]
+		if _, ok := meta[key]; ok {
+			continue
+		}
+
+		var (
+			val string
+			err error
+		)
+		if data[loc[4]] == '(' {
+			val, err = pdfLiteralString(data[loc[5]:])
+		} else {
+			val, err = pdfHexString(data[loc[5]:])
+		}
+		if err != nil || val == "" {
+			continue
+		}
+
+		if key == "created" {
+			if t, ok := parsePdfDate(val); ok {
+				meta[key] = t.Format(time.RFC3339)
+			}
+			continue
+		}
+		meta[key] = val
+	}
+
+	return meta, nil
+}
+
+// pdfLiteralString reads a parenthesized pdf string, data starts just after the
+// opening paren
+func pdfLiteralString(data []byte) (string, error) {
+	buf := &bytes.Buffer{}
+	depth := 1
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch c {
+		case '\\':
+			i++
+			if i >= len(data) {
+				return "", io.ErrUnexpectedEOF
+			}
+			switch data[i] {
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			case '\r', '\n':
+				// line continuation
+			default:
+				buf.WriteByte(data[i])
+			}
+		case '(':
+			depth++
+			buf.WriteByte(c)
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfDecodeText(buf.Bytes()), nil
+			}
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", io.ErrUnexpectedEOF
+}
+
+// pdfHexString reads a hex-encoded pdf string, data starts just after the opening <
+func pdfHexString(data []byte) (string, error) {
+	end := bytes.IndexByte(data, '>')
+	if end < 0 {
+		return "", io.ErrUnexpectedEOF
+	}
+	digits := bytes.Map(func(r rune) rune {
+		if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+			return -1
+		}
+		return r
+	}, data[:end])
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+
+	out, err := hex.DecodeString(string(digits))
+	if err != nil {
+		return "", err
+	}
+	return pdfDecodeText(out), nil
+}
+
+// pdfDecodeText converts UTF-16BE strings (marked with a BOM) to UTF-8,
+// leaving PDFDocEncoded strings as-is
+func pdfDecodeText(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+		b = b[2:]
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		return strings.TrimSpace(string(utf16.Decode(u)))
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// parsePdfDate parses the date format used by pdf info dictionaries, eg: D:20170102150405Z
+func parsePdfDate(s string) (time.Time, bool) {
+	m := pdfDate.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, false
+	}
+	layout := "2006"
+	for i, l := range []string{"01", "02", "15", "04", "05"} {
+		if m[i+2] == "" {
+			break
+		}
+		layout += l
+	}
+	t, err := time.Parse(layout, strings.Join(m[1:], ""))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.In(time.UTC), true
+}
+
+// contentPrefix opens at most maxSuggestBytes of a url's content, stored in
+// ImportContentDir or fetched from a replica peer if it isn't stored locally
+func (s *Service) contentPrefix(u *core.Url) (io.ReadCloser, error) {
+	if s.Config == nil || s.Config.ImportContentDir == "" {
+		return nil, ErrNoBlockStore
+	}
+	f, err := s.Replicas.open(s.DB, s.Config.ImportContentDir, u.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, maxSuggestBytes), f}, nil
+}
+
+// SuggestMetadataAction returns suggested metadata for a given content hash
+type SuggestMetadataAction struct {
+	ReqAction
+	clientAction
+	Subject string `json:"subject"`
+}
+
+func (SuggestMetadataAction) Type() string        { return "METADATA_SUGGEST_REQUEST" }
+func (SuggestMetadataAction) SuccessType() string { return "METADATA_SUGGEST_SUCCESS" }
+func (SuggestMetadataAction) FailureType() string { return "METADATA_SUGGEST_FAILURE" }
+
+func (SuggestMetadataAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &SuggestMetadataAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *SuggestMetadataAction) Exec() (res *ClientResponse) {
+	visible, err := a.canSee(a.Subject)
+	if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+	if !visible {
+		return notFoundResponse(a, a.RequestId, "content", a.Subject)
+	}
+
+	svc := a.client.service()
+	u := &core.Url{Hash: a.Subject}
+	if err := u.Read(svc.Store); err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "content", a.Subject)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	meta := map[string]interface{}{}
+	if rdr, err := svc.contentPrefix(u); err != nil {
+		log.Info(err.Error())
+	} else {
+		meta = SuggestMetadata(u, rdr)
+		rdr.Close()
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "METADATA_SUGGESTION",
+		Data: map[string]interface{}{
+			"subject": a.Subject,
+			"meta":    meta,
+		},
+	}
+}
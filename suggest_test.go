@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/datatogether/core"
+)
+
+func readSuggestFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata/suggest", name))
+	if err != nil {
+		t.Fatalf("error reading fixture %s: %s", name, err.Error())
+	}
+	return data
+}
+
+// compare maps via their json encoding to paper over []interface{} vs []string differences
+func suggestionsEqual(a, b map[string]interface{}) bool {
+	ad, _ := json.Marshal(a)
+	bd, _ := json.Marshal(b)
+	return bytes.Equal(ad, bd)
+}
+
+func TestExtractPdfMetadata(t *testing.T) {
+	cases := []struct {
+		fixture string
+		expect  map[string]interface{}
+		err     bool
+	}{
+		{"report.pdf", map[string]interface{}{
+			"title":   "Sea Level Rise (Technical Report)",
+			"author":  "NOAA",
+			"created": "2017-02-15T09:30:00Z",
+		}, false},
+		{"noinfo.pdf", map[string]interface{}{}, false},
+		{"stations.csv", nil, true},
+	}
+
+	for i, c := range cases {
+		got, err := extractPdfMetadata(readSuggestFixture(t, c.fixture))
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if !c.err && !suggestionsEqual(c.expect, got) {
+			t.Errorf("case %d result mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestExtractCsvMetadata(t *testing.T) {
+	got, err := extractCsvMetadata(readSuggestFixture(t, "stations.csv"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := map[string]interface{}{
+		"columns":     []string{"station_id", "name", "latitude", "longitude", "elevation, m"},
+		"columnCount": 5,
+	}
+	if !suggestionsEqual(expect, got) {
+		t.Errorf("result mismatch. expected: %v, got: %v", expect, got)
+	}
+
+	if _, err := extractCsvMetadata([]byte{}); err == nil {
+		t.Errorf("expected empty csv to error")
+	}
+}
+
+func TestExtractJsonMetadata(t *testing.T) {
+	cases := []struct {
+		fixture string
+		expect  map[string]interface{}
+		err     bool
+	}{
+		{"dataset.json", map[string]interface{}{"keys": []string{"title", "stations", "updated"}}, false},
+		{"truncated.json", map[string]interface{}{"keys": []string{"title", "stations"}}, false},
+		{"broken.json", nil, true},
+		{"array.json", nil, true},
+	}
+
+	for i, c := range cases {
+		got, err := extractJsonMetadata(readSuggestFixture(t, c.fixture))
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if !c.err && !suggestionsEqual(c.expect, got) {
+			t.Errorf("case %d result mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestSuggestMetadata(t *testing.T) {
+	cases := []struct {
+		url, contentType, fixture string
+		expectKey                 string
+	}{
+		{"http://example.gov/report.pdf", "application/pdf", "report.pdf", "title"},
+		{"http://example.gov/stations.csv", "text/csv", "stations.csv", "columnCount"},
+		{"http://example.gov/dataset", "application/json", "dataset.json", "keys"},
+		{"http://example.gov/data.json", "", "dataset.json", "keys"},
+		// parse failures degrade to an empty suggestion
+		{"http://example.gov/broken.json", "application/json", "broken.json", ""},
+		{"http://example.gov/noinfo.pdf", "application/pdf", "noinfo.pdf", ""},
+	}
+
+	for i, c := range cases {
+		u := &core.Url{Url: c.url, ContentType: c.contentType}
+		got := SuggestMetadata(u, bytes.NewReader(readSuggestFixture(t, c.fixture)))
+		if got == nil {
+			t.Errorf("case %d: suggestion should never be nil", i)
+			continue
+		}
+		if c.expectKey == "" {
+			if len(got) != 0 {
+				t.Errorf("case %d: expected empty suggestion, got: %v", i, got)
+			}
+			continue
+		}
+		if _, ok := got[c.expectKey]; !ok {
+			t.Errorf("case %d: expected suggestion to have key %s, got: %v", i, c.expectKey, got)
+		}
+	}
+
+	// only the first maxSuggestBytes should ever be read
+	big := strings.NewReader(`{"a": "` + strings.Repeat("x", maxSuggestBytes*2) + `"}`)
+	size := big.Len()
+	SuggestMetadata(&core.Url{Url: "http://example.gov/big.json"}, big)
+	if read := size - big.Len(); read != maxSuggestBytes {
+		t.Errorf("expected %d bytes to be read, got: %d", maxSuggestBytes, read)
+	}
+}
+
+func TestContentPrefix(t *testing.T) {
+	const hash = "1220aaaa0000000000000000000000000000000000000000000000000000000000aa"
+	svc := newTestService()
+	svc.Config.ImportContentDir = ""
+	if _, err := svc.contentPrefix(&core.Url{Hash: hash}); err != ErrNoBlockStore {
+		t.Errorf("expected content prefixes to need a content dir, got: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "suggest")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, hash), bytes.Repeat([]byte("a"), maxSuggestBytes+10), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	svc.Config.ImportContentDir = dir
+
+	rdr, err := svc.contentPrefix(&core.Url{Hash: hash})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(rdr)
+	rdr.Close()
+	if err != nil || len(data) != maxSuggestBytes {
+		t.Errorf("expected the first %d bytes of stored content, got: %d %v", maxSuggestBytes, len(data), err)
+	}
+	if _, err := svc.contentPrefix(&core.Url{Hash: "1220bbbb"}); !os.IsNotExist(err) {
+		t.Errorf("expected content that isn't stored not to exist, got: %v", err)
+	}
+}
@@ -9,8 +9,7 @@ import (
 
 type TasksRequestAct struct {
 	ReqAction
-	Page     int `json:"page"`
-	PageSize int `json:"pageSize"`
+	pageRequest
 }
 
 func (TasksRequestAct) Type() string        { return "TASKS_FETCH_REQUEST" }
@@ -25,6 +24,9 @@ func (TasksRequestAct) Parse(reqId string, data json.RawMessage) ClientRequestAc
 }
 
 func (a *TasksRequestAct) Exec() (res *ClientResponse) {
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
 	conn, err := net.Dial("tcp", cfg.TasksServiceUrl)
 	if err != nil {
 		log.Info(err.Error())
@@ -37,8 +39,8 @@ func (a *TasksRequestAct) Exec() (res *ClientResponse) {
 	}
 	cli := rpc.NewClient(conn)
 	p := &tasks.TasksListParams{
-		Limit:  a.PageSize,
-		Offset: (a.Page - 1) * a.PageSize,
+		Limit:  a.fetch(),
+		Offset: a.offset,
 	}
 	reply := []*tasks.Task{}
 	if err := cli.Call("TaskRequests.List", p, &reply); err != nil {
@@ -55,7 +57,9 @@ func (a *TasksRequestAct) Exec() (res *ClientResponse) {
 		Type:      a.SuccessType(),
 		RequestId: a.RequestId,
 		Schema:    "TASK_ARRAY",
-		Data:      reply,
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      newPage(&a.pageRequest, reply),
 	}
 }
 
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+const (
+	// how long a subject waits for more writes before it's title is recalculated.
+	// short enough that a single edit still feels immediate
+	titleUpdateDebounce = 250 * time.Millisecond
+	// most urls updated by a single statement
+	titleUpdateBatchSize = 200
+)
+
+// titleUpdateStats exposes title update counts at /debug/vars
+var titleUpdateStats = expvar.NewMap("titleUpdates")
+
+// titles is the package-level title updater
+var titles = newTitleUpdater(titleUpdateDebounce, titleUpdateBatchSize)
+
+func init() {
+	addEventListener(func(e *Event) {
+		if cfg == nil || !cfg.ConsensusTitles {
+			return
+		}
+		switch e.Type {
+		case EventMetadataAdded, EventMetadataDeleted:
+			if e.Subject != "" {
+				titles.queue(e.Subject)
+			}
+		}
+	})
+}
+
+// titleUpdater keeps url titles in line with metadata consensus, if
+// cfg.ConsensusTitles is set. Subjects are
+// queued on every metadata write, & repeat writes to a queued subject collapse
+// into one recalculation. Due subjects are written in batches, so a bulk import
+// touching thousands of subjects costs a handful of statements, not thousands
+type titleUpdater struct {
+	sync.Mutex
+	debounce  time.Duration
+	batchSize int
+	// when each queued subject is due
+	pending map[string]time.Time
+	wake    chan struct{}
+	stop    chan chan struct{}
+	// db to read consensus from & write titles to. nil skips the database,
+	// which only makes sense in tests
+	db *sql.DB
+}
+
+func newTitleUpdater(debounce time.Duration, batchSize int) *titleUpdater {
+	return &titleUpdater{
+		debounce:  debounce,
+		batchSize: batchSize,
+		pending:   map[string]time.Time{},
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan chan struct{}),
+	}
+}
+
+// queue schedules a subject's title to be recalculated. subjects already
+// queued keep their place
+func (u *titleUpdater) queue(subject string) {
+	u.Lock()
+	if _, ok := u.pending[subject]; ok {
+		u.Unlock()
+		titleUpdateStats.Add("coalesced", 1)
+		return
+	}
+	u.pending[subject] = time.Now().Add(u.debounce)
+	u.Unlock()
+	titleUpdateStats.Add("queued", 1)
+
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due removes & returns up to batchSize subjects that are due at t, along with
+// the time the next remaining subject is due. zero if nothing remains
+func (u *titleUpdater) due(t time.Time) (subjects []string, next time.Time) {
+	u.Lock()
+	defer u.Unlock()
+	for subject, at := range u.pending {
+		if !at.After(t) && len(subjects) < u.batchSize {
+			subjects = append(subjects, subject)
+			delete(u.pending, subject)
+		} else if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return
+}
+
+// run drains the queue as subjects come due, until Flush is called
+func (u *titleUpdater) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		subjects, next := u.due(time.Now())
+		if len(subjects) > 0 {
+			u.update(subjects)
+			// there may be more due than fit in a batch
+			continue
+		}
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = next.Sub(time.Now())
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-u.wake:
+		case <-timer.C:
+		case done := <-u.stop:
+			u.drain()
+			close(done)
+			return
+		}
+	}
+}
+
+// drain writes everything queued, due or not
+func (u *titleUpdater) drain() {
+	for {
+		subjects, _ := u.due(time.Now().Add(u.debounce))
+		if len(subjects) == 0 {
+			return
+		}
+		u.update(subjects)
+	}
+}
+
+// Flush writes all queued titles & stops the updater. Call on shutdown
+func (u *titleUpdater) Flush(timeout time.Duration) error {
+	done := make(chan struct{})
+	select {
+	case u.stop <- done:
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for title updater")
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out flushing title updates")
+	}
+}
+
+// update recalculates titles for a batch of subjects & writes any that changed
+func (u *titleUpdater) update(subjects []string) {
+	if u.db == nil {
+		return
+	}
+
+	changes := map[string]string{}
+	for _, subject := range subjects {
+		title, ok, err := consensusTitle(u.db, subject)
+		if err != nil {
+			titleUpdateStats.Add("errors", 1)
+			log.Infof("error calculating title for %s: %s", subject, err.Error())
+			continue
+		}
+		if ok {
+			changes[subject] = title
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	n, err := writeTitles(u.db, changes)
+	if err != nil {
+		titleUpdateStats.Add("errors", 1)
+		log.Infof("error writing %d titles: %s", len(changes), err.Error())
+		return
+	}
+	titleUpdateStats.Add("batches", 1)
+	titleUpdateStats.Add("written", n)
+}
+
+// writeTitles sets the title of each url by hash in a single statement,
+// skipping urls that already have the title. returns the number of urls changed
+func writeTitles(db *sql.DB, titles map[string]string) (int64, error) {
+	var (
+		values = &bytes.Buffer{}
+		args   = make([]interface{}, 0, len(titles)*2)
+	)
+	for hash, title := range titles {
+		if len(args) > 0 {
+			values.WriteString(", ")
+		}
+		fmt.Fprintf(values, "($%d, $%d)", len(args)+1, len(args)+2)
+		args = append(args, hash, title)
+	}
+
+	res, err := db.Exec(`update urls set title = v.title, updated = (now() at time zone 'utc')
+		from (values `+values.String()+`) as v(hash, title)
+		where urls.hash = v.hash and urls.title <> v.title`, args...)
+	if err := checkWriteErr(err); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// consensusTitle finds the title most metadata for a subject agrees on, ties
+// going to the lowest value hash so the result is stable. ok is false if no
+// metadata sets a title
+func consensusTitle(db *sql.DB, subject string) (title string, ok bool, err error) {
+	blocks, err := MetadataForSubject(db, subject)
+	if err != nil {
+		return "", false, err
+	}
+	for i, b := range blocks {
+		blocks[i] = withoutReservedKeys(b)
+		blocks[i].Subject = subject
+	}
+
+	c, values, err := core.SumConsensus(subject, blocks)
+	if err != nil {
+		return "", false, err
+	}
+
+	var (
+		best  string
+		votes int
+	)
+	for hash, n := range c["title"] {
+		if n > votes || (n == votes && hash < best) {
+			best, votes = hash, n
+		}
+	}
+	if best == "" {
+		return "", false, nil
+	}
+	title, ok = values[best].(string)
+	return title, ok, nil
+}
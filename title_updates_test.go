@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTitleUpdaterCoalesce(t *testing.T) {
+	u := newTitleUpdater(time.Minute, 2)
+	for _, subject := range []string{"a", "b", "a", "c", "a"} {
+		u.queue(subject)
+	}
+	if len(u.pending) != 3 {
+		t.Errorf("expected repeat subjects to collapse, got %d queued", len(u.pending))
+	}
+
+	// nothing is due inside the debounce window
+	if subjects, next := u.due(time.Now()); len(subjects) != 0 || next.IsZero() {
+		t.Errorf("expected nothing due yet, got: %v", subjects)
+	}
+
+	// once due, subjects come out a batch at a time
+	later := time.Now().Add(2 * time.Minute)
+	first, _ := u.due(later)
+	second, next := u.due(later)
+	if len(first) != 2 || len(second) != 1 {
+		t.Errorf("expected batches of 2 & 1, got: %v, %v", first, second)
+	}
+	if !next.IsZero() || len(u.pending) != 0 {
+		t.Errorf("expected queue to be empty")
+	}
+}
+
+func TestTitleUpdaterFlush(t *testing.T) {
+	u := newTitleUpdater(time.Hour, 10)
+	go u.run()
+	u.queue("a")
+	u.queue("b")
+
+	if err := u.Flush(time.Second); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(u.pending) != 0 {
+		t.Errorf("expected flush to drain the queue, %d subjects left", len(u.pending))
+	}
+}
+
+func TestWriteTitles(t *testing.T) {
+	defer resetTestData(appDB, "urls")
+
+	var hash, title string
+	if err := appDB.QueryRow("select hash, title from urls where hash != '' limit 1").Scan(&hash, &title); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	n, err := writeTitles(appDB, map[string]string{hash: "EPA", "not-a-hash": "EPA"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != 1 {
+		t.Errorf("expected 1 url changed, got: %d", n)
+	}
+
+	// unchanged titles aren't rewritten
+	if n, err = writeTitles(appDB, map[string]string{hash: "EPA"}); err != nil {
+		t.Fatal(err.Error())
+	} else if n != 0 {
+		t.Errorf("expected unchanged title to be skipped, got: %d", n)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testTransport is a client for one of the transports the server speaks
+type testTransport interface {
+	// send an action envelope
+	send(data string) error
+	// next message from the server, immediate responses & queued messages alike
+	next() (*ClientResponse, error)
+	close()
+}
+
+type wsTransport struct {
+	server *httptest.Server
+	conn   *websocket.Conn
+}
+
+func newWsTransport(hub *Room) (testTransport, error) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &wsTransport{server: s, conn: conn}, nil
+}
+
+func (t *wsTransport) send(data string) error {
+	return t.conn.WriteMessage(websocket.TextMessage, []byte(data))
+}
+
+func (t *wsTransport) next() (*ClientResponse, error) {
+	t.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	res := &ClientResponse{}
+	err := t.conn.ReadJSON(res)
+	return res, err
+}
+
+func (t *wsTransport) close() {
+	t.conn.Close()
+	t.server.Close()
+}
+
+type pollTransport struct {
+	server  *httptest.Server
+	session string
+	seq     int64
+	// messages received but not yet read
+	pending []*ClientResponse
+}
+
+func newPollTransport(hub *Room) (testTransport, error) {
+	m := http.NewServeMux()
+	m.HandleFunc("/actions", func(w http.ResponseWriter, r *http.Request) { serveActions(hub, w, r) })
+	m.HandleFunc("/poll", servePoll)
+	return &pollTransport{server: httptest.NewServer(m)}, nil
+}
+
+func (t *pollTransport) send(data string) error {
+	res, err := http.Post(fmt.Sprintf("%s/actions?session=%s", t.server.URL, t.session), "application/json", bytes.NewBufferString(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	t.session = res.Header.Get(pollSessionHeader)
+	if res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	r := &ClientResponse{}
+	if err := json.NewDecoder(res.Body).Decode(r); err != nil {
+		return err
+	}
+	t.pending = append(t.pending, r)
+	return nil
+}
+
+func (t *pollTransport) next() (*ClientResponse, error) {
+	if len(t.pending) == 0 {
+		res, err := http.Get(fmt.Sprintf("%s/poll?session=%s&seq=%d", t.server.URL, t.session, t.seq))
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("poll status %d", res.StatusCode)
+		}
+		p := &pollResponse{}
+		if err := json.NewDecoder(res.Body).Decode(p); err != nil {
+			return nil, err
+		}
+		for _, msg := range p.Messages {
+			r := &ClientResponse{}
+			if err := json.Unmarshal(msg.Data, r); err != nil {
+				return nil, err
+			}
+			t.pending = append(t.pending, r)
+			t.seq = msg.Seq
+		}
+		if len(t.pending) == 0 {
+			return nil, fmt.Errorf("no messages")
+		}
+	}
+	r := t.pending[0]
+	t.pending = t.pending[1:]
+	return r, nil
+}
+
+func (t *pollTransport) close() { t.server.Close() }
+
+// TestTransportConformance runs the same exchange over every transport
+func TestTransportConformance(t *testing.T) {
+	hub := newRoom()
+	go hub.run()
+
+	transports := map[string]func(*Room) (testTransport, error){
+		"websocket": newWsTransport,
+		"poll":      newPollTransport,
+	}
+
+	for name, newTransport := range transports {
+		tr, err := newTransport(hub)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+
+		// immediate responses
+		if err := tr.send("not json"); err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		res, err := tr.next()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if res.Type != "PARSE_ERROR" {
+			t.Errorf("%s: expected PARSE_ERROR, got: %s", name, res.Type)
+		}
+
+		subject := "transport-" + name
+		if err := tr.send(fmt.Sprintf(`{"type":"SUBJECT_SUBSCRIBE_REQUEST","requestId":"1","data":{"subject":"%s"}}`, subject)); err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		res, err = tr.next()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if res.Type != (SubjectSubscribeAction{}).SuccessType() || res.RequestId != "1" {
+			t.Errorf("%s: expected subscribe success for request 1, got: %s %s", name, res.Type, res.RequestId)
+		}
+
+		// server-initiated messages
+		for i := 0; i < 2; i++ {
+			hub.publish <- &topicMessage{topic: subjectTopic(subject), data: []byte(fmt.Sprintf(`{"type":"PING","requestId":"%d"}`, i))}
+			res, err = tr.next()
+			if err != nil {
+				t.Fatalf("%s: %s", name, err.Error())
+			}
+			if res.Type != "PING" || res.RequestId != fmt.Sprintf("%d", i) {
+				t.Errorf("%s: expected PING %d, got: %s %s", name, i, res.Type, res.RequestId)
+			}
+		}
+
+		tr.close()
+	}
+}
+
+func TestPollSessionOutbox(t *testing.T) {
+	s := &pollSession{wake: make(chan struct{})}
+	for i := 0; i < maxOutboxSize; i++ {
+		if !s.queue([]byte("{}")) {
+			t.Fatalf("expected message %d to queue", i)
+		}
+	}
+	if s.queue([]byte("{}")) {
+		t.Errorf("expected full outbox to reject messages")
+	}
+
+	msgs, _, _ := s.after(10)
+	if len(msgs) != maxOutboxSize-10 || msgs[0].Seq != 11 {
+		t.Errorf("expected messages after seq 10")
+	}
+	if len(s.outbox) != maxOutboxSize-10 {
+		t.Errorf("expected acknowledged messages to be dropped, have %d", len(s.outbox))
+	}
+	if !s.queue([]byte("{}")) {
+		t.Errorf("expected room in outbox after acknowledgement")
+	}
+}
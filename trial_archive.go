@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+const (
+	// captchaRequiredErrCode tells the frontend to present a captcha challenge
+	// & retry the request with it's token
+	captchaRequiredErrCode = "CAPTCHA_REQUIRED"
+	// trialLimitErrCode is set when an ip address has used up it's trial archives for the day
+	trialLimitErrCode = "TRIAL_LIMIT_REACHED"
+	// most links followed from an anonymous archive request
+	trialLinkCap = 10
+	// most anonymous archive requests waiting to be processed
+	trialQueueSize = 64
+)
+
+var (
+	// ErrTrialDisabled is returned for anonymous archive requests when they're turned off
+	ErrTrialDisabled = fmt.Errorf("archiving without an account isn't available")
+	// ErrCaptchaRequired is returned for anonymous archive requests without a valid captcha token
+	ErrCaptchaRequired = fmt.Errorf("please complete the captcha to archive without an account")
+	// ErrTrialLimit is returned once an ip address has used up it's anonymous archive requests for the day
+	ErrTrialLimit = fmt.Errorf("you've reached today's limit for archiving without an account, please sign in to archive more")
+	// ErrTrialBusy is returned when the anonymous archive queue is full
+	ErrTrialBusy = fmt.Errorf("too many people are trying archiving right now, please try again in a few minutes")
+)
+
+// CaptchaVerifier checks captcha tokens server-side
+type CaptchaVerifier interface {
+	// Verify returns an error if a token isn't valid for a request from remoteIP
+	Verify(token, remoteIP string) error
+}
+
+// captcha verifies tokens for anonymous archive requests. nil if captchas are disabled
+var captcha CaptchaVerifier
+
+// siteVerifyCaptcha verifies tokens against a siteverify endpoint. hCaptcha
+// & Turnstile share the same request & response shape
+type siteVerifyCaptcha struct {
+	endpoint string
+	secret   string
+	client   *http.Client
+}
+
+// newCaptchaVerifier creates a verifier for a configured provider, one of
+// ["hcaptcha","turnstile"]. a blank provider disables captchas
+func newCaptchaVerifier(provider, secret string) (CaptchaVerifier, error) {
+	endpoints := map[string]string{
+		"hcaptcha":  "https://hcaptcha.com/siteverify",
+		"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	}
+	if provider == "" {
+		return nil, nil
+	}
+	endpoint, ok := endpoints[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown captcha provider: %s", provider)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("captcha provider %s requires a secret", provider)
+	}
+	return &siteVerifyCaptcha{endpoint: endpoint, secret: secret, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (c *siteVerifyCaptcha) Verify(token, remoteIP string) error {
+	res, err := c.client.PostForm(c.endpoint, url.Values{
+		"secret":   {c.secret},
+		"response": {token},
+		"remoteip": {remoteIP},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	result := struct {
+		Success bool     `json:"success"`
+		Errors  []string `json:"error-codes"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		log.Infof("captcha verification failed: %v", result.Errors)
+		return ErrCaptchaRequired
+	}
+	return nil
+}
+
+// requesterSecret keys requester hashes so ip addresses can't be recovered
+// from them by hashing every address. set from cfg.RequesterSecret, random
+// otherwise
+var requesterSecret = randomRequesterSecret()
+
+func randomRequesterSecret() []byte {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// requesterHash identifies an anonymous requester without storing their ip address
+func requesterHash(ip string) string {
+	mac := hmac.New(sha256.New, requesterSecret)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// trialArchivesSince counts anonymous archive requests from a requester since
+// a time, & returns when the earliest of them was made
+func trialArchivesSince(db *sql.DB, requester string, since time.Time) (count int, earliest time.Time, err error) {
+	err = db.QueryRow("select count(1), coalesce(min(created), $2) from archive_requests where anonymous = true and requester = $1 and created > $2",
+		requester, since.In(time.UTC)).Scan(&count, &earliest)
+	return
+}
+
+// trialArchiveUsage counts anonymous archive requests from each requester since a time
+func trialArchiveUsage(db *sql.DB, since time.Time) (map[string]int, error) {
+	return countArchiveRequests(db, "select requester, count(1) from archive_requests where anonymous = true and created > $1 group by requester", since)
+}
+
+// countArchiveRequests reads requester, count rows selected since a time
+func countArchiveRequests(db *sql.DB, query string, since time.Time) (map[string]int, error) {
+	rows, err := db.Query(query, since.In(time.UTC))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	used := map[string]int{}
+	for rows.Next() {
+		var (
+			requester string
+			count     int
+		)
+		if err := rows.Scan(&requester, &count); err != nil {
+			return nil, err
+		}
+		used[requester] = count
+	}
+	return used, rows.Err()
+}
+
+// trialJob is an anonymous archive request waiting to be processed
+type trialJob struct {
+	svc    *Service
+	client *Client
+	reqId  string
+	url    *core.Url
+}
+
+// trialQueue holds anonymous archive requests. a single worker processes them
+// so trials never compete with registered users for more than one fetch at a time
+var trialQueue = make(chan *trialJob, trialQueueSize)
+
+// runTrialArchives processes anonymous archive requests one at a time
+func runTrialArchives() {
+	for job := range trialQueue {
+		job.run()
+	}
+}
+
+// run GET's the requested url & up to trialLinkCap of the links it references
+func (j *trialJob) run() {
+	// the client may have disconnected while the job was queued, closing it's
+	// send channel. that can't take down the worker
+	defer func() {
+		if r := recover(); r != nil {
+			j.svc.Log.Infof("trial archive of %s: %v", j.url.Url, r)
+		}
+	}()
+
+	_, links, err := j.svc.getRetained(j.url, nil, retentionEphemeral)
+	if err != nil {
+		j.svc.Log.Info(err.Error())
+		j.client.SendResponse(&ClientResponse{
+			Type:      "URL_SET_ERROR",
+			RequestId: j.reqId,
+			Data:      map[string]interface{}{"url": j.url.Url, "error": err.Error()},
+		})
+		return
+	}
+	j.client.SendResponse(&ClientResponse{
+		Type:      "URL_SET_SUCCESS",
+		RequestId: j.reqId,
+		Data:      map[string]interface{}{"url": j.url.Url, "success": true},
+	})
+
+	followed := 0
+	for _, l := range links {
+		if followed == trialLinkCap {
+			break
+		}
+		// urls outside of all subprimers aren't followed
+		if isOrphaned(l.Dst) {
+			continue
+		}
+		followed++
+		time.Sleep(j.svc.FollowDelay)
+		if _, _, err := j.svc.getRetained(l.Dst, nil, retentionEphemeral); err != nil {
+			j.svc.Log.Info(err.Error())
+		}
+	}
+}
+
+// TrialArchiveAction archives a url for someone without an account. Requests
+// must carry a captcha token if captchas are configured, & are limited per ip
+// address per day
+type TrialArchiveAction struct {
+	ReqAction
+	clientAction
+	Url          string `json:"url"`
+	CaptchaToken string `json:"captchaToken"`
+}
+
+func (TrialArchiveAction) Type() string        { return "TRIAL_ARCHIVE_REQUEST" }
+func (TrialArchiveAction) SuccessType() string { return "TRIAL_ARCHIVE_SUCCESS" }
+func (TrialArchiveAction) FailureType() string { return "TRIAL_ARCHIVE_FAILURE" }
+
+func (TrialArchiveAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &TrialArchiveAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *TrialArchiveAction) Exec() (res *ClientResponse) {
+	if a.err != nil {
+		log.Info(a.err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: a.err.Error()}
+	}
+	if a.client == nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrTrialDisabled.Error()}
+	}
+	s := a.client.service()
+	if s.Config == nil || s.Config.TrialArchivesPerDay <= 0 {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrTrialDisabled.Error()}
+	}
+
+	ip := a.client.remoteIP()
+	if s.Captcha != nil {
+		if a.CaptchaToken == "" || s.Captcha.Verify(a.CaptchaToken, ip) != nil {
+			return &ClientResponse{
+				Type:      a.FailureType(),
+				RequestId: a.RequestId,
+				Error:     ErrCaptchaRequired.Error(),
+				Code:      captchaRequiredErrCode,
+				Data:      map[string]string{"provider": s.Config.CaptchaProvider, "siteKey": s.Config.CaptchaSiteKey},
+			}
+		}
+	}
+
+	url, redacted, err := s.RedactArchivingUrl(a.Url)
+	if err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	if err := s.ValidArchivingUrl(url); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+	// anonymous requests can't archive into restricted subprimers
+	if err := s.checkArchiveAccess(url, ""); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	refusal, err := rateLimits.admit(s, a.client.limitKeys(), time.Now(), limitTrialArchives)
+	if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: "internal server error"}
+	}
+	if refusal != nil {
+		return refusal.response(a, a.RequestId)
+	}
+
+	u, err := s.recordArchiveIntake(url, redacted, archiveRequester{anonymous: true, requester: a.client.archiveRequester()})
+	if err != nil {
+		s.Log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	select {
+	case trialQueue <- &trialJob{svc: s, client: a.client, reqId: a.RequestId, url: u}:
+	default:
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrTrialBusy.Error()}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "URL",
+		Data:      u,
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewCaptchaVerifier(t *testing.T) {
+	cases := []struct {
+		provider, secret string
+		enabled, err     bool
+	}{
+		{"", "", false, false},
+		{"hcaptcha", "secret", true, false},
+		{"turnstile", "secret", true, false},
+		{"turnstile", "", false, true},
+		{"recaptcha", "secret", false, true},
+	}
+
+	for i, c := range cases {
+		v, err := newCaptchaVerifier(c.provider, c.secret)
+		if (err != nil) != c.err {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if (v != nil) != c.enabled {
+			t.Errorf("case %d enabled mismatch. expected: %t, got: %t", i, c.enabled, v != nil)
+		}
+	}
+}
+
+func TestSiteVerifyCaptcha(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("secret") != "secret" {
+			t.Errorf("expected secret to be sent")
+		}
+		fmt.Fprintf(w, `{"success": %t}`, r.FormValue("response") == "good")
+	}))
+	defer s.Close()
+
+	v := &siteVerifyCaptcha{endpoint: s.URL, secret: "secret", client: http.DefaultClient}
+	if err := v.Verify("good", "127.0.0.1"); err != nil {
+		t.Errorf("expected valid token to verify, got: %s", err.Error())
+	}
+	if err := v.Verify("bad", "127.0.0.1"); err != ErrCaptchaRequired {
+		t.Errorf("expected invalid token to require a captcha, got: %v", err)
+	}
+}
+
+func TestTrialArchiveCaptchaRequired(t *testing.T) {
+	svc := NewService(nil, nil, &config{TrialArchivesPerDay: 3, CaptchaProvider: "turnstile", CaptchaSiteKey: "site"})
+	svc.Captcha = &siteVerifyCaptcha{endpoint: "http://127.0.0.1:0", secret: "secret", client: http.DefaultClient}
+
+	a := TrialArchiveAction{}.Parse("req", []byte(`{"url":"http://epa.gov"}`)).(*TrialArchiveAction)
+	a.SetClient(&Client{addr: "127.0.0.1", svc: svc})
+	res := a.Exec()
+	if res.Code != captchaRequiredErrCode {
+		t.Errorf("expected code %s, got: %s", captchaRequiredErrCode, res.Code)
+	}
+}
+
+func TestRequesterHash(t *testing.T) {
+	defer func(secret []byte) { requesterSecret = secret }(requesterSecret)
+
+	requesterSecret = []byte("a")
+	a := requesterHash("10.0.0.1")
+	if a != requesterHash("10.0.0.1") {
+		t.Errorf("expected requester hashes to be stable")
+	}
+	if a == requesterHash("10.0.0.2") {
+		t.Errorf("expected addresses to hash differently")
+	}
+	if sum := sha256.Sum256([]byte("10.0.0.1")); a == hex.EncodeToString(sum[:16]) {
+		t.Errorf("expected requester hashes to be keyed")
+	}
+	requesterSecret = []byte("b")
+	if a == requesterHash("10.0.0.1") {
+		t.Errorf("expected a different secret to change requester hashes")
+	}
+}
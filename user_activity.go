@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// User activity
+//
+// Moderators review accounts from the user_actions log: every archive request
+// & metadata write a signed-in user makes, & every time they hit a rate limit
+// or daily quota. activity is aggregated over userActivityWindow in a single
+// grouped query, joined with the moderation cases opened against subjects the
+// user archived or wrote metadata about. users that have been erased are left
+// out, & their actions are removed with the rest of their data.
+//
+// users are flagged when their activity stands out:
+//
+//   metadataVolume:  more than userActivityMetadataFactor times the median metadata writes
+//   subprimerSpread: archives in userActivitySubprimerSpread or more subprimers in a utc day
+//   rateLimited:     userActivityRateLimitHits or more rate limit hits
+//
+// lists sort by "anomalous" (most flags first) unless asked otherwise
+
+// actions recorded in the user_actions log
+const (
+	userActionArchive     = "archive"
+	userActionMetadata    = "metadata"
+	userActionRateLimited = "rate_limited"
+)
+
+// anomaly flags
+const (
+	userFlagMetadataVolume  = "metadataVolume"
+	userFlagSubprimerSpread = "subprimerSpread"
+	userFlagRateLimited     = "rateLimited"
+)
+
+const (
+	// how far back activity is aggregated
+	userActivityWindow = 30 * 24 * time.Hour
+	// number of recent actions in a user's summary
+	userActivityRecent = 20
+	// multiple of the median metadata writes a user is flagged past
+	userActivityMetadataFactor = 10
+	// distinct subprimers archived in a day a user is flagged at
+	userActivitySubprimerSpread = 10
+	// rate limit hits a user is flagged at
+	userActivityRateLimitHits = 20
+)
+
+// userActivitySorts maps sort names to the order activity is listed in
+var userActivitySorts = map[string]string{
+	"anomalous":   "flags desc, report_cases desc, metadata_writes desc, user_id",
+	"archives":    "archives desc, user_id",
+	"metadata":    "metadata_writes desc, user_id",
+	"rateLimited": "rate_limited desc, user_id",
+	"reports":     "report_cases desc, user_id",
+	"recent":      "last_active desc, user_id",
+}
+
+// ErrUserActivitySort is returned when listing user activity by an unknown sort
+var ErrUserActivitySort = fmt.Errorf("sort must be one of anomalous, archives, metadata, rateLimited, reports or recent")
+
+// UserAction is an entry in the user action log
+type UserAction struct {
+	Created time.Time `json:"created"`
+	UserId  string    `json:"userId"`
+	// one of "archive", "metadata", "rate_limited"
+	Action string `json:"action"`
+	// subprimer an archived url falls under
+	Subprimer string `json:"subprimer,omitempty"`
+	// url archived, subject of metadata, or the limit that was hit
+	Target string `json:"target"`
+}
+
+// UserActivity is a user's activity within userActivityWindow
+type UserActivity struct {
+	UserId         string `json:"userId"`
+	Archives       int64  `json:"archives"`
+	MetadataWrites int64  `json:"metadataWrites"`
+	RateLimited    int64  `json:"rateLimited"`
+	// most distinct subprimers archived in one utc day
+	DailySubprimers int64 `json:"dailySubprimers"`
+	// moderation cases against subjects the user archived or wrote metadata about
+	ReportCases int64     `json:"reportCases"`
+	LastActive  time.Time `json:"lastActive"`
+	// anomaly flags, see userFlagMetadataVolume
+	Flags []string `json:"flags"`
+}
+
+// UserActivityDetail is a user's activity & their most recent actions
+type UserActivityDetail struct {
+	*UserActivity
+	Recent []*UserAction `json:"recent"`
+}
+
+// logUserAction records an action in the user action log. actions by
+// anonymous users aren't logged, & failures don't stop the action
+func logUserAction(db *sql.DB, userId, action, subprimer, target string, now time.Time) {
+	if db == nil || userId == "" {
+		return
+	}
+	if _, err := db.Exec("insert into user_actions (created,user_id,action,subprimer,target) values ($1, $2, $3, $4, $5)",
+		now.Round(time.Second).In(time.UTC), userId, action, subprimer, target); err != nil {
+		log.Infof("error logging %s action by %s: %s", action, userId, err.Error())
+	}
+}
+
+// logArchiveAction records an archive request, with the subprimer it falls under
+func logArchiveAction(db *sql.DB, userId, url, subprimerUrl string, now time.Time) {
+	if db == nil || userId == "" {
+		return
+	}
+	subprimer, err := subprimerForUrl(db, subprimerUrl)
+	if err != nil {
+		log.Info(err.Error())
+	}
+	logUserAction(db, userId, userActionArchive, subprimer, url, now)
+}
+
+// userActivityQuery aggregates the action log for every user active since $1.
+// the median is taken across all of them before users are filtered by where,
+// which compares against $2. flags are worked out here so lists can sort by them
+const userActivityQuery = `with actions as (
+	select user_id, created, action, subprimer, target from user_actions
+	where created >= $1 and user_id not in (select user_id from erase_jobs where status = 'complete')
+), totals as (
+	select user_id,
+		count(*) filter (where action = 'archive') as archives,
+		count(*) filter (where action = 'metadata') as metadata_writes,
+		count(*) filter (where action = 'rate_limited') as rate_limited,
+		max(created) as last_active
+	from actions group by user_id
+), spread as (
+	select user_id, max(subprimers) as subprimers from (
+		select user_id, count(distinct subprimer) as subprimers from actions
+		where action = 'archive' and subprimer != '' group by user_id, created::date
+	) days group by user_id
+), cases as (
+	select a.user_id, count(distinct c.id) as cases
+	from (select distinct user_id, target from actions where action != 'rate_limited') a
+	join moderation_cases c on c.subject = a.target
+	group by a.user_id
+), median as (
+	select coalesce(percentile_cont(0.5) within group (order by metadata_writes), 0) as writes from totals where metadata_writes > 0
+), activity as (
+	select t.user_id, t.archives, t.metadata_writes, t.rate_limited, coalesce(s.subprimers, 0) as subprimers,
+		coalesce(c.cases, 0) as report_cases, t.last_active,
+		t.metadata_writes > m.writes * $3::float8 as metadata_volume,
+		coalesce(s.subprimers, 0) >= $4::bigint as subprimer_spread,
+		t.rate_limited >= $5::bigint as rate_limited_flag
+	from totals t cross join median m
+	left join spread s on s.user_id = t.user_id
+	left join cases c on c.user_id = t.user_id
+)
+select user_id, archives, metadata_writes, rate_limited, subprimers, report_cases, last_active,
+	metadata_volume, subprimer_spread, rate_limited_flag
+from (
+	select *, metadata_volume::int + subprimer_spread::int + rate_limited_flag::int as flags from activity
+) a where %s order by %s limit $6 offset $7`
+
+// queryUserActivity runs userActivityQuery
+func queryUserActivity(db *sql.DB, where, order, arg string, limit, offset int, now time.Time) ([]*UserActivity, error) {
+	since := now.Add(-userActivityWindow).In(time.UTC)
+	rows, err := db.Query(fmt.Sprintf(userActivityQuery, where, order),
+		since, arg, userActivityMetadataFactor, userActivitySubprimerSpread, userActivityRateLimitHits, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activity := []*UserActivity{}
+	for rows.Next() {
+		a := &UserActivity{Flags: []string{}}
+		var metadataVolume, subprimerSpread, rateLimited bool
+		if err := rows.Scan(&a.UserId, &a.Archives, &a.MetadataWrites, &a.RateLimited, &a.DailySubprimers, &a.ReportCases, &a.LastActive,
+			&metadataVolume, &subprimerSpread, &rateLimited); err != nil {
+			return nil, err
+		}
+		if metadataVolume {
+			a.Flags = append(a.Flags, userFlagMetadataVolume)
+		}
+		if subprimerSpread {
+			a.Flags = append(a.Flags, userFlagSubprimerSpread)
+		}
+		if rateLimited {
+			a.Flags = append(a.Flags, userFlagRateLimited)
+		}
+		a.LastActive = a.LastActive.In(time.UTC)
+		activity = append(activity, a)
+	}
+	return activity, rows.Err()
+}
+
+// ListUserActivity lists the activity of every user active within
+// userActivityWindow, ordered by one of userActivitySorts
+func ListUserActivity(db *sql.DB, sort string, limit, offset int) ([]*UserActivity, error) {
+	return SearchUserActivity(db, "", sort, limit, offset)
+}
+
+// SearchUserActivity lists the activity of users who's id contains query,
+// ordered by one of userActivitySorts
+func SearchUserActivity(db *sql.DB, query, sort string, limit, offset int) ([]*UserActivity, error) {
+	if sort == "" {
+		sort = "anomalous"
+	}
+	order, ok := userActivitySorts[sort]
+	if !ok {
+		return nil, ErrUserActivitySort
+	}
+	return queryUserActivity(db, "strpos(user_id, $2) > 0", order, query, limit, offset, time.Now())
+}
+
+// UserActivitySummary reads a user's activity & their most recent actions.
+// returns ErrNotFound if the user hasn't been active within
+// userActivityWindow, or has been erased
+func UserActivitySummary(db *sql.DB, userId string) (*UserActivityDetail, error) {
+	activity, err := queryUserActivity(db, "user_id = $2", "user_id", userId, 1, 0, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(activity) == 0 {
+		return nil, ErrNotFound
+	}
+
+	rows, err := db.Query("select created, user_id, action, subprimer, target from user_actions where user_id = $1 order by created desc, id desc limit $2",
+		userId, userActivityRecent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	d := &UserActivityDetail{UserActivity: activity[0], Recent: []*UserAction{}}
+	for rows.Next() {
+		a := &UserAction{}
+		if err := rows.Scan(&a.Created, &a.UserId, &a.Action, &a.Subprimer, &a.Target); err != nil {
+			return nil, err
+		}
+		a.Created = a.Created.In(time.UTC)
+		d.Recent = append(d.Recent, a)
+	}
+	return d, rows.Err()
+}
+
+// ListUserActivityAction lists user activity for moderators
+type ListUserActivityAction struct {
+	ReqAction
+	pageRequest
+	clientAction
+	Token string `json:"token"`
+	// only users who's id contains query are listed
+	Query string `json:"query"`
+	// one of userActivitySorts, defaults to "anomalous"
+	Sort string `json:"sort"`
+}
+
+func (ListUserActivityAction) Type() string        { return "USER_ACTIVITY_REQUEST" }
+func (ListUserActivityAction) SuccessType() string { return "USER_ACTIVITY_SUCCESS" }
+func (ListUserActivityAction) FailureType() string { return "USER_ACTIVITY_FAILURE" }
+
+func (ListUserActivityAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &ListUserActivityAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *ListUserActivityAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrNotModerator.Error(),
+		}
+	}
+	if err := a.window(); err != nil {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	activity, err := SearchUserActivity(svc.DB, a.Query, a.Sort, a.fetch(), a.offset)
+	if err != nil {
+		if err != ErrUserActivitySort {
+			log.Info(err.Error())
+		}
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "USER_ACTIVITY_ARRAY",
+		Page:      a.Page,
+		PageSize:  a.PageSize,
+		Data:      newPage(&a.pageRequest, activity),
+	}
+}
+
+// UserActivitySummaryAction reads a user's activity for moderators
+type UserActivitySummaryAction struct {
+	ReqAction
+	clientAction
+	Token  string `json:"token"`
+	UserId string `json:"userId"`
+}
+
+func (UserActivitySummaryAction) Type() string        { return "USER_ACTIVITY_SUMMARY_REQUEST" }
+func (UserActivitySummaryAction) SuccessType() string { return "USER_ACTIVITY_SUMMARY_SUCCESS" }
+func (UserActivitySummaryAction) FailureType() string { return "USER_ACTIVITY_SUMMARY_FAILURE" }
+
+func (UserActivitySummaryAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &UserActivitySummaryAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *UserActivitySummaryAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	if !validModerationToken(svc.Config, a.Token) {
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     ErrNotModerator.Error(),
+		}
+	}
+
+	d, err := UserActivitySummary(svc.DB, a.UserId)
+	if err == ErrNotFound {
+		return notFoundResponse(a, a.RequestId, "user", a.UserId)
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{
+			Type:      a.FailureType(),
+			RequestId: a.RequestId,
+			Error:     err.Error(),
+		}
+	}
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "USER_ACTIVITY",
+		Data:      d,
+	}
+}
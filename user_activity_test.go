@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestUserActivity(t *testing.T) {
+	defer resetTestData(appDB, "user_actions", "moderation_cases", "erase_jobs")
+	if err := emptyTestData(appDB, "user_actions", "moderation_cases", "erase_jobs"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Now()
+	for user, writes := range map[string]int{"a": 2, "b": 2, "c": 1, "erased": 50} {
+		for i := 0; i < writes; i++ {
+			logUserAction(appDB, user, userActionMetadata, "", "1220b", now)
+		}
+	}
+	logUserAction(appDB, "a", userActionArchive, "", "http://www.epa.gov", now)
+	logUserAction(appDB, "a", userActionRateLimited, "", "link_archives", now)
+	if _, err := appDB.Exec(`insert into user_actions (created,user_id,action,subprimer,target)
+		select $1, 'spammer', 'metadata', '', 'subject-' || n from generate_series(1, 100) n;
+		insert into user_actions (created,user_id,action,subprimer,target)
+		select $1, 'hopper', 'archive', 'subprimer-' || n, 'http://example.com/' || n from generate_series(1, 12) n;
+		insert into user_actions (created,user_id,action,subprimer,target) values ($2, 'lapsed', 'archive', '', 'http://www.epa.gov');
+		insert into moderation_cases (id,subject) values ('4d3c2b1a-0f9e-4d8c-b7a6-5f4e3d2c1b0a', 'http://www.epa.gov');
+		insert into erase_jobs (id,user_id,mode,status,counts) values ('9a8b7c6d-5e4f-4a3b-2c1d-0e9f8a7b6c5d', 'erased', 'suppress', 'complete', '{}')`,
+		now.Round(time.Second).In(time.UTC), now.Add(-2*userActivityWindow).In(time.UTC)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	list, err := ListUserActivity(appDB, "", 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// erased & lapsed users aren't listed, anomalous users come first
+	expect := []struct {
+		userId string
+		flags  []string
+	}{
+		{"spammer", []string{userFlagMetadataVolume}},
+		{"hopper", []string{userFlagSubprimerSpread}},
+		{"a", nil},
+		{"b", nil},
+		{"c", nil},
+	}
+	if len(list) != len(expect) {
+		t.Fatalf("expected %d users, got: %d", len(expect), len(list))
+	}
+	for i, e := range expect {
+		if list[i].UserId != e.userId || len(list[i].Flags) != len(e.flags) || (len(e.flags) > 0 && list[i].Flags[0] != e.flags[0]) {
+			t.Errorf("case %d expected %s flagged %v, got: %s flagged %v", i, e.userId, e.flags, list[i].UserId, list[i].Flags)
+		}
+	}
+
+	if list, err := ListUserActivity(appDB, "archives", 1, 0); err != nil || len(list) != 1 || list[0].UserId != "hopper" || list[0].DailySubprimers != 12 {
+		t.Errorf("expected hopper to have archived the most, got: %v %v", list, err)
+	}
+	if _, err := ListUserActivity(appDB, "loudest", 10, 0); err != ErrUserActivitySort {
+		t.Errorf("expected unknown sorts to error, got: %v", err)
+	}
+	if list, err := SearchUserActivity(appDB, "spam", "", 10, 0); err != nil || len(list) != 1 || list[0].UserId != "spammer" {
+		t.Errorf("expected a search to find spammer, got: %v %v", list, err)
+	}
+
+	d, err := UserActivitySummary(appDB, "a")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if d.Archives != 1 || d.MetadataWrites != 2 || d.RateLimited != 1 || d.ReportCases != 1 || len(d.Recent) != 4 {
+		t.Errorf("unexpected summary: %v, %d recent actions", d.UserActivity, len(d.Recent))
+	}
+	for _, userId := range []string{"erased", "lapsed", "missing"} {
+		if _, err := UserActivitySummary(appDB, userId); err != ErrNotFound {
+			t.Errorf("expected %s not to be found, got: %v", userId, err)
+		}
+	}
+
+	// only moderators can look
+	svc := newTestService()
+	svc.Config.ModerationToken = "matrix"
+	client := &Client{svc: svc}
+	res := client.HandleRequestAction(ListUserActivityAction{}.Type(), "req", false, "", json.RawMessage(`{"token":"wrong"}`))
+	if res.Error != ErrNotModerator.Error() {
+		t.Errorf("expected an invalid token to be refused, got: %q", res.Error)
+	}
+	res = client.HandleRequestAction(UserActivitySummaryAction{}.Type(), "req", false, "", json.RawMessage(`{"token":"matrix","userId":"spammer"}`))
+	if d, ok := res.Data.(*UserActivityDetail); !ok || d.MetadataWrites != 100 {
+		t.Errorf("expected spammer's summary, got: %v %s", res.Data, res.Error)
+	}
+}
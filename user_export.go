@@ -0,0 +1,577 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// User data exports
+//
+// Users can download everything they've contributed as a zip of NDJSON files,
+// one per kind of contribution, plus a manifest. metadata.ndjson holds the
+// metadata blocks they authored as they're stored, so it can be loaded back
+// with the import-metadata command. Exports are streamed directly to api keys
+// with the export scope at GET /exports, or prepared in the background for
+// websocket clients with USER_EXPORT_REQUEST & kept in cfg.UserExportDir,
+// named by their hash, until they expire. prepared exports are downloaded at
+// /exports/{hash}. users can start one export a day
+
+const (
+	userExportPreparing = "preparing"
+	userExportReady     = "ready"
+	userExportStreamed  = "streamed"
+	userExportExpired   = "expired"
+	userExportFailed    = "failed"
+
+	// version of the export format, recorded in it's manifest
+	userExportVersion = 1
+	// how long prepared exports can be downloaded
+	userExportTTL = 6 * time.Hour
+	// users can start one export per window. failed exports don't count
+	userExportWindow = 24 * time.Hour
+	// exports still preparing after this long were interrupted by a restart
+	userExportTimeout = time.Hour
+)
+
+var (
+	// ErrUserExportLimit is returned when a user has already exported their data today
+	ErrUserExportLimit = fmt.Errorf("you can only export your data once a day, please try again tomorrow")
+	// ErrUserExportsDisabled is returned when exports can't be prepared because
+	// UserExportDir isn't configured
+	ErrUserExportsDisabled = fmt.Errorf("preparing data exports is disabled on this server")
+	// ErrUserExportRequester is returned when an anonymous client asks for an export
+	ErrUserExportRequester = fmt.Errorf("connect with an api key to export your data")
+)
+
+// UserExport records an export of a user's data
+type UserExport struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	UserId  string    `json:"userId"`
+	Status  string    `json:"status"`
+	// multihash of the prepared zip
+	Hash string `json:"hash,omitempty"`
+	Size int64  `json:"size,omitempty"`
+	// when a prepared export stops being downloadable
+	Expires *time.Time `json:"expires,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// Download is the path a ready export is downloaded from
+func (e *UserExport) Download() string {
+	if e.Status != userExportReady {
+		return ""
+	}
+	return "/exports/" + e.Hash
+}
+
+// MarshalJSON adds the download path
+func (e *UserExport) MarshalJSON() ([]byte, error) {
+	type export UserExport
+	return json.Marshal(&struct {
+		*export
+		Download string `json:"download,omitempty"`
+	}{(*export)(e), e.Download()})
+}
+
+// userExportCols are the columns of user_exports
+var userExportCols = &columnSet{
+	table:   "user_exports",
+	columns: []string{"id", "created", "user_id", "status", "hash", "size", "expires", "error"},
+}
+
+// scanTargets maps userExportCols to the export's fields
+func (e *UserExport) scanTargets() scanTargets {
+	return scanTargets{
+		"id":      &e.Id,
+		"created": &e.Created,
+		"user_id": &e.UserId,
+		"status":  &e.Status,
+		"hash":    &e.Hash,
+		"size":    &e.Size,
+		"expires": &e.Expires,
+		"error":   &e.Error,
+	}
+}
+
+// UserExportManifest describes an export, it's written last as manifest.json
+type UserExportManifest struct {
+	Version int       `json:"version"`
+	UserId  string    `json:"userId"`
+	Created time.Time `json:"created"`
+	// rows written to each file
+	Counts map[string]int `json:"counts"`
+}
+
+// UserExportArchiveRequest is an archive request in an export
+type UserExportArchiveRequest struct {
+	Id      int64     `json:"id"`
+	Created time.Time `json:"created"`
+	Url     string    `json:"url"`
+	// page a link archive request was made from
+	Via string `json:"via,omitempty"`
+	// id of the api key the request was made with, if any
+	ApiKey string `json:"apiKey,omitempty"`
+}
+
+// userExportFiles are written to an export in order, each writing a user's
+// rows with enc & returning the number written
+var userExportFiles = []struct {
+	name  string
+	write func(db sqlQueryable, userId string, enc *json.Encoder) (int, error)
+}{
+	{"metadata.ndjson", exportUserMetadata},
+	{"archive_requests.ndjson", exportUserArchiveRequests},
+	{"watchlist.ndjson", exportUserWatchlist},
+}
+
+// ExportUserData writes everything a user has contributed to w as a zip. rows
+// are written as they're read, so exports aren't held in memory
+func ExportUserData(db sqlQueryable, userId string, w io.Writer) error {
+	if userId == "" {
+		return ErrUserExportRequester
+	}
+	z := zip.NewWriter(w)
+	m := &UserExportManifest{
+		Version: userExportVersion,
+		UserId:  userId,
+		Created: time.Now().Round(time.Second).In(time.UTC),
+		Counts:  map[string]int{},
+	}
+
+	for _, f := range userExportFiles {
+		fw, err := createUserExportFile(z, f.name, m.Created)
+		if err != nil {
+			return err
+		}
+		n, err := f.write(db, userId, json.NewEncoder(fw))
+		if err != nil {
+			return err
+		}
+		m.Counts[f.name] = n
+	}
+
+	fw, err := createUserExportFile(z, "manifest.json", m.Created)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// createUserExportFile adds a file to an export, stamped with when the export was made
+func createUserExportFile(z *zip.Writer, name string, created time.Time) (io.Writer, error) {
+	h := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	h.SetModTime(created)
+	return z.CreateHeader(h)
+}
+
+// exportUserMetadata writes the metadata blocks a user authored, each chain in
+// order. deleted & suppressed blocks aren't exported
+func exportUserMetadata(db sqlQueryable, userId string, enc *json.Encoder) (int, error) {
+	rows, err := db.Query("select "+metadataCols.String()+" from metadata where key_id = $1 and deleted = false order by subject, time_stamp, hash", userId)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		m, err := scanMetadata(rows)
+		if err != nil {
+			return n, err
+		}
+		if err := enc.Encode(m); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// exportUserArchiveRequests writes the archives a user requested, including
+// those made with their api keys
+func exportUserArchiveRequests(db sqlQueryable, userId string, enc *json.Encoder) (int, error) {
+	rows, err := db.Query(`select id, created, url, via, case when user_id = $1 then '' else requester end from archive_requests
+		where user_id = $1 or requester in (select id::text from api_keys where key_id = $1)
+		order by created, id`, userId)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		r := &UserExportArchiveRequest{}
+		if err := rows.Scan(&r.Id, &r.Created, &r.Url, &r.Via, &r.ApiKey); err != nil {
+			return n, err
+		}
+		if err := enc.Encode(r); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// exportUserWatchlist writes a user's saved searches
+func exportUserWatchlist(db sqlQueryable, userId string, enc *json.Encoder) (int, error) {
+	rows, err := db.Query("select "+savedSearchCols.String()+" from saved_searches where owner = $1 order by created", userId)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		s := &SavedSearch{}
+		if err := savedSearchCols.scan(rows, s.scanTargets()); err != nil {
+			return n, err
+		}
+		if err := enc.Encode(s); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// reserveUserExport records a user starting an export, failing with
+// ErrUserExportLimit if they've started one in the last userExportWindow
+func reserveUserExport(db *sql.DB, userId, status string, now time.Time) (*UserExport, error) {
+	e := &UserExport{
+		Id:      uuid.New(),
+		Created: now.Round(time.Second).In(time.UTC),
+		UserId:  userId,
+		Status:  status,
+	}
+	res, err := db.Exec(`insert into user_exports (id, created, user_id, status) select $1, $2, $3, $4
+		where not exists (select 1 from user_exports where user_id = $3 and created > $5 and status != $6)`,
+		e.Id, e.Created, e.UserId, e.Status, e.Created.Add(-userExportWindow), userExportFailed)
+	if err != nil {
+		return nil, checkWriteErr(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrUserExportLimit
+	}
+	return e, nil
+}
+
+// latestUserExport reads the export a user started most recently
+func latestUserExport(db *sql.DB, userId string) (*UserExport, error) {
+	e := &UserExport{}
+	err := userExportCols.scan(db.QueryRow("select "+userExportCols.String()+" from user_exports where user_id = $1 order by created desc limit 1", userId), e.scanTargets())
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return e, err
+}
+
+// ReadUserExport reads a prepared export that can still be downloaded by it's hash
+func ReadUserExport(db *sql.DB, hash string, now time.Time) (*UserExport, error) {
+	e := &UserExport{}
+	err := userExportCols.scan(db.QueryRow("select "+userExportCols.String()+" from user_exports where hash = $1 and status = $2 and expires > $3 order by created desc limit 1",
+		hash, userExportReady, now.In(time.UTC)), e.scanTargets())
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return e, err
+}
+
+// failUserExport records that an export didn't finish, which frees the user
+// to try again
+func failUserExport(db *sql.DB, e *UserExport, exportErr error) {
+	e.Status = userExportFailed
+	e.Error = exportErr.Error()
+	if _, err := db.Exec("update user_exports set status = $2, error = $3 where id = $1", e.Id, e.Status, e.Error); err != nil {
+		log.Info(err.Error())
+	}
+}
+
+// prepareUserExport writes a reserved export to dir, named by it's hash. the
+// export is written to a temp file first so partial exports are never served
+func prepareUserExport(db *sql.DB, dir string, e *UserExport, now time.Time) error {
+	f, err := ioutil.TempFile(dir, ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h, err := newContentHasher(contentHashAlgorithm)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := ExportUserData(db, e.UserId, io.MultiWriter(f, h)); err != nil {
+		f.Close()
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	hash, err := h.Multihash()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, hash)); err != nil {
+		return err
+	}
+
+	expires := now.Add(userExportTTL).Round(time.Second).In(time.UTC)
+	e.Status, e.Hash, e.Size, e.Expires = userExportReady, hash, info.Size(), &expires
+	_, err = db.Exec("update user_exports set status = $2, hash = $3, size = $4, expires = $5 where id = $1",
+		e.Id, e.Status, e.Hash, e.Size, e.Expires)
+	return err
+}
+
+// SweepUserExports removes prepared exports that have expired from dir,
+// returning the number of files removed. exports interrupted by a restart are
+// marked failed
+func SweepUserExports(db *sql.DB, dir string, now time.Time) (int, error) {
+	now = now.In(time.UTC)
+	if _, err := db.Exec("update user_exports set status = $1, error = 'interrupted' where status = $2 and created < $3",
+		userExportFailed, userExportPreparing, now.Add(-userExportTimeout)); err != nil {
+		return 0, err
+	}
+
+	// identical exports share a file, which is kept while any of them can be downloaded
+	rows, err := db.Query(`select distinct hash from user_exports where status = $1 and expires <= $2
+		and hash not in (select hash from user_exports where status = $1 and expires > $2)`, userExportReady, now)
+	if err != nil {
+		return 0, err
+	}
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		hashes = append(hashes, hash)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, hash := range hashes {
+		if err := os.Remove(filepath.Join(dir, hash)); err == nil {
+			removed++
+		} else if !os.IsNotExist(err) {
+			return removed, err
+		}
+	}
+	_, err = db.Exec("update user_exports set status = $1 where status = $2 and expires <= $3", userExportExpired, userExportReady, now)
+	return removed, err
+}
+
+// sweepUserExports is the leader task that removes expired exports
+func sweepUserExports(db *sql.DB, now time.Time) {
+	if cfg.UserExportDir == "" {
+		return
+	}
+	n, err := SweepUserExports(db, cfg.UserExportDir, now)
+	if err != nil {
+		log.Infof("error sweeping expired exports: %s", err.Error())
+	}
+	if n > 0 {
+		log.Infof("removed %d expired exports", n)
+	}
+}
+
+// UserExportHandler serves /exports with the default service
+func UserExportHandler(w http.ResponseWriter, r *http.Request) {
+	defaultService().serveUserExport(w, r)
+}
+
+// serveUserExport streams a user's data to api keys with the export scope at
+// GET /exports, & serves prepared exports at GET /exports/{hash}. the hash of a
+// prepared export is only given to the user who prepared it
+func (s *Service) serveUserExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if hash := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/exports"), "/"); hash != "" {
+		s.serveUserExportFile(w, r, hash)
+		return
+	}
+
+	key, err := authenticateApiKey(s.DB, bearerToken(r), apiScopeExport)
+	if err == ErrInvalidApiKey {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	} else if err == ErrApiKeyScope {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+	// exports cover every subprimer, keys limited to some can't download them
+	if len(key.Subprimers) > 0 {
+		err = ErrApiKeySubprimer
+	}
+	logApiKeyAction(s.DB, key.Id, "GET /exports", "", err == nil, err, s.Clock())
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": err.Error(), "code": apiKeyScopeErrCode, "apiKey": key.scope()})
+		return
+	}
+
+	e, err := reserveUserExport(s.DB, key.KeyId, userExportStreamed, s.Clock())
+	if err == ErrUserExportLimit {
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	} else if err == ErrMaintenanceMode {
+		writeMaintenanceError(w)
+		return
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="patchbay-export.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	// once the response has started errors can't be reported, the download is left truncated
+	if err := ExportUserData(s.DB, key.KeyId, w); err != nil {
+		s.Log.Infof("error exporting data for %s: %s", key.KeyId, err.Error())
+		failUserExport(s.DB, e, err)
+	}
+}
+
+// serveUserExportFile serves a prepared export that hasn't expired
+func (s *Service) serveUserExportFile(w http.ResponseWriter, r *http.Request, hash string) {
+	if s.Config == nil || s.Config.UserExportDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := ReadUserExport(s.DB, hash, s.Clock()); err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.Config.UserExportDir, hash))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.Log.Info(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="patchbay-export.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, f); err != nil {
+		s.Log.Info(err.Error())
+	}
+}
+
+// UserExportAction starts preparing an export of the data of the user the
+// client's api key acts for, which must have the export scope. the
+// client is sent a USER_EXPORT_READY response with the export's download path
+// once it's prepared, or USER_EXPORT_FAILURE if it can't be. requests past the
+// daily limit fail with the user's latest export
+type UserExportAction struct {
+	ReqAction
+	clientAction
+}
+
+func (UserExportAction) Type() string        { return "USER_EXPORT_REQUEST" }
+func (UserExportAction) SuccessType() string { return "USER_EXPORT_SUCCESS" }
+func (UserExportAction) FailureType() string { return "USER_EXPORT_FAILURE" }
+
+func (UserExportAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &UserExportAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *UserExportAction) Exec() (res *ClientResponse) {
+	svc := a.client.service()
+	// the key id a client says hello with can be anyone's, only exports for
+	// the user an api key acts for
+	key := a.client.apiKey
+	if key == nil || key.KeyId == "" {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrUserExportRequester.Error()}
+	}
+	if !key.hasScope(apiScopeExport) {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrApiKeyScope.Error()}
+	}
+	userId := key.KeyId
+	if svc.Config == nil || svc.Config.UserExportDir == "" {
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: ErrUserExportsDisabled.Error()}
+	}
+
+	e, err := reserveUserExport(svc.DB, userId, userExportPreparing, svc.Clock())
+	if err == ErrUserExportLimit {
+		res := &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error(), personal: true}
+		if latest, err := latestUserExport(svc.DB, userId); err == nil {
+			res.Schema = "USER_EXPORT"
+			res.Data = latest
+		}
+		return res
+	} else if err != nil {
+		log.Info(err.Error())
+		return &ClientResponse{Type: a.FailureType(), RequestId: a.RequestId, Error: err.Error()}
+	}
+
+	// the job updates it's own copy, e is sent in the response
+	job := *e
+	go func(c *Client, reqId string) {
+		if err := prepareUserExport(svc.DB, svc.Config.UserExportDir, &job, svc.Clock()); err != nil {
+			svc.Log.Infof("error preparing export for %s: %s", job.UserId, err.Error())
+			failUserExport(svc.DB, &job, err)
+			if c != nil {
+				c.SendResponse(&ClientResponse{Type: "USER_EXPORT_FAILURE", RequestId: reqId, Schema: "USER_EXPORT", Error: err.Error(), Data: &job})
+			}
+			return
+		}
+		if c != nil {
+			c.SendResponse(&ClientResponse{Type: "USER_EXPORT_READY", RequestId: reqId, Schema: "USER_EXPORT", Data: &job})
+		}
+	}(a.client, a.RequestId)
+
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "USER_EXPORT",
+		Data:      e,
+		personal:  true,
+	}
+}
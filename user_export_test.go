@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+// readTestExport reads the files of an export zip
+func readTestExport(t *testing.T, data []byte) map[string][]byte {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	files := map[string][]byte{}
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if files[f.Name], err = ioutil.ReadAll(r); err != nil {
+			t.Fatal(err.Error())
+		}
+		r.Close()
+	}
+	return files
+}
+
+func TestExportUserDataRoundTrip(t *testing.T) {
+	defer resetTestData(appDB, "metadata", "relations", "archive_requests", "saved_searches", "api_keys")
+	const subject = "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a"
+
+	svc := newTestService()
+	svc.Store = nil
+	first := &core.Metadata{KeyId: "exporter", Subject: subject, Meta: map[string]interface{}{"title": "EPA"}}
+	if err := svc.WriteMetadata(first); err != nil {
+		t.Fatal(err.Error())
+	}
+	second := &core.Metadata{KeyId: "exporter", Subject: subject, Prev: first.Hash, Meta: map[string]interface{}{"title": "EPA", "tags": []interface{}{"climate"}}}
+	if err := svc.WriteMetadata(second); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := svc.WriteMetadata(&core.Metadata{KeyId: "someone else", Subject: subject, Meta: map[string]interface{}{"title": "not theirs"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	apiKey, _, err := CreateApiKey(appDB, "exporter", "ci", []string{apiScopeArchive}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into archive_requests (created,url,user_id,requester) values
+		('2017-01-01 00:00:01', 'http://www.epa.gov/a', 'exporter', ''),
+		('2017-01-01 00:00:02', 'http://www.epa.gov/b', '', $1),
+		('2017-01-01 00:00:03', 'http://www.epa.gov/c', '', 'ip')`, apiKey.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := appDB.Exec(`insert into saved_searches (id,owner,name,query) values ('0b8f3c1e-4d2a-4f6b-9a7e-1c2d3e4f5a6b','exporter','climate','climate')`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ExportUserData(appDB, "exporter", buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	files := readTestExport(t, buf.Bytes())
+	m := &UserExportManifest{}
+	if err := json.Unmarshal(files["manifest.json"], m); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := map[string]int{"metadata.ndjson": 2, "archive_requests.ndjson": 2, "watchlist.ndjson": 1}
+	for name, n := range expect {
+		if m.Counts[name] != n {
+			t.Errorf("expected %d rows in %s, got: %d", n, name, m.Counts[name])
+		}
+		if lines := bytes.Count(files[name], []byte("\n")); lines != n {
+			t.Errorf("expected %s to have %d lines, got: %d", name, n, lines)
+		}
+	}
+	if !strings.Contains(string(files["archive_requests.ndjson"]), `"apiKey":"`+apiKey.Id+`"`) {
+		t.Errorf("expected archive requests made with an api key to name it, got: %s", files["archive_requests.ndjson"])
+	}
+
+	// exported metadata loads back into an empty table, keeping it's hashes
+	if _, err := appDB.Exec("delete from metadata"); err != nil {
+		t.Fatal(err.Error())
+	}
+	r, err := ImportMetadata(appDB, bytes.NewReader(files["metadata.ndjson"]), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Imported != 2 || r.Existing != 0 || len(r.Mismatches) != 0 {
+		t.Errorf("expected 2 blocks imported, got: %#v", r)
+	}
+	for _, b := range []*core.Metadata{first, second} {
+		stored, err := scanMetadata(appDB.QueryRow("select "+metadataCols.String()+" from metadata where hash = $1", b.Hash))
+		if err != nil {
+			t.Fatalf("%s: %s", b.Hash, err.Error())
+		}
+		if hash, _ := metadataHash(stored); hash != b.Hash {
+			t.Errorf("expected imported block to hash to %s, got: %s", b.Hash, hash)
+		}
+	}
+
+	// re-running an import skips stored blocks, & blocks that don't match their hash aren't imported
+	tampered := bytes.Replace(files["metadata.ndjson"], []byte(`"climate"`), []byte(`"weather"`), 1)
+	if r, err = ImportMetadata(appDB, bytes.NewReader(tampered), nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Imported != 0 || r.Existing != 1 || len(r.Mismatches) != 1 || r.Mismatches[0].Expected != second.Hash {
+		t.Errorf("expected 1 existing & 1 mismatched block, got: %#v", r)
+	}
+}
+
+func TestUserExportAction(t *testing.T) {
+	defer resetTestData(appDB, "metadata", "user_exports", "api_keys")
+	dir, err := ioutil.TempDir("", "user_exports")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	svc := newTestService()
+	svc.Config.UserExportDir = dir
+	client := &Client{svc: svc, send: make(chan []byte, 4)}
+	exec := func() *ClientResponse {
+		a := UserExportAction{}.Parse("req", json.RawMessage(`{}`))
+		a.(ClientBoundAction).SetClient(client)
+		return a.Exec()
+	}
+
+	if res := exec(); res.Error != ErrUserExportRequester.Error() {
+		t.Errorf("expected anonymous exports to fail, got: %q", res.Error)
+	}
+
+	// saying hello with a key id doesn't export that user's data
+	client.setKeyId("exporter")
+	if res := exec(); res.Error != ErrUserExportRequester.Error() {
+		t.Errorf("expected exports without an api key to fail, got: %q", res.Error)
+	}
+	client.apiKey = &ApiKey{KeyId: "exporter", Scopes: []string{apiScopeRead}}
+	if res := exec(); res.Error != ErrApiKeyScope.Error() {
+		t.Errorf("expected exports with keys without the export scope to fail, got: %q", res.Error)
+	}
+
+	client.apiKey = &ApiKey{KeyId: "exporter", Scopes: []string{apiScopeExport}}
+	res := exec()
+	if res.Error != "" || !res.personal {
+		t.Fatalf("expected a personal response, got: %s", res.Error)
+	}
+	if e := res.Data.(*UserExport); e.Status != userExportPreparing {
+		t.Errorf("expected export to be preparing, got: %s", e.Status)
+	}
+
+	// the client is told when the export is ready
+	ready := &ClientResponse{}
+	select {
+	case data := <-client.send:
+		json.Unmarshal(data, ready)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the export")
+	}
+	e, err := latestUserExport(appDB, "exporter")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ready.Type != "USER_EXPORT_READY" || e.Status != userExportReady || e.Hash == "" {
+		t.Fatalf("expected a ready export, got: %s %s", ready.Type, e.Status)
+	}
+
+	w := httptest.NewRecorder()
+	svc.serveUserExport(w, httptest.NewRequest("GET", e.Download(), nil))
+	if w.Code != http.StatusOK || int64(w.Body.Len()) != e.Size {
+		t.Errorf("expected a %d byte download, got: %d %d bytes", e.Size, w.Code, w.Body.Len())
+	}
+	if files := readTestExport(t, w.Body.Bytes()); files["manifest.json"] == nil {
+		t.Errorf("expected the download to have a manifest")
+	}
+
+	// one export a day, later requests are told about the latest
+	res = exec()
+	if res.Error != ErrUserExportLimit.Error() || res.Data == nil {
+		t.Errorf("expected a second export to be limited, got: %q", res.Error)
+	}
+
+	// streaming counts towards the limit too
+	key, token, err := CreateApiKey(appDB, "exporter", "ci", []string{apiScopeExport}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req := httptest.NewRequest("GET", "/exports", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	svc.serveUserExport(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected streaming to be limited, got: %d", w.Code)
+	}
+	appDB.Exec("delete from user_exports where user_id = $1", key.KeyId)
+	w = httptest.NewRecorder()
+	svc.serveUserExport(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("expected a streamed export, got: %d", w.Code)
+	}
+
+	// expired exports are swept & can't be downloaded
+	appDB.Exec("update user_exports set status = $1, hash = $2, expires = $3", userExportReady, e.Hash, *e.Expires)
+	n, err := SweepUserExports(appDB, dir, e.Expires.Add(time.Second))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(dir, e.Hash)); n != 1 || !os.IsNotExist(err) {
+		t.Errorf("expected the export to be removed, removed %d", n)
+	}
+	w = httptest.NewRecorder()
+	svc.serveUserExport(w, httptest.NewRequest("GET", e.Download(), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected expired exports not to be found, got: %d", w.Code)
+	}
+}
+
+func TestOpenMetadataImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata_import")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	const block = `{"hash":"1220a","keyId":"key"}` + "\n"
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	f, _ := z.Create("metadata.ndjson")
+	f.Write([]byte(block))
+	z.Close()
+	empty := &bytes.Buffer{}
+	zip.NewWriter(empty).Close()
+
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"export.zip", buf.Bytes(), nil},
+		{"blocks.ndjson", []byte(block), nil},
+		{"other.zip", empty.Bytes(), ErrNoExportMetadata},
+	}
+	for i, c := range cases {
+		path := filepath.Join(dir, c.name)
+		if err := ioutil.WriteFile(path, c.data, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		r, err := openMetadataImport(path)
+		if err != c.err {
+			t.Errorf("case %d expected error %v, got: %v", i, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		r.Close()
+		if line != block {
+			t.Errorf("case %d expected %q, got: %q", i, block, line)
+		}
+	}
+}
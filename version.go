@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// build info, set at build time with ldflags, see the Dockerfile. eg:
+// go install -ldflags "-X main.buildVersion=v1.2.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildTime    = ""
+)
+
+const (
+	// schemaVersion is the version of sql/schema.sql this build expects. bump it
+	// with every change to the schema
+	schemaVersion = 22
+	// protocolVersion is the version of the client action protocol this build
+	// speaks. bump it when actions are added or their payloads change
+	protocolVersion = 28
+)
+
+// ServerInfo describes the build & schema a server is running, & if it's leading
+type ServerInfo struct {
+	Version         string `json:"version"`
+	Commit          string `json:"commit,omitempty"`
+	BuildTime       string `json:"buildTime,omitempty"`
+	SchemaVersion   int    `json:"schemaVersion"`
+	ProtocolVersion int    `json:"protocolVersion"`
+	// leadership as of this instance's last lease claim, nil before the server starts
+	Leader *LeaderStatus `json:"leader,omitempty"`
+	// fields still sent under an old name, & when they'll stop being sent
+	Deprecations []*FieldDeprecation `json:"deprecations"`
+	// list actions answered with pages, & the protocol version they changed in
+	Paginated []*PaginatedAction `json:"paginated"`
+	// locales clients can ask for errors in
+	Locales []string `json:"locales"`
+}
+
+// serverInfo reports this build's info
+func serverInfo() *ServerInfo {
+	info := &ServerInfo{
+		Version:         buildVersion,
+		Commit:          buildCommit,
+		BuildTime:       buildTime,
+		SchemaVersion:   schemaVersion,
+		ProtocolVersion: protocolVersion,
+		Deprecations:    deprecatedFields,
+		Paginated:       paginatedActions,
+		Locales:         messages.locales(),
+	}
+	if leader != nil {
+		info.Leader = leader.Status()
+	}
+	return info
+}
+
+// protocolWarning describes a mismatch between the protocol version a client
+// was built against & the one the server speaks, empty if the server can serve
+// the client. servers keep answering older clients, so only newer clients warn
+func protocolWarning(clientVersion int) string {
+	if clientVersion <= protocolVersion {
+		return ""
+	}
+	return fmt.Sprintf("this app was built for a newer server (protocol version %d, server speaks %d). some features may not work until the server is updated", clientVersion, protocolVersion)
+}
+
+// versionHook adds the build version to every log line
+type versionHook struct{}
+
+func (versionHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (versionHook) Fire(e *logrus.Entry) error {
+	// entries made with WithFields share their data, so it's copied rather than
+	// written to in place
+	data := make(logrus.Fields, len(e.Data)+1)
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	data["version"] = buildVersion
+	e.Data = data
+	return nil
+}
+
+// ServerInfoAction reports the build & schema the server is running
+type ServerInfoAction struct {
+	ReqAction
+}
+
+func (ServerInfoAction) Type() string        { return "SERVER_INFO_REQUEST" }
+func (ServerInfoAction) SuccessType() string { return "SERVER_INFO_SUCCESS" }
+func (ServerInfoAction) FailureType() string { return "SERVER_INFO_FAILURE" }
+
+func (ServerInfoAction) Parse(reqId string, data json.RawMessage) ClientRequestAction {
+	a := &ServerInfoAction{}
+	a.RequestId = reqId
+	a.err = json.Unmarshal(data, a)
+	return a
+}
+
+func (a *ServerInfoAction) Exec() (res *ClientResponse) {
+	return &ClientResponse{
+		Type:      a.SuccessType(),
+		RequestId: a.RequestId,
+		Schema:    "SERVER_INFO",
+		Data:      serverInfo(),
+	}
+}
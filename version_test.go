@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestProtocolWarning(t *testing.T) {
+	cases := []struct {
+		client int
+		warn   bool
+	}{
+		{0, false},
+		{protocolVersion - 1, false},
+		{protocolVersion, false},
+		{protocolVersion + 1, true},
+	}
+
+	for i, c := range cases {
+		if got := protocolWarning(c.client); (got != "") != c.warn {
+			t.Errorf("case %d expected warning: %t, got: %q", i, c.warn, got)
+		}
+	}
+}
+
+func TestVersionHook(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logrus.New()
+	l.Out = buf
+	l.Formatter = &logrus.JSONFormatter{}
+	l.AddHook(versionHook{})
+
+	entry := l.WithField("job", "a")
+	entry.Info("one")
+	if _, ok := entry.Data["version"]; ok {
+		t.Errorf("expected hook not to modify shared entry data")
+	}
+	l.Info("two")
+
+	for i, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatal(err.Error())
+		}
+		if fields["version"] != buildVersion {
+			t.Errorf("line %d expected version %s, got: %v", i, buildVersion, fields["version"])
+		}
+	}
+}
+
+func TestHealthCheckHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	HealthCheckHandler(w, httptest.NewRequest("GET", "/healthcheck", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got: %d", w.Code)
+	}
+
+	res := struct {
+		Status int         `json:"status"`
+		Server *ServerInfo `json:"server"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Status != http.StatusOK || res.Server == nil || res.Server.SchemaVersion != schemaVersion || res.Server.Version != buildVersion {
+		t.Errorf("unexpected health response: %d %v", res.Status, res.Server)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/lib/pq"
+)
+
+// Visibility
+//
+// A subprimer can limit who sees what's archived under it with the "visibility"
+// source meta key:
+//
+//	{"visibility": "public"}
+//	{"visibility": "members", "members": ["[keyId]"]}
+//	{"visibility": "embargoed", "embargoUntil": "2027-01-01T00:00:00Z", "members": ["[keyId]"]}
+//
+// Members & owners of a restricted subprimer see everything under it, everyone
+// else is answered as if it didn't exist. A url falls under the most specific
+// subprimer that matches it, the same subprimer it's archived under. Content
+// is visible if any url it was captured at is visible, the same bytes published
+// in a public subprimer can't be kept secret by an embargo elsewhere.
+// Embargoes end on their own at embargoUntil, the leader flips them to public
+// once the date passes so the setting reflects it.
+
+const (
+	// visibilityMetaKey is the source meta key setting who can see a subprimer's urls
+	visibilityMetaKey = "visibility"
+	// embargoUntilMetaKey is the RFC3339 timestamp an embargoed subprimer becomes public
+	embargoUntilMetaKey = "embargoUntil"
+	// sourceMembersMetaKey lists the key ids that can see a restricted subprimer,
+	// in addition to it's owners
+	sourceMembersMetaKey = "members"
+)
+
+// visibility settings
+const (
+	visibilityPublic    = "public"
+	visibilityMembers   = "members"
+	visibilityEmbargoed = "embargoed"
+)
+
+// ErrRestricted is returned when archiving a url in a restricted subprimer
+// without being one of it's members. a subprimer's settings aren't secret, so
+// unlike reads this doesn't pretend the url doesn't exist
+var ErrRestricted = fmt.Errorf("only subprimer members can archive restricted urls")
+
+// sourceAccess is a subprimer's visibility setting
+type sourceAccess struct {
+	id  string
+	url string
+	// visibility setting, one of the visibility constants
+	visibility string
+	// when an embargo ends
+	until time.Time
+	// key ids of members & owners
+	members map[string]bool
+}
+
+// newSourceAccess reads the visibility setting from a source's meta. embargoes
+// without a valid end date are treated as members-only, so a typo doesn't
+// publish anything
+func newSourceAccess(id, url string, meta map[string]interface{}) *sourceAccess {
+	a := &sourceAccess{id: id, url: strings.ToLower(url), visibility: visibilityPublic, members: map[string]bool{}}
+	if v, ok := meta[visibilityMetaKey].(string); ok && v != "" {
+		a.visibility = v
+	}
+	if a.visibility == visibilityEmbargoed {
+		until, _ := meta[embargoUntilMetaKey].(string)
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			a.visibility = visibilityMembers
+		}
+		a.until = t
+	}
+	for _, key := range []string{sourceMembersMetaKey, sourceOwnersMetaKey} {
+		if ids, ok := meta[key].([]interface{}); ok {
+			for _, id := range ids {
+				if s, ok := id.(string); ok {
+					a.members[s] = true
+				}
+			}
+		}
+	}
+	return a
+}
+
+// restricted reports weather the subprimer's urls are limited to members at t
+func (a *sourceAccess) restricted(t time.Time) bool {
+	switch a.visibility {
+	case visibilityPublic:
+		return false
+	case visibilityEmbargoed:
+		return t.Before(a.until)
+	default:
+		// unknown settings fail closed
+		return true
+	}
+}
+
+// accessRules are the visibility settings of every subprimer at a point in time
+type accessRules struct {
+	db  *sql.DB
+	now time.Time
+	// sources ordered most specific first, nil if none are restricted
+	sources []*sourceAccess
+}
+
+// loadAccessRules reads subprimer visibility settings
+func loadAccessRules(db *sql.DB, now time.Time) (*accessRules, error) {
+	r := &accessRules{db: db, now: now}
+	if db == nil {
+		return r, nil
+	}
+	rows, err := db.Query("select id, url, meta from sources where deleted = false")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	restricted := false
+	sources := []*sourceAccess{}
+	for rows.Next() {
+		var (
+			id, url string
+			data    []byte
+		)
+		if err := rows.Scan(&id, &url, &data); err != nil {
+			return nil, err
+		}
+		meta := map[string]interface{}{}
+		if data != nil {
+			if err := json.Unmarshal(data, &meta); err != nil {
+				return nil, err
+			}
+		}
+		a := newSourceAccess(id, url, meta)
+		restricted = restricted || a.restricted(now)
+		sources = append(sources, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if restricted {
+		sort.SliceStable(sources, func(i, j int) bool { return len(sources[i].url) > len(sources[j].url) })
+		r.sources = sources
+	}
+	return r, nil
+}
+
+// restricting returns the subprimer limiting who can see a url, nil if it's public
+func (r *accessRules) restricting(url string) *sourceAccess {
+	if len(r.sources) == 0 {
+		return nil
+	}
+	url = strings.ToLower(url)
+	for _, a := range r.sources {
+		if strings.Contains(url, a.url) {
+			if a.restricted(r.now) {
+				return a
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// subjectMembers returns the key ids that can see a subject. restricted is
+// false if everyone can
+func (r *accessRules) subjectMembers(subject string) (members map[string]bool, restricted bool, err error) {
+	if len(r.sources) == 0 || subject == "" {
+		return nil, false, nil
+	}
+	urls, err := subjectUrls(r.db, subject)
+	if err != nil {
+		return nil, false, err
+	}
+	members = map[string]bool{}
+	for _, url := range urls {
+		a := r.restricting(url)
+		if a == nil {
+			return nil, false, nil
+		}
+		for id := range a.members {
+			members[id] = true
+		}
+	}
+	// subjects that aren't captured content, eg: collection ids
+	if len(urls) == 0 {
+		return nil, false, nil
+	}
+	return members, true, nil
+}
+
+// subjectUrls lists the urls content was captured at, under any of it's hash aliases
+func subjectUrls(db *sql.DB, hash string) ([]string, error) {
+	hashes, err := hashAliases(db, hash)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("select url from urls where hash = any($1)", pq.Array(hashes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := []string{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+// Visibility is what a single requester can see
+type Visibility struct {
+	rules *accessRules
+	keyId string
+	// subjects already checked
+	subjects map[string]bool
+}
+
+// loadVisibility reads what the person with keyId can see at now. requests
+// without a key id only see public subprimers
+func loadVisibility(db *sql.DB, keyId string, now time.Time) (*Visibility, error) {
+	rules, err := loadAccessRules(db, now)
+	if err != nil {
+		return nil, err
+	}
+	return &Visibility{rules: rules, keyId: keyId, subjects: map[string]bool{}}, nil
+}
+
+// Url checks if a url is visible
+func (v *Visibility) Url(url string) bool {
+	a := v.rules.restricting(url)
+	return a == nil || (v.keyId != "" && a.members[v.keyId])
+}
+
+// Subject checks if content is visible
+func (v *Visibility) Subject(subject string) (bool, error) {
+	if visible, ok := v.subjects[subject]; ok {
+		return visible, nil
+	}
+	members, restricted, err := v.rules.subjectMembers(subject)
+	if err != nil {
+		return false, err
+	}
+	visible := !restricted || (v.keyId != "" && members[v.keyId])
+	v.subjects[subject] = visible
+	return visible, nil
+}
+
+// Urls filters a list of urls to the visible ones
+func (v *Visibility) Urls(urls []*core.Url) []*core.Url {
+	visible := make([]*core.Url, 0, len(urls))
+	for _, u := range urls {
+		if v.Url(u.Url) {
+			visible = append(visible, u)
+		}
+	}
+	return visible
+}
+
+// Links filters a list of links to ones where both ends are visible. a public
+// page linking to an embargoed one mustn't reveal what was captured there,
+// nor an embargoed page what it links to
+func (v *Visibility) Links(links []*core.Link) []*core.Link {
+	visible := make([]*core.Link, 0, len(links))
+	for _, l := range links {
+		if l.Src != nil && !v.Url(l.Src.Url) {
+			continue
+		}
+		if l.Dst != nil && !v.Url(l.Dst.Url) {
+			continue
+		}
+		visible = append(visible, l)
+	}
+	return visible
+}
+
+// Metadata filters a list of metadata blocks to ones about visible subjects
+func (v *Visibility) Metadata(blocks []*core.Metadata) ([]*core.Metadata, error) {
+	visible := make([]*core.Metadata, 0, len(blocks))
+	for _, m := range blocks {
+		ok, err := v.Subject(m.Subject)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			visible = append(visible, m)
+		}
+	}
+	return visible, nil
+}
+
+// visibility loads what the client that sent an action can see. membership is
+// checked against the client's authenticated identity, never the key id it
+// said hello with
+func (a *clientAction) visibility() (*Visibility, error) {
+	return loadVisibility(appDB, a.client.identity(), time.Now())
+}
+
+// canSee checks if the client that sent an action can see a subject
+func (a *clientAction) canSee(subject string) (bool, error) {
+	v, err := a.visibility()
+	if err != nil {
+		return false, err
+	}
+	return v.Subject(subject)
+}
+
+// checkArchiveAccess makes sure a url in a restricted subprimer is only
+// archived by it's members. keyId must be an authenticated identity
+func (s *Service) checkArchiveAccess(url, keyId string) error {
+	v, err := loadVisibility(s.DB, keyId, s.Clock())
+	if err != nil {
+		return err
+	}
+	if !v.Url(url) {
+		return ErrRestricted
+	}
+	return nil
+}
+
+// broadcastAllowed picks the clients an event about a subject can be sent to,
+// nil if it can go to every client. events about subjects that can't be
+// checked aren't sent to anyone
+func broadcastAllowed(db *sql.DB, subject string, now time.Time) (func(c *Client) bool, error) {
+	if db == nil || subject == "" {
+		return nil, nil
+	}
+	rules, err := loadAccessRules(db, now)
+	if err != nil {
+		return nil, err
+	}
+	members, restricted, err := rules.subjectMembers(subject)
+	if err != nil || !restricted {
+		return nil, err
+	}
+	return func(c *Client) bool {
+		id := c.identity()
+		return id != "" && members[id]
+	}, nil
+}
+
+// liftEmbargoes sets subprimers whose embargo has passed to public. they're
+// already visible to everyone, this makes the setting say so
+func liftEmbargoes(db *sql.DB, now time.Time) {
+	rows, err := db.Query("select id, url, meta from sources where deleted = false and meta::jsonb->>'visibility' = $1", visibilityEmbargoed)
+	if err != nil {
+		log.Infof("error reading embargoes: %s", err.Error())
+		return
+	}
+	// embargoes that have passed, & the end date they were read with
+	expired := map[*sourceAccess]string{}
+	for rows.Next() {
+		var (
+			id, url string
+			data    []byte
+		)
+		if err := rows.Scan(&id, &url, &data); err != nil {
+			log.Infof("error reading embargoes: %s", err.Error())
+			rows.Close()
+			return
+		}
+		meta := map[string]interface{}{}
+		if err := json.Unmarshal(data, &meta); err != nil {
+			log.Infof("error reading embargo for source %s: %s", id, err.Error())
+			continue
+		}
+		if a := newSourceAccess(id, url, meta); a.visibility == visibilityEmbargoed && !a.restricted(now) {
+			expired[a], _ = meta[embargoUntilMetaKey].(string)
+		}
+	}
+	rows.Close()
+
+	for a, until := range expired {
+		// the embargo is checked again in case it was extended since it was read
+		res, err := db.Exec(`update sources set meta = (meta::jsonb || jsonb_build_object('visibility', $2::text))::json, updated = $3
+			where id = $1 and meta::jsonb->>'visibility' = $4 and meta::jsonb->>'embargoUntil' = $5`,
+			a.id, visibilityPublic, now.Round(time.Second).In(time.UTC), visibilityEmbargoed, until)
+		if err := checkWriteErr(err); err != nil {
+			log.Infof("error lifting embargo on %s: %s", a.url, err.Error())
+			continue
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			continue
+		}
+		log.Infof("embargo on %s ended, it's now public", a.url)
+		// visibility doesn't change which urls fall under a subprimer
+		defaultService().publishSourceUpdated(a.id, true)
+	}
+}
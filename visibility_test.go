@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestVisibilityUrl(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	members := []interface{}{"member"}
+	rules := &accessRules{now: now, sources: []*sourceAccess{
+		newSourceAccess("4", "www.epa.gov/haps/open", map[string]interface{}{"visibility": "public"}),
+		newSourceAccess("3", "www.epa.gov/haps", map[string]interface{}{"visibility": "embargoed", "embargoUntil": "2027-01-01T00:00:00Z", "members": members}),
+		newSourceAccess("2", "www.epa.gov/past", map[string]interface{}{"visibility": "embargoed", "embargoUntil": "2026-01-01T00:00:00Z"}),
+		newSourceAccess("5", "www.epa.gov/typo", map[string]interface{}{"visibility": "embargoed", "embargoUntil": "next year"}),
+		newSourceAccess("6", "www.epa.gov/team", map[string]interface{}{"visibility": "members", "owners": []interface{}{"owner"}}),
+		newSourceAccess("1", "www.epa.gov", nil),
+	}}
+
+	cases := []struct {
+		url, keyId string
+		expect     bool
+	}{
+		{"http://www.epa.gov", "", true},
+		{"http://www.epa.gov/haps/report.pdf", "", false},
+		{"http://WWW.EPA.GOV/HAPS/report.pdf", "", false},
+		{"http://www.epa.gov/haps/report.pdf", "stranger", false},
+		{"http://www.epa.gov/haps/report.pdf", "member", true},
+		// the most specific subprimer decides
+		{"http://www.epa.gov/haps/open/report.pdf", "", true},
+		// embargoes that have passed are public, even before they're lifted
+		{"http://www.epa.gov/past/report.pdf", "", true},
+		// embargoes without a valid date stay members-only
+		{"http://www.epa.gov/typo/report.pdf", "", false},
+		{"http://www.epa.gov/team/report.pdf", "member", false},
+		{"http://www.epa.gov/team/report.pdf", "owner", true},
+		{"http://www.census.gov", "", true},
+	}
+
+	for i, c := range cases {
+		v := &Visibility{rules: rules, keyId: c.keyId, subjects: map[string]bool{}}
+		if got := v.Url(c.url); got != c.expect {
+			t.Errorf("case %d: %s for '%s' expected %t, got: %t", i, c.url, c.keyId, c.expect, got)
+		}
+	}
+
+	v := &Visibility{rules: rules, subjects: map[string]bool{}}
+	links := v.Links([]*core.Link{
+		{Src: &core.Url{Url: "http://www.epa.gov"}, Dst: &core.Url{Url: "http://www.epa.gov/about"}},
+		{Src: &core.Url{Url: "http://www.epa.gov"}, Dst: &core.Url{Url: "http://www.epa.gov/haps/report.pdf"}},
+		{Src: &core.Url{Url: "http://www.epa.gov/haps"}, Dst: &core.Url{Url: "http://www.epa.gov"}},
+	})
+	if len(links) != 1 || links[0].Dst.Url != "http://www.epa.gov/about" {
+		t.Errorf("expected links with a hidden end to be dropped, got %d links", len(links))
+	}
+}
+
+func TestVisibilityLeakage(t *testing.T) {
+	defer resetTestData(appDB, "sources", "urls", "links", "metadata")
+	const (
+		src     = "590e001b-7060-4e54-bc81-c20c305a8155"
+		public  = "http://www.epa.gov"
+		secret  = "http://www.epa.gov/haps/secret.pdf"
+		subject = "1220f00d0000000000000000000000000000000000000000000000000000000000bb"
+	)
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	meta, _ := json.Marshal(map[string]interface{}{"visibility": "embargoed", "embargoUntil": until, "members": []string{"member"}})
+	for _, q := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"update sources set meta = $2 where id = $1", []interface{}{src, string(meta)}},
+		{"insert into urls (url,created,updated,hash,title) values ($1, now(), now(), $2, 'secret report')", []interface{}{secret, subject}},
+		{"insert into links (created,updated,src,dst) values (now(), now(), $1, $2)", []interface{}{public, secret}},
+		{"insert into links (created,updated,src,dst) values (now(), now(), $1, $2)", []interface{}{secret, public}},
+	} {
+		if _, err := appDB.Exec(q.query, q.args...); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	member := &Client{addr: "127.0.0.1", svc: newTestService(), apiKey: &ApiKey{KeyId: "member"}}
+	member.setKeyId("member")
+	stranger := &Client{addr: "127.0.0.1", svc: newTestService(), apiKey: &ApiKey{KeyId: "stranger"}}
+	stranger.setKeyId("stranger")
+	// saying hello with a member's key id doesn't make a client a member
+	claimer := &Client{addr: "127.0.0.1", svc: newTestService()}
+	claimer.setKeyId("member")
+
+	// members keep writing during the embargo, strangers can't
+	save := func(c *Client) *ClientResponse {
+		a := SaveMetadataAction{}.Parse("save", json.RawMessage(`{"keyId":"`+c.requester()+`","subject":"`+subject+`","meta":{"title":"secret"}}`))
+		a.(ClientBoundAction).SetClient(c)
+		return a.Exec()
+	}
+	if res := save(member); res.Error != "" {
+		t.Fatalf("expected members to describe embargoed content, got: %s", res.Error)
+	}
+	for i, c := range []*Client{stranger, claimer} {
+		if res := save(c); res.Code != notFoundErrCode {
+			t.Errorf("case %d: expected non-members describing embargoed content to be not found, got: '%s'", i, res.Code)
+		}
+	}
+
+	exec := func(c *Client, a ClientAction, data string) *ClientResponse {
+		act := a.Parse("req", json.RawMessage(data))
+		act.(ClientBoundAction).SetClient(c)
+		return act.Exec()
+	}
+	count := func(res *ClientResponse) int {
+		items := res.Data
+		if pg, ok := items.(*Page); ok {
+			items = pg.Items
+		}
+		data, _ := json.Marshal(items)
+		list := []interface{}{}
+		json.Unmarshal(data, &list)
+		return len(list)
+	}
+
+	cases := []struct {
+		action       ClientAction
+		data         string
+		member, none int
+	}{
+		// links from a public url into an embargoed one
+		{FetchOutboundLinksAct{}, `{"url":"` + public + `"}`, 1, 0},
+		{FetchInboundLinksAct{}, `{"url":"` + public + `"}`, 1, 0},
+		// links asked for from the embargoed side
+		{FetchOutboundLinksAct{}, `{"url":"` + secret + `"}`, 1, 0},
+		{FetchInboundLinksAct{}, `{"url":"` + secret + `"}`, 1, 0},
+		{FetchContentUrlsAction{}, `{"hash":"` + subject + `"}`, 1, 0},
+		{SearchReqAct{}, `{"query":"secret","page":1,"pageSize":10}`, 1, 0},
+		{MetadataByKeyRequest{}, `{"key":"member","page":1,"pageSize":10}`, 1, 0},
+		{MetadataHistoryAction{}, `{"subject":"` + subject + `"}`, 1, 0},
+	}
+	for i, c := range cases {
+		if got := count(exec(member, c.action, c.data)); got != c.member {
+			t.Errorf("case %d: %s expected %d results for members, got: %d", i, c.action.Type(), c.member, got)
+		}
+		if got := count(exec(stranger, c.action, c.data)); got != c.none {
+			t.Errorf("case %d: %s expected %d results for strangers, got: %d", i, c.action.Type(), c.none, got)
+		}
+		if got := count(exec(claimer, c.action, c.data)); got != c.none {
+			t.Errorf("case %d: %s expected %d results for unauthenticated clients, got: %d", i, c.action.Type(), c.none, got)
+		}
+	}
+
+	single := []struct {
+		action ClientAction
+		data   string
+	}{
+		{FetchUrlAct{}, `{"url":"` + secret + `"}`},
+		{FetchMetadataAction{}, `{"keyId":"member","subject":"` + subject + `"}`},
+		{LinkHistoryAction{}, `{"src":"` + public + `","dst":"` + secret + `"}`},
+		{SubjectSubscribeAction{}, `{"subject":"` + subject + `"}`},
+	}
+	for i, c := range single {
+		if res := exec(stranger, c.action, c.data); res.Code != notFoundErrCode {
+			t.Errorf("case %d: %s expected strangers to get not found, got: '%s' %s", i, c.action.Type(), res.Code, res.Error)
+		}
+	}
+	if res := exec(member, FetchUrlAct{}, `{"url":"`+secret+`"}`); res.Error != "" {
+		t.Errorf("expected members to fetch embargoed urls, got: %s", res.Error)
+	}
+
+	// events about embargoed content only go to members
+	allow, err := broadcastAllowed(appDB, subject, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if allow == nil || !allow(member) || allow(stranger) || allow(claimer) {
+		t.Errorf("expected embargoed events to only be broadcast to members")
+	}
+
+	// once the embargo passes the leader lifts it
+	later := time.Now().Add(2 * time.Hour)
+	liftEmbargoes(appDB, later)
+	var visibility string
+	if err := appDB.QueryRow("select meta::jsonb->>'visibility' from sources where id = $1", src).Scan(&visibility); err != nil {
+		t.Fatal(err.Error())
+	}
+	if visibility != visibilityPublic {
+		t.Errorf("expected lifted embargo to be public, got: '%s'", visibility)
+	}
+	if allow, err := broadcastAllowed(appDB, subject, later); err != nil || allow != nil {
+		t.Errorf("expected lifted embargo events to go to everyone")
+	}
+	if got := count(exec(stranger, FetchOutboundLinksAct{}, `{"url":"`+public+`"}`)); got != 1 {
+		t.Errorf("expected lifted embargo links to be public, got %d links", got)
+	}
+}
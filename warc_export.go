@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// urls read per page when exporting a subprimer or collection
+	exportPageSize = 500
+	// how many records between progress reports
+	exportProgressInterval = 100
+)
+
+// ExportReport summarizes a WARC export
+type ExportReport struct {
+	// response records written
+	Records int `json:"records"`
+	// captured urls whose content isn't stored locally, which are left out
+	Missing int `json:"missing"`
+	// bytes of content written, before compression
+	Bytes int64 `json:"bytes"`
+	// capture notes written, when they're included
+	Notes int `json:"notes,omitempty"`
+}
+
+// ExportWARC writes the latest capture of every url in a subprimer to w as a
+// gzipped WARC, a gzip member per record, which ImportWARC reads back. content
+// is read from contentDir under any of it's hash aliases, captures whose
+// content isn't stored there are counted as missing. capture notes are left out
+// unless notes is true, when each capture's notes follow it as a metadata record.
+// responses refer to a warcinfo record carrying the hash of the subprimer's
+// config snapshot, so the rules that governed the captures can be verified
+func ExportWARC(db *sql.DB, store datastore.Datastore, w io.Writer, sourceId, contentDir string, notes bool, progress func(ExportReport)) (*ExportReport, error) {
+	if contentDir == "" {
+		return nil, ErrNoBlockStore
+	}
+	s := &core.Source{Id: sourceId}
+	if err := s.Read(store); err != nil {
+		return nil, err
+	}
+	snap, err := SnapshotSource(db, s)
+	if err := checkWriteErr(err); err != nil {
+		return nil, err
+	}
+	members := func(after string, limit int) ([]string, error) {
+		return sourceMemberUrls(db, sourceId, after, limit)
+	}
+	snapshot := func(url string) (string, error) {
+		return snap.Hash, nil
+	}
+	return exportWARC(db, store, w, members, snapshot, contentDir, notes, progress)
+}
+
+// ExportCollectionWARC writes the latest capture of every url in a collection
+// to w, the same way ExportWARC does for subprimers. collections span
+// subprimers, so there's a warcinfo record for each subprimer's config snapshot
+func ExportCollectionWARC(db *sql.DB, store datastore.Datastore, w io.Writer, collectionId, contentDir string, notes bool, progress func(ExportReport)) (*ExportReport, error) {
+	if contentDir == "" {
+		return nil, ErrNoBlockStore
+	}
+	if _, err := readCollectionAccess(db, collectionId); err != nil {
+		return nil, err
+	}
+	members := func(after string, limit int) ([]string, error) {
+		return collectionMemberUrls(db, collectionId, after, limit)
+	}
+	snapshot := func(url string) (string, error) {
+		hash, err := snapshotForUrl(db, url)
+		return hash, checkWriteErr(err)
+	}
+	return exportWARC(db, store, w, members, snapshot, contentDir, notes, progress)
+}
+
+// exportWARC writes the latest capture of every url members lists. members
+// returns a page of urls after a cursor, in order. snapshot returns the hash
+// of the config snapshot governing a url, a warcinfo record is written for each
+// snapshot before the first response that refers to it
+func exportWARC(db *sql.DB, store datastore.Datastore, w io.Writer, members func(after string, limit int) ([]string, error), snapshot func(url string) (string, error), contentDir string, notes bool, progress func(ExportReport)) (*ExportReport, error) {
+	r := &ExportReport{}
+	cursor := ""
+	// warcinfo record ids, by snapshot hash
+	infos := map[string]string{}
+	created := time.Now()
+	for {
+		urls, err := members(cursor, exportPageSize)
+		if err != nil {
+			return r, err
+		}
+		for _, url := range urls {
+			cursor = url
+			u := &core.Url{Url: url}
+			if err := u.Read(store); err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return r, err
+			}
+			if u.Hash == "" || u.LastGet == nil || u.Status == 0 {
+				continue
+			}
+			f, err := replicas.open(db, contentDir, u.Hash)
+			if os.IsNotExist(err) {
+				r.Missing++
+				continue
+			} else if err != nil {
+				return r, err
+			}
+			info, err := exportWARCInfo(w, infos, snapshot, u.Url, created)
+			if err != nil {
+				f.Close()
+				return r, err
+			}
+			n, err := writeWARCResponse(w, u, f, info)
+			f.Close()
+			if err != nil {
+				return r, err
+			}
+			r.Records++
+			r.Bytes += n
+			if notes {
+				list, err := ReadCaptureNotes(db, u.Hash)
+				if err != nil {
+					return r, err
+				}
+				if len(list) > 0 {
+					if err := writeWARCNotes(w, u, list); err != nil {
+						return r, err
+					}
+					r.Notes += len(list)
+				}
+			}
+			if progress != nil && r.Records%exportProgressInterval == 0 {
+				progress(*r)
+			}
+		}
+		if len(urls) < exportPageSize {
+			return r, nil
+		}
+	}
+}
+
+// sourceMemberUrls lists a page of the urls a subprimer holds, in order
+func sourceMemberUrls(db *sql.DB, sourceId, after string, limit int) ([]string, error) {
+	rows, err := db.Query("select url from source_memberships where source_id = $1 and url > $2 order by url limit $3", sourceId, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := []string{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+// collectionMemberUrls lists a page of the urls a collection holds, in order
+func collectionMemberUrls(db *sql.DB, collectionId, after string, limit int) ([]string, error) {
+	rows, err := db.Query(`select urls.url from collection_items i join urls on urls.id = i.url_id
+		where i.collection_id = $1 and urls.url > $2 order by urls.url limit $3`, collectionId, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := []string{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+// exportWARCInfo returns the id of the warcinfo record for the config snapshot
+// governing url, writing the record if it hasn't been already. urls that no
+// subprimer governs have no warcinfo record
+func exportWARCInfo(w io.Writer, infos map[string]string, snapshot func(url string) (string, error), url string, created time.Time) (string, error) {
+	hash, err := snapshot(url)
+	if err != nil || hash == "" {
+		return "", err
+	}
+	if id, ok := infos[hash]; ok {
+		return id, nil
+	}
+	id := uuid.New()
+	if err := writeWARCInfo(w, id, hash, created); err != nil {
+		return "", err
+	}
+	infos[hash] = id
+	return id, nil
+}
+
+// openStoredContent opens content stored in dir under hash or any of it's
+// hash aliases. the error satisfies os.IsNotExist if it isn't stored
+func openStoredContent(db *sql.DB, dir, hash string) (*os.File, error) {
+	hashes, err := hashAliases(db, hash)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hashes {
+		f, err := os.Open(filepath.Join(dir, h))
+		if err == nil {
+			return f, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// writeWARCInfo writes a gzipped warcinfo record describing the export, with
+// the hash of the config snapshot that governed the captures that refer to it
+func writeWARCInfo(w io.Writer, id, snapshot string, created time.Time) error {
+	fields := fmt.Sprintf("software: patchbay\r\nformat: WARC File Format 1.0\r\nconfig-snapshot: %s\r\n", snapshot)
+	gz := gzip.NewWriter(w)
+	fmt.Fprintf(gz, "WARC/1.0\r\nWARC-Type: warcinfo\r\nWARC-Record-ID: <urn:uuid:%s>\r\nWARC-Date: %s\r\nContent-Type: application/warc-fields\r\nContent-Length: %d\r\n\r\n",
+		id, created.In(time.UTC).Format(time.RFC3339), len(fields))
+	if _, err := io.WriteString(gz, fields+"\r\n\r\n"); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// writeWARCResponse writes a url's latest capture as a gzipped WARC response
+// record, returning the length of the body written. stored bodies are decoded,
+// so headers describing the transfer encoding are replaced. responses refer to
+// the warcinfo record with id warcinfo, if it isn't empty
+func writeWARCResponse(w io.Writer, u *core.Url, body *os.File, warcinfo string) (int64, error) {
+	info, err := body.Stat()
+	if err != nil {
+		return 0, err
+	}
+	length := info.Size()
+
+	head := &bytes.Buffer{}
+	fmt.Fprintf(head, "HTTP/1.1 %d %s\r\n", u.Status, http.StatusText(u.Status))
+	for i := 0; i+1 < len(u.Headers); i += 2 {
+		switch http.CanonicalHeaderKey(u.Headers[i]) {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		fmt.Fprintf(head, "%s: %s\r\n", u.Headers[i], u.Headers[i+1])
+	}
+	fmt.Fprintf(head, "Content-Length: %d\r\n\r\n", length)
+
+	gz := gzip.NewWriter(w)
+	fmt.Fprintf(gz, "WARC/1.0\r\nWARC-Type: response\r\nWARC-Record-ID: <urn:uuid:%s>\r\nWARC-Date: %s\r\nWARC-Target-URI: %s\r\n",
+		uuid.New(), u.LastGet.In(time.UTC).Format(time.RFC3339), u.Url)
+	if warcinfo != "" {
+		fmt.Fprintf(gz, "WARC-Warcinfo-ID: <urn:uuid:%s>\r\n", warcinfo)
+	}
+	fmt.Fprintf(gz, "Content-Type: application/http; msgtype=response\r\nContent-Length: %d\r\n\r\n", int64(head.Len())+length)
+	if _, err := head.WriteTo(gz); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(gz, body)
+	if err != nil {
+		return n, err
+	}
+	if n != length {
+		return n, fmt.Errorf("content for %s changed while it was exported", u.Url)
+	}
+	if _, err := io.WriteString(gz, "\r\n\r\n"); err != nil {
+		return n, err
+	}
+	return n, gz.Close()
+}
+
+// writeWARCNotes writes the notes about a url's latest capture as a gzipped
+// WARC metadata record. ImportWARC skips metadata records, so notes aren't
+// imported
+func writeWARCNotes(w io.Writer, u *core.Url, notes []*CaptureNote) error {
+	body, err := json.Marshal(notes)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	fmt.Fprintf(gz, "WARC/1.0\r\nWARC-Type: metadata\r\nWARC-Record-ID: <urn:uuid:%s>\r\nWARC-Date: %s\r\nWARC-Target-URI: %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n",
+		uuid.New(), u.LastGet.In(time.UTC).Format(time.RFC3339), u.Url, len(body))
+	if _, err := gz.Write(body); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(gz, "\r\n\r\n"); err != nil {
+		return err
+	}
+	return gz.Close()
+}
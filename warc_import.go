@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// provenance recorded in url meta for imported captures
+	importedProvenance = "warc-import"
+	// html bodies larger than this are stored but not searched for links
+	maxImportLinkExtractSize = 10 << 20
+	// most per-record errors kept in an import report
+	maxImportErrors = 100
+	// how many records between progress reports
+	importProgressInterval = 100
+)
+
+// ErrImportsDisabled is returned when no directory is configured for imported content
+var ErrImportsDisabled = fmt.Errorf("WARC imports require a configured import content directory")
+
+// ImportOpts configures a WARC import
+type ImportOpts struct {
+	// directory record bodies are written to, named by hash
+	ContentDir string
+	// import records whose url doesn't fall under any subprimer, which are skipped by default
+	IncludeUnmatched bool
+	// called with a copy of the report as the import progresses
+	Progress func(ImportReport)
+}
+
+// ImportReport summarizes an import
+type ImportReport struct {
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// every WARC record read
+	Records int `json:"records"`
+	// response records stored as captures
+	Imported int `json:"imported"`
+	// records that aren't responses, or responses outside of all subprimers
+	Skipped int `json:"skipped"`
+	// responses that couldn't be imported
+	Failed int `json:"failed"`
+	// the first maxImportErrors record errors
+	Errors []*ImportRecordError `json:"errors"`
+	// an error that stopped the import, if any
+	Error string `json:"error,omitempty"`
+}
+
+// ImportRecordError is a failure to import a single record
+type ImportRecordError struct {
+	RecordId string `json:"recordId"`
+	Url      string `json:"url"`
+	Error    string `json:"error"`
+}
+
+func (r *ImportReport) recordError(recordId, url string, err error) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, &ImportRecordError{RecordId: recordId, Url: url, Error: err.Error()})
+	}
+}
+
+// ImportWARC reads captures from a WARC file (optionally gzipped) into the archive.
+// records are streamed, so memory use doesn't depend on the size of the input.
+// A record that can't be imported is noted in the report & the import carries on,
+// an unreadable WARC stream or entering maintenance mode ends the import
+func ImportWARC(db *sql.DB, store datastore.Datastore, r io.Reader, opts ImportOpts) (*ImportReport, error) {
+	report := &ImportReport{Started: time.Now().Round(time.Second).In(time.UTC), Errors: []*ImportRecordError{}}
+	if opts.ContentDir == "" {
+		return report, ErrImportsDisabled
+	}
+	if err := maintenance.Check(); err != nil {
+		return report, err
+	}
+
+	wr, err := newWARCReader(r)
+	if err != nil {
+		return report, err
+	}
+
+	for {
+		rec, err := wr.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return report, err
+		}
+		report.Records++
+
+		if rec.header.Get("WARC-Type") != "response" {
+			report.Skipped++
+		} else if err := importResponse(db, store, rec, opts); err == errImportSkipped {
+			report.Skipped++
+		} else if err == ErrMaintenanceMode {
+			return report, err
+		} else if err != nil {
+			report.recordError(rec.header.Get("WARC-Record-ID"), rec.header.Get("WARC-Target-URI"), err)
+		} else {
+			report.Imported++
+		}
+
+		if opts.Progress != nil && report.Records%importProgressInterval == 0 {
+			opts.Progress(*report)
+		}
+	}
+
+	finished := time.Now().Round(time.Second).In(time.UTC)
+	report.Finished = &finished
+	return report, nil
+}
+
+// errImportSkipped signals a response record that was deliberately left out
+var errImportSkipped = fmt.Errorf("skipped")
+
+// importResponse stores a response record as a capture of it's target url
+func importResponse(db *sql.DB, store datastore.Datastore, rec *warcRecord, opts ImportOpts) error {
+	captured, err := time.Parse(time.RFC3339, rec.header.Get("WARC-Date"))
+	if err != nil {
+		return fmt.Errorf("invalid WARC-Date: %s", err.Error())
+	}
+
+	rawurl, redacted, err := RedactArchivingUrl(rec.header.Get("WARC-Target-URI"))
+	if err != nil {
+		return err
+	}
+
+	if !opts.IncludeUnmatched {
+		s, err := matchSource(db, rawurl)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return errImportSkipped
+		}
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(rec.body), nil)
+	if err != nil {
+		return fmt.Errorf("invalid http response: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	u := &core.Url{Url: rawurl}
+	if err := u.Read(store); err != nil && err != ErrNotFound {
+		return err
+	}
+	markRedacted(u, redacted)
+
+	// sniff the start of the body, holding on to html for link extraction
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(res.Body, sniff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	sniff = sniff[:n]
+	contentSniff := http.DetectContentType(sniff)
+
+	body := io.MultiReader(bytes.NewReader(sniff), res.Body)
+	var html *capWriter
+	if contentSniff == "text/html; charset=utf-8" || contentSniff == "text/plain; charset=utf-8" {
+		html = &capWriter{max: maxImportLinkExtractSize}
+		body = io.TeeReader(body, html)
+	}
+
+	hash, length, err := storeImportedBody(opts.ContentDir, body)
+	if err != nil {
+		return err
+	}
+	auditCaptureWrite(db, opts.ContentDir, hash, length)
+
+	// a url keeps the details of it's latest capture, older captures
+	// only add a snapshot
+	latest := u.LastGet == nil || captured.After(*u.LastGet)
+	if latest {
+		u.Status = res.StatusCode
+		u.ContentType = res.Header.Get("Content-Type")
+		u.ContentSniff = contentSniff
+		u.ContentLength = length
+		u.Headers = headersSlice(res.Header)
+		u.Hash = hash
+		u.LastGet = &captured
+		if u.Meta == nil {
+			u.Meta = map[string]interface{}{}
+		}
+		u.Meta["provenance"] = importedProvenance
+		u.Meta["warcRecordId"] = rec.header.Get("WARC-Record-ID")
+	}
+
+	var doc *goquery.Document
+	if html != nil && !html.overflowed {
+		if doc, err = goquery.NewDocumentFromReader(&html.buf); err != nil {
+			return err
+		}
+		if latest {
+			u.Title = doc.Find("title").Text()
+		}
+	}
+
+	if err := checkWriteErr(u.Save(store)); err != nil {
+		return err
+	}
+
+	// snapshots are written from the url, so describe this capture
+	capture := *u
+	capture.Status = res.StatusCode
+	capture.Headers = headersSlice(res.Header)
+	capture.Hash = hash
+	capture.LastGet = &captured
+	if err := checkWriteErr(core.WriteSnapshot(store, &capture)); err != nil {
+		return err
+	}
+
+	if doc != nil {
+		if _, err := u.ExtractDocLinks(store, doc); err != nil {
+			return checkWriteErr(err)
+		}
+		found := map[string]string{}
+		if base, err := u.ParsedUrl(); err == nil {
+			for _, dst := range docLinkUrls(base, doc) {
+				found[dst] = "html"
+			}
+			// older captures don't replace the anchors of the latest one
+			if latest {
+				if err := saveLinkAnchors(db, u.Url, docLinkAnchors(base, doc)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := recordLinkSightings(db, u.Url, hash, captured, found); err != nil {
+			return checkWriteErr(err)
+		}
+	}
+	return nil
+}
+
+// storeImportedBody writes a body to dir named by it's multihash, returning
+// the hash & length. bodies already stored aren't written twice
+func storeImportedBody(dir string, body io.Reader) (string, int64, error) {
+	f, err := ioutil.TempFile(dir, ".import-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name())
+
+	h, err := newContentHasher(contentHashAlgorithm)
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	length, err := io.Copy(io.MultiWriter(f, h), body)
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+
+	hash, err := h.Multihash()
+	if err != nil {
+		return "", 0, err
+	}
+
+	path := filepath.Join(dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, length, nil
+	}
+	return hash, length, os.Rename(f.Name(), path)
+}
+
+// headersSlice formats headers in the form [key,value,key,value...], same as crawled urls
+func headersSlice(h http.Header) (headers []string) {
+	for key, val := range h {
+		headers = append(headers, key, strings.Join(val, ","))
+	}
+	return
+}
+
+// capWriter buffers up to max bytes, noting if more were written
+type capWriter struct {
+	buf        bytes.Buffer
+	max        int
+	overflowed bool
+}
+
+func (w *capWriter) Write(p []byte) (int, error) {
+	if !w.overflowed {
+		if w.buf.Len()+len(p) > w.max {
+			w.overflowed = true
+			w.buf.Reset()
+		} else {
+			w.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// warcRecord is a single record read from a WARC file. body must be read
+// before the next record is read
+type warcRecord struct {
+	header textproto.MIMEHeader
+	body   io.Reader
+}
+
+// warcReader streams records from a WARC file. Records are read using their
+// Content-Length, so bodies are never held in memory
+type warcReader struct {
+	r    *textproto.Reader
+	body *io.LimitedReader
+}
+
+// newWARCReader creates a reader, decompressing gzipped input. gzipped WARCs
+// are a gzip member per record, which gzip.Reader reads as one stream
+func newWARCReader(r io.Reader) (*warcReader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gz)
+	}
+	return &warcReader{r: textproto.NewReader(br)}, nil
+}
+
+// next reads the next record, discarding any unread body of the previous one.
+// returns io.EOF when there are no more records
+func (w *warcReader) next() (*warcRecord, error) {
+	if w.body != nil {
+		if _, err := io.Copy(ioutil.Discard, w.body); err != nil {
+			return nil, err
+		}
+		w.body = nil
+	}
+
+	// records are separated by blank lines
+	var version string
+	for {
+		line, err := w.r.ReadLine()
+		if err == io.EOF && line == "" {
+			return nil, io.EOF
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if version = strings.TrimSpace(line); version != "" {
+			break
+		}
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("invalid WARC record: expected version line, got: %.40q", version)
+	}
+
+	header, err := w.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("invalid WARC record headers: %s", err.Error())
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid WARC record Content-Length: %q", header.Get("Content-Length"))
+	}
+
+	w.body = &io.LimitedReader{R: w.r.R, N: length}
+	return &warcRecord{header: header, body: w.body}, nil
+}
+
+// importJob is a WARC import started from the admin endpoint
+type importJob struct {
+	sync.Mutex
+	id     string
+	report ImportReport
+	done   bool
+}
+
+// warcImports tracks imports started from the admin endpoint, for progress reporting
+var warcImports = struct {
+	sync.Mutex
+	jobs map[string]*importJob
+}{jobs: map[string]*importJob{}}
+
+func (j *importJob) update(r ImportReport) {
+	j.Lock()
+	j.report = r
+	j.Unlock()
+}
+
+func (j *importJob) status() map[string]interface{} {
+	j.Lock()
+	defer j.Unlock()
+	return map[string]interface{}{"id": j.id, "done": j.done, "report": j.report}
+}
+
+// ImportWARCHandler accepts WARC uploads (POST, as the request body or a
+// multipart "file" field) & reports import progress (GET ?id=)
+func ImportWARCHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminConfigured(w) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		warcImports.Lock()
+		j := warcImports.jobs[r.URL.Query().Get("id")]
+		warcImports.Unlock()
+		if j == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "import not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, j.status())
+	case "POST":
+		if cfg.ImportContentDir == "" {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": ErrImportsDisabled.Error()})
+			return
+		}
+		if maintenance.Check() != nil {
+			writeMaintenanceError(w)
+			return
+		}
+		j, err := startWARCImport(r)
+		if err != nil {
+			log.Info(err.Error())
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, j.status())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// startWARCImport spools an upload to disk & imports it in the background.
+// uploads can be far larger than memory, & spooling lets the request finish
+// before the import does
+func startWARCImport(r *http.Request) (*importJob, error) {
+	var upload io.Reader = r.Body
+	if mr, err := r.MultipartReader(); err == nil {
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return nil, fmt.Errorf("multipart upload requires a 'file' field")
+			}
+			if part.FormName() == "file" {
+				upload = part
+				break
+			}
+		}
+	}
+
+	f, err := ioutil.TempFile(cfg.ImportContentDir, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, upload); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	j := &importJob{id: uuid.New()}
+	warcImports.Lock()
+	warcImports.jobs[j.id] = j
+	warcImports.Unlock()
+
+	opts := ImportOpts{
+		ContentDir:       cfg.ImportContentDir,
+		IncludeUnmatched: r.URL.Query().Get("includeUnmatched") == "true",
+		Progress:         j.update,
+	}
+
+	go func() {
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		report, err := ImportWARC(appDB, store, f, opts)
+		if err != nil {
+			log.Infof("WARC import %s: %s", j.id, err.Error())
+			report.Error = err.Error()
+		}
+		j.Lock()
+		j.report = *report
+		j.done = true
+		j.Unlock()
+	}()
+
+	return j, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/datatogether/core"
+)
+
+// testWARCRecord formats a WARC record with a content block
+func testWARCRecord(warcType, uri, date, block string) string {
+	return fmt.Sprintf("WARC/1.0\r\nWARC-Type: %s\r\nWARC-Record-ID: <urn:uuid:%s>\r\nWARC-Target-URI: %s\r\nWARC-Date: %s\r\nContent-Length: %d\r\n\r\n%s\r\n\r\n",
+		warcType, uri, uri, date, len(block), block)
+}
+
+var testWARCResponse = "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n<html><head><title>EPA</title></head><body>\r\n\r\n<a href=\"/air\">air</a></body></html>"
+
+func testWARC() string {
+	return testWARCRecord("warcinfo", "", "2017-01-01T00:00:00Z", "software: test\r\n") +
+		testWARCRecord("request", "http://www.epa.gov/", "2017-01-01T00:00:01Z", "GET / HTTP/1.1\r\nHost: www.epa.gov\r\n\r\n") +
+		testWARCRecord("response", "http://www.epa.gov/", "2017-01-01T00:00:01Z", testWARCResponse)
+}
+
+func TestWARCReader(t *testing.T) {
+	gz := &bytes.Buffer{}
+	// gzipped WARCs compress each record separately
+	for _, rec := range []string{testWARCRecord("warcinfo", "", "2017-01-01T00:00:00Z", "software: test\r\n"), testWARCRecord("response", "http://www.epa.gov/", "2017-01-01T00:00:01Z", testWARCResponse)} {
+		w := gzip.NewWriter(gz)
+		w.Write([]byte(rec))
+		w.Close()
+	}
+
+	cases := []struct {
+		input  io.Reader
+		types  []string
+		bodies map[int]string
+	}{
+		{bytes.NewBufferString(testWARC()), []string{"warcinfo", "request", "response"}, map[int]string{2: testWARCResponse}},
+		{gz, []string{"warcinfo", "response"}, map[int]string{1: testWARCResponse}},
+		{bytes.NewBufferString(""), []string{}, nil},
+	}
+
+	for i, c := range cases {
+		r, err := newWARCReader(c.input)
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err.Error())
+			continue
+		}
+
+		types := []string{}
+		for {
+			rec, err := r.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("case %d unexpected error: %s", i, err.Error())
+				break
+			}
+			if body, ok := c.bodies[len(types)]; ok {
+				data, _ := ioutil.ReadAll(rec.body)
+				if string(data) != body {
+					t.Errorf("case %d record %d body mismatch: %q", i, len(types), string(data))
+				}
+			}
+			types = append(types, rec.header.Get("WARC-Type"))
+		}
+
+		if fmt.Sprint(types) != fmt.Sprint(c.types) {
+			t.Errorf("case %d record types mismatch. expected: %v, got: %v", i, c.types, types)
+		}
+	}
+}
+
+func TestWARCReaderInvalid(t *testing.T) {
+	cases := []string{
+		"HTTP/1.1 200 OK\r\n\r\n",
+		"WARC/1.0\r\nWARC-Type: response\r\nContent-Length: nope\r\n\r\n",
+	}
+	for i, c := range cases {
+		r, err := newWARCReader(bytes.NewBufferString(c))
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err.Error())
+			continue
+		}
+		if _, err := r.next(); err == nil || err == io.EOF {
+			t.Errorf("case %d expected error, got: %v", i, err)
+		}
+	}
+}
+
+func TestCapWriter(t *testing.T) {
+	w := &capWriter{max: 5}
+	w.Write([]byte("abc"))
+	if w.overflowed || w.buf.String() != "abc" {
+		t.Errorf("expected writes under max to be buffered")
+	}
+	if n, _ := w.Write([]byte("def")); n != 3 {
+		t.Errorf("expected writes past max to report full length, got %d", n)
+	}
+	if !w.overflowed || w.buf.Len() != 0 {
+		t.Errorf("expected writes past max to overflow & drop the buffer")
+	}
+}
+
+func TestStoreImportedBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patchbay_import")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	expect, _ := hashContent([]byte(testWARCResponse))
+	for i := 0; i < 2; i++ {
+		hash, length, err := storeImportedBody(dir, bytes.NewBufferString(testWARCResponse))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if hash != expect {
+			t.Errorf("hash mismatch. expected: %s, got: %s", expect, hash)
+		}
+		if length != int64(len(testWARCResponse)) {
+			t.Errorf("length mismatch. expected: %d, got: %d", len(testWARCResponse), length)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	hidden, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(files) != 1 || len(hidden) != 0 {
+		t.Errorf("expected one stored body & no leftover temp files, got: %v %v", files, hidden)
+	}
+}
+
+func TestImportWARC(t *testing.T) {
+	defer resetTestData(appDB, "urls", "links", "snapshots")
+
+	dir, err := ioutil.TempDir("", "patchbay_import")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	warc := testWARC() + testWARCRecord("response", "http://www.epa.gov/", "2017-01-01T00:00:02Z", "not http")
+	report, err := ImportWARC(appDB, store, bytes.NewBufferString(warc), ImportOpts{ContentDir: dir, IncludeUnmatched: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Records != 4 || report.Imported != 1 || report.Skipped != 2 || report.Failed != 1 {
+		t.Errorf("unexpected report: %#v", report)
+	}
+
+	u := &core.Url{Url: "http://www.epa.gov/"}
+	if err := u.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if u.Meta["provenance"] != importedProvenance {
+		t.Errorf("expected url to be flagged as imported")
+	}
+	if u.Title != "EPA" {
+		t.Errorf("expected title to be read from capture, got: %s", u.Title)
+	}
+
+	snapshots, err := core.SnapshotsForUrl(appDB, u.Url)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(snapshots) == 0 || snapshots[0].Hash != u.Hash {
+		t.Errorf("expected a snapshot of the imported capture")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// outboxWebhook is the outbox destination for webhooks. deliveries target
+	// the webhook's url
+	outboxWebhook = "webhook"
+	// outboxAlert is the outbox destination for alerts sent to the webhook
+	// admins configure, which can be an internal address
+	outboxAlert = "alert"
+	// how long a webhook has to respond
+	webhookTimeout = 10 * time.Second
+)
+
+// webhooks delivers outbox webhooks, refusing internal addresses
+var webhooks = newWebhookClient(false)
+
+func init() {
+	registerOutboxDestination(outboxWebhook, webhookSender(webhooks))
+	registerOutboxDestination(outboxAlert, webhookSender(newWebhookClient(true)))
+}
+
+// newWebhookClient creates a client that connects to webhooks through the
+// internal address guard, see egress.dial. the guard checks every address
+// dialed, redirects included. allowInternal turns it off
+func newWebhookClient(allowInternal bool) *http.Client {
+	e := newEgress(egressDirect, nil, allowInternal)
+	return &http.Client{Transport: e.client.Transport, Timeout: webhookTimeout}
+}
+
+// webhookSender delivers outbox deliveries to webhooks with client
+func webhookSender(client *http.Client) func(d *OutboxDelivery) error {
+	return func(d *OutboxDelivery) error {
+		return postWebhookData(client, d.Target, outboxKey(d), d.Payload)
+	}
+}
+
+// validWebhookUrl checks a webhook is an http url that doesn't resolve to an
+// internal address, unless allowInternal is set. deliveries are guarded too,
+// as a host can resolve to something else by the time it's called
+func validWebhookUrl(rawurl string, allowInternal bool) error {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url: %s", rawurl)
+	}
+	if allowInternal {
+		return nil
+	}
+	return checkTarget(u)
+}
+
+// postWebhookData POST's json to a webhook. a non-empty idempotency key is sent
+// as the Idempotency-Key header, for webhooks to recognize repeat deliveries.
+// webhooks that don't respond with a 2xx status haven't accepted the delivery
+func postWebhookData(client *http.Client, url, idempotencyKey string, data []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookClientGuard(t *testing.T) {
+	delivered := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered++
+	}))
+	defer hook.Close()
+
+	// the test webhook serves from a loopback address, which is internal
+	if err := postWebhookData(newWebhookClient(false), hook.URL, "", []byte(`{}`)); err == nil || !strings.Contains(err.Error(), ErrForbiddenTarget.Error()) {
+		t.Errorf("expected delivery to an internal address to be refused, got: %v", err)
+	}
+	if err := postWebhookData(newWebhookClient(true), hook.URL, "", []byte(`{}`)); err != nil {
+		t.Errorf("expected delivery to be allowed, got: %s", err.Error())
+	}
+	if delivered != 1 {
+		t.Errorf("expected 1 delivery, got: %d", delivered)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+// Wire names
+//
+// Every struct sent to or read from clients pins it's field names with json
+// tags, so renaming a go field can't change the wire format. Names are
+// lowerCamelCase, with ids & initialisms written as words: "keyId", "requestId",
+// "url", "pageSize". Fields the frontend reads from core types that don't
+// follow this are re-emitted by a local wrapper (see linkDetail), & the old
+// name is listed in deprecatedFields.
+//
+// Renaming a wire field means sending both names for one protocol version,
+// listing the old one in deprecatedFields & removing it at RemovedIn. The
+// golden files in testdata/wire lock the current format, & are rewritten
+// with: go test -run TestWireFormat -update
+
+// FieldDeprecation describes a field that's sent under both an old & a new
+// name while clients move to the new one
+type FieldDeprecation struct {
+	// schema of the object the field appears in, arrays use their element's schema
+	Schema string `json:"schema"`
+	// old name, still sent until RemovedIn
+	Field string `json:"field"`
+	// canonical name clients should read instead
+	Replacement string `json:"replacement"`
+	// first protocol version the replacement is sent in
+	Since int `json:"since"`
+	// first protocol version the old name isn't sent in
+	RemovedIn int `json:"removedIn"`
+}
+
+// deprecatedFields are reported in SERVER_INFO, so clients can be checked
+// against them. LINK.Hash was removed in protocol version 4
+var deprecatedFields = []*FieldDeprecation{}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata/wire")
+
+// TestWireFormat checks wire types serialize exactly as their golden file in
+// testdata/wire. A failure here means a change to what clients receive, see wire.go
+func TestWireFormat(t *testing.T) {
+	at := time.Date(2017, 1, 1, 0, 0, 1, 0, time.UTC)
+	age := int64(60)
+	src, dst := &core.Url{Url: "http://www.epa.gov"}, &core.Url{Url: "http://www.epa.gov/data", Status: 200, LastGet: &at}
+	link := &core.Link{Hash: "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a", Created: at, Updated: at, Src: src, Dst: dst}
+
+	cases := []struct {
+		name  string
+		value interface{}
+	}{
+		{"client_response", &ClientResponse{
+			Type:      "URL_FETCH_SUCCESS",
+			RequestId: "1",
+			Schema:    "URL",
+			Page:      1,
+			PageSize:  50,
+			Id:        "archive_request.1",
+			Data:      map[string]interface{}{"url": "http://www.epa.gov"},
+			Token:     "1220...",
+			MaxAge:    30,
+		}},
+		{"client_response_error", &ClientResponse{
+			Type:        "ARCHIVE_LINK_FAILURE",
+			RequestId:   "1",
+			Error:       ErrLinkQuarantined.Error(),
+			Code:        quarantinedErrCode,
+			SilentError: true,
+		}},
+		{"client_response_not_found", notFoundResponse(&FetchUrlAct{}, "1", "url", "http://www.epa.gov")},
+		{"metadata", &core.Metadata{
+			Hash:      "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+			Timestamp: at,
+			KeyId:     "key",
+			Subject:   "1220af06510193276b5fd9ad2fc55dcc004ada557d9259ca3505478bfef0b12ed988",
+			Meta:      map[string]interface{}{"title": "EPA"},
+		}},
+		{"metadata_detail", &metadataDetail{
+			Metadata: &core.Metadata{
+				Hash:      "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+				Timestamp: at,
+				KeyId:     "key",
+				Subject:   "1220af06510193276b5fd9ad2fc55dcc004ada557d9259ca3505478bfef0b12ed988",
+				Meta:      map[string]interface{}{"title": "EPA"},
+			},
+			Verification: badgeVerified,
+		}},
+		{"link", newLinkDetails([]*core.Link{link}, at.Add(time.Duration(age)*time.Second))[0]},
+		{"server_info", &ServerInfo{
+			Version:         "v1.0.0",
+			Commit:          "8fc6f99",
+			BuildTime:       "2017-01-01T00:00:01Z",
+			SchemaVersion:   2,
+			ProtocolVersion: 2,
+			Leader:          &LeaderStatus{Instance: "host-1", Leading: true, Leader: "host-1", Since: &at},
+			Deprecations:    deprecatedFields,
+			Paginated:       paginatedActions,
+			Locales:         []string{"en", "es"},
+		}},
+		{"page", newPage(&pageRequest{PageSize: 1, offset: 1}, newLinkDetails([]*core.Link{link, link}, at.Add(time.Duration(age)*time.Second)))},
+		{"page_last", slicePage(&pageRequest{PageSize: 2, offset: 1}, newLinkDetails([]*core.Link{link, link}, at.Add(time.Duration(age)*time.Second)))},
+		{"event", &Event{Type: EventMetadataAdded, Subject: "1220...", Origin: "host-1", Version: "v1.0.0", Data: map[string]interface{}{"keyId": "key"}}},
+		{"editor", &Editor{EditorId: "editor", Name: "Alice", Started: at, LastSeen: at}},
+		{"meta_field", &MetaField{Key: "format", Label: "Format", Input: "select", Help: "file format", Options: []string{"csv", "json"}}},
+		{"relation", &Relation{Subject: "1220...", Relation: "supersedes", Target: "1220...", KeyId: "key", Hash: "1220...", Created: at}},
+		{"moderation_case", &ModerationCase{Id: "case", Created: at, Updated: at, Subject: "1220...", Status: "open", ReportCount: 1}},
+		{"maintenance_status", &MaintenanceStatus{Reason: "upgrade", Started: at, Until: at}},
+		{"saved_search", &SavedSearch{Id: "search", Created: at, Updated: at, Owner: "key", Name: "sea level", SourceId: "noaa", Tag: "climate", Query: "sea level", Webhook: "https://example.com/hook", Active: true}},
+		{"archive_summary", &core.Metadata{
+			Hash:      "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+			Timestamp: at,
+			KeyId:     "system",
+			Subject:   "1220af06510193276b5fd9ad2fc55dcc004ada557d9259ca3505478bfef0b12ed988",
+			Meta: map[string]interface{}{archiveSummaryKey: &ArchiveSummary{
+				Url:           "http://www.epa.gov",
+				ContentHash:   "1220af06510193276b5fd9ad2fc55dcc004ada557d9259ca3505478bfef0b12ed988",
+				ContentLength: 1024,
+				ContentType:   "text/html",
+				Status:        200,
+				Links:         12,
+				LinksFetched:  10,
+				Manifest:      "1220...",
+			}},
+		}},
+		{"saved_search_match", &SavedSearchMatch{SearchId: "search", Url: "http://www.noaa.gov/sea-level", Subject: "1220...", Created: at}},
+		{"url_content", &UrlContent{Url: "http://www.epa.gov", Hash: "1220...", Prev: "1220..."}},
+		{"bandwidth_status", &BandwidthStatus{State: bandwidthThrottled, Month: "2017-01", Crawled: 800, Served: 10, CrawlCap: 1000}},
+		{"hash_alias", &HashAlias{Old: "1220...", New: "a0e40220..."}},
+		{"link_anchor", &linkDetail{
+			Hash:       "1220...",
+			Created:    at,
+			Updated:    at,
+			Src:        &core.Url{Url: "http://www.epa.gov"},
+			Dst:        &core.Url{Url: "http://www.epa.gov/report.pdf"},
+			Health:     &LinkHealth{},
+			AnchorText: "final report",
+			Rel:        "nofollow",
+		}},
+		{"server_request", &ServerRequest{
+			ServerRequestId: "5b1031f4-38a8-40b3-be91-c324bf686a87",
+			Type:            "TOKEN_REFRESH_REQUIRED",
+			Data:            map[string]interface{}{"sessionExpires": at},
+			ReplyExpected:   true,
+		}},
+		{"collection", &collectionDetail{
+			Collection: &core.Collection{
+				Id:          "5b1031f4-38a8-40b3-be91-c324bf686a87",
+				Created:     at,
+				Updated:     at,
+				Creator:     "key",
+				Title:       "2024 hurricane response",
+				Description: "pages about hurricane response",
+			},
+			Visibility: collectionPrivate,
+		}},
+		{"collection_change", &CollectionChange{
+			CollectionId: "5b1031f4-38a8-40b3-be91-c324bf686a87",
+			Change:       collectionAdded,
+			Urls:         []string{"http://www.epa.gov/hurricanes"},
+			KeyId:        "key",
+		}},
+		{"server_reply", &ServerReply{
+			ServerRequestId: "5b1031f4-38a8-40b3-be91-c324bf686a87",
+			Data:            json.RawMessage(`{"sessionExpires":"2017-01-01T01:00:01Z"}`),
+		}},
+		{"chain_health_run", &ChainHealthRun{
+			Id:           "5b1031f4-38a8-40b3-be91-c324bf686a87",
+			Created:      at,
+			Seed:         1483228800,
+			SampleSize:   200,
+			Sampled:      4,
+			Healthy:      1,
+			Broken:       1,
+			Forked:       1,
+			Unverifiable: 1,
+			Causes:       map[string]int{causeHashMismatch: 1, causeFork: 1, causeDeleted: 1},
+			Examples: map[string][]string{
+				causeHashMismatch: {"1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a"},
+			},
+		}},
+		{"subscription_filter", &SubscriptionFilter{
+			Types:       []string{"URL_SET_ERROR", "CONTENT_SUPPRESSED"},
+			MinSeverity: "warning",
+			ExcludeOwn:  true,
+		}},
+		{"subprimer_plan", &SubprimerPlan{
+			SourceId:        "5b1031f4-38a8-40b3-be91-c324bf686a87",
+			Interval:        604800,
+			Urls:            2,
+			Captured:        2,
+			Requests:        6,
+			Bytes:           6144,
+			WallClock:       18,
+			MonthlyRequests: 25,
+			MonthlyBytes:    26331,
+			Overlaps: []*PlanOverlap{
+				{SourceId: "d8d4d8c4-7f65-4d0b-b8a4-2b0e4e8f8a1b", Title: "EPA", SharedUrls: 1, Interval: 43200},
+			},
+			Utilization:           0.00003,
+			ScheduledMonthlyBytes: 26331,
+			Assumptions: &PlanAssumptions{
+				AvgPageBytes:      1024,
+				LinksPerPage:      2,
+				HtmlShare:         1,
+				AvgFetchMillis:    1000,
+				FollowDelayMillis: 3000,
+				Notes:             []string{"archiving waits 3000ms before following each link"},
+			},
+		}},
+		{"dashboard", &Dashboard{
+			Version:      dashboardVersion,
+			Personalized: true,
+			Sections: map[string]*DashboardSection{
+				dashboardPopularUrls: {Data: []*PopularUrl{{Url: "http://www.epa.gov", Title: "EPA", Hash: link.Hash, Requests: 3}}, Truncated: true},
+				dashboardStats:       {Data: &DashboardStats{Urls: 120, Captured: 80, Sources: 4, CapturedToday: 12, Counted: at}},
+				dashboardArchives:    {Data: []*DashboardArchiveRequest{{Id: 1, Created: at, Url: "http://www.epa.gov/data", Status: 200, Captured: &at, Hash: link.Hash}}},
+				dashboardAnnouncements: {Data: []*Announcement{
+					{Kind: "maintenance", Message: maintenanceReasonScheduled, Until: &at},
+					{Kind: "notice", Message: "new subprimers for NOAA"},
+				}},
+				dashboardWatchlist: {Error: ErrSavedSearchesDisabled.Error()},
+			},
+		}},
+		{"render_card", &RenderCard{
+			Url:        "http://www.epa.gov/climatechange",
+			Hash:       "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+			Created:    at,
+			Heading:    "Climate Change",
+			Paragraph:  "Climate change is happening.",
+			ThemeColor: "#0071bc",
+			Favicon: &RenderFavicon{
+				Hash:        "1220c4a1e5a5d0e3a4b8cbd1e0fb0bd9d3a9d7c0f8a6e2e1b5a7c3d9e8f0a1b2c3d4",
+				Url:         "http://www.epa.gov/favicon.ico",
+				ContentType: "image/x-icon",
+				Size:        1150,
+			},
+		}},
+		{"user_export", &UserExport{
+			Id:      "0b8f3c1e-4d2a-4f6b-9a7e-1c2d3e4f5a6b",
+			Created: at,
+			UserId:  "key",
+			Status:  userExportReady,
+			Hash:    "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+			Size:    2048,
+			Expires: &at,
+		}},
+		{"room_announcement", &RoomAnnouncement{
+			Id:       "6f1d2c3b-4a5e-4f60-8b7c-9d0e1f2a3b4c",
+			Created:  at,
+			Updated:  at,
+			Message:  "down for maintenance at 5pm",
+			Severity: "warning",
+			Starts:   at,
+			Ends:     &at,
+			Room:     "subject:1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+		}},
+		{"api_key_scope", &ApiKeyScope{
+			Id:         "7a2e3d4c-5b6f-4071-8c8d-0e1f2a3b4c5d",
+			Scopes:     []string{apiScopeRead, apiScopeArchive},
+			Subprimers: []string{"5b4e3d6c-7f80-4192-a314-c5d6e7f8091a"},
+		}},
+		{"capture_note", &CaptureNote{
+			Id:      "2c9e4f1a-7b3d-4e5f-8a6b-0c1d2e3f4a5b",
+			Created: at,
+			Capture: "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+			Author:  "key",
+			Text:    "this fetch got a cookie banner",
+		}},
+		{"guardrail_status", &GuardrailStatus{
+			Shedding:      shedLevels[shedArchives],
+			Pressure:      92,
+			Load:          &LoadSample{Goroutines: 9200, HeapBytes: 512 << 20, Queued: 1200},
+			MaxGoroutines: 10000,
+			MaxQueued:     20000,
+			Since:         at,
+		}},
+		{"user_activity", &UserActivityDetail{
+			UserActivity: &UserActivity{
+				UserId:          "key",
+				Archives:        40,
+				MetadataWrites:  3,
+				RateLimited:     1,
+				DailySubprimers: 12,
+				ReportCases:     2,
+				LastActive:      at,
+				Flags:           []string{userFlagSubprimerSpread},
+			},
+			Recent: []*UserAction{
+				{Created: at, UserId: "key", Action: userActionArchive, Subprimer: "5b4e3d6c-7f80-4192-a314-c5d6e7f8091a", Target: "http://www.epa.gov"},
+				{Created: at, UserId: "key", Action: userActionRateLimited, Target: "link_archives"},
+			},
+		}},
+		{"outbox_delivery", &OutboxDelivery{
+			Id:          7,
+			Created:     at,
+			Destination: outboxWebhook,
+			Target:      "https://example.com/hook",
+			Payload:     json.RawMessage(`{"match":{"url":"http://www.epa.gov"}}`),
+			Attempts:    outboxMaxAttempts,
+			NextAttempt: at,
+			Status:      outboxDead,
+			LastError:   "webhook responded 500",
+		}},
+		{"capture_listing", &captureListing{
+			Url:   &core.Url{Url: "http://www.epa.gov", Hash: "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a"},
+			Notes: 2,
+		}},
+		{"client_latency", &ClientLatency{RttMs: 3200, Samples: 40, PongWaitMs: 96000, PingPeriodMs: 86400}},
+		{"custody_report", &Report{
+			Hash:        "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+			CurrentHash: "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+			Aliases:     []string{"1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a"},
+			Generated:   at,
+			Urls:        []string{"http://www.epa.gov"},
+			Entries: []*CustodyEntry{{
+				Kind:       custodyRequest,
+				At:         at,
+				Summary:    "http://www.epa.gov requested by key",
+				Source:     "archive_requests/12",
+				Record:     json.RawMessage(`{"id":12,"url":"http://www.epa.gov","user_id":"key"}`),
+				RecordHash: "5f1d2c3b4a59687766554433221100ffeeddccbbaa99887766554433221100ff",
+			}},
+			Gaps:      []*CustodyGap{{Kind: custodyReplication, Note: "replication & pin confirmations aren't recorded by this server"}},
+			Signature: "MEUCIQ==",
+			PublicKey: "MFkwEw==",
+		}},
+		{"metadata_key_rename_plan", &MetaKeyRenamePlan{
+			SourceId:  "5b1031f4-38a8-40b3-be91-c324bf686a87",
+			KeyId:     "a1b2c3",
+			From:      "agency_name",
+			To:        "publisher",
+			Renames:   []*MetaKeyChange{{Subject: "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a", Value: "EPA"}},
+			Merges:    []*MetaKeyChange{},
+			Conflicts: []*MetaKeyChange{{Subject: "1220c0ffee00000000000000000000000000000000000000000000000000000000ee", Value: "EPA", Existing: "NOAA"}},
+			Hash:      "9c56cc51b374c3ba189210d5b6d4bf57790d351c96c47c02190ecf1e430635ab",
+		}},
+		{"metadata_key_rename_job", &MetaKeyRenameJob{
+			Id:        "4f3e2d1c-0b9a-4876-9543-210fedcba987",
+			Created:   at,
+			Updated:   at,
+			SourceId:  "5b1031f4-38a8-40b3-be91-c324bf686a87",
+			KeyId:     "a1b2c3",
+			From:      "agency_name",
+			To:        "publisher",
+			Plan:      "9c56cc51b374c3ba189210d5b6d4bf57790d351c96c47c02190ecf1e430635ab",
+			Status:    jobRunning,
+			Cursor:    "1220b499c5e883f2a3d47fe96c51779d05d5758c53c24caabc447db137b220c1688a",
+			Checked:   100,
+			Renamed:   97,
+			Merged:    2,
+			Conflicts: metaKeyChanges{{Subject: "1220c0ffee00000000000000000000000000000000000000000000000000000000ee", Value: "EPA", Existing: "NOAA"}},
+		}},
+		{"limit_status", &LimitStatus{Name: limitTrialArchives, Scope: limitScopeRequester, Budget: 3, WindowSeconds: 86400, Applies: true, Keys: 12, Used: 20, MostUsed: 3, Exhausted: 2}},
+	}
+
+	for _, c := range cases {
+		got, err := json.MarshalIndent(c.value, "", "  ")
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err.Error())
+			continue
+		}
+		got = append(got, '\n')
+
+		path := filepath.Join("testdata/wire", c.name+".json")
+		if *updateGolden {
+			if err := ioutil.WriteFile(path, got, 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			continue
+		}
+		expect, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err.Error())
+			continue
+		}
+		if !bytes.Equal(got, expect) {
+			t.Errorf("%s wire format mismatch. expected:\n%s\ngot:\n%s", c.name, expect, got)
+		}
+	}
+}
+
+func TestDeprecatedFieldsSent(t *testing.T) {
+	// deprecated names must be sent alongside their replacement until they're removed
+	at := time.Date(2017, 1, 1, 0, 0, 1, 0, time.UTC)
+	link := &core.Link{Hash: "1220...", Created: at, Updated: at, Src: &core.Url{Url: "http://www.epa.gov"}, Dst: &core.Url{Url: "http://www.epa.gov/data"}}
+	data, err := json.Marshal(newLinkDetails([]*core.Link{link}, at)[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, d := range deprecatedFields {
+		if d.Schema != "LINK" {
+			continue
+		}
+		if protocolVersion >= d.RemovedIn {
+			t.Errorf("%s.%s should have been removed in protocol version %d", d.Schema, d.Field, d.RemovedIn)
+		}
+		if fields[d.Field] != fields[d.Replacement] || fields[d.Replacement] == nil {
+			t.Errorf("expected %s & %s to both be sent, got: %s", d.Field, d.Replacement, data)
+		}
+	}
+}
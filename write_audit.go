@@ -0,0 +1,330 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
+	"github.com/lib/pq"
+)
+
+// EventHashMismatch is published when something read back after a write doesn't
+// hash to what was written, which means the write & read paths disagree
+const EventHashMismatch = "HASH_MISMATCH"
+
+const (
+	// most writes waiting to be verified. writes past this aren't verified
+	writeAuditQueueSize = 1024
+	// once the queue is this full, only a sample of writes are verified
+	writeAuditLoadThreshold = writeAuditQueueSize / 4
+	// metadata blocks read per page when verifying stored metadata
+	writeAuditVerifyPageSize = 500
+)
+
+// writeAuditStats exposes verification counts at /debug/vars
+var writeAuditStats = expvar.NewMap("writeAudit")
+
+// writeAudit is a single write to verify. rehash reads back what was written
+// & hashes it the same way the writer did
+type writeAudit struct {
+	kind   string
+	hash   string
+	rehash func() (string, error)
+}
+
+// HashMismatch describes a write that didn't survive a round trip
+type HashMismatch struct {
+	Kind     string `json:"kind"`
+	Expected string `json:"expected"`
+	Got      string `json:"got"`
+}
+
+// writeAuditor verifies writes in the background so writers aren't slowed down
+type writeAuditor struct {
+	queue chan *writeAudit
+	// fraction of writes verified once the queue passes writeAuditLoadThreshold
+	sampleRate float64
+}
+
+var auditor = newWriteAuditor(writeAuditQueueSize, 1)
+
+func init() {
+	addEventListener(notifyHashMismatch)
+}
+
+// notifyHashMismatch queues a mismatch this instance found for delivery to the
+// alert webhook, if one is configured. only the instance that found it sends
+// it, every instance hears the event
+func notifyHashMismatch(e *Event) {
+	if e.Type != EventHashMismatch || e.Origin != instanceId || cfg == nil || cfg.AlertWebhookUrl == "" || appDB == nil {
+		return
+	}
+	go func() {
+		if err := queueAlert(appDB, cfg.AlertWebhookUrl, e, time.Now()); err != nil {
+			log.Infof("error queueing %s alert: %s", e.Type, err.Error())
+		}
+	}()
+}
+
+// queueAlert enqueues an event for delivery to the alert webhook through the outbox
+func queueAlert(db *sql.DB, url string, e *Event, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return checkWriteErr(err)
+	}
+	defer tx.Rollback()
+	if err := enqueueOutbox(tx, outboxAlert, url, e, now); err != nil {
+		return checkWriteErr(err)
+	}
+	return checkWriteErr(tx.Commit())
+}
+
+func newWriteAuditor(size int, sampleRate float64) *writeAuditor {
+	return &writeAuditor{queue: make(chan *writeAudit, size), sampleRate: sampleRate}
+}
+
+// run verifies queued writes
+func (a *writeAuditor) run() {
+	for w := range a.queue {
+		a.verify(w)
+	}
+}
+
+// audit queues a write for verification, sampling under load & dropping
+// writes the queue has no room for. never blocks
+func (a *writeAuditor) audit(w *writeAudit) {
+	if len(a.queue) >= writeAuditLoadThreshold && rand.Float64() >= a.sampleRate {
+		writeAuditStats.Add("sampledOut", 1)
+		return
+	}
+	select {
+	case a.queue <- w:
+	default:
+		writeAuditStats.Add("dropped", 1)
+	}
+}
+
+// verify re-hashes a write, alerting on mismatch
+func (a *writeAuditor) verify(w *writeAudit) {
+	got, err := w.rehash()
+	if err != nil {
+		writeAuditStats.Add("errors", 1)
+		log.Infof("error verifying %s %s: %s", w.kind, w.hash, err.Error())
+		return
+	}
+	reportAudit(w.kind, w.hash, got)
+}
+
+// reportAudit counts a verified write, alerting if what was read back hashed
+// to something else
+func reportAudit(kind, hash, got string) {
+	writeAuditStats.Add("verified", 1)
+	if got == hash {
+		return
+	}
+
+	writeAuditStats.Add("mismatches", 1)
+	log.Errorf("%s hash mismatch. wrote: %s, read back: %s", kind, hash, got)
+	publishEvent(&Event{
+		Type: EventHashMismatch,
+		Data: &HashMismatch{Kind: kind, Expected: hash, Got: got},
+	})
+}
+
+// auditMetadataWrite verifies a metadata block by reading it's row back &
+// recomputing it's hash
+func auditMetadataWrite(db *sql.DB, m *core.Metadata) {
+	if db == nil {
+		return
+	}
+	auditor.audit(&writeAudit{
+		kind: "metadata",
+		hash: m.Hash,
+		rehash: func() (string, error) {
+			stored, err := scanMetadata(db.QueryRow("select "+metadataCols.String()+" from metadata where hash = $1", m.Hash))
+			if err != nil {
+				return "", err
+			}
+			return metadataHash(stored)
+		},
+	})
+}
+
+// metadataHash recomputes a metadata block's hash from it's contents
+func metadataHash(m *core.Metadata) (string, error) {
+	data, err := m.HashableBytes()
+	if err != nil {
+		return "", err
+	}
+	return core.CalcHash(data)
+}
+
+// MetadataVerification is the result of re-hashing stored metadata
+type MetadataVerification struct {
+	Checked    int             `json:"checked"`
+	Mismatches []*HashMismatch `json:"mismatches"`
+}
+
+// VerifyMetadata re-hashes stored metadata blocks the same way writes are
+// audited, checking all of them or only those about subject & it's hash
+// aliases. suppressed blocks have no content left to hash & anonymized blocks
+// aren't attributed to the key they were hashed with, both are skipped.
+// progress is called with the number of blocks checked after each page
+func VerifyMetadata(db *sql.DB, subject string, progress func(checked int)) (*MetadataVerification, error) {
+	subjects := []string{}
+	if subject != "" {
+		var err error
+		if subjects, err = hashAliases(db, subject); err != nil {
+			return nil, err
+		}
+	}
+
+	v := &MetadataVerification{Mismatches: []*HashMismatch{}}
+	cursor := ""
+	for {
+		rows, err := db.Query("select "+metadataCols.String()+" from metadata where hash > $1 and deleted = false and (cardinality($2::text[]) = 0 or subject = any($2)) order by hash limit $3",
+			cursor, pq.Array(subjects), writeAuditVerifyPageSize)
+		if err != nil {
+			return nil, err
+		}
+		blocks := []*core.Metadata{}
+		for rows.Next() {
+			m, err := scanMetadata(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			blocks = append(blocks, m)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range blocks {
+			cursor = m.Hash
+			if erasedKeyId(m.KeyId) {
+				continue
+			}
+			got, err := metadataHash(m)
+			if err != nil {
+				return nil, err
+			}
+			v.Checked++
+			if got != m.Hash {
+				v.Mismatches = append(v.Mismatches, &HashMismatch{Kind: "metadata", Expected: m.Hash, Got: got})
+			}
+		}
+		if progress != nil {
+			progress(v.Checked)
+		}
+		if len(blocks) < writeAuditVerifyPageSize {
+			return v, nil
+		}
+	}
+}
+
+// auditForensicsWrite verifies a stored forensic record against it's hash
+func auditForensicsWrite(db *sql.DB, hash string) {
+	auditor.audit(&writeAudit{
+		kind: "forensics",
+		hash: hash,
+		rehash: func() (string, error) {
+			var data []byte
+			if err := db.QueryRow("select record from fetch_forensics where hash = $1", hash).Scan(&data); err != nil {
+				return "", err
+			}
+			return hashContentLike(hash, data)
+		},
+	})
+}
+
+// auditCaptureWrite verifies a capture body stored on disk against it's hash.
+// large captures are left to the idle verifier, see idle_verify.go
+func auditCaptureWrite(db *sql.DB, dir, hash string, size int64) {
+	if db != nil && size >= idleVerify.minSize {
+		if err := queueIdleVerification(db, filepath.Join(dir, hash), hash, size, time.Now()); err != nil {
+			log.Infof("error queueing %s for verification: %s", hash, err.Error())
+		}
+		return
+	}
+	auditor.audit(&writeAudit{
+		kind: "capture",
+		hash: hash,
+		rehash: func() (string, error) {
+			f, err := os.Open(filepath.Join(dir, hash))
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+
+			alg, err := hashAlgorithm(hash)
+			if err != nil {
+				return "", err
+			}
+			h, err := newContentHasher(alg)
+			if err != nil {
+				return "", err
+			}
+			if _, err := io.Copy(h, f); err != nil {
+				return "", err
+			}
+			return h.Multihash()
+		},
+	})
+}
+
+// auditCaptureRecord verifies the url record a capture saved by reading it back
+// from the store & fingerprinting it the same way. urls recaptured since are
+// skipped, their record has rightly changed
+func auditCaptureRecord(store datastore.Datastore, u *core.Url) {
+	if store == nil || u.LastGet == nil {
+		return
+	}
+	hash, err := captureRecordHash(u)
+	if err != nil {
+		log.Infof("error fingerprinting capture of %s: %s", u.Url, err.Error())
+		return
+	}
+	captured := u.LastGet.Unix()
+	auditor.audit(&writeAudit{
+		kind: "capture record",
+		hash: hash,
+		rehash: func() (string, error) {
+			stored := &core.Url{Url: u.Url}
+			if err := stored.Read(store); err != nil {
+				return "", err
+			}
+			if stored.LastGet == nil || stored.LastGet.Unix() != captured {
+				return hash, nil
+			}
+			return captureRecordHash(stored)
+		},
+	})
+}
+
+// captureRecordHash fingerprints the fields of a url a capture records
+func captureRecordHash(u *core.Url) (string, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"url":           u.Url,
+		"status":        u.Status,
+		"contentLength": u.ContentLength,
+		"contentType":   u.ContentType,
+		"contentSniff":  u.ContentSniff,
+		"title":         u.Title,
+		"hash":          u.Hash,
+		"headers":       u.Headers,
+	})
+	if err != nil {
+		return "", err
+	}
+	return hashContent(data)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/datatogether/core"
+)
+
+func TestWriteAuditMismatch(t *testing.T) {
+	mismatches := make(chan *HashMismatch, 1)
+	addEventListener(func(e *Event) {
+		if e.Type == EventHashMismatch {
+			mismatches <- e.Data.(*HashMismatch)
+		}
+	})
+
+	// hash a block written in a non-UTC zone, then read it back the way a
+	// timestamp column does: same instant, different zone. the JSON the hash
+	// is calculated from no longer matches
+	m := &core.Metadata{
+		Timestamp: time.Date(2017, 1, 1, 0, 0, 1, 0, time.FixedZone("EST", -5*60*60)),
+		KeyId:     "key",
+		Subject:   "subject",
+		Meta:      map[string]interface{}{"title": "EPA"},
+	}
+	data, _ := m.HashableBytes()
+	m.Hash, _ = core.CalcHash(data)
+
+	before := auditCount("mismatches")
+	a := newWriteAuditor(1, 1)
+	a.verify(&writeAudit{
+		kind: "metadata",
+		hash: m.Hash,
+		rehash: func() (string, error) {
+			stored := *m
+			stored.Timestamp = m.Timestamp.In(time.UTC)
+			data, err := stored.HashableBytes()
+			if err != nil {
+				return "", err
+			}
+			return core.CalcHash(data)
+		},
+	})
+
+	select {
+	case mm := <-mismatches:
+		if mm.Expected != m.Hash || mm.Got == m.Hash {
+			t.Errorf("unexpected mismatch report: %#v", mm)
+		}
+	default:
+		t.Errorf("expected a hash mismatch alert")
+	}
+	if auditCount("mismatches") != before+1 {
+		t.Errorf("expected mismatch metric to increase")
+	}
+
+	// a clean round trip raises nothing
+	a.verify(&writeAudit{kind: "metadata", hash: m.Hash, rehash: func() (string, error) { return m.Hash, nil }})
+	select {
+	case <-mismatches:
+		t.Errorf("expected no alert for a matching hash")
+	default:
+	}
+}
+
+func auditCount(key string) int64 {
+	if v, ok := writeAuditStats.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestWriteAuditorSampling(t *testing.T) {
+	a := newWriteAuditor(writeAuditQueueSize, 0)
+	w := &writeAudit{rehash: func() (string, error) { return "", nil }}
+
+	// under the load threshold every write is queued
+	for i := 0; i < writeAuditLoadThreshold; i++ {
+		a.audit(w)
+	}
+	if len(a.queue) != writeAuditLoadThreshold {
+		t.Errorf("expected %d queued audits, got %d", writeAuditLoadThreshold, len(a.queue))
+	}
+
+	// past it a sample rate of zero queues nothing
+	a.audit(w)
+	if len(a.queue) != writeAuditLoadThreshold {
+		t.Errorf("expected audits past the load threshold to be sampled out")
+	}
+}
+
+func TestCaptureRecordHash(t *testing.T) {
+	captured := &core.Url{
+		Url:           "http://www.epa.gov",
+		Status:        200,
+		ContentLength: 1024,
+		ContentType:   "text/html",
+		Title:         "EPA",
+		Headers:       []string{"Content-Type", "text/html"},
+	}
+	hash, err := captureRecordHash(captured)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		change func(u *core.Url)
+		match  bool
+	}{
+		{func(u *core.Url) {}, true},
+		{func(u *core.Url) { now := time.Now(); u.LastGet = &now }, true},
+		{func(u *core.Url) { u.Status = 500 }, false},
+		{func(u *core.Url) { u.Title = "EPA " }, false},
+		{func(u *core.Url) { u.Headers = []string{"Content-Type", "text/plain"} }, false},
+	}
+	for i, c := range cases {
+		stored := *captured
+		stored.Headers = append([]string{}, captured.Headers...)
+		c.change(&stored)
+		got, err := captureRecordHash(&stored)
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if (got == hash) != c.match {
+			t.Errorf("case %d expected match to be %t", i, c.match)
+		}
+	}
+}